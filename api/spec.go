@@ -0,0 +1,79 @@
+// Package api embeds the OpenAPI description of the public HTTP API, which
+// is maintained next to it in openapi.yaml.
+package api
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed openapi.yaml
+var specYAML []byte
+
+// Spec is the parsed OpenAPI document.
+type Spec struct {
+	// JSON is the document as served at /openapi.json.
+	JSON  []byte
+	paths map[string]map[string]any
+}
+
+// Load parses the embedded document.
+func Load() (*Spec, error) {
+	var doc struct {
+		Paths map[string]map[string]any `yaml:"paths"`
+	}
+	if err := yaml.Unmarshal(specYAML, &doc); err != nil {
+		return nil, fmt.Errorf("openapi.yaml: %w", err)
+	}
+	var full any
+	if err := yaml.Unmarshal(specYAML, &full); err != nil {
+		return nil, fmt.Errorf("openapi.yaml: %w", err)
+	}
+	b, err := json.Marshal(full)
+	if err != nil {
+		return nil, fmt.Errorf("openapi.yaml: %w", err)
+	}
+	return &Spec{JSON: b, paths: doc.Paths}, nil
+}
+
+// Documents reports whether the spec describes method on a chi route pattern.
+func (s *Spec) Documents(method, route string) bool {
+	_, ok := s.paths[route][strings.ToLower(method)]
+	return ok
+}
+
+// Operations lists the operations the spec describes, as "METHOD /route".
+func (s *Spec) Operations() []string {
+	var ops []string
+	for route, item := range s.paths {
+		for method := range item {
+			switch method {
+			case "get", "put", "post", "delete", "options", "head", "patch", "trace":
+				ops = append(ops, strings.ToUpper(method)+" "+route)
+			}
+		}
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+// SwaggerUI is a page rendering /openapi.json with Swagger UI from a CDN.
+const SwaggerUI = `<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>go-ingest-service API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
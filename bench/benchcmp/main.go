@@ -0,0 +1,182 @@
+// Command benchcmp compares two outputs of go test -bench, e.g. of the
+// last release and of the working tree, and exits with status 1 when a
+// benchmark got worse by more than the threshold: slower or allocating
+// more per op, or fewer per second for rates such as MB/s or req/s. With
+// -count above 1 the medians of the runs are compared, so a single noisy
+// run does not fail the gate.
+//
+//	benchcmp [-threshold 10] old.txt new.txt
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// procs is the -GOMAXPROCS suffix go test appends to benchmark names.
+var procs = regexp.MustCompile(`-\d+$`)
+
+// results holds the values of each benchmark by unit, one per run, and
+// the benchmarks and their units in the order go test printed them.
+type results struct {
+	names  []string
+	units  map[string][]string
+	values map[string]map[string][]float64
+}
+
+// parse reads the result lines of go test -bench output, skipping the
+// rest.
+func parse(r io.Reader) (results, error) {
+	res := results{units: map[string][]string{}, values: map[string]map[string][]float64{}}
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) < 4 || len(f)%2 != 0 || !strings.HasPrefix(f[0], "Benchmark") {
+			continue
+		}
+		if _, err := strconv.Atoi(f[1]); err != nil {
+			continue
+		}
+		name := procs.ReplaceAllString(f[0], "")
+		if res.values[name] == nil {
+			res.names = append(res.names, name)
+			res.values[name] = map[string][]float64{}
+		}
+		for i := 2; i < len(f); i += 2 {
+			v, err := strconv.ParseFloat(f[i], 64)
+			if err != nil {
+				return results{}, fmt.Errorf("%s: value %q: %w", name, f[i], err)
+			}
+			unit := f[i+1]
+			if _, ok := res.values[name][unit]; !ok {
+				res.units[name] = append(res.units[name], unit)
+			}
+			res.values[name][unit] = append(res.values[name][unit], v)
+		}
+	}
+	return res, sc.Err()
+}
+
+func median(vs []float64) float64 {
+	s := slices.Sorted(slices.Values(vs))
+	if n := len(s); n%2 == 0 {
+		return (s[n/2-1] + s[n/2]) / 2
+	}
+	return s[len(s)/2]
+}
+
+// change is how one unit of one benchmark moved.
+type change struct {
+	name, unit string
+	old, new   float64
+}
+
+// pct returns the change in percent.
+func (c change) pct() float64 {
+	switch {
+	case c.old == c.new:
+		return 0
+	case c.old == 0:
+		return 100
+	}
+	return (c.new - c.old) / c.old * 100
+}
+
+// worse returns by how many percent c is worse: for rates a drop, for
+// everything else a rise.
+func (c change) worse() float64 {
+	if strings.HasSuffix(c.unit, "/s") {
+		return -c.pct()
+	}
+	return c.pct()
+}
+
+// compare returns the changes of the units both results have, in the order
+// the new benchmarks ran.
+func compare(base, head results) []change {
+	var out []change
+	for _, name := range head.names {
+		for _, unit := range head.units[name] {
+			if prev, ok := base.values[name][unit]; ok {
+				out = append(out, change{name: name, unit: unit, old: median(prev), new: median(head.values[name][unit])})
+			}
+		}
+	}
+	return out
+}
+
+// report prints the changes and returns the exit status: 1 when one is
+// worse by more than threshold percent.
+func report(w io.Writer, cs []change, threshold float64) int {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "benchmark\tunit\told\tnew\tdelta\t")
+	var worse []change
+	for _, c := range cs {
+		mark := ""
+		if c.worse() > threshold {
+			mark = " !"
+			worse = append(worse, c)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%+.1f%%%s\t\n", c.name, c.unit, format(c.old), format(c.new), c.pct(), mark)
+	}
+	_ = tw.Flush()
+	if len(worse) == 0 {
+		return 0
+	}
+	fmt.Fprintf(w, "\n%d results worse by more than %g%%:\n", len(worse), threshold)
+	for _, c := range worse {
+		fmt.Fprintf(w, "  %s %s: %s -> %s\n", c.name, c.unit, format(c.old), format(c.new))
+	}
+	return 1
+}
+
+// format prints v with two decimals below 100, as go test prints small
+// results, and whole above.
+func format(v float64) string {
+	if v >= 100 || v == math.Trunc(v) {
+		return strconv.FormatFloat(v, 'f', 0, 64)
+	}
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+func load(path string) (results, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return results{}, err
+	}
+	defer f.Close()
+	return parse(f)
+}
+
+func main() {
+	threshold := flag.Float64("threshold", 10, "percent a result may get worse")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: benchcmp [-threshold percent] old.txt new.txt")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	base, err := load(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "benchcmp:", err)
+		os.Exit(2)
+	}
+	head, err := load(flag.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "benchcmp:", err)
+		os.Exit(2)
+	}
+	os.Exit(report(os.Stdout, compare(base, head), *threshold))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const base = `goos: linux
+pkg: github.com/rafaelosorio/go-ingest-service/bench
+BenchmarkDecode/event-8   	  500000	      2400 ns/op	  60.00 MB/s	     330 B/op	       3 allocs/op
+BenchmarkDecode/event-8   	  500000	      2300 ns/op	  62.00 MB/s	     330 B/op	       3 allocs/op
+BenchmarkDecode/event-8   	  500000	      9000 ns/op	  16.00 MB/s	     330 B/op	       3 allocs/op
+BenchmarkService/ingest-8 	    2000	    700000 ns/op	      1400 req/s
+BenchmarkGone-8           	    1000	      1000 ns/op
+PASS
+`
+
+// TestCompare compares medians, so one slow run does not count, and flags
+// rates that drop and costs that rise past the threshold.
+func TestCompare(t *testing.T) {
+	old, err := parse(strings.NewReader(base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := parse(strings.NewReader(`BenchmarkDecode/event-4   	  500000	      2450 ns/op	  61.00 MB/s	     330 B/op	       4 allocs/op
+BenchmarkService/ingest-4 	    2000	    720000 ns/op	      1100 req/s
+BenchmarkNew-4            	    1000	      1000 ns/op
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if code := report(&out, compare(old, head), 10); code != 1 {
+		t.Errorf("exit status %d, want 1", code)
+	}
+	got := out.String()
+	for _, want := range []string{
+		"+2.1%",
+		"BenchmarkDecode/event allocs/op: 3 -> 4",
+		"BenchmarkService/ingest req/s: 1400 -> 1100",
+		"2 results worse",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("report lacks %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "BenchmarkNew") || strings.Contains(got, "BenchmarkGone") {
+		t.Errorf("report compares benchmarks missing on one side:\n%s", got)
+	}
+	if code := report(&out, compare(old, old), 10); code != 0 {
+		t.Errorf("unchanged results: exit status %d", code)
+	}
+}
@@ -0,0 +1,53 @@
+package bench
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/codec"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+func body(i int) []byte {
+	e := sample(i)
+	return fmt.Appendf(nil, `{"type":%q,"payload":%s,"tags":["eu"],"correlation_id":"req-%d"}`, e.Type, e.Payload, i)
+}
+
+// BenchmarkDecode decodes request bodies the way the ingest handlers do:
+// one event, and batches as sent to /v1/events/batch.
+func BenchmarkDecode(b *testing.B) {
+	var c codec.JSON
+	b.Run("event", func(b *testing.B) {
+		data := body(1)
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		for b.Loop() {
+			var e event.Event
+			if err := c.Unmarshal(data, &e); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("batch=%d", n), func(b *testing.B) {
+			parts := make([][]byte, n)
+			for i := range parts {
+				parts[i] = body(i)
+			}
+			data := append(append([]byte("["), bytes.Join(parts, []byte(","))...), ']')
+			if !json.Valid(data) {
+				b.Fatal("invalid batch")
+			}
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for b.Loop() {
+				var es []event.Event
+				if err := c.Unmarshal(data, &es); err != nil || len(es) != n {
+					b.Fatalf("decoded %d events: %v", len(es), err)
+				}
+			}
+		})
+	}
+}
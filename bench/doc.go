@@ -0,0 +1,6 @@
+// Package bench benchmarks the ingest hot path: the stores under parallel
+// writers and readers, the JSON decode of request bodies, sink batch
+// flushes, and requests through the service binary. scripts/bench.sh runs
+// it on two revisions and fails when the newer one is slower, so
+// regressions are caught before a release.
+package bench
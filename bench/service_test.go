@@ -0,0 +1,128 @@
+package bench
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// benchKey is the API key of the service the benchmarks run.
+const benchKey = "bench-key"
+
+// serve runs the service binary on SQLite, as deployed, and returns its
+// base URL once it is ready. The handlers are wired in cmd/api, so the
+// benchmarks go through the binary rather than an in-process router.
+func serve(b *testing.B) string {
+	b.Helper()
+	dir := b.TempDir()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	logs, err := os.Create(filepath.Join(dir, "service.log"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer logs.Close()
+	cmd := exec.Command(binary)
+	cmd.Env = append(os.Environ(),
+		"HTTP_ADDR="+addr,
+		"AUTH_ENABLED=true",
+		"API_KEYS=bench:"+benchKey+":ingest+read",
+		"STORAGE_DRIVER=sqlite",
+		"STORAGE_DSN="+filepath.Join(dir, "events.db"),
+		"LOG_LEVEL=warn",
+	)
+	cmd.Stdout, cmd.Stderr = logs, logs
+	if err := cmd.Start(); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		if b.Failed() {
+			if out, err := os.ReadFile(filepath.Join(dir, "service.log")); err == nil {
+				b.Logf("service log:\n%s", out)
+			}
+		}
+	})
+	base := "http://" + addr
+	for deadline := time.Now().Add(15 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if resp, err := http.Get(base + "/readyz"); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return base
+			}
+		}
+	}
+	b.Fatal("service not ready after 15s")
+	return ""
+}
+
+// do sends body with the benchmark key and fails b unless the status is want.
+func do(b *testing.B, client *http.Client, method, url string, body []byte, want int) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		b.Error(err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", benchKey)
+	resp, err := client.Do(req)
+	if err != nil {
+		b.Error(err)
+		return
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != want {
+		b.Errorf("%s %s: status %d, want %d: %s", method, url, resp.StatusCode, want, raw)
+	}
+}
+
+// BenchmarkService measures requests per second through the whole stack:
+// middleware, auth, decoding, validation, storage and encoding, from
+// parallel clients over loopback.
+func BenchmarkService(b *testing.B) {
+	if binary == "" {
+		b.Skip("service not built")
+	}
+	base := serve(b)
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 64}, Timeout: 10 * time.Second}
+	parts := make([][]byte, 10)
+	for i := range parts {
+		parts[i] = body(i)
+	}
+	batch := append(append([]byte("["), bytes.Join(parts, []byte(","))...), ']')
+	for i := range 1000 {
+		do(b, client, "POST", base+"/v1/events", body(i), http.StatusCreated)
+	}
+
+	for _, c := range []struct {
+		name, method, path string
+		body               []byte
+		want               int
+	}{
+		{"ingest", "POST", "/v1/events", body(1), http.StatusCreated},
+		{"ingest-batch=10", "POST", "/v1/events/batch", batch, http.StatusCreated},
+		{"list", "GET", "/v1/events?limit=50", nil, http.StatusOK},
+		{"list-type", "GET", "/v1/events?type=order.paid&limit=50", nil, http.StatusOK},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					do(b, client, c.method, base+c.path, c.body, c.want)
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/sink"
+)
+
+// BenchmarkSinkFlush publishes events to a webhook sink on an httptest
+// server and waits for every batch to be delivered, per event.
+func BenchmarkSinkFlush(b *testing.B) {
+	for _, size := range []int{10, 100, 500} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			var received atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var batch []json.RawMessage
+				if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				received.Add(int64(len(batch)))
+			}))
+			defer srv.Close()
+
+			d, err := sink.NewDispatcher([]config.SinkConfig{{
+				Name:          "bench",
+				Kind:          "webhook",
+				URL:           srv.URL,
+				QueueSize:     b.N,
+				BatchSize:     size,
+				FlushInterval: 10 * time.Millisecond,
+			}}, config.RoutingConfig{}, nil, config.BreakerConfig{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			events := make([]event.Event, min(b.N, 1000))
+			for i := range events {
+				events[i] = sample(i)
+				events[i].ID = int64(i + 1)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := range b.N {
+				d.Publish(events[i%len(events)])
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			d.Close(ctx)
+			b.StopTimer()
+			if n := received.Load(); n != int64(b.N) {
+				b.Fatalf("delivered %d of %d events", n, b.N)
+			}
+		})
+	}
+}
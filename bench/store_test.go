@@ -0,0 +1,117 @@
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+// types spreads the events of a benchmark over a few types, as producers do.
+var types = []string{"order.created", "order.paid", "user.signup", "page.viewed"}
+
+func sample(i int) event.Event {
+	return event.Event{
+		Type:    types[i%len(types)],
+		Payload: json.RawMessage(fmt.Sprintf(`{"order_id":%d,"amount":1299,"currency":"EUR","items":[{"sku":"A-1","qty":2}]}`, i)),
+		Tags:    []string{"eu"},
+	}
+}
+
+// stores opens each driver as deployed: memory, SQLite, and SQLite behind
+// the hot tier.
+var stores = []struct {
+	name string
+	cfg  config.StorageConfig
+}{
+	{"memory", config.StorageConfig{Driver: "memory"}},
+	{"sqlite", config.StorageConfig{Driver: "sqlite"}},
+	{"sqlite+hot", config.StorageConfig{Driver: "sqlite", Hot: config.HotTierConfig{EventsPerType: 1000}}},
+}
+
+func open(b *testing.B, cfg config.StorageConfig) storage.Store {
+	b.Helper()
+	if cfg.Driver == "sqlite" {
+		cfg.DSN = filepath.Join(b.TempDir(), "events.db")
+	}
+	s, err := storage.Open(cfg, config.IDsConfig{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+// BenchmarkStoreAdd stores events from parallel writers.
+func BenchmarkStoreAdd(b *testing.B) {
+	for _, st := range stores {
+		b.Run(st.name, func(b *testing.B) {
+			s := open(b, st.cfg)
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					if _, err := s.Add(context.Background(), sample(i)); err != nil {
+						b.Error(err)
+						return
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkStoreList reads the latest page, of every type and of one, from
+// parallel readers while a writer keeps adding events.
+func BenchmarkStoreList(b *testing.B) {
+	for _, st := range stores {
+		for _, q := range []struct {
+			name  string
+			query storage.Query
+		}{
+			{"latest", storage.Query{Limit: 50}},
+			{"type", storage.Query{Types: []string{"order.paid"}, Limit: 50}},
+		} {
+			b.Run(st.name+"/"+q.name, func(b *testing.B) {
+				s := open(b, st.cfg)
+				for i := range 10_000 {
+					if _, err := s.Add(context.Background(), sample(i)); err != nil {
+						b.Fatal(err)
+					}
+				}
+				done := make(chan struct{})
+				var wg sync.WaitGroup
+				wg.Go(func() {
+					for i := 0; ; i++ {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						_, _ = s.Add(context.Background(), sample(i))
+					}
+				})
+				b.ReportAllocs()
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						if _, err := s.List(context.Background(), q.query); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				})
+				b.StopTimer()
+				close(done)
+				wg.Wait()
+			})
+		}
+	}
+}
@@ -0,0 +1,648 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/acl"
+	"github.com/rafaelosorio/go-ingest-service/internal/audit"
+	"github.com/rafaelosorio/go-ingest-service/internal/auth"
+	"github.com/rafaelosorio/go-ingest-service/internal/codec"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/dedup"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/httpx"
+	"github.com/rafaelosorio/go-ingest-service/internal/ids"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+	"github.com/rafaelosorio/go-ingest-service/internal/upload"
+)
+
+// eventHandlers serve the /v1/events routes. main mounts them behind
+// authentication and the roles of each route; they expect the caller's
+// Principal in the request context.
+type eventHandlers struct {
+	*ingester
+	codecs *codec.Registry
+	json   codec.JSON
+	// saved are the saved queries usable as ?query=<name>.
+	saved   map[string]config.SavedQueryConfig
+	exports config.ExportConfig
+	audits  *audit.Log
+	uploads *upload.Uploads
+}
+
+// create stores an event.
+func (eh *eventHandlers) create(w http.ResponseWriter, r *http.Request) {
+	p, _ := auth.FromContext(r.Context())
+	key := usageKey(p)
+	// the event is copied where it is kept, so it goes back to the pool
+	in := codec.AcquireEvent()
+	defer codec.ReleaseEvent(in)
+	err := decodeBody(r, eh.codecs, in)
+	if httpx.IsTooLarge(err) {
+		eh.meter.Reject(key, "", 1)
+		httpx.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		eh.meter.Reject(key, "", 1)
+		httpx.Malformed(w, "invalid json (need type, payload)")
+		return
+	}
+	size := len(in.Payload)
+	if prob := eh.prepare(r.Context(), w.Header(), p, correlationID(r), client(r), in); prob != nil {
+		if !dryRun(r) {
+			eh.rejected(key, in)
+		}
+		prob.Write(w)
+		return
+	}
+	if dryRun(r) {
+		in.ReceivedAt = time.Now().UTC()
+		respond(w, r, eh.codecs, http.StatusOK, *in)
+		return
+	}
+	if respondAsync(r) {
+		eh.submitAsync(w, key, []event.Event{*in}, []int{size})
+		return
+	}
+	created, err := eh.accept(r.Context(), *in)
+	if err != nil {
+		if unavailable(w, err) {
+			return
+		}
+		log.Error().Err(err).Msg("store event")
+		httpx.Error(w, "storage error", http.StatusInternalServerError)
+		return
+	}
+	eh.accepted(key, &created, size)
+	status, id := http.StatusCreated, created.ID
+	switch {
+	case created.DuplicateOf != 0:
+		status, id = http.StatusOK, created.DuplicateOf
+	case created.SampledOut:
+		respond(w, r, eh.codecs, http.StatusAccepted, created)
+		return
+	}
+	w.Header().Set(consistencyHeader, consistencyToken(id))
+	respond(w, r, eh.codecs, status, created)
+}
+
+// createBatch stores events in bulk; the whole batch is validated before
+// any is stored.
+func (eh *eventHandlers) createBatch(w http.ResponseWriter, r *http.Request) {
+	p, _ := auth.FromContext(r.Context())
+	key := usageKey(p)
+	var in []event.Event
+	err := decodeBody(r, eh.codecs, &in)
+	if httpx.IsTooLarge(err) {
+		eh.meter.Reject(key, "", 1)
+		httpx.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		eh.meter.Reject(key, "", 1)
+		httpx.Malformed(w, "invalid json (need an array of events)")
+		return
+	}
+	if len(in) > maxBatch {
+		eh.meter.Reject(key, "", len(in))
+		httpx.Error(w, fmt.Sprintf("too many events (max %d)", maxBatch), http.StatusRequestEntityTooLarge)
+		return
+	}
+	sizes := make([]int, len(in))
+	for i := range in {
+		sizes[i] = len(in[i].Payload)
+	}
+	// every invalid event is listed, the first one sets the status
+	var invalid *httpx.Problem
+	for i := range in {
+		prob := eh.prepare(r.Context(), w.Header(), p, correlationID(r), client(r), &in[i])
+		if prob == nil {
+			continue
+		}
+		if invalid == nil {
+			invalid = prob
+		}
+		invalid.Details = append(invalid.Details, fmt.Sprintf("event %d: %s", i, prob.Message))
+	}
+	if invalid != nil {
+		// the valid events of the batch are refused with it
+		if !dryRun(r) {
+			for i := range in {
+				eh.rejected(key, &in[i])
+			}
+		}
+		invalid.Message = fmt.Sprintf("%d of %d events rejected, none stored", len(invalid.Details), len(in))
+		invalid.Write(w)
+		return
+	}
+	if dryRun(r) {
+		now := time.Now().UTC()
+		for i := range in {
+			in[i].ReceivedAt = now
+		}
+		respond(w, r, eh.codecs, http.StatusOK, in)
+		return
+	}
+	if respondAsync(r) {
+		eh.submitAsync(w, key, in, sizes)
+		return
+	}
+	out := make([]event.Event, 0, len(in))
+	var last int64
+	for i, e := range in {
+		created, err := eh.accept(r.Context(), e)
+		if err != nil {
+			if unavailable(w, err) {
+				return
+			}
+			log.Error().Err(err).Int("stored", len(out)).Msg("store batch")
+			httpx.Error(w, "storage error", http.StatusInternalServerError)
+			return
+		}
+		eh.accepted(key, &created, sizes[i])
+		out = append(out, created)
+		last = max(last, created.ID, created.DuplicateOf)
+	}
+	w.Header().Set(consistencyHeader, consistencyToken(last))
+	respond(w, r, eh.codecs, http.StatusCreated, out)
+}
+
+// list serves GET /events and GET /events/search, which needs a payload
+// filter and takes a limit; route keys the cached responses.
+func (eh *eventHandlers) list(route string, search bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := listQuery(r, eh.saved, eh.acls)
+		if err != nil {
+			queryError(w, err)
+			return
+		}
+		if search {
+			if len(q.Fields) == 0 && len(q.NotFields) == 0 {
+				httpx.Error(w, "need at least one payload.<field>= or payload.<field>!= filter", http.StatusBadRequest)
+				return
+			}
+			if s := r.URL.Query().Get("limit"); s != "" {
+				if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit <= 0 || q.Limit > maxSearchLimit {
+					httpx.Error(w, fmt.Sprintf("limit must be 1-%d", maxSearchLimit), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		var fields []string
+		if v := r.URL.Query().Get("fields"); v != "" {
+			if fields, err = codec.ParseFields(v); err != nil {
+				httpx.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		c := eh.codecs.Response(r)
+		key := cacheKey(r, q) + " " + c.ContentTypes()[0]
+		body, gen, ok := eh.responses.Get(route, key, q)
+		if ok {
+			writeBody(w, c, http.StatusOK, body)
+			return
+		}
+		list, err := eh.store.List(r.Context(), q)
+		if err != nil {
+			if unavailable(w, err) {
+				return
+			}
+			log.Error().Err(err).Msg("list events")
+			httpx.Error(w, "storage error", http.StatusInternalServerError)
+			return
+		}
+		var out any = list
+		if fields != nil {
+			out = codec.Projection{Events: list, Fields: fields}
+		}
+		body, err = c.Marshal(out)
+		if err != nil {
+			log.Error().Err(err).Msg("encode events")
+			httpx.Error(w, "encoding error", http.StatusInternalServerError)
+			return
+		}
+		eh.responses.Put(key, gen, body)
+		writeBody(w, c, http.StatusOK, body)
+	}
+}
+
+// export streams bulk extracts page by page, up to export.max_rows.
+func (eh *eventHandlers) export(w http.ResponseWriter, r *http.Request) {
+	q, err := listQuery(r, eh.saved, eh.acls)
+	if err != nil {
+		queryError(w, err)
+		return
+	}
+	params := r.URL.Query()
+	if params.Get("order") == "" && params.Get("sort") == "" {
+		q.Ascending = true
+	}
+	if q.OrderBy != "" && q.OrderBy != "id" {
+		httpx.Error(w, "order_by: exports are ordered by id", http.StatusBadRequest)
+		return
+	}
+	limit := eh.exports.MaxRows
+	if v := params.Get("limit"); v != "" {
+		if limit, err = strconv.ParseInt(v, 10, 64); err != nil || limit <= 0 || limit > eh.exports.MaxRows {
+			httpx.Error(w, fmt.Sprintf("limit must be 1-%d", eh.exports.MaxRows), http.StatusBadRequest)
+			return
+		}
+	}
+	x := &exportWriter{w: w, rc: http.NewResponseController(w), format: params.Get("format"), json: eh.json}
+	switch x.format {
+	case "":
+		x.format = "ndjson"
+	case "ndjson", "csv":
+	default:
+		httpx.Error(w, "format: want csv or ndjson", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), eh.exports.MaxDuration)
+	defer cancel()
+	truncated, err := exportEvents(ctx, eh.store, q, limit, x.write, x.flush)
+	if err == nil {
+		err = x.close(truncated)
+	}
+	switch {
+	case err == nil:
+	case !x.started:
+		log.Error().Err(err).Msg("export events")
+		httpx.Error(w, "storage error", http.StatusInternalServerError)
+	default:
+		// the response has started; the client sees a cut-off stream
+		// without the trailer
+		log.Warn().Err(err).Msg("export events aborted")
+	}
+}
+
+// seek returns the first event ID received at or after a time, to
+// position cursors.
+func (eh *eventHandlers) seek(w http.ResponseWriter, r *http.Request) {
+	at, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("at"))
+	if err != nil {
+		httpx.Error(w, "at: want an RFC 3339 timestamp", http.StatusBadRequest)
+		return
+	}
+	q, err := listQuery(r, eh.saved, eh.acls)
+	if err != nil {
+		queryError(w, err)
+		return
+	}
+	q.Since, q.Ascending, q.OrderBy, q.Limit = at, true, "id", 1
+	if err := q.Validate(); err != nil {
+		httpx.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	list, err := eh.store.List(r.Context(), q)
+	if err != nil {
+		if unavailable(w, err) {
+			return
+		}
+		log.Error().Err(err).Msg("seek events")
+		httpx.Error(w, "storage error", http.StatusInternalServerError)
+		return
+	}
+	if len(list) == 0 {
+		httpx.Error(w, "no event at or after "+at.Format(time.RFC3339Nano), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"id": eh.idc.Value(list[0].ID), "received_at": list[0].ReceivedAt})
+}
+
+// lookup returns the event of the ID raw, sent as param, answering 404 for
+// one the caller may not read.
+func (eh *eventHandlers) lookup(w http.ResponseWriter, r *http.Request, param, raw string) (event.Event, bool) {
+	id, err := ids.Parse(raw)
+	if err != nil {
+		httpx.Error(w, param+" must be an event ID", http.StatusBadRequest)
+		return event.Event{}, false
+	}
+	e, err := eh.store.Get(r.Context(), id)
+	p, _ := auth.FromContext(r.Context())
+	if err == nil && (!p.CanAccess(e.Type) || !eh.acls.Allowed(p, acl.Read, e.Type)) {
+		err = storage.ErrNotFound
+	}
+	if err != nil {
+		fail(w, err)
+		return event.Event{}, false
+	}
+	return e, true
+}
+
+// get returns an event with its latest annotation.
+func (eh *eventHandlers) get(w http.ResponseWriter, r *http.Request) {
+	resolve := r.URL.Query().Get("resolve")
+	if resolve != "" && resolve != "payload" && resolve != "url" {
+		httpx.Errorf(http.StatusBadRequest, httpx.CodeValidation, "resolve must be payload or url").Write(w)
+		return
+	}
+	e, ok := eh.lookup(w, r, "id", chi.URLParam(r, "id"))
+	if !ok {
+		return
+	}
+	// the payload of an event finalized from an upload is a reference
+	// to the object, resolved on request to its content or a URL
+	var payloadURL string
+	if eh.uploads != nil {
+		var err error
+		switch resolve {
+		case "payload":
+			var b json.RawMessage
+			if b, ok, err = eh.uploads.Resolve(r.Context(), e.Payload); ok && err == nil {
+				e.Payload = b
+			}
+		case "url":
+			payloadURL, _, err = eh.uploads.URL(e.Payload)
+		}
+		if err != nil {
+			fail(w, err)
+			return
+		}
+	}
+	a, err := latestAnnotation(r.Context(), eh.store, e.ID)
+	if err != nil {
+		log.Error().Err(err).Int64("id", e.ID).Msg("get annotation")
+		httpx.Error(w, "storage error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", annotationETag(a.Version))
+	// the binary formats carry the event alone
+	if _, ok := eh.codecs.Response(r).(codec.JSON); !ok {
+		respond(w, r, eh.codecs, http.StatusOK, e)
+		return
+	}
+	out := struct {
+		ID any `json:"id"`
+		event.Event
+		PayloadURL string `json:"payload_url,omitempty"`
+		Annotation any    `json:"annotation,omitempty"`
+	}{ID: eh.idc.Value(e.ID), Event: e, PayloadURL: payloadURL}
+	if a.Version > 0 {
+		out.Annotation = viewAnnotation(eh.idc, a)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// getMany returns many events by ID in one round trip, for reconcilers
+// holding lists of IDs; events outside the caller's namespaces or ACL are
+// reported missing.
+func (eh *eventHandlers) getMany(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		IDs []ids.Ref `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		httpx.Malformed(w, "invalid json (need ids)")
+		return
+	}
+	want := make([]int64, 0, len(in.IDs))
+	asked := make(map[int64]bool, len(in.IDs))
+	for _, id := range ids.Refs(in.IDs) {
+		if id <= 0 {
+			httpx.Errorf(http.StatusBadRequest, httpx.CodeValidation, "ids must be positive event IDs").Write(w)
+			return
+		}
+		if !asked[id] {
+			asked[id] = true
+			want = append(want, id)
+		}
+	}
+	if len(want) == 0 || len(want) > maxEventLookup {
+		httpx.Errorf(http.StatusBadRequest, httpx.CodeValidation, "ids must list 1 to %d event IDs", maxEventLookup).Write(w)
+		return
+	}
+	found, err := eh.store.GetMany(r.Context(), want)
+	if err != nil {
+		if unavailable(w, err) {
+			return
+		}
+		log.Error().Err(err).Int("ids", len(want)).Msg("get events")
+		httpx.Error(w, "storage error", http.StatusInternalServerError)
+		return
+	}
+	p, _ := auth.FromContext(r.Context())
+	found = slices.DeleteFunc(found, func(e event.Event) bool { return !p.CanAccess(e.Type) || !eh.acls.Allowed(p, acl.Read, e.Type) })
+	for _, e := range found {
+		delete(asked, e.ID)
+	}
+	missing := []int64{}
+	for _, id := range want {
+		if asked[id] {
+			missing = append(missing, id)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"events": eh.json.View(found), "missing": eh.idc.Values(missing)})
+}
+
+// diff explains why two events that look alike were not deduplicated, or
+// came out of the pipeline differently.
+func (eh *eventHandlers) diff(w http.ResponseWriter, r *http.Request) {
+	a, ok := eh.lookup(w, r, "a", r.URL.Query().Get("a"))
+	if !ok {
+		return
+	}
+	b, ok := eh.lookup(w, r, "b", r.URL.Query().Get("b"))
+	if !ok {
+		return
+	}
+	changes, err := event.Diff(a.Payload, b.Payload)
+	if err != nil {
+		log.Error().Err(err).Int64("a", a.ID).Int64("b", b.ID).Msg("diff events")
+		httpx.Error(w, "stored payload is not valid JSON", http.StatusInternalServerError)
+		return
+	}
+	fields := []string{}
+	if a.Type != b.Type {
+		fields = append(fields, "type")
+	}
+	if !slices.Equal(a.Tags, b.Tags) {
+		fields = append(fields, "tags")
+	}
+	if !maps.Equal(a.Metadata, b.Metadata) {
+		fields = append(fields, "metadata")
+	}
+	if a.SchemaVersion != b.SchemaVersion {
+		fields = append(fields, "schema_version")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"a":              eh.idc.Value(a.ID),
+		"b":              eh.idc.Value(b.ID),
+		"equal":          len(changes) == 0,
+		"same_dedup_key": dedup.SameKey(&a, &b),
+		"fields":         fields,
+		"changes":        changes,
+	})
+}
+
+// history lists the annotation versions of an event.
+func (eh *eventHandlers) history(w http.ResponseWriter, r *http.Request) {
+	e, ok := eh.lookup(w, r, "id", chi.URLParam(r, "id"))
+	if !ok {
+		return
+	}
+	list, err := eh.store.Annotations(r.Context(), e.ID)
+	if err != nil {
+		log.Error().Err(err).Int64("id", e.ID).Msg("annotation history")
+		httpx.Error(w, "storage error", http.StatusInternalServerError)
+		return
+	}
+	views := make([]any, len(list))
+	for i, a := range list {
+		views[i] = viewAnnotation(eh.idc, a)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(views)
+}
+
+// annotate changes the status and annotations of an event, a write on its
+// type. Events stay immutable: their status and annotations are versioned
+// beside them, and the version is the ETag If-Match is checked against.
+func (eh *eventHandlers) annotate(w http.ResponseWriter, r *http.Request) {
+	var in annotationPatch
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&in); err != nil {
+		httpx.Malformed(w, "invalid json (need status or annotations)")
+		return
+	}
+	if err := in.validate(); err != nil {
+		httpx.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	e, ok := eh.lookup(w, r, "id", chi.URLParam(r, "id"))
+	if !ok {
+		return
+	}
+	// annotating is a write on the event's type
+	if err := eh.acls.Check(r.Context(), acl.Write, e.Type); err != nil {
+		fail(w, err)
+		return
+	}
+	actor := "anonymous"
+	if p, ok := auth.FromContext(r.Context()); ok {
+		actor = p.Subject
+	}
+	match := strings.TrimSpace(r.Header.Get("If-Match"))
+	// without a version to check, a concurrent change is merged into
+	// by retrying on the newer version
+	for attempt := 0; ; attempt++ {
+		cur, err := latestAnnotation(r.Context(), eh.store, e.ID)
+		if err != nil {
+			log.Error().Err(err).Int64("id", e.ID).Msg("get annotation")
+			httpx.Error(w, "storage error", http.StatusInternalServerError)
+			return
+		}
+		if match != "" && match != "*" && match != annotationETag(cur.Version) {
+			w.Header().Set("ETag", annotationETag(cur.Version))
+			fail(w, fmt.Errorf("event changed since %s: %w", match, storage.ErrVersionMismatch))
+			return
+		}
+		next, err := in.apply(cur)
+		if err != nil {
+			httpx.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		next.Actor = actor
+		saved, err := eh.store.Annotate(r.Context(), next)
+		if errors.Is(err, storage.ErrVersionMismatch) && (match == "" || match == "*") && attempt < 3 {
+			continue
+		}
+		if err != nil {
+			fail(w, err)
+			return
+		}
+		eh.audits.Request(r, "event.annotate", eh.idc.Format(e.ID), map[string]any{"version": saved.Version, "status": saved.Status})
+		w.Header().Set("ETag", annotationETag(saved.Version))
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(viewAnnotation(eh.idc, saved))
+		return
+	}
+}
+
+// trash deletes an event into the trash, where admins can list and restore
+// it until the janitor purges it after storage.trash_retention.
+func (eh *eventHandlers) trash(w http.ResponseWriter, r *http.Request) {
+	e, ok := eh.lookup(w, r, "id", chi.URLParam(r, "id"))
+	if !ok {
+		return
+	}
+	if err := eh.acls.Check(r.Context(), acl.Write, e.Type); err != nil {
+		fail(w, err)
+		return
+	}
+	trashed, err := eh.store.Trash(r.Context(), e.ID)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	eh.responses.Invalidate(&e)
+	eh.audits.Request(r, "event.delete", eh.idc.Format(e.ID), map[string]any{"type": e.Type})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(eh.json.View(trashed))
+}
+
+// listTrash lists the events in the trash.
+func (eh *eventHandlers) listTrash(w http.ResponseWriter, r *http.Request) {
+	q, err := listQuery(r, eh.saved, eh.acls)
+	if err != nil {
+		queryError(w, err)
+		return
+	}
+	q.Trashed = true
+	list, err := eh.store.List(r.Context(), q)
+	if err != nil {
+		if unavailable(w, err) {
+			return
+		}
+		log.Error().Err(err).Msg("list trash")
+		httpx.Error(w, "storage error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(eh.json.View(list))
+}
+
+// restore takes an event out of the trash.
+func (eh *eventHandlers) restore(w http.ResponseWriter, r *http.Request) {
+	id, err := ids.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		httpx.Error(w, "id must be an event ID", http.StatusBadRequest)
+		return
+	}
+	// admins limited to namespaces only restore events in them
+	p, _ := auth.FromContext(r.Context())
+	found, err := eh.store.List(r.Context(), storage.Query{Trashed: true, FromID: id, BeforeID: id + 1})
+	if err == nil && (len(found) == 0 || !p.CanAccess(found[0].Type)) {
+		err = storage.ErrNotFound
+	}
+	if err == nil {
+		err = eh.acls.Check(r.Context(), acl.Write, found[0].Type)
+	}
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	restored, err := eh.store.Restore(r.Context(), id)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	eh.responses.Invalidate(&restored)
+	eh.audits.Request(r, "event.restore", eh.idc.Format(id), map[string]any{"type": restored.Type})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(eh.json.View(restored))
+}
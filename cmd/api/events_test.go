@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/acl"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+// create stores the event body as key, returning its path under /v1.
+func create(t *testing.T, ts *httptest.Server, s *server, key, body string) string {
+	t.Helper()
+	status, out := do(t, ts, http.MethodPost, "/v1/events", key, body)
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(out), &created); status != http.StatusCreated || err != nil || created.ID == 0 {
+		t.Fatalf("create %s: %d %s", body, status, out)
+	}
+	return "/v1/events/" + s.ing.idc.Format(created.ID)
+}
+
+// TestEventRoutes writes, reads, annotates, deletes and restores an event.
+func TestEventRoutes(t *testing.T) {
+	ts, s := newTestServer(t, nil)
+	path := create(t, ts, s, "writer", `{"type":"order.created","payload":{"n":1}}`)
+
+	if status, body := do(t, ts, http.MethodGet, path, "viewer", ""); status != http.StatusOK || !strings.Contains(body, `"order.created"`) {
+		t.Errorf("get: %d %s", status, body)
+	}
+	if status, body := do(t, ts, http.MethodGet, "/v1/events?type=order.created", "viewer", ""); status != http.StatusOK || !strings.Contains(body, `"n":1`) {
+		t.Errorf("list: %d %s", status, body)
+	}
+	if status, body := do(t, ts, http.MethodPatch, path, "writer", `{"status":"done"}`); status != http.StatusOK || !strings.Contains(body, `"done"`) {
+		t.Errorf("annotate: %d %s", status, body)
+	}
+	if status, body := do(t, ts, http.MethodDelete, path, "writer", ""); status != http.StatusOK {
+		t.Errorf("delete: %d %s", status, body)
+	}
+	if status, _ := do(t, ts, http.MethodGet, path, "writer", ""); status != http.StatusNotFound {
+		t.Errorf("get deleted: %d, want 404", status)
+	}
+	if status, body := do(t, ts, http.MethodGet, "/v1/events/trash", "admin", ""); status != http.StatusOK || !strings.Contains(body, `"order.created"`) {
+		t.Errorf("list trash: %d %s", status, body)
+	}
+	// only admins restore
+	if status, _ := do(t, ts, http.MethodPost, path+"/restore", "writer", ""); status != http.StatusForbidden {
+		t.Errorf("restore as writer: %d, want 403", status)
+	}
+	if status, body := do(t, ts, http.MethodPost, path+"/restore", "admin", ""); status != http.StatusOK {
+		t.Errorf("restore: %d %s", status, body)
+	}
+	if status, _ := do(t, ts, http.MethodGet, path, "writer", ""); status != http.StatusOK {
+		t.Errorf("get restored: %d, want 200", status)
+	}
+
+	if status, _ := do(t, ts, http.MethodPost, "/v1/events", "viewer", `{"type":"order.created","payload":{}}`); status != http.StatusForbidden {
+		t.Errorf("create as viewer: %d, want 403", status)
+	}
+	if status, _ := do(t, ts, http.MethodPost, "/v1/events", "", `{"type":"order.created","payload":{}}`); status != http.StatusUnauthorized {
+		t.Errorf("create without a key: %d, want 401", status)
+	}
+	if status, _ := do(t, ts, http.MethodPost, "/v1/events", "writer", `{"payload":{}}`); status != http.StatusBadRequest {
+		t.Errorf("create without type: %d, want 400", status)
+	}
+	// one invalid event refuses the whole batch
+	status, body := do(t, ts, http.MethodPost, "/v1/events/batch", "writer", `[{"type":"order.created","payload":{}},{"payload":{}}]`)
+	if status != http.StatusBadRequest || !strings.Contains(body, `"1 of 2 events rejected, none stored"`) || !strings.Contains(body, "event 1: type is required") {
+		t.Errorf("invalid batch: %d %s", status, body)
+	}
+}
+
+// TestEventRoutesACL refuses writes, annotations, deletes and restores of
+// a type the caller may not write, and hides the events it may not read.
+func TestEventRoutesACL(t *testing.T) {
+	ts, s := newTestServer(t, nil)
+	ctx := context.Background()
+	for _, r := range []storage.ACLRule{
+		{Subject: "reader", Actions: []string{acl.Write}, Types: []string{"billing.*"}, Effect: acl.Deny},
+		{Subject: "outsider", Actions: []string{acl.Read, acl.Write}, Types: []string{"billing.*"}, Effect: acl.Deny},
+		{Subject: "admin", Actions: []string{acl.Write}, Types: []string{"billing.*"}, Effect: acl.Deny},
+	} {
+		if _, err := s.ing.acls.Add(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := create(t, ts, s, "writer", `{"type":"billing.invoice","payload":{}}`)
+
+	for _, tc := range []struct {
+		method, path, key, body string
+		status                  int
+	}{
+		{http.MethodPost, "/v1/events", "reader", `{"type":"billing.invoice","payload":{}}`, http.StatusForbidden},
+		{http.MethodGet, path, "reader", "", http.StatusOK},
+		{http.MethodPatch, path, "reader", `{"status":"void"}`, http.StatusForbidden},
+		{http.MethodDelete, path, "reader", "", http.StatusForbidden},
+		{http.MethodGet, path, "outsider", "", http.StatusNotFound},
+		{http.MethodPatch, path, "outsider", `{"status":"void"}`, http.StatusNotFound},
+		{http.MethodDelete, path, "outsider", "", http.StatusNotFound},
+	} {
+		if status, body := do(t, ts, tc.method, tc.path, tc.key, tc.body); status != tc.status {
+			t.Errorf("%s %s as %s: %d %s, want %d", tc.method, tc.path, tc.key, status, body, tc.status)
+		}
+	}
+	// the refused calls left the event as it was
+	if status, body := do(t, ts, http.MethodGet, path, "writer", ""); status != http.StatusOK || strings.Contains(body, "annotation") {
+		t.Errorf("after refused calls: %d %s", status, body)
+	}
+
+	if status, body := do(t, ts, http.MethodDelete, path, "writer", ""); status != http.StatusOK {
+		t.Fatalf("delete: %d %s", status, body)
+	}
+	// restoring is a write on the type too, for admins as well
+	if status, _ := do(t, ts, http.MethodPost, path+"/restore", "admin", ""); status != http.StatusForbidden {
+		t.Errorf("restore as an admin denied writes: %d, want 403", status)
+	}
+}
+
+// patch annotates the event at path as writer, with If-Match set to match
+// unless it is empty, returning the status, ETag and body.
+func patch(t *testing.T, ts *httptest.Server, path, match, body string) (int, string, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPatch, ts.URL+path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", "writer")
+	if match != "" {
+		req.Header.Set("If-Match", match)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	return res.StatusCode, res.Header.Get("ETag"), string(b)
+}
+
+// TestAnnotateIfMatch applies a change made on the current ETag, refuses
+// one made on a stale ETag, applies an unconditional one on top of the
+// latest version, and keeps every version in the history.
+func TestAnnotateIfMatch(t *testing.T) {
+	ts, s := newTestServer(t, nil)
+	path := create(t, ts, s, "writer", `{"type":"order.created","payload":{}}`)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+	req.Header.Set("X-API-Key", "writer")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if etag := res.Header.Get("ETag"); etag != `"0"` {
+		t.Fatalf("ETag of an event never annotated: %q", etag)
+	}
+
+	status, etag, body := patch(t, ts, path, `"0"`, `{"status":"processing","annotations":{"owner":"ops"}}`)
+	if status != http.StatusOK || etag != `"1"` {
+		t.Fatalf("annotate on the current ETag: %d %q %s", status, etag, body)
+	}
+	status, etag, body = patch(t, ts, path, `"0"`, `{"status":"done"}`)
+	if status != http.StatusPreconditionFailed || etag != `"1"` || !strings.Contains(body, "VERSION_MISMATCH") {
+		t.Errorf("annotate on a stale ETag: %d %q %s", status, etag, body)
+	}
+	status, etag, body = patch(t, ts, path, "", `{"annotations":{"note":"retried"}}`)
+	if status != http.StatusOK || etag != `"2"` || !strings.Contains(body, `"processing"`) || !strings.Contains(body, `"owner":"ops"`) {
+		t.Errorf("annotate without If-Match: %d %q %s", status, etag, body)
+	}
+
+	status, body = do(t, ts, http.MethodGet, path+"/history", "viewer", "")
+	var history []storage.Annotation
+	if err := json.Unmarshal([]byte(body), &history); status != http.StatusOK || err != nil {
+		t.Fatalf("history: %d %s", status, body)
+	}
+	if len(history) != 2 {
+		t.Fatalf("history holds %d versions, want 2: %s", len(history), body)
+	}
+	first, second := history[0], history[1]
+	if first.Version != 1 || first.Status != "processing" || first.Annotations["owner"] != "ops" || first.Actor != "writer" {
+		t.Errorf("version 1: %+v", first)
+	}
+	if second.Version != 2 || second.Status != "processing" || second.Annotations["note"] != "retried" || second.Annotations["owner"] != "ops" {
+		t.Errorf("version 2: %+v", second)
+	}
+}
+
+// TestSeek returns the first event received at or after a time among those
+// matching the filters, 404 past the last one, and 400 for a time that is
+// not RFC 3339.
+func TestSeek(t *testing.T) {
+	ts, s := newTestServer(t, nil)
+	var received []time.Time
+	var ids []string
+	for _, typ := range []string{"order.created", "signup", "order.paid"} {
+		path := create(t, ts, s, "writer", `{"type":"`+typ+`","payload":{}}`)
+		_, body := do(t, ts, http.MethodGet, path, "writer", "")
+		var e struct {
+			ReceivedAt time.Time `json:"received_at"`
+		}
+		if err := json.Unmarshal([]byte(body), &e); err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, e.ReceivedAt)
+		ids = append(ids, strings.TrimPrefix(path, "/v1/events/"))
+		time.Sleep(2 * time.Millisecond)
+	}
+	at := func(t time.Time) string { return url.QueryEscape(t.Format(time.RFC3339Nano)) }
+
+	for _, tc := range []struct {
+		query  string
+		status int
+		id     string
+	}{
+		{"at=" + at(received[0].Add(-time.Hour)), http.StatusOK, ids[0]},
+		{"at=" + at(received[1]), http.StatusOK, ids[1]},
+		{"at=" + at(received[1].Add(time.Nanosecond)), http.StatusOK, ids[2]},
+		{"at=" + at(received[0]) + "&type=order.*", http.StatusOK, ids[0]},
+		{"at=" + at(received[1]) + "&type=order.created", http.StatusNotFound, ""},
+		{"at=" + at(received[2].Add(time.Nanosecond)), http.StatusNotFound, ""},
+		{"", http.StatusBadRequest, ""},
+		{"at=yesterday", http.StatusBadRequest, ""},
+		{"at=" + at(received[0]) + "&query=unknown", http.StatusBadRequest, ""},
+	} {
+		status, body := do(t, ts, http.MethodGet, "/v1/events/seek?"+tc.query, "viewer", "")
+		if status != tc.status {
+			t.Errorf("seek %s: %d %s, want %d", tc.query, status, body, tc.status)
+			continue
+		}
+		if tc.id != "" && !strings.Contains(body, `"id":`+tc.id+`,`) {
+			t.Errorf("seek %s: %s, want event %s", tc.query, body, tc.id)
+		}
+	}
+}
+
+// TestDiffRoute compares two events, and answers 404 when either is
+// missing.
+func TestDiffRoute(t *testing.T) {
+	ts, s := newTestServer(t, nil)
+	a := strings.TrimPrefix(create(t, ts, s, "writer", `{"type":"order.created","payload":{"n":1,"sku":"x"}}`), "/v1/events/")
+	b := strings.TrimPrefix(create(t, ts, s, "writer", `{"type":"order.created","payload":{"sku":"x","n":1}}`), "/v1/events/")
+	c := strings.TrimPrefix(create(t, ts, s, "writer", `{"type":"order.paid","payload":{"n":2}}`), "/v1/events/")
+
+	status, body := do(t, ts, http.MethodGet, "/v1/events/diff?a="+a+"&b="+b, "viewer", "")
+	if status != http.StatusOK || !strings.Contains(body, `"equal":true`) || !strings.Contains(body, `"changes":[]`) || !strings.Contains(body, `"fields":[]`) {
+		t.Errorf("identical: %d %s", status, body)
+	}
+	status, body = do(t, ts, http.MethodGet, "/v1/events/diff?a="+a+"&b="+c, "viewer", "")
+	if status != http.StatusOK || !strings.Contains(body, `"equal":false`) || !strings.Contains(body, `"same_dedup_key":false`) || !strings.Contains(body, `"fields":["type"]`) ||
+		!strings.Contains(body, `{"op":"replace","path":"/n","a":1,"b":2}`) || !strings.Contains(body, `{"op":"remove","path":"/sku","a":"x"}`) {
+		t.Errorf("changed: %d %s", status, body)
+	}
+	for _, q := range []string{"a=" + a + "&b=9999", "a=9999&b=" + b} {
+		if status, body := do(t, ts, http.MethodGet, "/v1/events/diff?"+q, "viewer", ""); status != http.StatusNotFound {
+			t.Errorf("missing event, %s: %d %s, want 404", q, status, body)
+		}
+	}
+	if status, _ := do(t, ts, http.MethodGet, "/v1/events/diff?a="+a, "viewer", ""); status != http.StatusBadRequest {
+		t.Errorf("without b: %d, want 400", status)
+	}
+}
+
+// TestSearch filters on payload fields together with types, answers an
+// empty list when nothing matches, and 400 for a malformed query.
+func TestSearch(t *testing.T) {
+	ts, s := newTestServer(t, nil)
+	for _, body := range []string{
+		`{"type":"order.created","payload":{"user_id":42,"status":"ok"}}`,
+		`{"type":"order.created","payload":{"user_id":42,"status":"failed"}}`,
+		`{"type":"order.paid","payload":{"user_id":42,"status":"failed"}}`,
+		`{"type":"order.created","payload":{"user_id":7,"status":"failed"}}`,
+	} {
+		create(t, ts, s, "writer", body)
+	}
+	for _, tc := range []struct {
+		query string
+		want  int
+	}{
+		{"payload.user_id=42", 3},
+		{"payload.user_id=42&payload.status!=ok", 2},
+		{"payload.user_id=42&payload.status!=ok&type=order.created", 1},
+		{"payload.user_id=42&limit=1", 1},
+		{"payload.user_id=43", 0},
+		{"payload.status=ok&type=order.paid", 0},
+	} {
+		status, body := do(t, ts, http.MethodGet, "/v1/events/search?"+tc.query, "viewer", "")
+		var got []json.RawMessage
+		if err := json.Unmarshal([]byte(body), &got); status != http.StatusOK || err != nil || len(got) != tc.want {
+			t.Errorf("search %s: %d %s, want %d events", tc.query, status, body, tc.want)
+		}
+	}
+	for _, query := range []string{
+		"type=order.created",
+		"payload.user.id=42",
+		"payload.user_id=42&limit=0",
+		"payload.user_id=42&limit=1001",
+		"payload.user_id=42&since=today",
+		"payload.user_id=42&order=up",
+	} {
+		if status, body := do(t, ts, http.MethodGet, "/v1/events/search?"+query, "viewer", ""); status != http.StatusBadRequest {
+			t.Errorf("search %s: %d %s, want 400", query, status, body)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/acl"
+	"github.com/rafaelosorio/go-ingest-service/internal/admission"
+	"github.com/rafaelosorio/go-ingest-service/internal/alert"
+	"github.com/rafaelosorio/go-ingest-service/internal/auth"
+	"github.com/rafaelosorio/go-ingest-service/internal/breaker"
+	"github.com/rafaelosorio/go-ingest-service/internal/cache"
+	"github.com/rafaelosorio/go-ingest-service/internal/dedup"
+	"github.com/rafaelosorio/go-ingest-service/internal/deprecation"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/guardrail"
+	"github.com/rafaelosorio/go-ingest-service/internal/httpx"
+	"github.com/rafaelosorio/go-ingest-service/internal/ids"
+	"github.com/rafaelosorio/go-ingest-service/internal/ingestmetrics"
+	"github.com/rafaelosorio/go-ingest-service/internal/leader"
+	"github.com/rafaelosorio/go-ingest-service/internal/live"
+	"github.com/rafaelosorio/go-ingest-service/internal/pipeline"
+	"github.com/rafaelosorio/go-ingest-service/internal/receipt"
+	"github.com/rafaelosorio/go-ingest-service/internal/sampling"
+	"github.com/rafaelosorio/go-ingest-service/internal/schedule"
+	"github.com/rafaelosorio/go-ingest-service/internal/schema"
+	"github.com/rafaelosorio/go-ingest-service/internal/sink"
+	"github.com/rafaelosorio/go-ingest-service/internal/skew"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+	"github.com/rafaelosorio/go-ingest-service/internal/tenant"
+	"github.com/rafaelosorio/go-ingest-service/internal/usage"
+)
+
+// ingester takes the events of every source, the event routes as well as
+// the log, metric and syslog receivers, uploads and the events the service
+// emits itself: prepare checks an event and runs its pipeline, accept
+// stores it and hands it to the sinks, subscribers and alert rules.
+type ingester struct {
+	store storage.Store
+	idc   ids.Codec
+	// reserved are the type prefixes only the service emits.
+	reserved     []string
+	acls         *acl.List
+	tenants      *tenant.Manager
+	deprecations *deprecation.Policy
+	guard        *guardrail.Guard
+	schemas      *schema.Registry
+	clock        *skew.Checker
+	pipelines    *pipeline.Engine
+	dupes        *dedup.Dedup
+	sampler      *sampling.Sampler
+	admit        *admission.Controller
+	sinks        *sink.Dispatcher
+	hub          *live.Hub
+	alerts       *alert.Engine
+	// responses are the cached list and stats responses a new event drops.
+	responses *cache.Cache
+	// scheduler holds the events with a deliver_at while elector leads.
+	scheduler *schedule.Scheduler
+	elector   *leader.Elector
+	meter     *usage.Meter
+	receipts  *receipt.Tracker
+}
+
+// prepare validates an incoming event and runs its pipeline, returning
+// the HTTP status to answer with on failure. An event without a
+// correlation ID gets correlation, see correlationID; c is the sender
+// the pipeline's enrichment steps describe. The pipeline stops once ctx
+// ends.
+func (ing *ingester) prepare(ctx context.Context, h http.Header, p *auth.Principal, correlation string, c pipeline.Client, in *event.Event) *httpx.Problem {
+	if in.Type == "" {
+		return httpx.Errorf(http.StatusBadRequest, httpx.CodeValidation, "type is required")
+	}
+	for _, id := range []struct{ name, v string }{{"correlation_id", in.CorrelationID}, {"causation_id", in.CausationID}, {"partition_key", in.PartitionKey}} {
+		if len(id.v) > maxEventRefLen || strings.ContainsFunc(id.v, unicode.IsControl) {
+			return httpx.Errorf(http.StatusBadRequest, httpx.CodeValidation, "%s must be at most %d bytes without control characters", id.name, maxEventRefLen)
+		}
+	}
+	if in.CorrelationID == "" {
+		in.CorrelationID = correlation
+	}
+	if !p.CanAccess(in.Type) {
+		return problem(fmt.Errorf("type %q: %w", in.Type, auth.ErrNamespace))
+	}
+	if err := ing.acls.Check(ctx, acl.Write, in.Type); err != nil {
+		return problem(err)
+	}
+	// only the service emits reserved types, whoever the producer is
+	if event.Reserved(ing.reserved, in.Type) {
+		return httpx.Errorf(http.StatusForbidden, codeReservedType, "type %q is reserved for the service", in.Type)
+	}
+	if err := ing.tenants.Admit(in.Type); err != nil {
+		return problem(err)
+	}
+	if err := ing.deprecations.Type(h, p, in.Type); err != nil {
+		return httpx.Errorf(http.StatusGone, httpx.CodeGone, "%v", err)
+	}
+	if err := ing.guard.Check(in); err != nil {
+		return problem(err)
+	}
+	if err := ing.schemas.Apply(ctx, in, time.Now()); err != nil {
+		prob := problem(err)
+		var pe *schema.PayloadError
+		if errors.As(err, &pe) {
+			prob.Details = pe.Problems
+		}
+		return prob
+	}
+	var err error
+	if in.Tags, err = event.NormalizeTags(in.Tags); err != nil {
+		return httpx.Errorf(http.StatusBadRequest, httpx.CodeValidation, "%v", err)
+	}
+	if in.DeliverAt != nil && time.Until(*in.DeliverAt) > maxDeliveryDelay {
+		return httpx.Errorf(http.StatusBadRequest, httpx.CodeValidation, "deliver_at is more than %s ahead", maxDeliveryDelay)
+	}
+	if in.TTLSeconds != 0 {
+		if in.TTLSeconds < 0 || in.TTLSeconds > int64(math.MaxInt64/time.Second) || in.ExpiresAt != nil {
+			return httpx.Errorf(http.StatusBadRequest, httpx.CodeValidation, "ttl_seconds must be positive and not set with expires_at")
+		}
+		at := time.Now().Add(time.Duration(in.TTLSeconds) * time.Second).UTC()
+		in.ExpiresAt, in.TTLSeconds = &at, 0
+	}
+	if in.ExpiresAt != nil && !in.ExpiresAt.After(time.Now()) {
+		return httpx.Errorf(http.StatusBadRequest, httpx.CodeValidation, "expires_at is not in the future")
+	}
+	if err := ing.clock.Check(in); err != nil {
+		return problem(err)
+	}
+	if err := ing.pipelines.Process(ctx, in, c); err != nil {
+		if ctx.Err() != nil {
+			return problem(err)
+		}
+		return httpx.Errorf(http.StatusUnprocessableEntity, codePipelineRejected, "%v", err)
+	}
+	return nil
+}
+
+// accept stores an event prepare let through, unless it is a duplicate or
+// sampled out, which are returned marked as such without being stored.
+func (ing *ingester) accept(ctx context.Context, in event.Event) (event.Event, error) {
+	in.DuplicateOf, in.SampledOut = 0, false
+	if id, dup := ing.dupes.Check(&in); dup {
+		in.DuplicateOf, in.ReceivedAt = id, time.Now().UTC()
+		return in, nil
+	}
+	if in.Type != sampling.SummaryType && !ing.sampler.Keep(&in) {
+		in.SampledOut, in.ReceivedAt = true, time.Now().UTC()
+		return in, nil
+	}
+	start := time.Now()
+	created, err := ing.store.Add(ctx, in, ing.sinks.Targets(&in)...)
+	ing.admit.ObserveWrite(time.Since(start))
+	if err != nil {
+		ingestmetrics.CountCanceled(ctx, "store", err)
+		return created, err
+	}
+	ing.dupes.Record(&created)
+	ing.tenants.Record(created.Type)
+	ing.guard.Record(created.Type)
+	if created.DeliverAt != nil {
+		if ing.elector.Leading() {
+			ing.scheduler.Add(created)
+		}
+	} else {
+		ing.sinks.Publish(created)
+		ing.hub.Publish(created)
+	}
+	ing.alerts.Observe(created)
+	ing.responses.Invalidate(&created)
+	return created, nil
+}
+
+// accepted counts an event of size payload bytes stored for key, rejected
+// one refused.
+func (ing *ingester) accepted(key string, e *event.Event, size int) {
+	ing.meter.Accept(key, ing.tenants.Tenant(e.Type), size)
+}
+
+func (ing *ingester) rejected(key string, e *event.Event) {
+	ing.meter.Reject(key, ing.tenants.Tenant(e.Type), 1)
+}
+
+// submitAsync answers a request preferring respond-async with 202 and a
+// receipt, leaving the events to the tracker's workers.
+func (ing *ingester) submitAsync(w http.ResponseWriter, key string, in []event.Event, sizes []int) {
+	rc, err := ing.receipts.Submit(key, len(in), func() ([]int64, error) {
+		ids := make([]int64, 0, len(in))
+		for i, e := range in {
+			created, err := ing.accept(context.Background(), e)
+			if err != nil {
+				if !errors.Is(err, breaker.ErrOpen) {
+					log.Error().Err(err).Int("stored", len(ids)).Msg("store async events")
+					err = errors.New("storage error")
+				}
+				return ids, err
+			}
+			ing.accepted(key, &created, sizes[i])
+			ids = append(ids, max(created.ID, created.DuplicateOf))
+		}
+		return ids, nil
+	})
+	if err != nil {
+		w.Header().Set("Retry-After", "1")
+		problem(err).Write(w)
+		return
+	}
+	w.Header().Set("Preference-Applied", "respond-async")
+	w.Header().Set("Location", "/v1/receipts/"+rc.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(viewReceipt(ing.idc, rc))
+}
@@ -1,11 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -13,9 +25,87 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+
+	apispec "github.com/rafaelosorio/go-ingest-service/api"
+	"github.com/rafaelosorio/go-ingest-service/internal/accesslog"
+	"github.com/rafaelosorio/go-ingest-service/internal/acl"
+	"github.com/rafaelosorio/go-ingest-service/internal/admission"
+	"github.com/rafaelosorio/go-ingest-service/internal/alert"
+	"github.com/rafaelosorio/go-ingest-service/internal/amqp"
+	"github.com/rafaelosorio/go-ingest-service/internal/audit"
+	"github.com/rafaelosorio/go-ingest-service/internal/auth"
+	"github.com/rafaelosorio/go-ingest-service/internal/breaker"
+	"github.com/rafaelosorio/go-ingest-service/internal/cache"
+	"github.com/rafaelosorio/go-ingest-service/internal/chaos"
+	"github.com/rafaelosorio/go-ingest-service/internal/codec"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/connlimit"
+	"github.com/rafaelosorio/go-ingest-service/internal/consumer"
+	"github.com/rafaelosorio/go-ingest-service/internal/dedup"
+	"github.com/rafaelosorio/go-ingest-service/internal/demo"
+	"github.com/rafaelosorio/go-ingest-service/internal/deprecation"
+	"github.com/rafaelosorio/go-ingest-service/internal/egress"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/expr"
+	"github.com/rafaelosorio/go-ingest-service/internal/filetail"
+	"github.com/rafaelosorio/go-ingest-service/internal/graphql"
+	"github.com/rafaelosorio/go-ingest-service/internal/guardrail"
+	"github.com/rafaelosorio/go-ingest-service/internal/httpx"
+	"github.com/rafaelosorio/go-ingest-service/internal/ids"
+	"github.com/rafaelosorio/go-ingest-service/internal/ingestmetrics"
+	"github.com/rafaelosorio/go-ingest-service/internal/keyring"
+	"github.com/rafaelosorio/go-ingest-service/internal/leader"
+	"github.com/rafaelosorio/go-ingest-service/internal/live"
+	"github.com/rafaelosorio/go-ingest-service/internal/otlp"
+	"github.com/rafaelosorio/go-ingest-service/internal/pipeline"
+	"github.com/rafaelosorio/go-ingest-service/internal/pluginhost"
+	"github.com/rafaelosorio/go-ingest-service/internal/ratelimit"
+	"github.com/rafaelosorio/go-ingest-service/internal/receipt"
+	"github.com/rafaelosorio/go-ingest-service/internal/reload"
+	"github.com/rafaelosorio/go-ingest-service/internal/remotewrite"
+	"github.com/rafaelosorio/go-ingest-service/internal/sampling"
+	"github.com/rafaelosorio/go-ingest-service/internal/schedule"
+	"github.com/rafaelosorio/go-ingest-service/internal/schema"
+	"github.com/rafaelosorio/go-ingest-service/internal/shrink"
+	"github.com/rafaelosorio/go-ingest-service/internal/sink"
+	"github.com/rafaelosorio/go-ingest-service/internal/skew"
+	"github.com/rafaelosorio/go-ingest-service/internal/snapshot"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+	"github.com/rafaelosorio/go-ingest-service/internal/synthetic"
+	"github.com/rafaelosorio/go-ingest-service/internal/syslog"
+	"github.com/rafaelosorio/go-ingest-service/internal/tenant"
+	"github.com/rafaelosorio/go-ingest-service/internal/tlsx"
+	"github.com/rafaelosorio/go-ingest-service/internal/upload"
+	"github.com/rafaelosorio/go-ingest-service/internal/usage"
+)
+
+const (
+	// maxBatch caps the number of events in one POST /events/batch.
+	maxBatch = 1000
+	// maxLogRecords caps the records in one POST /v1/logs export.
+	maxLogRecords = 10_000
+	// maxReceiptLookup caps the IDs in one GET /v1/receipts.
+	maxReceiptLookup = 100
+	// maxEventLookup caps the IDs in one POST /v1/events/get.
+	maxEventLookup = 5000
+	// maxRemoteWriteSamples caps the samples in one POST /api/v1/write.
+	maxRemoteWriteSamples = 10_000
+	// maxBacktestEvents caps the events replayed by one alert backtest.
+	maxBacktestEvents = 100_000
+	// maxDeliveryDelay bounds how far ahead deliver_at may be.
+	maxDeliveryDelay = 30 * 24 * time.Hour
+	// statsStreamChunks is how many partial results a streamed stats
+	// response is split into.
+	statsStreamChunks = 20
+	// maxSearchLimit caps the limit of GET /events/search.
+	maxSearchLimit = 1000
+	// usageFlush is how often usage counts are added to the store.
+	usageFlush = 10 * time.Second
+	// sinkFlushTimeout bounds how long the sinks publish what they still
+	// hold at shutdown before the publishes are canceled.
+	sinkFlushTimeout = 30 * time.Second
 )
 
 var (
@@ -23,73 +113,362 @@ var (
 		prometheus.CounterOpts{Name: "http_requests_total", Help: "Total HTTP requests"},
 		[]string{"route", "method", "code"},
 	)
-	reqDuration = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "http_request_duration_seconds",
-			Help:    "HTTP request latency",
-			Buckets: prometheus.DefBuckets,
-		},
-		[]string{"route", "method"},
-	)
+	// reqDuration is built in main once we know whether native histograms are on.
+	reqDuration *prometheus.HistogramVec
 )
 
+func newDurationHistogram(cfg config.MetricsConfig) *prometheus.HistogramVec {
+	opts := prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency",
+		Buckets: prometheus.DefBuckets,
+	}
+	if cfg.NativeHistograms {
+		opts.NativeHistogramBucketFactor = 1.1
+		opts.NativeHistogramMaxBucketNumber = 160
+		opts.NativeHistogramMinResetDuration = time.Hour
+	}
+	return prometheus.NewHistogramVec(opts, []string{"route", "method"})
+}
+
 func main() {
+	demoMode := flag.Bool("demo", false, "run a throwaway in-memory instance with seeded data and synthetic producers")
+	restoreFrom := flag.String("restore-from", "", "bootstrap an empty SQLite store from a snapshot: a file path or s3://bucket/key")
+	flag.Parse()
+
 	zerolog.TimeFieldFormat = time.RFC3339
 	log.Logger = log.Output(zerolog.NewConsoleWriter())
 
-	addr := getenv("HTTP_ADDR", ":8080")
+	// the demo overrides are applied again on every reload
+	load := config.Load
+	if *demoMode {
+		load = func() (*config.Config, error) {
+			cfg, err := config.Load()
+			if err != nil {
+				return nil, err
+			}
+			demo.Configure(cfg)
+			return cfg, cfg.Validate()
+		}
+	}
+	cfg, err := load()
+	if err != nil {
+		log.Fatal().Err(err).Msg("load config")
+	}
 
-	prometheus.MustRegister(reqsTotal, reqDuration)
+	// on Kubernetes, the downward API names the pod and node of each line
+	// and, optionally, series
+	instance := cfg.Instance.Labels()
+	if len(instance) > 0 {
+		logCtx := log.With()
+		for _, name := range slices.Sorted(maps.Keys(instance)) {
+			logCtx = logCtx.Str(name, instance[name])
+		}
+		log.Logger = logCtx.Logger()
+	}
+	metrics := prometheus.DefaultRegisterer
+	if cfg.Instance.LabelMetrics {
+		metrics = prometheus.WrapRegistererWith(instance, metrics)
+	}
 
-	r := chi.NewRouter()
-	r.Use(middleware.RequestID, middleware.RealIP, middleware.Recoverer, middleware.Timeout(30*time.Second))
-	r.Use(logMiddleware)
+	reqDuration = newDurationHistogram(cfg.Metrics)
+	metrics.MustRegister(reqsTotal, reqDuration)
+	metrics.MustRegister(sink.Collectors()...)
+	metrics.MustRegister(egress.Collectors()...)
+	metrics.MustRegister(ingestmetrics.Collectors()...)
+	metrics.MustRegister(auth.Collectors()...)
+	metrics.MustRegister(pipeline.Collectors()...)
+	metrics.MustRegister(alert.Collectors()...)
+	metrics.MustRegister(cache.Collectors()...)
+	metrics.MustRegister(dedup.Collectors()...)
+	metrics.MustRegister(guardrail.Collectors()...)
+	metrics.MustRegister(consumer.Collectors()...)
+	metrics.MustRegister(deprecation.Collectors()...)
+	metrics.MustRegister(schedule.Collectors()...)
+	metrics.MustRegister(storage.Collectors()...)
+	metrics.MustRegister(audit.Collectors()...)
+	metrics.MustRegister(accesslog.Collectors()...)
+	metrics.MustRegister(httpx.Collectors()...)
+	metrics.MustRegister(reload.Collectors()...)
+	metrics.MustRegister(admission.Collectors()...)
+	metrics.MustRegister(sampling.Collectors()...)
+	metrics.MustRegister(tenant.Collectors()...)
+	metrics.MustRegister(syslog.Collectors()...)
+	metrics.MustRegister(otlp.Collectors()...)
+	metrics.MustRegister(remotewrite.Collectors()...)
+	metrics.MustRegister(graphql.Collectors()...)
+	metrics.MustRegister(live.Collectors()...)
+	metrics.MustRegister(pluginhost.Collectors()...)
+	metrics.MustRegister(usage.Collectors()...)
+	metrics.MustRegister(breaker.Collectors()...)
+	metrics.MustRegister(receipt.Collectors()...)
+	metrics.MustRegister(amqp.Collectors()...)
+	metrics.MustRegister(filetail.Collectors()...)
+	metrics.MustRegister(synthetic.Collectors()...)
+	metrics.MustRegister(skew.Collectors()...)
+	metrics.MustRegister(keyring.Collectors()...)
+	metrics.MustRegister(shrink.Collectors()...)
+	metrics.MustRegister(connlimit.Collectors()...)
+	metrics.MustRegister(upload.Collectors()...)
+	metrics.MustRegister(ratelimit.Collectors()...)
+	metrics.MustRegister(expr.Collectors()...)
+	metrics.MustRegister(chaos.Collectors()...)
+	metrics.MustRegister(leader.Collectors()...)
+	metrics.MustRegister(acl.Collectors()...)
 
-	// health
-	r.Get("/healthz", instrument("/healthz", func(w http.ResponseWriter, _ *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
-	}))
+	s, err := newServer(cfg, load, metrics, *restoreFrom)
+	if err != nil {
+		log.Fatal().Err(err).Msg("start")
+	}
 
-	// metrics
-	r.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{
+		Handler:           s.handler,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+	}
 
-	store := &Store{}
+	// TLS material is reloaded on SIGHUP, with the config, and when the
+	// files change
+	reloadDone := make(chan struct{})
+	defer close(reloadDone)
+	var certs *tlsx.Reloader
+	if cfg.TLS.CertFile != "" {
+		if certs, err = tlsx.New(cfg.TLS); err != nil {
+			log.Fatal().Err(err).Msg("load tls certificates")
+		}
+		srv.TLSConfig = certs.Config()
+		go certs.Watch(10*time.Second, reloadDone)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if gen, err := s.reload(); err != nil {
+				log.Error().Err(err).Int("generation", gen).Msg("config reload rejected")
+			} else {
+				s.audits.System("config.reload", "", map[string]any{"signal": "SIGHUP", "generation": gen})
+			}
+			if certs == nil {
+				continue
+			}
+			if err := certs.Reload(); err != nil {
+				log.Error().Err(err).Msg("tls reload")
+				continue
+			}
+			log.Info().Msg("tls certificates reloaded")
+		}
+	}()
 
-	// create events
-	r.Post("/events", instrument("/events", func(w http.ResponseWriter, r *http.Request) {
-		var in Event
-		if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.Type == "" {
-			http.Error(w, "invalid json (need type, payload)", http.StatusBadRequest)
-			return
+	// http_addr is TCP or a Unix socket; server.unix_socket adds a socket
+	addrs := []string{cfg.HTTPAddr}
+	if cfg.Server.UnixSocket != "" {
+		addrs = append(addrs, httpx.UnixPrefix+cfg.Server.UnixSocket)
+	}
+	// Serve sets up HTTP/2 in TLSConfig, so decide before the first one
+	useTLS := srv.TLSConfig != nil
+	for _, addr := range addrs {
+		ln, err := httpx.Listen(addr, cfg.Server.SocketFileMode())
+		if err != nil {
+			log.Fatal().Err(err).Str("addr", addr).Msg("listen")
 		}
-		created := store.Add(in)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		_ = json.NewEncoder(w).Encode(created)
-	}))
+		log.Info().Str("addr", addr).Msg("listening")
+		ln = s.limits.Listener(ln, useTLS)
+		go func() {
+			var err error
+			if useTLS {
+				// certificates come from TLSConfig
+				err = srv.ServeTLS(ln, "", "")
+			} else {
+				err = srv.Serve(ln)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				panic(err)
+			}
+		}()
+	}
 
-	// list events
-	r.Get("/events", instrument("/events", func(w http.ResponseWriter, r *http.Request) {
-		list := store.List(50)
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(list)
-	}))
+	// syslog messages go through the same checks and pipeline as POST
+	// /v1/events, without a caller to limit their types
+	var syslogs *syslog.Server
+	if cfg.Syslog.UDPAddr != "" || cfg.Syslog.TCPAddr != "" {
+		syslogs, err = syslog.Listen(cfg.Syslog, func(e event.Event) error {
+			if err := s.ing.admit.Admit(); err != nil {
+				return err
+			}
+			size := len(e.Payload)
+			peer, _, _ := net.SplitHostPort(e.Metadata["syslog.peer"])
+			if prob := s.ing.prepare(context.Background(), http.Header{}, nil, "", pipeline.Client{IP: peer}, &e); prob != nil {
+				s.ing.rejected("syslog", &e)
+				return prob
+			}
+			created, err := s.ing.accept(context.Background(), e)
+			if err == nil {
+				s.ing.accepted("syslog", &created, size)
+			}
+			return err
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("syslog listener")
+		}
+	}
 
-	srv := &http.Server{Addr: addr, Handler: r}
+	// so do the messages of the AMQP source queue; those refused are
+	// dead-lettered, those the service cannot take right now requeued
+	var amqpSource *amqp.Source
+	if cfg.AMQPSource.URL != "" {
+		amqpSource = amqp.Start(cfg.AMQPSource, func(e event.Event) error {
+			if err := s.ing.admit.Admit(); err != nil {
+				return err
+			}
+			size := len(e.Payload)
+			if prob := s.ing.prepare(context.Background(), http.Header{}, nil, "", pipeline.Client{}, &e); prob != nil {
+				s.ing.rejected("amqp", &e)
+				return amqp.Reject(prob)
+			}
+			created, err := s.ing.accept(context.Background(), e)
+			if err == nil {
+				s.ing.accepted("amqp", &created, size)
+			}
+			return err
+		})
+	}
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			panic(err)
+	// and the lines of the tailed files; those refused are skipped, those
+	// the service cannot take right now read again
+	var fileSource *filetail.Tailer
+	if len(cfg.FileSource.Paths) > 0 {
+		fileSource, err = filetail.Start(cfg.FileSource, func(e event.Event) error {
+			if err := s.ing.admit.Admit(); err != nil {
+				return err
+			}
+			size := len(e.Payload)
+			if prob := s.ing.prepare(context.Background(), http.Header{}, nil, "", pipeline.Client{}, &e); prob != nil {
+				s.ing.rejected("file", &e)
+				return filetail.Reject(prob)
+			}
+			created, err := s.ing.accept(context.Background(), e)
+			if err == nil {
+				s.ing.accepted("file", &created, size)
+			}
+			return err
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("file source")
 		}
-	}()
+	}
+
+	stopGRPC := func() {}
+	if cfg.Health.GRPCAddr != "" {
+		if stopGRPC, err = s.checker.ServeGRPC(cfg.Health.GRPCAddr); err != nil {
+			log.Fatal().Err(err).Msg("grpc health listener")
+		}
+	}
+	s.checker.SetServing()
+
+	demoCtx, stopDemo := context.WithCancel(context.Background())
+	defer stopDemo()
+	if *demoMode && httpx.IsUnix(cfg.HTTPAddr) {
+		log.Warn().Msg("demo mode: synthetic producers need a TCP http_addr")
+	} else if *demoMode {
+		_, port, _ := net.SplitHostPort(cfg.HTTPAddr)
+		base := "http://localhost:" + port
+		log.Info().Str("docs", base+"/docs").Msg("demo mode: in-memory store, auth off, synthetic producers")
+		go demo.Run(demoCtx, base)
+	}
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-	<-stop
+	sig := <-stop
+	stopDemo()
+	s.audits.System("service.drain", "", map[string]any{"signal": sig.String(), "drain_delay": cfg.Health.DrainDelay.String()})
+
+	// fail readiness first and keep serving while load balancers deregister
+	// us, unless a preStop hook already waited
+	if d := cfg.Health.DrainDelay; d > 0 {
+		log.Info().Dur("delay", d).Msg("draining")
+	}
+	s.checker.Drain(context.Background(), cfg.Health.DrainDelay)
+	stopGRPC()
+	if syslogs != nil {
+		syslogs.Close()
+	}
+	if amqpSource != nil {
+		amqpSource.Close()
+	}
+	if fileSource != nil {
+		fileSource.Close()
+	}
+	s.generators.Close()
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	_ = srv.Shutdown(ctx)
+	s.close()
+
+}
+
+// janitor deletes the events past their expires_at or their trash
+// retention and, with p and a retention, drops the partitions past it, at
+// startup and every minute after, until ctx is done. It also compacts the
+// types of cfg.Compact. It skips the rounds while another instance leads.
+// Dropped partitions reset responses; purges go through its Wrap.
+func janitor(ctx context.Context, store storage.Store, p storage.Partitioner, cfg config.StorageConfig, elector *leader.Elector, responses *cache.Cache) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		if elector.Leading() {
+			clean(ctx, store, p, cfg, responses)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// clean is a round of the janitor.
+func clean(ctx context.Context, store storage.Store, p storage.Partitioner, cfg config.StorageConfig, responses *cache.Cache) {
+	if p != nil && cfg.Retention > 0 {
+		dropped, err := p.DropPartitions(time.Now().Add(-cfg.Retention))
+		if err != nil {
+			log.Error().Err(err).Msg("drop expired partitions")
+		}
+		if len(dropped) > 0 {
+			responses.Reset()
+		}
+		for _, d := range dropped {
+			log.Info().Time("start", d.Start).Time("end", d.End).Int64("events", d.Events).Msg("dropped expired partition")
+		}
+	}
+	if n, err := storage.PurgeExpired(ctx, store); err != nil {
+		log.Error().Err(err).Msg("purge expired events")
+	} else if n > 0 {
+		log.Info().Int64("events", n).Msg("purged expired events")
+	}
+	if n, err := storage.PurgeTrash(ctx, store, time.Now().Add(-cfg.TrashRetention)); err != nil {
+		log.Error().Err(err).Msg("purge trash")
+	} else if n > 0 {
+		log.Info().Int64("events", n).Msg("purged trashed events")
+	}
+	if len(cfg.Compact) > 0 {
+		if n, err := storage.Compact(ctx, store, cfg.Compact); err != nil {
+			log.Error().Err(err).Msg("compact events")
+		} else if n > 0 {
+			log.Info().Int64("events", n).Msg("compacted events")
+		}
+	}
+}
+
+// observe records v, attaching the trace ID as an exemplar when there is one.
+func observe(o prometheus.Observer, v float64, traceID string) {
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && traceID != "" {
+		eo.ObserveWithExemplar(v, prometheus.Labels{"trace_id": traceID})
+		return
+	}
+	o.Observe(v)
 }
 
 func instrument(route string, h http.HandlerFunc) http.HandlerFunc {
@@ -98,7 +477,7 @@ func instrument(route string, h http.HandlerFunc) http.HandlerFunc {
 		sw := &statusWriter{ResponseWriter: w, code: 200}
 		h(sw, r)
 		reqsTotal.WithLabelValues(route, r.Method, http.StatusText(sw.code)).Inc()
-		reqDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		observe(reqDuration.WithLabelValues(route, r.Method), time.Since(start).Seconds(), httpx.TraceID(r))
 	}
 }
 
@@ -112,57 +491,829 @@ func (w *statusWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
-func getenv(k, def string) string {
-	if v := os.Getenv(k); v != "" {
-		return v
+// Unwrap lets http.ResponseController reach the Flusher underneath.
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// usageKey is who ingest by p is accounted to: the API key ID or token
+// subject, "anonymous" without auth.
+func usageKey(p *auth.Principal) string {
+	if p == nil {
+		return "anonymous"
 	}
-	return def
+	return p.Subject
 }
 
-func logMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		next.ServeHTTP(w, r)
-		log.Info().
-			Str("method", r.Method).
-			Str("path", r.URL.Path).
-			Dur("duration", time.Since(start)).
-			Msg("request")
-	})
+// recoveryReport describes the state startup picked up from the store. It
+// is fixed once the service is up.
+type recoveryReport struct {
+	StartedAt time.Time `json:"started_at"`
+	// Duration runs from opening the store to the last restored item.
+	Duration string `json:"duration"`
+	Storage  string `json:"storage"`
+	// ScheduledEvents are events waiting for their deliver_at, rescheduled.
+	ScheduledEvents int `json:"scheduled_events"`
+	// DedupEvents and IdempotencyKeys are 0 unless persisted.
+	DedupEvents     int `json:"dedup_events"`
+	IdempotencyKeys int `json:"idempotency_keys"`
+	Consumers       int `json:"consumers"`
+	Tenants         int `json:"tenants"`
+	// Outbox holds the deliveries per sink that were left over: pending
+	// ones are resumed, dead ones are kept for inspection.
+	Outbox map[string]outboxRecovery `json:"outbox"`
+	// WAL is the SQLite log an unclean shutdown left, nil after a clean one.
+	WAL *storage.WALRecovery `json:"wal,omitempty"`
+	// LastEvent is the newest event stored, the last one kept before the
+	// restart.
+	LastEvent *lastEvent `json:"last_event,omitempty"`
+	// Spill holds the batches the upstream sinks spilled to disk.
+	Spill map[string]sink.Spill `json:"spill,omitempty"`
 }
 
-type Event struct {
-	ID         int64     `json:"id"`
-	Type       string    `json:"type"`
-	Payload    string    `json:"payload"`
+type lastEvent struct {
+	ID         any       `json:"id"`
 	ReceivedAt time.Time `json:"received_at"`
 }
 
-type Store struct {
-	seq    int64
-	events []Event
-	mu     sync.Mutex
+type outboxRecovery struct {
+	Pending int64 `json:"pending"`
+	Dead    int64 `json:"dead"`
+}
+
+// faultView is a chaos fault as GET /admin/chaos/faults lists it, with
+// durations as strings like the config file has them.
+type faultView struct {
+	Target      string   `json:"target"`
+	Ops         []string `json:"ops,omitempty"`
+	Latency     string   `json:"latency,omitempty"`
+	Jitter      string   `json:"jitter,omitempty"`
+	ErrorRate   float64  `json:"error_rate,omitempty"`
+	PartialRate float64  `json:"partial_rate,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+func viewFaults(faults []config.FaultConfig) []faultView {
+	out := make([]faultView, len(faults))
+	for i, f := range faults {
+		out[i] = faultView{Target: f.Target, Ops: f.Ops, ErrorRate: f.ErrorRate, PartialRate: f.PartialRate, Error: f.Error}
+		if f.Latency > 0 {
+			out[i].Latency = f.Latency.String()
+		}
+		if f.Jitter > 0 {
+			out[i].Jitter = f.Jitter.String()
+		}
+	}
+	return out
+}
+
+// maxDeadLetters caps a page of GET /admin/outbox/dead.
+const maxDeadLetters = 1000
+
+// deadLetter is a dead outbox delivery, as listed by GET /admin/outbox/dead.
+type deadLetter struct {
+	Sink string `json:"sink"`
+	// Event is the event.Event, its IDs as the API writes them
+	Event     any    `json:"event"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// viewReceipt returns rc with its event IDs written by idc.
+func viewReceipt(idc ids.Codec, rc storage.Receipt) any {
+	if idc == (ids.Codec{}) {
+		return rc
+	}
+	return struct {
+		storage.Receipt
+		EventIDs []any `json:"event_ids,omitempty"`
+	}{rc, idc.Values(rc.EventIDs)}
+}
+
+// viewAnnotation returns a with its event ID written by idc.
+func viewAnnotation(idc ids.Codec, a storage.Annotation) any {
+	if idc == (ids.Codec{}) {
+		return a
+	}
+	return struct {
+		storage.Annotation
+		EventID any `json:"event_id"`
+	}{a, idc.Value(a.EventID)}
+}
+
+// statsLine is one line of a streamed stats response.
+type statsLine struct {
+	*storage.Stats
+	// Final marks the last line, which covers the whole window.
+	Final bool   `json:"final,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// streamStats writes the stats of q as NDJSON: one line per chunk of
+// buckets, oldest first, flushed as soon as it is computed, then a final
+// line with the whole window as the non-streaming response has it.
+func streamStats(w http.ResponseWriter, r *http.Request, store storage.Store, q storage.Query, bucket time.Duration) {
+	if err := storage.ValidateStats(q, bucket); err != nil {
+		httpx.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	var total *storage.Stats
+	for _, chunk := range storage.StatsChunks(q, bucket, statsStreamChunks) {
+		if r.Context().Err() != nil {
+			return
+		}
+		st, err := store.Stats(r.Context(), chunk, bucket)
+		if err != nil {
+			if unavailable(w, err) {
+				return
+			}
+			log.Error().Err(err).Msg("event stats")
+			_ = enc.Encode(statsLine{Error: "storage error"})
+			return
+		}
+		_ = enc.Encode(statsLine{Stats: st})
+		_ = rc.Flush()
+		if total == nil {
+			total = st
+		} else {
+			total.Merge(st)
+		}
+	}
+	_ = enc.Encode(statsLine{Stats: total, Final: true})
+}
+
+// exportPage is how many events exportEvents reads at a time.
+const exportPage = 1000
+
+// exportEvents calls write with the events matching q, paging through the
+// store by ID (oldest first with q.Ascending, newest first otherwise) and
+// flushing after every page. It stops after limit events (0: no cap) and
+// reports whether matching events were left out.
+func exportEvents(ctx context.Context, store storage.Store, q storage.Query, limit int64, write func(*event.Event) error, flush func() error) (bool, error) {
+	q.Limit = exportPage
+	if q.Ascending {
+		q.FromID = max(q.FromID, 1)
+	}
+	var n int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		page, err := store.List(ctx, q)
+		if err != nil {
+			return false, err
+		}
+		for i := range page {
+			if limit > 0 && n == limit {
+				return true, flush()
+			}
+			if err := write(&page[i]); err != nil {
+				return false, err
+			}
+			n++
+		}
+		if err := flush(); err != nil {
+			return false, err
+		}
+		if len(page) < exportPage {
+			return false, nil
+		}
+		if last := page[len(page)-1].ID; q.Ascending {
+			q.FromID = last + 1
+		} else {
+			q.BeforeID = last
+		}
+	}
+}
+
+// exportTrailer is set to true when an export stopped at its row cap.
+const exportTrailer = "Export-Truncated"
+
+// exportWriter encodes exported events as NDJSON or CSV; the compress
+// middleware of the stream group encodes them for the wire. Headers are sent
+// with the first event, so a failure before it can still be answered with an
+// error status.
+type exportWriter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	format  string
+	json    codec.JSON
+	started bool
+
+	enc *json.Encoder
+	csv *csv.Writer
+}
+
+var exportColumns = []string{"id", "type", "received_at", "deliver_at", "tags", "metadata", "payload", "correlation_id", "causation_id", "partition_key", "occurred_at"}
+
+func (x *exportWriter) start() error {
+	if x.started {
+		return nil
+	}
+	x.started = true
+	h := x.w.Header()
+	h.Set("Trailer", exportTrailer)
+	if x.format == "csv" {
+		h.Set("Content-Type", "text/csv; charset=utf-8")
+		x.csv = csv.NewWriter(x.w)
+		return x.csv.Write(exportColumns)
+	}
+	h.Set("Content-Type", "application/x-ndjson")
+	x.enc = json.NewEncoder(x.w)
+	return nil
+}
+
+func (x *exportWriter) write(e *event.Event) error {
+	if err := x.start(); err != nil {
+		return err
+	}
+	if x.csv == nil {
+		return x.enc.Encode(x.json.View(e))
+	}
+	var deliverAt, occurredAt, metadata string
+	if e.DeliverAt != nil {
+		deliverAt = e.DeliverAt.Format(time.RFC3339Nano)
+	}
+	if e.OccurredAt != nil {
+		occurredAt = e.OccurredAt.Format(time.RFC3339Nano)
+	}
+	if len(e.Metadata) > 0 {
+		b, err := json.Marshal(e.Metadata)
+		if err != nil {
+			return err
+		}
+		metadata = string(b)
+	}
+	return x.csv.Write([]string{
+		x.json.IDs.Format(e.ID), e.Type, e.ReceivedAt.Format(time.RFC3339Nano), deliverAt,
+		strings.Join(e.Tags, ","), metadata, string(e.Payload), e.CorrelationID, e.CausationID, e.PartitionKey, occurredAt,
+	})
+}
+
+func (x *exportWriter) flush() error {
+	if !x.started {
+		return nil
+	}
+	if x.csv != nil {
+		x.csv.Flush()
+		if err := x.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return x.rc.Flush()
+}
+
+// close ends the stream, marking it truncated in the trailer.
+func (x *exportWriter) close(truncated bool) error {
+	if err := x.start(); err != nil {
+		return err
+	}
+	if err := x.flush(); err != nil {
+		return err
+	}
+	x.w.Header().Set(exportTrailer, strconv.FormatBool(truncated))
+	return nil
+}
+
+// listQuery builds the store query for GET /events. query=<name> starts from
+// a saved query; tag=, payload.<field>= and payload.<field>!= add to it,
+// type= replaces its types and since= and until= (RFC 3339) its time
+// bounds, and correlation_id= and causation_id= match event references.
+// order=asc|desc and order_by=id|received_at|occurred_at sort the result,
+// as does their shorthand sort=[-]id|received_at|occurred_at.
+func listQuery(r *http.Request, saved map[string]config.SavedQueryConfig, acls *acl.List) (storage.Query, error) {
+	params := r.URL.Query()
+	var q storage.Query
+	if name := params.Get("query"); name != "" {
+		c, ok := saved[name]
+		if !ok {
+			return q, fmt.Errorf("unknown saved query %q", name)
+		}
+		q = storage.SavedQuery(c, time.Now())
+	}
+	q.Limit = 50
+	var err error
+	if types := params["type"]; len(types) > 0 {
+		q.Types = types
+	}
+	q.Tags = append(slices.Clone(q.Tags), params["tag"]...)
+	q.CorrelationID, q.CausationID = params.Get("correlation_id"), params.Get("causation_id")
+	for k, v := range params {
+		name, ok := strings.CutPrefix(k, "payload.")
+		if !ok {
+			continue
+		}
+		// payload.status!=ok arrives as the key "payload.status!"
+		if name, ok := strings.CutSuffix(name, "!"); ok {
+			if q.NotFields == nil {
+				q.NotFields = map[string]string{}
+			}
+			q.NotFields[name] = v[0]
+			continue
+		}
+		q.Fields = maps.Clone(q.Fields)
+		if q.Fields == nil {
+			q.Fields = map[string]string{}
+		}
+		q.Fields[name] = v[0]
+	}
+	for _, b := range []struct {
+		param string
+		dst   *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if v := params.Get(b.param); v != "" {
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return q, fmt.Errorf("%s: want an RFC 3339 timestamp", b.param)
+			}
+			*b.dst = t
+		}
+	}
+	switch params.Get("order") {
+	case "", "desc":
+	case "asc":
+		q.Ascending = true
+	default:
+		return q, fmt.Errorf("order: want asc or desc")
+	}
+	q.OrderBy = params.Get("order_by")
+	// sort=received_at is order=asc&order_by=received_at, sort=-received_at
+	// the same newest first
+	if v := params.Get("sort"); v != "" {
+		if params.Has("order") || params.Has("order_by") {
+			return q, fmt.Errorf("sort: not with order or order_by")
+		}
+		key, desc := strings.CutPrefix(v, "-")
+		if key != "id" && key != "received_at" && key != "occurred_at" {
+			return q, fmt.Errorf("sort: want id, received_at or occurred_at, optionally prefixed with -")
+		}
+		q.OrderBy, q.Ascending = key, !desc
+	}
+	if v := params.Get("min_token"); v != "" {
+		if q.MinID, err = parseConsistencyToken(v); err != nil {
+			return q, err
+		}
+	}
+	// callers only see the types their ACL lets them read, in their
+	// namespaces' subtrees when limited to some
+	if err := acls.Scope(r.Context(), &q); err != nil {
+		return q, err
+	}
+	p, _ := auth.FromContext(r.Context())
+	if q.Types, err = p.ScopeTypes(q.Types); err != nil {
+		return q, err
+	}
+	return q, q.Validate()
+}
+
+// maxEventRefLen caps the correlation and causation IDs of an event.
+const maxEventRefLen = 128
+
+// correlationID is the correlation ID given to the events of r that have
+// none: the trace ID of its traceparent, so events join the trace that
+// produced them, or else its request ID (X-Request-Id or generated).
+func correlationID(r *http.Request) string {
+	if id := httpx.TraceID(r); id != "" {
+		return id
+	}
+	return middleware.GetReqID(r.Context())
+}
+
+// client is the sender of r for enrichment; RealIP has already replaced
+// the address with that of the proxy headers.
+func client(r *http.Request) pipeline.Client {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return pipeline.Client{IP: ip, UserAgent: r.UserAgent()}
+}
+
+// consistencyHeader carries the token of a write, which reads take as
+// ?min_token= to reflect it even when served by a replica.
+const consistencyHeader = "Consistency-Token"
+
+// consistencyToken is opaque to clients; it holds the ID of the newest event
+// written.
+func consistencyToken(id int64) string {
+	return "v1." + strconv.FormatInt(id, 36)
+}
+
+func parseConsistencyToken(s string) (int64, error) {
+	v, ok := strings.CutPrefix(s, "v1.")
+	id, err := strconv.ParseInt(v, 36, 64)
+	if !ok || err != nil || id < 0 {
+		return 0, fmt.Errorf("min_token: invalid consistency token %q", s)
+	}
+	return id, nil
+}
+
+// queryError answers a query that failed to parse or is out of the caller's
+// namespaces or ACL.
+func queryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, auth.ErrNamespace) || errors.Is(err, acl.ErrDenied) {
+		fail(w, err)
+		return
+	}
+	httpx.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// consumerScope checks that the caller's namespaces and ACL cover every
+// type the consumer reads; a consumer of all types needs an unrestricted
+// caller.
+func consumerScope(r *http.Request, consumers *consumer.Manager, acls *acl.List, name string) error {
+	c, err := consumers.Get(name)
+	if err != nil {
+		return err
+	}
+	q := storage.Query{Types: c.Types}
+	if err := acls.Scope(r.Context(), &q); err != nil {
+		return err
+	}
+	if len(q.Types) != len(c.Types) || len(q.NotTypes) > 0 {
+		return fmt.Errorf("consumer %s reads types the caller may not: %w", name, acl.ErrDenied)
+	}
+	p, _ := auth.FromContext(r.Context())
+	if p == nil || len(p.Namespaces) == 0 {
+		return nil
+	}
+	if len(c.Types) == 0 {
+		return fmt.Errorf("consumer %s reads every type: %w", name, auth.ErrNamespace)
+	}
+	_, err = p.ScopeTypes(c.Types)
+	return err
+}
+
+// Limits on an event's annotation.
+const (
+	maxAnnotationKeys  = 64
+	maxAnnotationKey   = 128
+	maxAnnotationValue = 1024
+	maxStatus          = 64
+)
+
+// annotationPatch is a JSON merge patch of an event's annotation: a null
+// annotation value removes the key, an empty status clears it.
+type annotationPatch struct {
+	Status      *string            `json:"status"`
+	Annotations map[string]*string `json:"annotations"`
 }
 
-func (s *Store) Add(e Event) Event {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.seq++
-	e.ID = s.seq
-	e.ReceivedAt = time.Now().UTC()
-	s.events = append(s.events, e)
-	return e
+func (in annotationPatch) validate() error {
+	if in.Status == nil && len(in.Annotations) == 0 {
+		return errors.New("need status or annotations")
+	}
+	if in.Status != nil && len(*in.Status) > maxStatus {
+		return fmt.Errorf("status longer than %d bytes", maxStatus)
+	}
+	for k, v := range in.Annotations {
+		if k == "" || len(k) > maxAnnotationKey {
+			return fmt.Errorf("annotation keys must be 1-%d bytes", maxAnnotationKey)
+		}
+		if v != nil && len(*v) > maxAnnotationValue {
+			return fmt.Errorf("annotation %q longer than %d bytes", k, maxAnnotationValue)
+		}
+	}
+	return nil
 }
 
-func (s *Store) List(limit int) []Event {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if limit <= 0 || limit > len(s.events) {
-		limit = len(s.events)
+// apply returns the next version of cur with the patch merged in.
+func (in annotationPatch) apply(cur storage.Annotation) (storage.Annotation, error) {
+	next := storage.Annotation{EventID: cur.EventID, Version: cur.Version + 1, Status: cur.Status, Annotations: maps.Clone(cur.Annotations)}
+	if in.Status != nil {
+		next.Status = *in.Status
+	}
+	for k, v := range in.Annotations {
+		if v == nil {
+			delete(next.Annotations, k)
+			continue
+		}
+		if next.Annotations == nil {
+			next.Annotations = map[string]string{}
+		}
+		next.Annotations[k] = *v
+	}
+	if len(next.Annotations) > maxAnnotationKeys {
+		return storage.Annotation{}, fmt.Errorf("more than %d annotations", maxAnnotationKeys)
 	}
-	out := make([]Event, 0, limit)
-	for i := len(s.events) - 1; i >= 0 && len(out) < limit; i-- {
-		out = append(out, s.events[i])
+	return next, nil
+}
+
+// latestAnnotation returns the current annotation of event id, version 0
+// when it has none.
+func latestAnnotation(ctx context.Context, store storage.Store, id int64) (storage.Annotation, error) {
+	list, err := store.Annotations(ctx, id)
+	if err != nil || len(list) == 0 {
+		return storage.Annotation{EventID: id}, err
+	}
+	return list[len(list)-1], nil
+}
+
+func annotationETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// Error codes of domain errors, beside the generic ones of httpx.
+const (
+	codeNamespace        = "NAMESPACE_FORBIDDEN"
+	codeTypeForbidden    = "TYPE_FORBIDDEN"
+	codeACLRuleNotFound  = "ACL_RULE_NOT_FOUND"
+	codeReservedType     = "RESERVED_TYPE"
+	codeEventNotFound    = "EVENT_NOT_FOUND"
+	codeVersionMismatch  = "VERSION_MISMATCH"
+	codeConsumerNotFound = "CONSUMER_NOT_FOUND"
+	codeConsumerExists   = "CONSUMER_EXISTS"
+	codeLeaseFenced      = "LEASE_FENCED"
+	codeTenantNotFound   = "TENANT_NOT_FOUND"
+	codeTenantExists     = "TENANT_EXISTS"
+	codeTenantLimit      = "TENANT_LIMIT_REACHED"
+	codeNoTenant         = "NO_TENANT"
+	codeQuotaExceeded    = "QUOTA_EXCEEDED"
+	codePipelineRejected = "PIPELINE_REJECTED"
+	codeSchemaVersion    = "SCHEMA_VERSION_REJECTED"
+	codeSchemaViolation  = "SCHEMA_VIOLATION"
+	codeSchemaUpgrade    = "SCHEMA_UPGRADE_FAILED"
+	codeReceiptNotFound  = "RECEIPT_NOT_FOUND"
+	codeNoEncryption     = "ENCRYPTION_NOT_CONFIGURED"
+	codeTooManyFields    = "TOO_MANY_FIELDS"
+	codeKeyTooLong       = "FIELD_NAME_TOO_LONG"
+	codeTypeLimit        = "TYPE_LIMIT_REACHED"
+	codeJobNotFound      = "JOB_NOT_FOUND"
+	codeClockSkew        = "OCCURRED_AT_OUT_OF_RANGE"
+	codeTimeout          = "TIMEOUT"
+	codeClientClosed     = "CLIENT_CLOSED_REQUEST"
+	codeUploadNotFound   = "UPLOAD_NOT_FOUND"
+	codeUploadExpired    = "UPLOAD_EXPIRED"
+	codeUploadIncomplete = "UPLOAD_INCOMPLETE"
+	codeUploadChanged    = "UPLOAD_CHANGED"
+)
+
+// statusClientClosed is nginx's status for a request whose client went away
+// before the answer, which only the access log sees.
+const statusClientClosed = 499
+
+// problems maps the errors of the domain packages to their responses. The
+// first entry err matches wins.
+var problems = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{auth.ErrNamespace, http.StatusForbidden, codeNamespace},
+	{acl.ErrDenied, http.StatusForbidden, codeTypeForbidden},
+	{acl.ErrNotFound, http.StatusNotFound, codeACLRuleNotFound},
+	{acl.ErrInvalid, http.StatusBadRequest, httpx.CodeValidation},
+	{storage.ErrNotFound, http.StatusNotFound, codeEventNotFound},
+	{storage.ErrVersionMismatch, http.StatusPreconditionFailed, codeVersionMismatch},
+	{consumer.ErrNotFound, http.StatusNotFound, codeConsumerNotFound},
+	{consumer.ErrExists, http.StatusConflict, codeConsumerExists},
+	{consumer.ErrFenced, http.StatusConflict, codeLeaseFenced},
+	{consumer.ErrInvalid, http.StatusBadRequest, httpx.CodeValidation},
+	{tenant.ErrNotFound, http.StatusNotFound, codeTenantNotFound},
+	{tenant.ErrExists, http.StatusConflict, codeTenantExists},
+	{tenant.ErrInvalid, http.StatusBadRequest, httpx.CodeValidation},
+	{tenant.ErrLimit, http.StatusForbidden, codeTenantLimit},
+	{tenant.ErrNoTenant, http.StatusForbidden, codeNoTenant},
+	{tenant.ErrQuota, http.StatusTooManyRequests, codeQuotaExceeded},
+	{guardrail.ErrPayloadTooLarge, http.StatusRequestEntityTooLarge, httpx.CodeTooLarge},
+	{guardrail.ErrTooManyFields, http.StatusUnprocessableEntity, codeTooManyFields},
+	{guardrail.ErrKeyTooLong, http.StatusUnprocessableEntity, codeKeyTooLong},
+	{guardrail.ErrTooManyTypes, http.StatusUnprocessableEntity, codeTypeLimit},
+	{schema.ErrVersionRejected, http.StatusUnprocessableEntity, codeSchemaVersion},
+	{schema.ErrInvalidPayload, http.StatusUnprocessableEntity, codeSchemaViolation},
+	{schema.ErrUpgrade, http.StatusUnprocessableEntity, codeSchemaUpgrade},
+	{breaker.ErrOpen, http.StatusServiceUnavailable, httpx.CodeUnavailable},
+	{context.DeadlineExceeded, http.StatusGatewayTimeout, codeTimeout},
+	{context.Canceled, statusClientClosed, codeClientClosed},
+	{snapshot.ErrInvalid, http.StatusBadRequest, httpx.CodeValidation},
+	{receipt.ErrQueueFull, http.StatusServiceUnavailable, httpx.CodeUnavailable},
+	{keyring.ErrInvalid, http.StatusBadRequest, httpx.CodeValidation},
+	{keyring.ErrNoMasterKey, http.StatusConflict, codeNoEncryption},
+	{keyring.ErrNoKMS, http.StatusConflict, codeNoEncryption},
+	{keyring.ErrUnavailable, http.StatusServiceUnavailable, httpx.CodeUnavailable},
+	{skew.ErrOutOfRange, http.StatusUnprocessableEntity, codeClockSkew},
+	{synthetic.ErrNotFound, http.StatusNotFound, codeJobNotFound},
+	{synthetic.ErrBusy, http.StatusTooManyRequests, httpx.CodeRateLimited},
+	{upload.ErrNotFound, http.StatusNotFound, codeUploadNotFound},
+	{upload.ErrExpired, http.StatusGone, codeUploadExpired},
+	{upload.ErrIncomplete, http.StatusConflict, codeUploadIncomplete},
+	{upload.ErrInvalid, http.StatusUnprocessableEntity, httpx.CodeValidation},
+	{upload.ErrTooLarge, http.StatusRequestEntityTooLarge, httpx.CodeTooLarge},
+	{upload.ErrInFlight, http.StatusConflict, httpx.CodeConflict},
+	{upload.ErrChanged, http.StatusConflict, codeUploadChanged},
+}
+
+// problem maps err to its response, see problems. Anything unknown is an
+// internal error: it is logged and its message withheld from the client.
+func problem(err error) *httpx.Problem {
+	var p *httpx.Problem
+	if errors.As(err, &p) {
+		return p
+	}
+	for _, m := range problems {
+		if errors.Is(err, m.err) {
+			return &httpx.Problem{Status: m.status, Code: m.code, Message: err.Error()}
+		}
+	}
+	log.Error().Err(err).Msg("request failed")
+	return httpx.Errorf(http.StatusInternalServerError, httpx.CodeInternal, "storage error")
+}
+
+// fail answers with the problem err maps to.
+func fail(w http.ResponseWriter, err error) {
+	if unavailable(w, err) {
+		return
+	}
+	problem(err).Write(w)
+}
+
+// unavailable answers 503 with Retry-After when err comes from an open
+// circuit breaker, and 504 or 499 when it is the request's context ending,
+// none of which is worth a log line per request, and reports whether it
+// did.
+func unavailable(w http.ResponseWriter, err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		problem(err).Write(w)
+		return true
+	}
+	var open *breaker.OpenError
+	if !errors.As(err, &open) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(open.RetryAfter.Seconds()))))
+	problem(err).Write(w)
+	return true
+}
+
+// dryRun reports whether r asks for its events to be checked and run
+// through their pipelines, and answered as they would be stored, without
+// storing them: ?dry_run=true.
+func dryRun(r *http.Request) bool {
+	return r.URL.Query().Get("dry_run") == "true"
+}
+
+// respondAsync reports whether r asks to be answered before its events are
+// stored, with "Prefer: respond-async" (RFC 7240).
+func respondAsync(r *http.Request) bool {
+	for _, v := range r.Header.Values("Prefer") {
+		for pref := range strings.SplitSeq(v, ",") {
+			name, _, _ := strings.Cut(pref, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseTenantBody decodes a self-service request body, YAML or JSON with the
+// field names of the config file, into v. It answers 400 and returns false
+// when that fails.
+func parseTenantBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		httpx.Malformed(w, "read body")
+		return false
+	}
+	if err := config.Parse(raw, v); err != nil {
+		httpx.Malformed(w, "invalid body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// legacyPaths routes the unversioned paths under prefixes, which predate API
+// versioning, to the same handlers as /<version>. Their URL is left alone so
+// logs and deprecations.routes see what the caller sent.
+func legacyPaths(version string, prefixes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, p := range prefixes {
+				if r.URL.Path == p || strings.HasPrefix(r.URL.Path, p+"/") {
+					successor := "/" + version + r.URL.Path
+					chi.RouteContext(r.Context()).RoutePath = successor
+					w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
+					break
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// undocumented reports routes deliberately left out of the OpenAPI spec:
+// operator endpoints, the admin UI, the docs themselves, and the gRPC-Web
+// routes of the services api/*.proto describes, named /<package>.<Service>/.
+func undocumented(route string) bool {
+	for _, p := range []string{"/admin/", "/debug/", "/metrics", "/openapi.json", "/docs", "/ui"} {
+		if strings.HasPrefix(route, p) {
+			return true
+		}
+	}
+	service, _, _ := strings.Cut(strings.TrimPrefix(route, "/"), "/")
+	return strings.Contains(service, ".")
+}
+
+// missingFromSpec lists the routes of r, as "METHOD /pattern", that the
+// spec does not describe and are not undocumented on purpose. The preStop
+// hook is for the kubelet only.
+func missingFromSpec(r chi.Routes, spec *apispec.Spec, preStop string) []string {
+	var missing []string
+	_ = chi.Walk(r, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		if !spec.Documents(method, route) && !undocumented(route) && route != preStop {
+			missing = append(missing, method+" "+route)
+		}
+		return nil
+	})
+	return missing
+}
+
+// cacheKey identifies a read request by path, normalized query string and
+// the types its query q was narrowed to by the caller's namespaces and ACL.
+func cacheKey(r *http.Request, q storage.Query) string {
+	return r.URL.Path + "?" + r.URL.Query().Encode() + "#" + strings.Join(q.Types, ",") + "!" + strings.Join(q.NotTypes, ",")
+}
+
+// bodyBuffers holds the buffers request bodies are read into; codecs do not
+// keep the bytes they decode, so a buffer is reused once its body is decoded.
+var bodyBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// maxPooledBody is the largest buffer put back into bodyBuffers, so one
+// huge batch does not pin its memory.
+const maxPooledBody = 1 << 20
+
+// decodeBody reads the request body in the format named by its Content-Type.
+func decodeBody(r *http.Request, codecs *codec.Registry, v any) error {
+	buf := bodyBuffers.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledBody {
+			buf.Reset()
+			bodyBuffers.Put(buf)
+		}
+	}()
+	if _, err := buf.ReadFrom(r.Body); err != nil {
+		return err
+	}
+	return codecs.Request(r).Unmarshal(buf.Bytes(), v)
+}
+
+// respond encodes v in the format the request's Accept header prefers.
+func respond(w http.ResponseWriter, r *http.Request, codecs *codec.Registry, status int, v any) {
+	c := codecs.Response(r)
+	body, err := c.Marshal(v)
+	if err != nil {
+		log.Error().Err(err).Msg("encode response")
+		httpx.Error(w, "encoding error", http.StatusInternalServerError)
+		return
+	}
+	writeBody(w, c, status, body)
+}
+
+func writeBody(w http.ResponseWriter, c codec.Codec, status int, body []byte) {
+	w.Header().Set("Content-Type", c.ContentTypes()[0])
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+func writeJSON(w http.ResponseWriter, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(append(body, '\n'))
+}
+
+// routeGroup returns the optional middlewares enabled for a route group, in
+// the configured order.
+func routeGroup(g config.RouteGroupConfig, access *accesslog.Logger, compression config.CompressionConfig) []func(http.Handler) http.Handler {
+	var out []func(http.Handler) http.Handler
+	for _, name := range g.Middlewares {
+		switch name {
+		case "log":
+			out = append(out, access.Middleware)
+		case "timeout":
+			out = append(out, middleware.Timeout(g.Timeout))
+		case "compress":
+			out = append(out, httpx.Compress(compression.MinBytes, compression.Encodings))
+		}
 	}
 	return out
 }
+
+// idempotencyStore keeps the responses of the idempotency cache in the store.
+type idempotencyStore struct{ store storage.Store }
+
+func (s idempotencyStore) SaveResponse(r httpx.StoredResponse) error {
+	return s.store.SaveIdempotent(context.Background(), storage.IdempotentResponse(r))
+}
+
+func (s idempotencyStore) Responses() ([]httpx.StoredResponse, error) {
+	saved, err := s.store.IdempotentResponses(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	out := make([]httpx.StoredResponse, len(saved))
+	for i, r := range saved {
+		out[i] = httpx.StoredResponse(r)
+	}
+	return out, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// TestLegacyPaths serves the unversioned paths with the /v1 handlers,
+// pointing to their successor and leaving the URL as sent.
+func TestLegacyPaths(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(legacyPaths("v1", "/events", "/consumers"))
+	r.Route("/v1", func(v1 chi.Router) {
+		v1.Get("/events/{id}", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, r.URL.Path+" "+chi.URLParam(r, "id"))
+		})
+	})
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	for _, tc := range []struct {
+		path   string
+		status int
+		body   string
+		link   string
+	}{
+		{"/v1/events/7", http.StatusOK, "/v1/events/7 7", ""},
+		{"/events/7", http.StatusOK, "/events/7 7", `</v1/events/7>; rel="successor-version"`},
+		{"/consumers/c1", http.StatusNotFound, "", `</v1/consumers/c1>; rel="successor-version"`},
+		{"/eventsx/7", http.StatusNotFound, "", ""},
+		{"/schemas/a", http.StatusNotFound, "", ""},
+	} {
+		res, err := http.Get(ts.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tc.status || (tc.status == http.StatusOK && string(body) != tc.body) {
+			t.Errorf("%s: %d %q, want %d %q", tc.path, res.StatusCode, body, tc.status, tc.body)
+		}
+		if got := res.Header.Get("Link"); got != tc.link {
+			t.Errorf("%s: Link %q, want %q", tc.path, got, tc.link)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+
+	apispec "github.com/rafaelosorio/go-ingest-service/api"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+// testKeys are the API keys of a test server, each its ID as its secret.
+var testKeys = []config.APIKeyConfig{
+	{ID: "writer", Key: "writer", Roles: []string{"ingest", "read"}},
+	{ID: "reader", Key: "reader", Roles: []string{"ingest", "read"}},
+	{ID: "outsider", Key: "outsider", Roles: []string{"ingest", "read"}},
+	{ID: "viewer", Key: "viewer", Roles: []string{"read"}},
+	{ID: "admin", Key: "admin", Roles: []string{"admin", "ingest", "read"}},
+}
+
+// newTestServer serves an instance over the in-memory store with auth on
+// and testKeys; configure, when not nil, changes the config first.
+func newTestServer(t *testing.T, configure func(*config.Config)) (*httptest.Server, *server) {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Auth = config.AuthConfig{Enabled: true, APIKeys: testKeys}
+	if configure != nil {
+		configure(cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if reqDuration == nil {
+		reqDuration = newDurationHistogram(cfg.Metrics)
+	}
+	s, err := newServer(cfg, func() (*config.Config, error) { return cfg, nil }, prometheus.NewRegistry(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.handler)
+	t.Cleanup(func() {
+		ts.Close()
+		s.close()
+	})
+	return ts, s
+}
+
+// do sends a JSON request with the API key key, returning the status and
+// body.
+func do(t *testing.T, ts *httptest.Server, method, path, key, body string) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	return res.StatusCode, string(b)
+}
+
+// TestGraphQLMethods takes queries as GETs and POSTs only.
+func TestGraphQLMethods(t *testing.T) {
+	ts, s := newTestServer(t, nil)
+	create(t, ts, s, "writer", `{"type":"order.created","payload":{}}`)
+	if status, body := do(t, ts, http.MethodPost, "/graphql", "viewer", `{"query":"{ events { type } }"}`); status != http.StatusOK || !strings.Contains(body, `"order.created"`) {
+		t.Errorf("POST: %d %s", status, body)
+	}
+	if status, body := do(t, ts, http.MethodGet, "/graphql?query="+url.QueryEscape("{ events { type } }"), "viewer", ""); status != http.StatusOK || !strings.Contains(body, `"order.created"`) {
+		t.Errorf("GET: %d %s", status, body)
+	}
+	for _, method := range []string{http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		if status, _ := do(t, ts, method, "/graphql", "viewer", `{"query":"{ events { type } }"}`); status != http.StatusMethodNotAllowed {
+			t.Errorf("%s: %d, want 405", method, status)
+		}
+	}
+}
+
+// TestOpenAPI fails when api/openapi.yaml and the routes drift apart: a
+// public route the spec misses, or an operation no route serves. Every
+// optional feature adding routes is on.
+func TestOpenAPI(t *testing.T) {
+	var conf *config.Config
+	_, s := newTestServer(t, func(cfg *config.Config) {
+		conf = cfg
+		cfg.Docs.SwaggerUI = true
+		cfg.UI.Enabled = true
+		cfg.Server.GRPCWeb = true
+		cfg.Debug.Enabled = true
+		cfg.Outbox.Enabled = true
+		cfg.Uploads.Enabled = true
+		cfg.Uploads.S3.Bucket = "uploads"
+		cfg.Uploads.S3.Region = "us-east-1"
+	})
+	spec, err := apispec.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := s.handler.(chi.Routes)
+	for _, m := range missingFromSpec(routes, spec, conf.Health.PreStopPath) {
+		t.Errorf("%s is missing from api/openapi.yaml", m)
+	}
+	served := map[string]bool{}
+	_ = chi.Walk(routes, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		served[method+" "+route] = true
+		return nil
+	})
+	for _, op := range spec.Operations() {
+		if !served[op] {
+			t.Errorf("api/openapi.yaml documents %s, which no route serves", op)
+		}
+	}
+}
+
+// TestDebugRoutes serves pprof and the runtime stats to admins, once
+// enabled.
+func TestDebugRoutes(t *testing.T) {
+	paths := []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/runtime"}
+	ts, _ := newTestServer(t, nil)
+	for _, path := range paths {
+		if status, _ := do(t, ts, http.MethodGet, path, "admin", ""); status != http.StatusNotFound {
+			t.Errorf("%s while disabled: %d, want 404", path, status)
+		}
+	}
+
+	ts, _ = newTestServer(t, func(cfg *config.Config) { cfg.Debug.Enabled = true })
+	for _, path := range paths {
+		if status, body := do(t, ts, http.MethodGet, path, "admin", ""); status != http.StatusOK {
+			t.Errorf("%s as an admin: %d %s", path, status, body)
+		}
+		if status, _ := do(t, ts, http.MethodGet, path, "writer", ""); status != http.StatusForbidden {
+			t.Errorf("%s as a writer: %d, want 403", path, status)
+		}
+		if status, _ := do(t, ts, http.MethodGet, path, "", ""); status != http.StatusUnauthorized {
+			t.Errorf("%s without a key: %d, want 401", path, status)
+		}
+	}
+	if _, body := do(t, ts, http.MethodGet, "/debug/runtime", "admin", ""); !strings.Contains(body, `"goroutines"`) || !strings.Contains(body, `"heap"`) {
+		t.Errorf("runtime stats: %s", body)
+	}
+}
+
+// TestExemplars attaches the trace ID of a request's traceparent to its
+// latency, as an exemplar of the OpenMetrics scrape.
+func TestExemplars(t *testing.T) {
+	ts, _ := newTestServer(t, nil)
+	// main registers the histogram with the default registry /metrics reads
+	if err := prometheus.Register(reqDuration); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { prometheus.Unregister(reqDuration) })
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/v1/events", nil)
+	req.Header.Set("X-API-Key", "viewer")
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Fatalf("scrape content type %q", ct)
+	}
+	var found bool
+	for line := range strings.Lines(string(b)) {
+		if strings.HasPrefix(line, `http_request_duration_seconds_bucket{method="GET",route="/v1/events"`) && strings.Contains(line, `# {trace_id="`+traceID+`"}`) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no exemplar of trace %s on the /v1/events latency:\n%s", traceID, b)
+	}
+}
+
+// TestStatsStream sends the stats as NDJSON, a line per chunk of the window
+// and a final line for all of it, and stops once the client goes away.
+func TestStatsStream(t *testing.T) {
+	ts, s := newTestServer(t, nil)
+	for range 3 {
+		create(t, ts, s, "writer", `{"type":"order.created","payload":{}}`)
+	}
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/v1/events/stats", nil)
+	req.Header.Set("X-API-Key", "viewer")
+	req.Header.Set("Accept", "application/x-ndjson")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); res.StatusCode != http.StatusOK || ct != "application/x-ndjson" {
+		t.Fatalf("stats stream: %d %q", res.StatusCode, ct)
+	}
+	b, _ := io.ReadAll(res.Body)
+	if !strings.HasSuffix(string(b), "}\n") {
+		t.Fatalf("stream does not end on a whole line: %q", b)
+	}
+	var lines []statsLine
+	for line := range strings.Lines(string(b)) {
+		var l statsLine
+		if err := json.Unmarshal([]byte(line), &l); err != nil || l.Stats == nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		lines = append(lines, l)
+	}
+	// the hour is split into whole minutes, at most statsStreamChunks
+	// chunks of them
+	if len(lines) < 2 || len(lines) > statsStreamChunks+1 {
+		t.Fatalf("%d lines, want up to %d chunks and the final one", len(lines), statsStreamChunks)
+	}
+	last := len(lines) - 1
+	var partial int64
+	for _, l := range lines[:last] {
+		if l.Final {
+			t.Errorf("a chunk is marked final: %+v", l)
+		}
+		partial += l.Total
+	}
+	if final := lines[last]; !final.Final || final.Total != 3 || partial != 3 {
+		t.Errorf("final line %+v, chunks counting %d events, want 3", final, partial)
+	}
+
+	// the client goes away after the first chunk
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := &cancelingStats{Store: storage.NewMemory(1), cancel: cancel}
+	until := time.Now()
+	q := storage.Query{Since: until.Add(-time.Hour).Truncate(time.Minute), Until: until}
+	w := httptest.NewRecorder()
+	streamStats(w, httptest.NewRequest(http.MethodGet, "/v1/events/stats", nil).WithContext(ctx), store, q, time.Minute)
+	if store.calls != 1 || strings.Count(w.Body.String(), "\n") != 1 || strings.Contains(w.Body.String(), `"final"`) {
+		t.Errorf("after the client left: %d chunks computed, body %s", store.calls, w.Body.String())
+	}
+}
+
+// cancelingStats cancels the request once it has computed a chunk.
+type cancelingStats struct {
+	storage.Store
+	cancel func()
+	calls  int
+}
+
+func (c *cancelingStats) Stats(ctx context.Context, q storage.Query, bucket time.Duration) (*storage.Stats, error) {
+	c.calls++
+	defer c.cancel()
+	return c.Store.Stats(ctx, q, bucket)
+}
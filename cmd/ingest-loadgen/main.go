@@ -0,0 +1,474 @@
+// Command ingest-loadgen sends a configurable mix of events to the ingest
+// service at a fixed or ramping rate and reports throughput and latency
+// percentiles, so changes to the store or the pipeline can be measured the
+// same way every time.
+//
+//	ingest-loadgen -rate 500 -duration 1m -types page.view=8,signup=1,checkout=1
+//	ingest-loadgen -rate 100 -ramp-to 2000 -duration 5m -batch 50 -size exp:512
+//	ingest-loadgen -url https://ingest.example.com -api-key $KEY -json > run.json
+//	ingest-loadgen -scenario black-friday.yaml
+//	ingest-loadgen -grpc -rate 1000 -batch 100
+//
+// With -grpc the events are sent through ingest.v1.EventService, Ingest or
+// IngestBatch, over the Connect protocol in the Protocol Buffers encoding,
+// which the service serves with server.grpc_web.
+//
+// A scenario runs several producers at once, each with its own types,
+// payload sizes and rate, bursts and payload spikes included, next to pull
+// consumers; see scenario.
+//
+// The load is open: requests are started on schedule whether or not earlier
+// ones have finished, and latency is measured from the scheduled start, so a
+// slow service shows up in the percentiles instead of lowering the rate.
+// Requests that find every worker busy are counted as missed.
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func main() {
+	url := flag.String("url", "http://localhost:8080", "base URL of the service")
+	apiKey := flag.String("api-key", os.Getenv("INGEST_API_KEY"), "API key with the ingest role")
+	types := flag.String("types", "loadgen.event", "event types with weights, e.g. page.view=8,signup=1")
+	size := flag.String("size", "256", "payload bytes: fixed (256), uniform range (64-4096) or exponential (exp:512)")
+	rate := flag.Float64("rate", 100, "events per second at the start")
+	rampTo := flag.Float64("ramp-to", 0, "events per second at the end, ramping linearly (default: -rate throughout)")
+	duration := flag.Duration("duration", 30*time.Second, "how long to send")
+	batch := flag.Int("batch", 0, "events per POST /v1/events/batch; 0 sends them one by one to POST /v1/events")
+	workers := flag.Int("workers", 64, "concurrent requests at most")
+	seed := flag.Uint64("seed", 1, "random seed, for the same types and payloads on every run")
+	scenarioPath := flag.String("scenario", "", "YAML scenario of producers and consumers, in place of -types, -size, -rate, -ramp-to, -batch and -duration")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	useGRPC := flag.Bool("grpc", false, "send through ingest.v1.EventService over Connect instead of the /v1 routes")
+	flag.Parse()
+
+	if *workers <= 0 {
+		fail(fmt.Errorf("need -workers > 0"))
+	}
+	g := &generator{
+		url:     strings.TrimRight(*url, "/"),
+		apiKey:  *apiKey,
+		hc:      &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{MaxIdleConnsPerHost: *workers}},
+		results: newResults(),
+		grpc:    *useGRPC,
+	}
+	var sc *scenario
+	if *scenarioPath != "" {
+		var err error
+		if sc, err = loadScenario(*scenarioPath); err != nil {
+			fail(err)
+		}
+		if g.producers, err = sc.producers(*seed); err != nil {
+			fail(err)
+		}
+		*duration = sc.Duration
+	} else {
+		p, err := newProducer("", *types, *size, *batch, *seed)
+		if err != nil {
+			fail(err)
+		}
+		if *rate <= 0 || *rampTo < 0 || *duration <= 0 {
+			fail(fmt.Errorf("need -rate > 0 and -duration > 0"))
+		}
+		*rampTo = cmp.Or(*rampTo, *rate)
+		p.rate = ramp(*rate, *rampTo, *duration)
+		g.producers = []*producer{p}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	wait := func() {}
+	if sc != nil {
+		wait = g.runConsumers(ctx, sc.Consumers, *duration)
+	}
+	g.run(ctx, *duration, *workers)
+	wait()
+
+	rep := g.results.report(*rate, *rampTo, *batch)
+	rep.GRPC = *useGRPC
+	if sc != nil {
+		rep.Scenario, rep.Rate, rep.RampTo, rep.Batch = *scenarioPath, 0, 0, 0
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(rep)
+		return
+	}
+	rep.print(os.Stdout)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "error:", err)
+	os.Exit(2)
+}
+
+// tick is how often the scheduler starts the requests that came due.
+const tick = 5 * time.Millisecond
+
+type generator struct {
+	url       string
+	apiKey    string
+	hc        *http.Client
+	producers []*producer
+	// grpc sends the events through EventService instead of /v1/events
+	grpc bool
+
+	results *results
+}
+
+// producer is one source of load: a type mix and payload sizes sent at its
+// own rate.
+type producer struct {
+	name  string
+	mix   *mix
+	sizes sizes
+	// spike, when set, is drawn instead of sizes for spikeShare of the
+	// events.
+	spike      *sizes
+	spikeShare float64
+	batch      int
+	// rate returns the events per second due elapsed into the run.
+	rate func(elapsed time.Duration) float64
+
+	// rng, seq and owed are only used by the scheduler goroutine; owed is
+	// how many requests are due but not yet scheduled.
+	rng  *rand.Rand
+	seq  int
+	owed float64
+}
+
+// ramp goes linearly from `from` to `to` events per second over d.
+func ramp(from, to float64, d time.Duration) func(time.Duration) float64 {
+	return func(elapsed time.Duration) float64 {
+		return from + (to-from)*elapsed.Seconds()/d.Seconds()
+	}
+}
+
+// request is one scheduled POST.
+type request struct {
+	due         time.Time
+	producer    string
+	path        string
+	contentType string
+	body        []byte
+	events      int
+}
+
+// run schedules the requests of every producer for d and waits for the last
+// ones to finish.
+func (g *generator) run(ctx context.Context, d time.Duration, workers int) {
+	queue := make(chan request, workers)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range queue {
+				g.send(req)
+			}
+		}()
+	}
+
+	start := time.Now()
+	g.results.start = start
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	last := start
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case now := <-ticker.C:
+			elapsed := now.Sub(start)
+			if elapsed >= d {
+				break loop
+			}
+			for _, p := range g.producers {
+				perRequest := max(p.batch, 1)
+				p.owed += p.rate(elapsed) * now.Sub(last).Seconds() / float64(perRequest)
+				for ; p.owed >= 1; p.owed-- {
+					select {
+					case queue <- p.next(now, g.grpc):
+					default:
+						g.results.miss(p.name, perRequest)
+					}
+				}
+			}
+			last = now
+		}
+	}
+	close(queue)
+	wg.Wait()
+	g.results.end = time.Now()
+}
+
+// next builds the request of p scheduled at due, for EventService with
+// grpc.
+func (p *producer) next(due time.Time, grpc bool) request {
+	type ev struct {
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	events := make([]ev, max(p.batch, 1))
+	for i := range events {
+		p.seq++
+		events[i] = ev{p.mix.pick(p.rng), payload(p.rng, p.draw(), p.seq)}
+	}
+	req := request{due: due, producer: p.name, contentType: "application/json", events: len(events)}
+	switch {
+	case grpc && p.batch == 0:
+		req.path, req.contentType = "/ingest.v1.EventService/Ingest", "application/proto"
+		req.body = protoEvent(nil, events[0].Type, events[0].Payload)
+	case grpc:
+		req.path, req.contentType = "/ingest.v1.EventService/IngestBatch", "application/proto"
+		// an EventList: the events are its field 1
+		for _, e := range events {
+			req.body = protowire.AppendTag(req.body, 1, protowire.BytesType)
+			req.body = protowire.AppendBytes(req.body, protoEvent(nil, e.Type, e.Payload))
+		}
+	case p.batch == 0:
+		req.path = "/v1/events"
+		req.body, _ = json.Marshal(events[0])
+	default:
+		req.path = "/v1/events/batch"
+		req.body, _ = json.Marshal(events)
+	}
+	return req
+}
+
+// protoEvent appends the ingest.v1.Event of type typ and payload to b.
+func protoEvent(b []byte, typ string, payload []byte) []byte {
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, typ)
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	return protowire.AppendBytes(b, payload)
+}
+
+func (g *generator) send(req request) {
+	r, err := http.NewRequest(http.MethodPost, g.url+req.path, bytes.NewReader(req.body))
+	if err != nil {
+		g.results.add(req, "error", 0)
+		return
+	}
+	r.Header.Set("Content-Type", req.contentType)
+	if g.grpc {
+		r.Header.Set("Connect-Protocol-Version", "1")
+	}
+	if g.apiKey != "" {
+		r.Header.Set("X-API-Key", g.apiKey)
+	}
+	resp, err := g.hc.Do(r)
+	if err != nil {
+		g.results.add(req, "error", time.Since(req.due))
+		return
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	g.results.add(req, strconv.Itoa(resp.StatusCode), time.Since(req.due))
+}
+
+// results collects the outcome of every request.
+type results struct {
+	start, end time.Time
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	statuses  map[string]int
+	events    int
+	accepted  int
+	bytes     int64
+	missed    int
+	// producers and consumers break the run down for a scenario.
+	producers map[string]*producerCounts
+	consumers map[string]*consumerCounts
+}
+
+func newResults() *results {
+	return &results{statuses: map[string]int{}, producers: map[string]*producerCounts{}, consumers: map[string]*consumerCounts{}}
+}
+
+// producerCounts are the events of one producer.
+type producerCounts struct {
+	Events   int `json:"events"`
+	Accepted int `json:"accepted"`
+	Missed   int `json:"missed"`
+}
+
+func (r *results) producer(name string) *producerCounts {
+	c := r.producers[name]
+	if c == nil {
+		c = &producerCounts{}
+		r.producers[name] = c
+	}
+	return c
+}
+
+func (r *results) add(req request, status string, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statuses[status]++
+	r.events += req.events
+	r.bytes += int64(len(req.body))
+	p := r.producer(req.producer)
+	p.Events += req.events
+	if status == "error" {
+		return
+	}
+	r.latencies = append(r.latencies, latency)
+	if status == "200" || status == "201" || status == "202" {
+		r.accepted += req.events
+		p.Accepted += req.events
+	}
+}
+
+func (r *results) miss(producer string, events int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.missed += events
+	r.producer(producer).Missed += events
+}
+
+// report summarizes a run.
+type report struct {
+	// Scenario is the -scenario file, whose producers replace Rate,
+	// RampTo and Batch.
+	Scenario string  `json:"scenario,omitempty"`
+	Duration string  `json:"duration"`
+	Rate     float64 `json:"rate"`
+	RampTo   float64 `json:"ramp_to"`
+	Batch    int     `json:"batch"`
+	// GRPC is set for a run through EventService; Statuses are still the
+	// HTTP statuses of the Connect calls.
+	GRPC     bool `json:"grpc,omitempty"`
+	Requests int  `json:"requests"`
+	Events   int  `json:"events"`
+	// Accepted counts the events of 2xx responses.
+	Accepted int `json:"accepted"`
+	// Missed counts the events not sent because every worker was busy.
+	Missed     int            `json:"missed"`
+	Bytes      int64          `json:"bytes"`
+	Throughput float64        `json:"events_per_second"`
+	Statuses   map[string]int `json:"statuses"`
+	// Latency percentiles are in milliseconds.
+	Latency   map[string]float64        `json:"latency_ms"`
+	Producers map[string]producerCounts `json:"producers,omitempty"`
+	Consumers map[string]consumerReport `json:"consumers,omitempty"`
+}
+
+// consumerReport adds the latency percentiles of the pulls, in
+// milliseconds, to the counts of a consumer.
+type consumerReport struct {
+	consumerCounts
+	Latency map[string]float64 `json:"latency_ms"`
+}
+
+var percentiles = []struct {
+	name string
+	q    float64
+}{{"p50", 0.50}, {"p90", 0.90}, {"p99", 0.99}, {"p999", 0.999}, {"max", 1}}
+
+func latencies(sorted []time.Duration) map[string]float64 {
+	out := map[string]float64{}
+	for _, p := range percentiles {
+		out[p.name] = ms(quantile(sorted, p.q))
+	}
+	return out
+}
+
+func (r *results) report(rate, rampTo float64, batch int) report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	elapsed := r.end.Sub(r.start)
+	out := report{
+		Duration: elapsed.Round(time.Millisecond).String(),
+		Rate:     rate, RampTo: rampTo, Batch: batch,
+		Events: r.events, Accepted: r.accepted, Missed: r.missed, Bytes: r.bytes,
+		Throughput: float64(r.accepted) / elapsed.Seconds(),
+		Statuses:   r.statuses,
+	}
+	for _, n := range r.statuses {
+		out.Requests += n
+	}
+	slices.Sort(r.latencies)
+	out.Latency = latencies(r.latencies)
+	if len(r.producers) > 1 || len(r.consumers) > 0 {
+		out.Producers = map[string]producerCounts{}
+		for name, c := range r.producers {
+			out.Producers[name] = *c
+		}
+	}
+	for name, c := range r.consumers {
+		if out.Consumers == nil {
+			out.Consumers = map[string]consumerReport{}
+		}
+		slices.Sort(c.latencies)
+		out.Consumers[name] = consumerReport{consumerCounts: *c, Latency: latencies(c.latencies)}
+	}
+	return out
+}
+
+// quantile returns the q-quantile of sorted, by the nearest-rank method.
+func quantile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(q*float64(len(sorted))+0.5) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+func ms(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+
+func (rep report) print(w io.Writer) {
+	via := ""
+	if rep.GRPC {
+		via = ", through EventService"
+	}
+	if rep.Scenario != "" {
+		fmt.Fprintf(w, "duration    %s (scenario %s%s)\n", rep.Duration, rep.Scenario, via)
+	} else {
+		fmt.Fprintf(w, "duration    %s (rate %g -> %g ev/s, batch %d%s)\n", rep.Duration, rep.Rate, rep.RampTo, rep.Batch, via)
+	}
+	fmt.Fprintf(w, "requests    %d (%d events, %d accepted, %d missed, %.1f MB)\n",
+		rep.Requests, rep.Events, rep.Accepted, rep.Missed, float64(rep.Bytes)/1e6)
+	fmt.Fprintf(w, "throughput  %.1f accepted ev/s\n", rep.Throughput)
+	codes := make([]string, 0, len(rep.Statuses))
+	for code, n := range rep.Statuses {
+		codes = append(codes, fmt.Sprintf("%s=%d", code, n))
+	}
+	slices.Sort(codes)
+	fmt.Fprintf(w, "statuses    %s\n", strings.Join(codes, " "))
+	fmt.Fprintf(w, "latency ms  p50 %.2f  p90 %.2f  p99 %.2f  p99.9 %.2f  max %.2f\n",
+		rep.Latency["p50"], rep.Latency["p90"], rep.Latency["p99"], rep.Latency["p999"], rep.Latency["max"])
+	for _, name := range slices.Sorted(maps.Keys(rep.Producers)) {
+		p := rep.Producers[name]
+		fmt.Fprintf(w, "producer    %s: %d events, %d accepted, %d missed\n", name, p.Events, p.Accepted, p.Missed)
+	}
+	for _, name := range slices.Sorted(maps.Keys(rep.Consumers)) {
+		c := rep.Consumers[name]
+		fmt.Fprintf(w, "consumer    %s: %d pulls, %d events, %d errors, pull p50 %.2f  p99 %.2f ms\n",
+			name, c.Pulls, c.Events, c.Errors, c.Latency["p50"], c.Latency["p99"])
+		if c.LastError != "" {
+			fmt.Fprintf(w, "            last error: %s\n", c.LastError)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/codec"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/rpc"
+)
+
+// TestRamp goes linearly from the start rate to the end one over the run.
+func TestRamp(t *testing.T) {
+	r := ramp(100, 300, 10*time.Second)
+	for elapsed, want := range map[time.Duration]float64{0: 100, 5 * time.Second: 200, 10 * time.Second: 300} {
+		if got := r(elapsed); got != want {
+			t.Errorf("rate at %s: %g, want %g", elapsed, got, want)
+		}
+	}
+}
+
+// TestReport counts the events of accepted and failed requests apart and
+// takes the latency percentiles by nearest rank.
+func TestReport(t *testing.T) {
+	r := newResults()
+	r.start = time.Now()
+	r.end = r.start.Add(2 * time.Second)
+	for i := 1; i <= 100; i++ {
+		r.add(request{producer: "p", body: make([]byte, 10), events: 2}, "201", time.Duration(i)*time.Millisecond)
+	}
+	r.add(request{producer: "p", events: 2}, "429", 500*time.Millisecond)
+	r.add(request{producer: "p", events: 2}, "error", 0)
+	r.miss("p", 2)
+
+	rep := r.report(100, 100, 2)
+	if rep.Requests != 102 || rep.Events != 204 || rep.Accepted != 200 || rep.Missed != 2 || rep.Bytes != 1000 {
+		t.Errorf("counts %+v", rep)
+	}
+	if rep.Throughput != 100 {
+		t.Errorf("throughput %g, want 100 accepted ev/s", rep.Throughput)
+	}
+	want := map[string]float64{"p50": 51, "p90": 91, "p99": 100, "p999": 500, "max": 500}
+	for name, ms := range want {
+		if rep.Latency[name] != ms {
+			t.Errorf("%s: %g ms, want %g", name, rep.Latency[name], ms)
+		}
+	}
+	if rep.Statuses["201"] != 100 || rep.Statuses["429"] != 1 || rep.Statuses["error"] != 1 {
+		t.Errorf("statuses %v", rep.Statuses)
+	}
+	var out strings.Builder
+	rep.print(&out)
+	for _, line := range []string{
+		"requests    102 (204 events, 200 accepted, 2 missed, 0.0 MB)",
+		"statuses    201=100 429=1 error=1",
+		"latency ms  p50 51.00  p90 91.00  p99 100.00  p99.9 500.00  max 500.00",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("report lacks %q:\n%s", line, out.String())
+		}
+	}
+}
+
+// TestRun sends at the scheduled rate, in batches, and reports what the
+// service accepted.
+func TestRun(t *testing.T) {
+	var mu sync.Mutex
+	received := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var events []json.RawMessage
+		if r.URL.Path != "/v1/events/batch" || json.NewDecoder(r.Body).Decode(&events) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received += len(events)
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+	p, err := newProducer("", "a=3,b=1", "64-128", 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.rate = ramp(400, 400, time.Second)
+	g := &generator{url: ts.URL, hc: ts.Client(), producers: []*producer{p}, results: newResults()}
+	g.run(context.Background(), time.Second, 8)
+
+	rep := g.results.report(400, 400, 10)
+	if rep.Accepted != received || rep.Missed != 0 || rep.Statuses["201"] != received/10 {
+		t.Errorf("reported %+v, service received %d", rep, received)
+	}
+	// the scheduler's ticks leave the last one out at most
+	if received < 350 || received > 410 {
+		t.Errorf("sent %d events in 1s at 400 ev/s", received)
+	}
+}
+
+// TestGRPC sends through EventService over Connect, in messages the
+// service's Protocol Buffers codec reads back.
+func TestGRPC(t *testing.T) {
+	var mu sync.Mutex
+	var got []event.Event
+	routes := http.NewServeMux()
+	routes.HandleFunc("POST /v1/events/batch", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var events []event.Event
+		if err := (codec.Protobuf{}).Unmarshal(body, &events); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		got = append(got, events...)
+		mu.Unlock()
+		out, _ := codec.Protobuf{}.Marshal(events)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(out)
+	})
+	ts := httptest.NewServer(rpc.New(routes).Handler(nil))
+	defer ts.Close()
+
+	p, err := newProducer("", "order.created", "64", 5, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &generator{url: ts.URL, hc: ts.Client(), grpc: true, results: newResults()}
+	req := p.next(time.Now(), true)
+	if req.path != "/ingest.v1.EventService/IngestBatch" || req.contentType != "application/proto" {
+		t.Fatalf("request %s %s", req.path, req.contentType)
+	}
+	g.send(req)
+	if rep := g.results.report(0, 0, 5); rep.Statuses["200"] != 1 || rep.Accepted != 5 {
+		t.Fatalf("statuses %v, %d accepted", rep.Statuses, rep.Accepted)
+	}
+	if len(got) != 5 {
+		t.Fatalf("service got %d events, want 5", len(got))
+	}
+	for i, e := range got {
+		var payload struct {
+			Seq int `json:"seq"`
+		}
+		if e.Type != "order.created" || json.Unmarshal(e.Payload, &payload) != nil || payload.Seq != i+1 || len(e.Payload) != 64 {
+			t.Errorf("event %d: %s %s", i, e.Type, e.Payload)
+		}
+	}
+
+	// a single event is an Event message of its own
+	single, _ := newProducer("", "signup", "64", 0, 1)
+	req = single.next(time.Now(), true)
+	var e event.Event
+	if err := (codec.Protobuf{}).Unmarshal(req.body, &e); err != nil || e.Type != "signup" || !bytes.HasPrefix(e.Payload, []byte(`{"seq":1,`)) {
+		t.Errorf("Ingest %s: %s %s, %v", req.path, e.Type, e.Payload, err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+)
+
+// mix picks event types by weight.
+type mix struct {
+	types   []string
+	weights []int
+	total   int
+}
+
+// parseMix reads "page.view=5,signup=1"; a type without a weight counts 1.
+func parseMix(s string) (*mix, error) {
+	m := &mix{}
+	for _, part := range strings.Split(s, ",") {
+		typ, w, hasWeight := strings.Cut(strings.TrimSpace(part), "=")
+		if typ == "" {
+			return nil, fmt.Errorf("empty type in %q", s)
+		}
+		weight := 1
+		if hasWeight {
+			n, err := strconv.Atoi(w)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("type %s: weight must be a positive integer", typ)
+			}
+			weight = n
+		}
+		m.types = append(m.types, typ)
+		m.weights = append(m.weights, weight)
+		m.total += weight
+	}
+	return m, nil
+}
+
+func (m *mix) pick(rng *rand.Rand) string {
+	n := rng.IntN(m.total)
+	for i, w := range m.weights {
+		if n < w {
+			return m.types[i]
+		}
+		n -= w
+	}
+	return m.types[len(m.types)-1]
+}
+
+// sizes draws payload sizes in bytes: "256" is fixed, "64-4096" uniform
+// and "exp:512" exponential with that mean.
+type sizes struct {
+	min, max int
+	mean     float64
+}
+
+// maxPayload keeps a single event under the service's default body limit.
+const maxPayload = 512 << 10
+
+func parseSizes(s string) (sizes, error) {
+	if v, ok := strings.CutPrefix(s, "exp:"); ok {
+		mean, err := strconv.Atoi(v)
+		if err != nil || mean <= 0 {
+			return sizes{}, fmt.Errorf("size %q: want exp:<mean bytes>", s)
+		}
+		return sizes{min: 16, max: maxPayload, mean: float64(mean)}, nil
+	}
+	lo, hi, isRange := strings.Cut(s, "-")
+	a, err := strconv.Atoi(lo)
+	if err != nil || a < 16 || a > maxPayload {
+		return sizes{}, fmt.Errorf("size %q: want bytes between 16 and %d", s, maxPayload)
+	}
+	b := a
+	if isRange {
+		if b, err = strconv.Atoi(hi); err != nil || b < a || b > maxPayload {
+			return sizes{}, fmt.Errorf("size %q: want <min>-<max> up to %d", s, maxPayload)
+		}
+	}
+	return sizes{min: a, max: b}, nil
+}
+
+func (s sizes) draw(rng *rand.Rand) int {
+	if s.mean > 0 {
+		return min(max(int(math.Round(rng.ExpFloat64()*s.mean)), s.min), s.max)
+	}
+	return s.min + rng.IntN(s.max-s.min+1)
+}
+
+// payload returns a JSON object of about n bytes.
+func payload(rng *rand.Rand, n, seq int) json.RawMessage {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+	head := fmt.Sprintf(`{"seq":%d,"user_id":%d,"data":"`, seq, rng.IntN(100_000))
+	pad := max(n-len(head)-2, 0)
+	b := make([]byte, 0, len(head)+pad+2)
+	b = append(b, head...)
+	for range pad {
+		b = append(b, alphabet[rng.IntN(len(alphabet))])
+	}
+	return append(b, '"', '}')
+}
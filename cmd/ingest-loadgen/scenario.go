@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// scenario is a run read from -scenario: producers sending at once, each
+// with its own types, payload sizes and rate, and pull consumers reading
+// alongside them.
+//
+//	duration: 10m
+//	producers:
+//	  - name: steady
+//	    types: page.view=8,signup=1,checkout=1
+//	    size: exp:512
+//	    rate: 300
+//	    batch: 50
+//	  - name: flash-sale        # bursty: 2000 ev/s for 5s of every minute
+//	    types: checkout
+//	    rate: 10
+//	    burst: {every: 1m, for: 5s, rate: 2000}
+//	  - name: uploads           # 1% of the payloads are 100-400 KB
+//	    types: upload.done
+//	    size: 256-2048
+//	    rate: 20
+//	    spike: {size: 100000-400000, share: 0.01}
+//	consumers:
+//	  - name: slow-analytics    # pulls 100 every 2s, acks 500ms later
+//	    types: [page.view]
+//	    max: 100
+//	    every: 2s
+//	    ack_delay: 500ms
+//
+// A hot event type is a heavy weight in a producer's types, e.g.
+// "cart.update=95,cart.checkout=5".
+type scenario struct {
+	Duration  time.Duration  `yaml:"duration"`
+	Producers []producerSpec `yaml:"producers"`
+	Consumers []consumerSpec `yaml:"consumers"`
+}
+
+type producerSpec struct {
+	Name string `yaml:"name"`
+	// Types and Size take the -types and -size syntax.
+	Types string `yaml:"types"`
+	Size  string `yaml:"size"`
+	// Rate goes linearly to RampTo, when set, over the run.
+	Rate   float64 `yaml:"rate"`
+	RampTo float64 `yaml:"ramp_to"`
+	Batch  int     `yaml:"batch"`
+	Burst  *struct {
+		// Rate replaces the producer's for For out of Every, starting
+		// with the run.
+		Every time.Duration `yaml:"every"`
+		For   time.Duration `yaml:"for"`
+		Rate  float64       `yaml:"rate"`
+	} `yaml:"burst"`
+	Spike *struct {
+		// Size is drawn instead of the producer's for Share of the events.
+		Size  string  `yaml:"size"`
+		Share float64 `yaml:"share"`
+	} `yaml:"spike"`
+}
+
+type consumerSpec struct {
+	Name  string   `yaml:"name"`
+	Types []string `yaml:"types"`
+	// Max events are pulled every Every, and acknowledged AckDelay later.
+	Max      int           `yaml:"max"`
+	Every    time.Duration `yaml:"every"`
+	AckDelay time.Duration `yaml:"ack_delay"`
+}
+
+// loadScenario reads and checks the scenario at path.
+func loadScenario(path string) (*scenario, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sc scenario
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&sc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if sc.Duration <= 0 || len(sc.Producers) == 0 {
+		return nil, fmt.Errorf("%s: need a duration and at least one producer", path)
+	}
+	names := map[string]bool{}
+	for i, p := range sc.Producers {
+		if p.Name == "" {
+			sc.Producers[i].Name = fmt.Sprintf("producer-%d", i+1)
+		}
+		if names[sc.Producers[i].Name] {
+			return nil, fmt.Errorf("%s: producer %s is defined twice", path, p.Name)
+		}
+		names[sc.Producers[i].Name] = true
+	}
+	for _, c := range sc.Consumers {
+		if c.Name == "" || c.Every <= 0 || c.AckDelay < 0 || c.Max < 0 {
+			return nil, fmt.Errorf("%s: consumer %q: need a name and every > 0", path, c.Name)
+		}
+	}
+	return &sc, nil
+}
+
+// producers builds the producers of sc, each with its own random stream
+// off seed.
+func (sc *scenario) producers(seed uint64) ([]*producer, error) {
+	var out []*producer
+	for i, spec := range sc.Producers {
+		p, err := newProducer(spec.Name, cmp.Or(spec.Types, "loadgen.event"), cmp.Or(spec.Size, "256"), spec.Batch, seed+uint64(i))
+		if err != nil {
+			return nil, fmt.Errorf("producer %s: %w", spec.Name, err)
+		}
+		if spec.Rate <= 0 || spec.RampTo < 0 {
+			return nil, fmt.Errorf("producer %s: need rate > 0", spec.Name)
+		}
+		p.rate = ramp(spec.Rate, cmp.Or(spec.RampTo, spec.Rate), sc.Duration)
+		if b := spec.Burst; b != nil {
+			if b.Every <= 0 || b.For <= 0 || b.For > b.Every || b.Rate <= 0 {
+				return nil, fmt.Errorf("producer %s: burst needs 0 < for <= every and rate > 0", spec.Name)
+			}
+			base := p.rate
+			p.rate = func(elapsed time.Duration) float64 {
+				if elapsed%b.Every < b.For {
+					return b.Rate
+				}
+				return base(elapsed)
+			}
+		}
+		if s := spec.Spike; s != nil {
+			sz, err := parseSizes(s.Size)
+			if err != nil || s.Share <= 0 || s.Share > 1 {
+				return nil, fmt.Errorf("producer %s: spike needs a size and a share in (0, 1]", spec.Name)
+			}
+			p.spike, p.spikeShare = &sz, s.Share
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// consume creates the consumer of spec, accepting one that exists, then
+// pulls and acknowledges as spec says until ctx ends.
+func (g *generator) consume(ctx context.Context, spec consumerSpec) {
+	body, _ := json.Marshal(map[string]any{"name": spec.Name, "types": spec.Types})
+	status, _, err := g.call(ctx, http.MethodPost, "/v1/consumers", body, nil)
+	if err == nil && status != http.StatusCreated && status != http.StatusConflict {
+		err = fmt.Errorf("create: status %d", status)
+	}
+	if err != nil {
+		g.results.pulled(spec.Name, 0, 0, err)
+		return
+	}
+	path := "/v1/consumers/" + url.PathEscape(spec.Name)
+	pull := path + "/pull"
+	if spec.Max > 0 {
+		pull += "?max=" + strconv.Itoa(spec.Max)
+	}
+	ticker := time.NewTicker(spec.Every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		start := time.Now()
+		var events []struct {
+			ID json.RawMessage `json:"id"`
+		}
+		status, h, err := g.call(ctx, http.MethodGet, pull, nil, &events)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil && status != http.StatusOK {
+			err = fmt.Errorf("pull: status %d", status)
+		}
+		g.results.pulled(spec.Name, len(events), time.Since(start), err)
+		if err != nil || len(events) == 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(spec.AckDelay):
+		}
+		ids := make([]json.RawMessage, len(events))
+		for i, e := range events {
+			ids[i] = e.ID
+		}
+		token, _ := strconv.ParseInt(h.Get("Lease-Token"), 10, 64)
+		body, _ := json.Marshal(map[string]any{"ids": ids, "token": token})
+		status, _, err = g.call(ctx, http.MethodPost, path+"/ack", body, nil)
+		if err == nil && status != http.StatusOK {
+			err = fmt.Errorf("ack: status %d", status)
+		}
+		if err != nil && ctx.Err() == nil {
+			g.results.pulled(spec.Name, 0, 0, err)
+		}
+	}
+}
+
+// call sends a request outside the schedule, decoding the answer into out
+// when not nil.
+func (g *generator) call(ctx context.Context, method, path string, body []byte, out any) (int, http.Header, error) {
+	r, err := http.NewRequestWithContext(ctx, method, g.url+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept", "application/json")
+	if g.apiKey != "" {
+		r.Header.Set("X-API-Key", g.apiKey)
+	}
+	resp, err := g.hc.Do(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, resp.Header, err
+		}
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, resp.Header, nil
+}
+
+// consumerCounts is what one consumer pulled.
+type consumerCounts struct {
+	Pulls  int `json:"pulls"`
+	Events int `json:"events"`
+	Errors int `json:"errors"`
+	// LastError is the last failed call, for a run whose consumer never
+	// got going.
+	LastError string `json:"last_error,omitempty"`
+
+	latencies []time.Duration
+}
+
+func (r *results) pulled(name string, events int, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.consumers[name]
+	if c == nil {
+		c = &consumerCounts{}
+		r.consumers[name] = c
+	}
+	if err != nil {
+		c.Errors++
+		c.LastError = err.Error()
+		return
+	}
+	c.Pulls++
+	c.Events += events
+	c.latencies = append(c.latencies, latency)
+}
+
+// runConsumers starts the consumers of sc, stopping them when ctx ends or
+// the run's duration passes; wait waits for them.
+func (g *generator) runConsumers(ctx context.Context, specs []consumerSpec, d time.Duration) (wait func()) {
+	ctx, cancel := context.WithTimeout(ctx, d)
+	var wg sync.WaitGroup
+	for _, spec := range specs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.consume(ctx, spec)
+		}()
+	}
+	return func() {
+		wg.Wait()
+		cancel()
+	}
+}
+
+// draw returns the payload size of the next event of p.
+func (p *producer) draw() int {
+	if p.spike != nil && p.rng.Float64() < p.spikeShare {
+		return p.spike.draw(p.rng)
+	}
+	return p.sizes.draw(p.rng)
+}
+
+// newProducer parses the -types and -size syntax of a producer.
+func newProducer(name, types, size string, batch int, seed uint64) (*producer, error) {
+	m, err := parseMix(types)
+	if err != nil {
+		return nil, err
+	}
+	sz, err := parseSizes(size)
+	if err != nil {
+		return nil, err
+	}
+	if batch < 0 || batch > 1000 {
+		return nil, fmt.Errorf("batch must be 0-1000")
+	}
+	return &producer{name: name, mix: m, sizes: sz, batch: batch, rng: rand.New(rand.NewPCG(seed, seed))}, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/pkg/client"
+)
+
+// dlqList prints the dead outbox deliveries, the sinks' dead letters.
+func dlqList(args []string) error {
+	fs := flag.NewFlagSet("dlq list", flag.ExitOnError)
+	g := addGlobals(fs)
+	sink := fs.String("sink", "", "sink name (default: every sink)")
+	limit := fs.Int("limit", 0, "dead letters to list, newest first (default: the service's, 100)")
+	_ = fs.Parse(args)
+	if err := g.validOutput(); err != nil {
+		return err
+	}
+	c, err := g.client()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	dead, err := c.DeadLetters(ctx, *sink, *limit)
+	if err != nil {
+		return err
+	}
+	if g.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(dead)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SINK\tID\tTYPE\tRECEIVED\tATTEMPTS\tLAST ERROR")
+	for _, d := range dead {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%d\t%s\n", d.Sink, d.Event.ID, d.Event.Type,
+			d.Event.ReceivedAt.Local().Format(time.DateTime), d.Attempts, truncate(d.LastError, 60))
+	}
+	return tw.Flush()
+}
+
+// dlqRetry delivers dead letters to their sink again from scratch.
+func dlqRetry(args []string) error {
+	return dlqApply("dlq retry", "retried", args, (*client.Client).RetryDeadLetters)
+}
+
+// dlqDiscard drops dead letters.
+func dlqDiscard(args []string) error {
+	return dlqApply("dlq discard", "discarded", args, (*client.Client).DiscardDeadLetters)
+}
+
+// dlqApply parses --sink and the event IDs of a retry or discard and
+// applies it.
+func dlqApply(name, done string, args []string, apply func(*client.Client, context.Context, string, ...int64) (int, error)) error {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	g := addGlobals(fs)
+	sink := fs.String("sink", "", "sink name")
+	_ = fs.Parse(args)
+	if err := g.validOutput(); err != nil {
+		return err
+	}
+	if *sink == "" || fs.NArg() == 0 {
+		return fmt.Errorf("usage: ingestctl %s --sink <name> <event id>...", name)
+	}
+	ids := make([]int64, fs.NArg())
+	for i, a := range fs.Args() {
+		id, err := strconv.ParseInt(a, 10, 64)
+		if err != nil || id <= 0 {
+			return fmt.Errorf("%q is not an event ID", a)
+		}
+		ids[i] = id
+	}
+	c, err := g.client()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	n, err := apply(c, ctx, *sink, ids...)
+	if err != nil {
+		return err
+	}
+	if g.output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(map[string]int{done: n})
+	}
+	// IDs that are not dead deliveries to the sink are ignored
+	fmt.Printf("%s %d of %d\n", done, n, len(ids))
+	return nil
+}
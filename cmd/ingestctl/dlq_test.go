@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// capture runs fn with its standard output going to the returned string.
+func capture(t *testing.T, fn func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := os.Stdout
+	os.Stdout = w
+	done := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- string(b)
+	}()
+	err = fn()
+	os.Stdout = orig
+	w.Close()
+	return <-done, err
+}
+
+// TestDLQ lists, retries and discards dead letters through the admin
+// endpoints of the outbox.
+func TestDLQ(t *testing.T) {
+	var posted []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "admin" {
+			http.Error(w, `{"error":{"message":"forbidden"}}`, http.StatusForbidden)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /admin/outbox/dead":
+			if r.URL.RawQuery != "limit=5&sink=warehouse" {
+				t.Errorf("list query %q", r.URL.RawQuery)
+			}
+			_, _ = io.WriteString(w, `[{"sink":"warehouse","event":{"id":812,"type":"order.paid","payload":{}},"attempts":8,"last_error":"webhook returned 503"}]`)
+		case "POST /admin/outbox/dead/retry", "POST /admin/outbox/dead/discard":
+			b, _ := io.ReadAll(r.Body)
+			posted = append(posted, r.URL.Path+" "+string(b))
+			var in struct {
+				IDs []int64 `json:"ids"`
+			}
+			_ = json.Unmarshal(b, &in)
+			done := "retried"
+			if strings.HasSuffix(r.URL.Path, "discard") {
+				done = "discarded"
+			}
+			_ = json.NewEncoder(w).Encode(map[string]int{done: len(in.IDs) - 1})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	t.Setenv("INGESTCTL_CONFIG", t.TempDir()+"/config.yaml")
+	flags := []string{"--server", ts.URL, "--api-key", "admin"}
+
+	out, err := capture(t, func() error { return dlqList(append(flags, "--sink", "warehouse", "--limit", "5")) })
+	if err != nil || !strings.Contains(out, "warehouse") || !strings.Contains(out, "812") || !strings.Contains(out, "webhook returned 503") {
+		t.Errorf("list: %v\n%s", err, out)
+	}
+	out, err = capture(t, func() error { return dlqRetry(append(flags, "--sink", "warehouse", "812", "813")) })
+	if err != nil || out != "retried 1 of 2\n" {
+		t.Errorf("retry: %v %q", err, out)
+	}
+	out, err = capture(t, func() error { return dlqDiscard(append(flags, "-o", "json", "--sink", "warehouse", "790", "791")) })
+	if err != nil || strings.TrimSpace(out) != `{"discarded":1}` {
+		t.Errorf("discard: %v %q", err, out)
+	}
+	want := []string{
+		`/admin/outbox/dead/retry {"ids":[812,813],"sink":"warehouse"}`,
+		`/admin/outbox/dead/discard {"ids":[790,791],"sink":"warehouse"}`,
+	}
+	if strings.Join(posted, "\n") != strings.Join(want, "\n") {
+		t.Errorf("posted:\n%s\nwant:\n%s", strings.Join(posted, "\n"), strings.Join(want, "\n"))
+	}
+
+	for _, args := range [][]string{
+		{"812"},
+		{"--sink", "warehouse"},
+		{"--sink", "warehouse", "abc"},
+	} {
+		if _, err := capture(t, func() error { return dlqRetry(append(flags, args...)) }); err == nil {
+			t.Errorf("retry %v: no error", args)
+		}
+	}
+	_, err = capture(t, func() error { return dlqList([]string{"--server", ts.URL, "--api-key", "reader"}) })
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("list as non-admin: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/pkg/client"
+)
+
+func eventsList(args []string) error {
+	fs := flag.NewFlagSet("events list", flag.ExitOnError)
+	g := addGlobals(fs)
+	var types, tags, fields stringList
+	fs.Var(&types, "type", "event type pattern (* and ? wildcards), repeatable")
+	fs.Var(&tags, "tag", "required tag, repeatable")
+	fs.Var(&fields, "field", "payload field filter key=value, repeatable")
+	since := fs.String("since", "", "start of the time range: duration ago (1h) or RFC 3339")
+	until := fs.String("until", "", "end of the time range: duration ago or RFC 3339")
+	query := fs.String("query", "", "saved query name")
+	_ = fs.Parse(args)
+	if err := g.validOutput(); err != nil {
+		return err
+	}
+
+	opts := client.ListOptions{Query: *query, Types: types, Tags: tags}
+	for _, f := range fields {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			return fmt.Errorf("--field %q: want key=value", f)
+		}
+		if opts.Fields == nil {
+			opts.Fields = map[string]string{}
+		}
+		opts.Fields[k] = v
+	}
+	var err error
+	if opts.Since, err = parseTime(*since); err != nil {
+		return fmt.Errorf("--since: %w", err)
+	}
+	if opts.Until, err = parseTime(*until); err != nil {
+		return fmt.Errorf("--until: %w", err)
+	}
+
+	c, err := g.client()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	events, err := c.ListEvents(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if g.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(events)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTYPE\tRECEIVED\tTAGS\tPAYLOAD")
+	for _, e := range events {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", e.ID, e.Type, e.ReceivedAt.Local().Format(time.DateTime),
+			strings.Join(e.Tags, ","), truncate(string(e.Payload), 60))
+	}
+	return tw.Flush()
+}
+
+func eventsPost(args []string) error {
+	fs := flag.NewFlagSet("events post", flag.ExitOnError)
+	g := addGlobals(fs)
+	file := fs.String("f", "-", "events as NDJSON or a JSON array")
+	batch := fs.Int("batch", 500, "events per request (max 1000)")
+	_ = fs.Parse(args)
+	if err := g.validOutput(); err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	c, err := g.client()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var sent []client.Event
+	var pending []client.Event
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		out, err := c.SendBatch(ctx, pending)
+		if err != nil {
+			return fmt.Errorf("after %d events: %w", len(sent), err)
+		}
+		sent = append(sent, out...)
+		pending = pending[:0]
+		return nil
+	}
+	err = event.ReadStream(r, func(raw json.RawMessage) error {
+		var e client.Event
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return fmt.Errorf("event %d: %w", len(sent)+len(pending), err)
+		}
+		e.ID, e.ReceivedAt = 0, time.Time{}
+		if pending = append(pending, e); len(pending) >= *batch {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return err
+	}
+	if g.output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(sent)
+	}
+	fmt.Printf("posted %d events\n", len(sent))
+	return nil
+}
+
+// parseTime accepts a duration before now or an RFC 3339 timestamp.
+func parseTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
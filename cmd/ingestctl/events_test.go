@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestEventsList turns the flags into the query of GET /v1/events, and
+// refuses malformed ones before sending anything.
+func TestEventsList(t *testing.T) {
+	var queries []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		_, _ = io.WriteString(w, `[{"id":7,"type":"order.paid","payload":{"total":12},"tags":["eu"],"received_at":"2026-03-01T12:00:00Z"}]`)
+	}))
+	defer ts.Close()
+	t.Setenv("INGESTCTL_CONFIG", t.TempDir()+"/config.yaml")
+	flags := []string{"--server", ts.URL, "--api-key", "reader"}
+
+	out, err := capture(t, func() error {
+		return eventsList(append(flags, "--type", "order.*", "--type", "signup", "--tag", "eu", "--field", "user_id=42", "--until", "2026-03-02T00:00:00Z"))
+	})
+	if err != nil || !strings.Contains(out, "order.paid") || !strings.Contains(out, `{"total":12}`) || !strings.HasPrefix(out, "ID") {
+		t.Errorf("list: %v\n%s", err, out)
+	}
+	want := "payload.user_id=42&tag=eu&type=order.%2A&type=signup&until=2026-03-02T00%3A00%3A00Z"
+	if len(queries) != 1 || queries[0] != want {
+		t.Errorf("queries %q, want %q", queries, want)
+	}
+
+	before := time.Now().Add(-time.Hour)
+	out, err = capture(t, func() error { return eventsList(append(flags, "-o", "json", "--since", "1h")) })
+	var events []struct {
+		ID int64 `json:"id"`
+	}
+	if err != nil || json.Unmarshal([]byte(out), &events) != nil || len(events) != 1 || events[0].ID != 7 {
+		t.Errorf("list as json: %v %s", err, out)
+	}
+	q, _ := url.ParseQuery(queries[len(queries)-1])
+	since, err := time.Parse(time.RFC3339Nano, q.Get("since"))
+	if err != nil || since.Before(before) || since.After(time.Now().Add(-time.Hour)) {
+		t.Errorf("--since 1h sent as %q", queries[len(queries)-1])
+	}
+
+	sent := len(queries)
+	for _, args := range [][]string{
+		{"--field", "user_id"},
+		{"--since", "yesterday"},
+		{"--until", "2026-03-02"},
+		{"-o", "yaml"},
+	} {
+		if _, err := capture(t, func() error { return eventsList(append(flags, args...)) }); err == nil {
+			t.Errorf("list %v: no error", args)
+		}
+	}
+	if len(queries) != sent {
+		t.Errorf("malformed flags reached the server: %q", queries[sent:])
+	}
+}
+
+// TestEventsPost reads events as NDJSON or a JSON array, posts them in
+// batches without their IDs and times, and stops at a malformed event.
+func TestEventsPost(t *testing.T) {
+	var batches []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/events/batch" {
+			http.NotFound(w, r)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		batches = append(batches, string(b))
+		var events []map[string]any
+		_ = json.Unmarshal(b, &events)
+		for i := range events {
+			events[i]["id"] = len(batches)*100 + i
+		}
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(events)
+	}))
+	defer ts.Close()
+	dir := t.TempDir()
+	t.Setenv("INGESTCTL_CONFIG", filepath.Join(dir, "config.yaml"))
+	flags := []string{"--server", ts.URL, "--api-key", "writer"}
+	file := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	ndjson := file("events.ndjson", `{"id":99,"type":"a","payload":{"n":1},"received_at":"2020-01-01T00:00:00Z"}
+
+{"type":"b","payload":{"n":2}}
+{"type":"c","payload":{"n":3}}
+`)
+	out, err := capture(t, func() error { return eventsPost(append(flags, "-f", ndjson, "--batch", "2")) })
+	if err != nil || out != "posted 3 events\n" {
+		t.Fatalf("post ndjson: %v %q", err, out)
+	}
+	if len(batches) != 2 || strings.Contains(batches[0], "99") || strings.Contains(batches[0], "2020") ||
+		!strings.Contains(batches[0], `"type":"a"`) || !strings.Contains(batches[0], `"type":"b"`) || !strings.Contains(batches[1], `"type":"c"`) {
+		t.Errorf("batches:\n%s", strings.Join(batches, "\n"))
+	}
+
+	array := file("events.json", `[{"type":"a","payload":{}}, {"type":"b","payload":{}}]`)
+	out, err = capture(t, func() error { return eventsPost(append(flags, "-o", "json", "-f", array)) })
+	var posted []struct {
+		ID int64 `json:"id"`
+	}
+	if err != nil || json.Unmarshal([]byte(out), &posted) != nil || len(posted) != 2 || posted[0].ID != 300 {
+		t.Errorf("post a json array: %v %s", err, out)
+	}
+
+	batches = nil
+	broken := file("broken.ndjson", "{\"type\":\"a\",\"payload\":{}}\n{\"type\":\"b\",\"payload\":{}}\n{\"type\":1}\n")
+	_, err = capture(t, func() error { return eventsPost(append(flags, "-f", broken, "--batch", "1")) })
+	if err == nil || !strings.Contains(err.Error(), "event 2") {
+		t.Errorf("post a malformed event: %v", err)
+	}
+	if len(batches) != 2 {
+		t.Errorf("%d batches posted before the malformed event, want 2", len(batches))
+	}
+	if _, err := capture(t, func() error { return eventsPost(append(flags, "-f", filepath.Join(dir, "missing.ndjson"))) }); err == nil {
+		t.Error("post a missing file: no error")
+	}
+}
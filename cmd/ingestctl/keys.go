@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// keysCreate generates an API key locally. The service reads keys from its
+// configuration, so the output is the secret for the caller plus the hashed
+// entry to add under auth.api_keys.
+func keysCreate(args []string) error {
+	fs := flag.NewFlagSet("keys create", flag.ExitOnError)
+	id := fs.String("id", "", "key identifier (logged as the principal)")
+	roles := fs.String("roles", "ingest", "comma separated roles: ingest, read, admin, manage")
+	namespaces := fs.String("namespaces", "", "comma separated namespaces the key is limited to (default: all)")
+	output := fs.String("o", "table", "output format: table or json")
+	_ = fs.Parse(args)
+	if *id == "" {
+		return errors.New("--id is required")
+	}
+	var raw [24]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return err
+	}
+	key := "ik_" + hex.EncodeToString(raw[:])
+	sum := sha256.Sum256([]byte(key))
+	hash := hex.EncodeToString(sum[:])
+	roleList := strings.Split(*roles, ",")
+	for _, r := range roleList {
+		switch r {
+		case "ingest", "read", "admin", "manage":
+		default:
+			return fmt.Errorf("unknown role %q", r)
+		}
+	}
+	var nsList []string
+	if *namespaces != "" {
+		nsList = strings.Split(*namespaces, ",")
+	}
+	switch *output {
+	case "json":
+		return json.NewEncoder(os.Stdout).Encode(map[string]any{
+			"id": *id, "key": key, "key_sha256": hash, "roles": roleList, "namespaces": nsList,
+		})
+	case "table":
+		fmt.Printf("key: %s\n\nAdd to the service config (the key itself is not stored):\n\n", key)
+		fmt.Printf("auth:\n  api_keys:\n    - id: %s\n      key_sha256: %s\n      roles: [%s]\n", *id, hash, strings.Join(roleList, ", "))
+		if len(nsList) > 0 {
+			fmt.Printf("      namespaces: [%s]\n", strings.Join(nsList, ", "))
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+}
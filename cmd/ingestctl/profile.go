@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/rafaelosorio/go-ingest-service/pkg/client"
+)
+
+// Profile is a named server configuration.
+type Profile struct {
+	Endpoints []string `yaml:"endpoints"`
+	// APIKeyEnv names the environment variable holding the key, so secrets
+	// stay out of the file; APIKey is used when it is unset.
+	APIKeyEnv string `yaml:"api_key_env,omitempty"`
+	APIKey    string `yaml:"api_key,omitempty"`
+}
+
+type profileFile struct {
+	Current  string              `yaml:"current"`
+	Profiles map[string]*Profile `yaml:"profiles"`
+}
+
+func profilePath() (string, error) {
+	if p := os.Getenv("INGESTCTL_CONFIG"); p != "" {
+		return p, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "ingestctl", "config.yaml"), nil
+}
+
+func loadProfiles() (*profileFile, string, error) {
+	path, err := profilePath()
+	if err != nil {
+		return nil, "", err
+	}
+	pf := &profileFile{Profiles: map[string]*Profile{}}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return pf, path, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if err := yaml.Unmarshal(raw, pf); err != nil {
+		return nil, "", fmt.Errorf("parse %s: %w", path, err)
+	}
+	if pf.Profiles == nil {
+		pf.Profiles = map[string]*Profile{}
+	}
+	return pf, path, nil
+}
+
+func (pf *profileFile) save(path string) error {
+	raw, err := yaml.Marshal(pf)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, raw, 0o600)
+}
+
+// client builds an API client from the selected profile and overrides.
+func (g *globals) client() (*client.Client, error) {
+	var p Profile
+	if g.server == "" || g.apiKey == "" {
+		pf, path, err := loadProfiles()
+		if err != nil {
+			return nil, err
+		}
+		name := g.profile
+		if name == "" {
+			name = pf.Current
+		}
+		if name != "" {
+			sel, ok := pf.Profiles[name]
+			if !ok {
+				return nil, fmt.Errorf("profile %q not found in %s", name, path)
+			}
+			p = *sel
+		}
+	}
+	if g.server != "" {
+		p.Endpoints = strings.Split(g.server, ",")
+	}
+	if len(p.Endpoints) == 0 {
+		p.Endpoints = []string{"http://localhost:8080"}
+	}
+	key := g.apiKey
+	if key == "" && p.APIKeyEnv != "" {
+		key = os.Getenv(p.APIKeyEnv)
+	}
+	if key == "" {
+		key = p.APIKey
+	}
+	var opts []client.Option
+	if key != "" {
+		opts = append(opts, client.WithAPIKey(key))
+	}
+	return client.New(p.Endpoints, opts...)
+}
+
+func profilesList(args []string) error {
+	fs := flag.NewFlagSet("profiles list", flag.ExitOnError)
+	_ = fs.Parse(args)
+	pf, _, err := loadProfiles()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(pf.Profiles))
+	for n := range pf.Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CURRENT\tNAME\tENDPOINTS\tAPI KEY")
+	for _, n := range names {
+		p := pf.Profiles[n]
+		cur := ""
+		if n == pf.Current {
+			cur = "*"
+		}
+		key := "-"
+		switch {
+		case p.APIKeyEnv != "":
+			key = "$" + p.APIKeyEnv
+		case p.APIKey != "":
+			key = "(in file)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", cur, n, strings.Join(p.Endpoints, ","), key)
+	}
+	return tw.Flush()
+}
+
+func profilesSet(args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errors.New("usage: ingestctl profiles set <name> [--server url[,url]] [--api-key-env VAR | --api-key KEY]")
+	}
+	name := args[0]
+	fs := flag.NewFlagSet("profiles set", flag.ExitOnError)
+	server := fs.String("server", "", "server URL(s), comma separated")
+	keyEnv := fs.String("api-key-env", "", "environment variable holding the API key")
+	key := fs.String("api-key", "", "API key stored in the config file")
+	_ = fs.Parse(args[1:])
+	pf, path, err := loadProfiles()
+	if err != nil {
+		return err
+	}
+	p := pf.Profiles[name]
+	if p == nil {
+		p = &Profile{}
+		pf.Profiles[name] = p
+	}
+	if *server != "" {
+		p.Endpoints = strings.Split(*server, ",")
+	}
+	if *keyEnv != "" {
+		p.APIKeyEnv, p.APIKey = *keyEnv, ""
+	}
+	if *key != "" {
+		p.APIKey, p.APIKeyEnv = *key, ""
+	}
+	if pf.Current == "" {
+		pf.Current = name
+	}
+	if err := pf.save(path); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "saved profile %s to %s\n", name, path)
+	return nil
+}
+
+func profilesUse(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: ingestctl profiles use <name>")
+	}
+	pf, path, err := loadProfiles()
+	if err != nil {
+		return err
+	}
+	if _, ok := pf.Profiles[args[0]]; !ok {
+		return fmt.Errorf("profile %q not found in %s", args[0], path)
+	}
+	pf.Current = args[0]
+	return pf.save(path)
+}
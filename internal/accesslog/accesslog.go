@@ -0,0 +1,220 @@
+// Package accesslog writes one structured line per HTTP request: who made
+// it, what it asked for and how it was answered. Successful requests can be
+// sampled at high volume, and sensitive headers are redacted.
+package accesslog
+
+import (
+	"context"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/auth"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+var sampledOut = prometheus.NewCounter(
+	prometheus.CounterOpts{Name: "access_log_sampled_out_total", Help: "Successful requests left out of the access log by sampling"},
+)
+
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{sampledOut}
+}
+
+// alwaysRedacted are the headers carrying credentials.
+var alwaysRedacted = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key", "X-Signature"}
+
+// Logger is the access log. Its Middleware is the "log" route middleware.
+type Logger struct {
+	log     zerolog.Logger
+	headers []string
+	all     bool
+	redact  map[string]bool
+	sampler *sampler
+}
+
+// New builds the access log for cfg, writing to os.Stdout like the service
+// log. fields, e.g. the instance labels, are added to every line.
+func New(cfg config.AccessLogConfig, fields map[string]string) *Logger {
+	l := newLogger(cfg, os.Stdout)
+	if len(fields) > 0 {
+		ctx := l.log.With()
+		for _, k := range slices.Sorted(maps.Keys(fields)) {
+			ctx = ctx.Str(k, fields[k])
+		}
+		l.log = ctx.Logger()
+	}
+	return l
+}
+
+func newLogger(cfg config.AccessLogConfig, out io.Writer) *Logger {
+	if cfg.Format != "json" {
+		out = zerolog.NewConsoleWriter(func(w *zerolog.ConsoleWriter) { w.Out = out })
+	}
+	l := &Logger{
+		log:    zerolog.New(out).With().Timestamp().Logger(),
+		redact: map[string]bool{},
+	}
+	for _, h := range cfg.Headers {
+		if h == "*" {
+			l.all = true
+			continue
+		}
+		l.headers = append(l.headers, http.CanonicalHeaderKey(h))
+	}
+	for _, h := range append(alwaysRedacted, cfg.Redact...) {
+		l.redact[http.CanonicalHeaderKey(h)] = true
+	}
+	if cfg.Sampling.Every > 1 {
+		l.sampler = &sampler{burst: cfg.Sampling.Burst, every: cfg.Sampling.Every}
+	}
+	return l
+}
+
+type ctxKey struct{}
+
+// record collects what later handlers learn about the request.
+type record struct {
+	mu     sync.Mutex
+	caller *auth.Principal
+	tenant string
+}
+
+// Identify records the authenticated caller of the request in ctx and its
+// tenant, if any. Authentication runs after the access log middleware, so
+// it reports the caller back through this.
+func Identify(ctx context.Context, p *auth.Principal, tenant string) {
+	if rec, ok := ctx.Value(ctxKey{}).(*record); ok {
+		rec.mu.Lock()
+		rec.caller, rec.tenant = p, tenant
+		rec.mu.Unlock()
+	}
+}
+
+// Middleware logs each request once it is answered.
+func (l *Logger) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &record{}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), ctxKey{}, rec)))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status/100 == 2 && !l.sampler.keep(start) {
+			sampledOut.Inc()
+			return
+		}
+		level := zerolog.InfoLevel
+		if status >= 500 {
+			level = zerolog.ErrorLevel
+		} else if status >= 400 {
+			level = zerolog.WarnLevel
+		}
+		ev := l.log.WithLevel(level).
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Int("status", status).
+			Int("bytes", ww.BytesWritten()).
+			Dur("duration", time.Since(start)).
+			Str("request_id", middleware.GetReqID(r.Context())).
+			Str("remote_ip", remoteIP(r)).
+			Str("user_agent", r.UserAgent())
+		if rc := chi.RouteContext(r.Context()); rc != nil && rc.RoutePattern() != "" {
+			ev = ev.Str("route", rc.RoutePattern())
+		}
+		rec.mu.Lock()
+		if p := rec.caller; p != nil {
+			// JWT subjects are users or services, not keys
+			if p.Method == "jwt" {
+				ev = ev.Str("subject", p.Subject)
+			} else {
+				ev = ev.Str("key_id", p.Subject)
+			}
+		}
+		if rec.tenant != "" {
+			ev = ev.Str("tenant", rec.tenant)
+		}
+		rec.mu.Unlock()
+		if h := l.requestHeaders(r.Header); h != nil {
+			ev = ev.Dict("headers", h)
+		}
+		ev.Msg("request")
+	})
+}
+
+// requestHeaders returns the configured headers present on the request,
+// with the sensitive ones redacted.
+func (l *Logger) requestHeaders(h http.Header) *zerolog.Event {
+	var d *zerolog.Event
+	add := func(name string, values []string) {
+		if d == nil {
+			d = zerolog.Dict()
+		}
+		if l.redact[name] {
+			d.Str(name, "[redacted]")
+			return
+		}
+		d.Str(name, strings.Join(values, ", "))
+	}
+	if l.all {
+		for _, name := range slices.Sorted(maps.Keys(h)) {
+			add(name, h[name])
+		}
+		return d
+	}
+	for _, name := range l.headers {
+		if values, ok := h[name]; ok {
+			add(name, values)
+		}
+	}
+	return d
+}
+
+// remoteIP is the client address without its port; RealIP has already put
+// X-Forwarded-For or X-Real-IP in it.
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// sampler keeps the first burst successful requests of each second, then
+// one in every.
+type sampler struct {
+	burst, every int
+
+	mu     sync.Mutex
+	second int64
+	seen   int
+}
+
+func (s *sampler) keep(now time.Time) bool {
+	if s == nil {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sec := now.Unix(); sec != s.second {
+		s.second, s.seen = sec, 0
+	}
+	s.seen++
+	if s.seen <= s.burst {
+		return true
+	}
+	return (s.seen-s.burst)%s.every == 0
+}
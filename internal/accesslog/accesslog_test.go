@@ -0,0 +1,71 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/auth"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// TestMiddleware checks the fields of a JSON line, header redaction and
+// that only successful requests are sampled.
+func TestMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	l := newLogger(config.AccessLogConfig{
+		Format:   "json",
+		Sampling: config.AccessLogSampling{Burst: 1, Every: 1000},
+		Headers:  []string{"x-api-key", "Referer"},
+	}, &out)
+	status := http.StatusOK
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Identify(r.Context(), &auth.Principal{Subject: "acme/ci", Method: "api_key"}, "acme")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("hello"))
+	}))
+	serve := func() {
+		req := httptest.NewRequest(http.MethodGet, "/v1/events", nil)
+		req.Header.Set("X-API-Key", "secret")
+		req.Header.Set("Referer", "https://example.com")
+		req.Header.Set("User-Agent", "test")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve()
+	serve()
+	serve()
+	status = http.StatusBadRequest
+	serve()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want the first 200 and the 400:\n%s", len(lines), out.String())
+	}
+	var first struct {
+		Status    int               `json:"status"`
+		Bytes     int               `json:"bytes"`
+		KeyID     string            `json:"key_id"`
+		Tenant    string            `json:"tenant"`
+		UserAgent string            `json:"user_agent"`
+		Headers   map[string]string `json:"headers"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Status != 200 || first.Bytes != 5 || first.KeyID != "acme/ci" || first.Tenant != "acme" || first.UserAgent != "test" {
+		t.Errorf("unexpected line: %s", lines[0])
+	}
+	if first.Headers["X-Api-Key"] != "[redacted]" || first.Headers["Referer"] != "https://example.com" {
+		t.Errorf("headers: %v", first.Headers)
+	}
+	if strings.Contains(out.String(), "secret") {
+		t.Error("API key leaked into the access log")
+	}
+	if !strings.Contains(lines[1], `"status":400`) || !strings.Contains(lines[1], `"level":"warn"`) {
+		t.Errorf("400 line: %s", lines[1])
+	}
+}
@@ -0,0 +1,307 @@
+// Package acl restricts, beyond roles and namespaces, which callers may
+// write or read which event types, e.g. letting a producer key write
+// billing.* without reading it back. Rules name a caller by API key ID or
+// token subject, or every caller by "*", and allow or deny writing, reading
+// or both for type patterns. A matching deny rule wins; otherwise a matching
+// allow rule grants access, and without either the configured default
+// decides. Admins are exempt from a "deny" default, not from deny rules.
+//
+// Writes of a refused type fail. Reads are narrowed: listings leave out the
+// types a caller may not read, and only a query for such types alone, or for
+// types outside those allowed under a "deny" default, fails. Refusals are
+// handed to a callback for the audit trail.
+package acl
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/auth"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+	"github.com/rafaelosorio/go-ingest-service/internal/typematch"
+)
+
+// Actions, effects and the subject of rules for every caller.
+const (
+	Write    = "write"
+	Read     = "read"
+	Allow    = "allow"
+	Deny     = "deny"
+	Everyone = "*"
+)
+
+var (
+	// ErrDenied is returned for a write or read the rules refuse.
+	ErrDenied   = errors.New("denied by the event type ACL")
+	ErrNotFound = errors.New("acl rule not found")
+	ErrInvalid  = errors.New("invalid acl rule")
+)
+
+var denials = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "acl_denials_total", Help: "Requests the event type ACL refused, by action"},
+	[]string{"action"},
+)
+
+// Collectors returns the ACL metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{denials}
+}
+
+// Denial describes a refused request.
+type Denial struct {
+	Action string `json:"action"`
+	// Type is the event type written or the type pattern queried, "*" for
+	// a query without one.
+	Type string `json:"type"`
+	// Rule is the ID of the deny rule that matched; empty when the default
+	// refused.
+	Rule string `json:"rule,omitempty"`
+}
+
+// List holds the rules kept in the store and decides by them.
+type List struct {
+	store       storage.Store
+	defaultDeny bool
+	denied      func(context.Context, Denial)
+
+	mu    sync.RWMutex
+	rules []rule
+}
+
+type rule struct {
+	storage.ACLRule
+	types *typematch.Set
+}
+
+// New loads the rules of store; denied, when not nil, is called with the
+// context of every refused request.
+func New(store storage.Store, cfg config.ACLConfig, denied func(context.Context, Denial)) (*List, error) {
+	saved, err := store.ACLRules(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	l := &List{store: store, defaultDeny: cfg.Default == Deny, denied: denied}
+	for _, r := range saved {
+		l.rules = append(l.rules, compile(r))
+	}
+	return l, nil
+}
+
+func compile(r storage.ACLRule) rule {
+	return rule{ACLRule: r, types: typematch.Compile(r.Types)}
+}
+
+// Default returns what the list decides when no rule matches.
+func (l *List) Default() string {
+	if l.defaultDeny {
+		return Deny
+	}
+	return Allow
+}
+
+// Rules returns the rules, oldest first.
+func (l *List) Rules() []storage.ACLRule {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	out := make([]storage.ACLRule, len(l.rules))
+	for i, r := range l.rules {
+		out[i] = r.ACLRule
+	}
+	return out
+}
+
+// Add validates r and stores it under a new ID.
+func (l *List) Add(ctx context.Context, r storage.ACLRule) (storage.ACLRule, error) {
+	if err := validate(&r); err != nil {
+		return storage.ACLRule{}, err
+	}
+	r.ID, r.CreatedAt = newID(), time.Now().UTC()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.store.SaveACLRule(ctx, r); err != nil {
+		return storage.ACLRule{}, err
+	}
+	l.rules = append(l.rules, compile(r))
+	return r, nil
+}
+
+// Delete removes the rule id, returning it.
+func (l *List) Delete(ctx context.Context, id string) (storage.ACLRule, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := slices.IndexFunc(l.rules, func(r rule) bool { return r.ID == id })
+	if i < 0 {
+		return storage.ACLRule{}, ErrNotFound
+	}
+	if err := l.store.DeleteACLRule(ctx, id); err != nil {
+		return storage.ACLRule{}, err
+	}
+	r := l.rules[i].ACLRule
+	l.rules = slices.Delete(l.rules, i, i+1)
+	return r, nil
+}
+
+func validate(r *storage.ACLRule) error {
+	if r.Subject == "" || len(r.Subject) > 128 {
+		return fmt.Errorf("%w: subject must be 1-128 bytes, an API key ID, token subject or *", ErrInvalid)
+	}
+	if len(r.Actions) == 0 {
+		return fmt.Errorf("%w: actions must list write, read or both", ErrInvalid)
+	}
+	for _, a := range r.Actions {
+		if a != Write && a != Read {
+			return fmt.Errorf("%w: unknown action %q, want write or read", ErrInvalid, a)
+		}
+	}
+	slices.Sort(r.Actions)
+	r.Actions = slices.Compact(r.Actions)
+	if len(r.Types) == 0 {
+		return fmt.Errorf("%w: types must list at least one type pattern", ErrInvalid)
+	}
+	for _, p := range r.Types {
+		if err := typematch.Validate(p); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+	}
+	if r.Effect != Allow && r.Effect != Deny {
+		return fmt.Errorf("%w: effect must be allow or deny, got %q", ErrInvalid, r.Effect)
+	}
+	return nil
+}
+
+// applies reports whether r covers action by p.
+func (r *rule) applies(p *auth.Principal, action string) bool {
+	return (r.Subject == Everyone || r.Subject == p.Subject) && slices.Contains(r.Actions, action)
+}
+
+// Allowed reports whether p may do action on events of type typ. A nil
+// Principal (auth disabled) may do everything.
+func (l *List) Allowed(p *auth.Principal, action, typ string) bool {
+	ok, _ := l.decide(p, action, typ)
+	return ok
+}
+
+// decide returns whether p may do action on typ and, when a deny rule
+// refuses it, that rule's ID.
+func (l *List) decide(p *auth.Principal, action, typ string) (bool, string) {
+	if p == nil {
+		return true, ""
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	ok := !l.defaultDeny || p.Has(auth.RoleAdmin)
+	for i := range l.rules {
+		r := &l.rules[i]
+		if !r.applies(p, action) || !r.types.Match(typ) {
+			continue
+		}
+		if r.Effect == Deny {
+			return false, r.ID
+		}
+		ok = true
+	}
+	return ok, ""
+}
+
+// Check returns ErrDenied, recording the denial, when the caller of ctx may
+// not do action on events of type typ.
+func (l *List) Check(ctx context.Context, action, typ string) error {
+	p, _ := auth.FromContext(ctx)
+	if ok, id := l.decide(p, action, typ); !ok {
+		return l.refuse(ctx, Denial{Action: action, Type: typ, Rule: id})
+	}
+	return nil
+}
+
+// Scope narrows q to the types the caller of ctx may read: the types deny
+// rules cover are left out, and under a "deny" default q keeps to those
+// allow rules cover, all of them when q names none. A type pattern of q
+// lying wholly in a deny rule, or outside every allow rule under a "deny"
+// default, fails with ErrDenied.
+func (l *List) Scope(ctx context.Context, q *storage.Query) error {
+	p, _ := auth.FromContext(ctx)
+	if p == nil {
+		return nil
+	}
+	l.mu.RLock()
+	var allowed, denied []string
+	var denial *Denial
+	for i := range l.rules {
+		r := &l.rules[i]
+		if !r.applies(p, Read) {
+			continue
+		}
+		if r.Effect == Allow {
+			allowed = append(allowed, r.Types...)
+			continue
+		}
+		denied = append(denied, r.Types...)
+		for _, t := range q.Types {
+			if denial == nil && within(t, r.Types) {
+				denial = &Denial{Action: Read, Type: t, Rule: r.ID}
+			}
+		}
+	}
+	l.mu.RUnlock()
+	if denial != nil {
+		return l.refuse(ctx, *denial)
+	}
+	if l.defaultDeny && !p.Has(auth.RoleAdmin) {
+		if len(q.Types) == 0 {
+			if len(allowed) == 0 {
+				return l.refuse(ctx, Denial{Action: Read, Type: Everyone})
+			}
+			q.Types = allowed
+		}
+		for _, t := range q.Types {
+			if !within(t, allowed) {
+				return l.refuse(ctx, Denial{Action: Read, Type: t})
+			}
+		}
+	}
+	if len(denied) > 0 {
+		q.NotTypes = append(slices.Clip(q.NotTypes), denied...)
+	}
+	return nil
+}
+
+func (l *List) refuse(ctx context.Context, d Denial) error {
+	denials.WithLabelValues(d.Action).Inc()
+	if l.denied != nil {
+		l.denied(ctx, d)
+	}
+	return fmt.Errorf("%s type %q: %w", d.Action, d.Type, ErrDenied)
+}
+
+// within reports whether every type matching the pattern p matches one of
+// patterns: a literal p must match one, any other p must equal one or have
+// its literal part, up to the first wildcard, start with the prefix of a
+// prefix pattern.
+func within(p string, patterns []string) bool {
+	if typematch.IsLiteral(p) {
+		return typematch.MatchAny(patterns, p)
+	}
+	literal := p[:strings.IndexAny(p, "*?")]
+	for _, pat := range patterns {
+		if prefix, ok := typematch.Prefix(pat); pat == p || (ok && strings.HasPrefix(literal, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return "acl_" + hex.EncodeToString(b)
+}
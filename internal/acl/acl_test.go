@@ -0,0 +1,115 @@
+package acl
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/auth"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+func as(subject string, roles ...auth.Role) context.Context {
+	return auth.WithPrincipal(context.Background(), &auth.Principal{Subject: subject, Roles: roles})
+}
+
+func newList(t *testing.T, store storage.Store, def string, rules ...storage.ACLRule) (*List, *[]Denial) {
+	t.Helper()
+	var denied []Denial
+	l, err := New(store, config.ACLConfig{Default: def}, func(_ context.Context, d Denial) { denied = append(denied, d) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rules {
+		if _, err := l.Add(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return l, &denied
+}
+
+// TestCheck lets deny rules win over allow rules and the default decide
+// the rest, which under "deny" admins skip.
+func TestCheck(t *testing.T) {
+	l, denied := newList(t, storage.NewMemory(1), Deny,
+		storage.ACLRule{Subject: "producer", Actions: []string{Write}, Types: []string{"billing.*"}, Effect: Allow},
+		storage.ACLRule{Subject: Everyone, Actions: []string{Write, Read}, Types: []string{"billing.secret"}, Effect: Deny},
+	)
+	for _, c := range []struct {
+		ctx    context.Context
+		action string
+		typ    string
+		ok     bool
+	}{
+		{as("producer", auth.RoleIngest), Write, "billing.invoice", true},
+		{as("producer", auth.RoleIngest), Read, "billing.invoice", false},
+		{as("producer", auth.RoleIngest), Write, "order.created", false},
+		{as("producer", auth.RoleIngest), Write, "billing.secret", false},
+		{as("root", auth.RoleAdmin), Read, "order.created", true},
+		{as("root", auth.RoleAdmin), Write, "billing.secret", false},
+		{context.Background(), Write, "billing.secret", true},
+	} {
+		err := l.Check(c.ctx, c.action, c.typ)
+		if (err == nil) != c.ok || (err != nil && !errors.Is(err, ErrDenied)) {
+			t.Errorf("%s %s: %v, want allowed %t", c.action, c.typ, err, c.ok)
+		}
+	}
+	if len(*denied) != 4 || (*denied)[2].Rule == "" || (*denied)[1].Rule != "" {
+		t.Errorf("denials %+v", *denied)
+	}
+}
+
+// TestScope narrows reads to the allowed types without the denied ones and
+// refuses queries for denied types alone.
+func TestScope(t *testing.T) {
+	store := storage.NewMemory(1)
+	newList(t, store, Allow,
+		storage.ACLRule{Subject: "analyst", Actions: []string{Read}, Types: []string{"billing.*"}, Effect: Deny},
+		storage.ACLRule{Subject: "auditor", Actions: []string{Read}, Types: []string{"billing.*", "audit"}, Effect: Allow},
+	)
+	// rules are read back from the store
+	l, _ := newList(t, store, Allow)
+	var q storage.Query
+	if err := l.Scope(as("analyst"), &q); err != nil || len(q.Types) != 0 || !slices.Equal(q.NotTypes, []string{"billing.*"}) {
+		t.Errorf("analyst: %+v, %v", q, err)
+	}
+	for _, types := range [][]string{{"billing.invoice"}, {"billing.in*"}, {"order.*", "billing.*"}} {
+		if err := l.Scope(as("analyst"), &storage.Query{Types: types}); !errors.Is(err, ErrDenied) {
+			t.Errorf("analyst %v: %v, want ErrDenied", types, err)
+		}
+	}
+
+	l, denied := newList(t, store, Deny)
+	q = storage.Query{}
+	if err := l.Scope(as("auditor"), &q); err != nil || !slices.Equal(q.Types, []string{"billing.*", "audit"}) {
+		t.Errorf("auditor: %+v, %v", q, err)
+	}
+	for types, ok := range map[string]bool{"billing.x*": true, "audit": true, "audit*": false, "*": false} {
+		if err := l.Scope(as("auditor"), &storage.Query{Types: []string{types}}); (err == nil) != ok {
+			t.Errorf("auditor %s: %v, want allowed %t", types, err, ok)
+		}
+	}
+	if err := l.Scope(as("analyst"), &storage.Query{}); !errors.Is(err, ErrDenied) || (*denied)[len(*denied)-1].Type != Everyone {
+		t.Errorf("analyst without allow rules: %v", err)
+	}
+}
+
+func TestAddInvalid(t *testing.T) {
+	l, _ := newList(t, storage.NewMemory(1), Allow)
+	for _, r := range []storage.ACLRule{
+		{Actions: []string{Read}, Types: []string{"a"}, Effect: Allow},
+		{Subject: "k", Actions: []string{"delete"}, Types: []string{"a"}, Effect: Allow},
+		{Subject: "k", Actions: []string{Read}, Effect: Allow},
+		{Subject: "k", Actions: []string{Read}, Types: []string{"a[bc]"}, Effect: Allow},
+		{Subject: "k", Actions: []string{Read}, Types: []string{"a"}, Effect: "maybe"},
+	} {
+		if _, err := l.Add(context.Background(), r); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%+v: %v, want ErrInvalid", r, err)
+		}
+	}
+	if _, err := l.Delete(context.Background(), "acl_missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete: %v", err)
+	}
+}
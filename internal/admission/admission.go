@@ -0,0 +1,181 @@
+// Package admission sheds ingest load early, with 429 and Retry-After, when
+// storage writes slow down or the sink queues fill up, instead of letting
+// requests queue until they time out.
+package admission
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/httpx"
+)
+
+var (
+	pressureRatio = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "admission_pressure", Help: "Load relative to the shedding thresholds; requests are shed at 1"},
+	)
+	pressureLevel = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "admission_pressure_level", Help: "Pressure level: 0 normal, 1 elevated, 2 shedding"},
+	)
+	rejectedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "admission_rejected_total", Help: "Requests shed with 429 by cause (write_latency, queue_depth)"},
+		[]string{"cause"},
+	)
+)
+
+// Collectors returns the admission metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{pressureRatio, pressureLevel, rejectedTotal}
+}
+
+type Level int
+
+const (
+	Normal Level = iota
+	// Elevated is at least 75% of a threshold.
+	Elevated
+	// Shedding rejects ingest requests.
+	Shedding
+)
+
+func (l Level) String() string {
+	switch l {
+	case Elevated:
+		return "elevated"
+	case Shedding:
+		return "shedding"
+	default:
+		return "normal"
+	}
+}
+
+// latencyHalfLife is how fast the write latency average decays without new
+// writes, so that shedding stops once the backend had time to catch up.
+const latencyHalfLife = 2 * time.Second
+
+// Controller tracks a moving average of storage write latency and the fill
+// of the sink queues. A disabled Controller still reports the pressure but
+// admits every request.
+type Controller struct {
+	enabled       bool
+	maxLatency    time.Duration
+	maxFill       float64
+	retryAfter    time.Duration
+	failReadiness bool
+	queueFill     func() float64
+
+	mu      sync.Mutex
+	latency float64 // seconds
+	last    time.Time
+}
+
+// New builds a Controller; queueFill returns the fill (0-1) of the fullest
+// write queue.
+func New(cfg config.AdmissionConfig, queueFill func() float64) *Controller {
+	c := &Controller{
+		enabled:       cfg.Enabled,
+		maxLatency:    cfg.MaxWriteLatency,
+		maxFill:       cfg.MaxQueueFill,
+		retryAfter:    cfg.RetryAfter,
+		failReadiness: cfg.FailReadiness,
+		queueFill:     queueFill,
+	}
+	if c.maxLatency <= 0 {
+		c.maxLatency = 250 * time.Millisecond
+	}
+	if c.maxFill <= 0 {
+		c.maxFill = 0.9
+	}
+	if c.retryAfter <= 0 {
+		c.retryAfter = time.Second
+	}
+	return c
+}
+
+// ObserveWrite records the duration of one storage write.
+func (c *Controller) ObserveWrite(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.latency = 0.8*c.decayed(now) + 0.2*d.Seconds()
+	c.last = now
+}
+
+// decayed is the latency average as of now. The caller holds c.mu.
+func (c *Controller) decayed(now time.Time) float64 {
+	if c.last.IsZero() {
+		return 0
+	}
+	return c.latency * math.Exp2(-now.Sub(c.last).Seconds()/latencyHalfLife.Seconds())
+}
+
+// Pressure returns the load relative to the thresholds, the resulting level
+// and, when shedding, the cause.
+func (c *Controller) Pressure() (float64, Level, string) {
+	c.mu.Lock()
+	latency := c.decayed(time.Now()) / c.maxLatency.Seconds()
+	c.mu.Unlock()
+	ratio, cause := latency, "write_latency"
+	if fill := c.queueFill() / c.maxFill; fill > ratio {
+		ratio, cause = fill, "queue_depth"
+	}
+	level := Normal
+	switch {
+	case ratio >= 1:
+		level = Shedding
+	case ratio >= 0.75:
+		level = Elevated
+	}
+	pressureRatio.Set(ratio)
+	pressureLevel.Set(float64(level))
+	return ratio, level, cause
+}
+
+// Readiness reports the pressure level for the readiness check, and whether
+// the instance should be taken out of rotation while shedding.
+func (c *Controller) Readiness() (string, bool) {
+	_, level, _ := c.Pressure()
+	return level.String(), !(c.enabled && c.failReadiness && level == Shedding)
+}
+
+// ErrShedding rejects ingest while shedding.
+var ErrShedding = errors.New("overloaded, retry later")
+
+// Admit returns ErrShedding while shedding, for ingest that does not go
+// through Middleware.
+func (c *Controller) Admit() error {
+	if c.shed() {
+		return ErrShedding
+	}
+	return nil
+}
+
+func (c *Controller) shed() bool {
+	if !c.enabled {
+		return false
+	}
+	_, level, cause := c.Pressure()
+	if level == Shedding {
+		rejectedTotal.WithLabelValues(cause).Inc()
+	}
+	return level == Shedding
+}
+
+// Middleware answers 429 with Retry-After while shedding.
+func (c *Controller) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.shed() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(c.retryAfter.Seconds()))))
+			httpx.Error(w, ErrShedding.Error(), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
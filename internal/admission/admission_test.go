@@ -0,0 +1,70 @@
+package admission
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// TestPressure levels the load against the write latency and queue fill
+// thresholds, and sheds ingest with 429 only when enabled.
+func TestPressure(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		enabled bool
+		writes  []time.Duration
+		fill    float64
+		level   Level
+		cause   string
+		status  int
+	}{
+		{"idle", true, nil, 0, Normal, "write_latency", http.StatusOK},
+		{"fast writes", true, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}, 0.01, Normal, "write_latency", http.StatusOK},
+		{"queue filling", true, nil, 0.72, Elevated, "queue_depth", http.StatusOK},
+		{"queue full", true, []time.Duration{time.Millisecond}, 0.95, Shedding, "queue_depth", http.StatusTooManyRequests},
+		{"slow writes", true, []time.Duration{2 * time.Second, 2 * time.Second}, 0.5, Shedding, "write_latency", http.StatusTooManyRequests},
+		{"disabled", false, []time.Duration{2 * time.Second}, 1, Shedding, "write_latency", http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := New(config.AdmissionConfig{Enabled: tc.enabled, MaxWriteLatency: 100 * time.Millisecond, MaxQueueFill: 0.8, RetryAfter: 1500 * time.Millisecond},
+				func() float64 { return tc.fill })
+			for _, d := range tc.writes {
+				c.ObserveWrite(d)
+			}
+			if _, level, cause := c.Pressure(); level != tc.level || cause != tc.cause {
+				t.Errorf("pressure %s (%s), want %s (%s)", level, cause, tc.level, tc.cause)
+			}
+			rec := httptest.NewRecorder()
+			c.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/events", nil))
+			if rec.Code != tc.status {
+				t.Errorf("status %d, want %d", rec.Code, tc.status)
+			}
+			if shed := tc.status == http.StatusTooManyRequests; shed != (rec.Header().Get("Retry-After") == "2") || shed != (c.Admit() == ErrShedding) {
+				t.Errorf("shed %v: Retry-After %q, Admit %v", shed, rec.Header().Get("Retry-After"), c.Admit())
+			}
+		})
+	}
+}
+
+// TestLatencyDecays stops shedding once writes have been quiet for a while,
+// and takes the instance out of rotation meanwhile only with
+// fail_readiness.
+func TestLatencyDecays(t *testing.T) {
+	for _, failReadiness := range []bool{false, true} {
+		c := New(config.AdmissionConfig{Enabled: true, MaxWriteLatency: 100 * time.Millisecond, FailReadiness: failReadiness}, func() float64 { return 0 })
+		c.ObserveWrite(time.Second)
+		if level, ready := c.Readiness(); level != "shedding" || ready == failReadiness {
+			t.Errorf("fail_readiness %v: %s, ready %v", failReadiness, level, ready)
+		}
+		// four half-lives later the average is 1/16th
+		c.mu.Lock()
+		c.last = c.last.Add(-4 * latencyHalfLife)
+		c.mu.Unlock()
+		if level, ready := c.Readiness(); level != "normal" || !ready {
+			t.Errorf("fail_readiness %v, after a quiet while: %s, ready %v", failReadiness, level, ready)
+		}
+	}
+}
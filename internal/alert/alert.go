@@ -0,0 +1,390 @@
+// Package alert evaluates count-over-window rules against ingested events and
+// notifies webhook, Slack or PagerDuty destinations when they fire or resolve.
+package alert
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+var (
+	ruleFiring = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "alert_rule_firing", Help: "Whether an alert rule is currently firing"},
+		[]string{"rule"},
+	)
+	notificationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "alert_notifications_total", Help: "Alert notifications by notifier and result"},
+		[]string{"notifier", "result"},
+	)
+	evaluationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "alert_rule_evaluations_total", Help: "Alert rule evaluations by result (match, nomatch, error)"},
+		[]string{"rule", "result"},
+	)
+	evaluationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "alert_rule_evaluation_duration_seconds",
+			Help:    "Alert rule evaluation latency per event",
+			Buckets: []float64{.000001, .000005, .00001, .00005, .0001, .0005, .001},
+		},
+		[]string{"rule"},
+	)
+)
+
+// Collectors returns the alerting metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{ruleFiring, notificationsTotal, evaluationsTotal, evaluationDuration, anomaliesTotal, anomalyFiring}
+}
+
+type Status string
+
+const (
+	Firing   Status = "firing"
+	Resolved Status = "resolved"
+	// Digest is the status of the daily digest, which neither fires nor
+	// resolves.
+	Digest Status = "digest"
+)
+
+// Notification describes a rule changing state.
+type Notification struct {
+	Rule      string        `json:"rule"`
+	Status    Status        `json:"status"`
+	Summary   string        `json:"summary"`
+	Severity  string        `json:"severity"`
+	Threshold int           `json:"threshold"`
+	Window    time.Duration `json:"window_ns"`
+	// Since is when the rule started firing.
+	Since time.Time `json:"since"`
+	At    time.Time `json:"at"`
+	// Type, Count and Baseline describe an anomaly: the event type, its
+	// count over the interval just ended and what that count usually is.
+	Type     string  `json:"type,omitempty"`
+	Count    int64   `json:"count,omitempty"`
+	Baseline float64 `json:"baseline,omitempty"`
+	// Report is the summary a digest carries.
+	Report *Report `json:"report,omitempty"`
+
+	notify []string
+}
+
+// rule keeps the arrival times of the last Threshold+1 matching events: the
+// rule fires when the oldest of them is still inside the window.
+type rule struct {
+	cfg    config.AlertRuleConfig
+	query  storage.Query
+	mu     sync.Mutex
+	ring   []time.Time
+	next   int
+	full   bool
+	firing bool
+	since  time.Time
+}
+
+// RuleState is the externally visible state of a rule.
+type RuleState struct {
+	Name      string        `json:"name"`
+	Firing    bool          `json:"firing"`
+	Since     time.Time     `json:"since,omitzero"`
+	Threshold int           `json:"threshold"`
+	Window    time.Duration `json:"window_ns"`
+}
+
+// Engine evaluates rules on every observed event. Notifications are sent by
+// a background worker so slow destinations never block ingest.
+type Engine struct {
+	// mu guards rules and notifiers against AddRules and RemoveRules.
+	mu        sync.RWMutex
+	rules     []*rule
+	notifiers map[string]Notifier
+	queue     chan Notification
+	done      chan struct{}
+	stopped   chan struct{}
+	wg        sync.WaitGroup
+}
+
+// New builds the engine for cfg. Rules referencing a saved query resolve it
+// from saved.
+func New(cfg config.AlertsConfig, saved map[string]config.SavedQueryConfig) (*Engine, error) {
+	en := &Engine{
+		notifiers: map[string]Notifier{},
+		queue:     make(chan Notification, 64),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	for _, nc := range cfg.Notifiers {
+		n, err := newNotifier(nc)
+		if err != nil {
+			return nil, err
+		}
+		en.notifiers[nc.Name] = n
+	}
+	for _, rc := range cfg.Rules {
+		r, err := newRule(rc, saved)
+		if err != nil {
+			return nil, err
+		}
+		en.rules = append(en.rules, r)
+		ruleFiring.WithLabelValues(rc.Name).Set(0)
+	}
+	en.wg.Add(1)
+	go en.deliver()
+	go en.resolveLoop()
+	return en, nil
+}
+
+// AddRules starts evaluating the rules of cfg at runtime, e.g. for a tenant.
+// Its rules may only notify its own notifiers, and no name may already be in
+// use. Nothing is added when cfg is invalid.
+func (en *Engine) AddRules(cfg config.AlertsConfig) error {
+	if err := cfg.Validate(nil); err != nil {
+		return err
+	}
+	if cfg.Anomalies.Enabled || cfg.Digest.Enabled {
+		return fmt.Errorf("anomalies and digest watch the whole service, and cannot be added")
+	}
+	notifiers := map[string]Notifier{}
+	for _, nc := range cfg.Notifiers {
+		n, err := newNotifier(nc)
+		if err != nil {
+			return err
+		}
+		notifiers[nc.Name] = n
+	}
+	rules := make([]*rule, 0, len(cfg.Rules))
+	for _, rc := range cfg.Rules {
+		r, err := newRule(rc, nil)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, r)
+	}
+	en.mu.Lock()
+	defer en.mu.Unlock()
+	for name := range notifiers {
+		if _, ok := en.notifiers[name]; ok {
+			return fmt.Errorf("notifier %s: name already in use", name)
+		}
+	}
+	for _, r := range rules {
+		if slices.ContainsFunc(en.rules, func(have *rule) bool { return have.cfg.Name == r.cfg.Name }) {
+			return fmt.Errorf("rule %s: name already in use", r.cfg.Name)
+		}
+	}
+	maps.Copy(en.notifiers, notifiers)
+	for _, r := range rules {
+		en.rules = append(en.rules, r)
+		ruleFiring.WithLabelValues(r.cfg.Name).Set(0)
+	}
+	return nil
+}
+
+// RemoveRules stops the rules and notifiers of cfg added by AddRules.
+// Notifications already queued for them are dropped.
+func (en *Engine) RemoveRules(cfg config.AlertsConfig) {
+	en.mu.Lock()
+	defer en.mu.Unlock()
+	for _, nc := range cfg.Notifiers {
+		delete(en.notifiers, nc.Name)
+	}
+	for _, rc := range cfg.Rules {
+		en.rules = slices.DeleteFunc(en.rules, func(r *rule) bool { return r.cfg.Name == rc.Name })
+		ruleFiring.DeleteLabelValues(rc.Name)
+	}
+}
+
+func newRule(rc config.AlertRuleConfig, saved map[string]config.SavedQueryConfig) (*rule, error) {
+	f := rc.Filter
+	if rc.Query != "" {
+		var ok bool
+		if f, ok = saved[rc.Query]; !ok {
+			return nil, fmt.Errorf("rule %s: unknown saved query %q", rc.Name, rc.Query)
+		}
+	}
+	q := storage.Query{Types: f.Types, Tags: f.Tags, Fields: f.Fields}
+	if err := q.Validate(); err != nil {
+		return nil, fmt.Errorf("rule %s: %w", rc.Name, err)
+	}
+	if rc.Threshold < 0 || rc.Window <= 0 {
+		return nil, fmt.Errorf("rule %s: threshold must be >= 0 and window > 0", rc.Name)
+	}
+	if rc.Severity == "" {
+		rc.Severity = "error"
+	}
+	return &rule{cfg: rc, query: q.Compile(), ring: make([]time.Time, rc.Threshold+1)}, nil
+}
+
+// Observe feeds an accepted event to every rule. A rule that fails is
+// counted and skipped; the others still see the event.
+func (en *Engine) Observe(e event.Event) {
+	en.mu.RLock()
+	defer en.mu.RUnlock()
+	for _, r := range en.rules {
+		start := time.Now()
+		matched, err := en.evaluate(r, &e)
+		evaluationDuration.WithLabelValues(r.cfg.Name).Observe(time.Since(start).Seconds())
+		switch {
+		case err != nil:
+			evaluationsTotal.WithLabelValues(r.cfg.Name, "error").Inc()
+			log.Error().Err(err).Str("rule", r.cfg.Name).Int64("event", e.ID).Msg("alert rule")
+		case matched:
+			evaluationsTotal.WithLabelValues(r.cfg.Name, "match").Inc()
+		default:
+			evaluationsTotal.WithLabelValues(r.cfg.Name, "nomatch").Inc()
+		}
+	}
+}
+
+func (en *Engine) evaluate(r *rule, e *event.Event) (matched bool, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	if !r.query.Match(e) {
+		return false, nil
+	}
+	if r.record(e.ReceivedAt) {
+		en.notify(r, Firing, e.ReceivedAt)
+	}
+	return true, nil
+}
+
+// record adds a matching arrival and reports whether the rule started firing.
+func (r *rule) record(at time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ring[r.next] = at
+	r.next = (r.next + 1) % len(r.ring)
+	if r.next == 0 {
+		r.full = true
+	}
+	if r.firing || !r.over(at) {
+		return false
+	}
+	r.firing, r.since = true, at
+	return true
+}
+
+// over reports whether more than Threshold events arrived in the window
+// ending at now. The caller holds r.mu.
+func (r *rule) over(now time.Time) bool {
+	return r.full && now.Sub(r.ring[r.next]) < r.cfg.Window
+}
+
+func (en *Engine) resolveLoop() {
+	defer close(en.stopped)
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-en.done:
+			return
+		case now := <-t.C:
+			en.mu.RLock()
+			for _, r := range en.rules {
+				r.mu.Lock()
+				resolve := r.firing && !r.over(now)
+				if resolve {
+					r.firing = false
+				}
+				r.mu.Unlock()
+				if resolve {
+					en.notify(r, Resolved, now)
+				}
+			}
+			en.mu.RUnlock()
+		}
+	}
+}
+
+func (en *Engine) notify(r *rule, status Status, at time.Time) {
+	if status == Firing {
+		ruleFiring.WithLabelValues(r.cfg.Name).Set(1)
+	} else {
+		ruleFiring.WithLabelValues(r.cfg.Name).Set(0)
+	}
+	en.send(Notification{
+		Rule:      r.cfg.Name,
+		Status:    status,
+		Summary:   fmt.Sprintf("%s: more than %d matching events in %s", r.cfg.Name, r.cfg.Threshold, r.cfg.Window),
+		Severity:  r.cfg.Severity,
+		Threshold: r.cfg.Threshold,
+		Window:    r.cfg.Window,
+		Since:     r.since,
+		At:        at,
+		notify:    r.cfg.Notify,
+	})
+}
+
+// send queues n for its notifiers, dropping it when the queue is full.
+func (en *Engine) send(n Notification) {
+	log.Warn().Str("rule", n.Rule).Str("status", string(n.Status)).Msg("alert")
+	select {
+	case en.queue <- n:
+	default:
+		for _, name := range n.notify {
+			notificationsTotal.WithLabelValues(name, "dropped").Inc()
+		}
+	}
+}
+
+func (en *Engine) deliver() {
+	defer en.wg.Done()
+	for n := range en.queue {
+		for _, name := range n.notify {
+			en.mu.RLock()
+			notifier, ok := en.notifiers[name]
+			en.mu.RUnlock()
+			if !ok {
+				// removed since the rule fired
+				notificationsTotal.WithLabelValues(name, "dropped").Inc()
+				continue
+			}
+			if err := notifier.Notify(n); err != nil {
+				notificationsTotal.WithLabelValues(name, "failed").Inc()
+				log.Error().Err(err).Str("notifier", name).Str("rule", n.Rule).Msg("alert notification")
+				continue
+			}
+			notificationsTotal.WithLabelValues(name, "sent").Inc()
+		}
+	}
+}
+
+// QueueDepth returns the number of notifications waiting to be sent.
+func (en *Engine) QueueDepth() int { return len(en.queue) }
+
+// Rules returns the current state of every rule.
+func (en *Engine) Rules() []RuleState {
+	en.mu.RLock()
+	defer en.mu.RUnlock()
+	out := make([]RuleState, 0, len(en.rules))
+	for _, r := range en.rules {
+		r.mu.Lock()
+		st := RuleState{Name: r.cfg.Name, Firing: r.firing, Threshold: r.cfg.Threshold, Window: r.cfg.Window}
+		if r.firing {
+			st.Since = r.since
+		}
+		r.mu.Unlock()
+		out = append(out, st)
+	}
+	return out
+}
+
+// Close stops evaluation and sends pending notifications. Observe must not
+// be called afterwards.
+func (en *Engine) Close() {
+	close(en.done)
+	<-en.stopped
+	close(en.queue)
+	en.wg.Wait()
+}
@@ -0,0 +1,54 @@
+package alert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+func count(c prometheus.Counter) float64 {
+	var m dto.Metric
+	_ = c.Write(&m)
+	return m.GetCounter().GetValue()
+}
+
+// TestObserveIsolatesRules counts every rule's evaluations and keeps
+// evaluating the others when one of them fails.
+func TestObserveIsolatesRules(t *testing.T) {
+	en, err := New(config.AlertsConfig{Rules: []config.AlertRuleConfig{
+		{Name: "broken", Filter: config.SavedQueryConfig{Types: []string{"order.*"}}, Window: time.Minute},
+		{Name: "orders", Filter: config.SavedQueryConfig{Types: []string{"order.*"}}, Threshold: 1, Window: time.Minute},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer en.Close()
+	// a rule whose state is corrupt panics on every match
+	en.rules[0].ring = nil
+
+	now := time.Now()
+	for _, typ := range []string{"order.paid", "user.signup", "order.paid"} {
+		en.Observe(event.Event{Type: typ, ReceivedAt: now})
+	}
+	for _, tc := range []struct {
+		rule, result string
+		want         float64
+	}{
+		{"broken", "error", 2},
+		{"broken", "nomatch", 1},
+		{"orders", "match", 2},
+		{"orders", "nomatch", 1},
+	} {
+		if got := count(evaluationsTotal.WithLabelValues(tc.rule, tc.result)); got != tc.want {
+			t.Errorf("%s %s: %v evaluations, want %v", tc.rule, tc.result, got, tc.want)
+		}
+	}
+	if states := en.Rules(); states[0].Firing || !states[1].Firing {
+		t.Errorf("rules: %+v", states)
+	}
+}
@@ -0,0 +1,58 @@
+package alert
+
+import (
+	"slices"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// Period is a stretch of time during which a rule would have fired. End is
+// when the count fell back to the threshold, which may lie after the last
+// replayed event.
+type Period struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// BacktestResult summarizes how a rule would have behaved on past events.
+type BacktestResult struct {
+	Rule    string   `json:"rule"`
+	Events  int      `json:"events"`
+	Matched int      `json:"matched"`
+	Firings []Period `json:"firings"`
+}
+
+// Backtest replays events in arrival order through rc, without notifying,
+// and reports every period during which the rule would have fired.
+func Backtest(rc config.AlertRuleConfig, saved map[string]config.SavedQueryConfig, events []event.Event) (*BacktestResult, error) {
+	r, err := newRule(rc, saved)
+	if err != nil {
+		return nil, err
+	}
+	events = slices.Clone(events)
+	slices.SortStableFunc(events, func(a, b event.Event) int { return a.ReceivedAt.Compare(b.ReceivedAt) })
+
+	res := &BacktestResult{Rule: rc.Name, Events: len(events), Firings: []Period{}}
+	for i := range events {
+		e := &events[i]
+		if !r.query.Match(e) {
+			continue
+		}
+		res.Matched++
+		if r.firing && !r.over(e.ReceivedAt) {
+			// the oldest remembered arrival left the window before this event
+			r.firing = false
+			res.Firings[len(res.Firings)-1].End = r.ring[r.next].Add(r.cfg.Window)
+		}
+		if r.record(e.ReceivedAt) {
+			res.Firings = append(res.Firings, Period{Start: e.ReceivedAt})
+		}
+	}
+	if r.firing {
+		// with no further events the count drops once the window has passed
+		res.Firings[len(res.Firings)-1].End = r.ring[r.next].Add(r.cfg.Window)
+	}
+	return res, nil
+}
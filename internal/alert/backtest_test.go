@@ -0,0 +1,47 @@
+package alert
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// TestBacktest replays events given out of order and reports when the rule
+// would have fired, and when the count fell back to the threshold.
+func TestBacktest(t *testing.T) {
+	t0 := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(s int) time.Time { return t0.Add(time.Duration(s) * time.Second) }
+	var events []event.Event
+	for _, s := range []int{215, 0, 20, 10, 50, 200, 210} {
+		events = append(events, event.Event{Type: "order.failed", ReceivedAt: at(s)})
+	}
+	events = append(events, event.Event{Type: "order.paid", ReceivedAt: at(30)})
+
+	rc := config.AlertRuleConfig{Name: "failures", Filter: config.SavedQueryConfig{Types: []string{"order.failed"}}, Threshold: 2, Window: time.Minute}
+	res, err := Backtest(rc, nil, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &BacktestResult{Rule: "failures", Events: 8, Matched: 7, Firings: []Period{
+		// the third failure within a minute, until the one at 10s leaves it
+		{Start: at(20), End: at(70)},
+		// still firing after the last event, until the one at 200s leaves
+		{Start: at(215), End: at(260)},
+	}}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("got %+v\nwant %+v", res, want)
+	}
+
+	// a higher threshold never fires on the same events
+	rc.Threshold = 4
+	if res, err := Backtest(rc, nil, events); err != nil || len(res.Firings) != 0 {
+		t.Errorf("threshold 4: %+v %v", res, err)
+	}
+	rc.Query = "unknown"
+	if _, err := Backtest(rc, nil, events); err == nil {
+		t.Error("backtest of a rule on an unknown saved query did not fail")
+	}
+}
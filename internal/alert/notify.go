@@ -0,0 +1,125 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/egress"
+)
+
+const pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// Notifier delivers a notification to one destination.
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+func newNotifier(cfg config.NotifierConfig) (Notifier, error) {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	var policy *egress.Policy
+	if cfg.Egress != nil {
+		var err error
+		if policy, err = egress.New(*cfg.Egress); err != nil {
+			return nil, fmt.Errorf("notifier %s: %w", cfg.Name, err)
+		}
+	}
+	p := poster{name: cfg.Name, url: cfg.URL, headers: cfg.Headers, client: policy.Client(timeout)}
+	switch cfg.Kind {
+	case "webhook":
+		return webhook{p}, nil
+	case "slack":
+		return slack{p}, nil
+	case "pagerduty":
+		if p.url == "" {
+			p.url = pagerDutyURL
+		}
+		return pagerDuty{poster: p, routingKey: cfg.RoutingKey}, nil
+	default:
+		return nil, fmt.Errorf("notifier %s: unknown kind %q", cfg.Name, cfg.Kind)
+	}
+}
+
+// poster POSTs JSON bodies and expects a 2xx answer.
+type poster struct {
+	name    string
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func (p poster) post(v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range p.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("notifier %s: unexpected status %d", p.name, resp.StatusCode)
+	}
+	return nil
+}
+
+// webhook sends the notification as is.
+type webhook struct{ poster }
+
+func (w webhook) Notify(n Notification) error { return w.post(n) }
+
+// slack posts a text message to an incoming webhook.
+type slack struct{ poster }
+
+func (s slack) Notify(n Notification) error {
+	icon := ":rotating_light:"
+	switch n.Status {
+	case Resolved:
+		icon = ":white_check_mark:"
+	case Digest:
+		icon = ":bar_chart:"
+	}
+	return s.post(map[string]string{"text": fmt.Sprintf("%s [%s] %s", icon, n.Status, n.Summary)})
+}
+
+// pagerDuty triggers and resolves incidents through the Events API v2,
+// deduplicated per rule.
+type pagerDuty struct {
+	poster
+	routingKey string
+}
+
+func (p pagerDuty) Notify(n Notification) error {
+	action := "trigger"
+	if n.Status == Resolved {
+		action = "resolve"
+	}
+	return p.post(map[string]any{
+		"routing_key":  p.routingKey,
+		"event_action": action,
+		"dedup_key":    "go-ingest-service/" + n.Rule,
+		"payload": map[string]any{
+			"summary":   n.Summary,
+			"source":    "go-ingest-service",
+			"severity":  n.Severity,
+			"timestamp": n.Since.Format(time.RFC3339),
+		},
+	})
+}
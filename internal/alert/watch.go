@@ -0,0 +1,378 @@
+package alert
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+// Types of the events the watcher emits, with a Notification as payload.
+const (
+	AnomalyType = "_system.anomaly"
+	DigestType  = "_system.digest"
+)
+
+// Kinds of anomaly.
+const (
+	Silence = "silence"
+	Spike   = "spike"
+)
+
+var (
+	anomaliesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "alert_anomalies_total", Help: "Anomalies detected in the ingest rate of event types, by kind (silence, spike)"},
+		[]string{"kind"},
+	)
+	anomalyFiring = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "alert_anomaly_firing", Help: "Whether an event type's ingest rate is anomalous, by type and kind"},
+		[]string{"type", "kind"},
+	)
+)
+
+// baseline is what the count of a type per interval usually is.
+type baseline struct {
+	rate float64
+	// anomaly is the kind firing, if any, since when
+	anomaly string
+	since   time.Time
+}
+
+// Watcher watches the count of each event type per interval, across every
+// instance sharing the store, against its baseline, and sends the daily
+// digest. Only the leader watches: a new leader primes the baselines from
+// the store again.
+type Watcher struct {
+	en       *Engine
+	store    storage.Store
+	cfg      config.AlertsConfig
+	notTypes []string
+	leading  func() bool
+	emit     func(event.Event)
+
+	mu     sync.Mutex
+	types  map[string]*baseline
+	primed bool
+	// fired counts the anomalies since the last digest
+	fired int
+}
+
+// Watch returns a watcher for the anomalies and digest of cfg, which hands
+// the events it emits to emit. Types starting with one of reserved are left
+// out.
+func (en *Engine) Watch(cfg config.AlertsConfig, store storage.Store, reserved []string, leading func() bool, emit func(event.Event)) *Watcher {
+	w := &Watcher{en: en, store: store, cfg: cfg, leading: leading, emit: emit, types: map[string]*baseline{}}
+	for _, p := range reserved {
+		w.notTypes = append(w.notTypes, p+"*")
+	}
+	return w
+}
+
+// Run checks the anomalies every interval and sends the digest every day,
+// until ctx is done.
+func (w *Watcher) Run(ctx context.Context) {
+	var tick, digest <-chan time.Time
+	if w.cfg.Anomalies.Enabled {
+		t := time.NewTicker(w.cfg.Anomalies.Interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	var timer *time.Timer
+	if w.cfg.Digest.Enabled {
+		timer = time.NewTimer(time.Until(w.nextDigest(time.Now())))
+		defer timer.Stop()
+		digest = timer.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick:
+			w.tick(ctx, now)
+		case now := <-digest:
+			w.sendDigest(ctx, now)
+			timer.Reset(time.Until(w.nextDigest(now)))
+		}
+	}
+}
+
+// nextDigest returns when the digest after now is due.
+func (w *Watcher) nextDigest(now time.Time) time.Time {
+	h, m := w.cfg.Digest.DigestTime()
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), h, m, 0, 0, time.UTC)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// tick compares the counts of the interval ended at now with the
+// baselines, priming them first when this instance just started leading.
+func (w *Watcher) tick(ctx context.Context, now time.Time) {
+	if !w.leading() {
+		w.mu.Lock()
+		w.primed = false
+		w.mu.Unlock()
+		return
+	}
+	a := w.cfg.Anomalies
+	w.mu.Lock()
+	primed := w.primed
+	w.mu.Unlock()
+	if !primed {
+		counts, err := w.counts(ctx, now.Add(-a.Baseline), now, a.Types)
+		if err != nil {
+			log.Error().Err(err).Msg("prime anomaly baselines")
+			return
+		}
+		w.prime(counts)
+		return
+	}
+	counts, err := w.counts(ctx, now.Add(-a.Interval), now, a.Types)
+	if err != nil {
+		log.Error().Err(err).Msg("count events for anomalies")
+		return
+	}
+	for _, n := range w.compare(counts, now) {
+		w.en.send(n)
+		w.emitNotification(AnomalyType, n)
+	}
+}
+
+// counts returns the number of events of each type watched received in
+// [since, until).
+func (w *Watcher) counts(ctx context.Context, since, until time.Time, types []string) (map[string]int64, error) {
+	st, err := w.store.Stats(ctx, storage.Query{Types: types, NotTypes: w.notTypes, Since: since, Until: until}, until.Sub(since))
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(st.Types))
+	for _, t := range st.Types {
+		counts[t.Type] = t.Count
+	}
+	return counts, nil
+}
+
+// prime sets the baselines to the mean count per interval of counts,
+// taken over the baseline.
+func (w *Watcher) prime(counts map[string]int64) {
+	intervals := float64(w.cfg.Anomalies.Baseline) / float64(w.cfg.Anomalies.Interval)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	clear(w.types)
+	for typ, n := range counts {
+		w.types[typ] = &baseline{rate: float64(n) / intervals}
+	}
+	w.primed = true
+	log.Info().Int("types", len(counts)).Msg("anomaly baselines primed")
+}
+
+// compare checks counts, over the interval ended at now, against the
+// baselines and moves them on, returning the anomalies that fired or
+// resolved. A type seen for the first time starts at its count; a type
+// stays out of its baseline while it is anomalous.
+func (w *Watcher) compare(counts map[string]int64, now time.Time) []Notification {
+	a := w.cfg.Anomalies
+	weight := min(float64(a.Interval)/float64(a.Baseline), 1)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var out []Notification
+	for typ := range counts {
+		if _, ok := w.types[typ]; !ok {
+			w.types[typ] = &baseline{rate: float64(counts[typ])}
+		}
+	}
+	for _, typ := range slices.Sorted(maps.Keys(w.types)) {
+		b, n := w.types[typ], counts[typ]
+		anomaly := ""
+		switch {
+		case n == 0 && b.rate >= a.MinEvents:
+			anomaly = Silence
+		case float64(n) >= a.MinEvents && float64(n) > a.SpikeFactor*b.rate:
+			anomaly = Spike
+		}
+		if anomaly != b.anomaly {
+			if b.anomaly != "" {
+				anomalyFiring.DeleteLabelValues(typ, b.anomaly)
+				out = append(out, w.anomaly(typ, b, Resolved, n, now))
+			}
+			if anomaly != "" {
+				b.since = now
+				anomaliesTotal.WithLabelValues(anomaly).Inc()
+				anomalyFiring.WithLabelValues(typ, anomaly).Set(1)
+				w.fired++
+			}
+			b.anomaly = anomaly
+			if anomaly != "" {
+				out = append(out, w.anomaly(typ, b, Firing, n, now))
+			}
+		}
+		if anomaly != "" {
+			continue
+		}
+		b.rate += weight * (float64(n) - b.rate)
+		// a type that stopped sending long ago is forgotten
+		if b.rate < 0.01 {
+			delete(w.types, typ)
+		}
+	}
+	return out
+}
+
+// anomaly describes b, the baseline of typ, firing or resolving with n
+// events over the interval ended at now.
+func (w *Watcher) anomaly(typ string, b *baseline, status Status, n int64, now time.Time) Notification {
+	a := w.cfg.Anomalies
+	var summary string
+	switch {
+	case status == Resolved:
+		summary = fmt.Sprintf("%s is back to normal: %d events in %s, usually %.1f", typ, n, a.Interval, b.rate)
+	case b.anomaly == Silence:
+		summary = fmt.Sprintf("%s went silent: no events in %s, usually %.1f", typ, a.Interval, b.rate)
+	default:
+		summary = fmt.Sprintf("%s spiked: %d events in %s, usually %.1f", typ, n, a.Interval, b.rate)
+	}
+	return Notification{
+		Rule:     "anomaly/" + typ,
+		Status:   status,
+		Summary:  summary,
+		Severity: a.Severity,
+		Window:   a.Interval,
+		Since:    b.since,
+		At:       now,
+		Type:     typ,
+		Count:    n,
+		Baseline: b.rate,
+		notify:   a.Notify,
+	}
+}
+
+// Report summarizes a day of ingest for the digest.
+type Report struct {
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+	Total int64     `json:"total"`
+	// PreviousTotal is the total of the day before.
+	PreviousTotal int64 `json:"previous_total"`
+	// Types are the busiest types of the day, with their count the day
+	// before.
+	Types []ReportType `json:"types"`
+	// New are the types sent during the day but not the day before;
+	// Silent the other way round.
+	New    []string `json:"new"`
+	Silent []string `json:"silent"`
+	// Anomalies counts those that fired since the last digest.
+	Anomalies int `json:"anomalies"`
+}
+
+type ReportType struct {
+	Type     string `json:"type"`
+	Count    int64  `json:"count"`
+	Previous int64  `json:"previous"`
+}
+
+// sendDigest reports on the day ended at now, when leading.
+func (w *Watcher) sendDigest(ctx context.Context, now time.Time) {
+	if !w.leading() {
+		return
+	}
+	day, err := w.counts(ctx, now.Add(-24*time.Hour), now, nil)
+	if err != nil {
+		log.Error().Err(err).Msg("count events for the digest")
+		return
+	}
+	prev, err := w.counts(ctx, now.Add(-48*time.Hour), now.Add(-24*time.Hour), nil)
+	if err != nil {
+		log.Error().Err(err).Msg("count events for the digest")
+		return
+	}
+	w.mu.Lock()
+	fired := w.fired
+	w.fired = 0
+	w.mu.Unlock()
+	r := report(day, prev, w.cfg.Digest.Top)
+	r.Since, r.Until, r.Anomalies = now.Add(-24*time.Hour).UTC(), now.UTC(), fired
+	n := Notification{
+		Rule:    "digest",
+		Status:  Digest,
+		Summary: r.summary(),
+		At:      now,
+		Report:  &r,
+		notify:  w.cfg.Digest.Notify,
+	}
+	w.en.send(n)
+	w.emitNotification(DigestType, n)
+}
+
+// report compares the counts of a day with those of the day before,
+// listing the top busiest types.
+func report(day, prev map[string]int64, top int) Report {
+	r := Report{Types: []ReportType{}, New: []string{}, Silent: []string{}}
+	for typ, n := range day {
+		r.Total += n
+		r.Types = append(r.Types, ReportType{Type: typ, Count: n, Previous: prev[typ]})
+		if prev[typ] == 0 {
+			r.New = append(r.New, typ)
+		}
+	}
+	for typ, n := range prev {
+		r.PreviousTotal += n
+		if day[typ] == 0 {
+			r.Silent = append(r.Silent, typ)
+		}
+	}
+	slices.SortFunc(r.Types, func(a, b ReportType) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Type, b.Type))
+	})
+	r.Types = r.Types[:min(top, len(r.Types))]
+	slices.Sort(r.New)
+	slices.Sort(r.Silent)
+	return r
+}
+
+// summary is the digest in a line of text, for Slack.
+func (r Report) summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Ingest digest for the day to %s: %d events", r.Until.Format("2006-01-02 15:04 MST"), r.Total)
+	if r.PreviousTotal > 0 {
+		fmt.Fprintf(&b, " (%+.0f%% on the day before)", 100*float64(r.Total-r.PreviousTotal)/float64(r.PreviousTotal))
+	}
+	if len(r.Types) > 0 {
+		busiest := make([]string, len(r.Types))
+		for i, t := range r.Types {
+			busiest[i] = fmt.Sprintf("%s %d", t.Type, t.Count)
+		}
+		b.WriteString("; busiest: " + strings.Join(busiest, ", "))
+	}
+	if len(r.New) > 0 {
+		b.WriteString("; new: " + strings.Join(r.New, ", "))
+	}
+	if len(r.Silent) > 0 {
+		b.WriteString("; silent: " + strings.Join(r.Silent, ", "))
+	}
+	fmt.Fprintf(&b, "; %d anomalies", r.Anomalies)
+	return b.String()
+}
+
+// emitNotification hands n to emit as an event of type typ.
+func (w *Watcher) emitNotification(typ string, n Notification) {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		log.Error().Err(err).Msg("encode alert event")
+		return
+	}
+	w.emit(event.Event{Type: typ, Payload: payload})
+}
@@ -0,0 +1,60 @@
+package alert
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// TestCompare fires and resolves silences and spikes against baselines.
+func TestCompare(t *testing.T) {
+	w := (&Engine{}).Watch(config.AlertsConfig{Anomalies: config.AnomalyConfig{
+		Enabled: true, Interval: time.Minute, Baseline: time.Hour, MinEvents: 10, SpikeFactor: 5,
+	}}, nil, nil, nil, nil)
+	w.prime(map[string]int64{"order.paid": 1200, "debug.trace": 60})
+	now := time.Now()
+	step := func(counts map[string]int64) []string {
+		now = now.Add(time.Minute)
+		var got []string
+		for _, n := range w.compare(counts, now) {
+			got = append(got, string(n.Status)+" "+n.Type+" "+w.types[n.Type].anomaly)
+		}
+		return got
+	}
+
+	if got := step(map[string]int64{"order.paid": 21, "debug.trace": 0}); got != nil {
+		t.Fatalf("normal interval: %v", got)
+	}
+	// debug.trace averages 1 an interval, too few for its silence to count
+	if got := step(map[string]int64{"debug.trace": 0}); !slices.Equal(got, []string{"firing order.paid silence"}) {
+		t.Fatalf("silent interval: %v", got)
+	}
+	rate := w.types["order.paid"].rate
+	if got := step(nil); got != nil || w.types["order.paid"].rate != rate {
+		t.Fatalf("still silent: %v, baseline %v then %v", got, rate, w.types["order.paid"].rate)
+	}
+	if got := step(map[string]int64{"order.paid": 500}); !slices.Equal(got, []string{"resolved order.paid spike", "firing order.paid spike"}) {
+		t.Fatalf("silence turning into a spike: %v", got)
+	}
+	if got := step(map[string]int64{"order.paid": 20}); !slices.Equal(got, []string{"resolved order.paid "}) {
+		t.Fatalf("back to normal: %v", got)
+	}
+	// a type seen for the first time is its own baseline
+	if got := step(map[string]int64{"order.paid": 20, "user.signup": 400}); got != nil {
+		t.Fatalf("new type: %v", got)
+	}
+	if w.fired != 2 {
+		t.Errorf("fired %d anomalies, want 2", w.fired)
+	}
+}
+
+func TestReport(t *testing.T) {
+	r := report(map[string]int64{"a": 5, "b": 50, "c": 7}, map[string]int64{"a": 10, "d": 3}, 2)
+	want := []ReportType{{Type: "b", Count: 50}, {Type: "c", Count: 7}}
+	if r.Total != 62 || r.PreviousTotal != 13 || !slices.Equal(r.Types, want) ||
+		!slices.Equal(r.New, []string{"b", "c"}) || !slices.Equal(r.Silent, []string{"d"}) {
+		t.Errorf("report: %+v", r)
+	}
+}
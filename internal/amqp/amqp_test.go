@@ -0,0 +1,235 @@
+package amqp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// broker is a fake RabbitMQ speaking just enough AMQP for one client: it
+// confirms published messages (nacking those routed to "nack"), and
+// delivers its queue on consume, recording how each delivery was settled.
+type broker struct {
+	t     *testing.T
+	lis   net.Listener
+	queue [][]byte
+
+	mu        sync.Mutex
+	published []Delivery
+	settled   map[uint64]string
+}
+
+func newBroker(t *testing.T, queue ...[]byte) *broker {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &broker{t: t, lis: lis, queue: queue, settled: map[uint64]string{}}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = lis.Close() })
+	return b
+}
+
+func (b *broker) url() string { return "amqp://guest:guest@" + b.lis.Addr().String() + "/" }
+
+func (b *broker) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	send := func(ch uint16, m *builder) { _, _ = conn.Write(appendFrame(nil, frameMethod, ch, m.b)) }
+	next := func() frame {
+		f, err := readFrame(rd, 0)
+		if err != nil {
+			panic(err)
+		}
+		return f
+	}
+	defer func() { _ = recover() }()
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(rd, header); err != nil || string(header) != "AMQP\x00\x00\x09\x01" {
+		return
+	}
+	send(0, method(classConnection, connectionStart).octet(0).octet(9).table(nil).longstr("AMQPLAIN PLAIN").longstr("en_US"))
+	p := &parser{b: next().payload}
+	p.skipTable()
+	p.shortstr()
+	if auth := p.longstr(); auth != "\x00guest\x00guest" {
+		b.t.Errorf("auth %q", auth)
+	}
+	// a small frame_max splits bodies over several frames
+	send(0, method(classConnection, connectionTune).short(0).long(4096).short(0))
+	next() // tune-ok
+	next() // open
+	send(0, method(classConnection, connectionOpenOk).shortstr(""))
+	next() // channel open
+	send(channel, method(classChannel, channelOpenOk).longstr(""))
+
+	var tag uint64
+	for {
+		f := next()
+		switch {
+		case f.class == classConfirm && f.method == confirmSelect:
+			send(channel, method(classConfirm, confirmSelectOk))
+		case f.class == classBasic && f.method == basicQos:
+			send(channel, method(classBasic, basicQosOk))
+		case f.class == classBasic && f.method == basicConsume:
+			send(channel, method(classBasic, basicConsumeOk).shortstr("ctag"))
+			for i, body := range b.queue {
+				send(channel, method(classBasic, basicDeliver).shortstr("ctag").longlong(uint64(i+1)).bits(false).shortstr("in").shortstr("k"))
+				_, _ = conn.Write(appendFrame(nil, frameHeader, channel, contentHeader(len(body), Properties{CorrelationID: "c1", MessageID: "m1"})))
+				_, _ = conn.Write(appendFrame(nil, frameBody, channel, body))
+			}
+		case f.class == classBasic && (f.method == basicAck || f.method == basicNack):
+			p := &parser{b: f.payload}
+			t, bits := p.longlong(), p.octet()
+			result := "ack"
+			if f.method == basicNack {
+				result = "drop"
+				if bits&2 != 0 {
+					result = "requeue"
+				}
+			}
+			b.mu.Lock()
+			b.settled[t] = result
+			b.mu.Unlock()
+		case f.class == classBasic && f.method == basicPublish:
+			p := &parser{b: f.payload}
+			p.short()
+			d := Delivery{Exchange: p.shortstr(), RoutingKey: p.shortstr()}
+			size, props, err := parseContentHeader(next().payload)
+			if err != nil {
+				b.t.Error(err)
+				return
+			}
+			d.Properties = props
+			for uint64(len(d.Body)) < size {
+				d.Body = append(d.Body, next().payload...)
+			}
+			b.mu.Lock()
+			b.published = append(b.published, d)
+			b.mu.Unlock()
+			tag++
+			reply := basicAck
+			if d.RoutingKey == "nack" {
+				reply = basicNack
+			}
+			send(channel, method(classBasic, uint16(reply)).longlong(tag).bits(false))
+		case f.class == classConnection && f.method == connectionClose:
+			send(0, method(classConnection, connectionCloseOk))
+			return
+		}
+	}
+}
+
+func TestPublishConfirms(t *testing.T) {
+	b := newBroker(t)
+	c, err := Dial(b.url(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Confirm(); err != nil {
+		t.Fatal(err)
+	}
+	big := bytes.Repeat([]byte("x"), 10_000)
+	c.Publish("events", "order.created", Properties{ContentType: "application/json", Persistent: true, MessageID: "1", Type: "order.created"}, []byte(`{"id":1}`))
+	c.Publish("events", "order.paid", Properties{}, big)
+	if err := c.WaitConfirms(); err != nil {
+		t.Fatal(err)
+	}
+	c.Publish("events", "nack", Properties{}, []byte("{}"))
+	if err := c.WaitConfirms(); !errors.Is(err, ErrNacked) {
+		t.Fatalf("got %v, want ErrNacked", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.published) != 3 {
+		t.Fatalf("%d messages published, want 3", len(b.published))
+	}
+	first := b.published[0]
+	if first.Exchange != "events" || first.RoutingKey != "order.created" || string(first.Body) != `{"id":1}` ||
+		!first.Properties.Persistent || first.Properties.MessageID != "1" || first.Properties.Type != "order.created" {
+		t.Errorf("first message: %+v", first)
+	}
+	if !bytes.Equal(b.published[1].Body, big) {
+		t.Errorf("split body arrived as %d bytes", len(b.published[1].Body))
+	}
+}
+
+// TestSource acknowledges stored events, drops invalid and rejected ones
+// and requeues the others.
+func TestSource(t *testing.T) {
+	b := newBroker(t,
+		[]byte(`{"type":"order.created","payload":{"n":1}}`),
+		[]byte(`not json`),
+		[]byte(`{"type":"forbidden","payload":{}}`),
+		[]byte(`{"type":"order.paid","payload":{}}`),
+	)
+	var mu sync.Mutex
+	var got []event.Event
+	s := Start(config.AMQPSourceConfig{URL: b.url(), Queue: "in", Prefetch: 10}, func(e event.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, e)
+		switch e.Type {
+		case "forbidden":
+			return Reject(errors.New("namespace"))
+		case "order.paid":
+			return errors.New("storage down")
+		}
+		return nil
+	})
+	defer s.Close()
+
+	want := map[uint64]string{1: "ack", 2: "drop", 3: "drop", 4: "requeue"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.Lock()
+		done := len(b.settled) == len(want)
+		b.mu.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.mu.Lock()
+	for tag, w := range want {
+		if b.settled[tag] != w {
+			t.Errorf("delivery %d: %q, want %q", tag, b.settled[tag], w)
+		}
+	}
+	b.mu.Unlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 3 {
+		t.Fatalf("handled %d events, want 3", len(got))
+	}
+	e := got[0]
+	if e.CorrelationID != "c1" || e.Metadata["amqp.routing_key"] != "k" || e.Metadata["amqp.message_id"] != "m1" {
+		t.Errorf("event: %+v", e)
+	}
+	var payload map[string]int
+	if err := json.Unmarshal(e.Payload, &payload); err != nil || payload["n"] != 1 || !strings.HasPrefix(e.Type, "order.") {
+		t.Errorf("payload %s", e.Payload)
+	}
+}
@@ -0,0 +1,371 @@
+// Package amqp is a minimal AMQP 0-9-1 client for RabbitMQ: one channel per
+// connection, publishing with publisher confirms, and consuming one queue
+// with manual acknowledgements. It backs the amqp sink and the queue
+// source.
+package amqp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrNacked is returned by WaitConfirms when the broker refused a message.
+var ErrNacked = errors.New("message nacked by the broker")
+
+// CloseError is a connection or channel closed by the broker, with its
+// reply code, e.g. 404 for an unknown exchange or queue.
+type CloseError struct {
+	Code uint16
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("amqp: closed by broker: %d %s", e.Code, e.Text)
+}
+
+// channel is the only channel a Conn opens.
+const channel = 1
+
+// Conn is a connection with one open channel. It is not safe for
+// concurrent use, except Close, which unblocks a pending read. Heartbeats
+// are turned off; dead peers are found by TCP keepalive and by the
+// deadlines of the calls.
+type Conn struct {
+	conn     net.Conn
+	rd       *bufio.Reader
+	frameMax int
+	timeout  time.Duration
+
+	// published counts the messages published since Confirm, and
+	// unconfirmed holds the delivery tags not acknowledged yet.
+	published   uint64
+	unconfirmed map[uint64]bool
+	nacked      bool
+	// out holds the frames of the messages published since the last
+	// WaitConfirms.
+	out []byte
+}
+
+// Dial connects to amqp://[user:password@]host[:port][/vhost] (amqps://
+// for TLS), guest:guest and the vhost "/" when left out, and opens the
+// channel.
+func Dial(rawURL string, timeout time.Duration) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "amqp" && u.Scheme != "amqps") || u.Host == "" {
+		return nil, errors.New("url must be amqp://[user:password@]host[:port][/vhost] or amqps://")
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "5672"
+		if u.Scheme == "amqps" {
+			port = "5671"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	user, pass := "guest", "guest"
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+	vhost := "/"
+	if p := strings.TrimPrefix(u.Path, "/"); p != "" {
+		vhost = p
+	}
+
+	d := &net.Dialer{Timeout: timeout, KeepAlive: 15 * time.Second}
+	var conn net.Conn
+	if u.Scheme == "amqps" {
+		conn, err = tls.DialWithDialer(d, "tcp", addr, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = d.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{conn: conn, rd: bufio.NewReader(conn), timeout: timeout}
+	if err := c.open(user, pass, vhost); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// open runs the connection handshake and opens the channel.
+func (c *Conn) open(user, pass, vhost string) error {
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	defer func() { _ = c.conn.SetDeadline(time.Time{}) }()
+	if _, err := c.conn.Write([]byte("AMQP\x00\x00\x09\x01")); err != nil {
+		return err
+	}
+	f, err := c.expect(0, classConnection, connectionStart)
+	if err != nil {
+		return err
+	}
+	p := &parser{b: f.payload}
+	p.octet()
+	p.octet()
+	p.skipTable()
+	if mechs := p.longstr(); p.err == nil && !strings.Contains(" "+mechs+" ", " PLAIN ") {
+		return fmt.Errorf("amqp: broker does not offer PLAIN authentication (%s)", mechs)
+	}
+	props := map[string]string{"product": "go-ingest-service", "platform": "Go"}
+	if err := c.send(0, method(classConnection, connectionStartOk).table(props).
+		shortstr("PLAIN").longstr("\x00"+user+"\x00"+pass).shortstr("en_US")); err != nil {
+		return err
+	}
+	if f, err = c.expect(0, classConnection, connectionTune); err != nil {
+		return err
+	}
+	p = &parser{b: f.payload}
+	channelMax, frameMax := p.short(), p.long()
+	if frameMax == 0 {
+		frameMax = 128 << 10
+	}
+	if channelMax == 0 {
+		channelMax = 2047
+	}
+	c.frameMax = int(frameMax)
+	if err := c.send(0, method(classConnection, connectionTuneOk).short(channelMax).long(frameMax).short(0)); err != nil {
+		return err
+	}
+	if err := c.send(0, method(classConnection, connectionOpen).shortstr(vhost).shortstr("").bits(false)); err != nil {
+		return err
+	}
+	if _, err := c.expect(0, classConnection, connectionOpenOk); err != nil {
+		return err
+	}
+	if err := c.send(channel, method(classChannel, channelOpen).shortstr("")); err != nil {
+		return err
+	}
+	_, err = c.expect(channel, classChannel, channelOpenOk)
+	return err
+}
+
+// Confirm puts the channel in confirm mode: every message published after
+// is acknowledged by the broker once it has taken responsibility for it.
+func (c *Conn) Confirm() error {
+	return c.call(method(classConfirm, confirmSelect).bits(false), classConfirm, confirmSelectOk)
+}
+
+// Qos limits the unacknowledged deliveries of the channel to prefetch.
+func (c *Conn) Qos(prefetch int) error {
+	return c.call(method(classBasic, basicQos).long(0).short(uint16(prefetch)).bits(false), classBasic, basicQosOk)
+}
+
+// Consume starts delivering the messages of queue, to read with Next.
+func (c *Conn) Consume(queue string) error {
+	return c.call(method(classBasic, basicConsume).short(0).shortstr(queue).shortstr("").
+		bits(false, false, false, false).table(nil), classBasic, basicConsumeOk)
+}
+
+// Publish queues body for exchange with routing key; the batch is written
+// by WaitConfirms.
+func (c *Conn) Publish(exchange, key string, props Properties, body []byte) {
+	c.out = appendFrame(c.out, frameMethod, channel,
+		method(classBasic, basicPublish).short(0).shortstr(exchange).shortstr(key).bits(false, false).b)
+	c.out = appendFrame(c.out, frameHeader, channel, contentHeader(len(body), props))
+	// a body frame carries at most frame_max less the 8 bytes of framing
+	for chunk := c.frameMax - 8; len(body) > 0; {
+		n := min(chunk, len(body))
+		c.out = appendFrame(c.out, frameBody, channel, body[:n])
+		body = body[n:]
+	}
+	if c.unconfirmed == nil {
+		c.unconfirmed = map[uint64]bool{}
+	}
+	c.published++
+	c.unconfirmed[c.published] = true
+}
+
+// WaitConfirms writes the published messages and waits until the broker
+// has confirmed all of them, failing with ErrNacked when it refused any.
+func (c *Conn) WaitConfirms() error {
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	defer func() { _ = c.conn.SetDeadline(time.Time{}) }()
+	out := c.out
+	c.out = c.out[:0]
+	if _, err := c.conn.Write(out); err != nil {
+		return err
+	}
+	for len(c.unconfirmed) > 0 {
+		f, err := c.next()
+		if err != nil {
+			return err
+		}
+		if f.typ != frameMethod || f.class != classBasic {
+			continue
+		}
+		switch f.method {
+		case basicAck, basicNack:
+			p := &parser{b: f.payload}
+			tag, multiple := p.longlong(), p.octet()&1 != 0
+			if p.err != nil {
+				return p.err
+			}
+			for t := range c.unconfirmed {
+				if t == tag || (multiple && t < tag) {
+					delete(c.unconfirmed, t)
+				}
+			}
+			if f.method == basicNack {
+				c.nacked = true
+			}
+		}
+	}
+	if c.nacked {
+		c.nacked = false
+		return ErrNacked
+	}
+	return nil
+}
+
+// Delivery is a message received from the consumed queue.
+type Delivery struct {
+	Tag         uint64
+	Redelivered bool
+	Exchange    string
+	RoutingKey  string
+	Properties  Properties
+	Body        []byte
+}
+
+// Next blocks until the next delivery arrives.
+func (c *Conn) Next() (Delivery, error) {
+	for {
+		f, err := c.next()
+		if err != nil {
+			return Delivery{}, err
+		}
+		if f.typ != frameMethod || f.class != classBasic {
+			continue
+		}
+		switch f.method {
+		case basicCancel:
+			return Delivery{}, errors.New("amqp: consumer cancelled by the broker")
+		case basicDeliver:
+		default:
+			continue
+		}
+		p := &parser{b: f.payload}
+		p.shortstr() // consumer tag
+		d := Delivery{Tag: p.longlong(), Redelivered: p.octet()&1 != 0, Exchange: p.shortstr(), RoutingKey: p.shortstr()}
+		if p.err != nil {
+			return Delivery{}, p.err
+		}
+		h, err := c.next()
+		if err != nil {
+			return Delivery{}, err
+		}
+		if h.typ != frameHeader {
+			return Delivery{}, errors.New("amqp: expected a content header")
+		}
+		size, props, err := parseContentHeader(h.payload)
+		if err != nil {
+			return Delivery{}, err
+		}
+		d.Properties, d.Body = props, make([]byte, 0, size)
+		for uint64(len(d.Body)) < size {
+			b, err := c.next()
+			if err != nil {
+				return Delivery{}, err
+			}
+			if b.typ != frameBody {
+				return Delivery{}, errors.New("amqp: expected a content body")
+			}
+			d.Body = append(d.Body, b.payload...)
+		}
+		return d, nil
+	}
+}
+
+// Ack acknowledges the delivery tag.
+func (c *Conn) Ack(tag uint64) error {
+	return c.send(channel, method(classBasic, basicAck).longlong(tag).bits(false))
+}
+
+// Nack refuses the delivery tag: the broker delivers it again when
+// requeue, or dead-letters it (or drops it, without a dead-letter
+// exchange) otherwise.
+func (c *Conn) Nack(tag uint64, requeue bool) error {
+	return c.send(channel, method(classBasic, basicNack).longlong(tag).bits(false, requeue))
+}
+
+// Close closes the connection, politely when the broker answers in time.
+func (c *Conn) Close() error {
+	_ = c.conn.SetDeadline(time.Now().Add(time.Second))
+	if c.send(0, method(classConnection, connectionClose).short(200).shortstr("bye").short(0).short(0)) == nil {
+		_, _ = c.expect(0, classConnection, connectionCloseOk)
+	}
+	return c.conn.Close()
+}
+
+// Abort closes the socket at once, unblocking a Next in another goroutine.
+func (c *Conn) Abort() error { return c.conn.Close() }
+
+// call sends m on the channel and waits for the class and method reply.
+func (c *Conn) call(m *builder, class, id uint16) error {
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	defer func() { _ = c.conn.SetDeadline(time.Time{}) }()
+	if err := c.send(channel, m); err != nil {
+		return err
+	}
+	_, err := c.expect(channel, class, id)
+	return err
+}
+
+func (c *Conn) send(ch uint16, m *builder) error {
+	_, err := c.conn.Write(appendFrame(nil, frameMethod, ch, m.b))
+	return err
+}
+
+// expect reads frames until the method class.id arrives on ch, skipping
+// others.
+func (c *Conn) expect(ch, class, id uint16) (frame, error) {
+	for {
+		f, err := c.next()
+		if err != nil {
+			return f, err
+		}
+		if f.typ == frameMethod && f.channel == ch && f.class == class && f.method == id {
+			return f, nil
+		}
+	}
+}
+
+// next reads the next frame other than a heartbeat, turning a close by the
+// broker into a *CloseError after acknowledging it.
+func (c *Conn) next() (frame, error) {
+	for {
+		f, err := readFrame(c.rd, c.frameMax)
+		if err != nil {
+			return f, err
+		}
+		if f.typ == frameHeartbeat {
+			continue
+		}
+		if f.typ == frameMethod && (f.class == classConnection && f.method == connectionClose ||
+			f.class == classChannel && f.method == channelClose) {
+			p := &parser{b: f.payload}
+			cerr := &CloseError{Code: p.short(), Text: p.shortstr()}
+			if f.class == classConnection {
+				_ = c.send(0, method(classConnection, connectionCloseOk))
+			} else {
+				_ = c.send(f.channel, method(classChannel, channelCloseOk))
+			}
+			return f, cerr
+		}
+		return f, nil
+	}
+}
@@ -0,0 +1,208 @@
+package amqp
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+var (
+	messagesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "amqp_source_messages_total", Help: "Messages consumed from the AMQP source queue by result (accepted, invalid, rejected, requeued)"},
+		[]string{"result"},
+	)
+	connected = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "amqp_source_connected", Help: "1 while the AMQP source is consuming its queue"},
+	)
+)
+
+// Collectors returns the AMQP source metrics for registration by the
+// caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{messagesTotal, connected}
+}
+
+// Handler ingests the event of a message. Errors wrapped by Reject are
+// final; any other error requeues the message.
+type Handler func(event.Event) error
+
+type rejectError struct{ err error }
+
+func (e rejectError) Error() string { return e.err.Error() }
+func (e rejectError) Unwrap() error { return e.err }
+
+// Reject marks err as final: the message is not worth delivering again,
+// and is dead-lettered by the broker when the queue has a dead-letter
+// exchange.
+func Reject(err error) error { return rejectError{err} }
+
+// requeueDelay is how long a message the service could not take waits
+// before it is handed back, so an outage does not spin through the queue.
+const requeueDelay = time.Second
+
+// Source consumes a queue into the ingest pipeline, acknowledging each
+// message once it is stored, and reconnects with backoff when the
+// connection drops.
+type Source struct {
+	cfg    config.AMQPSourceConfig
+	handle Handler
+	stop   chan struct{}
+	done   chan struct{}
+
+	// mu is held while a message is handled, so Close lets it finish
+	mu     sync.Mutex
+	conn   *Conn
+	closed bool
+}
+
+// Start consumes cfg.Queue in the background.
+func Start(cfg config.AMQPSourceConfig, handle Handler) *Source {
+	s := &Source{cfg: cfg, handle: handle, stop: make(chan struct{}), done: make(chan struct{})}
+	go s.run()
+	return s
+}
+
+// Close stops consuming once the message being handled is acknowledged;
+// the ones prefetched and not handled go back to the queue.
+func (s *Source) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.stop)
+		if s.conn != nil {
+			_ = s.conn.Abort()
+		}
+	}
+	s.mu.Unlock()
+	<-s.done
+}
+
+func (s *Source) run() {
+	defer close(s.done)
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := s.consume()
+		connected.Set(0)
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		// a connection that lasted resets the backoff
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		log.Warn().Err(err).Str("queue", s.cfg.Queue).Dur("retry_in", backoff).Msg("amqp source disconnected")
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, 30*time.Second)
+	}
+}
+
+// consume connects and handles deliveries until the connection fails or
+// the source is closed.
+func (s *Source) consume() error {
+	c, err := Dial(s.cfg.URL, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return c.Close()
+	}
+	s.conn = c
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+		_ = c.Abort()
+	}()
+	if err := c.Qos(s.cfg.Prefetch); err != nil {
+		return err
+	}
+	if err := c.Consume(s.cfg.Queue); err != nil {
+		return err
+	}
+	connected.Set(1)
+	log.Info().Str("queue", s.cfg.Queue).Msg("amqp source consuming")
+	for {
+		d, err := c.Next()
+		if err != nil {
+			return err
+		}
+		if err := s.receive(c, d); err != nil {
+			return err
+		}
+	}
+}
+
+// receive hands d to the handler and settles it, returning the error of
+// the connection, if any.
+func (s *Source) receive(c *Conn, d Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("closed")
+	}
+	e, err := s.decode(d)
+	if err != nil {
+		messagesTotal.WithLabelValues("invalid").Inc()
+		log.Debug().Err(err).Uint64("tag", d.Tag).Msg("amqp message dropped")
+		return c.Nack(d.Tag, false)
+	}
+	err = s.handle(e)
+	var final rejectError
+	switch {
+	case err == nil:
+		messagesTotal.WithLabelValues("accepted").Inc()
+		return c.Ack(d.Tag)
+	case errors.As(err, &final):
+		messagesTotal.WithLabelValues("rejected").Inc()
+		log.Debug().Err(err).Str("type", e.Type).Msg("amqp message rejected")
+		return c.Nack(d.Tag, false)
+	default:
+		messagesTotal.WithLabelValues("requeued").Inc()
+		log.Warn().Err(err).Str("type", e.Type).Msg("amqp message requeued")
+		time.Sleep(requeueDelay)
+		return c.Nack(d.Tag, true)
+	}
+}
+
+// decode turns a message into an event: its body is the payload of an
+// event of the configured type, or else a whole event.
+func (s *Source) decode(d Delivery) (event.Event, error) {
+	var e event.Event
+	if s.cfg.Type != "" {
+		if !json.Valid(d.Body) {
+			return e, errors.New("body is not JSON")
+		}
+		e = event.Event{Type: s.cfg.Type, Payload: json.RawMessage(d.Body)}
+	} else if err := json.Unmarshal(d.Body, &e); err != nil {
+		return e, err
+	}
+	if e.CorrelationID == "" {
+		e.CorrelationID = d.Properties.CorrelationID
+	}
+	if e.Metadata == nil {
+		e.Metadata = map[string]string{}
+	}
+	e.Metadata["amqp.exchange"] = d.Exchange
+	e.Metadata["amqp.routing_key"] = d.RoutingKey
+	if d.Properties.MessageID != "" {
+		e.Metadata["amqp.message_id"] = d.Properties.MessageID
+	}
+	return e, nil
+}
@@ -0,0 +1,332 @@
+package amqp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// Frame types and the frame terminator of AMQP 0-9-1.
+const (
+	frameMethod    = 1
+	frameHeader    = 2
+	frameBody      = 3
+	frameHeartbeat = 8
+	frameEnd       = 0xCE
+)
+
+// Class and method IDs of the methods this client sends or expects.
+const (
+	classConnection = 10
+	classChannel    = 20
+	classBasic      = 60
+	classConfirm    = 85
+
+	connectionStart   = 10
+	connectionStartOk = 11
+	connectionTune    = 30
+	connectionTuneOk  = 31
+	connectionOpen    = 40
+	connectionOpenOk  = 41
+	connectionClose   = 50
+	connectionCloseOk = 51
+
+	channelOpen    = 10
+	channelOpenOk  = 11
+	channelClose   = 40
+	channelCloseOk = 41
+
+	basicQos       = 10
+	basicQosOk     = 11
+	basicConsume   = 20
+	basicConsumeOk = 21
+	basicCancel    = 30
+	basicPublish   = 40
+	basicReturn    = 50
+	basicDeliver   = 60
+	basicAck       = 80
+	basicNack      = 120
+
+	confirmSelect   = 10
+	confirmSelectOk = 11
+)
+
+// frame is one frame off the wire; for method frames class and method are
+// split off the payload.
+type frame struct {
+	typ     byte
+	channel uint16
+	class   uint16
+	method  uint16
+	payload []byte
+}
+
+func readFrame(rd *bufio.Reader, max int) (frame, error) {
+	var head [7]byte
+	if _, err := io.ReadFull(rd, head[:]); err != nil {
+		return frame{}, err
+	}
+	f := frame{typ: head[0], channel: binary.BigEndian.Uint16(head[1:3])}
+	size := binary.BigEndian.Uint32(head[3:7])
+	if max > 0 && size > uint32(max) {
+		return frame{}, fmt.Errorf("frame of %d bytes exceeds frame_max %d", size, max)
+	}
+	buf := make([]byte, size+1)
+	if _, err := io.ReadFull(rd, buf); err != nil {
+		return frame{}, err
+	}
+	if buf[size] != frameEnd {
+		return frame{}, errors.New("malformed frame")
+	}
+	f.payload = buf[:size]
+	if f.typ == frameMethod {
+		if size < 4 {
+			return frame{}, errors.New("short method frame")
+		}
+		f.class = binary.BigEndian.Uint16(f.payload[0:2])
+		f.method = binary.BigEndian.Uint16(f.payload[2:4])
+		f.payload = f.payload[4:]
+	}
+	return f, nil
+}
+
+func appendFrame(dst []byte, typ byte, channel uint16, payload []byte) []byte {
+	dst = append(dst, typ)
+	dst = binary.BigEndian.AppendUint16(dst, channel)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(payload)))
+	dst = append(dst, payload...)
+	return append(dst, frameEnd)
+}
+
+// builder encodes method arguments and content headers.
+type builder struct{ b []byte }
+
+func method(class, id uint16) *builder {
+	w := &builder{}
+	return w.short(class).short(id)
+}
+
+func (w *builder) octet(v byte) *builder { w.b = append(w.b, v); return w }
+func (w *builder) short(v uint16) *builder {
+	w.b = binary.BigEndian.AppendUint16(w.b, v)
+	return w
+}
+func (w *builder) long(v uint32) *builder {
+	w.b = binary.BigEndian.AppendUint32(w.b, v)
+	return w
+}
+func (w *builder) longlong(v uint64) *builder {
+	w.b = binary.BigEndian.AppendUint64(w.b, v)
+	return w
+}
+
+// shortstr truncates s to the 255 bytes a short string holds.
+func (w *builder) shortstr(s string) *builder {
+	if len(s) > math.MaxUint8 {
+		s = s[:math.MaxUint8]
+	}
+	w.b = append(append(w.b, byte(len(s))), s...)
+	return w
+}
+
+func (w *builder) longstr(s string) *builder {
+	w.long(uint32(len(s)))
+	w.b = append(w.b, s...)
+	return w
+}
+
+// bits packs flags into one octet, the first in the lowest bit.
+func (w *builder) bits(flags ...bool) *builder {
+	var v byte
+	for i, f := range flags {
+		if f {
+			v |= 1 << i
+		}
+	}
+	return w.octet(v)
+}
+
+// table encodes a field table of string values, in key order.
+func (w *builder) table(t map[string]string) *builder {
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var body builder
+	for _, k := range keys {
+		body.shortstr(k).octet('S').longstr(t[k])
+	}
+	w.long(uint32(len(body.b)))
+	w.b = append(w.b, body.b...)
+	return w
+}
+
+// parser decodes method arguments and content headers; the first error
+// sticks and zero values are returned after it.
+type parser struct {
+	b   []byte
+	err error
+}
+
+func (p *parser) take(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if len(p.b) < n {
+		p.err = errors.New("truncated frame")
+		return nil
+	}
+	out := p.b[:n]
+	p.b = p.b[n:]
+	return out
+}
+
+func (p *parser) octet() byte {
+	if b := p.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (p *parser) short() uint16 {
+	if b := p.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (p *parser) long() uint32 {
+	if b := p.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (p *parser) longlong() uint64 {
+	if b := p.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (p *parser) shortstr() string { return string(p.take(int(p.octet()))) }
+func (p *parser) longstr() string  { return string(p.take(int(p.long()))) }
+
+// skipTable skips a field table, whose values this client never reads.
+func (p *parser) skipTable() { p.take(int(p.long())) }
+
+// Properties are the message properties this client reads and writes.
+type Properties struct {
+	ContentType   string
+	Persistent    bool
+	CorrelationID string
+	MessageID     string
+	Timestamp     time.Time
+	Type          string
+}
+
+// Property flags, from the highest bit down, in wire order.
+const (
+	flagContentType     = 1 << 15
+	flagContentEncoding = 1 << 14
+	flagHeaders         = 1 << 13
+	flagDeliveryMode    = 1 << 12
+	flagPriority        = 1 << 11
+	flagCorrelationID   = 1 << 10
+	flagReplyTo         = 1 << 9
+	flagExpiration      = 1 << 8
+	flagMessageID       = 1 << 7
+	flagTimestamp       = 1 << 6
+	flagType            = 1 << 5
+	flagUserID          = 1 << 4
+	flagAppID           = 1 << 3
+	flagClusterID       = 1 << 2
+)
+
+// contentHeader encodes the header frame payload of a basic message.
+func contentHeader(size int, p Properties) []byte {
+	var flags uint16
+	var props builder
+	if p.ContentType != "" {
+		flags |= flagContentType
+		props.shortstr(p.ContentType)
+	}
+	if p.Persistent {
+		flags |= flagDeliveryMode
+		props.octet(2)
+	}
+	if p.CorrelationID != "" {
+		flags |= flagCorrelationID
+		props.shortstr(p.CorrelationID)
+	}
+	if p.MessageID != "" {
+		flags |= flagMessageID
+		props.shortstr(p.MessageID)
+	}
+	if !p.Timestamp.IsZero() {
+		flags |= flagTimestamp
+		props.longlong(uint64(p.Timestamp.Unix()))
+	}
+	if p.Type != "" {
+		flags |= flagType
+		props.shortstr(p.Type)
+	}
+	w := (&builder{}).short(classBasic).short(0).longlong(uint64(size)).short(flags)
+	w.b = append(w.b, props.b...)
+	return w.b
+}
+
+// parseContentHeader decodes a header frame payload into the body size and
+// the properties this client reads, skipping the others.
+func parseContentHeader(payload []byte) (uint64, Properties, error) {
+	p := &parser{b: payload}
+	p.short() // class
+	p.short() // weight
+	size := p.longlong()
+	flags := p.short()
+	var out Properties
+	if flags&1 != 0 {
+		return 0, out, errors.New("continued property flags are not supported")
+	}
+	if flags&flagContentType != 0 {
+		out.ContentType = p.shortstr()
+	}
+	if flags&flagContentEncoding != 0 {
+		p.shortstr()
+	}
+	if flags&flagHeaders != 0 {
+		p.skipTable()
+	}
+	if flags&flagDeliveryMode != 0 {
+		out.Persistent = p.octet() == 2
+	}
+	if flags&flagPriority != 0 {
+		p.octet()
+	}
+	if flags&flagCorrelationID != 0 {
+		out.CorrelationID = p.shortstr()
+	}
+	if flags&flagReplyTo != 0 {
+		p.shortstr()
+	}
+	if flags&flagExpiration != 0 {
+		p.shortstr()
+	}
+	if flags&flagMessageID != 0 {
+		out.MessageID = p.shortstr()
+	}
+	if flags&flagTimestamp != 0 {
+		out.Timestamp = time.Unix(int64(p.longlong()), 0).UTC()
+	}
+	if flags&flagType != 0 {
+		out.Type = p.shortstr()
+	}
+	// user-id, app-id and cluster-id follow and are not read
+	return size, out, p.err
+}
@@ -0,0 +1,255 @@
+// Package archive writes and verifies tamper-evident event archives.
+//
+// An archive is NDJSON: one record per event followed by a manifest line.
+// Records form a hash chain (each hash covers the previous hash and the event
+// bytes), the manifest carries the chain head and a Merkle root over all
+// events, and is signed with ed25519 so an auditor holding only the public key
+// can verify a dump offline:
+//
+//	{"seq":1,"prev":"00…","hash":"…","event":{…}}
+//	{"manifest":{"format":"ingest-archive/v1","count":1,"head":"…","merkle_root":"…","signature":"…"}}
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+const Format = "ingest-archive/v1"
+
+type Record struct {
+	Seq   int64           `json:"seq"`
+	Prev  string          `json:"prev"`
+	Hash  string          `json:"hash"`
+	Event json.RawMessage `json:"event"`
+}
+
+type Manifest struct {
+	Format     string    `json:"format"`
+	Count      int64     `json:"count"`
+	Head       string    `json:"head"`
+	MerkleRoot string    `json:"merkle_root"`
+	CreatedAt  time.Time `json:"created_at"`
+	KeyID      string    `json:"key_id,omitempty"`
+	Signature  string    `json:"signature,omitempty"`
+}
+
+// signedBytes is the message covered by the manifest signature.
+func (m *Manifest) signedBytes() []byte {
+	return []byte(m.Format + "\n" + strconv.FormatInt(m.Count, 10) + "\n" + m.Head + "\n" + m.MerkleRoot)
+}
+
+type manifestLine struct {
+	Manifest *Manifest `json:"manifest"`
+}
+
+func chainHash(prev []byte, ev []byte) []byte {
+	h := sha256.New()
+	h.Write(prev)
+	h.Write(ev)
+	return h.Sum(nil)
+}
+
+// merkleRoot follows RFC 6962: leaves are H(0x00||event), nodes H(0x01||l||r),
+// an odd node at the end of a level is promoted unchanged.
+func merkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+	level := leaves
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write([]byte{1})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+func merkleLeaf(ev []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(ev)
+	return h.Sum(nil)
+}
+
+// Writer appends events to an archive. Close must be called to write the
+// (optionally signed) manifest.
+type Writer struct {
+	w      *bufio.Writer
+	key    ed25519.PrivateKey
+	keyID  string
+	seq    int64
+	prev   []byte
+	leaves [][]byte
+}
+
+// NewWriter returns a Writer signing with key; a nil key writes an unsigned
+// archive that can still be checked for internal consistency.
+func NewWriter(w io.Writer, key ed25519.PrivateKey, keyID string) *Writer {
+	return &Writer{w: bufio.NewWriter(w), key: key, keyID: keyID, prev: make([]byte, sha256.Size)}
+}
+
+// Write appends one event, given as its JSON encoding.
+func (a *Writer) Write(ev json.RawMessage) error {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, ev); err != nil {
+		return fmt.Errorf("archive: invalid event json: %w", err)
+	}
+	ev = buf.Bytes()
+	a.seq++
+	hash := chainHash(a.prev, ev)
+	rec := Record{Seq: a.seq, Prev: hex.EncodeToString(a.prev), Hash: hex.EncodeToString(hash), Event: ev}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	a.prev = hash
+	a.leaves = append(a.leaves, merkleLeaf(ev))
+	return nil
+}
+
+func (a *Writer) Close() error {
+	m := &Manifest{
+		Format:     Format,
+		Count:      a.seq,
+		Head:       hex.EncodeToString(a.prev),
+		MerkleRoot: hex.EncodeToString(merkleRoot(a.leaves)),
+		CreatedAt:  time.Now().UTC(),
+		KeyID:      a.keyID,
+	}
+	if a.key != nil {
+		m.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(a.key, m.signedBytes()))
+	}
+	line, err := json.Marshal(manifestLine{Manifest: m})
+	if err != nil {
+		return err
+	}
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return a.w.Flush()
+}
+
+// Report summarizes a successfully verified archive.
+type Report struct {
+	Count      int64
+	Head       string
+	MerkleRoot string
+	KeyID      string
+	CreatedAt  time.Time
+	// Signed is true when the manifest signature was checked against a key.
+	Signed bool
+}
+
+// VerifyError pinpoints where verification failed.
+type VerifyError struct {
+	Line   int
+	Seq    int64
+	Reason string
+}
+
+func (e *VerifyError) Error() string {
+	if e.Seq > 0 {
+		return fmt.Sprintf("line %d (seq %d): %s", e.Line, e.Seq, e.Reason)
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Reason)
+}
+
+// Verify recomputes the hash chain and Merkle root of the archive read from r
+// and checks them against the manifest. When pub is non-nil the manifest
+// signature must also be valid.
+func Verify(r io.Reader, pub ed25519.PublicKey) (*Report, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 64<<20)
+	prev := make([]byte, sha256.Size)
+	var leaves [][]byte
+	var seq int64
+	var manifest *Manifest
+	line := 0
+	for sc.Scan() {
+		line++
+		raw := sc.Bytes()
+		if len(bytes.TrimSpace(raw)) == 0 {
+			continue
+		}
+		if manifest != nil {
+			return nil, &VerifyError{Line: line, Reason: "data after manifest"}
+		}
+		var ml manifestLine
+		if err := json.Unmarshal(raw, &ml); err == nil && ml.Manifest != nil {
+			manifest = ml.Manifest
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return nil, &VerifyError{Line: line, Reason: "malformed record: " + err.Error()}
+		}
+		seq++
+		if rec.Seq != seq {
+			return nil, &VerifyError{Line: line, Seq: rec.Seq, Reason: fmt.Sprintf("expected seq %d (record missing or reordered)", seq)}
+		}
+		if rec.Prev != hex.EncodeToString(prev) {
+			return nil, &VerifyError{Line: line, Seq: seq, Reason: "prev hash does not match previous record"}
+		}
+		hash := chainHash(prev, rec.Event)
+		if rec.Hash != hex.EncodeToString(hash) {
+			return nil, &VerifyError{Line: line, Seq: seq, Reason: "hash mismatch (event modified)"}
+		}
+		prev = hash
+		leaves = append(leaves, merkleLeaf(rec.Event))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, &VerifyError{Line: line, Reason: "manifest missing (archive truncated)"}
+	}
+	if manifest.Format != Format {
+		return nil, fmt.Errorf("unsupported archive format %q", manifest.Format)
+	}
+	if manifest.Count != seq {
+		return nil, fmt.Errorf("manifest count %d does not match %d records", manifest.Count, seq)
+	}
+	if manifest.Head != hex.EncodeToString(prev) {
+		return nil, errors.New("manifest head does not match hash chain")
+	}
+	if manifest.MerkleRoot != hex.EncodeToString(merkleRoot(leaves)) {
+		return nil, errors.New("manifest merkle root does not match events")
+	}
+	rep := &Report{Count: seq, Head: manifest.Head, MerkleRoot: manifest.MerkleRoot, KeyID: manifest.KeyID, CreatedAt: manifest.CreatedAt}
+	if pub != nil {
+		sig, err := base64.StdEncoding.DecodeString(manifest.Signature)
+		if err != nil || manifest.Signature == "" {
+			return nil, errors.New("manifest is not signed")
+		}
+		if !ed25519.Verify(pub, manifest.signedBytes(), sig) {
+			return nil, errors.New("manifest signature is invalid")
+		}
+		rep.Signed = true
+	}
+	return rep, nil
+}
@@ -0,0 +1,126 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// write archives n events signed with key and returns the lines.
+func write(t *testing.T, n int, key ed25519.PrivateKey) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf, key, "k1")
+	for i := range n {
+		if err := w.Write(json.RawMessage(fmt.Sprintf(`{ "id": %d, "type": "order.created" }`, i+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(buf.String(), "\n")
+	return lines[:len(lines)-1]
+}
+
+func keys(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	dir := t.TempDir()
+	privPath, pubPath := filepath.Join(dir, "archive.key"), filepath.Join(dir, "archive.pub")
+	if err := GenerateKey(privPath, pubPath); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := LoadPrivateKey(privPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := LoadPublicKey(pubPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPublicKey(privPath); err == nil {
+		t.Error("private key loaded as public")
+	}
+	return pub, priv
+}
+
+// TestRoundTrip verifies what the Writer wrote, signed with a key pair
+// from PEM files, for archives of every size up to an uneven Merkle tree.
+func TestRoundTrip(t *testing.T) {
+	pub, priv := keys(t)
+	for _, n := range []int{0, 1, 2, 3, 7} {
+		lines := write(t, n, priv)
+		if len(lines) != n+1 {
+			t.Fatalf("%d events: %d lines", n, len(lines))
+		}
+		rep, err := Verify(strings.NewReader(strings.Join(lines, "")), pub)
+		if err != nil {
+			t.Fatalf("%d events: %v", n, err)
+		}
+		if rep.Count != int64(n) || !rep.Signed || rep.KeyID != "k1" {
+			t.Errorf("%d events: report %+v", n, rep)
+		}
+	}
+
+	var rec Record
+	if err := json.Unmarshal([]byte(write(t, 1, nil)[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if string(rec.Event) != `{"id":1,"type":"order.created"}` {
+		t.Errorf("event stored as %s", rec.Event)
+	}
+	if err := NewWriter(&bytes.Buffer{}, nil, "").Write(json.RawMessage(`{"id":`)); err == nil {
+		t.Error("invalid json archived")
+	}
+}
+
+// TestVerifyTampered points at the record that was modified, dropped or
+// reordered, and rejects a truncated archive, a manifest that does not
+// match, and a signature by another key.
+func TestVerifyTampered(t *testing.T) {
+	pub, priv := keys(t)
+	other, _ := keys(t)
+	lines := write(t, 4, priv)
+	edit := func(fn func(l []string) []string) string {
+		return strings.Join(fn(append([]string(nil), lines...)), "")
+	}
+	for name, c := range map[string]struct {
+		archive string
+		key     ed25519.PublicKey
+		line    int
+	}{
+		"modified event": {edit(func(l []string) []string {
+			l[1] = strings.Replace(l[1], `"id":2`, `"id":20`, 1)
+			return l
+		}), nil, 2},
+		"dropped record":   {edit(func(l []string) []string { return append(l[:2], l[3:]...) }), nil, 3},
+		"reordered":        {edit(func(l []string) []string { l[1], l[2] = l[2], l[1]; return l }), nil, 2},
+		"truncated":        {edit(func(l []string) []string { return l[:4] }), nil, 4},
+		"data after":       {edit(func(l []string) []string { return append(l, l[0]) }), nil, 6},
+		"malformed record": {edit(func(l []string) []string { l[0] = "{oops\n"; return l }), nil, 1},
+		"dropped last": {edit(func(l []string) []string {
+			return append(l[:3], l[4])
+		}), nil, 0},
+		"other key":     {strings.Join(lines, ""), other, 0},
+		"unsigned":      {strings.Join(write(t, 2, nil), ""), pub, 0},
+		"edited header": {edit(func(l []string) []string { l[4] = strings.Replace(l[4], `"count":4`, `"count":3`, 1); return l }), nil, 0},
+	} {
+		_, err := Verify(strings.NewReader(c.archive), c.key)
+		if err == nil {
+			t.Errorf("%s: verified", name)
+			continue
+		}
+		var ve *VerifyError
+		if got := errors.As(err, &ve); got != (c.line > 0) || got && ve.Line != c.line {
+			t.Errorf("%s: %v, want an error at line %d", name, err, c.line)
+		}
+	}
+	if _, err := Verify(strings.NewReader(strings.Join(lines, "")), pub); err != nil {
+		t.Errorf("untouched: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+// Package audit records administrative and destructive actions in the
+// append-only audit trail of the store: who did what, to what, when and
+// through which request. Entries can also be shipped to a sink.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/auth"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+var (
+	entriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "audit_entries_total", Help: "Audit entries recorded by action"},
+		[]string{"action"},
+	)
+	writeErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "audit_write_errors_total", Help: "Audit entries that could not be stored"},
+	)
+)
+
+// Collectors returns the audit metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{entriesTotal, writeErrors}
+}
+
+// Log appends to the audit trail.
+type Log struct {
+	store storage.Store
+	// ship, when set, forwards every stored entry as an "audit" event.
+	ship func(event.Event)
+}
+
+func New(store storage.Store, ship func(event.Event)) *Log {
+	return &Log{store: store, ship: ship}
+}
+
+// Request records action on target by the caller of r. details, when not
+// nil, is stored as JSON.
+func (l *Log) Request(r *http.Request, action, target string, details any) {
+	actor := "anonymous"
+	if p, ok := auth.FromContext(r.Context()); ok {
+		actor = p.Subject
+	}
+	l.record(storage.AuditEntry{
+		Actor:      actor,
+		Action:     action,
+		Target:     target,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		RequestID:  middleware.GetReqID(r.Context()),
+		RemoteAddr: r.RemoteAddr,
+	}, details)
+}
+
+// Context records action on target by the caller of the request ctx
+// belongs to, for code handed the context rather than the request; the
+// entry names the route instead of the path and has no remote address.
+func (l *Log) Context(ctx context.Context, action, target string, details any) {
+	e := storage.AuditEntry{Actor: "anonymous", Action: action, Target: target, RequestID: middleware.GetReqID(ctx)}
+	if p, ok := auth.FromContext(ctx); ok {
+		e.Actor = p.Subject
+	}
+	if rc := chi.RouteContext(ctx); rc != nil {
+		e.Method, e.Path = rc.RouteMethod, rc.RoutePattern()
+	}
+	l.record(e, details)
+}
+
+// System records an action the service took by itself, e.g. on a signal.
+func (l *Log) System(action, target string, details any) {
+	l.record(storage.AuditEntry{Actor: "system", Action: action, Target: target}, details)
+}
+
+func (l *Log) record(e storage.AuditEntry, details any) {
+	if details != nil {
+		b, err := json.Marshal(details)
+		if err != nil {
+			log.Error().Err(err).Str("action", e.Action).Msg("audit: encode details")
+		}
+		e.Details = b
+	}
+	// the entry is kept even when the request it records went away
+	stored, err := l.store.AppendAudit(context.Background(), e)
+	if err != nil {
+		writeErrors.Inc()
+		log.Error().Err(err).Str("action", e.Action).Str("actor", e.Actor).Msg("audit: store entry")
+		return
+	}
+	entriesTotal.WithLabelValues(e.Action).Inc()
+	if l.ship != nil {
+		payload, _ := json.Marshal(stored)
+		l.ship(event.Event{Type: "audit", Payload: payload, ReceivedAt: stored.Time})
+	}
+}
+
+// snapshot fingerprints the configured API keys and schema policies, which
+// only change through the config file.
+type snapshot struct {
+	APIKeys map[string]string `json:"api_keys"`
+	Schemas map[string]string `json:"schemas"`
+}
+
+// Config records, as actor "config", the API keys and schema policies
+// created, updated or removed since the configuration last recorded.
+func (l *Log) Config(cfg *config.Config) error {
+	cur := snapshot{APIKeys: map[string]string{}, Schemas: map[string]string{}}
+	keys := map[string]config.APIKeyConfig{}
+	for _, k := range cfg.Auth.APIKeys {
+		hash := strings.ToLower(k.KeySHA256)
+		if k.Key != "" {
+			sum := sha256.Sum256([]byte(k.Key))
+			hash = hex.EncodeToString(sum[:])
+		}
+		if k.SigningSecret != "" {
+			sum := sha256.Sum256([]byte(k.SigningSecret))
+			hash = "hmac:" + hex.EncodeToString(sum[:])
+		}
+		roles, ns := slices.Sorted(slices.Values(k.Roles)), slices.Sorted(slices.Values(k.Namespaces))
+		cur.APIKeys[k.ID] = fingerprint(hash, strings.Join(roles, ","), strings.Join(ns, ","))
+		keys[k.ID] = k
+	}
+	for typ, sc := range cfg.Schemas {
+		b, _ := json.Marshal(sc)
+		cur.Schemas[typ] = fingerprint(string(b))
+	}
+
+	var prev snapshot
+	last, err := l.store.Audit(context.Background(), storage.AuditQuery{Action: "config.applied", Limit: 1})
+	if err != nil {
+		return err
+	}
+	if len(last) > 0 {
+		if err := json.Unmarshal(last[0].Details, &prev); err != nil {
+			return err
+		}
+	}
+
+	changed := false
+	record := func(action, target string, details any) {
+		changed = true
+		l.record(storage.AuditEntry{Actor: "config", Action: action, Target: target}, details)
+	}
+	keyDetails := func(id string) any {
+		return map[string]any{"roles": keys[id].Roles, "namespaces": keys[id].Namespaces}
+	}
+	for _, id := range slices.Sorted(maps.Keys(cur.APIKeys)) {
+		switch old, ok := prev.APIKeys[id]; {
+		case !ok:
+			record("key.create", id, keyDetails(id))
+		case old != cur.APIKeys[id]:
+			record("key.update", id, keyDetails(id))
+		}
+	}
+	for _, id := range slices.Sorted(maps.Keys(prev.APIKeys)) {
+		if _, ok := cur.APIKeys[id]; !ok {
+			record("key.revoke", id, nil)
+		}
+	}
+	for _, typ := range slices.Sorted(maps.Keys(cur.Schemas)) {
+		switch old, ok := prev.Schemas[typ]; {
+		case !ok:
+			record("schema.create", typ, cfg.Schemas[typ])
+		case old != cur.Schemas[typ]:
+			record("schema.update", typ, cfg.Schemas[typ])
+		}
+	}
+	for _, typ := range slices.Sorted(maps.Keys(prev.Schemas)) {
+		if _, ok := cur.Schemas[typ]; !ok {
+			record("schema.delete", typ, nil)
+		}
+	}
+	if changed {
+		l.record(storage.AuditEntry{Actor: "config", Action: "config.applied"}, cur)
+	}
+	return nil
+}
+
+func fingerprint(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
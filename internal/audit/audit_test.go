@@ -0,0 +1,103 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/auth"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+// TestRequest records the caller and the request of an action, and ships
+// the stored entry.
+func TestRequest(t *testing.T) {
+	store := storage.NewMemory(1)
+	var shipped []event.Event
+	l := New(store, func(e event.Event) { shipped = append(shipped, e) })
+
+	r := httptest.NewRequest("DELETE", "/v1/events/42", nil)
+	ctx := auth.WithPrincipal(r.Context(), &auth.Principal{Subject: "ops-key"})
+	r = r.WithContext(context.WithValue(ctx, middleware.RequestIDKey, "req-1"))
+	l.Request(r, "event.delete", "42", map[string]string{"reason": "pii"})
+	l.Request(httptest.NewRequest("POST", "/admin/drain", nil), "drain", "", nil)
+	l.System("shutdown", "", nil)
+
+	entries, err := store.Audit(context.Background(), storage.AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("%d entries", len(entries))
+	}
+	// newest first
+	del := entries[2]
+	if del.Actor != "ops-key" || del.Action != "event.delete" || del.Target != "42" || del.Method != "DELETE" ||
+		del.Path != "/v1/events/42" || del.RequestID != "req-1" || del.RemoteAddr == "" || string(del.Details) != `{"reason":"pii"}` {
+		t.Errorf("delete entry %+v", del)
+	}
+	if entries[1].Actor != "anonymous" || entries[0].Actor != "system" || entries[0].Method != "" {
+		t.Errorf("drain %+v, shutdown %+v", entries[1], entries[0])
+	}
+	var first storage.AuditEntry
+	if len(shipped) != 3 || shipped[0].Type != "audit" || json.Unmarshal(shipped[0].Payload, &first) != nil || first.ID != del.ID {
+		t.Errorf("shipped %+v", shipped)
+	}
+}
+
+// TestConfig records the keys and schemas the configuration created,
+// changed and removed since it was last recorded, and nothing when it did
+// not change.
+func TestConfig(t *testing.T) {
+	store := storage.NewMemory(1)
+	l := New(store, nil)
+	cfg := &config.Config{
+		Auth: config.AuthConfig{APIKeys: []config.APIKeyConfig{
+			{ID: "ingest", Key: "k1", Roles: []string{"ingest"}},
+			{ID: "ops", Key: "k2", Roles: []string{"admin"}},
+		}},
+		Schemas: map[string]config.SchemaConfig{"order": {Latest: "1"}},
+	}
+	actions := func() []string {
+		t.Helper()
+		entries, err := store.Audit(context.Background(), storage.AuditQuery{Actor: "config"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, e := range slices.Backward(entries) {
+			out = append(out, e.Action+" "+e.Target)
+		}
+		return out
+	}
+
+	for _, tc := range []struct {
+		name   string
+		change func()
+		want   []string
+	}{
+		{"first start", func() {}, []string{"key.create ingest", "key.create ops", "schema.create order", "config.applied "}},
+		{"unchanged", func() {}, nil},
+		{"key rotated", func() { cfg.Auth.APIKeys[0].Key = "k3" }, []string{"key.update ingest", "config.applied "}},
+		{"roles reordered", func() { cfg.Auth.APIKeys[1].Roles = []string{"admin"} }, nil},
+		{"key and schema removed", func() {
+			cfg.Auth.APIKeys = cfg.Auth.APIKeys[:1]
+			cfg.Schemas = map[string]config.SchemaConfig{"order": {Latest: "2"}, "refund": {Latest: "1"}}
+		}, []string{"key.revoke ops", "schema.update order", "schema.create refund", "config.applied "}},
+	} {
+		before := len(actions())
+		tc.change()
+		if err := l.Config(cfg); err != nil {
+			t.Fatal(err)
+		}
+		if got := actions()[before:]; !slices.Equal(got, tc.want) {
+			t.Errorf("%s: recorded %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
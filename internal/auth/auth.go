@@ -0,0 +1,327 @@
+// Package auth authenticates requests with API keys or OIDC-issued JWTs and
+// enforces role-based access per route group.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/httpx"
+)
+
+type Role string
+
+const (
+	RoleIngest Role = "ingest"
+	RoleRead   Role = "read"
+	RoleAdmin  Role = "admin"
+	// RoleManage lets a tenant's keys change the tenant's own keys, sinks
+	// and alert rules.
+	RoleManage Role = "manage"
+)
+
+func validRole(r Role) bool {
+	return r == RoleIngest || r == RoleRead || r == RoleAdmin || r == RoleManage
+}
+
+// Principal is the authenticated caller.
+type Principal struct {
+	// Subject is the API key ID or the JWT "sub" claim.
+	Subject string
+	// Method is "api_key", "hmac" (a signed request) or "jwt".
+	Method string
+	Roles  []Role
+	// Namespaces limits the caller to event types in these subtrees;
+	// empty means every type.
+	Namespaces []string
+}
+
+// ErrNamespace is returned for event types outside the caller's namespaces.
+var ErrNamespace = errors.New("outside the caller's namespaces")
+
+// CanAccess reports whether p may write or read events of type typ. A nil
+// Principal (auth disabled) may access everything.
+func (p *Principal) CanAccess(typ string) bool {
+	if p == nil || len(p.Namespaces) == 0 {
+		return true
+	}
+	for _, ns := range p.Namespaces {
+		if event.InNamespace(typ, ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// ScopeTypes narrows type patterns to p's namespaces. No patterns become one
+// per namespace; given patterns must each stay inside a namespace, i.e. their
+// literal prefix up to the first wildcard lies in it.
+func (p *Principal) ScopeTypes(patterns []string) ([]string, error) {
+	if p == nil || len(p.Namespaces) == 0 {
+		return patterns, nil
+	}
+	if len(patterns) == 0 {
+		out := make([]string, len(p.Namespaces))
+		for i, ns := range p.Namespaces {
+			out[i] = ns + "/*"
+		}
+		return out, nil
+	}
+	for _, pat := range patterns {
+		literal, _, _ := strings.Cut(pat, "*")
+		literal, _, _ = strings.Cut(literal, "?")
+		if !p.CanAccess(literal) {
+			return nil, fmt.Errorf("type %q: %w", pat, ErrNamespace)
+		}
+	}
+	return patterns, nil
+}
+
+// Has reports whether p holds r; admins hold every role.
+func (p *Principal) Has(r Role) bool {
+	for _, have := range p.Roles {
+		if have == r || have == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+type ctxKey struct{}
+
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, ctxKey{}, p)
+}
+
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(ctxKey{}).(*Principal)
+	return p, ok
+}
+
+var failures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "auth_failures_total", Help: "Rejected requests by reason"},
+	[]string{"reason"},
+)
+
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{failures}
+}
+
+// Authenticator resolves request credentials into a Principal. API keys are
+// read from X-API-Key, signatures of keys with a signing secret from
+// X-Signature and JWTs from "Authorization: Bearer". All may be enabled at
+// the same time.
+type Authenticator struct {
+	enabled bool
+	jwt     *jwtVerifier
+	maxSkew time.Duration
+	nonces  *nonceCache
+	// maxBody caps the body of a signed request, read to verify it.
+	maxBody int64
+
+	mu      sync.RWMutex
+	keys    map[string]*Principal // by hex sha256 of the secret
+	signers map[string]signer     // by key ID
+}
+
+func New(cfg config.AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{
+		enabled: cfg.Enabled,
+		maxSkew: cfg.Signing.MaxSkew,
+		nonces:  newNonceCache(cfg.Signing.MaxNonces),
+		maxBody: cfg.Signing.MaxBodyBytes,
+		keys:    map[string]*Principal{},
+		signers: map[string]signer{},
+	}
+	for _, k := range cfg.APIKeys {
+		hash, p, err := apiKey(k)
+		if err != nil {
+			return nil, err
+		}
+		a.put(k, hash, p)
+	}
+	if cfg.OIDC.Issuer != "" {
+		v, err := newJWTVerifier(cfg.OIDC)
+		if err != nil {
+			return nil, err
+		}
+		a.jwt = v
+	}
+	return a, nil
+}
+
+// apiKey returns the secret hash and the Principal of k. Keys with a
+// signing secret have no hash.
+func apiKey(k config.APIKeyConfig) (string, *Principal, error) {
+	hash := strings.ToLower(k.KeySHA256)
+	if k.Key != "" {
+		hash = HashKey(k.Key)
+	}
+	if k.SigningSecret != "" {
+		hash = ""
+	}
+	p := &Principal{Subject: k.ID, Method: "api_key", Namespaces: k.Namespaces}
+	for _, ns := range k.Namespaces {
+		if err := event.ValidateNamespace(ns); err != nil {
+			return "", nil, fmt.Errorf("api key %s: %w", k.ID, err)
+		}
+	}
+	for _, r := range k.Roles {
+		if !validRole(Role(r)) {
+			return "", nil, fmt.Errorf("api key %s: unknown role %q", k.ID, r)
+		}
+		p.Roles = append(p.Roles, Role(r))
+	}
+	return hash, p, nil
+}
+
+// AddKeys accepts keys issued at runtime, e.g. for an onboarded tenant. It
+// adds none of them when one is invalid or its ID is already in use.
+func (a *Authenticator) AddKeys(keys []config.APIKeyConfig) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ids := map[string]bool{}
+	for _, p := range a.keys {
+		ids[p.Subject] = true
+	}
+	for id := range a.signers {
+		ids[id] = true
+	}
+	hashes := make([]string, len(keys))
+	principals := make([]*Principal, len(keys))
+	for i, k := range keys {
+		if ids[k.ID] {
+			return fmt.Errorf("api key %s: id already in use", k.ID)
+		}
+		ids[k.ID] = true
+		hash, p, err := apiKey(k)
+		if err != nil {
+			return err
+		}
+		hashes[i], principals[i] = hash, p
+	}
+	for i, k := range keys {
+		a.put(k, hashes[i], principals[i])
+	}
+	return nil
+}
+
+// put adds a key by its hash or, with a signing secret, its ID; a.mu is
+// held or a is not shared yet.
+func (a *Authenticator) put(k config.APIKeyConfig, hash string, p *Principal) {
+	if k.SigningSecret != "" {
+		p.Method = "hmac"
+		a.signers[k.ID] = signer{secret: []byte(k.SigningSecret), p: p}
+		return
+	}
+	a.keys[hash] = p
+}
+
+// RemoveKeys revokes the API keys with the given IDs.
+func (a *Authenticator) RemoveKeys(ids ...string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for hash, p := range a.keys {
+		for _, id := range ids {
+			if p.Subject == id {
+				delete(a.keys, hash)
+			}
+		}
+	}
+	for _, id := range ids {
+		delete(a.signers, id)
+	}
+}
+
+// key returns the Principal of an API key secret.
+func (a *Authenticator) key(secret string) (*Principal, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	p, ok := a.keys[HashKey(secret)]
+	return p, ok
+}
+
+// HashKey returns the hex sha256 of an API key secret, as in key_sha256.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Middleware authenticates every request when auth is enabled and stores the
+// Principal in the request context. Requests without valid credentials get 401.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	if !a.enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, reason := a.authenticate(r)
+		if p == nil {
+			failures.WithLabelValues(reason).Inc()
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ingest"`)
+			httpx.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+	})
+}
+
+// Require rejects requests whose Principal holds none of roles with 403.
+// It is a no-op when auth is disabled.
+func (a *Authenticator) Require(roles ...Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !a.enabled {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := FromContext(r.Context())
+			if ok {
+				for _, role := range roles {
+					if p.Has(role) {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+			failures.WithLabelValues("forbidden").Inc()
+			httpx.Error(w, "forbidden", http.StatusForbidden)
+		})
+	}
+}
+
+func (a *Authenticator) authenticate(r *http.Request) (*Principal, string) {
+	if r.Header.Get(SignatureHeader) != "" {
+		return a.verifySignature(r)
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		if p, ok := a.key(key); ok {
+			return p, ""
+		}
+		return nil, "invalid_api_key"
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, "missing_credentials"
+	}
+	if a.jwt != nil && strings.Count(token, ".") == 2 {
+		p, err := a.jwt.verify(token)
+		if err != nil {
+			return nil, "invalid_jwt"
+		}
+		return p, ""
+	}
+	if p, ok := a.key(token); ok {
+		return p, ""
+	}
+	return nil, "invalid_api_key"
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// TestNamespaces limits a key to the subtrees of its namespaces, for the
+// types it sends and the type patterns it reads with.
+func TestNamespaces(t *testing.T) {
+	a, err := New(config.AuthConfig{Enabled: true, APIKeys: []config.APIKeyConfig{
+		{ID: "billing", Key: "k1", Roles: []string{"ingest"}, Namespaces: []string{"acme/billing"}},
+		{ID: "all", Key: "k2", Roles: []string{"ingest"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	billing, _ := a.key("k1")
+	all, _ := a.key("k2")
+	for _, tc := range []struct {
+		p    *Principal
+		typ  string
+		want bool
+	}{
+		{billing, "acme/billing/invoice.paid", true},
+		{billing, "acme/billing/eu/invoice.paid", true},
+		{billing, "acme/shipping/sent", false},
+		{billing, "acme/billingx/invoice.paid", false},
+		{billing, "invoice.paid", false},
+		{all, "acme/shipping/sent", true},
+		{nil, "invoice.paid", true},
+	} {
+		if got := tc.p.CanAccess(tc.typ); got != tc.want {
+			t.Errorf("%v on %s: %v, want %v", tc.p, tc.typ, got, tc.want)
+		}
+	}
+
+	if got, err := billing.ScopeTypes(nil); err != nil || !slices.Equal(got, []string{"acme/billing/*"}) {
+		t.Errorf("no patterns: %v, %v", got, err)
+	}
+	if got, err := billing.ScopeTypes([]string{"acme/billing/invoice.*"}); err != nil || len(got) != 1 {
+		t.Errorf("pattern inside: %v, %v", got, err)
+	}
+	for _, pat := range []string{"acme/*", "acme/bill*", "*"} {
+		if _, err := billing.ScopeTypes([]string{pat}); !errors.Is(err, ErrNamespace) {
+			t.Errorf("pattern %s: %v", pat, err)
+		}
+	}
+
+	for _, ns := range []string{"", "/acme", "acme/", "acme//billing", "acme/*"} {
+		_, err := New(config.AuthConfig{Enabled: true, APIKeys: []config.APIKeyConfig{{ID: "x", Key: "k", Namespaces: []string{ns}}}})
+		if err == nil {
+			t.Errorf("namespace %q accepted", ns)
+		}
+	}
+}
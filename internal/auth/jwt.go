@@ -0,0 +1,305 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// jwtVerifier validates tokens issued by an OIDC provider against its JWKS.
+// Keys are cached and refetched every refresh interval, or early (at most once
+// per minRefetch) when a token of the issuer references an unknown kid after
+// key rotation. Fetches run without holding mu, one at a time: tokens signed
+// with a known key are verified meanwhile, those waiting for a key share the
+// fetch.
+type jwtVerifier struct {
+	cfg    config.OIDCConfig
+	parser *jwt.Parser
+	client *http.Client
+
+	mu   sync.Mutex
+	keys map[string]any
+	// fetchedAt is when the last fetch started; fetching is closed when the
+	// running one ends, nil when none runs.
+	fetchedAt time.Time
+	fetching  chan struct{}
+	fetchErr  error
+}
+
+const minRefetch = 30 * time.Second
+
+func newJWTVerifier(cfg config.OIDCConfig) (*jwtVerifier, error) {
+	if cfg.RolesClaim == "" {
+		cfg.RolesClaim = "roles"
+	}
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = time.Hour
+	}
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(cfg.Issuer),
+		jwt.WithLeeway(cfg.Leeway),
+		jwt.WithExpirationRequired(),
+	}
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+	for _, roles := range cfg.RoleMapping {
+		for _, r := range roles {
+			if !validRole(Role(r)) {
+				return nil, fmt.Errorf("oidc role_mapping: unknown role %q", r)
+			}
+		}
+	}
+	return &jwtVerifier{
+		cfg:    cfg,
+		parser: jwt.NewParser(opts...),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (v *jwtVerifier) verify(raw string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(raw, claims, v.keyFunc); err != nil {
+		return nil, err
+	}
+	sub, _ := claims.GetSubject()
+	p := &Principal{Subject: sub, Method: "jwt", Roles: v.roles(claims)}
+	if len(p.Roles) == 0 {
+		return nil, errors.New("token carries no known role")
+	}
+	if v.cfg.NamespacesClaim != "" {
+		// a missing claim must not widen the token to every namespace
+		for _, ns := range claimValues(claims, v.cfg.NamespacesClaim) {
+			if event.ValidateNamespace(ns) == nil {
+				p.Namespaces = append(p.Namespaces, ns)
+			}
+		}
+		if len(p.Namespaces) == 0 {
+			return nil, errors.New("token carries no namespace")
+		}
+	}
+	return p, nil
+}
+
+// claimValues reads the claim at a dotted path such as "realm_access.roles",
+// holding an array or a space separated string.
+func claimValues(claims jwt.MapClaims, path string) []string {
+	var cur any = map[string]any(claims)
+	for _, part := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil
+		}
+		cur = m[part]
+	}
+	var values []string
+	switch c := cur.(type) {
+	case string:
+		values = strings.Fields(c)
+	case []any:
+		for _, x := range c {
+			if s, ok := x.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+// roles maps the values of the configured roles claim to service roles.
+// Only values in the role mapping grant roles: a claim the provider lets
+// users set must not name a service role by accident.
+func (v *jwtVerifier) roles(claims jwt.MapClaims) []Role {
+	seen := map[Role]bool{}
+	var out []Role
+	for _, val := range claimValues(claims, v.cfg.RolesClaim) {
+		for _, r := range v.cfg.RoleMapping[val] {
+			if !seen[Role(r)] {
+				seen[Role(r)] = true
+				out = append(out, Role(r))
+			}
+		}
+	}
+	return out
+}
+
+func (v *jwtVerifier) keyFunc(t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	since := time.Since(v.fetchedAt)
+	switch {
+	case ok:
+		if since > v.cfg.RefreshInterval {
+			v.refresh()
+		}
+		v.mu.Unlock()
+		return key, nil
+	case v.keys == nil || (since > minRefetch && v.ofIssuer(t)):
+		done := v.refresh()
+		v.mu.Unlock()
+		<-done
+	default:
+		v.mu.Unlock()
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if v.keys == nil {
+		return nil, v.fetchErr
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// ofIssuer reports whether the unverified claims of t are of the issuer and
+// not expired, so that made up tokens cannot make every unknown kid refetch.
+func (v *jwtVerifier) ofIssuer(t *jwt.Token) bool {
+	iss, err := t.Claims.GetIssuer()
+	if err != nil || iss != v.cfg.Issuer {
+		return false
+	}
+	exp, err := t.Claims.GetExpirationTime()
+	return err == nil && exp != nil && time.Now().Before(exp.Add(v.cfg.Leeway))
+}
+
+// refresh starts fetching the JWKS unless a fetch runs already, returning
+// a channel closed when it ends; the caller holds v.mu.
+func (v *jwtVerifier) refresh() <-chan struct{} {
+	if v.fetching != nil {
+		return v.fetching
+	}
+	done := make(chan struct{})
+	v.fetching, v.fetchedAt = done, time.Now()
+	go func() {
+		keys, err := v.fetch()
+		v.mu.Lock()
+		if err == nil {
+			v.keys = keys
+		}
+		v.fetchErr, v.fetching = err, nil
+		v.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// fetch loads the JWKS.
+func (v *jwtVerifier) fetch() (map[string]any, error) {
+	url := v.cfg.JWKSURL
+	if url == "" {
+		var doc struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(strings.TrimSuffix(v.cfg.Issuer, "/")+"/.well-known/openid-configuration", &doc); err != nil {
+			return nil, fmt.Errorf("oidc discovery: %w", err)
+		}
+		url = doc.JWKSURI
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := v.getJSON(url, &set); err != nil {
+		return nil, fmt.Errorf("fetch jwks: %w", err)
+	}
+	keys := map[string]any{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	return keys, nil
+}
+
+func (v *jwtVerifier) getJSON(url string, out any) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		curve, size, err := ecCurve(k.Crv)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("invalid EC coordinates")
+		}
+		return ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, x...), y...))
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func ecCurve(crv string) (elliptic.Curve, int, error) {
+	switch crv {
+	case "P-256":
+		return elliptic.P256(), 32, nil
+	case "P-384":
+		return elliptic.P384(), 48, nil
+	case "P-521":
+		return elliptic.P521(), 66, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported curve %q", crv)
+	}
+}
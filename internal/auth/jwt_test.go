@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+const issuer = "https://login.example.com/realms/platform"
+
+// provider serves a JWKS with the public keys it holds, counting fetches;
+// a fetch blocks while hold is set.
+type provider struct {
+	mu      sync.Mutex
+	keys    map[string]*ecdsa.PrivateKey
+	fetches atomic.Int32
+	hold    chan struct{}
+}
+
+func newProvider(t *testing.T) (*provider, *httptest.Server) {
+	p := &provider{keys: map[string]*ecdsa.PrivateKey{}}
+	p.rotate(t, "k1")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.fetches.Add(1)
+		p.mu.Lock()
+		hold := p.hold
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		for kid, k := range p.keys {
+			b64 := func(n []byte) string { return base64.RawURLEncoding.EncodeToString(n) }
+			x, y := make([]byte, 32), make([]byte, 32)
+			k.X.FillBytes(x)
+			k.Y.FillBytes(y)
+			set.Keys = append(set.Keys, jwk{Kty: "EC", Kid: kid, Use: "sig", Crv: "P-256", X: b64(x), Y: b64(y)})
+		}
+		p.mu.Unlock()
+		if hold != nil {
+			<-hold
+		}
+		_ = json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(srv.Close)
+	return p, srv
+}
+
+// rotate publishes a new key under kid in place of the others.
+func (p *provider) rotate(t *testing.T, kid string) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	p.keys = map[string]*ecdsa.PrivateKey{kid: k}
+	p.mu.Unlock()
+}
+
+// token signs claims, completed with valid defaults, with the key under kid;
+// with another key instead when forged.
+func (p *provider) token(t *testing.T, kid string, claims jwt.MapClaims, forged bool) string {
+	full := jwt.MapClaims{"iss": issuer, "aud": "ingest-api", "sub": "svc-1", "exp": time.Now().Add(time.Hour).Unix(), "roles": []string{"ingest-writer"}}
+	for k, v := range claims {
+		full[k] = v
+	}
+	p.mu.Lock()
+	key := p.keys[kid]
+	p.mu.Unlock()
+	if key == nil || forged {
+		var err error
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodES256, full)
+	tok.Header["kid"] = kid
+	s, err := tok.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func verifier(t *testing.T, jwks string) *jwtVerifier {
+	v, err := newJWTVerifier(config.OIDCConfig{
+		Issuer:      issuer,
+		JWKSURL:     jwks,
+		Audience:    "ingest-api",
+		RoleMapping: map[string][]string{"ingest-writer": {"ingest"}, "analyst": {"read"}, "ops": {"admin", "read"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// TestJWTVerify accepts a token signed by the issuer's key for the audience
+// and rejects any that is forged, of another issuer or audience, or expired.
+func TestJWTVerify(t *testing.T) {
+	p, srv := newProvider(t)
+	v := verifier(t, srv.URL)
+
+	got, err := v.verify(p.token(t, "k1", nil, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Subject != "svc-1" || got.Method != "jwt" || !slices.Equal(got.Roles, []Role{RoleIngest}) {
+		t.Errorf("principal %+v", got)
+	}
+	for name, tok := range map[string]string{
+		"forged":         p.token(t, "k1", nil, true),
+		"other issuer":   p.token(t, "k1", jwt.MapClaims{"iss": "https://evil.example.com"}, false),
+		"other audience": p.token(t, "k1", jwt.MapClaims{"aud": "billing-api"}, false),
+		"expired":        p.token(t, "k1", jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}, false),
+		"no expiry":      p.token(t, "k1", jwt.MapClaims{"exp": nil}, false),
+		"not yet valid":  p.token(t, "k1", jwt.MapClaims{"nbf": time.Now().Add(time.Hour).Unix()}, false),
+		"hmac":           hmacToken(t),
+	} {
+		if got, err := v.verify(tok); err == nil {
+			t.Errorf("%s: accepted as %+v", name, got)
+		}
+	}
+}
+
+func hmacToken(t *testing.T) string {
+	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"iss": issuer, "aud": "ingest-api", "exp": time.Now().Add(time.Hour).Unix(), "roles": "ingest-writer"})
+	tok.Header["kid"] = "k1"
+	s, err := tok.SignedString([]byte("k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// TestJWTRoles grants only the roles the mapping lists for the claim's
+// values: a value naming a role itself grants nothing.
+func TestJWTRoles(t *testing.T) {
+	p, srv := newProvider(t)
+	v := verifier(t, srv.URL)
+	for _, c := range []struct {
+		roles any
+		want  []Role
+	}{
+		{[]string{"analyst", "ops"}, []Role{RoleRead, RoleAdmin}},
+		{"ingest-writer analyst", []Role{RoleIngest, RoleRead}},
+		{[]string{"admin", "analyst"}, []Role{RoleRead}},
+		{[]string{"admin"}, nil},
+		{nil, nil},
+	} {
+		got, err := v.verify(p.token(t, "k1", jwt.MapClaims{"roles": c.roles}, false))
+		if c.want == nil {
+			if err == nil {
+				t.Errorf("roles %v: accepted with %v", c.roles, got.Roles)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got.Roles, c.want) {
+			t.Errorf("roles %v: %v, %v; want %v", c.roles, got, err, c.want)
+		}
+	}
+}
+
+// TestJWTKeyRotation refetches the JWKS for a new kid of the issuer, at most
+// once per minRefetch, and not for tokens of anyone else.
+func TestJWTKeyRotation(t *testing.T) {
+	p, srv := newProvider(t)
+	v := verifier(t, srv.URL)
+	if _, err := v.verify(p.token(t, "k1", nil, false)); err != nil {
+		t.Fatal(err)
+	}
+	p.rotate(t, "k2")
+	rotated := p.token(t, "k2", nil, false)
+	if _, err := v.verify(rotated); err == nil {
+		t.Fatal("new kid accepted before minRefetch passed")
+	}
+
+	v.mu.Lock()
+	v.fetchedAt = time.Now().Add(-2 * minRefetch)
+	v.mu.Unlock()
+	before := p.fetches.Load()
+	for _, tok := range []string{
+		p.token(t, "k9", jwt.MapClaims{"iss": "https://evil.example.com"}, false),
+		p.token(t, "k9", jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}, false),
+	} {
+		if _, err := v.verify(tok); err == nil {
+			t.Fatal("unknown kid accepted")
+		}
+	}
+	if n := p.fetches.Load() - before; n != 0 {
+		t.Fatalf("%d fetches for tokens of no concern", n)
+	}
+	if _, err := v.verify(rotated); err != nil {
+		t.Fatalf("after rotation: %v", err)
+	}
+	if n := p.fetches.Load() - before; n != 1 {
+		t.Errorf("%d fetches for the rotation", n)
+	}
+}
+
+// TestJWTFetchOutsideLock verifies tokens with a cached key while a
+// refresh hangs on the provider.
+func TestJWTFetchOutsideLock(t *testing.T) {
+	p, srv := newProvider(t)
+	v := verifier(t, srv.URL)
+	tok := p.token(t, "k1", nil, false)
+	if _, err := v.verify(tok); err != nil {
+		t.Fatal(err)
+	}
+	hold := make(chan struct{})
+	p.mu.Lock()
+	p.hold = hold
+	p.mu.Unlock()
+	defer close(hold)
+	v.mu.Lock()
+	v.fetchedAt = time.Now().Add(-2 * v.cfg.RefreshInterval)
+	v.mu.Unlock()
+
+	done := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := v.verify(tok)
+			done <- err
+		}()
+	}
+	for range 2 {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("verify blocked on the JWKS fetch")
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of HMAC-signed requests. The signature is "v1=" and the hex
+// HMAC-SHA256, keyed with the key's signing secret, of SigningString.
+const (
+	SignatureKeyHeader       = "X-Signature-Key"
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	SignatureNonceHeader     = "X-Signature-Nonce"
+	SignatureHeader          = "X-Signature"
+)
+
+// SigningString is what a request's signature covers: the Unix timestamp in
+// seconds, the nonce, the method, the request URI (path and query) and the
+// body as sent, compressed or not, separated by newlines.
+func SigningString(timestamp, nonce, method, uri string, body []byte) []byte {
+	var b bytes.Buffer
+	b.Grow(len(timestamp) + len(nonce) + len(method) + len(uri) + len(body) + 4)
+	for _, s := range []string{timestamp, nonce, method, uri} {
+		b.WriteString(s)
+		b.WriteByte('\n')
+	}
+	b.Write(body)
+	return b.Bytes()
+}
+
+// Sign returns the X-Signature value of a request.
+func Sign(secret []byte, timestamp, nonce, method, uri string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(SigningString(timestamp, nonce, method, uri, body))
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// signer is an API key that authenticates by signing requests.
+type signer struct {
+	secret []byte
+	p      *Principal
+}
+
+// verifySignature authenticates a signed request: the signature must match
+// the body, the timestamp be within maxSkew of now, and the nonce not have
+// been seen with the key before. The body, of at most maxBody bytes,
+// is read and put back.
+func (a *Authenticator) verifySignature(r *http.Request) (*Principal, string) {
+	a.mu.RLock()
+	s, ok := a.signers[r.Header.Get(SignatureKeyHeader)]
+	a.mu.RUnlock()
+	if !ok {
+		return nil, "invalid_api_key"
+	}
+	ts, nonce := r.Header.Get(SignatureTimestampHeader), r.Header.Get(SignatureNonceHeader)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || len(nonce) < 8 || len(nonce) > 128 {
+		return nil, "invalid_signature"
+	}
+	now := time.Now()
+	at := time.Unix(sec, 0)
+	if at.Before(now.Add(-a.maxSkew)) || at.After(now.Add(a.maxSkew)) {
+		return nil, "stale_signature"
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, a.maxBody+1))
+	if err != nil {
+		return nil, "invalid_signature"
+	}
+	if int64(len(body)) > a.maxBody {
+		return nil, "signed_body_too_large"
+	}
+	_ = r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	want := Sign(s.secret, ts, nonce, r.Method, r.URL.RequestURI(), body)
+	if !hmac.Equal([]byte(want), []byte(strings.TrimSpace(r.Header.Get(SignatureHeader)))) {
+		return nil, "invalid_signature"
+	}
+	// only a valid signature spends the nonce, so forged requests cannot
+	// fill the cache
+	switch a.nonces.use(s.p.Subject+"\x00"+nonce, at.Add(a.maxSkew), now) {
+	case nonceReplayed:
+		return nil, "replayed_nonce"
+	case nonceCacheFull:
+		return nil, "nonce_cache_full"
+	}
+	return s.p, ""
+}
+
+type nonceResult int
+
+const (
+	nonceFresh nonceResult = iota
+	nonceReplayed
+	nonceCacheFull
+)
+
+// nonceCache remembers the nonces of signed requests until their timestamp
+// falls out of the skew window, after which a replay is stale anyway.
+type nonceCache struct {
+	max int
+
+	mu      sync.Mutex
+	expires map[string]time.Time
+	// queue orders the nonces by expiry, so expired ones are dropped from
+	// its front instead of by scanning expires
+	queue nonceQueue
+}
+
+func newNonceCache(max int) *nonceCache {
+	return &nonceCache{max: max, expires: map[string]time.Time{}}
+}
+
+// use records nonce until expires, reporting whether it was seen already
+// or, with no room left, cannot be remembered.
+func (c *nonceCache) use(nonce string, expires, now time.Time) nonceResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.queue) > 0 && !c.queue[0].expires.After(now) {
+		delete(c.expires, heap.Pop(&c.queue).(nonceEntry).nonce)
+	}
+	if _, ok := c.expires[nonce]; ok {
+		return nonceReplayed
+	}
+	if len(c.expires) >= c.max {
+		return nonceCacheFull
+	}
+	c.expires[nonce] = expires
+	heap.Push(&c.queue, nonceEntry{nonce: nonce, expires: expires})
+	return nonceFresh
+}
+
+type nonceEntry struct {
+	nonce   string
+	expires time.Time
+}
+
+// nonceQueue is a min-heap of nonces by expiry.
+type nonceQueue []nonceEntry
+
+func (q nonceQueue) Len() int           { return len(q) }
+func (q nonceQueue) Less(i, j int) bool { return q[i].expires.Before(q[j].expires) }
+func (q nonceQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *nonceQueue) Push(x any)        { *q = append(*q, x.(nonceEntry)) }
+
+func (q *nonceQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+const secret = "pos-secret"
+
+func signingAuth(t *testing.T, signing config.SigningConfig) *Authenticator {
+	t.Helper()
+	a, err := New(config.AuthConfig{
+		Enabled: true,
+		APIKeys: []config.APIKeyConfig{{ID: "pos", SigningSecret: secret, Roles: []string{"ingest"}}},
+		Signing: signing,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// signed returns a request signed at at with nonce; sig overrides the
+// signature when not empty.
+func signed(at time.Time, nonce, body, sig string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/v1/events?dry_run=true", strings.NewReader(body))
+	ts := strconv.FormatInt(at.Unix(), 10)
+	if sig == "" {
+		sig = Sign([]byte(secret), ts, nonce, r.Method, r.URL.RequestURI(), []byte(body))
+	}
+	r.Header.Set(SignatureKeyHeader, "pos")
+	r.Header.Set(SignatureTimestampHeader, ts)
+	r.Header.Set(SignatureNonceHeader, nonce)
+	r.Header.Set(SignatureHeader, sig)
+	return r
+}
+
+// TestVerifySignature accepts a request signed over its body and hands the
+// body on; a tampered body or URI, a wrong secret or a clock outside the
+// skew window is refused.
+func TestVerifySignature(t *testing.T) {
+	a := signingAuth(t, config.SigningConfig{MaxSkew: time.Minute, MaxNonces: 100, MaxBodyBytes: 64})
+	now := time.Now()
+	body := `{"type":"sale","payload":{}}`
+
+	r := signed(now, "nonce-0001", body, "")
+	p, reason := a.authenticate(r)
+	if p == nil || p.Subject != "pos" || p.Method != "hmac" {
+		t.Fatalf("valid request: %v, %s", p, reason)
+	}
+	if got, _ := io.ReadAll(r.Body); string(got) != body {
+		t.Errorf("body handed on: %q", got)
+	}
+
+	tampered := signed(now, "nonce-0002", body, "")
+	tampered.Body = io.NopCloser(strings.NewReader(`{"type":"refund","payload":{}}`))
+	otherURI := signed(now, "nonce-0003", body, "")
+	otherURI.URL.RawQuery = ""
+	ts := strconv.FormatInt(now.Unix(), 10)
+	for name, c := range map[string]struct {
+		r    *http.Request
+		want string
+	}{
+		"tampered body": {tampered, "invalid_signature"},
+		"other uri":     {otherURI, "invalid_signature"},
+		"wrong secret":  {signed(now, "nonce-0004", body, Sign([]byte("guess"), ts, "nonce-0004", "POST", "/v1/events?dry_run=true", []byte(body))), "invalid_signature"},
+		"short nonce":   {signed(now, "n-1", body, ""), "invalid_signature"},
+		"too old":       {signed(now.Add(-2*time.Minute), "nonce-0005", body, ""), "stale_signature"},
+		"too new":       {signed(now.Add(2*time.Minute), "nonce-0006", body, ""), "stale_signature"},
+		"too large":     {signed(now, "nonce-0007", strings.Repeat("x", 65), ""), "signed_body_too_large"},
+	} {
+		if p, reason := a.authenticate(c.r); p != nil || reason != c.want {
+			t.Errorf("%s: %v, %q, want %q", name, p, reason, c.want)
+		}
+	}
+}
+
+// TestReplayedNonce refuses a nonce used before with the key, but not a
+// nonce of a request that failed verification.
+func TestReplayedNonce(t *testing.T) {
+	a := signingAuth(t, config.SigningConfig{MaxSkew: time.Minute, MaxNonces: 100, MaxBodyBytes: 1024})
+	now := time.Now()
+	if p, reason := a.authenticate(signed(now, "nonce-forged", "{}", "v1=00")); p != nil || reason != "invalid_signature" {
+		t.Fatalf("forged: %v, %s", p, reason)
+	}
+	if p, reason := a.authenticate(signed(now, "nonce-forged", "{}", "")); p == nil {
+		t.Fatalf("first use after a forged request: %s", reason)
+	}
+	if p, reason := a.authenticate(signed(now, "nonce-forged", "{}", "")); p != nil || reason != "replayed_nonce" {
+		t.Errorf("replay: %v, %s", p, reason)
+	}
+}
+
+// TestNonceCacheFull refuses new nonces while the cache is full of live
+// ones and takes them again once the oldest expire.
+func TestNonceCacheFull(t *testing.T) {
+	c := newNonceCache(3)
+	now := time.Now()
+	for i := range 3 {
+		if got := c.use(fmt.Sprint("n", i), now.Add(time.Duration(i+1)*time.Second), now); got != nonceFresh {
+			t.Fatalf("n%d: %v", i, got)
+		}
+	}
+	if got := c.use("n3", now.Add(time.Minute), now); got != nonceCacheFull {
+		t.Fatalf("full: %v", got)
+	}
+	if got := c.use("n1", now.Add(time.Minute), now); got != nonceReplayed {
+		t.Fatalf("replay while full: %v", got)
+	}
+
+	later := now.Add(1500 * time.Millisecond) // n0 expired
+	if got := c.use("n3", later.Add(time.Minute), later); got != nonceFresh {
+		t.Fatalf("after expiry: %v", got)
+	}
+	if got := c.use("n0", later.Add(time.Minute), later); got != nonceCacheFull {
+		t.Errorf("expired nonce with the cache full again: %v", got)
+	}
+	if len(c.expires) != len(c.queue) {
+		t.Errorf("%d nonces, %d queued", len(c.expires), len(c.queue))
+	}
+}
@@ -0,0 +1,205 @@
+// Package breaker implements circuit breakers for the service's external
+// dependencies. After a run of consecutive failures a breaker opens and
+// rejects calls at once instead of letting them wait on a dependency that is
+// down; once its open timeout passes, a single probe call is let through,
+// which closes the breaker when it succeeds and opens it again when not.
+package breaker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+var (
+	stateGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "circuit_breaker_state", Help: "Circuit breaker state: 0 closed, 1 half-open, 2 open"},
+		[]string{"breaker"},
+	)
+	transitions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "circuit_breaker_transitions_total", Help: "Circuit breaker state changes by the state entered"},
+		[]string{"breaker", "state"},
+	)
+	rejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "circuit_breaker_rejected_total", Help: "Calls rejected by an open circuit breaker"},
+		[]string{"breaker"},
+	)
+)
+
+// Collectors returns the breaker metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{stateGauge, transitions, rejected}
+}
+
+type State int
+
+const (
+	Closed State = iota
+	HalfOpen
+	Open
+)
+
+func (s State) String() string {
+	switch s {
+	case HalfOpen:
+		return "half_open"
+	case Open:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// ErrOpen matches every *OpenError with errors.Is.
+var ErrOpen = errors.New("circuit breaker open")
+
+// OpenError is returned by Allow while a breaker rejects calls.
+type OpenError struct {
+	Name string
+	// RetryAfter is how long until the next probe may be let through.
+	RetryAfter time.Duration
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("%s unavailable: circuit breaker open", e.Name)
+}
+
+func (e *OpenError) Is(target error) bool { return target == ErrOpen }
+
+// Breaker guards calls to one dependency. A nil *Breaker, as returned for a
+// disabled config, allows every call.
+type Breaker struct {
+	name      string
+	threshold int
+	timeout   time.Duration
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	// until is when an open breaker lets the next probe through
+	until time.Time
+	// probing is set while the half-open probe is in flight
+	probing bool
+}
+
+// New returns the breaker for the dependency name, or nil when cfg
+// disables it.
+func New(name string, cfg config.BreakerConfig) *Breaker {
+	if cfg.FailureThreshold <= 0 {
+		return nil
+	}
+	stateGauge.WithLabelValues(name).Set(float64(Closed))
+	return &Breaker{name: name, threshold: cfg.FailureThreshold, timeout: cfg.OpenTimeout}
+}
+
+func (b *Breaker) Name() string {
+	if b == nil {
+		return ""
+	}
+	return b.name
+}
+
+// Allow reports whether a call may proceed, or returns an *OpenError. Every
+// allowed call must be followed by Done with its outcome.
+func (b *Breaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case Open:
+		if wait := time.Until(b.until); wait > 0 {
+			rejected.WithLabelValues(b.name).Inc()
+			return &OpenError{Name: b.name, RetryAfter: wait}
+		}
+		b.set(HalfOpen)
+		b.probing = true
+		return nil
+	case HalfOpen:
+		if b.probing {
+			rejected.WithLabelValues(b.name).Inc()
+			return &OpenError{Name: b.name, RetryAfter: b.timeout}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Done records the outcome of a call Allow let through; a nil err is a
+// success.
+func (b *Breaker) Done(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == HalfOpen {
+		b.probing = false
+	}
+	if err == nil {
+		b.failures = 0
+		if b.state != Closed {
+			b.set(Closed)
+			log.Info().Str("breaker", b.name).Msg("circuit breaker closed")
+		}
+		return
+	}
+	b.failures++
+	if b.state == HalfOpen || (b.state == Closed && b.failures >= b.threshold) {
+		b.until = time.Now().Add(b.timeout)
+		b.set(Open)
+		log.Warn().Err(err).Str("breaker", b.name).Int("failures", b.failures).Dur("open_for", b.timeout).Msg("circuit breaker opened")
+	}
+}
+
+// Abandon ends a call Allow let through without an outcome, as when its
+// caller gave up on it: it neither resets nor adds to the failures, and a
+// half-open breaker lets the next call probe.
+func (b *Breaker) Abandon() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == HalfOpen {
+		b.probing = false
+	}
+}
+
+// Do runs fn unless the breaker is open, recording its outcome.
+func (b *Breaker) Do(fn func() error) error {
+	if err := b.Allow(); err != nil {
+		return err
+	}
+	err := fn()
+	b.Done(err)
+	return err
+}
+
+// State returns the current state. An open breaker whose timeout passed
+// reports HalfOpen, since the next call probes it: a readiness check that
+// took the instance out of rotation must let calls back in for that.
+func (b *Breaker) State() State {
+	if b == nil {
+		return Closed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Open && !time.Now().Before(b.until) {
+		return HalfOpen
+	}
+	return b.state
+}
+
+func (b *Breaker) set(s State) {
+	b.state = s
+	stateGauge.WithLabelValues(b.name).Set(float64(s))
+	transitions.WithLabelValues(b.name, s.String()).Inc()
+}
@@ -0,0 +1,76 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// TestBreaker walks a breaker through opening on consecutive failures, a
+// failed probe, an abandoned one, and a probe that closes it.
+func TestBreaker(t *testing.T) {
+	b := New("test", config.BreakerConfig{FailureThreshold: 3, OpenTimeout: 20 * time.Millisecond})
+	down := errors.New("down")
+	fail := func() error { return down }
+
+	_ = b.Do(fail)
+	_ = b.Do(fail)
+	_ = b.Do(func() error { return nil })
+	_ = b.Do(fail)
+	_ = b.Do(fail)
+	if got := b.State(); got != Closed {
+		t.Fatalf("after a success and two failures: state %v, want closed", got)
+	}
+	_ = b.Do(fail)
+	if got := b.State(); got != Open {
+		t.Fatalf("after three failures: state %v, want open", got)
+	}
+	err := b.Do(func() error { t.Fatal("called while open"); return nil })
+	if !errors.Is(err, ErrOpen) {
+		t.Fatalf("call while open: %v, want ErrOpen", err)
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if got := b.State(); got != HalfOpen {
+		t.Fatalf("after the open timeout: state %v, want half_open", got)
+	}
+	if err := b.Allow(); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if err := b.Allow(); !errors.Is(err, ErrOpen) {
+		t.Fatalf("second call during the probe: %v, want ErrOpen", err)
+	}
+	b.Done(down)
+	if got := b.State(); got != Open {
+		t.Fatalf("after a failed probe: state %v, want open", got)
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	b.Abandon()
+	if got := b.State(); got != HalfOpen {
+		t.Fatalf("after an abandoned probe: state %v, want half_open", got)
+	}
+	if err := b.Do(func() error { return nil }); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if got := b.State(); got != Closed {
+		t.Fatalf("after a successful probe: state %v, want closed", got)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	b := New("off", config.BreakerConfig{})
+	if b != nil {
+		t.Fatal("a zero failure_threshold should disable the breaker")
+	}
+	for range 10 {
+		if err := b.Do(func() error { return errors.New("down") }); errors.Is(err, ErrOpen) {
+			t.Fatal("a disabled breaker opened")
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Package cache keeps encoded responses of read queries in process so that
+// dashboards repeating the same query do not hit the store every time.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "query_cache_requests_total", Help: "Query cache lookups by route and result (hit, miss)"},
+		[]string{"route", "result"},
+	)
+	invalidationsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "query_cache_invalidations_total", Help: "Cached responses dropped because a new event matched them"},
+	)
+	entriesGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "query_cache_entries", Help: "Responses currently cached"},
+	)
+)
+
+// Collectors returns the cache metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{requestsTotal, invalidationsTotal, entriesGauge}
+}
+
+// Cache is an LRU of encoded responses. An entry lives until its TTL passes
+// or an accepted event matches the query that produced it. A disabled Cache
+// never stores anything.
+//
+// Every miss starts a fill under a new generation, which Put must present:
+// an event matching the fill's query, or a Reset, while the response is
+// computed revokes the generation, so a response read before the change is
+// not stored.
+type Cache struct {
+	enabled bool
+	ttl     time.Duration
+	max     int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+	gen     uint64
+	fills   map[uint64]fill
+}
+
+// fill is a response being computed after a miss.
+type fill struct {
+	query   storage.Query
+	started time.Time
+}
+
+type entry struct {
+	key     string
+	query   storage.Query
+	body    []byte
+	expires time.Time
+}
+
+func New(cfg config.CacheConfig) *Cache {
+	c := &Cache{
+		enabled: cfg.Enabled,
+		ttl:     cfg.TTL,
+		max:     cfg.MaxEntries,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+		fills:   map[uint64]fill{},
+	}
+	if c.ttl <= 0 {
+		c.ttl = 10 * time.Second
+	}
+	if c.max <= 0 {
+		c.max = 1000
+	}
+	return c
+}
+
+// Get returns the cached response for key, recording a hit or miss for
+// route. On a miss it returns the generation under which Put stores the
+// response computed from q.
+func (c *Cache) Get(route, key string, q storage.Query) (body []byte, gen uint64, ok bool) {
+	if !c.enabled {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*entry)
+		if now.Before(e.expires) {
+			c.lru.MoveToFront(el)
+			requestsTotal.WithLabelValues(route, "hit").Inc()
+			return e.body, 0, true
+		}
+		c.remove(el)
+	}
+	requestsTotal.WithLabelValues(route, "miss").Inc()
+	// fills that failed never Put; one taking longer than the TTL would be
+	// stale once stored anyway
+	for g, f := range c.fills {
+		if now.Sub(f.started) > c.ttl {
+			delete(c.fills, g)
+		}
+	}
+	c.gen++
+	c.fills[c.gen] = fill{query: q.Compile(), started: now}
+	return nil, c.gen, false
+}
+
+// Put stores body as the response for key, computed under gen, unless an
+// event or Reset revoked gen in the meantime.
+func (c *Cache) Put(key string, gen uint64, body []byte) {
+	if !c.enabled {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.fills[gen]
+	if !ok {
+		return
+	}
+	delete(c.fills, gen)
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&entry{key: key, query: f.query, body: body, expires: time.Now().Add(c.ttl)})
+	for c.lru.Len() > c.max {
+		c.remove(c.lru.Back())
+	}
+	entriesGauge.Set(float64(c.lru.Len()))
+}
+
+// Invalidate drops every response whose query matches e and revokes the
+// fills of such queries.
+func (c *Cache) Invalidate(e *event.Event) {
+	if !c.enabled {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for g, f := range c.fills {
+		if f.query.Match(e) {
+			delete(c.fills, g)
+		}
+	}
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*entry).query.Match(e) {
+			c.remove(el)
+			invalidationsTotal.Inc()
+		}
+		el = next
+	}
+	entriesGauge.Set(float64(c.lru.Len()))
+}
+
+// Reset drops every response and revokes every fill, for when stored
+// events change in a way Invalidate cannot follow, like a purge or a
+// destroyed tenant key.
+func (c *Cache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.fills)
+	clear(c.entries)
+	c.lru.Init()
+	entriesGauge.Set(0)
+}
+
+// remove deletes el. The caller holds c.mu.
+func (c *Cache) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*entry).key)
+	c.lru.Remove(el)
+}
+
+// Store resets the cache whenever Purge deletes events.
+type Store struct {
+	storage.Store
+	c *Cache
+}
+
+// Wrap returns s behind c, so that purges by retention, the janitor or
+// offboarding do not leave deleted events in cached responses.
+func (c *Cache) Wrap(s storage.Store) *Store {
+	return &Store{Store: s, c: c}
+}
+
+func (s *Store) Purge(ctx context.Context, q storage.Query) (int64, error) {
+	n, err := s.Store.Purge(ctx, q)
+	if n > 0 {
+		s.c.Reset()
+	}
+	return n, err
+}
@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+// fillOf misses on key and stores body under the generation of the miss.
+func fillOf(t *testing.T, c *Cache, key string, q storage.Query, body string) {
+	t.Helper()
+	_, gen, ok := c.Get("/events", key, q)
+	if ok {
+		t.Fatalf("%s: unexpected hit", key)
+	}
+	c.Put(key, gen, []byte(body))
+}
+
+func hit(c *Cache, key string) string {
+	body, _, ok := c.Get("/events", key, storage.Query{})
+	if !ok {
+		return ""
+	}
+	return string(body)
+}
+
+// TestCache serves what was put until its TTL passes or an event matching
+// its query arrives, evicting the least recently used over the maximum.
+func TestCache(t *testing.T) {
+	c := New(config.CacheConfig{Enabled: true, TTL: 100 * time.Millisecond, MaxEntries: 2})
+	orders, users := storage.Query{Types: []string{"order.*"}}, storage.Query{Types: []string{"user.*"}}
+	fillOf(t, c, "orders", orders, "o")
+	fillOf(t, c, "users", users, "u")
+	if hit(c, "orders") != "o" || hit(c, "users") != "u" {
+		t.Fatal("stored responses missed")
+	}
+
+	c.Invalidate(&event.Event{Type: "order.created"})
+	if hit(c, "orders") != "" || hit(c, "users") != "u" {
+		t.Error("invalidation dropped the wrong responses")
+	}
+
+	fillOf(t, c, "orders", orders, "o")
+	hit(c, "orders") // users is now the least recently used
+	fillOf(t, c, "all", storage.Query{}, "a")
+	if hit(c, "users") != "" || hit(c, "orders") != "o" || hit(c, "all") != "a" {
+		t.Error("eviction dropped the wrong response")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if hit(c, "orders") != "" {
+		t.Error("expired response served")
+	}
+
+	off := New(config.CacheConfig{})
+	fillOf(t, off, "orders", orders, "o")
+	if hit(off, "orders") != "" {
+		t.Error("disabled cache served a response")
+	}
+}
+
+// TestStaleFill does not store a response computed while a matching event
+// arrived or the cache was reset, but does when the event does not match.
+func TestStaleFill(t *testing.T) {
+	c := New(config.CacheConfig{Enabled: true, TTL: time.Minute})
+	orders := storage.Query{Types: []string{"order.*"}}
+	for _, tc := range []struct {
+		name   string
+		change func()
+		stored bool
+	}{
+		{"matching event", func() { c.Invalidate(&event.Event{Type: "order.created"}) }, false},
+		{"other event", func() { c.Invalidate(&event.Event{Type: "user.created"}) }, true},
+		{"reset", c.Reset, false},
+	} {
+		c.Reset()
+		_, gen, _ := c.Get("/events", "orders", orders)
+		tc.change()
+		c.Put("orders", gen, []byte("o"))
+		if got := hit(c, "orders") != ""; got != tc.stored {
+			t.Errorf("%s: stored %v, want %v", tc.name, got, tc.stored)
+		}
+	}
+
+	// a generation is good for one Put
+	c.Reset()
+	_, gen, _ := c.Get("/events", "orders", orders)
+	c.Put("orders", gen, []byte("o"))
+	c.Invalidate(&event.Event{Type: "order.created"})
+	c.Put("orders", gen, []byte("stale"))
+	if got := hit(c, "orders"); got != "" {
+		t.Errorf("reused generation stored %q", got)
+	}
+}
+
+// TestWrap resets the cache when a purge deletes events, and only then.
+func TestWrap(t *testing.T) {
+	c := New(config.CacheConfig{Enabled: true, TTL: time.Minute})
+	s := c.Wrap(storage.NewMemory(1))
+	past := time.Now().Add(-time.Minute)
+	if _, err := s.Add(context.Background(), event.Event{Type: "user.created", Payload: json.RawMessage(`{}`), ExpiresAt: &past}); err != nil {
+		t.Fatal(err)
+	}
+
+	fillOf(t, c, "all", storage.Query{}, "a")
+	if n, err := s.Purge(context.Background(), storage.Query{Types: []string{"order.*"}}); err != nil || n != 0 {
+		t.Fatalf("purge: %d, %v", n, err)
+	}
+	if hit(c, "all") != "a" {
+		t.Error("empty purge reset the cache")
+	}
+	if n, err := storage.PurgeExpired(context.Background(), s); err != nil || n != 1 {
+		t.Fatalf("purge expired: %d, %v", n, err)
+	}
+	if hit(c, "all") != "" {
+		t.Error("purge kept the cached response")
+	}
+}
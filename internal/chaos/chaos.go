@@ -0,0 +1,133 @@
+// Package chaos injects faults into the service's calls to storage and
+// sinks: latency, errors and partial failures, at rates an admin sets at
+// runtime. It is a test-only mode for checking retries, the outbox's dead
+// letters and the circuit breakers in staging.
+package chaos
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+var injected = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "chaos_faults_injected_total", Help: "Faults injected by chaos mode by target and fault (latency, error, partial)"},
+	[]string{"target", "fault"},
+)
+
+// Collectors returns the chaos metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{injected}
+}
+
+// ErrInjected matches every injected error with errors.Is.
+var ErrInjected = errors.New("chaos: injected fault")
+
+// Controller holds the faults in effect. A nil *Controller, as used when
+// chaos mode is off, injects nothing.
+type Controller struct {
+	mu     sync.RWMutex
+	faults []config.FaultConfig
+}
+
+// New returns a controller injecting faults, which must be valid.
+func New(faults []config.FaultConfig) *Controller {
+	return &Controller{faults: faults}
+}
+
+// Faults returns the faults in effect.
+func (c *Controller) Faults() []config.FaultConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]config.FaultConfig{}, c.faults...)
+}
+
+// Set replaces the faults in effect, or keeps them when one is invalid.
+// None stops injecting.
+func (c *Controller) Set(faults []config.FaultConfig) error {
+	for i, f := range faults {
+		if err := f.Validate(); err != nil {
+			return fmt.Errorf("faults[%d]: %w", i, err)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults = faults
+	return nil
+}
+
+// Inject applies the faults matching op on target ("storage", or
+// "sink:<name>"): it sleeps their latency, then returns err for the call to
+// fail with without being made, or partial for it to fail with after doing
+// part of its work.
+func (c *Controller) Inject(target, op string) (partial, err error) {
+	if c == nil {
+		return nil, nil
+	}
+	c.mu.RLock()
+	var match []config.FaultConfig
+	for _, f := range c.faults {
+		if matches(f, target, op) {
+			match = append(match, f)
+		}
+	}
+	c.mu.RUnlock()
+	for _, f := range match {
+		if d := f.Latency + jitter(f.Jitter); d > 0 {
+			injected.WithLabelValues(target, "latency").Inc()
+			time.Sleep(d)
+		}
+		switch p := rand.Float64(); {
+		case p < f.ErrorRate:
+			injected.WithLabelValues(target, "error").Inc()
+			return nil, injectedError(f, target, op)
+		case p < f.ErrorRate+f.PartialRate:
+			injected.WithLabelValues(target, "partial").Inc()
+			return injectedError(f, target, op), nil
+		}
+	}
+	return nil, nil
+}
+
+func injectedError(f config.FaultConfig, target, op string) error {
+	return fmt.Errorf("%w: %s %s: %s", ErrInjected, target, op, cmp.Or(f.Error, "simulated failure"))
+}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return rand.N(max)
+}
+
+// SinkTarget is the target of the faults of a sink.
+func SinkTarget(name string) string {
+	return "sink:" + name
+}
+
+// matches reports whether f applies to op on target.
+func matches(f config.FaultConfig, target, op string) bool {
+	if len(f.Ops) > 0 && !slices.Contains(f.Ops, op) {
+		return false
+	}
+	name, ok := strings.CutPrefix(f.Target, "sink:")
+	if !ok {
+		return f.Target == target
+	}
+	sink, ok := strings.CutPrefix(target, "sink:")
+	if !ok {
+		return false
+	}
+	m, _ := path.Match(name, sink)
+	return m
+}
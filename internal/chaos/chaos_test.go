@@ -0,0 +1,52 @@
+package chaos
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// TestInject checks which calls a fault applies to, and the errors of
+// certain failures.
+func TestInject(t *testing.T) {
+	c := New([]config.FaultConfig{
+		{Target: "storage", Ops: []string{"add"}, ErrorRate: 1, Error: "disk full"},
+		{Target: "sink:ware*", PartialRate: 1},
+		{Target: "sink:audit", Latency: 20 * time.Millisecond},
+	})
+	if partial, err := c.Inject("storage", "add"); partial != nil || !errors.Is(err, ErrInjected) || err.Error() != "chaos: injected fault: storage add: disk full" {
+		t.Errorf("storage add: partial %v, err %v", partial, err)
+	}
+	if partial, err := c.Inject("storage", "list"); partial != nil || err != nil {
+		t.Errorf("storage list: partial %v, err %v", partial, err)
+	}
+	if partial, err := c.Inject(SinkTarget("warehouse"), "publish"); !errors.Is(partial, ErrInjected) || err != nil {
+		t.Errorf("sink warehouse: partial %v, err %v", partial, err)
+	}
+	start := time.Now()
+	if partial, err := c.Inject(SinkTarget("audit"), "publish"); partial != nil || err != nil {
+		t.Errorf("sink audit: partial %v, err %v", partial, err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("sink audit: took %v, want the 20ms latency", d)
+	}
+
+	if err := c.Set([]config.FaultConfig{{Target: "storage", ErrorRate: 0.8, PartialRate: 0.5}}); err == nil {
+		t.Error("rates adding up to more than 1 were accepted")
+	}
+	if len(c.Faults()) != 3 {
+		t.Error("an invalid Set replaced the faults")
+	}
+	if err := c.Set(nil); err != nil {
+		t.Fatal(err)
+	}
+	if partial, err := c.Inject("storage", "add"); partial != nil || err != nil {
+		t.Errorf("after clearing: partial %v, err %v", partial, err)
+	}
+	var off *Controller
+	if partial, err := off.Inject("storage", "add"); partial != nil || err != nil {
+		t.Errorf("nil controller: partial %v, err %v", partial, err)
+	}
+}
@@ -0,0 +1,146 @@
+// Package codec encodes event request and response bodies in the formats the
+// API speaks: JSON, Protocol Buffers and MessagePack. Handlers ask a Registry
+// for the codec matching a request, so adding a format does not touch them.
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+
+	"github.com/munnerz/goautoneg"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/ids"
+)
+
+// ErrUnsupported is returned for values a codec cannot represent.
+var ErrUnsupported = errors.New("codec: unsupported value")
+
+// Codec converts event.Event, *event.Event and []event.Event (and, for
+// generic formats, any value) to and from a wire format. Marshal also takes
+// a Projection.
+type Codec interface {
+	// ContentTypes lists the media types the codec answers to; the first is
+	// used in responses.
+	ContentTypes() []string
+	Marshal(v any) ([]byte, error)
+	// Unmarshal does not keep data, which callers may reuse.
+	Unmarshal(data []byte, v any) error
+}
+
+// Registry picks codecs by media type. The first registered codec is the
+// default.
+type Registry struct {
+	codecs []Codec
+	byType map[string]Codec
+	offers []string
+}
+
+func NewRegistry(codecs ...Codec) *Registry {
+	reg := &Registry{codecs: codecs, byType: map[string]Codec{}}
+	for _, c := range codecs {
+		for _, t := range c.ContentTypes() {
+			reg.byType[t] = c
+			reg.offers = append(reg.offers, t)
+		}
+	}
+	return reg
+}
+
+// Request returns the codec for the request's Content-Type. Missing and
+// unknown types get the default, since callers have long sent JSON without
+// setting one (curl -d sends a form type).
+func (reg *Registry) Request(r *http.Request) Codec {
+	if t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil {
+		if c, ok := reg.byType[t]; ok {
+			return c
+		}
+	}
+	return reg.codecs[0]
+}
+
+// Response returns the codec preferred by the request's Accept header,
+// falling back to the default when nothing registered is acceptable.
+func (reg *Registry) Response(r *http.Request) Codec {
+	if accept := r.Header.Get("Accept"); accept != "" {
+		if t := goautoneg.Negotiate(accept, reg.offers); t != "" {
+			return reg.byType[t]
+		}
+	}
+	return reg.codecs[0]
+}
+
+// JSON is the default codec.
+type JSON struct {
+	// IDs writes the IDs of events; the zero value writes numbers.
+	IDs ids.Codec
+}
+
+func (JSON) ContentTypes() []string { return []string{"application/json"} }
+
+// Marshal ends the document with a newline, like json.Encoder.
+func (c JSON) Marshal(v any) ([]byte, error) {
+	if p, ok := v.(Projection); ok {
+		return p.marshalJSON(c.IDs)
+	}
+	b, err := json.Marshal(c.View(v))
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// jsonEvent shadows the IDs of an event with their API representation.
+type jsonEvent struct {
+	ID any `json:"id"`
+	*event.Event
+	DuplicateOf any `json:"duplicate_of,omitempty"`
+}
+
+// View returns v ready for encoding/json: an event.Event, *event.Event or
+// []event.Event with its IDs written as c.IDs has them. Other values are
+// returned as they are.
+func (c JSON) View(v any) any {
+	if c.IDs == (ids.Codec{}) {
+		return v
+	}
+	switch v := v.(type) {
+	case event.Event:
+		return c.event(&v)
+	case *event.Event:
+		return c.event(v)
+	case []event.Event:
+		out := make([]jsonEvent, len(v))
+		for i := range v {
+			out[i] = c.event(&v[i])
+		}
+		return out
+	}
+	return v
+}
+
+func (c JSON) event(e *event.Event) jsonEvent {
+	out := jsonEvent{ID: c.IDs.Value(e.ID), Event: e}
+	if e.DuplicateOf != 0 {
+		out.DuplicateOf = c.IDs.Value(e.DuplicateOf)
+	}
+	return out
+}
+
+// Unmarshal decodes the usual event bodies without reflection, see
+// decodeEnvelope.
+func (JSON) Unmarshal(data []byte, v any) error {
+	switch v := v.(type) {
+	case *event.Event:
+		if decodeEnvelope(data, v) {
+			return nil
+		}
+	case *[]event.Event:
+		if decodeEnvelopes(data, v) {
+			return nil
+		}
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,174 @@
+package codec
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// bodies are single-event bodies the JSON codec must decode exactly like
+// encoding/json, whether or not its fast path takes them.
+var bodies = []string{
+	`{"type":"signup","payload":{"user_id":123,"plan":"pro"}}`,
+	` { "type" : "signup" , "payload" : [1, 2, {"a": "}"}] } `,
+	`{"payload":"{\"double\":\"encoded\"}","type":"legacy"}`,
+	`{"type":"a","payload":null}`,
+	`{"type":"a","payload":12.5e3}`,
+	`{"type":"a","payload":true,"schema_version":"2"}`,
+	`{"type":"a","payload":{},"tags":["beta"]}`,
+	`{"type":"a","payload":{},"correlation_id":"req-1","causation_id":"7"}`,
+	`{"type":"a\u00e9","payload":{}}`,
+	`{"Type":"a","payload":{}}`,
+	`{"type":"a","type":"b","payload":{}}`,
+	`{"type":"a","payload":{"x":}}`,
+	`{"type":"a","payload":{}} trailing`,
+	`{"type":"a","payload":{}`,
+	`{"type":"\xff","payload":{}}`,
+	`{"type":null,"payload":1}`,
+	`{}`,
+	`null`,
+	``,
+}
+
+func TestJSONUnmarshalMatchesEncodingJSON(t *testing.T) {
+	for _, body := range bodies {
+		var got, want event.Event
+		gotErr := JSON{}.Unmarshal([]byte(body), &got)
+		wantErr := json.Unmarshal([]byte(body), &want)
+		if (gotErr != nil) != (wantErr != nil) || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s:\n got %+v, %v\nwant %+v, %v", body, got, gotErr, want, wantErr)
+		}
+	}
+	batch := "[" + strings.Join(bodies[:6], ",") + "]"
+	for _, body := range []string{batch, "[]", " [ ] ", "[" + bodies[6] + "]", "[" + bodies[0] + ",]"} {
+		var got, want []event.Event
+		gotErr := JSON{}.Unmarshal([]byte(body), &got)
+		wantErr := json.Unmarshal([]byte(body), &want)
+		if (gotErr != nil) != (wantErr != nil) || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s:\n got %+v, %v\nwant %+v, %v", body, got, gotErr, want, wantErr)
+		}
+	}
+}
+
+func TestJSONUnmarshalCopiesPayload(t *testing.T) {
+	body := []byte(bodies[0])
+	var e event.Event
+	if err := (JSON{}).Unmarshal(body, &e); err != nil {
+		t.Fatal(err)
+	}
+	clear(body)
+	if string(e.Payload) != `{"user_id":123,"plan":"pro"}` {
+		t.Fatalf("payload changed with the body: %q", e.Payload)
+	}
+}
+
+// TestReleaseEvent reuses events without changing the copies taken of
+// them.
+func TestReleaseEvent(t *testing.T) {
+	e := AcquireEvent()
+	if err := (JSON{}).Unmarshal([]byte(bodies[7]), e); err != nil {
+		t.Fatal(err)
+	}
+	kept := *e
+	ReleaseEvent(e)
+	e = AcquireEvent()
+	defer ReleaseEvent(e)
+	if !reflect.DeepEqual(*e, event.Event{}) {
+		t.Errorf("acquired %+v", *e)
+	}
+	if err := (JSON{}).Unmarshal([]byte(bodies[0]), e); err != nil {
+		t.Fatal(err)
+	}
+	if kept.Type != "a" || string(kept.Payload) != `{}` || kept.CorrelationID != "req-1" {
+		t.Errorf("copy changed: %+v", kept)
+	}
+}
+
+// BenchmarkJSONUnmarshalEvent decodes into a pooled event like the API,
+// leaving the copy of the payload as the one allocation.
+func BenchmarkJSONUnmarshalEvent(b *testing.B) {
+	body := []byte(bodies[0])
+	b.ReportAllocs()
+	for b.Loop() {
+		e := AcquireEvent()
+		if err := (JSON{}).Unmarshal(body, e); err != nil {
+			b.Fatal(err)
+		}
+		ReleaseEvent(e)
+	}
+}
+
+// BenchmarkEncodingJSONUnmarshalEvent is the baseline the fast path is
+// measured against.
+func BenchmarkEncodingJSONUnmarshalEvent(b *testing.B) {
+	body := []byte(bodies[0])
+	b.ReportAllocs()
+	for b.Loop() {
+		var e event.Event
+		if err := json.Unmarshal(body, &e); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSONUnmarshalBatch(b *testing.B) {
+	body := []byte("[" + strings.Repeat(bodies[0]+",", 99) + bodies[0] + "]")
+	b.ReportAllocs()
+	for b.Loop() {
+		var events []event.Event
+		if err := (JSON{}).Unmarshal(body, &events); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodingJSONUnmarshalBatch(b *testing.B) {
+	body := []byte("[" + strings.Repeat(bodies[0]+",", 99) + bodies[0] + "]")
+	b.ReportAllocs()
+	for b.Loop() {
+		var events []event.Event
+		if err := json.Unmarshal(body, &events); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestProjection checks every codec keeps only the fields asked for.
+func TestProjection(t *testing.T) {
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	p := Projection{
+		Events: []event.Event{{ID: 7, Type: "order.paid", Payload: json.RawMessage(`{"amount":12}`), Tags: []string{"web"}, ReceivedAt: at}},
+		Fields: []string{"received_at", "id", "tags", "correlation_id"},
+	}
+	b, err := JSON{}.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[{"received_at":"2026-01-02T03:04:05Z","id":7,"tags":["web"]}]` + "\n"; string(b) != want {
+		t.Errorf("json: %s", b)
+	}
+	want := []event.Event{{ID: 7, Tags: []string{"web"}, ReceivedAt: at}}
+	for _, c := range []Codec{Protobuf{}, MessagePack{}} {
+		b, err := c.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []event.Event
+		if err := c.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) == 1 {
+			got[0].ReceivedAt = got[0].ReceivedAt.UTC()
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: %+v", c, got)
+		}
+	}
+	if _, err := ParseFields("id,secret"); err == nil {
+		t.Error("unknown field accepted")
+	}
+}
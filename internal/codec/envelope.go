@@ -0,0 +1,343 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// events holds the Events single-event requests decode into.
+var events = sync.Pool{New: func() any { return new(event.Event) }}
+
+// AcquireEvent returns a zero Event to decode a request into, from a pool.
+// ReleaseEvent gives it back once the request is done with it.
+func AcquireEvent() *event.Event {
+	return events.Get().(*event.Event)
+}
+
+// ReleaseEvent clears e and returns it to the pool; e must not be used
+// after. Copies of e, and the payload and strings they share, stay valid.
+func ReleaseEvent(e *event.Event) {
+	*e = event.Event{}
+	events.Put(e)
+}
+
+// payloadLists holds the lists of payloads decodeEnvelopes collects
+// before copying them into one buffer.
+var payloadLists = sync.Pool{New: func() any { return new([][]byte) }}
+
+// maxPooledPayloads is the longest list put back into payloadLists.
+const maxPooledPayloads = 4096
+
+// decodeEnvelope is the fast path of JSON.Unmarshal for a single event. It
+// handles the common body, an object of type, payload, schema_version and
+// correlation and causation IDs with plain strings, allocating only a copy
+// of the payload and the IDs: type and version strings are interned, and
+// e comes from AcquireEvent in the API. Anything else (other fields,
+// escapes in strings, invalid UTF-8, malformed JSON) reports false, leaving
+// e untouched for encoding/json, whose result it otherwise matches.
+func decodeEnvelope(data []byte, e *event.Event) bool {
+	env, ok := parseEnvelope(data)
+	if !ok {
+		return false
+	}
+	env.apply(e)
+	if env.hasPayload {
+		e.Payload = bytes.Clone(env.payload)
+	}
+	return true
+}
+
+// decodeEnvelopes is decodeEnvelope for a batch, a JSON array of events.
+// The payloads of the batch share one allocation.
+func decodeEnvelopes(data []byte, v *[]event.Event) bool {
+	i := skipSpace(data, 0)
+	if i == len(data) || data[i] != '[' {
+		return false
+	}
+	list := payloadLists.Get().(*[][]byte)
+	payloads := (*list)[:0]
+	defer func() {
+		if cap(payloads) <= maxPooledPayloads {
+			// the payloads point into data, which the caller reuses
+			clear(payloads)
+			*list = payloads[:0]
+			payloadLists.Put(list)
+		}
+	}()
+	var out []event.Event
+	size := 0
+	i = skipSpace(data, i+1)
+	if i < len(data) && data[i] == ']' {
+		i++
+	} else {
+		for {
+			end, ok := valueEnd(data, i)
+			if !ok {
+				return false
+			}
+			env, ok := parseEnvelope(data[i:end])
+			if !ok {
+				return false
+			}
+			if out == nil {
+				// batches are usually alike, so the first event tells
+				// about how many there are
+				n := len(data)/(end-i+1) + 1
+				out = make([]event.Event, 0, n)
+				payloads = slices.Grow(payloads, n)
+			}
+			out = append(out, event.Event{})
+			env.apply(&out[len(out)-1])
+			if env.hasPayload {
+				size += len(env.payload)
+				payloads = append(payloads, env.payload)
+			} else {
+				payloads = append(payloads, nil)
+			}
+			i = skipSpace(data, end)
+			if i == len(data) {
+				return false
+			}
+			if data[i] == ']' {
+				i++
+				break
+			}
+			if data[i] != ',' {
+				return false
+			}
+			i = skipSpace(data, i+1)
+		}
+	}
+	if skipSpace(data, i) != len(data) {
+		return false
+	}
+	if out == nil {
+		out = []event.Event{}
+	}
+	buf := make([]byte, 0, size)
+	for j, p := range payloads {
+		if p != nil {
+			start := len(buf)
+			buf = append(buf, p...)
+			// capped, so appending to one payload cannot overwrite the next
+			out[j].Payload = buf[start:len(buf):len(buf)]
+		}
+	}
+	*v = out
+	return true
+}
+
+// envelope holds the fields of a parsed event body, still in its buffer.
+type envelope struct {
+	typ, version, payload, correlation, causation, key                    []byte
+	hasType, hasVersion, hasPayload, hasCorrelation, hasCausation, hasKey bool
+}
+
+// parseEnvelope parses data as an event object with only plain-string type,
+// schema_version, correlation_id, causation_id and partition_key and a valid
+// JSON payload.
+func parseEnvelope(data []byte) (envelope, bool) {
+	var env envelope
+	i := skipSpace(data, 0)
+	if i == len(data) || data[i] != '{' {
+		return env, false
+	}
+	i = skipSpace(data, i+1)
+	if i < len(data) && data[i] == '}' {
+		i++
+	} else {
+		for {
+			key, next, ok := plainString(data, i)
+			if !ok {
+				return env, false
+			}
+			i = skipSpace(data, next)
+			if i == len(data) || data[i] != ':' {
+				return env, false
+			}
+			i = skipSpace(data, i+1)
+			switch string(key) {
+			case "type":
+				env.typ, next, env.hasType = plainString(data, i)
+				ok = env.hasType
+			case "schema_version":
+				env.version, next, env.hasVersion = plainString(data, i)
+				ok = env.hasVersion
+			case "correlation_id":
+				env.correlation, next, env.hasCorrelation = plainString(data, i)
+				ok = env.hasCorrelation
+			case "causation_id":
+				env.causation, next, env.hasCausation = plainString(data, i)
+				ok = env.hasCausation
+			case "partition_key":
+				env.key, next, env.hasKey = plainString(data, i)
+				ok = env.hasKey
+			case "payload":
+				next, ok = valueEnd(data, i)
+				env.payload, env.hasPayload = data[i:next], ok
+			default:
+				return env, false
+			}
+			if !ok {
+				return env, false
+			}
+			i = skipSpace(data, next)
+			if i == len(data) {
+				return env, false
+			}
+			if data[i] == '}' {
+				i++
+				break
+			}
+			if data[i] != ',' {
+				return env, false
+			}
+			i = skipSpace(data, i+1)
+		}
+	}
+	if skipSpace(data, i) != len(data) || (env.hasPayload && !json.Valid(env.payload)) {
+		return env, false
+	}
+	return env, true
+}
+
+// apply sets the type, version and IDs of e; the payload is left to the
+// caller.
+func (env *envelope) apply(e *event.Event) {
+	if env.hasType {
+		e.Type = intern(env.typ)
+	}
+	if env.hasVersion {
+		e.SchemaVersion = intern(env.version)
+	}
+	if env.hasCorrelation {
+		e.CorrelationID = string(env.correlation)
+	}
+	if env.hasCausation {
+		e.CausationID = string(env.causation)
+	}
+	if env.hasKey {
+		e.PartitionKey = string(env.key)
+	}
+}
+
+// maxInterned bounds the strings intern keeps; types and versions are few,
+// and a producer inventing new ones only misses the cache.
+const (
+	maxInterned    = 4096
+	maxInternedLen = 128
+)
+
+// interned maps strings to themselves. It is replaced, never modified, so
+// lookups need no lock.
+var (
+	interned   atomic.Pointer[map[string]string]
+	internedMu sync.Mutex
+)
+
+// intern returns b as a string, sharing the memory of earlier equal ones.
+func intern(b []byte) string {
+	if m := interned.Load(); m != nil {
+		if s, ok := (*m)[string(b)]; ok {
+			return s
+		}
+	}
+	s := string(b)
+	if len(s) > maxInternedLen {
+		return s
+	}
+	internedMu.Lock()
+	defer internedMu.Unlock()
+	cur := interned.Load()
+	if cur != nil {
+		if _, ok := (*cur)[s]; ok || len(*cur) >= maxInterned {
+			return s
+		}
+	}
+	next := make(map[string]string, 1)
+	if cur != nil {
+		next = maps.Clone(*cur)
+	}
+	next[s] = s
+	interned.Store(&next)
+	return s
+}
+
+func skipSpace(data []byte, i int) int {
+	for i < len(data) {
+		switch data[i] {
+		case ' ', '\t', '\n', '\r':
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// plainString returns the contents of the JSON string at data[i] and the
+// index after it. Strings with escapes, control characters or invalid
+// UTF-8 report false.
+func plainString(data []byte, i int) ([]byte, int, bool) {
+	if i == len(data) || data[i] != '"' {
+		return nil, 0, false
+	}
+	for j := i + 1; j < len(data); j++ {
+		switch c := data[j]; {
+		case c == '"':
+			s := data[i+1 : j]
+			return s, j + 1, utf8.Valid(s)
+		case c == '\\' || c < 0x20:
+			return nil, 0, false
+		}
+	}
+	return nil, 0, false
+}
+
+// valueEnd returns the index after the JSON value starting at data[i],
+// tracking only strings and nesting; the value is validated separately.
+func valueEnd(data []byte, i int) (int, bool) {
+	depth := 0
+	for j := i; j < len(data); j++ {
+		switch data[j] {
+		case '"':
+			for j++; j < len(data) && data[j] != '"'; j++ {
+				if data[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(data) {
+				return 0, false
+			}
+			if depth == 0 {
+				return j + 1, true
+			}
+		case '{', '[':
+			depth++
+		case '}', ']':
+			if depth == 0 {
+				// the end of the envelope after a scalar
+				return j, j > i
+			}
+			if depth--; depth == 0 {
+				return j + 1, true
+			}
+		case ',':
+			if depth == 0 {
+				return j, j > i
+			}
+		case ' ', '\t', '\n', '\r':
+			if depth == 0 && j > i {
+				return j, true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,169 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// MessagePack encodes events as maps with the JSON field names. The payload
+// is a native MessagePack value rather than embedded JSON, so it is
+// converted on the way in and out; other values use their JSON tags.
+type MessagePack struct{}
+
+func (MessagePack) ContentTypes() []string {
+	return []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"}
+}
+
+type msgpackEvent struct {
+	ID            int64              `json:"id"`
+	Type          string             `json:"type"`
+	Payload       msgpack.RawMessage `json:"payload,omitempty"`
+	Tags          []string           `json:"tags,omitempty"`
+	Metadata      map[string]string  `json:"metadata,omitempty"`
+	SchemaVersion string             `json:"schema_version,omitempty"`
+	CorrelationID string             `json:"correlation_id,omitempty"`
+	CausationID   string             `json:"causation_id,omitempty"`
+	PartitionKey  string             `json:"partition_key,omitempty"`
+	DeliverAt     *time.Time         `json:"deliver_at,omitempty"`
+	ExpiresAt     *time.Time         `json:"expires_at,omitempty"`
+	TTLSeconds    int64              `json:"ttl_seconds,omitempty"`
+	OccurredAt    *time.Time         `json:"occurred_at,omitempty"`
+	ReceivedAt    time.Time          `json:"received_at"`
+	DuplicateOf   int64              `json:"duplicate_of,omitempty"`
+	SampledOut    bool               `json:"sampled_out,omitempty"`
+}
+
+func (MessagePack) Marshal(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case event.Event:
+		return marshalMsgpack(toMsgpack(&v))
+	case *event.Event:
+		return marshalMsgpack(toMsgpack(v))
+	case []event.Event:
+		out := make([]msgpackEvent, len(v))
+		for i := range v {
+			out[i] = toMsgpack(&v[i])
+		}
+		return marshalMsgpack(out)
+	case Projection:
+		return marshalMsgpack(v.maps())
+	}
+	return marshalMsgpack(v)
+}
+
+func (MessagePack) Unmarshal(data []byte, v any) error {
+	switch v := v.(type) {
+	case *event.Event:
+		var in msgpackEvent
+		if err := unmarshalMsgpack(data, &in); err != nil {
+			return err
+		}
+		return fromMsgpack(&in, v)
+	case *[]event.Event:
+		var in []msgpackEvent
+		if err := unmarshalMsgpack(data, &in); err != nil {
+			return err
+		}
+		out := make([]event.Event, len(in))
+		for i := range in {
+			if err := fromMsgpack(&in[i], &out[i]); err != nil {
+				return fmt.Errorf("event %d: %w", i, err)
+			}
+		}
+		*v = out
+		return nil
+	}
+	return unmarshalMsgpack(data, v)
+}
+
+func marshalMsgpack(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func unmarshalMsgpack(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// toMsgpack converts e. Stored payloads are valid JSON; one that is not is
+// left out.
+func toMsgpack(e *event.Event) msgpackEvent {
+	out := msgpackEvent{
+		ID: e.ID, Type: e.Type, Tags: e.Tags, Metadata: e.Metadata,
+		DeliverAt: e.DeliverAt, ExpiresAt: e.ExpiresAt, TTLSeconds: e.TTLSeconds,
+		OccurredAt: e.OccurredAt, ReceivedAt: e.ReceivedAt, DuplicateOf: e.DuplicateOf,
+		SampledOut: e.SampledOut, SchemaVersion: e.SchemaVersion,
+		CorrelationID: e.CorrelationID, CausationID: e.CausationID,
+		PartitionKey: e.PartitionKey,
+	}
+	if len(e.Payload) == 0 {
+		return out
+	}
+	dec := json.NewDecoder(bytes.NewReader(e.Payload))
+	dec.UseNumber()
+	var payload any
+	if err := dec.Decode(&payload); err != nil {
+		return out
+	}
+	out.Payload, _ = msgpack.Marshal(nativeNumbers(payload))
+	return out
+}
+
+func fromMsgpack(in *msgpackEvent, e *event.Event) error {
+	*e = event.Event{
+		ID: in.ID, Type: in.Type, Tags: in.Tags, Metadata: in.Metadata,
+		DeliverAt: in.DeliverAt, ExpiresAt: in.ExpiresAt, TTLSeconds: in.TTLSeconds,
+		OccurredAt: in.OccurredAt, ReceivedAt: in.ReceivedAt, DuplicateOf: in.DuplicateOf,
+		SampledOut: in.SampledOut, SchemaVersion: in.SchemaVersion,
+		CorrelationID: in.CorrelationID, CausationID: in.CausationID,
+		PartitionKey: in.PartitionKey,
+	}
+	if len(in.Payload) == 0 {
+		return nil
+	}
+	var payload any
+	if err := msgpack.Unmarshal(in.Payload, &payload); err != nil {
+		return fmt.Errorf("payload: %w", err)
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("payload: %w", err)
+	}
+	e.Payload = b
+	return nil
+}
+
+// nativeNumbers replaces the json.Numbers in v with integers where they fit
+// and floats otherwise.
+func nativeNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for k, x := range v {
+			v[k] = nativeNumbers(x)
+		}
+	case []any:
+		for i, x := range v {
+			v[i] = nativeNumbers(x)
+		}
+	}
+	return v
+}
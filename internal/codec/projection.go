@@ -0,0 +1,176 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/ids"
+)
+
+// Projection is a list of events cut down to some of their fields, e.g. for
+// listings that only show id, type and received_at. Every codec encodes it
+// like []event.Event without the other fields.
+type Projection struct {
+	Events []event.Event
+	// Fields are JSON field names from ProjectionFields.
+	Fields []string
+}
+
+// ProjectionFields are the stored event fields a projection may keep.
+var ProjectionFields = []string{
+	"id", "type", "payload", "tags", "metadata", "schema_version",
+	"correlation_id", "causation_id", "partition_key", "deliver_at", "expires_at",
+	"occurred_at", "received_at",
+}
+
+// ParseFields parses a comma-separated list of ProjectionFields, dropping
+// repeats.
+func ParseFields(s string) ([]string, error) {
+	var fields []string
+	for f := range strings.SplitSeq(s, ",") {
+		f = strings.TrimSpace(f)
+		if !slices.Contains(ProjectionFields, f) {
+			return nil, fmt.Errorf("fields: unknown field %q, want some of %s", f, strings.Join(ProjectionFields, ", "))
+		}
+		if !slices.Contains(fields, f) {
+			fields = append(fields, f)
+		}
+	}
+	return fields, nil
+}
+
+// field returns the value of the field name of e, and false when it is empty
+// and the full encoding leaves it out.
+func field(e *event.Event, name string) (any, bool) {
+	switch name {
+	case "id":
+		return e.ID, true
+	case "type":
+		return e.Type, true
+	case "payload":
+		return e.Payload, true
+	case "tags":
+		return e.Tags, len(e.Tags) > 0
+	case "metadata":
+		return e.Metadata, len(e.Metadata) > 0
+	case "schema_version":
+		return e.SchemaVersion, e.SchemaVersion != ""
+	case "correlation_id":
+		return e.CorrelationID, e.CorrelationID != ""
+	case "causation_id":
+		return e.CausationID, e.CausationID != ""
+	case "partition_key":
+		return e.PartitionKey, e.PartitionKey != ""
+	case "deliver_at":
+		return e.DeliverAt, e.DeliverAt != nil
+	case "expires_at":
+		return e.ExpiresAt, e.ExpiresAt != nil
+	case "occurred_at":
+		return e.OccurredAt, e.OccurredAt != nil
+	case "received_at":
+		return e.ReceivedAt, true
+	}
+	return nil, false
+}
+
+// marshalJSON writes each event as an object with the fields in the order
+// they were asked for, the ID as c has it.
+func (p Projection) marshalJSON(c ids.Codec) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i := range p.Events {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('{')
+		first := true
+		for _, name := range p.Fields {
+			v, ok := field(&p.Events[i], name)
+			if !ok {
+				continue
+			}
+			if name == "id" {
+				v = c.Value(p.Events[i].ID)
+			}
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			if !first {
+				buf.WriteByte(',')
+			}
+			first = false
+			fmt.Fprintf(&buf, "%q:", name)
+			buf.Write(b)
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteString("]\n")
+	return buf.Bytes(), nil
+}
+
+// maps returns the events as maps for MessagePack, with native payloads.
+func (p Projection) maps() []map[string]any {
+	out := make([]map[string]any, len(p.Events))
+	for i := range p.Events {
+		e := &p.Events[i]
+		m := make(map[string]any, len(p.Fields))
+		for _, name := range p.Fields {
+			if name == "payload" {
+				if payload := toMsgpack(e).Payload; len(payload) > 0 {
+					m[name] = payload
+				}
+				continue
+			}
+			if v, ok := field(e, name); ok {
+				m[name] = v
+			}
+		}
+		out[i] = m
+	}
+	return out
+}
+
+// zeroed returns the events with the fields left out set to zero, which
+// Protocol Buffers does not encode.
+func (p Projection) zeroed() []event.Event {
+	out := make([]event.Event, len(p.Events))
+	for i := range p.Events {
+		e, keep := &p.Events[i], &out[i]
+		for _, name := range p.Fields {
+			switch name {
+			case "id":
+				keep.ID = e.ID
+			case "type":
+				keep.Type = e.Type
+			case "payload":
+				keep.Payload = e.Payload
+			case "tags":
+				keep.Tags = e.Tags
+			case "metadata":
+				keep.Metadata = e.Metadata
+			case "schema_version":
+				keep.SchemaVersion = e.SchemaVersion
+			case "correlation_id":
+				keep.CorrelationID = e.CorrelationID
+			case "causation_id":
+				keep.CausationID = e.CausationID
+			case "partition_key":
+				keep.PartitionKey = e.PartitionKey
+			case "deliver_at":
+				keep.DeliverAt = e.DeliverAt
+			case "expires_at":
+				keep.ExpiresAt = e.ExpiresAt
+			case "occurred_at":
+				keep.OccurredAt = e.OccurredAt
+			case "received_at":
+				keep.ReceivedAt = e.ReceivedAt
+			}
+		}
+	}
+	return out
+}
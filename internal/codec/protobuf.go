@@ -0,0 +1,292 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// Protobuf encodes events as the Event and EventList messages of
+// api/event.proto. Only event values are supported.
+type Protobuf struct{}
+
+func (Protobuf) ContentTypes() []string {
+	return []string{"application/x-protobuf", "application/protobuf"}
+}
+
+func (Protobuf) Marshal(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case event.Event:
+		return appendEvent(nil, &v), nil
+	case *event.Event:
+		return appendEvent(nil, v), nil
+	case Projection:
+		return Protobuf{}.Marshal(v.zeroed())
+	case []event.Event:
+		var b []byte
+		for i := range v {
+			b = protowire.AppendTag(b, 1, protowire.BytesType)
+			b = protowire.AppendBytes(b, appendEvent(nil, &v[i]))
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("%w: %T", ErrUnsupported, v)
+}
+
+func (Protobuf) Unmarshal(data []byte, v any) error {
+	switch v := v.(type) {
+	case *event.Event:
+		*v = event.Event{}
+		return decodeEvent(data, v)
+	case *[]event.Event:
+		out := []event.Event{}
+		err := fields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+			if num != 1 || typ != protowire.BytesType {
+				return protowire.ConsumeFieldValue(num, typ, b), nil
+			}
+			msg, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			var e event.Event
+			if err := decodeEvent(msg, &e); err != nil {
+				return 0, fmt.Errorf("event %d: %w", len(out), err)
+			}
+			out = append(out, e)
+			return n, nil
+		})
+		if err != nil {
+			return err
+		}
+		*v = out
+		return nil
+	}
+	return fmt.Errorf("%w: %T", ErrUnsupported, v)
+}
+
+func appendEvent(b []byte, e *event.Event) []byte {
+	if e.ID != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(e.ID))
+	}
+	if e.Type != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, e.Type)
+	}
+	if len(e.Payload) > 0 {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, e.Payload)
+	}
+	for _, t := range e.Tags {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendString(b, t)
+	}
+	for k, v := range e.Metadata {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, v)
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	if e.DeliverAt != nil {
+		b = appendTimestamp(b, 6, *e.DeliverAt)
+	}
+	if !e.ReceivedAt.IsZero() {
+		b = appendTimestamp(b, 7, e.ReceivedAt)
+	}
+	if e.DuplicateOf != 0 {
+		b = protowire.AppendTag(b, 8, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(e.DuplicateOf))
+	}
+	if e.SampledOut {
+		b = protowire.AppendTag(b, 9, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	if e.SchemaVersion != "" {
+		b = protowire.AppendTag(b, 10, protowire.BytesType)
+		b = protowire.AppendString(b, e.SchemaVersion)
+	}
+	if e.ExpiresAt != nil {
+		b = appendTimestamp(b, 11, *e.ExpiresAt)
+	}
+	if e.OccurredAt != nil {
+		b = appendTimestamp(b, 16, *e.OccurredAt)
+	}
+	if e.TTLSeconds != 0 {
+		b = protowire.AppendTag(b, 12, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(e.TTLSeconds))
+	}
+	if e.CorrelationID != "" {
+		b = protowire.AppendTag(b, 13, protowire.BytesType)
+		b = protowire.AppendString(b, e.CorrelationID)
+	}
+	if e.CausationID != "" {
+		b = protowire.AppendTag(b, 14, protowire.BytesType)
+		b = protowire.AppendString(b, e.CausationID)
+	}
+	if e.PartitionKey != "" {
+		b = protowire.AppendTag(b, 15, protowire.BytesType)
+		b = protowire.AppendString(b, e.PartitionKey)
+	}
+	return b
+}
+
+// appendTimestamp writes a google.protobuf.Timestamp field.
+func appendTimestamp(b []byte, num protowire.Number, t time.Time) []byte {
+	var ts []byte
+	if s := t.Unix(); s != 0 {
+		ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(s))
+	}
+	if n := t.Nanosecond(); n != 0 {
+		ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(n))
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, ts)
+}
+
+func decodeEvent(data []byte, e *event.Event) error {
+	return fields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case (num == 1 || num == 8 || num == 9 || num == 12) && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			switch num {
+			case 1:
+				e.ID = int64(v)
+			case 8:
+				e.DuplicateOf = int64(v)
+			case 12:
+				e.TTLSeconds = int64(v)
+			default:
+				e.SampledOut = v != 0
+			}
+			return n, nil
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			e.Type = v
+			return n, nil
+		case num == 10 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			e.SchemaVersion = v
+			return n, nil
+		case num == 13 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			e.CorrelationID = v
+			return n, nil
+		case num == 14 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			e.CausationID = v
+			return n, nil
+		case num == 15 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			e.PartitionKey = v
+			return n, nil
+		case num == 3 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n >= 0 && !json.Valid(v) {
+				return 0, errors.New("payload is not valid JSON")
+			}
+			e.Payload = bytes.Clone(v)
+			return n, nil
+		case num == 4 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n >= 0 {
+				e.Tags = append(e.Tags, v)
+			}
+			return n, nil
+		case num == 5 && typ == protowire.BytesType:
+			entry, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			var k, v string
+			if err := fields(entry, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+				if typ != protowire.BytesType || (num != 1 && num != 2) {
+					return protowire.ConsumeFieldValue(num, typ, b), nil
+				}
+				s, n := protowire.ConsumeString(b)
+				if num == 1 {
+					k = s
+				} else {
+					v = s
+				}
+				return n, nil
+			}); err != nil {
+				return 0, err
+			}
+			if e.Metadata == nil {
+				e.Metadata = map[string]string{}
+			}
+			e.Metadata[k] = v
+			return n, nil
+		case (num == 6 || num == 7 || num == 11 || num == 16) && typ == protowire.BytesType:
+			msg, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			t, err := decodeTimestamp(msg)
+			if err != nil {
+				return 0, err
+			}
+			switch num {
+			case 6:
+				e.DeliverAt = &t
+			case 11:
+				e.ExpiresAt = &t
+			case 16:
+				e.OccurredAt = &t
+			default:
+				e.ReceivedAt = t
+			}
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+func decodeTimestamp(data []byte) (time.Time, error) {
+	var sec, nsec int64
+	err := fields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.VarintType || (num != 1 && num != 2) {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		v, n := protowire.ConsumeVarint(b)
+		if num == 1 {
+			sec = int64(v)
+		} else {
+			nsec = int64(int32(v))
+		}
+		return n, nil
+	})
+	return time.Unix(sec, nsec).UTC(), err
+}
+
+// fields walks the fields of a message, handing each value to fn, which
+// returns the bytes it consumed (negative for a protowire error).
+func fields(data []byte, fn func(protowire.Number, protowire.Type, []byte) (int, error)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("protobuf: %w", protowire.ParseError(n))
+		}
+		data = data[n:]
+		m, err := fn(num, typ, data)
+		if err != nil {
+			return err
+		}
+		if m < 0 {
+			return fmt.Errorf("protobuf: %w", protowire.ParseError(m))
+		}
+		data = data[m:]
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"net/url"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secret values in Redacted.
+const redacted = "[REDACTED]"
+
+// secretKeys are settings whose whole value is a credential.
+var secretKeys = map[string]bool{
+	"key": true, "key_sha256": true, "signing_secret": true, "hash_key": true,
+	"routing_key": true, "password": true, "token": true, "secret": true,
+	"secret_access_key": true, "session_token": true, "master_key": true,
+}
+
+// Redacted returns c as a document of maps and lists keyed by the YAML
+// names, with credentials masked: API key secrets and hashes, HMAC and
+// routing keys, header and plugin environment values, and the user info,
+// path and query of URLs, which often embed tokens (Slack webhooks, Redis
+// passwords).
+func Redacted(c *Config) (map[string]any, error) {
+	raw, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	redact(doc)
+	return doc, nil
+}
+
+func redact(v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, x := range v {
+			switch {
+			case secretKeys[k]:
+				if x != nil && x != "" {
+					v[k] = redacted
+				}
+			case k == "headers":
+				if h, ok := x.(map[string]any); ok {
+					for name := range h {
+						h[name] = redacted
+					}
+				}
+			case k == "env":
+				if env, ok := x.([]any); ok {
+					for i, kv := range env {
+						if s, ok := kv.(string); ok {
+							name, _, _ := strings.Cut(s, "=")
+							env[i] = name + "=" + redacted
+						}
+					}
+				}
+			case k == "url" || strings.HasSuffix(k, "_url"):
+				if s, ok := x.(string); ok {
+					v[k] = redactURL(s)
+				}
+			default:
+				redact(x)
+			}
+		}
+	case []any:
+		for _, x := range v {
+			redact(x)
+		}
+	}
+}
+
+// redactURL keeps the scheme and host of s.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		if s == "" {
+			return s
+		}
+		return redacted
+	}
+	out := u.Scheme + "://" + u.Host
+	if u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		out += "/" + redacted
+	}
+	return out
+}
@@ -0,0 +1,254 @@
+// Package connlimit caps what clients hold open at once: connections, in
+// total and per client address, requests in flight, and streams per API
+// key. What goes over a limit is refused with 503 and Retry-After, so that
+// one buggy client opening thousands of sockets cannot exhaust the file
+// descriptors or memory every other client needs.
+package connlimit
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/auth"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/httpx"
+)
+
+// Reasons a connection or request is refused, the values of the reason
+// label.
+const (
+	ReasonConnections = "connections"
+	ReasonPerClient   = "per_client"
+	ReasonInFlight    = "in_flight"
+	ReasonStreams     = "streams"
+)
+
+var (
+	connectionsOpen = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "http_connections_open", Help: "Client connections open on the HTTP listeners"},
+	)
+	inFlightGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "http_requests_in_flight", Help: "Requests being served, streams aside"},
+	)
+	streamsOpen = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "http_streams_open", Help: "Exports and GraphQL subscriptions open"},
+	)
+	rejectedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "http_limit_rejected_total", Help: "Connections and requests refused with 503 by limit (connections, per_client, in_flight, streams)"},
+		[]string{"reason"},
+	)
+)
+
+// Collectors returns the limit metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{connectionsOpen, inFlightGauge, streamsOpen, rejectedTotal}
+}
+
+// refuseTimeout bounds the 503 written to a refused connection.
+const refuseTimeout = time.Second
+
+// Limiter enforces config.ConnLimitsConfig; zero limits are off.
+type Limiter struct {
+	cfg    config.ConnLimitsConfig
+	exempt map[string]bool
+
+	inFlight atomic.Int64
+
+	mu        sync.Mutex
+	conns     int
+	perClient map[string]int
+	streams   map[string]int
+}
+
+// New returns a Limiter for cfg. Requests to the exempt paths, like the
+// health probes, are never counted in flight.
+func New(cfg config.ConnLimitsConfig, exempt ...string) *Limiter {
+	l := &Limiter{cfg: cfg, exempt: map[string]bool{}, perClient: map[string]int{}, streams: map[string]int{}}
+	for _, p := range exempt {
+		l.exempt[p] = true
+	}
+	return l
+}
+
+// Listener counts the connections ln accepts. One over a limit is answered
+// 503 and closed right away, before it costs a goroutine per request; over
+// TLS, where nothing can be said before the handshake, it is only closed.
+// The client of a Unix socket connection is not known, so only the total
+// limit applies to it.
+func (l *Limiter) Listener(ln net.Listener, tls bool) net.Listener {
+	if l.cfg.MaxConnections <= 0 && l.cfg.MaxConnectionsPerClient <= 0 {
+		return ln
+	}
+	return &listener{Listener: ln, l: l, tls: tls}
+}
+
+type listener struct {
+	net.Listener
+	l   *Limiter
+	tls bool
+}
+
+func (ln *listener) Accept() (net.Conn, error) {
+	for {
+		c, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		client := ""
+		if a, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+			client = a.IP.String()
+		}
+		if reason := ln.l.open(client); reason != "" {
+			rejectedTotal.WithLabelValues(reason).Inc()
+			go refuse(c, reason, !ln.tls)
+			continue
+		}
+		return &conn{Conn: c, release: func() { ln.l.close(client) }}, nil
+	}
+}
+
+// open counts a connection from client, or returns why it is refused.
+func (l *Limiter) open(client string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if max := l.cfg.MaxConnections; max > 0 && l.conns >= max {
+		return ReasonConnections
+	}
+	if max := l.cfg.MaxConnectionsPerClient; max > 0 && client != "" && l.perClient[client] >= max {
+		return ReasonPerClient
+	}
+	l.conns++
+	if client != "" {
+		l.perClient[client]++
+	}
+	connectionsOpen.Set(float64(l.conns))
+	return ""
+}
+
+func (l *Limiter) close(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns--
+	if client != "" {
+		if l.perClient[client]--; l.perClient[client] <= 0 {
+			delete(l.perClient, client)
+		}
+	}
+	connectionsOpen.Set(float64(l.conns))
+}
+
+type conn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *conn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// refuse answers the first request on c with 503, when it can speak
+// plaintext HTTP, and closes it. The request is read first: closing with
+// unread data would reset the connection and lose the response.
+func refuse(c net.Conn, reason string, plaintext bool) {
+	defer c.Close()
+	if !plaintext {
+		return
+	}
+	_ = c.SetDeadline(time.Now().Add(refuseTimeout))
+	if _, err := http.ReadRequest(bufio.NewReader(c)); err != nil {
+		return
+	}
+	msg := "too many connections"
+	if reason == ReasonPerClient {
+		msg = "too many connections from this client"
+	}
+	body := httpx.Errorf(http.StatusServiceUnavailable, httpx.CodeUnavailable, "%s", msg).Body()
+	res := &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		ProtoMajor: 1, ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type": {httpx.ProblemContentType},
+			"Retry-After":  {"1"},
+		},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	_ = res.Write(c)
+}
+
+// InFlight refuses requests beyond server.limits.max_in_flight.
+func (l *Limiter) InFlight(next http.Handler) http.Handler {
+	max := int64(l.cfg.MaxInFlight)
+	if max <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.exempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		n := l.inFlight.Add(1)
+		defer func() { inFlightGauge.Set(float64(l.inFlight.Add(-1))) }()
+		inFlightGauge.Set(float64(n))
+		if n > max {
+			reject(w, ReasonInFlight, "too many requests in flight")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Streams refuses a stream beyond server.limits.max_streams_per_key open
+// for the same API key or token subject. It runs after authentication;
+// unauthenticated streams count per client address.
+func (l *Limiter) Streams(next http.Handler) http.Handler {
+	max := l.cfg.MaxStreamsPerKey
+	if max <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(key); err == nil {
+			key = host
+		}
+		if p, ok := auth.FromContext(r.Context()); ok {
+			key = "key:" + p.Subject
+		}
+		l.mu.Lock()
+		if l.streams[key] >= max {
+			l.mu.Unlock()
+			reject(w, ReasonStreams, "too many streams open for this key, at most "+strconv.Itoa(max))
+			return
+		}
+		l.streams[key]++
+		streamsOpen.Inc()
+		l.mu.Unlock()
+		defer func() {
+			l.mu.Lock()
+			if l.streams[key]--; l.streams[key] <= 0 {
+				delete(l.streams, key)
+			}
+			streamsOpen.Dec()
+			l.mu.Unlock()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func reject(w http.ResponseWriter, reason, msg string) {
+	rejectedTotal.WithLabelValues(reason).Inc()
+	w.Header().Set("Retry-After", "1")
+	httpx.Errorf(http.StatusServiceUnavailable, httpx.CodeUnavailable, "%s", msg).Write(w)
+}
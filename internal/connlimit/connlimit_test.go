@@ -0,0 +1,103 @@
+package connlimit
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/auth"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// TestListener holds the one connection a client may open and checks the
+// next one is answered 503, and let in again once the first closes.
+func TestListener(t *testing.T) {
+	l := New(config.ConnLimitsConfig{MaxConnectionsPerClient: 1})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go func() { _ = srv.Serve(l.Listener(ln, false)) }()
+	defer srv.Close()
+
+	get := func(c net.Conn) int {
+		t.Helper()
+		if _, err := c.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get(first); code != http.StatusOK {
+		t.Fatalf("first connection: %d", code)
+	}
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get(second); code != http.StatusServiceUnavailable {
+		t.Errorf("second connection: %d, want 503", code)
+	}
+	_ = second.Close()
+	_ = first.Close()
+
+	// the release of the first connection is asynchronous
+	for range 100 {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := get(c)
+		_ = c.Close()
+		if code == http.StatusOK {
+			return
+		}
+	}
+	t.Error("closed connections were not released")
+}
+
+// TestStreams counts streams per key: a second key is not held back by the
+// first, and a finished stream frees its slot.
+func TestStreams(t *testing.T) {
+	l := New(config.ConnLimitsConfig{MaxStreamsPerKey: 1})
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := l.Streams(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("hold") != "" {
+			started <- struct{}{}
+			<-release
+		}
+	}))
+	serve := func(subject, target string) int {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req = req.WithContext(auth.WithPrincipal(req.Context(), &auth.Principal{Subject: subject}))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	done := make(chan int)
+	go func() { done <- serve("a", "/?hold=1") }()
+	<-started
+	if code := serve("a", "/"); code != http.StatusServiceUnavailable {
+		t.Errorf("second stream of a: %d, want 503", code)
+	}
+	if code := serve("b", "/"); code != http.StatusOK {
+		t.Errorf("stream of b: %d", code)
+	}
+	close(release)
+	<-done
+	if code := serve("a", "/"); code != http.StatusOK {
+		t.Errorf("a after its stream ended: %d", code)
+	}
+}
@@ -0,0 +1,305 @@
+// Package consumer turns the event log into a lightweight work queue: named
+// consumers pull matching events, acknowledge them, and resume from a
+// persisted offset after a restart.
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+var (
+	eventsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "consumer_events_total", Help: "Consumer events by result (delivered, redelivered, acked)"},
+		[]string{"consumer", "result"},
+	)
+	pendingEvents = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "consumer_pending_events", Help: "Events pulled but not yet acknowledged"},
+		[]string{"consumer"},
+	)
+	fencedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "consumer_fenced_acks_total", Help: "Acks rejected because their lease went to a newer token"},
+		[]string{"consumer"},
+	)
+)
+
+// Collectors returns the consumer metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{eventsTotal, pendingEvents, fencedTotal}
+}
+
+var (
+	ErrNotFound = errors.New("consumer not found")
+	ErrExists   = errors.New("consumer already exists")
+	ErrInvalid  = errors.New("invalid consumer")
+	// ErrFenced is returned by Ack for a token whose events were leased
+	// again since, under a newer token.
+	ErrFenced = errors.New("lease superseded by a newer token")
+)
+
+const (
+	// MaxPull caps the events returned by one Pull.
+	MaxPull = 1000
+	// MaxPending caps the unacknowledged events of a consumer; Pull only
+	// redelivers expired ones once it is reached.
+	MaxPending = 10_000
+)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_.\-]{1,64}$`)
+
+// Manager serves the consumers. Pulled events are leased to the caller for
+// the ack timeout and handed out again if not acknowledged by then, so
+// several workers can share a consumer without processing an event twice
+// while it is in flight. Only the offset is persisted: after a restart,
+// events that were pulled but not acknowledged are delivered again.
+//
+// Every Pull that leases events issues a fencing token, greater than all
+// before it. A worker that stalled past its lease can no longer ack with its
+// token once the events went to another worker, and sinks it writes to can
+// reject the token in favour of the replacement's newer one.
+type Manager struct {
+	store      storage.Store
+	ackTimeout time.Duration
+	// groups holds the leases in Redis instead, see NewRedis
+	groups *groups
+
+	mu        sync.Mutex
+	consumers map[string]*consumer
+}
+
+type consumer struct {
+	mu    sync.Mutex
+	state storage.Consumer
+	query storage.Query
+	// cursor is the highest ID handed out; leases holds those not yet
+	// acknowledged.
+	cursor int64
+	leases map[int64]*lease
+	// pending counts the entries pending in the consumer group, with
+	// groups
+	pending int
+}
+
+type lease struct {
+	e        event.Event
+	deadline time.Time
+	token    int64
+}
+
+// Status describes a consumer for listing.
+type Status struct {
+	storage.Consumer
+	Pending int `json:"pending"`
+}
+
+// New loads the persisted consumers of store.
+func New(store storage.Store, ackTimeout time.Duration) (*Manager, error) {
+	saved, err := store.Consumers(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	m := &Manager{store: store, ackTimeout: ackTimeout, consumers: map[string]*consumer{}}
+	for _, c := range saved {
+		m.consumers[c.Name] = newConsumer(c)
+	}
+	return m, nil
+}
+
+func newConsumer(c storage.Consumer) *consumer {
+	return &consumer{
+		state:  c,
+		query:  storage.Query{Types: c.Types},
+		cursor: c.Offset,
+		leases: map[int64]*lease{},
+	}
+}
+
+// Create adds a consumer of the events whose type matches any of types (all
+// events when empty), starting from the oldest stored event.
+func (m *Manager) Create(ctx context.Context, name string, types []string) (storage.Consumer, error) {
+	if !namePattern.MatchString(name) {
+		return storage.Consumer{}, fmt.Errorf("%w: name must be 1-64 of A-Z a-z 0-9 _ . -", ErrInvalid)
+	}
+	if err := (storage.Query{Types: types}).Validate(); err != nil {
+		return storage.Consumer{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.consumers[name]; ok {
+		return storage.Consumer{}, ErrExists
+	}
+	c := storage.Consumer{Name: name, Types: types, CreatedAt: time.Now().UTC()}
+	if err := m.store.SaveConsumer(ctx, c); err != nil {
+		return storage.Consumer{}, err
+	}
+	if m.groups != nil {
+		if err := m.groups.create(ctx, c); err != nil {
+			return storage.Consumer{}, err
+		}
+	}
+	m.consumers[name] = newConsumer(c)
+	return c, nil
+}
+
+// List returns every consumer by name.
+func (m *Manager) List() []Status {
+	m.mu.Lock()
+	cs := make([]*consumer, 0, len(m.consumers))
+	for _, c := range m.consumers {
+		cs = append(cs, c)
+	}
+	m.mu.Unlock()
+	out := make([]Status, 0, len(cs))
+	for _, c := range cs {
+		c.mu.Lock()
+		out = append(out, Status{Consumer: c.state, Pending: len(c.leases) + c.pending})
+		c.mu.Unlock()
+	}
+	slices.SortFunc(out, func(a, b Status) int { return strings.Compare(a.Name, b.Name) })
+	return out
+}
+
+// Pull leases up to max events to the caller, oldest first: expired leases
+// before events never handed out. It returns the fencing token of the
+// lease, 0 when there are no events.
+func (m *Manager) Pull(ctx context.Context, name string, max int) ([]event.Event, int64, error) {
+	c, err := m.get(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	max = min(max, MaxPull)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m.groups != nil {
+		return m.pull(ctx, c, max)
+	}
+	now := time.Now()
+	deadline := now.Add(m.ackTimeout)
+
+	var expired []int64
+	for id, l := range c.leases {
+		if now.After(l.deadline) {
+			expired = append(expired, id)
+		}
+	}
+	slices.Sort(expired)
+	expired = expired[:min(len(expired), max)]
+
+	var events []event.Event
+	if n := min(max-len(expired), MaxPending-len(c.leases)); n > 0 {
+		q := c.query
+		q.FromID, q.Limit = c.cursor+1, n
+		if events, err = m.store.List(ctx, q); err != nil {
+			return nil, 0, err
+		}
+	}
+	out := []event.Event{}
+	if len(expired) == 0 && len(events) == 0 {
+		return out, 0, nil
+	}
+
+	// the token is persisted before the lease is handed out
+	next := c.state
+	next.Epoch++
+	if err := m.store.SaveConsumer(ctx, next); err != nil {
+		return nil, 0, err
+	}
+	c.state = next
+	for _, id := range expired {
+		l := c.leases[id]
+		l.deadline, l.token = deadline, next.Epoch
+		out = append(out, l.e)
+	}
+	for _, e := range events {
+		c.leases[e.ID] = &lease{e: e, deadline: deadline, token: next.Epoch}
+		c.cursor = e.ID
+		out = append(out, e)
+	}
+	eventsTotal.WithLabelValues(name, "redelivered").Add(float64(len(expired)))
+	eventsTotal.WithLabelValues(name, "delivered").Add(float64(len(events)))
+	pendingEvents.WithLabelValues(name).Set(float64(len(c.leases)))
+	return out, next.Epoch, nil
+}
+
+// Ack acknowledges the leased events among ids under token, the one Pull
+// returned with them, reporting how many were, and persists the advanced
+// offset. IDs not currently leased are ignored. Nothing is acknowledged and
+// ErrFenced returned if any of ids is leased under another token: every
+// lease has one, so a worker cannot ack without proving it still holds it.
+func (m *Manager) Ack(ctx context.Context, name string, ids []int64, token int64) (int, error) {
+	if token <= 0 {
+		return 0, fmt.Errorf("%w: token required: the Lease-Token of the pull", ErrInvalid)
+	}
+	c, err := m.get(name)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m.groups != nil {
+		return m.ack(ctx, c, ids, token)
+	}
+	for _, id := range ids {
+		if l, ok := c.leases[id]; ok && l.token != token {
+			fencedTotal.WithLabelValues(name).Inc()
+			return 0, fmt.Errorf("%w: event %d", ErrFenced, id)
+		}
+	}
+	n := 0
+	for _, id := range ids {
+		if _, ok := c.leases[id]; ok {
+			delete(c.leases, id)
+			n++
+		}
+	}
+	eventsTotal.WithLabelValues(name, "acked").Add(float64(n))
+	pendingEvents.WithLabelValues(name).Set(float64(len(c.leases)))
+
+	// everything below the oldest outstanding lease is done
+	offset := c.cursor
+	for id := range c.leases {
+		offset = min(offset, id-1)
+	}
+	if offset == c.state.Offset {
+		return n, nil
+	}
+	next := c.state
+	next.Offset = offset
+	if err := m.store.SaveConsumer(ctx, next); err != nil {
+		return n, err
+	}
+	c.state = next
+	return n, nil
+}
+
+// Get returns the persisted state of a consumer.
+func (m *Manager) Get(name string) (storage.Consumer, error) {
+	c, err := m.get(name)
+	if err != nil {
+		return storage.Consumer{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state, nil
+}
+
+func (m *Manager) get(name string) (*consumer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.consumers[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return c, nil
+}
@@ -0,0 +1,231 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/resp/resptest"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+func setup(t *testing.T, ackTimeout time.Duration, types ...string) (*Manager, storage.Store) {
+	t.Helper()
+	store := storage.NewMemory(1)
+	for _, typ := range types {
+		if _, err := store.Add(context.Background(), event.Event{Type: typ, Payload: json.RawMessage(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := New(store, ackTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Create(context.Background(), "billing", nil); err != nil {
+		t.Fatal(err)
+	}
+	return m, store
+}
+
+func ids(es []event.Event) []int64 {
+	out := make([]int64, len(es))
+	for i, e := range es {
+		out[i] = e.ID
+	}
+	return out
+}
+
+// TestAckFencing: a worker that stalled past its lease acks after the events
+// went to another worker and is fenced off, acknowledging nothing; the new
+// holder's ack goes through.
+func TestAckFencing(t *testing.T) {
+	const timeout = 20 * time.Millisecond
+	m, _ := setup(t, timeout, "a", "b")
+
+	stale, staleToken, err := m.Pull(context.Background(), "billing", 10)
+	if err != nil || len(stale) != 2 {
+		t.Fatalf("pull: %d events, %v", len(stale), err)
+	}
+	time.Sleep(2 * timeout)
+	fresh, freshToken, err := m.Pull(context.Background(), "billing", 10)
+	if err != nil || len(fresh) != 2 {
+		t.Fatalf("re-lease: %d events, %v", len(fresh), err)
+	}
+	if freshToken <= staleToken {
+		t.Fatalf("token %d after %d", freshToken, staleToken)
+	}
+
+	if n, err := m.Ack(context.Background(), "billing", ids(stale), staleToken); !errors.Is(err, ErrFenced) || n != 0 {
+		t.Fatalf("stale ack: %d, %v", n, err)
+	}
+	if n, err := m.Ack(context.Background(), "billing", ids(stale), 0); !errors.Is(err, ErrInvalid) || n != 0 {
+		t.Fatalf("ack without token: %d, %v", n, err)
+	}
+	if n, err := m.Ack(context.Background(), "billing", ids(fresh), freshToken); err != nil || n != 2 {
+		t.Fatalf("ack: %d, %v", n, err)
+	}
+	if c, _ := m.Get("billing"); c.Offset != fresh[1].ID {
+		t.Errorf("offset %d, want %d", c.Offset, fresh[1].ID)
+	}
+}
+
+// TestPull leases each event to one worker at a time, oldest first and of
+// the consumer's types only, and hands it out again once the lease expires.
+func TestPull(t *testing.T) {
+	const timeout = 30 * time.Millisecond
+	m, _ := setup(t, timeout, "order", "audit", "order", "order")
+	if _, err := m.Create(context.Background(), "orders", []string{"order"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, token, err := m.Pull(context.Background(), "orders", 2)
+	if err != nil || len(first) != 2 || token <= 0 {
+		t.Fatalf("pull: %d events, token %d, %v", len(first), token, err)
+	}
+	second, _, err := m.Pull(context.Background(), "orders", 10)
+	if err != nil || len(second) != 1 {
+		t.Fatalf("second pull: %d events, %v", len(second), err)
+	}
+	for _, e := range append(first, second...) {
+		if e.Type != "order" {
+			t.Errorf("event %d of type %s", e.ID, e.Type)
+		}
+	}
+	if ids(first)[1] >= ids(second)[0] {
+		t.Errorf("pulled %v then %v", ids(first), ids(second))
+	}
+	if none, tok, err := m.Pull(context.Background(), "orders", 10); err != nil || len(none) != 0 || tok != 0 {
+		t.Fatalf("pull with all leased: %v, token %d, %v", ids(none), tok, err)
+	}
+
+	if _, err := m.Ack(context.Background(), "orders", ids(second), token+1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * timeout)
+	again, _, err := m.Pull(context.Background(), "orders", 10)
+	if err != nil || !slices.Equal(ids(again), ids(first)) {
+		t.Errorf("after expiry: %v, want %v, %v", ids(again), ids(first), err)
+	}
+	if st := m.List(); len(st) != 2 || st[1].Name != "orders" || st[1].Pending != 2 {
+		t.Errorf("list %+v", st)
+	}
+	if _, _, err := m.Pull(context.Background(), "nobody", 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown consumer: %v", err)
+	}
+}
+
+// TestAckOffset advances the persisted offset only past events acknowledged
+// in full, so a restart delivers again what was pulled but not acked, with
+// tokens that keep growing.
+func TestAckOffset(t *testing.T) {
+	m, store := setup(t, time.Minute, "a", "b", "c")
+	es, token, err := m.Pull(context.Background(), "billing", 10)
+	if err != nil || len(es) != 3 {
+		t.Fatalf("pull: %d events, %v", len(es), err)
+	}
+	if n, err := m.Ack(context.Background(), "billing", []int64{es[1].ID, es[2].ID, 999}, token); err != nil || n != 2 {
+		t.Fatalf("ack: %d, %v", n, err)
+	}
+	if c, _ := m.Get("billing"); c.Offset != es[0].ID-1 {
+		t.Errorf("offset %d with event %d unacked", c.Offset, es[0].ID)
+	}
+
+	restarted, err := New(store, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redelivered, again, err := restarted.Pull(context.Background(), "billing", 10)
+	if err != nil || !slices.Equal(ids(redelivered), ids(es)) {
+		t.Fatalf("after restart: %v, %v", ids(redelivered), err)
+	}
+	if again <= token {
+		t.Errorf("token %d after restart, was %d", again, token)
+	}
+	if n, err := restarted.Ack(context.Background(), "billing", ids(redelivered), again); err != nil || n != 3 {
+		t.Fatalf("ack: %d, %v", n, err)
+	}
+	if c, _ := restarted.Get("billing"); c.Offset != es[2].ID {
+		t.Errorf("offset %d, want %d", c.Offset, es[2].ID)
+	}
+}
+
+// TestCreate refuses invalid names and types and a name in use.
+func TestCreate(t *testing.T) {
+	m, _ := setup(t, time.Minute)
+	for name, err := range map[string]error{
+		"billing":     ErrExists,
+		"has space":   ErrInvalid,
+		"":            ErrInvalid,
+		"ok-name.v2_": nil,
+	} {
+		if _, got := m.Create(context.Background(), name, nil); !errors.Is(got, err) {
+			t.Errorf("%q: %v, want %v", name, got, err)
+		}
+	}
+}
+
+// TestGroups delivers a consumer through its Redis consumer group, shared
+// by two instances: an event leased by one is not handed out by the other
+// until its lease expires, and the stale holder is fenced off.
+func TestGroups(t *testing.T) {
+	const timeout = 30 * time.Millisecond
+	ctx := context.Background()
+	srv := resptest.NewServer(t)
+	cfg := config.StorageRedisConfig{URL: srv.URL, Stream: "ingest:store", MaxLen: 100, Timeout: time.Second}
+	store, err := storage.NewRedisStream(storage.NewMemory(1), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for _, typ := range []string{"order", "audit", "order", "order"} {
+		if _, err := store.Add(ctx, event.Event{Type: typ, Payload: json.RawMessage(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := NewRedis(store, timeout, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Create(ctx, "orders", []string{"order"}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewRedis(store, timeout, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, token, err := a.Pull(ctx, "orders", 2)
+	if err != nil || !slices.Equal(ids(first), []int64{1, 3}) || token <= 0 {
+		t.Fatalf("pull: %v, token %d, %v", ids(first), token, err)
+	}
+	second, secondToken, err := b.Pull(ctx, "orders", 10)
+	if err != nil || !slices.Equal(ids(second), []int64{4}) || secondToken <= token {
+		t.Fatalf("pull on the other instance: %v, token %d, %v", ids(second), secondToken, err)
+	}
+	if none, tok, err := b.Pull(ctx, "orders", 10); err != nil || len(none) != 0 || tok != 0 {
+		t.Fatalf("pull with all leased: %v, token %d, %v", ids(none), tok, err)
+	}
+	if st := b.List(); len(st) != 1 || st[0].Pending != 3 {
+		t.Errorf("list %+v", st)
+	}
+
+	time.Sleep(2 * timeout)
+	again, againToken, err := b.Pull(ctx, "orders", 10)
+	if err != nil || !slices.Equal(ids(again), []int64{1, 3, 4}) {
+		t.Fatalf("after expiry: %v, %v", ids(again), err)
+	}
+	if n, err := a.Ack(ctx, "orders", ids(first), token); !errors.Is(err, ErrFenced) || n != 0 {
+		t.Fatalf("stale ack: %d, %v", n, err)
+	}
+	if n, err := b.Ack(ctx, "orders", []int64{1, 3, 999}, againToken); err != nil || n != 2 {
+		t.Fatalf("ack: %d, %v", n, err)
+	}
+	if c, _ := b.Get("orders"); c.Offset != 3 {
+		t.Errorf("offset %d with event 4 unacked", c.Offset)
+	}
+}
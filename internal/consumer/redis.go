@@ -0,0 +1,299 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/resp"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+// groups delivers the consumers through consumer groups on the stream of
+// a storage.RedisStream, one per consumer named after it. Redis keeps the
+// pending entries, so the instances share each consumer's leases; the
+// tokens of the leases are kept in the hash <stream>:leases:<consumer>,
+// and issued from the hash <stream>:epochs.
+type groups struct {
+	pool   *resp.Pool
+	stream string
+	// member is the name of this instance in the groups
+	member string
+}
+
+// NewRedis loads the persisted consumers of store like New, delivering them
+// through consumer groups on the stream cfg names, which store adds its
+// events to (see storage.RedisStream). A group only sees the events in the
+// stream: a new consumer starts from its oldest entry, and a consumer whose
+// offset is older than the stream skips the events in between.
+func NewRedis(store storage.Store, ackTimeout time.Duration, cfg config.StorageRedisConfig) (*Manager, error) {
+	opts, err := resp.ParseURL(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("consumer groups redis url: %w", err)
+	}
+	m, err := New(store, ackTimeout)
+	if err != nil {
+		return nil, err
+	}
+	member, _ := os.Hostname()
+	if member == "" {
+		member = "ingest"
+	}
+	m.groups = &groups{pool: resp.NewPool(opts, cfg.Timeout, 16), stream: cfg.Stream, member: member}
+	for _, c := range m.consumers {
+		if err := m.groups.create(context.Background(), c.state); err != nil {
+			m.groups.pool.Close()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// create adds the group of c, reading the entries after its offset, unless
+// it exists.
+func (g *groups) create(ctx context.Context, c storage.Consumer) error {
+	_, err := g.pool.Do(ctx, []string{"XGROUP", "CREATE", g.stream, c.Name, strconv.FormatInt(c.Offset, 10) + "-0", "MKSTREAM"})
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("consumer group %s: %w", c.Name, err)
+	}
+	return nil
+}
+
+// pull is Pull of c through its group, with c.mu held: entries idle past
+// the ack timeout are claimed again before new ones are read. Entries of
+// events c does not match, or that are gone from the store, are
+// acknowledged as they are read.
+func (m *Manager) pull(ctx context.Context, c *consumer, limit int) ([]event.Event, int64, error) {
+	g, name := m.groups, c.state.Name
+	idle := strconv.FormatInt(m.ackTimeout.Milliseconds(), 10)
+	replies, err := g.pool.Do(ctx,
+		[]string{"XPENDING", g.stream, name},
+		[]string{"XAUTOCLAIM", g.stream, name, g.member, idle, "0-0", "COUNT", strconv.Itoa(limit)},
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	pending, _ := pendingSummary(replies[0])
+	claim, _ := replies[1].([]any)
+	var claimed []int64
+	if len(claim) >= 2 {
+		claimed = entryIDs(claim[1])
+	}
+	if len(claim) >= 3 {
+		if gone, _ := claim[2].([]any); len(gone) > 0 {
+			log.Warn().Str("consumer", name).Int("entries", len(gone)).Msg("pending entries trimmed from the stream before their ack")
+		}
+	}
+	leased, err := m.leasable(ctx, c, claimed)
+	if err != nil {
+		return nil, 0, err
+	}
+	redelivered := len(leased)
+
+	// new entries, until enough match or MaxPending are pending
+	for n := min(limit-len(leased), MaxPending-pending); n > 0; n = min(limit-len(leased), MaxPending-pending) {
+		replies, err := g.pool.Do(ctx, []string{"XREADGROUP", "GROUP", name, g.member, "COUNT", strconv.Itoa(n), "STREAMS", g.stream, ">"})
+		if err != nil {
+			return nil, 0, err
+		}
+		read := readGroupIDs(replies[0])
+		if len(read) == 0 {
+			break
+		}
+		c.cursor = max(c.cursor, read[len(read)-1])
+		matched, err := m.leasable(ctx, c, read)
+		if err != nil {
+			return nil, 0, err
+		}
+		pending += len(matched)
+		leased = append(leased, matched...)
+	}
+	c.pending = pending
+	pendingEvents.WithLabelValues(name).Set(float64(pending))
+	if len(leased) == 0 {
+		return []event.Event{}, 0, nil
+	}
+
+	// the token is persisted before the lease is handed out
+	replies, err = g.pool.Do(ctx, []string{"HINCRBY", g.stream + ":epochs", name, "1"})
+	if err != nil {
+		return nil, 0, err
+	}
+	token, _ := replies[0].(int64)
+	if token <= c.state.Epoch {
+		// the hash was lost: carry on from the persisted epoch
+		replies, err = g.pool.Do(ctx, []string{"HINCRBY", g.stream + ":epochs", name, strconv.FormatInt(c.state.Epoch-token+1, 10)})
+		if err != nil {
+			return nil, 0, err
+		}
+		token, _ = replies[0].(int64)
+	}
+	next := c.state
+	next.Epoch = token
+	if err := m.store.SaveConsumer(ctx, next); err != nil {
+		return nil, 0, err
+	}
+	c.state = next
+	hset := []string{"HSET", g.leases(name)}
+	for _, e := range leased {
+		hset = append(hset, strconv.FormatInt(e.ID, 10), strconv.FormatInt(token, 10))
+	}
+	if _, err := g.pool.Do(ctx, hset); err != nil {
+		return nil, 0, err
+	}
+	eventsTotal.WithLabelValues(name, "redelivered").Add(float64(redelivered))
+	eventsTotal.WithLabelValues(name, "delivered").Add(float64(len(leased) - redelivered))
+	return leased, token, nil
+}
+
+// leasable returns the events of the entries ids that c matches, and
+// acknowledges the others, dropping their tokens.
+func (m *Manager) leasable(ctx context.Context, c *consumer, ids []int64) ([]event.Event, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	events, err := m.store.GetMany(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	out := events[:0]
+	kept := make(map[int64]bool, len(events))
+	for _, e := range events {
+		if c.query.Match(&e) {
+			out = append(out, e)
+			kept[e.ID] = true
+		}
+	}
+	xack := []string{"XACK", m.groups.stream, c.state.Name}
+	hdel := []string{"HDEL", m.groups.leases(c.state.Name)}
+	for _, id := range ids {
+		if !kept[id] {
+			xack = append(xack, entryID(id))
+			hdel = append(hdel, strconv.FormatInt(id, 10))
+		}
+	}
+	if len(xack) > 3 {
+		if _, err := m.groups.pool.Do(ctx, xack, hdel); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// ack is Ack of c through its group, with c.mu held.
+func (m *Manager) ack(ctx context.Context, c *consumer, ids []int64, token int64) (int, error) {
+	g, name := m.groups, c.state.Name
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	hmget := []string{"HMGET", g.leases(name)}
+	for _, id := range ids {
+		hmget = append(hmget, strconv.FormatInt(id, 10))
+	}
+	replies, err := g.pool.Do(ctx, hmget)
+	if err != nil {
+		return 0, err
+	}
+	tokens, _ := replies[0].([]any)
+	want := strconv.FormatInt(token, 10)
+	for i, t := range tokens {
+		if t != nil && t != want {
+			fencedTotal.WithLabelValues(name).Inc()
+			return 0, fmt.Errorf("%w: event %d", ErrFenced, ids[i])
+		}
+	}
+	xack := []string{"XACK", g.stream, name}
+	hdel := []string{"HDEL", g.leases(name)}
+	for _, id := range ids {
+		xack = append(xack, entryID(id))
+		hdel = append(hdel, strconv.FormatInt(id, 10))
+	}
+	replies, err = g.pool.Do(ctx, xack, hdel, []string{"XPENDING", g.stream, name})
+	if err != nil {
+		return 0, err
+	}
+	n, _ := replies[0].(int64)
+	eventsTotal.WithLabelValues(name, "acked").Add(float64(n))
+	pending, oldest := pendingSummary(replies[2])
+	c.pending = pending
+	pendingEvents.WithLabelValues(name).Set(float64(pending))
+
+	// everything below the oldest pending entry is done
+	offset := max(c.cursor, c.state.Offset)
+	if pending > 0 {
+		offset = oldest - 1
+	}
+	if offset <= c.state.Offset {
+		return int(n), nil
+	}
+	next := c.state
+	next.Offset = offset
+	if err := m.store.SaveConsumer(ctx, next); err != nil {
+		return int(n), err
+	}
+	c.state = next
+	return int(n), nil
+}
+
+func (g *groups) leases(name string) string { return g.stream + ":leases:" + name }
+
+// entryID is the stream entry ID of the event id.
+func entryID(id int64) string { return strconv.FormatInt(id, 10) + "-0" }
+
+// eventID is the event ID of the stream entry ID s.
+func eventID(s string) (int64, bool) {
+	ms, _, _ := strings.Cut(s, "-")
+	id, err := strconv.ParseInt(ms, 10, 64)
+	return id, err == nil
+}
+
+// entryIDs returns the event IDs of a list of stream entries.
+func entryIDs(reply any) []int64 {
+	entries, _ := reply.([]any)
+	out := make([]int64, 0, len(entries))
+	for _, e := range entries {
+		parts, _ := e.([]any)
+		if len(parts) == 0 {
+			continue
+		}
+		s, _ := parts[0].(string)
+		if id, ok := eventID(s); ok {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// readGroupIDs returns the event IDs of the entries of an XREADGROUP reply
+// of one stream, nil when there were none.
+func readGroupIDs(reply any) []int64 {
+	streams, _ := reply.([]any)
+	if len(streams) == 0 {
+		return nil
+	}
+	stream, _ := streams[0].([]any)
+	if len(stream) != 2 {
+		return nil
+	}
+	return entryIDs(stream[1])
+}
+
+// pendingSummary reads the count and oldest event ID of the summary form
+// of XPENDING.
+func pendingSummary(reply any) (int, int64) {
+	parts, _ := reply.([]any)
+	if len(parts) < 2 {
+		return 0, 0
+	}
+	n, _ := parts[0].(int64)
+	s, _ := parts[1].(string)
+	oldest, _ := eventID(s)
+	return int(n), oldest
+}
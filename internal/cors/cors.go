@@ -0,0 +1,130 @@
+// Package cors lets browser apps on other origins call the API: it answers
+// their CORS preflights and marks the responses to the origins allowed, so
+// a single-page app can post events without a proxy on its own origin.
+package cors
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// defaultHeaders are the request headers the API reads, gRPC-Web's and
+// Connect's included.
+var defaultHeaders = []string{
+	"Accept", "Authorization", "Content-Type", "Content-Encoding", "Idempotency-Key", "If-Match", "Prefer",
+	"X-API-Key", "X-Request-Id", "Traceparent", "Tracestate", "X-Grpc-Web", "X-User-Agent", "Grpc-Timeout",
+	"Connect-Protocol-Version", "Connect-Timeout-Ms",
+}
+
+// exposed are the response headers scripts may read.
+var exposed = []string{
+	"Location", "ETag", "Retry-After", "Consistency-Token", "Preference-Applied", "X-Request-Id",
+	"Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin",
+}
+
+const methods = "GET, POST, PUT, PATCH, DELETE"
+
+// Policy applies a config.CORSConfig.
+type Policy struct {
+	origins     []string
+	any         bool
+	headers     string
+	maxAge      string
+	credentials bool
+}
+
+// New returns the policy of cfg, nil when no origin is allowed.
+func New(cfg config.CORSConfig) *Policy {
+	if len(cfg.AllowedOrigins) == 0 {
+		return nil
+	}
+	headers := cfg.AllowedHeaders
+	if len(headers) == 0 {
+		headers = defaultHeaders
+	}
+	maxAge := cfg.MaxAge
+	if maxAge == 0 {
+		maxAge = 10 * time.Minute
+	}
+	p := &Policy{headers: strings.Join(headers, ", "), maxAge: strconv.Itoa(int(maxAge.Seconds())), credentials: cfg.AllowCredentials}
+	for _, o := range cfg.AllowedOrigins {
+		if o == "*" {
+			p.any = true
+		}
+		p.origins = append(p.origins, strings.ToLower(o))
+	}
+	return p
+}
+
+// Allowed reports whether requests from origin may read the responses.
+func (p *Policy) Allowed(origin string) bool {
+	if p.any {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	return slices.ContainsFunc(p.origins, func(o string) bool {
+		prefix, suffix, wild := strings.Cut(o, "*")
+		if !wild {
+			return o == origin
+		}
+		// the wildcard stands for one or more subdomain labels
+		sub, ok := strings.CutPrefix(origin, prefix)
+		if !ok {
+			return false
+		}
+		sub, ok = strings.CutSuffix(sub, suffix)
+		return ok && sub != "" && !strings.ContainsAny(sub, "/:")
+	})
+}
+
+// Middleware answers the preflights of allowed origins with 204 and adds
+// the CORS headers to their other requests. A nil policy passes every
+// request through, as do requests without an Origin; preflights from other
+// origins are refused with 403.
+func (p *Policy) Middleware(next http.Handler) http.Handler {
+	if p == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !p.Allowed(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if p.any && !p.credentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if p.credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			h.Set("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		h.Set("Access-Control-Allow-Methods", methods)
+		h.Set("Access-Control-Allow-Headers", p.headers)
+		h.Set("Access-Control-Max-Age", p.maxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,51 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// TestMiddleware answers preflights of allowed origins, refuses the others
+// and marks the responses of allowed origins only.
+func TestMiddleware(t *testing.T) {
+	p := New(config.CORSConfig{AllowedOrigins: []string{"https://app.example.com", "https://*.shop.example"}, AllowCredentials: true})
+	h := p.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	for _, tc := range []struct {
+		method, origin string
+		code           int
+		allow          string
+	}{
+		{http.MethodOptions, "https://app.example.com", http.StatusNoContent, "https://app.example.com"},
+		{http.MethodOptions, "https://eu.shop.example", http.StatusNoContent, "https://eu.shop.example"},
+		{http.MethodOptions, "https://shop.example", http.StatusForbidden, ""},
+		{http.MethodOptions, "https://evil.example/x.shop.example", http.StatusForbidden, ""},
+		{http.MethodPost, "https://APP.example.com", http.StatusCreated, "https://APP.example.com"},
+		{http.MethodPost, "https://evil.example", http.StatusCreated, ""},
+		{http.MethodPost, "", http.StatusCreated, ""},
+	} {
+		r := httptest.NewRequest(tc.method, "/v1/events", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if tc.method == http.MethodOptions {
+			r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.code || w.Header().Get("Access-Control-Allow-Origin") != tc.allow {
+			t.Errorf("%s from %q: got %d allowing %q, want %d allowing %q",
+				tc.method, tc.origin, w.Code, w.Header().Get("Access-Control-Allow-Origin"), tc.code, tc.allow)
+		}
+		if tc.allow != "" && w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+			t.Errorf("%s from %q: credentials not allowed", tc.method, tc.origin)
+		}
+	}
+	if New(config.CORSConfig{}) != nil {
+		t.Error("policy without origins")
+	}
+}
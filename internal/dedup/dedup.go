@@ -0,0 +1,181 @@
+// Package dedup drops events whose type and payload repeat an event accepted
+// shortly before, for producers that re-send the same event in a loop.
+package dedup
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+var (
+	eventsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "dedup_events_total", Help: "Events checked for duplicates by result (unique, duplicate)"},
+		[]string{"result"},
+	)
+	cacheEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "dedup_cache_entries", Help: "Content hashes remembered for duplicate detection"},
+	)
+	falseNegativeWindow = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dedup_false_negative_window_seconds",
+		Help: "How long after startup repeats of events accepted before it can go undetected",
+	})
+)
+
+// Collectors returns the dedup metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{eventsTotal, cacheEntries, falseNegativeWindow}
+}
+
+// Dedup remembers the content hash of every accepted event for the window,
+// counted from its first arrival. It is per instance and best effort: two
+// identical events arriving concurrently may both be accepted. A disabled
+// Dedup reports no duplicates.
+type Dedup struct {
+	enabled bool
+	window  time.Duration
+	max     int
+
+	mu     sync.Mutex
+	seen   map[[sha256.Size]byte]*list.Element
+	byTime *list.List // front is oldest
+}
+
+type entry struct {
+	key [sha256.Size]byte
+	id  int64
+	at  time.Time
+}
+
+func New(cfg config.DedupConfig) *Dedup {
+	d := &Dedup{
+		enabled: cfg.Enabled,
+		window:  cfg.Window,
+		max:     cfg.MaxEntries,
+		seen:    map[[sha256.Size]byte]*list.Element{},
+		byTime:  list.New(),
+	}
+	if d.window <= 0 {
+		d.window = 5 * time.Minute
+	}
+	if d.max <= 0 {
+		d.max = 100_000
+	}
+	if d.enabled {
+		// nothing from before this start is known until Restore
+		falseNegativeWindow.Set(d.window.Seconds())
+	}
+	return d
+}
+
+// Window is how long an accepted event is remembered.
+func (d *Dedup) Window() time.Duration { return d.window }
+
+// MaxEntries is how many events are remembered at most.
+func (d *Dedup) MaxEntries() int { return d.max }
+
+// Restore remembers events accepted before a restart, given newest first as
+// the store lists them, so that a restart does not reopen the window. It
+// must be called before the first Check.
+func (d *Dedup) Restore(events []event.Event) {
+	if !d.enabled {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for i := len(events) - 1; i >= 0; i-- {
+		e := &events[i]
+		k := key(e)
+		if _, ok := d.seen[k]; ok || now.Sub(e.ReceivedAt) > d.window {
+			continue
+		}
+		d.seen[k] = d.byTime.PushBack(&entry{key: k, id: e.ID, at: e.ReceivedAt})
+	}
+	for d.byTime.Len() > d.max {
+		d.remove(d.byTime.Front())
+	}
+	cacheEntries.Set(float64(d.byTime.Len()))
+	// when the store had more recent events than fit, the oldest part of
+	// the window is uncovered
+	gap := time.Duration(0)
+	if len(events) >= d.max {
+		gap = max(0, d.window-now.Sub(events[len(events)-1].ReceivedAt))
+	}
+	falseNegativeWindow.Set(gap.Seconds())
+}
+
+// Check returns the ID of the event with the same type and payload accepted
+// within the window, if any.
+func (d *Dedup) Check(e *event.Event) (int64, bool) {
+	if !d.enabled {
+		return 0, false
+	}
+	k := key(e)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire(time.Now())
+	if el, ok := d.seen[k]; ok {
+		eventsTotal.WithLabelValues("duplicate").Inc()
+		return el.Value.(*entry).id, true
+	}
+	eventsTotal.WithLabelValues("unique").Inc()
+	return 0, false
+}
+
+// Record remembers e, which has just been stored.
+func (d *Dedup) Record(e *event.Event) {
+	if !d.enabled {
+		return
+	}
+	k := key(e)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.seen[k]; ok {
+		return
+	}
+	d.seen[k] = d.byTime.PushBack(&entry{key: k, id: e.ID, at: time.Now()})
+	for d.byTime.Len() > d.max {
+		d.remove(d.byTime.Front())
+	}
+	cacheEntries.Set(float64(d.byTime.Len()))
+}
+
+func (d *Dedup) expire(now time.Time) {
+	for el := d.byTime.Front(); el != nil && now.Sub(el.Value.(*entry).at) > d.window; el = d.byTime.Front() {
+		d.remove(el)
+	}
+	cacheEntries.Set(float64(d.byTime.Len()))
+}
+
+func (d *Dedup) remove(el *list.Element) {
+	delete(d.seen, el.Value.(*entry).key)
+	d.byTime.Remove(el)
+}
+
+// SameKey reports whether a and b hash alike, i.e. whether one would be
+// dropped as a duplicate of the other within the window.
+func SameKey(a, b *event.Event) bool { return key(a) == key(b) }
+
+// key hashes the type and the compacted payload, so re-sends that differ only
+// in whitespace still match.
+func key(e *event.Event) [sha256.Size]byte {
+	var payload bytes.Buffer
+	if err := json.Compact(&payload, e.Payload); err != nil {
+		payload.Reset()
+		payload.Write(e.Payload)
+	}
+	h := sha256.New()
+	h.Write([]byte(e.Type))
+	h.Write([]byte{0})
+	h.Write(payload.Bytes())
+	return [sha256.Size]byte(h.Sum(nil))
+}
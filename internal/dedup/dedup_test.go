@@ -0,0 +1,122 @@
+package dedup
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+func ev(id int64, typ, payload string) *event.Event {
+	return &event.Event{ID: id, Type: typ, Payload: json.RawMessage(payload)}
+}
+
+// gauge reads the value of g.
+func gauge(g prometheus.Gauge) float64 {
+	var m dto.Metric
+	_ = g.Write(&m)
+	return m.GetGauge().GetValue()
+}
+
+// TestCheck finds repeats of a recorded event's type and payload, whatever
+// their whitespace, and only while enabled.
+func TestCheck(t *testing.T) {
+	d := New(config.DedupConfig{Enabled: true, Window: time.Minute})
+	d.Record(ev(7, "order.created", `{"id": 1, "items": [1, 2]}`))
+	for _, tc := range []struct {
+		name string
+		e    *event.Event
+		dup  bool
+	}{
+		{"same", ev(0, "order.created", `{"id": 1, "items": [1, 2]}`), true},
+		{"compacted", ev(0, "order.created", `{"id":1,"items":[1,2]}`), true},
+		{"other payload", ev(0, "order.created", `{"id": 2, "items": [1, 2]}`), false},
+		{"keys reordered", ev(0, "order.created", `{"items": [1, 2], "id": 1}`), false},
+		{"other type", ev(0, "order.paid", `{"id": 1, "items": [1, 2]}`), false},
+	} {
+		if id, dup := d.Check(tc.e); dup != tc.dup || dup && id != 7 {
+			t.Errorf("%s: %d, %v; want duplicate %v of 7", tc.name, id, dup, tc.dup)
+		}
+	}
+	// the first event stays the one duplicates point at
+	d.Record(ev(8, "order.created", `{"id":1,"items":[1,2]}`))
+	if id, _ := d.Check(ev(0, "order.created", `{"id":1,"items":[1,2]}`)); id != 7 {
+		t.Errorf("duplicate of %d, want 7", id)
+	}
+
+	off := New(config.DedupConfig{Window: time.Minute})
+	off.Record(ev(1, "a", `{}`))
+	if _, dup := off.Check(ev(0, "a", `{}`)); dup {
+		t.Error("disabled dedup found a duplicate")
+	}
+}
+
+// TestWindow forgets events once the window since their arrival passed,
+// and the oldest ones beyond max_entries.
+func TestWindow(t *testing.T) {
+	d := New(config.DedupConfig{Enabled: true, Window: time.Minute, MaxEntries: 2})
+	for i, typ := range []string{"a", "b", "c"} {
+		d.Record(ev(int64(i+1), typ, `{}`))
+	}
+	if _, dup := d.Check(ev(0, "a", `{}`)); dup {
+		t.Error("a is still remembered past max_entries")
+	}
+	if _, dup := d.Check(ev(0, "b", `{}`)); !dup {
+		t.Error("b was forgotten")
+	}
+	d.mu.Lock()
+	d.byTime.Front().Value.(*entry).at = time.Now().Add(-2 * time.Minute)
+	d.mu.Unlock()
+	if _, dup := d.Check(ev(0, "b", `{}`)); dup {
+		t.Error("b is still remembered past the window")
+	}
+	if _, dup := d.Check(ev(0, "c", `{}`)); !dup || gauge(cacheEntries) != 1 {
+		t.Errorf("c: duplicate %v, %v entries", dup, gauge(cacheEntries))
+	}
+}
+
+// TestRestore remembers the stored events still within the window, and
+// reports the part of the window left uncovered when more were stored than
+// fit.
+func TestRestore(t *testing.T) {
+	now := time.Now()
+	stored := func(id int64, typ string, age time.Duration) event.Event {
+		e := *ev(id, typ, `{}`)
+		e.ReceivedAt = now.Add(-age)
+		return e
+	}
+	for _, tc := range []struct {
+		name       string
+		max        int
+		events     []event.Event // newest first
+		remembered []string
+		gap        time.Duration
+	}{
+		{"within the window", 10, []event.Event{stored(3, "c", time.Second), stored(2, "b", 30*time.Second), stored(1, "a", 2*time.Minute)}, []string{"b", "c"}, 0},
+		{"more than fit", 2, []event.Event{stored(3, "c", time.Second), stored(2, "b", 20*time.Second)}, []string{"b", "c"}, 40 * time.Second},
+	} {
+		d := New(config.DedupConfig{Enabled: true, Window: time.Minute, MaxEntries: tc.max})
+		if gauge(falseNegativeWindow) != 60 {
+			t.Errorf("%s: before restoring, the whole window is uncovered", tc.name)
+		}
+		d.Restore(tc.events)
+		for _, typ := range []string{"a", "b", "c"} {
+			id, dup := d.Check(ev(0, typ, `{}`))
+			want := false
+			for _, r := range tc.remembered {
+				want = want || r == typ
+			}
+			if dup != want || dup && id != int64(typ[0]-'a'+1) {
+				t.Errorf("%s: %s duplicate of %d (%v), want %v", tc.name, typ, id, dup, want)
+			}
+		}
+		if gap := time.Duration(gauge(falseNegativeWindow) * float64(time.Second)); gap < tc.gap-time.Second || gap > tc.gap {
+			t.Errorf("%s: uncovered %v, want %v", tc.name, gap, tc.gap)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Package demo turns the service into a throwaway sandbox for --demo: an
+// in-memory store without auth, seeded with representative events and fed
+// by synthetic producers through the public API, so every read feature has
+// data to show.
+package demo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// seedEvents are sent at startup, in batches of seedBatch.
+const (
+	seedEvents = 500
+	seedBatch  = 100
+)
+
+// Configure overrides cfg for demo mode. Settings of the config file that
+// do not conflict (sinks, alerts, other pipelines) are kept.
+func Configure(cfg *config.Config) {
+	cfg.Storage = config.StorageConfig{Driver: "memory"}
+	cfg.Auth = config.AuthConfig{}
+	cfg.TLS = config.TLSConfig{}
+	cfg.Docs.SwaggerUI = true
+	cfg.Debug.Enabled = true
+	if cfg.Pipelines == nil {
+		cfg.Pipelines = map[string][]config.ProcessorConfig{}
+	}
+	cfg.Pipelines["user.signup"] = []config.ProcessorConfig{
+		{Name: "pii", Redact: []config.RedactRuleConfig{{Name: "email", Fields: []string{"email"}}}},
+	}
+	cfg.Pipelines["checkout.completed"] = []config.ProcessorConfig{
+		{Name: "amount", Coerce: map[string]string{"amount": "float"}},
+		{Name: "source", Metadata: map[string]string{"source": "demo"}},
+	}
+	if cfg.SavedQueries == nil {
+		cfg.SavedQueries = map[string]config.SavedQueryConfig{}
+	}
+	cfg.SavedQueries["failed-payments"] = config.SavedQueryConfig{
+		Types: []string{"payment.*"}, Fields: map[string]string{"status": "failed"}, Last: time.Hour,
+	}
+	if cfg.Schemas == nil {
+		cfg.Schemas = map[string]config.SchemaConfig{}
+	}
+	cfg.Schemas["checkout.completed"] = config.SchemaConfig{
+		Latest: "2",
+		Versions: map[string]config.SchemaVersionConfig{
+			"1": {Status: "deprecated", Deadline: time.Now().AddDate(0, 1, 0).UTC().Truncate(24 * time.Hour)},
+			"2": {Status: "accepted"},
+		},
+	}
+}
+
+// Run seeds the service listening at base (e.g. http://localhost:8080) and
+// then sends a few events a second until ctx is done.
+func Run(ctx context.Context, base string) {
+	c := &client{base: strings.TrimSuffix(base, "/"), http: &http.Client{Timeout: 5 * time.Second}}
+	if err := c.waitReady(ctx); err != nil {
+		log.Error().Err(err).Msg("demo: service not ready")
+		return
+	}
+	if err := c.post(ctx, "/v1/consumers", map[string]any{"name": "demo-worker", "types": []string{"checkout.*", "payment.*"}}); err != nil {
+		log.Warn().Err(err).Msg("demo: create consumer")
+	}
+	for sent := 0; sent < seedEvents; sent += seedBatch {
+		batch := make([]map[string]any, seedBatch)
+		for i := range batch {
+			batch[i] = randomEvent()
+		}
+		if err := c.post(ctx, "/v1/events/batch", batch); err != nil {
+			log.Error().Err(err).Msg("demo: seed events")
+			return
+		}
+	}
+	log.Info().Int("events", seedEvents).Msg("demo: seeded, synthetic producers running")
+
+	tick := time.NewTicker(250 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		if err := c.post(ctx, "/v1/events", randomEvent()); err != nil && ctx.Err() == nil {
+			log.Warn().Err(err).Msg("demo: produce event")
+		}
+	}
+}
+
+var (
+	plans      = []string{"free", "pro", "team"}
+	paths      = []string{"/", "/pricing", "/docs", "/checkout", "/account"}
+	reasons    = []string{"card_declined", "insufficient_funds", "expired_card"}
+	channels   = []string{"web", "mobile"}
+	regions    = []string{"region=eu", "region=us"}
+	currencies = []string{"EUR", "USD"}
+)
+
+// randomEvent returns one of the demo event types, page views being the
+// most frequent and failed payments the rarest.
+func randomEvent() map[string]any {
+	user := fmt.Sprintf("u-%04d", rand.IntN(500))
+	order := fmt.Sprintf("o-%06d", rand.IntN(1_000_000))
+	tags := []string{pick(channels), pick(regions)}
+	amount := fmt.Sprintf("%.2f", 5+rand.Float64()*200)
+	var typ string
+	var payload map[string]any
+	switch n := rand.IntN(100); {
+	case n < 55:
+		typ, payload = "page.view", map[string]any{"user_id": user, "path": pick(paths), "duration_ms": rand.IntN(3000)}
+	case n < 70:
+		typ, payload = "user.signup", map[string]any{"user_id": user, "email": user + "@example.com", "plan": pick(plans)}
+	case n < 85:
+		// amounts arrive as strings, the checkout pipeline coerces them
+		typ, payload = "checkout.completed", map[string]any{"order_id": order, "user_id": user, "amount": amount, "currency": pick(currencies)}
+	case n < 95:
+		typ, payload = "payment.succeeded", map[string]any{"order_id": order, "status": "ok", "amount": amount}
+	default:
+		typ, payload = "payment.failed", map[string]any{"order_id": order, "status": "failed", "reason": pick(reasons)}
+	}
+	return map[string]any{"type": typ, "payload": payload, "tags": tags}
+}
+
+func pick(s []string) string { return s[rand.IntN(len(s))] }
+
+type client struct {
+	base string
+	http *http.Client
+}
+
+func (c *client) waitReady(ctx context.Context) error {
+	for range 50 {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+"/openapi.json", nil)
+		if err != nil {
+			return err
+		}
+		if resp, err := c.http.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return fmt.Errorf("%s did not answer", c.base)
+}
+
+func (c *client) post(ctx context.Context, path string, body any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.base+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: %s", path, resp.Status)
+	}
+	return nil
+}
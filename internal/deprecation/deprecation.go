@@ -0,0 +1,94 @@
+// Package deprecation announces the retirement of event types and API routes
+// with Deprecation (RFC 9745) and Sunset (RFC 8594) headers, counts who still
+// uses them, and rejects them once the sunset has passed.
+package deprecation
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/auth"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/httpx"
+)
+
+var usageTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "deprecated_usage_total", Help: "Uses of deprecated event types and routes by producer"},
+	[]string{"kind", "name", "producer"},
+)
+
+// Collectors returns the deprecation metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{usageTotal}
+}
+
+type Policy struct {
+	types  map[string]config.DeprecationConfig
+	routes map[string]config.DeprecationConfig
+}
+
+func New(cfg config.DeprecationsConfig) *Policy {
+	return &Policy{types: cfg.Types, routes: cfg.Routes}
+}
+
+// Type checks an event of type typ sent by p, annotating h when the type is
+// deprecated. It returns an error once the type's sunset has passed.
+func (pol *Policy) Type(h http.Header, p *auth.Principal, typ string) error {
+	d, ok := pol.types[typ]
+	if !ok {
+		return nil
+	}
+	usageTotal.WithLabelValues("type", typ, producer(p)).Inc()
+	return apply(h, d, "event type "+typ)
+}
+
+// Routes annotates requests under a deprecated path prefix (the longest
+// matching one) and answers 410 Gone after its sunset. It expects the
+// Principal in the request context to attribute usage.
+func (pol *Policy) Routes(next http.Handler) http.Handler {
+	if len(pol.routes) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := ""
+		for pre := range pol.routes {
+			if strings.HasPrefix(r.URL.Path, pre) && len(pre) > len(prefix) {
+				prefix = pre
+			}
+		}
+		if prefix != "" {
+			p, _ := auth.FromContext(r.Context())
+			usageTotal.WithLabelValues("route", prefix, producer(p)).Inc()
+			if err := apply(w.Header(), pol.routes[prefix], prefix); err != nil {
+				httpx.Error(w, err.Error(), http.StatusGone)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func apply(h http.Header, d config.DeprecationConfig, what string) error {
+	h.Set("Deprecation", fmt.Sprintf("@%d", d.Since.Unix()))
+	if !d.Sunset.IsZero() {
+		h.Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if d.Link != "" {
+		h.Add("Link", fmt.Sprintf(`<%s>; rel="deprecation"`, d.Link))
+	}
+	if !d.Sunset.IsZero() && !time.Now().Before(d.Sunset) {
+		return fmt.Errorf("%s was retired on %s", what, d.Sunset.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func producer(p *auth.Principal) string {
+	if p == nil {
+		return "anonymous"
+	}
+	return p.Subject
+}
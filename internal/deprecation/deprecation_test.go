@@ -0,0 +1,71 @@
+package deprecation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/auth"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// TestType annotates deprecated types and rejects them after their sunset.
+func TestType(t *testing.T) {
+	since := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	pol := New(config.DeprecationsConfig{Types: map[string]config.DeprecationConfig{
+		"order.v1":  {Since: since, Sunset: time.Now().Add(time.Hour), Link: "https://example.com/order-v2"},
+		"signup.v1": {Since: since, Sunset: time.Now().Add(-time.Hour)},
+		"click.v1":  {Since: since},
+	}})
+	p := &auth.Principal{Subject: "web"}
+	for _, tc := range []struct {
+		typ          string
+		retired      bool
+		sunset, link bool
+		deprecation  string
+	}{
+		{"page.view", false, false, false, ""},
+		{"order.v1", false, true, true, "@1767225600"},
+		{"signup.v1", true, true, false, "@1767225600"},
+		{"click.v1", false, false, false, "@1767225600"},
+	} {
+		h := http.Header{}
+		err := pol.Type(h, p, tc.typ)
+		if (err != nil) != tc.retired {
+			t.Errorf("%s: err %v, want retired %v", tc.typ, err, tc.retired)
+		}
+		if h.Get("Deprecation") != tc.deprecation || (h.Get("Sunset") != "") != tc.sunset || (h.Get("Link") != "") != tc.link {
+			t.Errorf("%s: headers %v", tc.typ, h)
+		}
+	}
+}
+
+// TestRoutes answers the longest deprecated prefix and 410 Gone after its
+// sunset.
+func TestRoutes(t *testing.T) {
+	since := time.Now().Add(-24 * time.Hour)
+	pol := New(config.DeprecationsConfig{Routes: map[string]config.DeprecationConfig{
+		"/v1/legacy":      {Since: since, Sunset: time.Now().Add(time.Hour)},
+		"/v1/legacy/bulk": {Since: since, Sunset: time.Now().Add(-time.Hour)},
+	}})
+	h := pol.Routes(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, tc := range []struct {
+		path       string
+		status     int
+		deprecated bool
+	}{
+		{"/v1/events", http.StatusNoContent, false},
+		{"/v1/legacy/events", http.StatusNoContent, true},
+		{"/v1/legacy/bulk", http.StatusGone, true},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tc.status || (rec.Header().Get("Deprecation") != "") != tc.deprecated {
+			t.Errorf("%s: %d %v", tc.path, rec.Code, rec.Header())
+		}
+	}
+}
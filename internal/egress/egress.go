@@ -0,0 +1,110 @@
+// Package egress keeps outbound HTTP requests to destinations chosen by
+// tenants from reaching the service's own network: loopback, private,
+// link-local (cloud metadata) and other non-public addresses are refused
+// when connecting, after DNS resolution and on every redirect, unless an
+// allowed CIDR covers them.
+package egress
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+var refusedTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{Name: "egress_refused_total", Help: "Outbound connections of tenant destinations refused for a non-public address"},
+)
+
+// Collectors returns the egress metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{refusedTotal}
+}
+
+// ErrRefused is returned when connecting to an address the policy does not
+// allow.
+var ErrRefused = errors.New("destination address not allowed")
+
+// nonPublic are the ranges refused unless allowed, beyond what netip
+// classifies as loopback, private, link-local, multicast or unspecified.
+var nonPublic = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), // NAT64 reaches any IPv4 address
+	netip.MustParsePrefix("2002::/16"),    // 6to4, likewise
+}
+
+// Policy decides which addresses may be connected to.
+type Policy struct {
+	allow []netip.Prefix
+}
+
+// New returns the policy of cfg, whose CIDRs must be valid.
+func New(cfg config.EgressConfig) (*Policy, error) {
+	p := &Policy{}
+	for _, c := range cfg.AllowCIDRs {
+		prefix, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("egress.allow_cidrs: %w", err)
+		}
+		p.allow = append(p.allow, prefix.Masked())
+	}
+	return p, nil
+}
+
+// Allowed reports whether addr may be connected to.
+func (p *Policy) Allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, a := range p.allow {
+		if a.Contains(addr) {
+			return true
+		}
+	}
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return false
+	}
+	for _, n := range nonPublic {
+		if n.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// control checks the resolved address of every connection attempt.
+func (p *Policy) control(_, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("egress: %s: %w", address, ErrRefused)
+	}
+	if !p.Allowed(ap.Addr()) {
+		refusedTotal.Inc()
+		return fmt.Errorf("egress: %s: %w", ap.Addr(), ErrRefused)
+	}
+	return nil
+}
+
+// Client returns an HTTP client with timeout whose connections go through
+// p. A nil p returns a plain client. Proxies from the environment are not
+// used, since the proxy would connect on the client's behalf unchecked.
+func (p *Policy) Client(timeout time.Duration) *http.Client {
+	if p == nil {
+		return &http.Client{Timeout: timeout}
+	}
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: p.control}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = nil
+	tr.DialContext = d.DialContext
+	return &http.Client{Timeout: timeout, Transport: tr}
+}
@@ -0,0 +1,71 @@
+package egress
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// TestAllowed refuses loopback, private, link-local and other non-public
+// addresses, also IPv4-mapped, unless an allowed CIDR covers them.
+func TestAllowed(t *testing.T) {
+	p, err := New(config.EgressConfig{AllowCIDRs: []string{"10.20.0.0/16"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		addr string
+		ok   bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::248", true},
+		{"10.20.1.5", true},
+		{"10.21.0.1", false},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"169.254.169.254", false},
+		{"fd00:ec2::254", false},
+		{"192.168.1.1", false},
+		{"172.16.0.1", false},
+		{"100.100.100.200", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.20.0.1", true},
+		{"fe80::1", false},
+		{"224.0.0.1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+	} {
+		if got := p.Allowed(netip.MustParseAddr(tc.addr)); got != tc.ok {
+			t.Errorf("%s: allowed %v, want %v", tc.addr, got, tc.ok)
+		}
+	}
+	if _, err := New(config.EgressConfig{AllowCIDRs: []string{"10.0.0.0"}}); err == nil {
+		t.Error("address accepted as a CIDR")
+	}
+}
+
+// TestClient refuses to connect to a loopback server unless allowed; a nil
+// policy connects anywhere.
+func TestClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+
+	refusing, _ := New(config.EgressConfig{})
+	if _, err := refusing.Client(time.Second).Get(srv.URL); !errors.Is(err, ErrRefused) {
+		t.Errorf("loopback: %v", err)
+	}
+	allowing, _ := New(config.EgressConfig{AllowCIDRs: []string{"127.0.0.0/8"}})
+	for name, p := range map[string]*Policy{"allowed": allowing, "nil": nil} {
+		resp, err := p.Client(time.Second).Get(srv.URL)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
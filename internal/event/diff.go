@@ -0,0 +1,98 @@
+package event
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Change is one difference between two JSON values: the value at Path (a
+// JSON Pointer, "" for the whole value) was added in b, removed from a, or
+// replaced. A and B hold the compacted values on each side.
+type Change struct {
+	Op   string          `json:"op"`
+	Path string          `json:"path"`
+	A    json.RawMessage `json:"a,omitempty"`
+	B    json.RawMessage `json:"b,omitempty"`
+}
+
+// Diff lists the changes from payload a to payload b, objects key by key in
+// key order and arrays index by index. Numbers compare by their JSON text,
+// so 1 and 1.0 differ, as they do for dedup. It fails if either payload is
+// not valid JSON.
+func Diff(a, b json.RawMessage) ([]Change, error) {
+	va, err := decode(a)
+	if err != nil {
+		return nil, err
+	}
+	vb, err := decode(b)
+	if err != nil {
+		return nil, err
+	}
+	out := []Change{}
+	diff("", va, vb, &out)
+	return out, nil
+}
+
+func decode(raw json.RawMessage) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	err := dec.Decode(&v)
+	return v, err
+}
+
+func diff(path string, a, b any, out *[]Change) {
+	switch x := a.(type) {
+	case map[string]any:
+		if y, ok := b.(map[string]any); ok {
+			keys := slices.AppendSeq(slices.Collect(maps.Keys(x)), maps.Keys(y))
+			slices.Sort(keys)
+			for _, k := range slices.Compact(keys) {
+				p := path + "/" + escapePointer(k)
+				va, inA := x[k]
+				vb, inB := y[k]
+				switch {
+				case !inB:
+					*out = append(*out, Change{Op: "remove", Path: p, A: compact(va)})
+				case !inA:
+					*out = append(*out, Change{Op: "add", Path: p, B: compact(vb)})
+				default:
+					diff(p, va, vb, out)
+				}
+			}
+			return
+		}
+	case []any:
+		if y, ok := b.([]any); ok {
+			for i := range max(len(x), len(y)) {
+				p := path + "/" + strconv.Itoa(i)
+				switch {
+				case i >= len(y):
+					*out = append(*out, Change{Op: "remove", Path: p, A: compact(x[i])})
+				case i >= len(x):
+					*out = append(*out, Change{Op: "add", Path: p, B: compact(y[i])})
+				default:
+					diff(p, x[i], y[i], out)
+				}
+			}
+			return
+		}
+	}
+	if ca, cb := compact(a), compact(b); !bytes.Equal(ca, cb) {
+		*out = append(*out, Change{Op: "replace", Path: path, A: ca, B: cb})
+	}
+}
+
+func compact(v any) json.RawMessage {
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// escapePointer escapes a key for a JSON Pointer (RFC 6901).
+func escapePointer(k string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(k, "~", "~0"), "/", "~1")
+}
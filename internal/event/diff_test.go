@@ -0,0 +1,47 @@
+package event
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// TestDiff lists nothing for identical payloads, whatever their key order
+// and spacing, and the added, removed and replaced values of the others.
+func TestDiff(t *testing.T) {
+	for _, tc := range []struct {
+		name, a, b string
+		want       []Change
+	}{
+		{"identical", `{"a":1,"b":[1,2]}`, `{ "b": [1, 2], "a": 1 }`, []Change{}},
+		{"changed", `{"a":1,"b":{"c":"x"}}`, `{"a":1.0,"b":{"c":"y"}}`, []Change{
+			{Op: "replace", Path: "/a", A: json.RawMessage(`1`), B: json.RawMessage(`1.0`)},
+			{Op: "replace", Path: "/b/c", A: json.RawMessage(`"x"`), B: json.RawMessage(`"y"`)},
+		}},
+		{"missing", `{"a":1,"list":[1,2]}`, `{"b":{"c":true},"list":[1]}`, []Change{
+			{Op: "remove", Path: "/a", A: json.RawMessage(`1`)},
+			{Op: "add", Path: "/b", B: json.RawMessage(`{"c":true}`)},
+			{Op: "remove", Path: "/list/1", A: json.RawMessage(`2`)},
+		}},
+		{"type", `{"a":[1]}`, `{"a":{"0":1}}`, []Change{
+			{Op: "replace", Path: "/a", A: json.RawMessage(`[1]`), B: json.RawMessage(`{"0":1}`)},
+		}},
+		{"pointer", `{"a/b~":1}`, `{}`, []Change{
+			{Op: "remove", Path: "/a~1b~0", A: json.RawMessage(`1`)},
+		}},
+		{"whole", `1`, `"1"`, []Change{
+			{Op: "replace", Path: "", A: json.RawMessage(`1`), B: json.RawMessage(`"1"`)},
+		}},
+	} {
+		got, err := Diff(json.RawMessage(tc.a), json.RawMessage(tc.b))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v\nwant %+v", tc.name, got, tc.want)
+		}
+	}
+	if _, err := Diff(json.RawMessage(`{}`), json.RawMessage(`{"a":`)); err == nil {
+		t.Error("diff of invalid JSON did not fail")
+	}
+}
@@ -0,0 +1,172 @@
+// Package event defines the event model shared by the API, storage and sinks.
+package event
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type Event struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"`
+	// Payload is any JSON value, kept byte for byte. Producers that still
+	// double-encode send a string, which is stored as a JSON string.
+	Payload json.RawMessage `json:"payload"`
+	// Tags are free-form labels for variants of a type, filterable via ?tag=.
+	Tags []string `json:"tags,omitempty"`
+	// Metadata holds service-side annotations (pipeline, enrichment) kept
+	// apart from the producer's payload.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// SchemaVersion is the producer schema version the payload follows, see
+	// config.SchemaConfig.
+	SchemaVersion string `json:"schema_version,omitempty"`
+	// CorrelationID groups the events of one flow, e.g. all those caused
+	// by a user request; it defaults to the trace or request ID of the
+	// ingest request. CausationID is the ID, in the producer's terms, of
+	// the message that directly caused this one.
+	CorrelationID string `json:"correlation_id,omitempty"`
+	CausationID   string `json:"causation_id,omitempty"`
+	// PartitionKey names the entity a state-style event describes, e.g. a
+	// device ID; compacted types keep only the newest event per type and
+	// key.
+	PartitionKey string `json:"partition_key,omitempty"`
+	// DeliverAt holds the event back from sinks until that time; it is
+	// stored and listed immediately.
+	DeliverAt *time.Time `json:"deliver_at,omitempty"`
+	// ExpiresAt hides the event from reads once it has passed, until the
+	// retention janitor deletes it, whatever the retention policy.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// DeletedAt is set while the event is in the trash, hidden from reads
+	// until it is restored or the retention janitor purges it. Stores
+	// ignore it on Add.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// TTLSeconds is accepted in requests instead of ExpiresAt, counted from
+	// receipt; it is never stored.
+	TTLSeconds int64 `json:"ttl_seconds,omitempty"`
+	// OccurredAt is when the producer says the event happened, by its own
+	// clock, as opposed to ReceivedAt, when the service stored it.
+	OccurredAt *time.Time `json:"occurred_at,omitempty"`
+	ReceivedAt time.Time  `json:"received_at"`
+	// DuplicateOf is set in responses instead of storing an event that
+	// repeats the given one (dedup mode).
+	DuplicateOf int64 `json:"duplicate_of,omitempty"`
+	// SampledOut is set in responses instead of storing an event a
+	// sampling rule dropped.
+	SampledOut bool `json:"sampled_out,omitempty"`
+}
+
+// Occurred returns OccurredAt, or ReceivedAt for events that came without
+// it.
+func (e *Event) Occurred() time.Time {
+	if e.OccurredAt != nil {
+		return *e.OccurredAt
+	}
+	return e.ReceivedAt
+}
+
+// Expired reports whether e has an ExpiresAt that is not after now.
+func (e *Event) Expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !e.ExpiresAt.After(now)
+}
+
+// Field returns the raw JSON of a top-level payload field. It reports false
+// when the payload is not an object or the field is absent.
+func (e *Event) Field(name string) (json.RawMessage, bool) {
+	p := bytes.TrimSpace(e.Payload)
+	if len(p) == 0 || p[0] != '{' {
+		return nil, false
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(p, &obj); err != nil {
+		return nil, false
+	}
+	v, ok := obj[name]
+	return v, ok
+}
+
+// ScalarString renders a scalar JSON value the way it is spelled in a query
+// string: strings unquoted, numbers, booleans and null verbatim. Objects and
+// arrays report false.
+func ScalarString(v json.RawMessage) (string, bool) {
+	v = bytes.TrimSpace(v)
+	if len(v) == 0 || v[0] == '{' || v[0] == '[' {
+		return "", false
+	}
+	if v[0] == '"' {
+		var s string
+		if err := json.Unmarshal(v, &s); err != nil {
+			return "", false
+		}
+		return s, true
+	}
+	return string(v), true
+}
+
+const MaxTags = 32
+
+var tagPattern = regexp.MustCompile(`^[A-Za-z0-9_.:/=\-]{1,64}$`)
+
+// NormalizeTags validates tags and removes duplicates, keeping first-seen order.
+func NormalizeTags(tags []string) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	seen := make(map[string]bool, len(tags))
+	out := make([]string, 0, len(tags))
+	for _, t := range tags {
+		if !tagPattern.MatchString(t) {
+			return nil, fmt.Errorf("invalid tag %q", t)
+		}
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	if len(out) > MaxTags {
+		return nil, fmt.Errorf("too many tags (max %d)", MaxTags)
+	}
+	return out, nil
+}
+
+func (e *Event) HasTag(tag string) bool {
+	for _, t := range e.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Namespaces nest by "/": type "acme/billing/invoice.paid" lies in the
+// namespaces "acme/billing" and "acme". Types without a slash are in none.
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9_.\-]+(/[A-Za-z0-9_.\-]+)*$`)
+
+// ValidateNamespace rejects empty segments, surrounding slashes and wildcards.
+func ValidateNamespace(ns string) error {
+	if !namespacePattern.MatchString(ns) {
+		return fmt.Errorf("invalid namespace %q", ns)
+	}
+	return nil
+}
+
+// InNamespace reports whether typ lies in the subtree ns.
+func InNamespace(typ, ns string) bool {
+	return strings.HasPrefix(typ, ns+"/")
+}
+
+// TypeSegment keeps the characters valid in a segment of a type or
+// namespace, replacing the others with "_", for types built from names
+// sent by other systems.
+func TypeSegment(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
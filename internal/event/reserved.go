@@ -0,0 +1,25 @@
+package event
+
+import "strings"
+
+// Reserved reports whether typ starts with one of the reserved prefixes,
+// itself or in a namespace segment: with _system., both _system.start and
+// acme/_system.start are reserved.
+func Reserved(prefixes []string, typ string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(typ, p) || strings.Contains(typ, "/"+p) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReservedPatterns returns the type patterns matching exactly the types
+// Reserved reports.
+func ReservedPatterns(prefixes []string) []string {
+	out := make([]string, 0, 2*len(prefixes))
+	for _, p := range prefixes {
+		out = append(out, p+"*", "*/"+p+"*")
+	}
+	return out
+}
@@ -0,0 +1,59 @@
+package event
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// ReadStream calls fn with each event read from r, either NDJSON or a
+// single JSON array of events, as dumps and exports are written. It stops
+// at the first error fn returns.
+func ReadStream(r io.Reader, fn func(json.RawMessage) error) error {
+	br := bufio.NewReader(r)
+	first, err := peekNonSpace(br)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(br)
+	if first == '[' {
+		var list []json.RawMessage
+		if err := dec.Decode(&list); err != nil {
+			return err
+		}
+		for _, ev := range list {
+			if err := fn(ev); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for {
+		var ev json.RawMessage
+		if err := dec.Decode(&ev); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+}
+
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		if len(bytes.TrimSpace(b)) > 0 {
+			return b[0], nil
+		}
+		_, _ = br.ReadByte()
+	}
+}
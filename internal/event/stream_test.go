@@ -0,0 +1,39 @@
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestReadStream reads NDJSON and JSON arrays alike, and stops at the
+// first error.
+func TestReadStream(t *testing.T) {
+	stop := errors.New("stop")
+	for _, tc := range []struct {
+		name, in string
+		stopAt   int
+		want     []string
+		err      bool
+	}{
+		{"ndjson", "{\"id\":1}\n\n{\"id\":2}\n", 0, []string{`{"id":1}`, `{"id":2}`}, false},
+		{"array", "  \n[{\"id\":1}, {\"id\":2}]", 0, []string{`{"id":1}`, `{"id":2}`}, false},
+		{"empty", " \n", 0, nil, false},
+		{"truncated", "{\"id\":1}\n{\"id\":", 0, []string{`{"id":1}`}, true},
+		{"stopped", "{\"id\":1}\n{\"id\":2}\n", 1, []string{`{"id":1}`}, true},
+	} {
+		var got []string
+		err := ReadStream(strings.NewReader(tc.in), func(ev json.RawMessage) error {
+			got = append(got, string(ev))
+			if len(got) == tc.stopAt {
+				return stop
+			}
+			return nil
+		})
+		if (err != nil) != tc.err || !slices.Equal(got, tc.want) {
+			t.Errorf("%s: got %q, %v", tc.name, got, err)
+		}
+	}
+}
@@ -0,0 +1,503 @@
+// Package expr evaluates filter expressions over events, for routing rules,
+// sampling rules and subscriptions that need more than type patterns and
+// field equality:
+//
+//	payload.amount > 1000 && payload.region == "eu"
+//	type startsWith "order." && !("test" in tags)
+//	has(payload.coupon) || metadata.country in ["FR", "DE"]
+//
+// Names start from the event: id, type, tags, metadata, payload,
+// partition_key, correlation_id, causation_id and schema_version. Fields
+// are reached with .name or ["name"], list items with [index]. Operators
+// are, loosest first, ||, &&, the comparisons (== != < <= > >= in matches
+// contains startsWith endsWith), + -, * / %, and the unary ! and -.
+// Functions are has, len, lower and upper.
+//
+// Expressions are checked when compiled: unknown names, operands of the
+// wrong type and invalid regular expressions are errors then, while the
+// types of payload fields are known only at evaluation. Numbers are 64-bit
+// floats. A comparison with a missing field or null is false, except ==
+// and != with null; other type mismatches fail the evaluation, which then
+// does not match.
+package expr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+var (
+	evaluations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "expr_evaluations_total", Help: "Filter expression evaluations by expression (route:<name>, sampling:<index>, subscription) and result (true, false, error)"},
+		[]string{"expr", "result"},
+	)
+	evalDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "expr_evaluation_duration_seconds",
+			Help:    "Filter expression evaluation latency, payload decoding included, by expression",
+			Buckets: []float64{1e-6, 5e-6, 25e-6, 1e-4, 5e-4, 25e-4, 0.01},
+		},
+		[]string{"expr"},
+	)
+)
+
+// Collectors returns the expression metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{evaluations, evalDuration}
+}
+
+// Program is a compiled expression. A nil *Program matches every event.
+type Program struct {
+	src  string
+	root node
+	// the metric series of the expression's name
+	yes, no, failed prometheus.Counter
+	duration        prometheus.Observer
+}
+
+// Check compiles src without keeping it, for validating configuration.
+func Check(src string) error {
+	_, err := compile(src)
+	return err
+}
+
+func compile(src string) (node, error) {
+	root, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	k, err := check(root)
+	if err != nil {
+		return nil, err
+	}
+	if k != boolKind && k != anyKind {
+		return nil, errorAt(0, "want a boolean expression, got a %s", k)
+	}
+	return root, nil
+}
+
+// Compile compiles src, counting its evaluations under name.
+func Compile(name, src string) (*Program, error) {
+	root, err := compile(src)
+	if err != nil {
+		return nil, err
+	}
+	return &Program{
+		src:      src,
+		root:     root,
+		yes:      evaluations.WithLabelValues(name, "true"),
+		no:       evaluations.WithLabelValues(name, "false"),
+		failed:   evaluations.WithLabelValues(name, "error"),
+		duration: evalDuration.WithLabelValues(name),
+	}, nil
+}
+
+// String returns the source of p.
+func (p *Program) String() string {
+	if p == nil {
+		return ""
+	}
+	return p.src
+}
+
+// Env is an event as seen by expressions. Its payload is decoded once, on
+// first use, so several programs can share it.
+type Env struct {
+	e       *event.Event
+	payload any
+	decoded bool
+}
+
+// NewEnv returns the environment of e, which must not change while in use.
+func NewEnv(e *event.Event) *Env {
+	return &Env{e: e}
+}
+
+func (env *Env) decodedPayload() any {
+	if !env.decoded {
+		env.decoded = true
+		if err := json.Unmarshal(env.e.Payload, &env.payload); err != nil {
+			env.payload = nil
+		}
+	}
+	return env.payload
+}
+
+// Eval evaluates p in env.
+func (p *Program) Eval(env *Env) (bool, error) {
+	if p == nil {
+		return true, nil
+	}
+	start := time.Now()
+	v, err := eval(p.root, env)
+	p.duration.Observe(time.Since(start).Seconds())
+	if err == nil {
+		b, ok := v.(bool)
+		if !ok {
+			err = fmt.Errorf("expression: got a %s, want a boolean", typeName(v))
+		} else if b {
+			p.yes.Inc()
+			return true, nil
+		} else {
+			p.no.Inc()
+			return false, nil
+		}
+	}
+	p.failed.Inc()
+	return false, err
+}
+
+// Match reports whether p holds in env; an evaluation that fails does not
+// match.
+func (p *Program) Match(env *Env) bool {
+	ok, _ := p.Eval(env)
+	return ok
+}
+
+// errMissing marks a field that is not there, for has; everything else sees
+// null.
+var errMissing = errors.New("missing")
+
+func eval(n node, env *Env) (any, error) {
+	switch n := n.(type) {
+	case *literal:
+		return n.v, nil
+	case *ident:
+		return root(n.name, env), nil
+	case *member:
+		v, err := lookup(n, env)
+		if errors.Is(err, errMissing) {
+			return nil, nil
+		}
+		return v, err
+	case *list:
+		out := make([]any, len(n.elems))
+		for i, e := range n.elems {
+			v, err := eval(e, env)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+	case *unary:
+		v, err := eval(n.x, env)
+		if err != nil {
+			return nil, err
+		}
+		if n.op == "!" {
+			b, ok := v.(bool)
+			if !ok {
+				return nil, typeError(n.at, "!", v)
+			}
+			return !b, nil
+		}
+		f, ok := v.(float64)
+		if !ok {
+			return nil, typeError(n.at, "-", v)
+		}
+		return -f, nil
+	case *call:
+		return evalCall(n, env)
+	case *binary:
+		return evalBinary(n, env)
+	}
+	return nil, fmt.Errorf("expression: unexpected node")
+}
+
+func root(name string, env *Env) any {
+	e := env.e
+	switch name {
+	case "id":
+		return float64(e.ID)
+	case "type":
+		return e.Type
+	case "tags":
+		out := make([]any, len(e.Tags))
+		for i, t := range e.Tags {
+			out[i] = t
+		}
+		return out
+	case "metadata":
+		out := make(map[string]any, len(e.Metadata))
+		for k, v := range e.Metadata {
+			out[k] = v
+		}
+		return out
+	case "payload":
+		return env.decodedPayload()
+	case "partition_key":
+		return e.PartitionKey
+	case "correlation_id":
+		return e.CorrelationID
+	case "causation_id":
+		return e.CausationID
+	case "schema_version":
+		return e.SchemaVersion
+	}
+	return nil
+}
+
+// lookup evaluates a member, returning errMissing when the field or item
+// is not there.
+func lookup(n *member, env *Env) (any, error) {
+	var x any
+	var err error
+	if m, ok := n.x.(*member); ok {
+		if x, err = lookup(m, env); err != nil {
+			return nil, err
+		}
+	} else if x, err = eval(n.x, env); err != nil {
+		return nil, err
+	}
+	key, err := eval(n.key, env)
+	if err != nil {
+		return nil, err
+	}
+	switch x := x.(type) {
+	case map[string]any:
+		k, ok := key.(string)
+		if !ok {
+			return nil, errMissing
+		}
+		v, ok := x[k]
+		if !ok {
+			return nil, errMissing
+		}
+		return v, nil
+	case []any:
+		f, ok := key.(float64)
+		if !ok || f != math.Trunc(f) || f < 0 || int(f) >= len(x) {
+			return nil, errMissing
+		}
+		return x[int(f)], nil
+	}
+	return nil, errMissing
+}
+
+func evalCall(n *call, env *Env) (any, error) {
+	if n.fn == "has" {
+		_, err := lookup(n.args[0].(*member), env)
+		if errors.Is(err, errMissing) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	v, err := eval(n.args[0], env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.fn {
+	case "len":
+		switch v := v.(type) {
+		case string:
+			return float64(len([]rune(v))), nil
+		case []any:
+			return float64(len(v)), nil
+		case map[string]any:
+			return float64(len(v)), nil
+		}
+	case "lower", "upper":
+		if s, ok := v.(string); ok {
+			if n.fn == "lower" {
+				return strings.ToLower(s), nil
+			}
+			return strings.ToUpper(s), nil
+		}
+	}
+	return nil, typeError(n.at, n.fn, v)
+}
+
+func evalBinary(n *binary, env *Env) (any, error) {
+	l, err := eval(n.l, env)
+	if err != nil {
+		return nil, err
+	}
+	// && and || do not evaluate their right side when the left decides
+	if n.op == "&&" || n.op == "||" {
+		b, ok := l.(bool)
+		if !ok {
+			return nil, typeError(n.at, n.op, l)
+		}
+		if b == (n.op == "||") {
+			return b, nil
+		}
+		r, err := eval(n.r, env)
+		if err != nil {
+			return nil, err
+		}
+		if b, ok = r.(bool); !ok {
+			return nil, typeError(n.at, n.op, r)
+		}
+		return b, nil
+	}
+	r, err := eval(n.r, env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return equal(l, r), nil
+	case "!=":
+		return !equal(l, r), nil
+	case "in":
+		switch r := r.(type) {
+		case []any:
+			return slices.ContainsFunc(r, func(v any) bool { return equal(l, v) }), nil
+		case map[string]any:
+			k, ok := l.(string)
+			if !ok {
+				return false, nil
+			}
+			_, ok = r[k]
+			return ok, nil
+		case nil:
+			return false, nil
+		}
+		return nil, typeError(n.at, n.op, r)
+	}
+	if l == nil || r == nil {
+		// a missing field compares as false, and concatenates or adds as
+		// nothing can
+		switch n.op {
+		case "<", "<=", ">", ">=", "matches", "contains", "startsWith", "endsWith":
+			return false, nil
+		}
+		return nil, fmt.Errorf("expression: column %d: %s of null", n.at+1, n.op)
+	}
+	switch n.op {
+	case "<", "<=", ">", ">=":
+		c, ok := compare(l, r)
+		if !ok {
+			return nil, fmt.Errorf("expression: column %d: %s compares a %s with a %s", n.at+1, n.op, typeName(l), typeName(r))
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	case "matches", "contains", "startsWith", "endsWith":
+		ls, lok := l.(string)
+		rs, rok := r.(string)
+		if !lok || !rok {
+			return nil, fmt.Errorf("expression: column %d: %s needs strings, got a %s and a %s", n.at+1, n.op, typeName(l), typeName(r))
+		}
+		switch n.op {
+		case "matches":
+			return n.re.MatchString(ls), nil
+		case "contains":
+			return strings.Contains(ls, rs), nil
+		case "startsWith":
+			return strings.HasPrefix(ls, rs), nil
+		}
+		return strings.HasSuffix(ls, rs), nil
+	}
+	if ls, ok := l.(string); ok && n.op == "+" {
+		rs, ok := r.(string)
+		if !ok {
+			return nil, fmt.Errorf("expression: column %d: + of a string and a %s", n.at+1, typeName(r))
+		}
+		return ls + rs, nil
+	}
+	lf, lok := l.(float64)
+	rf, rok := r.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("expression: column %d: %s needs numbers, got a %s and a %s", n.at+1, n.op, typeName(l), typeName(r))
+	}
+	switch n.op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	}
+	if rf == 0 {
+		return nil, fmt.Errorf("expression: column %d: division by zero", n.at+1)
+	}
+	if n.op == "/" {
+		return lf / rf, nil
+	}
+	return math.Mod(lf, rf), nil
+}
+
+// equal compares decoded JSON values, lists and maps deeply.
+func equal(a, b any) bool {
+	switch a := a.(type) {
+	case []any:
+		b, ok := b.([]any)
+		return ok && slices.EqualFunc(a, b, equal)
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+	switch b.(type) {
+	case []any, map[string]any:
+		return false
+	}
+	return a == b
+}
+
+// compare orders two numbers or two strings.
+func compare(a, b any) (int, bool) {
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	}
+	return 0, false
+}
+
+func typeError(at int, op string, v any) error {
+	return fmt.Errorf("expression: column %d: %s does not take a %s", at+1, op, typeName(v))
+}
+
+func typeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "list"
+	case map[string]any:
+		return "map"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,94 @@
+package expr
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// TestEval evaluates expressions against one event.
+func TestEval(t *testing.T) {
+	e := &event.Event{
+		ID:           7,
+		Type:         "order.paid",
+		Tags:         []string{"web", "eu"},
+		Metadata:     map[string]string{"country": "FR"},
+		PartitionKey: "order-123",
+		Payload:      json.RawMessage(`{"amount":1500.5,"region":"eu","items":[{"sku":"a-1"},{"sku":"b-2"}],"coupon":null,"note":"Gift"}`),
+	}
+	for src, want := range map[string]bool{
+		`payload.amount > 1000 && payload.region == "eu"`: true,
+		`payload.amount > 1000 && payload.region == 'us'`: false,
+		`type startsWith "order." && !("test" in tags)`:   true,
+		`metadata.country in ["FR", "DE"]`:                true,
+		`metadata["country"] == "FR" || id == 0`:          true,
+		`payload.items[1].sku == "b-2"`:                   true,
+		`len(payload.items) == 2 && len(tags) == 2`:       true,
+		`has(payload.coupon) && payload.coupon == null`:   true,
+		`has(payload.missing)`:                            false,
+		`has(payload.items[5])`:                           false,
+		`payload.missing > 3`:                             false,
+		`payload.missing == null`:                         true,
+		`lower(payload.note) == "gift"`:                   true,
+		`payload.note matches "^G.*t$"`:                   true,
+		`payload.amount * 2 - 1 == 3000`:                  true,
+		`payload.amount % 1000 > 500`:                     true,
+		`partition_key endsWith "123"`:                    true,
+		`"eu" in tags && "region" in payload`:             true,
+		`-payload.amount < 0`:                             true,
+	} {
+		p, err := Compile("test", src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		got, err := p.Eval(NewEnv(e))
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+		}
+		if got != want {
+			t.Errorf("%s = %v, want %v", src, got, want)
+		}
+	}
+
+	// a type mismatch found only at evaluation fails it
+	p, err := Compile("test", `payload.region > 3`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := p.Eval(NewEnv(e)); ok || err == nil {
+		t.Errorf("string > number: %v, %v", ok, err)
+	}
+	var none *Program
+	if !none.Match(NewEnv(e)) {
+		t.Error("a nil program did not match")
+	}
+}
+
+// TestCheck rejects what can never evaluate when compiling.
+func TestCheck(t *testing.T) {
+	for _, src := range []string{
+		``,
+		`payload.amount >`,
+		`amount > 3`,
+		`type > 3`,
+		`id == "7"`,
+		`type.name == "x"`,
+		`payload.x && 3`,
+		`payload.a < payload.b < payload.c`,
+		`payload.x matches "("`,
+		`payload.x matches payload.y`,
+		`size(payload)`,
+		`has(type)`,
+		`payload.amount + 1`,
+		`"unterminated`,
+		`payload.x == 1 @`,
+		strings.Repeat("(", 100) + "true" + strings.Repeat(")", 100),
+	} {
+		if err := Check(src); err == nil {
+			t.Errorf("%q compiled", src)
+		}
+	}
+}
@@ -0,0 +1,601 @@
+package expr
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// MaxLength caps the source of an expression.
+	MaxLength = 4096
+	// maxDepth caps the nesting of an expression, which the parser and the
+	// evaluator follow by recursion.
+	maxDepth = 64
+)
+
+// kind is the static type of a node; anyKind is known only at evaluation,
+// like payload fields.
+type kind int
+
+const (
+	anyKind kind = iota
+	boolKind
+	numKind
+	stringKind
+	listKind
+	mapKind
+	nullKind
+)
+
+func (k kind) String() string {
+	return [...]string{"any", "bool", "number", "string", "list", "map", "null"}[k]
+}
+
+// roots are the names an expression starts from, with their static types.
+var roots = map[string]kind{
+	"id":             numKind,
+	"type":           stringKind,
+	"tags":           listKind,
+	"metadata":       mapKind,
+	"payload":        anyKind,
+	"partition_key":  stringKind,
+	"correlation_id": stringKind,
+	"causation_id":   stringKind,
+	"schema_version": stringKind,
+}
+
+// functions are the callable names with their arity and result type.
+var functions = map[string]struct {
+	arity  int
+	result kind
+}{
+	"has":   {1, boolKind},
+	"len":   {1, numKind},
+	"lower": {1, stringKind},
+	"upper": {1, stringKind},
+}
+
+type node interface{ pos() int }
+
+type (
+	literal struct {
+		at int
+		v  any
+	}
+	ident struct {
+		at   int
+		name string
+	}
+	// member is x.name or x[key].
+	member struct {
+		at  int
+		x   node
+		key node
+	}
+	unary struct {
+		at int
+		op string
+		x  node
+	}
+	binary struct {
+		at   int
+		op   string
+		l, r node
+		re   *regexp.Regexp // the compiled right side of matches
+	}
+	list struct {
+		at    int
+		elems []node
+	}
+	call struct {
+		at   int
+		fn   string
+		args []node
+	}
+)
+
+func (n *literal) pos() int { return n.at }
+func (n *ident) pos() int   { return n.at }
+func (n *member) pos() int  { return n.at }
+func (n *unary) pos() int   { return n.at }
+func (n *binary) pos() int  { return n.at }
+func (n *list) pos() int    { return n.at }
+func (n *call) pos() int    { return n.at }
+
+// Error is a compile error at a byte offset of the source.
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("expression: column %d: %s", e.Pos+1, e.Msg)
+}
+
+func errorAt(pos int, format string, args ...any) error {
+	return &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// tokens
+
+type tokenKind int
+
+const (
+	eof tokenKind = iota
+	name
+	number
+	str
+	punct
+)
+
+type token struct {
+	kind tokenKind
+	text string // punctuation, name, number, or decoded string
+	at   int
+}
+
+func lex(src string) ([]token, error) {
+	var out []token
+	for i := 0; i < len(src); {
+		r, n := utf8.DecodeRuneInString(src[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += n
+		case r == '_' || unicode.IsLetter(r):
+			j := i
+			for j < len(src) {
+				r, n := utf8.DecodeRuneInString(src[j:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				j += n
+			}
+			out = append(out, token{name, src[i:j], i})
+			i = j
+		case r >= '0' && r <= '9':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.' || src[j] == 'e' || src[j] == 'E' ||
+				(src[j] == '-' || src[j] == '+') && (src[j-1] == 'e' || src[j-1] == 'E')) {
+				j++
+			}
+			if _, err := strconv.ParseFloat(src[i:j], 64); err != nil {
+				return nil, errorAt(i, "invalid number %q", src[i:j])
+			}
+			out = append(out, token{number, src[i:j], i})
+			i = j
+		case r == '"' || r == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != byte(r) {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, errorAt(i, "unterminated string")
+			}
+			raw := src[i+1 : j]
+			if r == '\'' {
+				// single quotes take the escapes of double ones
+				raw = strings.ReplaceAll(strings.ReplaceAll(raw, `\'`, `'`), `"`, `\"`)
+			}
+			s, err := strconv.Unquote(`"` + raw + `"`)
+			if err != nil {
+				return nil, errorAt(i, "invalid string %s", src[i:j+1])
+			}
+			out = append(out, token{str, s, i})
+			i = j + 1
+		default:
+			op := ""
+			for _, p := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "%", "(", ")", "[", "]", ".", ","} {
+				if strings.HasPrefix(src[i:], p) {
+					op = p
+					break
+				}
+			}
+			if op == "" {
+				return nil, errorAt(i, "unexpected %q", r)
+			}
+			out = append(out, token{punct, op, i})
+			i += len(op)
+		}
+	}
+	return append(out, token{eof, "", len(src)}), nil
+}
+
+// parser
+
+type parser struct {
+	toks  []token
+	i     int
+	depth int
+}
+
+// precedence of the binary operators, loosest first.
+var precedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"in": 3, "matches": 3, "contains": 3, "startsWith": 3, "endsWith": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5,
+}
+
+func parse(src string) (node, error) {
+	if len(src) > MaxLength {
+		return nil, errorAt(0, "longer than %d bytes", MaxLength)
+	}
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	n, err := p.expr(1)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != eof {
+		return nil, errorAt(t.at, "unexpected %q", t.text)
+	}
+	return n, nil
+}
+
+func (p *parser) peek() token { return p.toks[p.i] }
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != eof {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) expect(text string) error {
+	if t := p.next(); t.kind != punct || t.text != text {
+		if t.kind == eof {
+			return errorAt(t.at, "want %q, got the end", text)
+		}
+		return errorAt(t.at, "want %q, got %q", text, t.text)
+	}
+	return nil
+}
+
+// binaryOp returns the operator at the current token, if any.
+func (p *parser) binaryOp() (string, int) {
+	t := p.peek()
+	if t.kind != punct && t.kind != name {
+		return "", 0
+	}
+	prec, ok := precedence[t.text]
+	if !ok {
+		return "", 0
+	}
+	return t.text, prec
+}
+
+// expr parses operators binding at least as tightly as min. Comparisons
+// do not chain.
+func (p *parser) expr(min int) (node, error) {
+	if p.depth++; p.depth > maxDepth {
+		return nil, errorAt(p.peek().at, "nested deeper than %d", maxDepth)
+	}
+	defer func() { p.depth-- }()
+	l, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, prec := p.binaryOp()
+		if op == "" || prec < min {
+			return l, nil
+		}
+		t := p.next()
+		r, err := p.expr(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		if prec == 3 {
+			if next, nextPrec := p.binaryOp(); nextPrec == 3 {
+				return nil, errorAt(p.peek().at, "comparisons do not chain, use && or parentheses before %q", next)
+			}
+		}
+		l = &binary{at: t.at, op: op, l: l, r: r}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	if t := p.peek(); t.kind == punct && (t.text == "!" || t.text == "-") {
+		p.next()
+		if p.depth++; p.depth > maxDepth {
+			return nil, errorAt(t.at, "nested deeper than %d", maxDepth)
+		}
+		defer func() { p.depth-- }()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{at: t.at, op: t.text, x: x}, nil
+	}
+	return p.postfix()
+}
+
+func (p *parser) postfix() (node, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == punct && t.text == ".":
+			p.next()
+			f := p.next()
+			if f.kind != name {
+				return nil, errorAt(f.at, "want a field name after .")
+			}
+			x = &member{at: t.at, x: x, key: &literal{at: f.at, v: f.text}}
+		case t.kind == punct && t.text == "[":
+			p.next()
+			key, err := p.expr(1)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &member{at: t.at, x: x, key: key}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case number:
+		f, _ := strconv.ParseFloat(t.text, 64)
+		return &literal{at: t.at, v: f}, nil
+	case str:
+		return &literal{at: t.at, v: t.text}, nil
+	case name:
+		switch t.text {
+		case "true", "false":
+			return &literal{at: t.at, v: t.text == "true"}, nil
+		case "null":
+			return &literal{at: t.at, v: nil}, nil
+		}
+		if p.peek().kind == punct && p.peek().text == "(" {
+			p.next()
+			c := &call{at: t.at, fn: t.text}
+			for p.peek().text != ")" || p.peek().kind != punct {
+				arg, err := p.expr(1)
+				if err != nil {
+					return nil, err
+				}
+				c.args = append(c.args, arg)
+				if p.peek().kind != punct || p.peek().text != "," {
+					break
+				}
+				p.next()
+			}
+			return c, p.expect(")")
+		}
+		return &ident{at: t.at, name: t.text}, nil
+	case punct:
+		switch t.text {
+		case "(":
+			x, err := p.expr(1)
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		case "[":
+			l := &list{at: t.at}
+			for p.peek().text != "]" || p.peek().kind != punct {
+				elem, err := p.expr(1)
+				if err != nil {
+					return nil, err
+				}
+				l.elems = append(l.elems, elem)
+				if p.peek().kind != punct || p.peek().text != "," {
+					break
+				}
+				p.next()
+			}
+			return l, p.expect("]")
+		}
+	case eof:
+		return nil, errorAt(t.at, "unexpected end")
+	}
+	return nil, errorAt(t.at, "unexpected %q", t.text)
+}
+
+// check resolves the names of n and returns its static type, rejecting
+// what can never evaluate: unknown names, operands of the wrong type and
+// invalid regular expressions.
+func check(n node) (kind, error) {
+	switch n := n.(type) {
+	case *literal:
+		switch n.v.(type) {
+		case bool:
+			return boolKind, nil
+		case float64:
+			return numKind, nil
+		case string:
+			return stringKind, nil
+		}
+		return nullKind, nil
+	case *ident:
+		k, ok := roots[n.name]
+		if !ok {
+			return 0, errorAt(n.at, "unknown name %q", n.name)
+		}
+		return k, nil
+	case *member:
+		x, err := check(n.x)
+		if err != nil {
+			return 0, err
+		}
+		key, err := check(n.key)
+		if err != nil {
+			return 0, err
+		}
+		switch x {
+		case mapKind:
+			if key != stringKind && key != anyKind {
+				return 0, errorAt(n.key.pos(), "a map key is a string, not a %s", key)
+			}
+			// metadata values are strings, or null when missing
+			return anyKind, nil
+		case listKind:
+			if key != numKind && key != anyKind {
+				return 0, errorAt(n.key.pos(), "a list index is a number, not a %s", key)
+			}
+			return anyKind, nil
+		case anyKind:
+			return anyKind, nil
+		}
+		return 0, errorAt(n.at, "a %s has no fields", x)
+	case *unary:
+		x, err := check(n.x)
+		if err != nil {
+			return 0, err
+		}
+		want := boolKind
+		if n.op == "-" {
+			want = numKind
+		}
+		if x != want && x != anyKind {
+			return 0, errorAt(n.at, "%s needs a %s, not a %s", n.op, want, x)
+		}
+		return want, nil
+	case *list:
+		for _, e := range n.elems {
+			if _, err := check(e); err != nil {
+				return 0, err
+			}
+		}
+		return listKind, nil
+	case *call:
+		fn, ok := functions[n.fn]
+		if !ok {
+			return 0, errorAt(n.at, "unknown function %q", n.fn)
+		}
+		if len(n.args) != fn.arity {
+			return 0, errorAt(n.at, "%s takes %d argument(s), got %d", n.fn, fn.arity, len(n.args))
+		}
+		arg, err := check(n.args[0])
+		if err != nil {
+			return 0, err
+		}
+		switch n.fn {
+		case "has":
+			if _, ok := n.args[0].(*member); !ok {
+				return 0, errorAt(n.at, "has takes a field, like has(payload.amount)")
+			}
+		case "len":
+			if arg != stringKind && arg != listKind && arg != mapKind && arg != anyKind {
+				return 0, errorAt(n.at, "len needs a string, list or map, not a %s", arg)
+			}
+		default:
+			if arg != stringKind && arg != anyKind {
+				return 0, errorAt(n.at, "%s needs a string, not a %s", n.fn, arg)
+			}
+		}
+		return fn.result, nil
+	case *binary:
+		return checkBinary(n)
+	}
+	return 0, errorAt(n.pos(), "unexpected node")
+}
+
+func checkBinary(n *binary) (kind, error) {
+	l, err := check(n.l)
+	if err != nil {
+		return 0, err
+	}
+	r, err := check(n.r)
+	if err != nil {
+		return 0, err
+	}
+	known := l != anyKind && r != anyKind
+	needs := func(k kind, side kind, at int) error {
+		if side != k && side != anyKind {
+			return errorAt(at, "%s needs a %s, not a %s", n.op, k, side)
+		}
+		return nil
+	}
+	switch n.op {
+	case "&&", "||":
+		if err := needs(boolKind, l, n.l.pos()); err != nil {
+			return 0, err
+		}
+		return boolKind, needs(boolKind, r, n.r.pos())
+	case "==", "!=":
+		if known && l != r && l != nullKind && r != nullKind {
+			return 0, errorAt(n.at, "%s compares a %s with a %s, never equal", n.op, l, r)
+		}
+		return boolKind, nil
+	case "<", "<=", ">", ">=":
+		if known && (l != r || (l != numKind && l != stringKind)) {
+			return 0, errorAt(n.at, "%s compares numbers or strings, not a %s with a %s", n.op, l, r)
+		}
+		return boolKind, nil
+	case "in":
+		if r != listKind && r != mapKind && r != anyKind {
+			return 0, errorAt(n.r.pos(), "in needs a list or map, not a %s", r)
+		}
+		return boolKind, nil
+	case "contains", "startsWith", "endsWith":
+		if err := needs(stringKind, l, n.l.pos()); err != nil {
+			return 0, err
+		}
+		return boolKind, needs(stringKind, r, n.r.pos())
+	case "matches":
+		if err := needs(stringKind, l, n.l.pos()); err != nil {
+			return 0, err
+		}
+		lit, ok := n.r.(*literal)
+		s, isString := lit.valueString()
+		if !ok || !isString {
+			return 0, errorAt(n.r.pos(), "matches takes a string literal")
+		}
+		if n.re, err = regexp.Compile(s); err != nil {
+			return 0, errorAt(n.r.pos(), "invalid regular expression: %v", err)
+		}
+		return boolKind, nil
+	case "+":
+		if l == stringKind || r == stringKind {
+			if err := needs(stringKind, l, n.l.pos()); err != nil {
+				return 0, err
+			}
+			return stringKind, needs(stringKind, r, n.r.pos())
+		}
+		if l == numKind || r == numKind {
+			if err := needs(numKind, l, n.l.pos()); err != nil {
+				return 0, err
+			}
+			return numKind, needs(numKind, r, n.r.pos())
+		}
+		return anyKind, nil
+	default: // - * / %
+		if err := needs(numKind, l, n.l.pos()); err != nil {
+			return 0, err
+		}
+		return numKind, needs(numKind, r, n.r.pos())
+	}
+}
+
+// valueString returns the value of a string literal; it is safe on nil.
+func (n *literal) valueString() (string, bool) {
+	if n == nil {
+		return "", false
+	}
+	s, ok := n.v.(string)
+	return s, ok
+}
@@ -0,0 +1,325 @@
+// Package filetail feeds the lines that legacy applications write to local
+// files into the ingest pipeline: log files being appended to, or NDJSON
+// files dropped into a directory. Files are read from the offset saved in a
+// checkpoint file, so a restart resumes where the last run stopped.
+//
+// Delivery is at least once: lines read after the last checkpoint are read
+// again after a crash. A file replaced under its path (by rotation) or
+// truncated is read again from its start; lines written to a rotated file
+// after it was last read are lost unless its new name matches a path too.
+package filetail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+var (
+	linesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "file_source_lines_total", Help: "Lines read by the file source by result (accepted, invalid, rejected)"},
+		[]string{"result"},
+	)
+	filesTailed = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "file_source_files", Help: "Files matched by the file source paths"},
+	)
+)
+
+// Collectors returns the file source metrics for registration by the
+// caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{linesTotal, filesTailed}
+}
+
+// Handler ingests the event of a line. Errors wrapped by Reject are final
+// and the line is skipped; on any other error the file is read again from
+// that line later.
+type Handler func(event.Event) error
+
+type rejectError struct{ err error }
+
+func (e rejectError) Error() string { return e.err.Error() }
+func (e rejectError) Unwrap() error { return e.err }
+
+// Reject marks err as final: the line is not worth reading again.
+func Reject(err error) error { return rejectError{err} }
+
+// position is how far a file has been read. ID tells a file replaced under
+// the same path apart, where the platform has inode numbers.
+type position struct {
+	ID     uint64 `json:"id,omitempty"`
+	Offset int64  `json:"offset"`
+}
+
+// Tailer reads the files matching its paths whenever the OS reports a
+// change in their directories, and every poll interval.
+type Tailer struct {
+	cfg    config.FileSourceConfig
+	handle Handler
+	wake   <-chan struct{}
+	watch  io.Closer
+
+	// offsets is only used by the run goroutine; saved is what the
+	// checkpoint holds, nil before it is first written
+	offsets map[string]position
+	saved   map[string]position
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// Start loads the checkpoint and tails cfg.Paths in the background.
+func Start(cfg config.FileSourceConfig, handle Handler) (*Tailer, error) {
+	if cfg.Format == "" {
+		cfg.Format = "ndjson"
+	}
+	if cfg.Checkpoint == "" {
+		cfg.Checkpoint = "file_source_offsets.json"
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.MaxLineBytes <= 0 {
+		cfg.MaxLineBytes = 64 << 10
+	}
+	t := &Tailer{cfg: cfg, handle: handle, offsets: map[string]position{}, stop: make(chan struct{}), done: make(chan struct{})}
+	raw, err := os.ReadFile(cfg.Checkpoint)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(raw, &t.offsets); err != nil {
+			return nil, err
+		}
+	}
+	if raw != nil {
+		t.saved = maps.Clone(t.offsets)
+	}
+	dirs := map[string]bool{}
+	for _, p := range cfg.Paths {
+		dirs[filepath.Dir(p)] = true
+	}
+	// without notifications the poll interval still picks changes up
+	if t.wake, t.watch, err = watch(dirs); err != nil {
+		log.Warn().Err(err).Msg("file source: no change notifications, polling only")
+	}
+	// files already there at the first start are skipped with from_end
+	go t.run(raw == nil)
+	return t, nil
+}
+
+// Close stops tailing once the line being handled is done, and saves the
+// checkpoint.
+func (t *Tailer) Close() {
+	t.once.Do(func() {
+		close(t.stop)
+		if t.watch != nil {
+			_ = t.watch.Close()
+		}
+	})
+	<-t.done
+}
+
+func (t *Tailer) run(first bool) {
+	defer close(t.done)
+	ticker := time.NewTicker(t.cfg.PollInterval)
+	defer ticker.Stop()
+	t.scan(first)
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		case <-t.wake:
+		}
+		t.scan(false)
+	}
+}
+
+// scan reads every file matching the paths to its end and saves the
+// offsets. With skip, files not in the checkpoint start at their end.
+func (t *Tailer) scan(skip bool) {
+	matched := map[string]bool{}
+	for _, p := range t.cfg.Paths {
+		// the patterns were validated, so Glob cannot fail
+		files, _ := filepath.Glob(p)
+		for _, f := range files {
+			matched[f] = true
+		}
+	}
+	filesTailed.Set(float64(len(matched)))
+	for path := range matched {
+		if t.stopped() {
+			break
+		}
+		if err := t.read(path, skip && t.cfg.FromEnd); err != nil && !errors.Is(err, errRetry) {
+			log.Warn().Err(err).Str("path", path).Msg("file source: read file")
+		}
+	}
+	// files gone for good are forgotten; those about to be renamed back
+	// start over, like any replaced file
+	for path := range t.offsets {
+		if !matched[path] {
+			delete(t.offsets, path)
+		}
+	}
+	if t.saved == nil || !maps.Equal(t.offsets, t.saved) {
+		if err := t.save(); err != nil {
+			log.Error().Err(err).Str("checkpoint", t.cfg.Checkpoint).Msg("file source: save offsets")
+			return
+		}
+		t.saved = maps.Clone(t.offsets)
+	}
+}
+
+// errRetry stops reading a file at a line the handler could not take now.
+var errRetry = errors.New("retry later")
+
+// read handles the complete lines of path past its offset.
+func (t *Tailer) read(path string, skip bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return err
+	}
+	pos, known := t.offsets[path]
+	switch id := fileID(fi); {
+	case !known && skip:
+		pos = position{ID: id, Offset: fi.Size()}
+	case !known, pos.ID != id, fi.Size() < pos.Offset:
+		pos = position{ID: id}
+	}
+	t.offsets[path] = pos
+	if _, err := f.Seek(pos.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(f, 64<<10)
+	var line []byte
+	var n int64
+	for !t.stopped() {
+		chunk, err := r.ReadSlice('\n')
+		n += int64(len(chunk))
+		// past the limit, the rest of a line is only counted, to skip it
+		// whole
+		if len(line) <= t.cfg.MaxLineBytes {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			// a line without its newline yet is read once complete
+			return nil
+		}
+		if err := t.line(path, pos.Offset, line); err != nil {
+			return err
+		}
+		pos.Offset += n
+		t.offsets[path] = pos
+		line, n = line[:0], 0
+	}
+	return nil
+}
+
+// line ingests one line, read at offset of path.
+func (t *Tailer) line(path string, offset int64, line []byte) error {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(bytes.TrimSpace(line)) == 0 {
+		return nil
+	}
+	if len(line) > t.cfg.MaxLineBytes {
+		linesTotal.WithLabelValues("invalid").Inc()
+		log.Debug().Str("path", path).Int64("offset", offset).Msg("file source: line too long")
+		return nil
+	}
+	e, err := t.decode(line)
+	if err != nil {
+		linesTotal.WithLabelValues("invalid").Inc()
+		log.Debug().Err(err).Str("path", path).Int64("offset", offset).Msg("file source: line dropped")
+		return nil
+	}
+	if e.Metadata == nil {
+		e.Metadata = map[string]string{}
+	}
+	e.Metadata["file.path"] = path
+	e.Metadata["file.offset"] = strconv.FormatInt(offset, 10)
+	err = t.handle(e)
+	var final rejectError
+	switch {
+	case err == nil:
+		linesTotal.WithLabelValues("accepted").Inc()
+		return nil
+	case errors.As(err, &final):
+		linesTotal.WithLabelValues("rejected").Inc()
+		log.Debug().Err(err).Str("path", path).Int64("offset", offset).Msg("file source: line rejected")
+		return nil
+	default:
+		log.Warn().Err(err).Str("path", path).Int64("offset", offset).Msg("file source: line deferred")
+		return errRetry
+	}
+}
+
+// decode turns a line into an event, see config.FileSourceConfig.Format.
+func (t *Tailer) decode(line []byte) (event.Event, error) {
+	var e event.Event
+	switch {
+	case t.cfg.Format == "text":
+		payload, err := json.Marshal(map[string]string{"line": string(line)})
+		if err != nil {
+			return e, err
+		}
+		e = event.Event{Type: t.cfg.Type, Payload: payload}
+	case t.cfg.Type != "":
+		if !json.Valid(line) {
+			return e, errors.New("line is not JSON")
+		}
+		e = event.Event{Type: t.cfg.Type, Payload: json.RawMessage(bytes.Clone(line))}
+	default:
+		if err := json.Unmarshal(line, &e); err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
+
+// save replaces the checkpoint file atomically.
+func (t *Tailer) save() error {
+	raw, err := json.MarshalIndent(t.offsets, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := t.cfg.Checkpoint + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.cfg.Checkpoint)
+}
+
+func (t *Tailer) stopped() bool {
+	select {
+	case <-t.stop:
+		return true
+	default:
+		return false
+	}
+}
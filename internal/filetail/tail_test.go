@@ -0,0 +1,87 @@
+package filetail
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// TestTail reads complete lines only, retries a line the handler defers,
+// resumes from the checkpoint after a restart and starts a truncated file
+// over.
+func TestTail(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "app.ndjson")
+	cfg := config.FileSourceConfig{
+		Paths:        []string{filepath.Join(dir, "*.ndjson")},
+		Checkpoint:   filepath.Join(dir, "offsets.json"),
+		PollInterval: 10 * time.Millisecond,
+	}
+	var mu sync.Mutex
+	var got []string
+	busy := true
+	handle := func(e event.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if e.Type == "busy" && busy {
+			busy = false
+			return errors.New("try again")
+		}
+		if e.Type == "bad" {
+			return Reject(errors.New("refused"))
+		}
+		got = append(got, e.Type)
+		return nil
+	}
+	wait := func(want ...string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			mu.Lock()
+			ok := slices.Equal(got, want)
+			mu.Unlock()
+			if ok {
+				return
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	write := func(flag int, s string) {
+		t.Helper()
+		f, err := os.OpenFile(log, flag|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(os.O_APPEND, `{"type":"a"}`+"\n"+`not json`+"\n"+`{"type":"bad"}`+"\n"+`{"type":"busy"}`+"\n"+`{"type":"b"`)
+	tail, err := Start(cfg, handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait("a", "busy")
+	write(os.O_APPEND, `}`+"\n")
+	wait("a", "busy", "b")
+	tail.Close()
+
+	write(os.O_APPEND, `{"type":"c"}`+"\n")
+	if tail, err = Start(cfg, handle); err != nil {
+		t.Fatal(err)
+	}
+	defer tail.Close()
+	wait("a", "busy", "b", "c")
+	write(os.O_TRUNC, `{"type":"d"}`+"\n")
+	wait("a", "busy", "b", "c", "d")
+}
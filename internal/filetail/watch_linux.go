@@ -0,0 +1,46 @@
+package filetail
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// watch asks inotify for the changes in dirs, signalling each batch of them
+// on the channel until the closer is closed. Directories that do not exist
+// yet, or have wildcards, are left to polling.
+func watch(dirs map[string]bool) (<-chan struct{}, io.Closer, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, nil, err
+	}
+	const mask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE
+	for dir := range dirs {
+		_, _ = syscall.InotifyAddWatch(fd, dir, mask)
+	}
+	// a non-blocking file goes through the runtime poller, so Close ends a
+	// pending Read
+	f := os.NewFile(uintptr(fd), "inotify")
+	wake := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			if _, err := f.Read(buf); err != nil {
+				return
+			}
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return wake, f, nil
+}
+
+// fileID is the inode number of fi.
+func fileID(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Ino
+	}
+	return 0
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package filetail
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// watch is only implemented with inotify; elsewhere files are polled.
+func watch(map[string]bool) (<-chan struct{}, io.Closer, error) {
+	return nil, nil, errors.ErrUnsupported
+}
+
+// fileID is 0 where inode numbers are not used: a replaced file is only
+// noticed when it is shorter than the offset read.
+func fileID(os.FileInfo) uint64 {
+	return 0
+}
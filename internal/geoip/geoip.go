@@ -0,0 +1,403 @@
+// Package geoip looks up IP addresses in a MaxMind DB file: GeoIP2 and
+// GeoLite2 City, Country and ASN databases. The file is read into memory
+// once; lookups do not allocate beyond the decoded record.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// metadataMarker starts the metadata section at the end of the file.
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// ErrInvalid is a file that is not a MaxMind DB, or a corrupt one.
+var ErrInvalid = errors.New("geoip: invalid MaxMind DB")
+
+// DB is an open MaxMind DB. It is safe for concurrent use.
+type DB struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// ipv4Start is the node IPv4 lookups start from in an IPv6 tree,
+	// after the 96 zero bits of ::/96.
+	ipv4Start uint
+	// Type is the database_type of the metadata, e.g. GeoLite2-City.
+	Type string
+}
+
+// Location is what a record says about an address; fields the database
+// does not have are empty.
+type Location struct {
+	// Country is the ISO 3166-1 alpha-2 code, CountryName its English name.
+	Country     string
+	CountryName string
+	Continent   string
+	// Region is the ISO 3166-2 code of the first subdivision, without the
+	// country prefix.
+	Region    string
+	City      string
+	TimeZone  string
+	Latitude  float64
+	Longitude float64
+	// HasCoordinates tells 0,0 from no coordinates.
+	HasCoordinates bool
+	// ASN and ASOrg come from ASN databases.
+	ASN   uint64
+	ASOrg string
+}
+
+// Open reads the database at path.
+func Open(path string) (*DB, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(buf)
+}
+
+// New parses a database held in buf, which it keeps.
+func New(buf []byte) (*DB, error) {
+	i := bytes.LastIndex(buf, metadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: no metadata", ErrInvalid)
+	}
+	d := decoder{buf: buf[i+len(metadataMarker):]}
+	v, _, err := d.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: metadata: %v", ErrInvalid, err)
+	}
+	meta, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", ErrInvalid)
+	}
+	db := &DB{
+		nodeCount:  uint(toUint(meta["node_count"])),
+		recordSize: uint(toUint(meta["record_size"])),
+		ipVersion:  uint(toUint(meta["ip_version"])),
+	}
+	db.Type, _ = meta["database_type"].(string)
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w: record size %d", ErrInvalid, db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("%w: ip version %d", ErrInvalid, db.ipVersion)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("%w: search tree larger than the file", ErrInvalid)
+	}
+	db.tree, db.data = buf[:treeSize], buf[treeSize+16:i]
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for range 96 {
+			if node >= db.nodeCount {
+				break
+			}
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// Lookup returns the location of addr, and false when the database has no
+// record for it.
+func (db *DB) Lookup(addr netip.Addr) (Location, bool, error) {
+	rec, ok, err := db.lookup(addr)
+	if !ok || err != nil {
+		return Location{}, false, err
+	}
+	m, _ := rec.(map[string]any)
+	var loc Location
+	loc.Country = str(m, "country", "iso_code")
+	loc.CountryName = str(m, "country", "names", "en")
+	loc.Continent = str(m, "continent", "code")
+	loc.City = str(m, "city", "names", "en")
+	loc.TimeZone = str(m, "location", "time_zone")
+	if subs, ok := m["subdivisions"].([]any); ok && len(subs) > 0 {
+		if s, ok := subs[0].(map[string]any); ok {
+			loc.Region = str(s, "iso_code")
+		}
+	}
+	if l, ok := m["location"].(map[string]any); ok {
+		lat, okLat := l["latitude"].(float64)
+		lon, okLon := l["longitude"].(float64)
+		if okLat && okLon {
+			loc.Latitude, loc.Longitude, loc.HasCoordinates = lat, lon, true
+		}
+	}
+	loc.ASN = toUint(m["autonomous_system_number"])
+	loc.ASOrg, _ = m["autonomous_system_organization"].(string)
+	return loc, true, nil
+}
+
+// lookup walks the search tree to the record of addr.
+func (db *DB) lookup(addr netip.Addr) (any, bool, error) {
+	addr = addr.Unmap()
+	node, bits := uint(0), addr.AsSlice()
+	if addr.Is4() && db.ipVersion == 6 {
+		node = db.ipv4Start
+	} else if addr.Is6() && db.ipVersion == 4 {
+		return nil, false, nil
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-i%8)) & 1
+		node = db.record(node, bit)
+	}
+	switch {
+	case node == db.nodeCount:
+		return nil, false, nil
+	case node < db.nodeCount:
+		return nil, false, fmt.Errorf("%w: search tree does not end in a record", ErrInvalid)
+	}
+	off := node - db.nodeCount - 16
+	if off >= uint(len(db.data)) {
+		return nil, false, fmt.Errorf("%w: record outside the data section", ErrInvalid)
+	}
+	d := decoder{buf: db.data}
+	v, _, err := d.decode(off, 0)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return v, true, nil
+}
+
+// record reads the left (bit 0) or right (bit 1) record of node.
+func (db *DB) record(node, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(db.tree[node*8+bit*4:]))
+	}
+}
+
+// maxDepth bounds the nesting of decoded values, against crafted files.
+const maxDepth = 32
+
+// decoder reads the MaxMind DB data format into maps, slices, strings,
+// float64, uint64 (all unsigned sizes), int64 and bool. Pointers are
+// offsets into buf.
+type decoder struct{ buf []byte }
+
+// Data types.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+var errTruncated = errors.New("data truncated")
+
+// decode returns the value at off and the offset after it.
+func (d decoder) decode(off uint, depth int) (any, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, errors.New("data nested too deep")
+	}
+	typ, size, off, err := d.control(off)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ == typePointer {
+		target, next, err := d.pointer(size, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(target, depth+1)
+		return v, next, err
+	}
+	end := off + size
+	if typ != typeMap && typ != typeArray && typ != typeBool && end > uint(len(d.buf)) {
+		return nil, 0, errTruncated
+	}
+	switch typ {
+	case typeString:
+		return string(d.buf[off:end]), end, nil
+	case typeBytes:
+		return bytes.Clone(d.buf[off:end]), end, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("double of %d bytes", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(d.buf[off:end])), end, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("float of %d bytes", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(d.buf[off:end]))), end, nil
+	case typeUint16, typeUint32, typeUint64, typeUint128:
+		if size > 16 {
+			return nil, 0, fmt.Errorf("unsigned integer of %d bytes", size)
+		}
+		var n uint64
+		// a uint128 beyond 64 bits keeps its low bits; no database field
+		// this package reads is that wide
+		for _, b := range d.buf[off:end] {
+			n = n<<8 | uint64(b)
+		}
+		return n, end, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("int32 of %d bytes", size)
+		}
+		var n uint32
+		for _, b := range d.buf[off:end] {
+			n = n<<8 | uint32(b)
+		}
+		if size == 4 {
+			return int64(int32(n)), end, nil
+		}
+		return int64(n), end, nil
+	case typeBool:
+		return size != 0, off, nil
+	case typeMap:
+		m := make(map[string]any, min(size, 64))
+		for range size {
+			k, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			if m[key], off, err = d.decode(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, off, nil
+	case typeArray:
+		a := make([]any, 0, min(size, 64))
+		for range size {
+			v, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, off = append(a, v), next
+		}
+		return a, off, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+	}
+}
+
+// control reads the control byte at off: the type, the size (or pointer
+// bits) and the offset of the payload.
+func (d decoder) control(off uint) (typ int, size, next uint, err error) {
+	if off >= uint(len(d.buf)) {
+		return 0, 0, 0, errTruncated
+	}
+	ctrl := d.buf[off]
+	off++
+	typ = int(ctrl >> 5)
+	if typ == typePointer {
+		return typ, uint(ctrl & 0x1F), off, nil
+	}
+	if typ == typeExtended {
+		if off >= uint(len(d.buf)) {
+			return 0, 0, 0, errTruncated
+		}
+		typ = 7 + int(d.buf[off])
+		off++
+	}
+	size = uint(ctrl & 0x1F)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(d.buf)) {
+			return 0, 0, 0, errTruncated
+		}
+		var extra uint
+		for _, b := range d.buf[off : off+n] {
+			extra = extra<<8 | uint(b)
+		}
+		off += n
+		switch n {
+		case 1:
+			size = 29 + extra
+		case 2:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+	return typ, size, off, nil
+}
+
+// pointer decodes a pointer whose control byte held bits, its payload at
+// off, returning the target and the offset after the pointer.
+func (d decoder) pointer(bits, off uint) (uint, uint, error) {
+	n := (bits>>3)&0x3 + 1
+	if off+n > uint(len(d.buf)) {
+		return 0, 0, errTruncated
+	}
+	var p uint
+	if n < 4 {
+		p = bits & 0x7
+	}
+	for _, b := range d.buf[off : off+n] {
+		p = p<<8 | uint(b)
+	}
+	switch n {
+	case 2:
+		p += 2048
+	case 3:
+		p += 526336
+	}
+	return p, off + n, nil
+}
+
+func toUint(v any) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		if n > 0 {
+			return uint64(n)
+		}
+	}
+	return 0
+}
+
+// str follows path through nested maps to a string.
+func str(m map[string]any, path ...string) string {
+	var v any = m
+	for _, k := range path {
+		mm, ok := v.(map[string]any)
+		if !ok {
+			return ""
+		}
+		v = mm[k]
+	}
+	s, _ := v.(string)
+	return s
+}
@@ -0,0 +1,170 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/netip"
+	"testing"
+)
+
+// writer builds a MaxMind DB in memory, enough of the format for the tests.
+type writer struct {
+	recordSize int
+	// records holds two references per node: >0 a node index, <0 the
+	// data offset -(ref+1), 0 empty
+	records [][2]int
+	data    []byte
+}
+
+func (w *writer) insert(prefix netip.Prefix, ipVersion int, record []byte) {
+	addr, bits := prefix.Addr(), prefix.Bits()
+	raw := addr.AsSlice()
+	if addr.Is4() && ipVersion == 6 {
+		raw, bits = append(make([]byte, 12), raw...), bits+96
+	}
+	off := len(w.data)
+	w.data = append(w.data, record...)
+	node := 0
+	for i := range bits {
+		bit := int(raw[i/8]>>(7-i%8)) & 1
+		if i == bits-1 {
+			w.records[node][bit] = -(off + 1)
+			return
+		}
+		if w.records[node][bit] <= 0 {
+			w.records = append(w.records, [2]int{})
+			w.records[node][bit] = len(w.records) - 1
+		}
+		node = w.records[node][bit]
+	}
+}
+
+func (w *writer) bytes(ipVersion int) []byte {
+	n := len(w.records)
+	value := func(ref int) uint32 {
+		switch {
+		case ref > 0:
+			return uint32(ref)
+		case ref < 0:
+			return uint32(n + 16 - ref - 1)
+		}
+		return uint32(n)
+	}
+	var out []byte
+	for _, r := range w.records {
+		l, rr := value(r[0]), value(r[1])
+		switch w.recordSize {
+		case 24:
+			out = append(out, byte(l>>16), byte(l>>8), byte(l), byte(rr>>16), byte(rr>>8), byte(rr))
+		case 28:
+			out = append(out, byte(l>>16), byte(l>>8), byte(l), byte(l>>24)<<4|byte(rr>>24)&0x0F, byte(rr>>16), byte(rr>>8), byte(rr))
+		default:
+			out = binary.BigEndian.AppendUint32(out, l)
+			out = binary.BigEndian.AppendUint32(out, rr)
+		}
+	}
+	out = append(out, make([]byte, 16)...)
+	out = append(out, w.data...)
+	out = append(out, metadataMarker...)
+	return append(out, encode(map[string]any{
+		"node_count":    uint32(n),
+		"record_size":   uint16(w.recordSize),
+		"ip_version":    uint16(ipVersion),
+		"database_type": "Test-City",
+	})...)
+}
+
+func ctrl(typ, size int) []byte {
+	var b []byte
+	if typ > 7 {
+		b = []byte{byte(size), byte(typ - 7)}
+	} else {
+		b = []byte{byte(typ<<5 | size)}
+	}
+	return b
+}
+
+// encode writes v in the data format; keys are written in no set order.
+func encode(v any) []byte {
+	switch x := v.(type) {
+	case string:
+		return append(ctrl(typeString, len(x)), x...)
+	case float64:
+		return binary.BigEndian.AppendUint64(ctrl(typeDouble, 8), math.Float64bits(x))
+	case uint16:
+		return binary.BigEndian.AppendUint16(ctrl(typeUint16, 2), x)
+	case uint32:
+		return binary.BigEndian.AppendUint32(ctrl(typeUint32, 4), x)
+	case []any:
+		out := ctrl(typeArray, len(x))
+		for _, e := range x {
+			out = append(out, encode(e)...)
+		}
+		return out
+	case map[string]any:
+		out := ctrl(typeMap, len(x))
+		for k, e := range x {
+			out = append(out, encode(k)...)
+			out = append(out, encode(e)...)
+		}
+		return out
+	case pointer:
+		return []byte{byte(typePointer<<5 | int(x)>>8&0x7), byte(x)}
+	}
+	panic("unsupported type")
+}
+
+// pointer is a pointer of the smallest size, under 2048.
+type pointer int
+
+func TestLookup(t *testing.T) {
+	us := map[string]any{"iso_code": "US", "names": map[string]any{"en": "United States", "de": "USA"}}
+	for _, tc := range []struct{ ipVersion, recordSize int }{{6, 24}, {6, 28}, {4, 32}} {
+		w := &writer{recordSize: tc.recordSize, records: make([][2]int, 1)}
+		w.insert(netip.MustParsePrefix("81.2.69.0/24"), tc.ipVersion, encode(map[string]any{
+			"country":      us,
+			"city":         map[string]any{"names": map[string]any{"en": "Boston"}},
+			"subdivisions": []any{map[string]any{"iso_code": "MA"}},
+			"location":     map[string]any{"latitude": 42.36, "longitude": -71.06, "time_zone": "America/New_York"},
+		}))
+		// the second record points at a country map stored apart
+		shared := len(w.data)
+		w.data = append(w.data, encode(us)...)
+		second := append(ctrl(typeMap, 2), encode("country")...)
+		second = append(second, encode(pointer(shared))...)
+		second = append(second, encode("autonomous_system_number")...)
+		second = append(second, encode(uint32(64500))...)
+		w.insert(netip.MustParsePrefix("81.2.70.0/23"), tc.ipVersion, second)
+		if tc.ipVersion == 6 {
+			w.insert(netip.MustParsePrefix("2001:db8::/32"), tc.ipVersion, encode(map[string]any{"country": map[string]any{"iso_code": "DE"}}))
+		}
+		db, err := New(w.bytes(tc.ipVersion))
+		if err != nil {
+			t.Fatalf("%+v: %v", tc, err)
+		}
+		loc, ok, err := db.Lookup(netip.MustParseAddr("81.2.69.160"))
+		if err != nil || !ok {
+			t.Fatalf("%+v: %v %v", tc, ok, err)
+		}
+		want := Location{Country: "US", CountryName: "United States", Region: "MA", City: "Boston", TimeZone: "America/New_York",
+			Latitude: 42.36, Longitude: -71.06, HasCoordinates: true}
+		if loc != want {
+			t.Errorf("%+v: %+v", tc, loc)
+		}
+		if loc, ok, err := db.Lookup(netip.MustParseAddr("::ffff:81.2.71.1")); err != nil || !ok || loc.Country != "US" || loc.ASN != 64500 {
+			t.Errorf("%+v: through a pointer: %+v %v %v", tc, loc, ok, err)
+		}
+		if _, ok, err := db.Lookup(netip.MustParseAddr("10.0.0.1")); ok || err != nil {
+			t.Errorf("%+v: unknown address: %v %v", tc, ok, err)
+		}
+		loc, ok, _ = db.Lookup(netip.MustParseAddr("2001:db8::1"))
+		if tc.ipVersion == 6 && (!ok || loc.Country != "DE") {
+			t.Errorf("%+v: IPv6: %+v %v", tc, loc, ok)
+		}
+	}
+
+	if _, err := New([]byte("not a database")); !errors.Is(err, ErrInvalid) {
+		t.Errorf("garbage: %v", err)
+	}
+}
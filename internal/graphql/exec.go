@@ -0,0 +1,620 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Error is a GraphQL error as it appears in the "errors" of a response.
+type Error struct {
+	Message   string     `json:"message"`
+	Locations []location `json:"locations,omitempty"`
+	Path      []any      `json:"path,omitempty"`
+}
+
+func (e *Error) Error() string { return e.Message }
+
+// Request is a GraphQL-over-HTTP request.
+type Request struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName,omitempty"`
+	Variables     map[string]any `json:"variables,omitempty"`
+}
+
+// Response is the result of an operation. Data is absent when the request
+// failed before execution, and null when an error nulled the whole result.
+type Response struct {
+	Data   any
+	Errors []*Error
+	// executed tells a null Data apart from an absent one.
+	executed bool
+}
+
+func (r *Response) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	if r.executed {
+		data, err := json.Marshal(r.Data)
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString(`"data":`)
+		b.Write(data)
+	}
+	if len(r.Errors) > 0 {
+		errs, err := json.Marshal(r.Errors)
+		if err != nil {
+			return nil, err
+		}
+		if r.executed {
+			b.WriteByte(',')
+		}
+		b.WriteString(`"errors":`)
+		b.Write(errs)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+func requestError(format string, args ...any) *Response {
+	return &Response{Errors: []*Error{{Message: fmt.Sprintf(format, args...)}}}
+}
+
+// object is a response object, which keeps its keys in selection order.
+type object []member
+
+type member struct {
+	key string
+	val any
+}
+
+func (o object) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(m.key)
+		b.Write(k)
+		b.WriteByte(':')
+		v, err := json.Marshal(m.val)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// maxFields bounds the fields one execution resolves, so that nested
+// lists (in introspection, say) cannot multiply into a huge response.
+const maxFields = 200_000
+
+var errTooComplex = &Error{Message: fmt.Sprintf("the operation resolves more than %d fields", maxFields)}
+
+// prepared is a validated operation with its variables coerced.
+type prepared struct {
+	s    *schema
+	doc  *document
+	op   *operation
+	vars map[string]any
+}
+
+// prepare parses and validates req, choosing the operation to run. A
+// non-nil Response reports a request error.
+func (s *schema) prepare(req *Request) (*prepared, *Response) {
+	doc, err := parse(req.Query)
+	if err != nil {
+		var se *syntaxError
+		if errors.As(err, &se) {
+			return nil, &Response{Errors: []*Error{{Message: "syntax error: " + se.msg, Locations: []location{se.loc}}}}
+		}
+		return nil, requestError("%v", err)
+	}
+	var op *operation
+	for _, o := range doc.operations {
+		if req.OperationName == "" || o.name == req.OperationName {
+			if op != nil {
+				if req.OperationName == "" {
+					return nil, requestError("the document holds several operations: operationName is required")
+				}
+				return nil, requestError("several operations are named %q", req.OperationName)
+			}
+			op = o
+		}
+	}
+	if op == nil {
+		if len(doc.operations) == 0 {
+			return nil, requestError("the document holds no operation")
+		}
+		return nil, requestError("unknown operation %q", req.OperationName)
+	}
+	v := &validator{s: s, doc: doc, op: op, defined: map[string]bool{}}
+	v.operation()
+	if len(v.errs) > 0 {
+		return nil, &Response{Errors: v.errs}
+	}
+	vars, err := s.coerceVariables(op, req.Variables)
+	if err != nil {
+		return nil, &Response{Errors: []*Error{{Message: err.Error(), Locations: []location{op.loc}}}}
+	}
+	return &prepared{s: s, doc: doc, op: op, vars: vars}, nil
+}
+
+func (s *schema) coerceVariables(op *operation, in map[string]any) (map[string]any, error) {
+	out := map[string]any{}
+	for _, d := range op.vars {
+		t := s.resolveType(d.typ)
+		v, ok := in[d.name]
+		if !ok {
+			if d.def == nil {
+				if t.kind == nonNullKind {
+					return nil, fmt.Errorf("variable $%s of type %s is required", d.name, t)
+				}
+				continue
+			}
+			v, _ = (&executor{}).literal(d.def)
+		}
+		c, err := coerce(t, v, "variable $"+d.name)
+		if err != nil {
+			return nil, err
+		}
+		out[d.name] = c
+	}
+	return out, nil
+}
+
+// execute runs a query with a nil root value.
+func (p *prepared) execute(ctx context.Context) *Response {
+	return p.executeOn(ctx, p.s.query, nil)
+}
+
+// executeOn runs the operation's selection set on root, of type t.
+func (p *prepared) executeOn(ctx context.Context, t *gqlType, root any) (resp *Response) {
+	ex := &executor{ctx: ctx, p: p, budget: maxFields}
+	defer func() {
+		if r := recover(); r != nil {
+			if r != errTooComplex {
+				panic(r)
+			}
+			resp = &Response{executed: true, Errors: append(ex.errors, errTooComplex)}
+		}
+	}()
+	data, ok := ex.selectionSet(t, root, p.op.sel, nil)
+	resp = &Response{executed: true, Errors: ex.errors}
+	if ok {
+		resp.Data = data
+	}
+	return resp
+}
+
+// subscribe starts the event stream of a subscription operation, whose
+// single root field validation has checked.
+func (p *prepared) subscribe(ctx context.Context) (<-chan any, func() error, *Response) {
+	ex := &executor{ctx: ctx, p: p}
+	fields := ex.collect(p.s.subscription, p.op.sel, nil, map[string]bool{})
+	f := p.s.subscription.field(fields[0].sels[0].name)
+	args, err := ex.arguments(f.args, fields[0].sels[0].args)
+	if err == nil {
+		var events <-chan any
+		var streamErr func() error
+		if events, streamErr, err = f.subscribe(ctx, args); err == nil {
+			return events, streamErr, nil
+		}
+	}
+	return nil, nil, &Response{Errors: []*Error{{
+		Message:   err.Error(),
+		Locations: []location{fields[0].sels[0].loc},
+		Path:      []any{fields[0].key},
+	}}}
+}
+
+type executor struct {
+	ctx    context.Context
+	p      *prepared
+	errors []*Error
+	budget int
+}
+
+// collected is the selections of one response key, merged.
+type collected struct {
+	key  string
+	sels []*selection
+}
+
+// collect gathers the fields of sel that apply to t, following fragments.
+func (ex *executor) collect(t *gqlType, sel []*selection, out []collected, visited map[string]bool) []collected {
+	for _, s := range sel {
+		if !ex.included(s.directives) {
+			continue
+		}
+		switch {
+		case s.spread != "":
+			if visited[s.spread] {
+				continue
+			}
+			visited[s.spread] = true
+			if f, ok := ex.p.doc.fragments[s.spread]; ok && f.on == t.name {
+				out = ex.collect(t, f.sel, out, visited)
+			}
+		case s.inline:
+			if s.on == "" || s.on == t.name {
+				out = ex.collect(t, s.sel, out, visited)
+			}
+		default:
+			i := slices.IndexFunc(out, func(c collected) bool { return c.key == s.key() })
+			if i < 0 {
+				out = append(out, collected{key: s.key()})
+				i = len(out) - 1
+			}
+			out[i].sels = append(out[i].sels, s)
+		}
+	}
+	return out
+}
+
+// included applies @skip and @include.
+func (ex *executor) included(ds []*directive) bool {
+	for _, d := range ds {
+		for _, a := range d.args {
+			v, _ := ex.literal(a.val)
+			if b, _ := v.(bool); a.name == "if" && b == (d.name == "skip") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// selectionSet resolves the fields of sel on src, an object of type t. It
+// reports false when a non-null field came out null, which nulls the
+// object.
+func (ex *executor) selectionSet(t *gqlType, src any, sel []*selection, path []any) (any, bool) {
+	fields := ex.collect(t, sel, nil, map[string]bool{})
+	out := make(object, 0, len(fields))
+	for _, c := range fields {
+		if ex.budget--; ex.budget < 0 {
+			panic(errTooComplex)
+		}
+		s := c.sels[0]
+		if s.name == "__typename" {
+			out = append(out, member{c.key, t.name})
+			continue
+		}
+		f := t.field(s.name)
+		fpath := append(slices.Clip(path), c.key)
+		var v any
+		args, err := ex.arguments(f.args, s.args)
+		if err == nil {
+			v, err = f.resolve(ex.ctx, src, args)
+		}
+		if err != nil {
+			ex.fail(s, fpath, err)
+			v = nil
+		}
+		var subsel []*selection
+		for _, s := range c.sels {
+			subsel = append(subsel, s.sel...)
+		}
+		r, ok := ex.complete(f.typ, subsel, v, fpath, s)
+		if !ok {
+			return nil, false
+		}
+		out = append(out, member{c.key, r})
+	}
+	return out, true
+}
+
+// complete turns the resolved v into its response form for type t. Only
+// non-null types report false, for a null, which nullable types above
+// absorb.
+func (ex *executor) complete(t *gqlType, sel []*selection, v any, path []any, s *selection) (any, bool) {
+	if t.kind == nonNullKind {
+		r, _ := ex.complete(t.ofType, sel, v, path, s)
+		if r == nil {
+			if !ex.failedAt(path) {
+				ex.fail(s, path, fmt.Errorf("cannot return null for non-null field of type %s", t))
+			}
+			return nil, false
+		}
+		return r, true
+	}
+	if v == nil {
+		return nil, true
+	}
+	switch t.kind {
+	case listKind:
+		items, ok := v.([]any)
+		if !ok {
+			ex.fail(s, path, fmt.Errorf("expected a list, resolved %T", v))
+			return nil, true
+		}
+		out := make([]any, len(items))
+		for i, item := range items {
+			r, ok := ex.complete(t.ofType, sel, item, append(slices.Clip(path), i), s)
+			if !ok {
+				return nil, true
+			}
+			out[i] = r
+		}
+		return out, true
+	case objectKind:
+		r, ok := ex.selectionSet(t, v, sel, path)
+		if !ok {
+			return nil, true
+		}
+		return r, true
+	case enumKind:
+		return v, true
+	}
+	r, err := t.serialize(v)
+	if err != nil {
+		ex.fail(s, path, err)
+		return nil, true
+	}
+	return r, true
+}
+
+func (ex *executor) fail(s *selection, path []any, err error) {
+	ex.errors = append(ex.errors, &Error{Message: err.Error(), Locations: []location{s.loc}, Path: path})
+}
+
+// failedAt reports whether an error was recorded at path or below it.
+func (ex *executor) failedAt(path []any) bool {
+	for _, e := range ex.errors {
+		if len(e.Path) >= len(path) && slices.Equal(e.Path[:len(path)], path) {
+			return true
+		}
+	}
+	return false
+}
+
+// arguments coerces the arguments given to a field, filling in defaults.
+func (ex *executor) arguments(defs []*inputValue, given []*argument) (map[string]any, error) {
+	out := make(map[string]any, len(defs))
+	for _, d := range defs {
+		var v any
+		ok := false
+		if i := slices.IndexFunc(given, func(a *argument) bool { return a.name == d.name }); i >= 0 {
+			v, ok = ex.literal(given[i].val)
+		}
+		if !ok {
+			if d.def == "" {
+				if d.typ.kind == nonNullKind {
+					return nil, fmt.Errorf("argument %q of type %s is required", d.name, d.typ)
+				}
+				continue
+			}
+			v = defaultValue(d)
+		}
+		c, err := coerce(d.typ, v, "argument "+d.name)
+		if err != nil {
+			return nil, err
+		}
+		out[d.name] = c
+	}
+	return out, nil
+}
+
+// literal returns the JSON form of v, with variables substituted. It
+// reports false for a variable that was not given.
+func (ex *executor) literal(v *value) (any, bool) {
+	switch v.kind {
+	case varValue:
+		var vars map[string]any
+		if ex.p != nil {
+			vars = ex.p.vars
+		}
+		out, ok := vars[v.raw]
+		return out, ok
+	case intValue, floatValue:
+		return json.Number(v.raw), true
+	case stringValue:
+		return v.raw, true
+	case boolValue:
+		return v.raw == "true", true
+	case nullValue:
+		return nil, true
+	case enumValue:
+		return enumLiteral(v.raw), true
+	case listValue:
+		out := make([]any, len(v.list))
+		for i, item := range v.list {
+			out[i], _ = ex.literal(item)
+		}
+		return out, true
+	}
+	out := make(map[string]any, len(v.fields))
+	for _, f := range v.fields {
+		if fv, ok := ex.literal(f.val); ok {
+			out[f.name] = fv
+		}
+	}
+	return out, true
+}
+
+// validator checks a document against the schema before it runs: fields,
+// arguments and fragments must exist, leaves take no selection and objects
+// need one, and variables must be defined.
+type validator struct {
+	s       *schema
+	doc     *document
+	op      *operation
+	defined map[string]bool
+	errs    []*Error
+}
+
+func (v *validator) errorf(loc location, format string, args ...any) {
+	v.errs = append(v.errs, &Error{Message: fmt.Sprintf(format, args...), Locations: []location{loc}})
+}
+
+func (v *validator) operation() {
+	var root *gqlType
+	switch v.op.kind {
+	case "query":
+		root = v.s.query
+	case "subscription":
+		root = v.s.subscription
+	}
+	if root == nil {
+		v.errorf(v.op.loc, "%s operations are not supported", v.op.kind)
+		return
+	}
+	for _, d := range v.op.vars {
+		if v.defined[d.name] {
+			v.errorf(d.loc, "variable $%s is defined twice", d.name)
+		}
+		v.defined[d.name] = true
+		t := v.s.resolveType(d.typ)
+		switch {
+		case t == nil:
+			v.errorf(d.loc, "variable $%s: unknown type %s", d.name, d.typ)
+		case !t.input():
+			v.errorf(d.loc, "variable $%s: %s is not an input type", d.name, t)
+		case d.def != nil:
+			lit, _ := (&executor{}).literal(d.def)
+			if _, err := coerce(t, lit, "default of $"+d.name); err != nil {
+				v.errorf(d.loc, "%v", err)
+			}
+		}
+	}
+	v.directives(v.op.directives)
+	v.selectionSet(root, v.op.sel, nil)
+	v.conflicts(root, v.op.sel)
+	if v.op.kind == "subscription" && len(v.errs) == 0 {
+		fields := (&executor{p: &prepared{doc: v.doc}}).collect(root, v.op.sel, nil, map[string]bool{})
+		if len(fields) != 1 || fields[0].sels[0].name == "__typename" {
+			v.errorf(v.op.loc, "a subscription selects exactly one field")
+		}
+	}
+}
+
+func (v *validator) selectionSet(t *gqlType, sel []*selection, spreading []string) {
+	for _, s := range sel {
+		v.directives(s.directives)
+		switch {
+		case s.spread != "":
+			f, ok := v.doc.fragments[s.spread]
+			if !ok {
+				v.errorf(s.loc, "unknown fragment %q", s.spread)
+				continue
+			}
+			if slices.Contains(spreading, s.spread) {
+				v.errorf(s.loc, "fragment %q spreads itself", s.spread)
+				continue
+			}
+			if v.condition(f.on, f.loc, t) {
+				v.directives(f.directives)
+				v.selectionSet(t, f.sel, append(spreading, s.spread))
+			}
+		case s.inline:
+			if s.on == "" || v.condition(s.on, s.loc, t) {
+				v.selectionSet(t, s.sel, spreading)
+			}
+		default:
+			v.field(t, s, spreading)
+		}
+	}
+}
+
+// condition checks that a fragment on the type named on can apply within
+// t, which, without interfaces and unions, means it is t.
+func (v *validator) condition(on string, loc location, t *gqlType) bool {
+	ct, ok := v.s.types[on]
+	switch {
+	case !ok:
+		v.errorf(loc, "unknown type %q", on)
+	case ct.kind != objectKind:
+		v.errorf(loc, "fragments cannot be on %s", on)
+	case ct != t:
+		v.errorf(loc, "a fragment on %s cannot be spread within %s", on, t.name)
+	default:
+		return true
+	}
+	return false
+}
+
+func (v *validator) field(t *gqlType, s *selection, spreading []string) {
+	if s.name == "__typename" {
+		if s.sel != nil {
+			v.errorf(s.loc, "field \"__typename\" takes no selection")
+		}
+		return
+	}
+	f := t.field(s.name)
+	if f == nil {
+		v.errorf(s.loc, "cannot query field %q on type %s", s.name, t.name)
+		return
+	}
+	for _, a := range s.args {
+		if !slices.ContainsFunc(f.args, func(d *inputValue) bool { return d.name == a.name }) {
+			v.errorf(a.loc, "unknown argument %q on field %s.%s", a.name, t.name, f.name)
+		}
+		v.value(a.val)
+	}
+	for _, d := range f.args {
+		if d.typ.kind == nonNullKind && d.def == "" &&
+			!slices.ContainsFunc(s.args, func(a *argument) bool { return a.name == d.name }) {
+			v.errorf(s.loc, "field %s.%s needs argument %q of type %s", t.name, f.name, d.name, d.typ)
+		}
+	}
+	switch {
+	case f.typ.leaf() && s.sel != nil:
+		v.errorf(s.loc, "field %q of type %s takes no selection", s.name, f.typ)
+	case !f.typ.leaf() && s.sel == nil:
+		v.errorf(s.loc, "field %q of type %s needs a selection", s.name, f.typ)
+	case s.sel != nil:
+		v.selectionSet(f.typ.named(), s.sel, spreading)
+		v.conflicts(f.typ.named(), s.sel)
+	}
+}
+
+// conflicts checks that the selections sharing a response key select the
+// same field.
+func (v *validator) conflicts(t *gqlType, sel []*selection) {
+	for _, c := range (&executor{p: &prepared{doc: v.doc}}).collect(t, sel, nil, map[string]bool{}) {
+		for _, s := range c.sels[1:] {
+			if s.name != c.sels[0].name {
+				v.errorf(s.loc, "%q selects both %s and %s", c.key, c.sels[0].name, s.name)
+			}
+		}
+	}
+}
+
+func (v *validator) directives(ds []*directive) {
+	for _, d := range ds {
+		if d.name != "skip" && d.name != "include" {
+			v.errorf(d.loc, "unknown directive @%s", d.name)
+			continue
+		}
+		if len(d.args) != 1 || d.args[0].name != "if" {
+			v.errorf(d.loc, "directive @%s takes a single argument \"if\"", d.name)
+			continue
+		}
+		v.value(d.args[0].val)
+	}
+}
+
+// value checks that the variables in a literal are defined.
+func (v *validator) value(val *value) {
+	switch val.kind {
+	case varValue:
+		if !v.defined[val.raw] {
+			v.errorf(val.loc, "variable $%s is not defined", val.raw)
+		}
+	case listValue:
+		for _, item := range val.list {
+			v.value(item)
+		}
+	case objectValue:
+		for _, f := range val.fields {
+			v.value(f.val)
+		}
+	}
+}
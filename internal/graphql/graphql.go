@@ -0,0 +1,670 @@
+// Package graphql serves event queries, stats and live subscriptions over
+// GraphQL: queries over HTTP (GET or POST), subscriptions over a WebSocket
+// speaking the graphql-transport-ws protocol. The parser, executor and
+// WebSocket are implemented here, for the small fixed schema built by
+// Server.
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/acl"
+	"github.com/rafaelosorio/go-ingest-service/internal/auth"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/expr"
+	"github.com/rafaelosorio/go-ingest-service/internal/httpx"
+	"github.com/rafaelosorio/go-ingest-service/internal/ids"
+	"github.com/rafaelosorio/go-ingest-service/internal/live"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+var operations = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "graphql_operations_total", Help: "GraphQL operations by type (query, subscription) and result (ok, error)"},
+	[]string{"operation", "result"},
+)
+
+// Collectors returns the GraphQL metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{operations}
+}
+
+const (
+	// MaxEvents caps the events one events query returns.
+	MaxEvents = 1000
+	// maxSubscriptions caps the operations running on one WebSocket.
+	maxSubscriptions = 100
+	// subscriptionBuffer is how many events a subscription may fall behind
+	// before it is ended.
+	subscriptionBuffer = 256
+	initTimeout        = 10 * time.Second
+)
+
+// Server answers GraphQL requests from the store and the live hub. It
+// expects the auth middleware ahead of it, and limits callers to their
+// namespaces' subtrees and the types their ACL lets them read as the REST
+// endpoints do.
+type Server struct {
+	store  storage.Store
+	hub    *live.Hub
+	ids    ids.Codec
+	acls   *acl.List
+	schema *schema
+}
+
+// New returns a server reading store and hub for the callers acls allows;
+// event IDs are the strings codec formats.
+func New(store storage.Store, hub *live.Hub, codec ids.Codec, acls *acl.List) *Server {
+	s := &Server{store: store, hub: hub, ids: codec, acls: acls}
+	s.schema = s.build()
+	return s
+}
+
+// build declares the schema's types with their resolvers.
+func (s *Server) build() *schema {
+	order := &gqlType{kind: enumKind, name: "Order", enumValues: []enumMember{{name: "ASC"}, {name: "DESC"}}}
+	payloadFilter := &gqlType{kind: inputKind, name: "PayloadFilter",
+		desc: "A top-level payload field compared by its scalar rendering, as in ?payload.<field>=.",
+		inputFields: []*inputValue{
+			{name: "field", typ: nonNull(stringType)},
+			{name: "eq", typ: stringType},
+			{name: "ne", typ: stringType},
+		}}
+	filter := &gqlType{kind: inputKind, name: "EventFilter", inputFields: []*inputValue{
+		{name: "types", typ: listOf(nonNull(stringType)), desc: "Type patterns, where * matches any run of characters and ? a single one."},
+		{name: "notTypes", typ: listOf(nonNull(stringType))},
+		{name: "tags", typ: listOf(nonNull(stringType)), desc: "Events carrying every one of these tags."},
+		{name: "correlationId", typ: stringType, desc: "Events of one flow, as in ?correlation_id=."},
+		{name: "causationId", typ: stringType},
+		{name: "since", typ: timeType, desc: "Bounds of received_at, as [since, until)."},
+		{name: "until", typ: timeType},
+		{name: "payload", typ: listOf(nonNull(payloadFilter))},
+	}}
+
+	ev := func(get func(e *event.Event) any) func(context.Context, any, map[string]any) (any, error) {
+		return func(_ context.Context, src any, _ map[string]any) (any, error) { return get(src.(*event.Event)), nil }
+	}
+	optionalTime := func(t *time.Time) any {
+		if t == nil {
+			return nil
+		}
+		return *t
+	}
+	optionalString := func(v string) any {
+		if v == "" {
+			return nil
+		}
+		return v
+	}
+	eventType := &gqlType{kind: objectKind, name: "Event", fields: []*field{
+		{name: "id", typ: nonNull(idType), resolve: ev(func(e *event.Event) any { return s.ids.Format(e.ID) })},
+		{name: "type", typ: nonNull(stringType), resolve: ev(func(e *event.Event) any { return e.Type })},
+		{name: "payload", typ: jsonType, resolve: ev(func(e *event.Event) any {
+			if len(e.Payload) == 0 {
+				return nil
+			}
+			return e.Payload
+		})},
+		{name: "tags", typ: nonNull(listOf(nonNull(stringType))), resolve: ev(func(e *event.Event) any {
+			out := make([]any, len(e.Tags))
+			for i, t := range e.Tags {
+				out[i] = t
+			}
+			return out
+		})},
+		{name: "metadata", typ: jsonType, resolve: ev(func(e *event.Event) any {
+			if len(e.Metadata) == 0 {
+				return nil
+			}
+			return e.Metadata
+		})},
+		{name: "schemaVersion", typ: stringType, resolve: ev(func(e *event.Event) any { return optionalString(e.SchemaVersion) })},
+		{name: "correlationId", typ: stringType, resolve: ev(func(e *event.Event) any { return optionalString(e.CorrelationID) })},
+		{name: "causationId", typ: stringType, resolve: ev(func(e *event.Event) any { return optionalString(e.CausationID) })},
+		{name: "partitionKey", typ: stringType, resolve: ev(func(e *event.Event) any { return optionalString(e.PartitionKey) })},
+		{name: "receivedAt", typ: nonNull(timeType), resolve: ev(func(e *event.Event) any { return e.ReceivedAt })},
+		{name: "occurredAt", typ: timeType, resolve: ev(func(e *event.Event) any { return optionalTime(e.OccurredAt) })},
+		{name: "deliverAt", typ: timeType, resolve: ev(func(e *event.Event) any { return optionalTime(e.DeliverAt) })},
+		{name: "expiresAt", typ: timeType, resolve: ev(func(e *event.Event) any { return optionalTime(e.ExpiresAt) })},
+	}}
+
+	typeStats := &gqlType{kind: objectKind, name: "TypeStats", fields: []*field{
+		{name: "type", typ: nonNull(stringType), resolve: typeStat(func(t *storage.TypeStats) any { return t.Type })},
+		{name: "count", typ: nonNull(intType), resolve: typeStat(func(t *storage.TypeStats) any { return t.Count })},
+		{name: "minPayloadBytes", typ: nonNull(intType), resolve: typeStat(func(t *storage.TypeStats) any { return t.MinPayloadBytes })},
+		{name: "maxPayloadBytes", typ: nonNull(intType), resolve: typeStat(func(t *storage.TypeStats) any { return t.MaxPayloadBytes })},
+		{name: "avgPayloadBytes", typ: nonNull(floatType), resolve: typeStat(func(t *storage.TypeStats) any { return t.AvgPayloadBytes })},
+	}}
+	bucketCount := &gqlType{kind: objectKind, name: "BucketCount", fields: []*field{
+		{name: "start", typ: nonNull(timeType), resolve: func(_ context.Context, src any, _ map[string]any) (any, error) {
+			return src.(*storage.BucketCount).Start, nil
+		}},
+		{name: "count", typ: nonNull(intType), resolve: func(_ context.Context, src any, _ map[string]any) (any, error) {
+			return src.(*storage.BucketCount).Count, nil
+		}},
+	}}
+	st := func(get func(st *storage.Stats) any) func(context.Context, any, map[string]any) (any, error) {
+		return func(_ context.Context, src any, _ map[string]any) (any, error) { return get(src.(*storage.Stats)), nil }
+	}
+	statsType := &gqlType{kind: objectKind, name: "Stats", fields: []*field{
+		{name: "since", typ: nonNull(timeType), resolve: st(func(st *storage.Stats) any { return st.Since })},
+		{name: "until", typ: nonNull(timeType), resolve: st(func(st *storage.Stats) any { return st.Until })},
+		{name: "bucket", typ: nonNull(stringType), desc: "The bucket width, as a duration.",
+			resolve: st(func(st *storage.Stats) any { return st.Bucket.String() })},
+		{name: "total", typ: nonNull(intType), resolve: st(func(st *storage.Stats) any { return st.Total })},
+		{name: "types", typ: nonNull(listOf(nonNull(typeStats))), resolve: st(func(st *storage.Stats) any {
+			out := make([]any, len(st.Types))
+			for i := range st.Types {
+				out[i] = &st.Types[i]
+			}
+			return out
+		})},
+		{name: "buckets", typ: nonNull(listOf(nonNull(bucketCount))), resolve: st(func(st *storage.Stats) any {
+			out := make([]any, len(st.Buckets))
+			for i := range st.Buckets {
+				out[i] = &st.Buckets[i]
+			}
+			return out
+		})},
+	}}
+
+	query := &gqlType{kind: objectKind, name: "Query", fields: []*field{
+		{name: "events", typ: nonNull(listOf(nonNull(eventType))), resolve: s.events,
+			desc: "Events matching filter, newest first unless order is ASC; after and before page by ID.",
+			args: []*inputValue{
+				{name: "filter", typ: filter},
+				{name: "limit", typ: intType, def: "50"},
+				{name: "order", typ: order, def: "DESC"},
+				{name: "after", typ: idType},
+				{name: "before", typ: idType},
+			}},
+		{name: "event", typ: eventType, resolve: s.event,
+			desc: "An event by ID, null when it does not exist or is out of the caller's namespaces.",
+			args: []*inputValue{{name: "id", typ: nonNull(idType)}}},
+		{name: "stats", typ: nonNull(statsType), resolve: s.stats,
+			desc: "Counts of the events matching filter per type and per bucket (a duration such as 1m); the window defaults to the last hour.",
+			args: []*inputValue{
+				{name: "filter", typ: filter},
+				{name: "bucket", typ: stringType, def: `"1m"`},
+			}},
+	}}
+	subscription := &gqlType{kind: objectKind, name: "Subscription", fields: []*field{
+		{name: "events", typ: nonNull(eventType), subscribe: s.subscribe,
+			desc: "Events matching filter as they are accepted; delayed events arrive when released.",
+			args: []*inputValue{
+				{name: "filter", typ: filter},
+				{name: "where", typ: stringType, desc: `An expression the events must satisfy too, e.g. payload.amount > 1000 && payload.region == "eu".`},
+			},
+			resolve: func(_ context.Context, src any, _ map[string]any) (any, error) { return src, nil }},
+	}}
+	return newSchema(query, subscription)
+}
+
+func typeStat(get func(t *storage.TypeStats) any) func(context.Context, any, map[string]any) (any, error) {
+	return func(_ context.Context, src any, _ map[string]any) (any, error) {
+		return get(src.(*storage.TypeStats)), nil
+	}
+}
+
+// query builds the storage query of an EventFilter, scoped to the caller.
+func (s *Server) query(ctx context.Context, args map[string]any) (storage.Query, error) {
+	var q storage.Query
+	f, _ := args["filter"].(map[string]any)
+	strs := func(name string) []string {
+		list, _ := f[name].([]any)
+		out := make([]string, len(list))
+		for i, v := range list {
+			out[i] = v.(string)
+		}
+		return out
+	}
+	q.Types, q.NotTypes, q.Tags = strs("types"), strs("notTypes"), strs("tags")
+	if len(q.Types) == 0 {
+		q.Types = nil
+	}
+	q.CorrelationID, _ = f["correlationId"].(string)
+	q.CausationID, _ = f["causationId"].(string)
+	q.Since, _ = f["since"].(time.Time)
+	q.Until, _ = f["until"].(time.Time)
+	list, _ := f["payload"].([]any)
+	for _, item := range list {
+		pf := item.(map[string]any)
+		name := pf["field"].(string)
+		if eq, ok := pf["eq"].(string); ok {
+			if q.Fields == nil {
+				q.Fields = map[string]string{}
+			}
+			q.Fields[name] = eq
+		}
+		if ne, ok := pf["ne"].(string); ok {
+			if q.NotFields == nil {
+				q.NotFields = map[string]string{}
+			}
+			q.NotFields[name] = ne
+		}
+	}
+	if err := s.acls.Scope(ctx, &q); err != nil {
+		return q, err
+	}
+	p, _ := auth.FromContext(ctx)
+	var err error
+	if q.Types, err = p.ScopeTypes(q.Types); err != nil {
+		return q, err
+	}
+	return q, q.Validate()
+}
+
+func parseID(v any) (int64, error) {
+	return ids.Parse(v.(string))
+}
+
+func (s *Server) events(ctx context.Context, _ any, args map[string]any) (any, error) {
+	q, err := s.query(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	q.Limit = args["limit"].(int)
+	if q.Limit <= 0 || q.Limit > MaxEvents {
+		return nil, fmt.Errorf("limit must be 1-%d", MaxEvents)
+	}
+	q.Ascending = args["order"] == "ASC"
+	if v, ok := args["after"]; ok && v != nil {
+		id, err := parseID(v)
+		if err != nil {
+			return nil, err
+		}
+		q.FromID = id + 1
+	}
+	if v, ok := args["before"]; ok && v != nil {
+		if q.BeforeID, err = parseID(v); err != nil {
+			return nil, err
+		}
+	}
+	list, err := s.store.List(ctx, q)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	out := make([]any, len(list))
+	for i := range list {
+		out[i] = &list[i]
+	}
+	return out, nil
+}
+
+func (s *Server) event(ctx context.Context, _ any, args map[string]any) (any, error) {
+	id, err := parseID(args["id"])
+	if err != nil {
+		return nil, err
+	}
+	e, err := s.store.Get(ctx, id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, storageError(err)
+	}
+	if p, _ := auth.FromContext(ctx); !p.CanAccess(e.Type) || !s.acls.Allowed(p, acl.Read, e.Type) {
+		return nil, nil
+	}
+	return &e, nil
+}
+
+func (s *Server) stats(ctx context.Context, _ any, args map[string]any) (any, error) {
+	q, err := s.query(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := time.ParseDuration(args["bucket"].(string))
+	if err != nil || bucket <= 0 {
+		return nil, errors.New("bucket: want a positive duration")
+	}
+	if q.Until.IsZero() {
+		q.Until = time.Now().UTC()
+	}
+	if q.Since.IsZero() {
+		q.Since = q.Until.Add(-time.Hour).Truncate(bucket)
+	}
+	st, err := s.store.Stats(ctx, q, bucket)
+	if errors.Is(err, storage.ErrInvalidQuery) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, storageError(err)
+	}
+	return st, nil
+}
+
+func (s *Server) subscribe(ctx context.Context, args map[string]any) (<-chan any, func() error, error) {
+	q, err := s.query(ctx, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	var where *expr.Program
+	if src, ok := args["where"].(string); ok && src != "" {
+		if where, err = expr.Compile("subscription", src); err != nil {
+			return nil, nil, err
+		}
+	}
+	sub := s.hub.Subscribe(q, where, subscriptionBuffer)
+	out := make(chan any)
+	go func() {
+		defer close(out)
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-sub.C:
+				if !ok {
+					return
+				}
+				select {
+				case out <- &e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, func() error {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return sub.Err()
+	}, nil
+}
+
+// storageError logs err and hides it from the client, as the REST handlers
+// answer "storage error".
+func storageError(err error) error {
+	log.Error().Err(err).Msg("graphql storage")
+	return errors.New("storage error")
+}
+
+// ServeHTTP answers queries sent with GET or POST (a JSON request, or the
+// query alone as application/graphql) and upgrades WebSocket requests.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isWebSocket(r) {
+		s.serveWebSocket(w, r)
+		return
+	}
+	var req Request
+	switch r.Method {
+	case http.MethodGet:
+		params := r.URL.Query()
+		req.Query, req.OperationName = params.Get("query"), params.Get("operationName")
+		if v := params.Get("variables"); v != "" {
+			if err := decodeJSON([]byte(v), &req.Variables); err != nil {
+				writeResponse(w, http.StatusBadRequest, requestError("variables: %v", err))
+				return
+			}
+		}
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			if httpx.IsTooLarge(err) {
+				httpx.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			httpx.Malformed(w, "could not read body")
+			return
+		}
+		if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/graphql" {
+			req.Query, req.OperationName = string(body), r.URL.Query().Get("operationName")
+		} else if err := decodeJSON(body, &req); err != nil {
+			writeResponse(w, http.StatusBadRequest, requestError("invalid request: %v", err))
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		httpx.Error(w, r.Method+" is not allowed on "+r.URL.Path, http.StatusMethodNotAllowed)
+		return
+	}
+	if req.Query == "" {
+		writeResponse(w, http.StatusBadRequest, requestError("query is required"))
+		return
+	}
+	p, resp := s.schema.prepare(&req)
+	if resp == nil && p.op.kind == "subscription" {
+		resp = requestError("subscriptions are served over a WebSocket (graphql-transport-ws)")
+	}
+	if resp != nil {
+		operations.WithLabelValues("query", "error").Inc()
+		writeResponse(w, http.StatusBadRequest, resp)
+		return
+	}
+	resp = p.execute(r.Context())
+	count("query", resp)
+	writeResponse(w, http.StatusOK, resp)
+}
+
+func count(op string, resp *Response) {
+	result := "ok"
+	if len(resp.Errors) > 0 {
+		result = "error"
+	}
+	operations.WithLabelValues(op, result).Inc()
+}
+
+// decodeJSON decodes numbers as json.Number, as input coercion expects.
+func decodeJSON(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func writeResponse(w http.ResponseWriter, status int, resp *Response) {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		log.Error().Err(err).Msg("encode graphql response")
+		httpx.Error(w, "encoding error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// The graphql-transport-ws protocol: the client opens with connection_init
+// and, once acknowledged, starts operations with subscribe; each result
+// comes as next, a stream end as complete, and a request that could not
+// start as error. Either side may ping.
+
+type wsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type session struct {
+	s     *Server
+	c     *wsConn
+	ctx   context.Context
+	mu    sync.Mutex
+	ops   map[string]context.CancelFunc
+	acked bool
+}
+
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	c, ok := upgrade(w, r, "graphql-transport-ws")
+	if !ok {
+		return
+	}
+	// the request context carries the caller; it must outlive the handshake
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	ss := &session{s: s, c: c, ctx: ctx, ops: map[string]context.CancelFunc{}}
+	defer func() {
+		cancel()
+		_ = c.close(1000, "")
+	}()
+
+	initTimer := time.AfterFunc(initTimeout, func() {
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		if !ss.acked {
+			_ = c.close(4408, "Connection initialisation timeout")
+		}
+	})
+	defer initTimer.Stop()
+	go func() {
+		ticker := time.NewTicker(wsPing)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if c.write(opPing, nil) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		raw, err := c.read()
+		if err != nil {
+			if !errClosed(err) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Debug().Err(err).Msg("graphql websocket read")
+			}
+			return
+		}
+		var m wsMessage
+		if json.Unmarshal(raw, &m) != nil || m.Type == "" {
+			_ = c.close(4400, "Invalid message received")
+			return
+		}
+		if !ss.handle(m) {
+			return
+		}
+	}
+}
+
+// handle acts on a client message, reporting false once the connection was
+// closed.
+func (ss *session) handle(m wsMessage) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	switch m.Type {
+	case "connection_init":
+		if ss.acked {
+			_ = ss.c.close(4429, "Too many initialisation requests")
+			return false
+		}
+		ss.acked = true
+		ss.send(wsMessage{Type: "connection_ack"})
+	case "ping":
+		ss.send(wsMessage{Type: "pong"})
+	case "pong":
+	case "subscribe":
+		if !ss.acked {
+			_ = ss.c.close(4401, "Unauthorized")
+			return false
+		}
+		var req Request
+		if m.ID == "" || decodeJSON(m.Payload, &req) != nil {
+			_ = ss.c.close(4400, "Invalid message received")
+			return false
+		}
+		if _, ok := ss.ops[m.ID]; ok {
+			_ = ss.c.close(4409, "Subscriber for "+m.ID+" already exists")
+			return false
+		}
+		if len(ss.ops) >= maxSubscriptions {
+			ss.send(errorMessage(m.ID, requestError("at most %d operations may run on a connection", maxSubscriptions).Errors))
+			return true
+		}
+		ctx, cancel := context.WithCancel(ss.ctx)
+		ss.ops[m.ID] = cancel
+		go ss.run(ctx, m.ID, &req)
+	case "complete":
+		if cancel, ok := ss.ops[m.ID]; ok {
+			cancel()
+			delete(ss.ops, m.ID)
+		}
+	default:
+		_ = ss.c.close(4400, "Invalid message received")
+		return false
+	}
+	return true
+}
+
+// run executes the operation id, sending its results until it ends or the
+// client completes it.
+func (ss *session) run(ctx context.Context, id string, req *Request) {
+	p, resp := ss.s.schema.prepare(req)
+	if resp != nil {
+		operations.WithLabelValues("subscription", "error").Inc()
+		ss.end(ctx, id, errorMessage(id, resp.Errors))
+		return
+	}
+	if p.op.kind == "query" {
+		resp := p.execute(ctx)
+		count("query", resp)
+		ss.next(ctx, id, resp)
+		ss.end(ctx, id, wsMessage{ID: id, Type: "complete"})
+		return
+	}
+	events, streamErr, resp := p.subscribe(ctx)
+	if resp != nil {
+		operations.WithLabelValues("subscription", "error").Inc()
+		ss.end(ctx, id, errorMessage(id, resp.Errors))
+		return
+	}
+	operations.WithLabelValues("subscription", "ok").Inc()
+	for e := range events {
+		ss.next(ctx, id, p.executeOn(ctx, ss.s.schema.subscription, e))
+	}
+	if err := streamErr(); err != nil {
+		ss.next(ctx, id, &Response{Errors: []*Error{{Message: err.Error()}}})
+	}
+	ss.end(ctx, id, wsMessage{ID: id, Type: "complete"})
+}
+
+func (ss *session) next(ctx context.Context, id string, resp *Response) {
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		log.Error().Err(err).Msg("encode graphql response")
+		return
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ctx.Err() == nil {
+		ss.send(wsMessage{ID: id, Type: "next", Payload: payload})
+	}
+}
+
+// end sends the last message of operation id and forgets it, unless the
+// client completed it first (and may have reused the ID since).
+func (ss *session) end(ctx context.Context, id string, last wsMessage) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	ss.send(last)
+	ss.ops[id]()
+	delete(ss.ops, id)
+}
+
+// errorMessage reports an operation that could not start.
+func errorMessage(id string, errs []*Error) wsMessage {
+	payload, _ := json.Marshal(errs)
+	return wsMessage{ID: id, Type: "error", Payload: payload}
+}
+
+func (ss *session) send(m wsMessage) {
+	b, _ := json.Marshal(m)
+	_ = ss.c.write(opText, b)
+}
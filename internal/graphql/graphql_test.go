@@ -0,0 +1,91 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/acl"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/ids"
+	"github.com/rafaelosorio/go-ingest-service/internal/live"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+func run(t *testing.T, s *Server, query string, vars map[string]any) string {
+	t.Helper()
+	prep, resp := s.schema.prepare(&Request{Query: query, Variables: vars})
+	if resp == nil {
+		resp = prep.execute(context.Background())
+	}
+	out, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestQueries(t *testing.T) {
+	store := storage.NewMemory(4)
+	now := time.Now()
+	for _, e := range []event.Event{
+		{Type: "order.created", Payload: json.RawMessage(`{"amount":10}`), Tags: []string{"eu"}, ReceivedAt: now},
+		{Type: "signup", Payload: json.RawMessage(`{"plan":"pro"}`), ReceivedAt: now},
+		{Type: "order.paid", Payload: json.RawMessage(`{"amount":10}`), ReceivedAt: now},
+	} {
+		if _, err := store.Add(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	acls, err := acl.New(store, config.ACLConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(store, live.NewHub(), ids.Codec{}, acls)
+
+	tests := []struct {
+		name, query string
+		vars        map[string]any
+		want        string
+	}{
+		{"filter and order",
+			`query($t: [String!]) { events(filter: {types: $t}, order: ASC) { id type } }`,
+			map[string]any{"t": []any{"order.*"}},
+			`{"data":{"events":[{"id":"1","type":"order.created"},{"id":"3","type":"order.paid"}]}}`},
+		{"aliases, fragments and directives",
+			`{ a: event(id: 2) { ...f } b: event(id: "99") { id } } fragment f on Event { type tags @skip(if: true) payload }`,
+			nil,
+			`{"data":{"a":{"type":"signup","payload":{"plan":"pro"}},"b":null}}`},
+		{"payload filter and limit",
+			`{ events(filter: {payload: [{field: "amount", eq: "10"}]}, limit: 1) { id __typename } }`,
+			nil,
+			`{"data":{"events":[{"id":"3","__typename":"Event"}]}}`},
+		{"stats",
+			`{ stats(filter: {tags: ["eu"]}) { total types { type count } } }`,
+			nil,
+			`{"data":{"stats":{"total":1,"types":[{"type":"order.created","count":1}]}}}`},
+		{"unknown field",
+			`{ events { nope } }`,
+			nil,
+			`{"errors":[{"message":"cannot query field \"nope\" on type Event","locations":[{"line":1,"column":12}]}]}`},
+		{"missing variable",
+			`query($id: ID!) { event(id: $id) { id } }`,
+			nil,
+			`{"errors":[{"message":"variable $id of type ID! is required","locations":[{"line":1,"column":6}]}]}`},
+		{"invalid argument",
+			`{ events(limit: 1001) { id } }`,
+			nil,
+			`{"data":null,"errors":[{"message":"limit must be 1-1000","locations":[{"line":1,"column":3}],"path":["events"]}]}`},
+		{"introspection",
+			`{ __type(name: "Order") { kind enumValues { name } } }`,
+			nil,
+			`{"data":{"__type":{"kind":"ENUM","enumValues":[{"name":"ASC"},{"name":"DESC"}]}}}`},
+	}
+	for _, tt := range tests {
+		if got := run(t, s, tt.query, tt.vars); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
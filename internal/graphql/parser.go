@@ -0,0 +1,633 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The parser reads executable documents (operations and fragments) of the
+// GraphQL October 2021 specification; type system definitions are refused.
+
+type document struct {
+	operations []*operation
+	fragments  map[string]*fragment
+}
+
+type operation struct {
+	kind       string // query, mutation or subscription
+	name       string
+	vars       []*varDef
+	directives []*directive
+	sel        []*selection
+	loc        location
+}
+
+type varDef struct {
+	name string
+	typ  *typeRef
+	def  *value
+	loc  location
+}
+
+// typeRef is a type as written in a variable definition.
+type typeRef struct {
+	name    string
+	elem    *typeRef // for lists
+	nonNull bool
+}
+
+func (t *typeRef) String() string {
+	s := t.name
+	if t.elem != nil {
+		s = "[" + t.elem.String() + "]"
+	}
+	if t.nonNull {
+		s += "!"
+	}
+	return s
+}
+
+type fragment struct {
+	name       string
+	on         string
+	sel        []*selection
+	loc        location
+	directives []*directive
+}
+
+// selection is a field, a fragment spread (spread set) or an inline
+// fragment (inline set).
+type selection struct {
+	alias, name string
+	args        []*argument
+	sel         []*selection
+	spread      string
+	inline      bool
+	on          string // type condition of an inline fragment, optional
+	directives  []*directive
+	loc         location
+}
+
+// key is the name of the field in the response.
+func (s *selection) key() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+type argument struct {
+	name string
+	val  *value
+	loc  location
+}
+
+type directive struct {
+	name string
+	args []*argument
+	loc  location
+}
+
+type valueKind int
+
+const (
+	varValue valueKind = iota
+	intValue
+	floatValue
+	stringValue
+	boolValue
+	nullValue
+	enumValue
+	listValue
+	objectValue
+)
+
+type value struct {
+	kind   valueKind
+	raw    string // variable and enum name, number, decoded string, true/false
+	list   []*value
+	fields []*argument
+	loc    location
+}
+
+type location struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// tokens
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokPunct
+	tokName
+	tokInt
+	tokFloat
+	tokString
+)
+
+type token struct {
+	kind tokenKind
+	val  string
+	loc  location
+}
+
+type lexer struct {
+	src       string
+	pos       int
+	line, col int
+	tok       token
+}
+
+// syntaxError reports a malformed document.
+type syntaxError struct {
+	msg string
+	loc location
+}
+
+func (e *syntaxError) Error() string {
+	return fmt.Sprintf("syntax error at %d:%d: %s", e.loc.Line, e.loc.Column, e.msg)
+}
+
+func (l *lexer) fail(loc location, format string, args ...any) {
+	panic(&syntaxError{msg: fmt.Sprintf(format, args...), loc: loc})
+}
+
+func (l *lexer) advance(n int) {
+	for _, c := range l.src[l.pos : l.pos+n] {
+		if c == '\n' {
+			l.line, l.col = l.line+1, 1
+		} else {
+			l.col++
+		}
+	}
+	l.pos += n
+}
+
+// next reads the following token into l.tok, skipping whitespace, commas
+// and comments.
+func (l *lexer) next() {
+skip:
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			l.advance(1)
+		case c == '#':
+			end := strings.IndexAny(l.src[l.pos:], "\r\n")
+			if end < 0 {
+				end = len(l.src) - l.pos
+			}
+			l.advance(end)
+		case strings.HasPrefix(l.src[l.pos:], "\ufeff"):
+			l.advance(len("\ufeff"))
+		default:
+			break skip
+		}
+	}
+	loc := location{l.line, l.col}
+	if l.pos == len(l.src) {
+		l.tok = token{kind: tokEOF, loc: loc}
+		return
+	}
+	rest := l.src[l.pos:]
+	c := rest[0]
+	switch {
+	case strings.HasPrefix(rest, "..."):
+		l.tok = token{tokPunct, "...", loc}
+		l.advance(3)
+	case strings.IndexByte("!$&()=:@[]{}|", c) >= 0:
+		l.tok = token{tokPunct, rest[:1], loc}
+		l.advance(1)
+	case c == '_' || isLetter(c):
+		n := 1
+		for n < len(rest) && (rest[n] == '_' || isLetter(rest[n]) || isDigit(rest[n])) {
+			n++
+		}
+		l.tok = token{tokName, rest[:n], loc}
+		l.advance(n)
+	case c == '-' || isDigit(c):
+		l.number(loc)
+	case strings.HasPrefix(rest, `"""`):
+		l.blockString(loc)
+	case c == '"':
+		l.string(loc)
+	default:
+		r, _ := utf8.DecodeRuneInString(rest)
+		l.fail(loc, "unexpected character %q", r)
+	}
+}
+
+func (l *lexer) number(loc location) {
+	rest := l.src[l.pos:]
+	n := 0
+	if rest[n] == '-' {
+		n++
+	}
+	start := n
+	for n < len(rest) && isDigit(rest[n]) {
+		n++
+	}
+	if n == start || (rest[start] == '0' && n-start > 1) {
+		l.fail(loc, "invalid number")
+	}
+	kind := tokInt
+	if n < len(rest) && rest[n] == '.' {
+		kind = tokFloat
+		n++
+		digits := n
+		for n < len(rest) && isDigit(rest[n]) {
+			n++
+		}
+		if n == digits {
+			l.fail(loc, "invalid number")
+		}
+	}
+	if n < len(rest) && (rest[n] == 'e' || rest[n] == 'E') {
+		kind = tokFloat
+		n++
+		if n < len(rest) && (rest[n] == '+' || rest[n] == '-') {
+			n++
+		}
+		digits := n
+		for n < len(rest) && isDigit(rest[n]) {
+			n++
+		}
+		if n == digits {
+			l.fail(loc, "invalid number")
+		}
+	}
+	if n < len(rest) && (rest[n] == '_' || rest[n] == '.' || isLetter(rest[n])) {
+		l.fail(loc, "invalid number")
+	}
+	l.tok = token{kind, rest[:n], loc}
+	l.advance(n)
+}
+
+func (l *lexer) string(loc location) {
+	var b strings.Builder
+	rest := l.src[l.pos:]
+	for i := 1; i < len(rest); {
+		switch c := rest[i]; {
+		case c == '"':
+			l.tok = token{tokString, b.String(), loc}
+			l.advance(i + 1)
+			return
+		case c == '\n' || c == '\r':
+			l.fail(loc, "unterminated string")
+		case c == '\\':
+			if i+1 == len(rest) {
+				l.fail(loc, "unterminated string")
+			}
+			switch e := rest[i+1]; e {
+			case '"', '\\', '/':
+				b.WriteByte(e)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if i+6 > len(rest) {
+					l.fail(loc, "invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(rest[i+2:i+6], 16, 32)
+				if err != nil {
+					l.fail(loc, "invalid unicode escape")
+				}
+				b.WriteRune(rune(r))
+				i += 4
+			default:
+				l.fail(loc, "invalid escape \\%c", e)
+			}
+			i += 2
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	l.fail(loc, "unterminated string")
+}
+
+// blockString reads a """block string""", removing the common indentation
+// and the blank first and last lines.
+func (l *lexer) blockString(loc location) {
+	rest := l.src[l.pos:]
+	var b strings.Builder
+	i := 3
+	for {
+		if i >= len(rest) {
+			l.fail(loc, "unterminated string")
+		}
+		if strings.HasPrefix(rest[i:], `\"""`) {
+			b.WriteString(`"""`)
+			i += 4
+			continue
+		}
+		if strings.HasPrefix(rest[i:], `"""`) {
+			break
+		}
+		b.WriteByte(rest[i])
+		i++
+	}
+	lines := strings.Split(strings.ReplaceAll(strings.ReplaceAll(b.String(), "\r\n", "\n"), "\r", "\n"), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && (indent < 0 || len(line)-len(trimmed) < indent) {
+			indent = len(line) - len(trimmed)
+		}
+	}
+	for j := 1; j < len(lines) && indent > 0; j++ {
+		lines[j] = lines[j][min(indent, len(lines[j])):]
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[0], " \t") == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[len(lines)-1], " \t") == "" {
+		lines = lines[:len(lines)-1]
+	}
+	l.tok = token{tokString, strings.Join(lines, "\n"), loc}
+	l.advance(i + 3)
+}
+
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+
+// parser
+
+type parser struct {
+	lexer
+}
+
+// parse reads src into a document.
+func parse(src string) (doc *document, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			se, ok := r.(*syntaxError)
+			if !ok {
+				panic(r)
+			}
+			doc, err = nil, se
+		}
+	}()
+	p := &parser{lexer{src: src, line: 1, col: 1}}
+	p.next()
+	doc = &document{fragments: map[string]*fragment{}}
+	if p.tok.kind == tokEOF {
+		p.fail(p.tok.loc, "empty document")
+	}
+	for p.tok.kind != tokEOF {
+		switch {
+		case p.peek("{"):
+			doc.operations = append(doc.operations, &operation{kind: "query", loc: p.tok.loc, sel: p.selectionSet()})
+		case p.peekName("query", "mutation", "subscription"):
+			doc.operations = append(doc.operations, p.operation())
+		case p.peekName("fragment"):
+			f := p.fragment()
+			if _, dup := doc.fragments[f.name]; dup {
+				p.fail(f.loc, "fragment %q is defined twice", f.name)
+			}
+			doc.fragments[f.name] = f
+		default:
+			p.fail(p.tok.loc, "expected an operation or a fragment, found %s", p.describe())
+		}
+	}
+	return doc, nil
+}
+
+func (p *parser) describe() string {
+	if p.tok.kind == tokEOF {
+		return "end of document"
+	}
+	return strconv.Quote(p.tok.val)
+}
+
+func (p *parser) peek(punct string) bool {
+	return p.tok.kind == tokPunct && p.tok.val == punct
+}
+
+func (p *parser) peekName(names ...string) bool {
+	if p.tok.kind != tokName {
+		return false
+	}
+	for _, n := range names {
+		if p.tok.val == n {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expect(punct string) {
+	if !p.peek(punct) {
+		p.fail(p.tok.loc, "expected %q, found %s", punct, p.describe())
+	}
+	p.next()
+}
+
+func (p *parser) skip(punct string) bool {
+	if p.peek(punct) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) name() string {
+	if p.tok.kind != tokName {
+		p.fail(p.tok.loc, "expected a name, found %s", p.describe())
+	}
+	n := p.tok.val
+	p.next()
+	return n
+}
+
+func (p *parser) operation() *operation {
+	op := &operation{loc: p.tok.loc, kind: p.name()}
+	if p.tok.kind == tokName {
+		op.name = p.name()
+	}
+	if p.skip("(") {
+		for !p.skip(")") {
+			v := &varDef{loc: p.tok.loc}
+			p.expect("$")
+			v.name = p.name()
+			p.expect(":")
+			v.typ = p.typeRef()
+			if p.skip("=") {
+				v.def = p.value(true)
+			}
+			for p.peek("@") {
+				p.directive() // directives on variables have no effect here
+			}
+			op.vars = append(op.vars, v)
+		}
+	}
+	op.directives = p.directives()
+	op.sel = p.selectionSet()
+	return op
+}
+
+func (p *parser) typeRef() *typeRef {
+	t := &typeRef{}
+	if p.skip("[") {
+		t.elem = p.typeRef()
+		p.expect("]")
+	} else {
+		t.name = p.name()
+	}
+	t.nonNull = p.skip("!")
+	return t
+}
+
+func (p *parser) fragment() *fragment {
+	f := &fragment{loc: p.tok.loc}
+	p.next()
+	if p.peekName("on") {
+		p.fail(p.tok.loc, "a fragment cannot be named \"on\"")
+	}
+	f.name = p.name()
+	if !p.peekName("on") {
+		p.fail(p.tok.loc, "expected \"on\", found %s", p.describe())
+	}
+	p.next()
+	f.on = p.name()
+	f.directives = p.directives()
+	f.sel = p.selectionSet()
+	return f
+}
+
+func (p *parser) selectionSet() []*selection {
+	p.expect("{")
+	var out []*selection
+	for !p.skip("}") {
+		out = append(out, p.selection())
+	}
+	if len(out) == 0 {
+		p.fail(p.tok.loc, "empty selection set")
+	}
+	return out
+}
+
+func (p *parser) selection() *selection {
+	s := &selection{loc: p.tok.loc}
+	if p.skip("...") {
+		if p.tok.kind == tokName && p.tok.val != "on" {
+			s.spread = p.name()
+			s.directives = p.directives()
+			return s
+		}
+		s.inline = true
+		if p.peekName("on") {
+			p.next()
+			s.on = p.name()
+		}
+		s.directives = p.directives()
+		s.sel = p.selectionSet()
+		return s
+	}
+	s.name = p.name()
+	if p.skip(":") {
+		s.alias, s.name = s.name, p.name()
+	}
+	s.args = p.arguments(false)
+	s.directives = p.directives()
+	if p.peek("{") {
+		s.sel = p.selectionSet()
+	}
+	return s
+}
+
+func (p *parser) arguments(constant bool) []*argument {
+	if !p.skip("(") {
+		return nil
+	}
+	var out []*argument
+	for !p.skip(")") {
+		a := &argument{loc: p.tok.loc, name: p.name()}
+		p.expect(":")
+		a.val = p.value(constant)
+		out = append(out, a)
+	}
+	return out
+}
+
+func (p *parser) directives() []*directive {
+	var out []*directive
+	for p.peek("@") {
+		out = append(out, p.directive())
+	}
+	return out
+}
+
+func (p *parser) directive() *directive {
+	d := &directive{loc: p.tok.loc}
+	p.expect("@")
+	d.name = p.name()
+	d.args = p.arguments(false)
+	return d
+}
+
+// value reads a literal; constant ones (variable defaults) may not hold
+// variables.
+func (p *parser) value(constant bool) *value {
+	v := &value{loc: p.tok.loc, raw: p.tok.val}
+	switch p.tok.kind {
+	case tokInt:
+		v.kind = intValue
+	case tokFloat:
+		v.kind = floatValue
+	case tokString:
+		v.kind = stringValue
+	case tokName:
+		switch p.tok.val {
+		case "true", "false":
+			v.kind = boolValue
+		case "null":
+			v.kind = nullValue
+		default:
+			v.kind = enumValue
+		}
+	case tokPunct:
+		switch p.tok.val {
+		case "$":
+			if constant {
+				p.fail(v.loc, "variables are not allowed here")
+			}
+			p.next()
+			v.kind, v.raw = varValue, p.name()
+			return v
+		case "[":
+			p.next()
+			v.kind = listValue
+			for !p.skip("]") {
+				v.list = append(v.list, p.value(constant))
+			}
+			return v
+		case "{":
+			p.next()
+			v.kind = objectValue
+			for !p.skip("}") {
+				f := &argument{loc: p.tok.loc, name: p.name()}
+				p.expect(":")
+				f.val = p.value(constant)
+				v.fields = append(v.fields, f)
+			}
+			return v
+		}
+		fallthrough
+	default:
+		p.fail(v.loc, "expected a value, found %s", p.describe())
+	}
+	p.next()
+	return v
+}
@@ -0,0 +1,552 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The type system is declared in Go: objects list their fields with
+// resolvers, scalars and enums how they serialize and parse. Interfaces and
+// unions are not needed by the schema and not supported.
+
+type kind string
+
+const (
+	scalarKind  kind = "SCALAR"
+	objectKind  kind = "OBJECT"
+	inputKind   kind = "INPUT_OBJECT"
+	enumKind    kind = "ENUM"
+	listKind    kind = "LIST"
+	nonNullKind kind = "NON_NULL"
+)
+
+type gqlType struct {
+	kind        kind
+	name, desc  string
+	fields      []*field      // objects
+	inputFields []*inputValue // input objects
+	enumValues  []enumMember  // enums
+	ofType      *gqlType      // lists and non-null types
+	// serialize returns the JSON form of a resolved scalar.
+	serialize func(v any) (any, error)
+	// parse returns the Go value of a scalar input in its JSON form (with
+	// numbers as json.Number).
+	parse func(v any) (any, error)
+}
+
+type enumMember struct{ name, desc string }
+
+type field struct {
+	name, desc string
+	args       []*inputValue
+	typ        *gqlType
+	// resolve returns the field's value on src with coerced args.
+	resolve func(ctx context.Context, src any, args map[string]any) (any, error)
+	// subscribe starts the event stream of a Subscription field. Each value
+	// received becomes the src of an execution of the selection set; once
+	// the channel closes, the function returned tells why, nil when ctx
+	// ended the stream.
+	subscribe func(ctx context.Context, args map[string]any) (<-chan any, func() error, error)
+}
+
+type inputValue struct {
+	name, desc string
+	typ        *gqlType
+	// def is the default as a GraphQL literal, "" for none.
+	def string
+}
+
+func nonNull(t *gqlType) *gqlType { return &gqlType{kind: nonNullKind, ofType: t} }
+func listOf(t *gqlType) *gqlType  { return &gqlType{kind: listKind, ofType: t} }
+
+// String renders t the way it is written in a document.
+func (t *gqlType) String() string {
+	switch t.kind {
+	case listKind:
+		return "[" + t.ofType.String() + "]"
+	case nonNullKind:
+		return t.ofType.String() + "!"
+	}
+	return t.name
+}
+
+// named returns t without its list and non-null wrappers.
+func (t *gqlType) named() *gqlType {
+	for t.ofType != nil {
+		t = t.ofType
+	}
+	return t
+}
+
+func (t *gqlType) field(name string) *field {
+	for _, f := range t.fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func (t *gqlType) leaf() bool {
+	n := t.named()
+	return n.kind == scalarKind || n.kind == enumKind
+}
+
+func (t *gqlType) input() bool {
+	n := t.named()
+	return n.kind == scalarKind || n.kind == enumKind || n.kind == inputKind
+}
+
+type schema struct {
+	query, subscription *gqlType
+	types               map[string]*gqlType
+}
+
+// newSchema collects every named type reachable from the roots, with the
+// introspection types and fields added.
+func newSchema(query, subscription *gqlType) *schema {
+	s := &schema{query: query, subscription: subscription, types: map[string]*gqlType{}}
+	for _, t := range []*gqlType{intType, floatType, stringType, booleanType, idType} {
+		s.types[t.name] = t
+	}
+	query.fields = append(query.fields, s.metaFields()...)
+	s.collect(query)
+	if subscription != nil {
+		s.collect(subscription)
+	}
+	return s
+}
+
+func (s *schema) collect(t *gqlType) {
+	t = t.named()
+	if _, ok := s.types[t.name]; ok {
+		return
+	}
+	s.types[t.name] = t
+	for _, f := range t.fields {
+		s.collect(f.typ)
+		for _, a := range f.args {
+			s.collect(a.typ)
+		}
+	}
+	for _, f := range t.inputFields {
+		s.collect(f.typ)
+	}
+}
+
+// resolveType returns the schema type written as t, nil for unknown names.
+func (s *schema) resolveType(t *typeRef) *gqlType {
+	var out *gqlType
+	if t.elem != nil {
+		elem := s.resolveType(t.elem)
+		if elem == nil {
+			return nil
+		}
+		out = listOf(elem)
+	} else if out = s.types[t.name]; out == nil {
+		return nil
+	}
+	if t.nonNull {
+		out = nonNull(out)
+	}
+	return out
+}
+
+// Input coercion. Values arrive in their JSON form, from the variables of
+// a request or converted from literals by executor.literal.
+
+// enumLiteral is an enum value written in a document, so that it is not
+// taken for a string.
+type enumLiteral string
+
+func coerce(t *gqlType, v any, path string) (any, error) {
+	if t.kind == nonNullKind {
+		if v == nil {
+			return nil, fmt.Errorf("%s: expected %s, found null", path, t)
+		}
+		return coerce(t.ofType, v, path)
+	}
+	if v == nil {
+		return nil, nil
+	}
+	switch t.kind {
+	case listKind:
+		list, ok := v.([]any)
+		if !ok {
+			list = []any{v}
+		}
+		out := make([]any, len(list))
+		for i, item := range list {
+			var err error
+			if out[i], err = coerce(t.ofType, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case inputKind:
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: expected %s, found %s", path, t, describeValue(v))
+		}
+		for k := range obj {
+			if !slices.ContainsFunc(t.inputFields, func(f *inputValue) bool { return f.name == k }) {
+				return nil, fmt.Errorf("%s: unknown field %q of %s", path, k, t)
+			}
+		}
+		out := make(map[string]any, len(t.inputFields))
+		for _, f := range t.inputFields {
+			fv, ok := obj[f.name]
+			if !ok {
+				if f.def == "" {
+					if f.typ.kind == nonNullKind {
+						return nil, fmt.Errorf("%s: missing field %q of %s", path, f.name, t)
+					}
+					continue
+				}
+				fv = defaultValue(f)
+			}
+			var err error
+			if out[f.name], err = coerce(f.typ, fv, path+"."+f.name); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case enumKind:
+		var name string
+		switch v := v.(type) {
+		case enumLiteral:
+			name = string(v)
+		case string:
+			name = v
+		}
+		if !slices.ContainsFunc(t.enumValues, func(e enumMember) bool { return e.name == name }) {
+			return nil, fmt.Errorf("%s: expected one of %s, found %s", path, enumNames(t), describeValue(v))
+		}
+		return name, nil
+	}
+	out, err := t.parse(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return out, nil
+}
+
+// defaultValue returns the JSON form of the default of f, which was written
+// by the schema and is known to be valid.
+func defaultValue(f *inputValue) any {
+	p := &parser{lexer{src: f.def, line: 1, col: 1}}
+	p.next()
+	v, _ := (&executor{}).literal(p.value(true))
+	return v
+}
+
+func enumNames(t *gqlType) string {
+	names := make([]string, len(t.enumValues))
+	for i, e := range t.enumValues {
+		names[i] = e.name
+	}
+	return strings.Join(names, ", ")
+}
+
+func describeValue(v any) string {
+	switch v := v.(type) {
+	case enumLiteral:
+		return string(v)
+	case string:
+		return strconv.Quote(v)
+	case json.Number:
+		return v.String()
+	case map[string]any:
+		return "an object"
+	case []any:
+		return "a list"
+	}
+	return fmt.Sprint(v)
+}
+
+// Scalars. ID serializes as a string and accepts integers; Int is 32-bit in
+// input but, like most servers, not checked in output, where counts may
+// exceed it.
+
+var (
+	intType = &gqlType{kind: scalarKind, name: "Int",
+		serialize: func(v any) (any, error) { return v, nil },
+		parse: func(v any) (any, error) {
+			n, ok := v.(json.Number)
+			i, err := n.Int64()
+			if !ok || err != nil || i < math.MinInt32 || i > math.MaxInt32 {
+				return nil, fmt.Errorf("expected a 32-bit integer, found %s", describeValue(v))
+			}
+			return int(i), nil
+		},
+	}
+	floatType = &gqlType{kind: scalarKind, name: "Float",
+		serialize: func(v any) (any, error) { return v, nil },
+		parse: func(v any) (any, error) {
+			n, ok := v.(json.Number)
+			f, err := n.Float64()
+			if !ok || err != nil {
+				return nil, fmt.Errorf("expected a number, found %s", describeValue(v))
+			}
+			return f, nil
+		},
+	}
+	stringType = &gqlType{kind: scalarKind, name: "String",
+		serialize: func(v any) (any, error) { return v, nil },
+		parse: func(v any) (any, error) {
+			if s, ok := v.(string); ok {
+				return s, nil
+			}
+			return nil, fmt.Errorf("expected a string, found %s", describeValue(v))
+		},
+	}
+	booleanType = &gqlType{kind: scalarKind, name: "Boolean",
+		serialize: func(v any) (any, error) { return v, nil },
+		parse: func(v any) (any, error) {
+			if b, ok := v.(bool); ok {
+				return b, nil
+			}
+			return nil, fmt.Errorf("expected a boolean, found %s", describeValue(v))
+		},
+	}
+	idType = &gqlType{kind: scalarKind, name: "ID",
+		serialize: func(v any) (any, error) {
+			if id, ok := v.(int64); ok {
+				return strconv.FormatInt(id, 10), nil
+			}
+			return v, nil
+		},
+		parse: func(v any) (any, error) {
+			switch v := v.(type) {
+			case string:
+				return v, nil
+			case json.Number:
+				if _, err := v.Int64(); err == nil {
+					return v.String(), nil
+				}
+			}
+			return nil, fmt.Errorf("expected an ID, found %s", describeValue(v))
+		},
+	}
+	timeType = &gqlType{kind: scalarKind, name: "Time", desc: "An RFC 3339 timestamp.",
+		serialize: func(v any) (any, error) {
+			if t, ok := v.(time.Time); ok {
+				return t.Format(time.RFC3339Nano), nil
+			}
+			return nil, fmt.Errorf("not a time: %T", v)
+		},
+		parse: func(v any) (any, error) {
+			if s, ok := v.(string); ok {
+				if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+					return t, nil
+				}
+			}
+			return nil, fmt.Errorf("expected an RFC 3339 timestamp, found %s", describeValue(v))
+		},
+	}
+	jsonType = &gqlType{kind: scalarKind, name: "JSON", desc: "Any JSON value.",
+		serialize: func(v any) (any, error) { return v, nil },
+		parse:     func(v any) (any, error) { return v, nil },
+	}
+)
+
+// Introspection, as far as tools such as GraphiQL and code generators use
+// it. Nothing is deprecated, so the deprecation fields are constant.
+
+var directives = []struct {
+	name, desc string
+}{
+	{"skip", "Skips the field or fragment when the argument is true."},
+	{"include", "Includes the field or fragment only when the argument is true."},
+}
+
+func (s *schema) metaFields() []*field {
+	var (
+		typeKind = &gqlType{kind: enumKind, name: "__TypeKind", enumValues: []enumMember{
+			{name: "SCALAR"}, {name: "OBJECT"}, {name: "INTERFACE"}, {name: "UNION"},
+			{name: "ENUM"}, {name: "INPUT_OBJECT"}, {name: "LIST"}, {name: "NON_NULL"},
+		}}
+		directiveLocation = &gqlType{kind: enumKind, name: "__DirectiveLocation", enumValues: []enumMember{
+			{name: "QUERY"}, {name: "MUTATION"}, {name: "SUBSCRIPTION"}, {name: "FIELD"},
+			{name: "FRAGMENT_DEFINITION"}, {name: "FRAGMENT_SPREAD"}, {name: "INLINE_FRAGMENT"},
+			{name: "VARIABLE_DEFINITION"}, {name: "SCHEMA"}, {name: "SCALAR"}, {name: "OBJECT"},
+			{name: "FIELD_DEFINITION"}, {name: "ARGUMENT_DEFINITION"}, {name: "INTERFACE"},
+			{name: "UNION"}, {name: "ENUM"}, {name: "ENUM_VALUE"}, {name: "INPUT_OBJECT"},
+			{name: "INPUT_FIELD_DEFINITION"},
+		}}
+		typ        = &gqlType{kind: objectKind, name: "__Type"}
+		fieldType  = &gqlType{kind: objectKind, name: "__Field"}
+		inputType  = &gqlType{kind: objectKind, name: "__InputValue"}
+		enumType   = &gqlType{kind: objectKind, name: "__EnumValue"}
+		directive  = &gqlType{kind: objectKind, name: "__Directive"}
+		schemaType = &gqlType{kind: objectKind, name: "__Schema"}
+	)
+	includeDeprecated := []*inputValue{{name: "includeDeprecated", typ: booleanType, def: "false"}}
+	constant := func(v any) func(context.Context, any, map[string]any) (any, error) {
+		return func(context.Context, any, map[string]any) (any, error) { return v, nil }
+	}
+	notDeprecated := []*field{
+		{name: "isDeprecated", typ: nonNull(booleanType), resolve: constant(false)},
+		{name: "deprecationReason", typ: stringType, resolve: constant(nil)},
+	}
+	str := func(get func(src any) string) func(context.Context, any, map[string]any) (any, error) {
+		return func(_ context.Context, src any, _ map[string]any) (any, error) {
+			if v := get(src); v != "" {
+				return v, nil
+			}
+			return nil, nil
+		}
+	}
+
+	schemaType.fields = []*field{
+		{name: "description", typ: stringType, resolve: constant(nil)},
+		{name: "types", typ: nonNull(listOf(nonNull(typ))), resolve: func(context.Context, any, map[string]any) (any, error) {
+			names := make([]string, 0, len(s.types))
+			for name := range s.types {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			out := make([]any, len(names))
+			for i, name := range names {
+				out[i] = s.types[name]
+			}
+			return out, nil
+		}},
+		{name: "queryType", typ: nonNull(typ), resolve: constant(s.query)},
+		{name: "mutationType", typ: typ, resolve: constant(nil)},
+		{name: "subscriptionType", typ: typ, resolve: func(context.Context, any, map[string]any) (any, error) {
+			if s.subscription == nil {
+				return nil, nil
+			}
+			return s.subscription, nil
+		}},
+		{name: "directives", typ: nonNull(listOf(nonNull(directive))), resolve: func(context.Context, any, map[string]any) (any, error) {
+			out := make([]any, len(directives))
+			for i := range directives {
+				out[i] = &directives[i]
+			}
+			return out, nil
+		}},
+	}
+
+	typ.fields = []*field{
+		{name: "kind", typ: nonNull(typeKind), resolve: func(_ context.Context, src any, _ map[string]any) (any, error) {
+			return string(src.(*gqlType).kind), nil
+		}},
+		{name: "name", typ: stringType, resolve: str(func(src any) string { return src.(*gqlType).name })},
+		{name: "description", typ: stringType, resolve: str(func(src any) string { return src.(*gqlType).desc })},
+		{name: "specifiedByURL", typ: stringType, resolve: constant(nil)},
+		{name: "fields", typ: listOf(nonNull(fieldType)), args: includeDeprecated, resolve: func(_ context.Context, src any, _ map[string]any) (any, error) {
+			t := src.(*gqlType)
+			if t.kind != objectKind {
+				return nil, nil
+			}
+			var out []any
+			for _, f := range t.fields {
+				if !strings.HasPrefix(f.name, "__") {
+					out = append(out, f)
+				}
+			}
+			return out, nil
+		}},
+		{name: "interfaces", typ: listOf(nonNull(typ)), resolve: func(_ context.Context, src any, _ map[string]any) (any, error) {
+			if src.(*gqlType).kind != objectKind {
+				return nil, nil
+			}
+			return []any{}, nil
+		}},
+		{name: "possibleTypes", typ: listOf(nonNull(typ)), resolve: constant(nil)},
+		{name: "enumValues", typ: listOf(nonNull(enumType)), args: includeDeprecated, resolve: func(_ context.Context, src any, _ map[string]any) (any, error) {
+			t := src.(*gqlType)
+			if t.kind != enumKind {
+				return nil, nil
+			}
+			out := make([]any, len(t.enumValues))
+			for i := range t.enumValues {
+				out[i] = &t.enumValues[i]
+			}
+			return out, nil
+		}},
+		{name: "inputFields", typ: listOf(nonNull(inputType)), args: includeDeprecated, resolve: func(_ context.Context, src any, _ map[string]any) (any, error) {
+			t := src.(*gqlType)
+			if t.kind != inputKind {
+				return nil, nil
+			}
+			out := make([]any, len(t.inputFields))
+			for i, f := range t.inputFields {
+				out[i] = f
+			}
+			return out, nil
+		}},
+		{name: "ofType", typ: typ, resolve: func(_ context.Context, src any, _ map[string]any) (any, error) {
+			if t := src.(*gqlType).ofType; t != nil {
+				return t, nil
+			}
+			return nil, nil
+		}},
+	}
+
+	fieldType.fields = append([]*field{
+		{name: "name", typ: nonNull(stringType), resolve: str(func(src any) string { return src.(*field).name })},
+		{name: "description", typ: stringType, resolve: str(func(src any) string { return src.(*field).desc })},
+		{name: "args", typ: nonNull(listOf(nonNull(inputType))), args: includeDeprecated, resolve: func(_ context.Context, src any, _ map[string]any) (any, error) {
+			return inputValues(src.(*field).args), nil
+		}},
+		{name: "type", typ: nonNull(typ), resolve: func(_ context.Context, src any, _ map[string]any) (any, error) {
+			return src.(*field).typ, nil
+		}},
+	}, notDeprecated...)
+
+	inputType.fields = append([]*field{
+		{name: "name", typ: nonNull(stringType), resolve: str(func(src any) string { return src.(*inputValue).name })},
+		{name: "description", typ: stringType, resolve: str(func(src any) string { return src.(*inputValue).desc })},
+		{name: "type", typ: nonNull(typ), resolve: func(_ context.Context, src any, _ map[string]any) (any, error) {
+			return src.(*inputValue).typ, nil
+		}},
+		{name: "defaultValue", typ: stringType, resolve: str(func(src any) string { return src.(*inputValue).def })},
+	}, notDeprecated...)
+
+	enumType.fields = append([]*field{
+		{name: "name", typ: nonNull(stringType), resolve: str(func(src any) string { return src.(*enumMember).name })},
+		{name: "description", typ: stringType, resolve: str(func(src any) string { return src.(*enumMember).desc })},
+	}, notDeprecated...)
+
+	directive.fields = []*field{
+		{name: "name", typ: nonNull(stringType), resolve: str(func(src any) string {
+			return src.(*struct{ name, desc string }).name
+		})},
+		{name: "description", typ: stringType, resolve: str(func(src any) string {
+			return src.(*struct{ name, desc string }).desc
+		})},
+		{name: "locations", typ: nonNull(listOf(nonNull(directiveLocation))), resolve: constant([]any{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"})},
+		{name: "args", typ: nonNull(listOf(nonNull(inputType))), args: includeDeprecated, resolve: constant([]any{
+			&inputValue{name: "if", typ: nonNull(booleanType)},
+		})},
+		{name: "isRepeatable", typ: nonNull(booleanType), resolve: constant(false)},
+	}
+
+	return []*field{
+		{name: "__schema", typ: nonNull(schemaType), resolve: constant(s)},
+		{name: "__type", typ: typ, args: []*inputValue{{name: "name", typ: nonNull(stringType)}},
+			resolve: func(_ context.Context, _ any, args map[string]any) (any, error) {
+				if t, ok := s.types[args["name"].(string)]; ok {
+					return t, nil
+				}
+				return nil, nil
+			}},
+	}
+}
+
+func inputValues(in []*inputValue) []any {
+	out := make([]any, len(in))
+	for i, v := range in {
+		out[i] = v
+	}
+	return out
+}
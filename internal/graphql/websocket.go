@@ -0,0 +1,245 @@
+package graphql
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/httpx"
+)
+
+// The server side of RFC 6455, as much as a text protocol needs: fragmented
+// messages are reassembled, pings answered, and writes serialized. Extensions
+// such as permessage-deflate are not negotiated.
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+const (
+	// wsIdle closes connections that sent nothing, not even a pong to the
+	// pings sent every wsPing, for that long.
+	wsIdle       = 90 * time.Second
+	wsPing       = 30 * time.Second
+	wsWriteLimit = 10 * time.Second
+	// wsMaxMessage caps an incoming message, a GraphQL request.
+	wsMaxMessage = 1 << 20
+)
+
+// closeError is a close frame received from the peer, or one this side
+// sent after a protocol error.
+type closeError struct {
+	code   int
+	reason string
+}
+
+func (e *closeError) Error() string { return fmt.Sprintf("websocket closed: %d %s", e.code, e.reason) }
+
+// isWebSocket reports whether r asks to upgrade to a WebSocket.
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") && headerHas(r.Header, "Connection", "upgrade")
+}
+
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	wmu    sync.Mutex
+	closed bool
+}
+
+// upgrade completes the opening handshake for a client offering
+// subprotocol, answering the request itself when it cannot.
+func upgrade(w http.ResponseWriter, r *http.Request, subprotocol string) (*wsConn, bool) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if raw, err := base64.StdEncoding.DecodeString(key); r.Method != http.MethodGet || err != nil || len(raw) != 16 {
+		httpx.Error(w, "invalid websocket handshake", http.StatusBadRequest)
+		return nil, false
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		httpx.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, false
+	}
+	if !headerHas(r.Header, "Sec-WebSocket-Protocol", subprotocol) {
+		httpx.Error(w, "websocket subprotocol "+subprotocol+" is required", http.StatusBadRequest)
+		return nil, false
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		httpx.Error(w, "websocket upgrade unsupported", http.StatusInternalServerError)
+		return nil, false
+	}
+	// the server's read and write timeouts are for requests, not sessions
+	_ = conn.SetDeadline(time.Time{})
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n" +
+		"Sec-WebSocket-Protocol: " + subprotocol + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, false
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, true
+}
+
+// read returns the next text or binary message, answering pings on the way.
+// A close from the peer is returned as a *closeError, after replying.
+func (c *wsConn) read() ([]byte, error) {
+	var msg []byte
+	started := false
+	for {
+		_ = c.conn.SetReadDeadline(time.Now().Add(wsIdle))
+		var head [2]byte
+		if _, err := io.ReadFull(c.br, head[:]); err != nil {
+			return nil, err
+		}
+		fin, op := head[0]&0x80 != 0, head[0]&0x0f
+		if head[0]&0x70 != 0 || head[1]&0x80 == 0 {
+			// reserved bits without an extension, or an unmasked client frame
+			return nil, c.fail(1002, "protocol error")
+		}
+		n := uint64(head[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return nil, err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return nil, err
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		control := op&0x8 != 0
+		if control && (!fin || n > 125) {
+			return nil, c.fail(1002, "protocol error")
+		}
+		if !control && uint64(len(msg))+n > wsMaxMessage {
+			return nil, c.fail(1009, "message too big")
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch op {
+		case opPing:
+			if err := c.write(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			ce := &closeError{code: 1005}
+			if len(payload) >= 2 {
+				ce.code, ce.reason = int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+			}
+			_ = c.close(1000, "")
+			return nil, ce
+		case opText, opBinary:
+			if started {
+				return nil, c.fail(1002, "protocol error")
+			}
+			started = true
+		case opContinuation:
+			if !started {
+				return nil, c.fail(1002, "protocol error")
+			}
+		default:
+			return nil, c.fail(1002, "protocol error")
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// write sends one unfragmented frame.
+func (c *wsConn) write(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	return c.writeLocked(op, payload)
+}
+
+func (c *wsConn) writeLocked(op byte, payload []byte) error {
+	head := make([]byte, 2, 10+len(payload))
+	head[0] = 0x80 | op
+	switch n := len(payload); {
+	case n < 126:
+		head[1] = byte(n)
+	case n <= 0xffff:
+		head[1] = 126
+		head = binary.BigEndian.AppendUint16(head, uint16(n))
+	default:
+		head[1] = 127
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteLimit))
+	_, err := c.conn.Write(append(head, payload...))
+	return err
+}
+
+// close sends a close frame with code and reason and closes the connection.
+func (c *wsConn) close(code int, reason string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	_ = c.writeLocked(opClose, append(payload, reason...))
+	return c.conn.Close()
+}
+
+// fail closes the connection after a protocol error, returning it.
+func (c *wsConn) fail(code int, reason string) error {
+	_ = c.close(code, reason)
+	return &closeError{code: code, reason: reason}
+}
+
+// errClosed reports whether err only means the connection is gone.
+func errClosed(err error) bool {
+	var ce *closeError
+	return errors.As(err, &ce) || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed)
+}
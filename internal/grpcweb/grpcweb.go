@@ -0,0 +1,151 @@
+// Package grpcweb translates gRPC-Web, the variant of gRPC that browsers
+// can speak over HTTP/1.1 (see PROTOCOL-WEB.md in the gRPC repository),
+// into calls on a grpc.Server running in the process, so browser apps reach
+// the gRPC services without a translating proxy like Envoy in front.
+//
+// The messages are framed the same way in both protocols; what differs is
+// that gRPC-Web carries the trailers (grpc-status and the like) in a last
+// frame of the body, and optionally base64-encodes the whole body for
+// clients that cannot read binary responses.
+package grpcweb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/httpx"
+)
+
+const (
+	contentType     = "application/grpc-web"
+	textContentType = "application/grpc-web-text"
+	// trailerFlag marks the frame holding the trailers.
+	trailerFlag = 0x80
+)
+
+// Handler serves the gRPC-Web requests for the services of srv, in the
+// binary (application/grpc-web, +proto) or the base64 text encoding
+// (application/grpc-web-text); the response is in the request's.
+func Handler(srv *grpc.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ct := strings.ToLower(r.Header.Get("Content-Type"))
+		base, text := contentType, strings.HasPrefix(ct, textContentType)
+		if text {
+			base = textContentType
+		}
+		subtype, ok := strings.CutPrefix(ct, base)
+		if r.Method != http.MethodPost || !ok || (subtype != "" && subtype[0] != '+' && subtype[0] != ';') {
+			httpx.Errorf(http.StatusUnsupportedMediaType, httpx.CodeUnsupportedMediaType, "want a POST of %s or %s", contentType, textContentType).Write(w)
+			return
+		}
+		// the server handler only serves HTTP/2 requests; it does not rely
+		// on anything HTTP/2 offers once the trailers are taken care of
+		req := r.Clone(r.Context())
+		req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2", 2, 0
+		req.Header.Set("Content-Type", "application/grpc"+subtype)
+		if text {
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{base64.NewDecoder(base64.StdEncoding, r.Body), r.Body}
+		}
+		rc := http.NewResponseController(w)
+		// streams read their requests while writing responses
+		_ = rc.EnableFullDuplex()
+		tw := &writer{w: w, rc: rc, header: http.Header{}, contentType: base + subtype, text: text}
+		srv.ServeHTTP(tw, req)
+		tw.finish()
+	})
+}
+
+// writer turns the HTTP/2 response of the gRPC server handler into a
+// gRPC-Web one.
+type writer struct {
+	w           http.ResponseWriter
+	rc          *http.ResponseController
+	header      http.Header
+	contentType string
+	text        bool
+	// enc base64-encodes the chunk being written in text mode; every flush
+	// ends a chunk with its padding, which clients decode chunk by chunk
+	enc         io.WriteCloser
+	wroteHeader bool
+}
+
+func (t *writer) Header() http.Header { return t.header }
+
+// WriteHeader sends the headers but for the trailers, which go in the last
+// frame.
+func (t *writer) WriteHeader(code int) {
+	if t.wroteHeader {
+		return
+	}
+	t.wroteHeader = true
+	h := t.w.Header()
+	for k, v := range t.header {
+		if k != "Trailer" && !strings.HasPrefix(k, http.TrailerPrefix) && !t.trailer(k) {
+			h[k] = v
+		}
+	}
+	h.Set("Content-Type", t.contentType)
+	h.Del("Content-Length")
+	t.w.WriteHeader(code)
+}
+
+func (t *writer) Write(b []byte) (int, error) {
+	t.WriteHeader(http.StatusOK)
+	if !t.text {
+		return t.w.Write(b)
+	}
+	if t.enc == nil {
+		t.enc = base64.NewEncoder(base64.StdEncoding, t.w)
+	}
+	return t.enc.Write(b)
+}
+
+func (t *writer) Flush() {
+	t.WriteHeader(http.StatusOK)
+	if t.enc != nil {
+		_ = t.enc.Close()
+		t.enc = nil
+	}
+	_ = t.rc.Flush()
+}
+
+// trailer reports whether the header k was declared a trailer.
+func (t *writer) trailer(k string) bool {
+	for _, v := range t.header.Values("Trailer") {
+		for name := range strings.SplitSeq(v, ",") {
+			if http.CanonicalHeaderKey(strings.TrimSpace(name)) == k {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// finish writes the trailers the handler set as the last frame.
+func (t *writer) finish() {
+	var b bytes.Buffer
+	for k, vs := range t.header {
+		name, undeclared := strings.CutPrefix(k, http.TrailerPrefix)
+		if !undeclared && !t.trailer(k) {
+			continue
+		}
+		for _, v := range vs {
+			fmt.Fprintf(&b, "%s: %s\r\n", strings.ToLower(name), v)
+		}
+	}
+	frame := make([]byte, 5, 5+b.Len())
+	frame[0] = trailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(b.Len()))
+	_, _ = t.Write(append(frame, b.Bytes()...))
+	t.Flush()
+}
@@ -0,0 +1,84 @@
+package grpcweb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// TestHandler calls grpc.health.v1.Health/Check over HTTP/1.1 in both
+// encodings, and an unknown method, whose status comes in the trailers.
+func TestHandler(t *testing.T) {
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, grpchealth.NewServer())
+	ts := httptest.NewServer(Handler(srv))
+	defer ts.Close()
+
+	// an empty HealthCheckRequest, and a HealthCheckResponse of SERVING
+	request := []byte{0, 0, 0, 0, 0}
+	serving := []byte{0, 0, 0, 0, 2, 0x08, 0x01}
+	for _, tc := range []struct {
+		method, contentType string
+		want                []byte
+		status              string
+	}{
+		{"Check", "application/grpc-web+proto", serving, "grpc-status: 0\r\n"},
+		{"Check", "application/grpc-web-text", serving, "grpc-status: 0\r\n"},
+		{"Nope", "application/grpc-web", nil, "grpc-status: 12\r\n"},
+	} {
+		body := request
+		if strings.HasSuffix(tc.contentType, "-text") {
+			body = []byte(base64.StdEncoding.EncodeToString(request))
+		}
+		res, err := http.Post(ts.URL+"/grpc.health.v1.Health/"+tc.method, tc.contentType, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.Header.Get("Content-Type"); got != tc.contentType {
+			t.Errorf("%s %s: content type %q", tc.method, tc.contentType, got)
+		}
+		if strings.HasSuffix(tc.contentType, "-text") {
+			// every flushed chunk is padded on its own, so decode the
+			// four-character quanta one by one
+			var decoded []byte
+			for q := range slices.Chunk(raw, 4) {
+				b, err := base64.StdEncoding.DecodeString(string(q))
+				if err != nil {
+					t.Fatalf("%s: decode %q: %v", tc.method, raw, err)
+				}
+				decoded = append(decoded, b...)
+			}
+			raw = decoded
+		}
+		data, ok := bytes.CutPrefix(raw, tc.want)
+		if !ok || len(data) < 5 || data[0] != trailerFlag {
+			t.Fatalf("%s %s: body %q", tc.method, tc.contentType, raw)
+		}
+		if trailers := string(data[5:]); !strings.Contains(trailers, tc.status) {
+			t.Errorf("%s %s: trailers %q, want %q", tc.method, tc.contentType, trailers, tc.status)
+		}
+	}
+
+	res, err := http.Post(ts.URL+"/grpc.health.v1.Health/Check", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("JSON request: status %d", res.StatusCode)
+	}
+}
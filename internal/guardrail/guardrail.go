@@ -0,0 +1,173 @@
+// Package guardrail refuses events too large or too oddly shaped for the
+// store and its indexes: oversized payloads, payloads with too many fields
+// or too long field names, and events of a new type once the store holds
+// too many distinct ones.
+package guardrail
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+var (
+	rejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "guardrail_rejections_total", Help: "Events refused by the ingest guardrails by reason (payload_bytes, fields, key_length, types)"},
+		[]string{"reason"},
+	)
+	distinctTypes = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "guardrail_distinct_types", Help: "Distinct event types counted against guardrails.max_types"},
+	)
+)
+
+// Collectors returns the guardrail metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{rejections, distinctTypes}
+}
+
+// The errors Check returns, by limit.
+var (
+	ErrPayloadTooLarge = errors.New("payload too large")
+	ErrTooManyFields   = errors.New("too many payload fields")
+	ErrKeyTooLong      = errors.New("payload field name too long")
+	ErrTooManyTypes    = errors.New("too many event types")
+)
+
+// Guard checks events against the guardrails. Distinct types are those in
+// the store when it started, see Seed, plus those recorded since; types
+// whose events all expired still count until the next restart.
+type Guard struct {
+	cfg config.GuardrailsConfig
+
+	mu    sync.Mutex
+	types map[string]bool
+}
+
+func New(cfg config.GuardrailsConfig) *Guard {
+	return &Guard{cfg: cfg, types: map[string]bool{}}
+}
+
+// CountsTypes reports whether a cap on distinct types is set, and so
+// whether Seed is worth calling.
+func (g *Guard) CountsTypes() bool {
+	return g.cfg.MaxTypes > 0
+}
+
+// Seed counts types, the distinct types already stored.
+func (g *Guard) Seed(types []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, t := range types {
+		g.types[t] = true
+	}
+	distinctTypes.Set(float64(len(g.types)))
+}
+
+// Record counts the type of a stored event. Types are counted once stored,
+// so a batch admitted just under the cap is stored whole.
+func (g *Guard) Record(typ string) {
+	if !g.CountsTypes() {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.types[typ] {
+		g.types[typ] = true
+		distinctTypes.Set(float64(len(g.types)))
+	}
+}
+
+// Check returns an error wrapping one of the Err values when e breaks a
+// guardrail.
+func (g *Guard) Check(e *event.Event) error {
+	if err := g.check(e); err != nil {
+		var reason string
+		switch {
+		case errors.Is(err, ErrPayloadTooLarge):
+			reason = "payload_bytes"
+		case errors.Is(err, ErrTooManyFields):
+			reason = "fields"
+		case errors.Is(err, ErrKeyTooLong):
+			reason = "key_length"
+		default:
+			reason = "types"
+		}
+		rejections.WithLabelValues(reason).Inc()
+		return err
+	}
+	return nil
+}
+
+func (g *Guard) check(e *event.Event) error {
+	if max := g.cfg.MaxPayloadBytes; max > 0 && int64(len(e.Payload)) > max {
+		return fmt.Errorf("%w: %d bytes (max %d)", ErrPayloadTooLarge, len(e.Payload), max)
+	}
+	if g.cfg.MaxFields > 0 || g.cfg.MaxKeyLength > 0 {
+		if err := g.checkFields(e.Payload); err != nil {
+			return err
+		}
+	}
+	if g.CountsTypes() {
+		g.mu.Lock()
+		known, n := g.types[e.Type], len(g.types)
+		g.mu.Unlock()
+		if !known && n >= g.cfg.MaxTypes {
+			return fmt.Errorf("%w: type %q would exceed the %d distinct types allowed", ErrTooManyTypes, e.Type, g.cfg.MaxTypes)
+		}
+	}
+	return nil
+}
+
+// checkFields counts the object members of payload at every depth and
+// measures their names, stopping at the first limit broken. Payloads that
+// are not valid JSON are left to the store to refuse.
+func (g *Guard) checkFields(payload json.RawMessage) error {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	// stack holds, for each open array or object, whether it is an
+	// object whose next token is a member name
+	type open struct{ object, name bool }
+	var stack []open
+	fields := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		var top *open
+		if len(stack) > 0 {
+			top = &stack[len(stack)-1]
+		}
+		if d, ok := tok.(json.Delim); ok && (d == '}' || d == ']') {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		if top != nil && top.object {
+			if top.name {
+				name, _ := tok.(string)
+				fields++
+				if max := g.cfg.MaxFields; max > 0 && fields > max {
+					return fmt.Errorf("%w: more than %d", ErrTooManyFields, max)
+				}
+				if max := g.cfg.MaxKeyLength; max > 0 && len(name) > max {
+					return fmt.Errorf("%w: %d bytes (max %d)", ErrKeyTooLong, len(name), max)
+				}
+				top.name = false
+				continue
+			}
+			top.name = true
+		}
+		switch tok {
+		case json.Delim('{'):
+			stack = append(stack, open{object: true, name: true})
+		case json.Delim('['):
+			stack = append(stack, open{})
+		}
+	}
+}
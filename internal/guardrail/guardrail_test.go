@@ -0,0 +1,43 @@
+package guardrail
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// TestCheck checks each guardrail on its own and that the distinct types
+// are counted once stored.
+func TestCheck(t *testing.T) {
+	g := New(config.GuardrailsConfig{MaxPayloadBytes: 64, MaxFields: 3, MaxKeyLength: 8, MaxTypes: 2})
+	g.Seed([]string{"order.created"})
+	for _, tc := range []struct {
+		typ, payload string
+		want         error
+	}{
+		{"order.created", `{"id":1,"items":[{"sku":"a"}]}`, nil},
+		{"order.created", `"a double-encoded {\"x\":1,\"y\":2,\"z\":3,\"w\":4}"`, nil},
+		{"order.created", `{"note":"` + strings.Repeat("x", 64) + `"}`, ErrPayloadTooLarge},
+		{"order.created", `{"a":1,"b":{"c":2,"d":3}}`, ErrTooManyFields},
+		{"order.created", `[{"a":1},{"b":2},{"c":3},{"d":4}]`, ErrTooManyFields},
+		{"order.created", `{"a":{"customer_id":1}}`, ErrKeyTooLong},
+		{"order.paid", `{}`, nil},
+	} {
+		err := g.Check(&event.Event{Type: tc.typ, Payload: json.RawMessage(tc.payload)})
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s %s: got %v, want %v", tc.typ, tc.payload, err, tc.want)
+		}
+	}
+
+	g.Record("order.paid")
+	if err := g.Check(&event.Event{Type: "order.shipped", Payload: json.RawMessage(`{}`)}); !errors.Is(err, ErrTooManyTypes) {
+		t.Errorf("third type: got %v, want %v", err, ErrTooManyTypes)
+	}
+	if err := g.Check(&event.Event{Type: "order.paid", Payload: json.RawMessage(`{}`)}); err != nil {
+		t.Errorf("recorded type: %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+// Package health tracks the serving state of the instance and exposes it to
+// load balancers over HTTP (liveness/readiness) and the gRPC health protocol.
+package health
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// PreStopTokenHeader carries the token of the preStop hook.
+const PreStopTokenHeader = "X-Prestop-Token"
+
+type State int32
+
+const (
+	Starting State = iota
+	Serving
+	Draining
+)
+
+func (s State) String() string {
+	switch s {
+	case Serving:
+		return "serving"
+	case Draining:
+		return "draining"
+	default:
+		return "starting"
+	}
+}
+
+// Checker holds the current state. Liveness stays green for the whole life of
+// the process; readiness is only green while Serving, so load balancers stop
+// routing new traffic as soon as a rollout begins draining the instance.
+// Startup turns green once the instance first serves and stays green, so a
+// Kubernetes startup probe can hold off the liveness probe however long
+// migrations or warming the hot tier take.
+type Checker struct {
+	cfg     config.HealthConfig
+	state   atomic.Int32
+	started atomic.Bool
+	grpc    *grpchealth.Server
+	// drainStart is when draining began, in Unix nanoseconds, 0 before.
+	drainStart atomic.Int64
+	// pressure, when set, reports the load level and whether the instance
+	// can take traffic at that level.
+	pressure func() (level string, ready bool)
+	// breakers, when set, reports the open circuit breakers and whether
+	// the instance can take traffic with them open.
+	breakers func() (open []string, ready bool)
+}
+
+func New(cfg config.HealthConfig) *Checker {
+	c := &Checker{cfg: cfg, grpc: grpchealth.NewServer()}
+	c.set(Starting)
+	return c
+}
+
+// ReportPressure makes readiness carry the load level from fn in the
+// X-Pressure-Level header, and fail while fn reports not ready. It must be
+// called before serving.
+func (c *Checker) ReportPressure(fn func() (level string, ready bool)) { c.pressure = fn }
+
+// ReportBreakers makes readiness list the open circuit breakers from fn in
+// the X-Open-Breakers header, and fail while fn reports not ready. It must
+// be called before serving.
+func (c *Checker) ReportBreakers(fn func() (open []string, ready bool)) { c.breakers = fn }
+
+func (c *Checker) State() State { return State(c.state.Load()) }
+
+func (c *Checker) SetServing() {
+	c.started.Store(true)
+	c.set(Serving)
+}
+
+func (c *Checker) SetDraining() {
+	c.drainStart.CompareAndSwap(0, time.Now().UnixNano())
+	c.set(Draining)
+}
+
+// Drain turns readiness red, if it is not already, and returns once delay
+// has passed since draining began or ctx ends. A preStop hook and the
+// SIGTERM that follows it both drain, and wait for delay only once between
+// them.
+func (c *Checker) Drain(ctx context.Context, delay time.Duration) {
+	c.SetDraining()
+	t := time.NewTimer(time.Until(time.Unix(0, c.drainStart.Load()).Add(delay)))
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+func (c *Checker) set(s State) {
+	c.state.Store(int32(s))
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if s == Serving {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	// "" is the overall server status per the gRPC health checking protocol.
+	c.grpc.SetServingStatus("", status)
+}
+
+// Liveness reports that the process is up.
+func (c *Checker) Liveness(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// Startup reports whether the instance has finished starting.
+func (c *Checker) Startup(w http.ResponseWriter, _ *http.Request) {
+	if !c.started.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(Starting.String()))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// PreStop drains the instance for a Kubernetes preStop httpGet hook and
+// answers once the drain delay has passed: the pod keeps serving while it
+// leaves the Service endpoints, and the SIGTERM sent after the hook shuts
+// down without waiting again. Nothing undoes a drain, so the hook must
+// carry the configured token in X-Prestop-Token; requests forwarded by a
+// proxy are refused even with it.
+func (c *Checker) PreStop(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Forwarded-For") != "" || r.Header.Get("Forwarded") != "" {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("forwarded"))
+		return
+	}
+	token := r.Header.Get(PreStopTokenHeader)
+	if c.cfg.PreStopToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(c.cfg.PreStopToken)) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("token"))
+		return
+	}
+	c.Drain(r.Context(), c.cfg.DrainDelay)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(Draining.String()))
+}
+
+// Readiness reports whether the instance should receive traffic.
+func (c *Checker) Readiness(w http.ResponseWriter, _ *http.Request) {
+	s := c.State()
+	if s == Serving && c.breakers != nil {
+		open, ready := c.breakers()
+		if len(open) > 0 {
+			w.Header().Set("X-Open-Breakers", strings.Join(open, ", "))
+		}
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("circuit breaker open"))
+			return
+		}
+	}
+	if s == Serving && c.pressure != nil {
+		level, ready := c.pressure()
+		w.Header().Set("X-Pressure-Level", level)
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(level))
+			return
+		}
+	}
+	if s == Serving {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+		return
+	}
+	if c.cfg.EnvoyHeaders {
+		// Tells Envoy's active health checker to fail the host immediately
+		// instead of waiting for the unhealthy threshold.
+		w.Header().Set("x-envoy-immediate-health-check-fail", "true")
+	}
+	code := c.cfg.DrainingStatus
+	if s == Starting {
+		code = http.StatusServiceUnavailable
+	}
+	w.WriteHeader(code)
+	_, _ = w.Write([]byte(s.String()))
+}
+
+// ServeGRPC serves grpc.health.v1.Health on addr until Stop is called.
+func (c *Checker) ServeGRPC(addr string) (stop func(), err error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := grpc.NewServer()
+	c.RegisterGRPC(srv)
+	go func() { _ = srv.Serve(lis) }()
+	return srv.GracefulStop, nil
+}
+
+// RegisterGRPC adds grpc.health.v1.Health to srv, e.g. to serve it over
+// gRPC-Web too.
+func (c *Checker) RegisterGRPC(srv *grpc.Server) {
+	healthpb.RegisterHealthServer(srv, c.grpc)
+}
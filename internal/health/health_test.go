@@ -0,0 +1,70 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+func status(h http.HandlerFunc, header ...string) int {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	h(w, r)
+	return w.Code
+}
+
+// TestStartup stays green from the first time the instance serves, through
+// draining.
+func TestStartup(t *testing.T) {
+	c := New(config.HealthConfig{DrainingStatus: http.StatusServiceUnavailable})
+	if got := status(c.Startup); got != http.StatusServiceUnavailable {
+		t.Errorf("starting: %d", got)
+	}
+	c.SetServing()
+	c.SetDraining()
+	if got := status(c.Startup); got != http.StatusOK {
+		t.Errorf("draining: %d", got)
+	}
+	if got := status(c.Readiness); got != http.StatusServiceUnavailable {
+		t.Errorf("readiness while draining: %d", got)
+	}
+}
+
+// TestPreStop drains for the delay once: the SIGTERM after the hook does
+// not wait again. A request without the token, or forwarded, does not
+// drain.
+func TestPreStop(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	const token = "0123456789abcdef"
+	c := New(config.HealthConfig{DrainingStatus: http.StatusServiceUnavailable, DrainDelay: delay, PreStopToken: token})
+	c.SetServing()
+	for _, header := range [][]string{
+		nil,
+		{PreStopTokenHeader, "0123456789abcdeX"},
+		{PreStopTokenHeader, token, "X-Forwarded-For", "203.0.113.7"},
+	} {
+		if got := status(c.PreStop, header...); got != http.StatusForbidden || c.State() != Serving {
+			t.Fatalf("%v: %d, state %s", header, got, c.State())
+		}
+	}
+
+	start := time.Now()
+	if got := status(c.PreStop, PreStopTokenHeader, token); got != http.StatusOK || c.State() != Draining {
+		t.Fatalf("prestop: %d, state %s", got, c.State())
+	}
+	if waited := time.Since(start); waited < delay {
+		t.Errorf("prestop answered after %s, before the %s delay", waited, delay)
+	}
+	start = time.Now()
+	c.Drain(context.Background(), delay)
+	if waited := time.Since(start); waited > delay/2 {
+		t.Errorf("drain after prestop waited %s again", waited)
+	}
+}
@@ -0,0 +1,119 @@
+// Package httpx holds HTTP middleware and helpers shared by the API handlers.
+package httpx
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// LimitBody caps the raw (on-the-wire) body of requests carrying one at max bytes.
+// Reads past the cap fail with *http.MaxBytesError, see IsTooLarge.
+func LimitBody(max int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if max > 0 && r.Body != nil && hasBody(r.Method) {
+				if r.ContentLength > max {
+					Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+					return
+				}
+				r.Body = http.MaxBytesReader(w, r.Body, max)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Decompress transparently decodes gzip and zstd request bodies according to
+// Content-Encoding, capping the decoded size at max bytes.
+func Decompress(max int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+			var body io.ReadCloser
+			switch enc {
+			case "", "identity":
+				next.ServeHTTP(w, r)
+				return
+			case "gzip", "x-gzip":
+				zr, err := gzip.NewReader(r.Body)
+				if err != nil {
+					if IsTooLarge(err) {
+						Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+						return
+					}
+					Malformed(w, "invalid gzip body")
+					return
+				}
+				body = zr
+			case "zstd":
+				zr, err := zstd.NewReader(r.Body, zstdOptions(max)...)
+				if err != nil {
+					Malformed(w, "invalid zstd body")
+					return
+				}
+				body = zstdBody{zr.IOReadCloser(), max}
+			default:
+				Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+				return
+			}
+			defer body.Close()
+			if max > 0 {
+				body = http.MaxBytesReader(w, body, max)
+			}
+			r.Body = body
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// zstdOptions bounds the memory a zstd body may make the decoder take: a
+// frame header can ask for a window of up to 3.75 TB, and a window larger
+// than max could only be filled past the decoded body cap anyway.
+func zstdOptions(max int64) []zstd.DOption {
+	opts := []zstd.DOption{zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true)}
+	if max > 0 {
+		limit := uint64(max)
+		if limit < zstd.MinWindowSize {
+			limit = zstd.MinWindowSize
+		}
+		opts = append(opts, zstd.WithDecoderMaxWindow(limit), zstd.WithDecoderMaxMemory(limit))
+	}
+	return opts
+}
+
+// zstdBody reports frames the decoder refused for asking for more memory
+// than the cap as too large, like a body decoding past it.
+type zstdBody struct {
+	io.ReadCloser
+	max int64
+}
+
+func (b zstdBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		err = &http.MaxBytesError{Limit: b.max}
+	}
+	return n, err
+}
+
+// IsTooLarge reports whether err was caused by a body exceeding its size cap.
+func IsTooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
+
+func hasBody(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+package httpx
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encodings Compress can produce.
+var Encodings = []string{"zstd", "gzip"}
+
+// Compress encodes responses in the encoding the request's Accept-Encoding
+// prefers, zstd or gzip, ties going to the earlier of prefer. Bodies are
+// held back until they reach minBytes, so small responses go out as they
+// are; larger ones are compressed as the handler writes, and flushes reach
+// the client, so exports stream in constant memory. Responses already
+// encoded, of compressed media types, or without a body are left alone.
+func Compress(minBytes int, prefer []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// protocol upgrades (GraphQL over WebSocket) hijack the connection
+			if r.Header.Get("Upgrade") != "" || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add("Vary", "Accept-Encoding")
+			enc := negotiateEncoding(r.Header.Get("Accept-Encoding"), prefer)
+			if enc == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, encoding: enc, min: minBytes}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// negotiateEncoding picks the encoding out of prefer with the highest
+// quality in the Accept-Encoding header, or "" for none.
+func negotiateEncoding(header string, prefer []string) string {
+	if header == "" {
+		return ""
+	}
+	q := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+		weight := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				var err error
+				if weight, err = strconv.ParseFloat(v, 64); err != nil {
+					weight = 0
+				}
+			}
+		}
+		q[name] = weight
+	}
+	best, bestQ := "", 0.0
+	for _, enc := range prefer {
+		w, ok := q[enc]
+		if !ok {
+			w = q["*"]
+		}
+		if w > bestQ {
+			best, bestQ = enc, w
+		}
+	}
+	return best
+}
+
+// incompressible are media types whose bodies are compressed already.
+var incompressible = []string{"image/", "video/", "audio/", "application/zip", "application/gzip", "application/zstd", "application/x-gzip"}
+
+func compressible(contentType string) bool {
+	ct := strings.ToLower(contentType)
+	return !slices.ContainsFunc(incompressible, func(p string) bool { return strings.HasPrefix(ct, p) })
+}
+
+var (
+	gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+	zstdWriters = sync.Pool{New: func() any {
+		// one goroutine and a small window per response keep memory flat
+		// with many concurrent exports
+		enc, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1), zstd.WithLowerEncoderMem(true), zstd.WithWindowSize(1<<20))
+		return enc
+	}}
+)
+
+// encoder is a pooled gzip or zstd writer.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressWriter buffers the start of a body until it knows whether to
+// compress it: once it holds min bytes, or the handler flushes, it does; a
+// response that ends smaller goes out as written.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	min      int
+
+	status  int
+	decided bool
+	buf     []byte
+	enc     encoder
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.status != 0 {
+		return
+	}
+	c.status = status
+	h := c.Header()
+	switch {
+	case status < 200 || status == http.StatusNoContent || status == http.StatusNotModified,
+		h.Get("Content-Encoding") != "",
+		!compressible(h.Get("Content-Type")):
+		c.passThrough()
+	default:
+		if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil {
+			if n < c.min {
+				c.passThrough()
+			} else {
+				c.compress()
+			}
+		}
+	}
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.decided {
+		c.buf = append(c.buf, p...)
+		if len(c.buf) < c.min {
+			return len(p), nil
+		}
+		if err := c.compress(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if c.enc != nil {
+		return c.enc.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+// Flush commits to compression: a handler that flushes is streaming.
+func (c *compressWriter) Flush() {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.decided {
+		if err := c.compress(); err != nil {
+			return
+		}
+	}
+	if c.enc != nil {
+		_ = c.enc.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the writer underneath.
+func (c *compressWriter) Unwrap() http.ResponseWriter { return c.ResponseWriter }
+
+func (c *compressWriter) passThrough() {
+	c.decided = true
+	c.ResponseWriter.WriteHeader(c.status)
+}
+
+func (c *compressWriter) compress() error {
+	c.decided = true
+	h := c.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", c.encoding)
+	// the compressed body is another representation of the resource
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+	switch c.encoding {
+	case "zstd":
+		z := zstdWriters.Get().(*zstd.Encoder)
+		z.Reset(c.ResponseWriter)
+		c.enc = z
+	default:
+		g := gzipWriters.Get().(*gzip.Writer)
+		g.Reset(c.ResponseWriter)
+		c.enc = g
+	}
+	buf := c.buf
+	c.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := c.enc.Write(buf)
+	return err
+}
+
+// close ends the body: the encoder's trailer, or the held back bytes of a
+// response too small to compress.
+func (c *compressWriter) close() {
+	if !c.decided {
+		if c.status == 0 {
+			// the handler wrote nothing
+			return
+		}
+		c.passThrough()
+		if len(c.buf) > 0 {
+			_, _ = c.ResponseWriter.Write(c.buf)
+		}
+		return
+	}
+	if c.enc == nil {
+		return
+	}
+	_ = c.enc.Close()
+	switch e := c.enc.(type) {
+	case *zstd.Encoder:
+		e.Reset(io.Discard)
+		zstdWriters.Put(e)
+	case *gzip.Writer:
+		e.Reset(io.Discard)
+		gzipWriters.Put(e)
+	}
+	c.enc = nil
+}
@@ -0,0 +1,104 @@
+package httpx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// fetch serves body through Compress, with the given Accept-Encoding and
+// response Content-Type, and returns the response and its decoded body.
+func fetch(t *testing.T, acceptEncoding, contentType string, body []byte, stream bool) (*httptest.ResponseRecorder, []byte) {
+	t.Helper()
+	h := Compress(100, Encodings)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("ETag", `"v1"`)
+		if stream {
+			for chunk := range slices.Chunk(body, 10) {
+				_, _ = w.Write(chunk)
+				w.(http.Flusher).Flush()
+			}
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/events", nil)
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	var dec io.Reader = bytes.NewReader(w.Body.Bytes())
+	switch w.Header().Get("Content-Encoding") {
+	case "gzip":
+		zr, err := gzip.NewReader(dec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec = zr
+	case "zstd":
+		zr, err := zstd.NewReader(dec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		dec = zr
+	}
+	out, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, out
+}
+
+// TestCompress picks the encoding the client prefers, zstd on a tie,
+// leaves bodies under the threshold and compressed media types alone, and
+// always varies on Accept-Encoding.
+func TestCompress(t *testing.T) {
+	large := []byte(strings.Repeat(`{"type":"order.created"}`, 20))
+	small := []byte(`{"type":"order.created"}`)
+	for _, tc := range []struct {
+		name, accept, contentType string
+		body                      []byte
+		stream                    bool
+		want                      string
+	}{
+		{"no header", "", "application/json", large, false, ""},
+		{"gzip", "gzip", "application/json", large, false, "gzip"},
+		{"zstd", "zstd", "application/json", large, false, "zstd"},
+		{"tie", "gzip, zstd", "application/json", large, false, "zstd"},
+		{"quality", "zstd;q=0.5, gzip", "application/json", large, false, "gzip"},
+		{"refused", "zstd;q=0, gzip;q=0", "application/json", large, false, ""},
+		{"wildcard", "*", "application/json", large, false, "zstd"},
+		{"unsupported", "br", "application/json", large, false, ""},
+		{"under the threshold", "gzip", "application/json", small, false, ""},
+		{"compressed already", "gzip", "application/zip", large, false, ""},
+		{"streamed", "gzip", "application/x-ndjson", small, true, "gzip"},
+	} {
+		w, got := fetch(t, tc.accept, tc.contentType, tc.body, tc.stream)
+		if enc := w.Header().Get("Content-Encoding"); enc != tc.want {
+			t.Errorf("%s: encoding %q, want %q", tc.name, enc, tc.want)
+		}
+		if !bytes.Equal(got, tc.body) {
+			t.Errorf("%s: body %q, want %q", tc.name, got, tc.body)
+		}
+		if vary := w.Header().Values("Vary"); len(vary) != 1 || vary[0] != "Accept-Encoding" {
+			t.Errorf("%s: Vary %q", tc.name, vary)
+		}
+		wantETag := `"v1"`
+		if tc.want != "" {
+			wantETag = `W/"v1"`
+		}
+		if etag := w.Header().Get("ETag"); etag != wantETag {
+			t.Errorf("%s: ETag %s, want %s", tc.name, etag, wantETag)
+		}
+	}
+}
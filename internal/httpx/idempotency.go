@@ -0,0 +1,226 @@
+package httpx
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	idemRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "idempotency_requests_total", Help: "Requests with an Idempotency-Key by result (fresh, replayed, conflict)"},
+		[]string{"result"},
+	)
+	idemEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "idempotency_cache_entries", Help: "Idempotency keys remembered"},
+	)
+	idemFalseNegativeWindow = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "idempotency_false_negative_window_seconds",
+		Help: "How long after startup retries of requests answered before it can be applied again",
+	})
+)
+
+// Collectors returns the httpx metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{idemRequests, idemEntries, idemFalseNegativeWindow}
+}
+
+// IdempotencyHeader carries the client-chosen key of a retryable write.
+const IdempotencyHeader = "Idempotency-Key"
+
+// StoredResponse is a finished response kept for replay until Expires.
+type StoredResponse struct {
+	Key     string
+	Status  int
+	Header  http.Header
+	Body    []byte
+	Expires time.Time
+}
+
+// IdempotencyStore persists finished responses so that a restart does not
+// forget the keys already answered.
+type IdempotencyStore interface {
+	SaveResponse(r StoredResponse) error
+	// Responses returns the responses that have not expired yet.
+	Responses() ([]StoredResponse, error)
+}
+
+// IdempotencyCache remembers the responses to requests carrying an
+// Idempotency-Key, in memory and, optionally, in an IdempotencyStore.
+type IdempotencyCache struct {
+	ttl     time.Duration
+	max     int
+	store   IdempotencyStore
+	mu      sync.Mutex
+	entries map[string]*idemEntry
+	order   []string
+}
+
+// NewIdempotencyCache keeps at most max keys for ttl each. store may be nil.
+func NewIdempotencyCache(ttl time.Duration, max int, store IdempotencyStore) *IdempotencyCache {
+	// until Restore, keys answered before this start are unknown
+	idemFalseNegativeWindow.Set(ttl.Seconds())
+	return &IdempotencyCache{ttl: ttl, max: max, store: store, entries: map[string]*idemEntry{}}
+}
+
+// Restore loads the unexpired responses of the store, returning how many.
+// It must be called before the middleware serves requests.
+func (c *IdempotencyCache) Restore() (int, error) {
+	if c.store == nil {
+		return 0, nil
+	}
+	saved, err := c.store.Responses()
+	if err != nil {
+		return 0, err
+	}
+	// evict expects the insertion order to follow expiry
+	slices.SortFunc(saved, func(a, b StoredResponse) int { return a.Expires.Compare(b.Expires) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range saved {
+		if _, ok := c.entries[r.Key]; !ok {
+			c.order = append(c.order, r.Key)
+		}
+		c.entries[r.Key] = &idemEntry{status: r.Status, header: r.Header, body: r.Body, expires: r.Expires, done: true}
+	}
+	c.evict(time.Now())
+	idemFalseNegativeWindow.Set(0)
+	return len(saved), nil
+}
+
+// Middleware replays the stored response of a request whose
+// Idempotency-Key was already seen within ttl, so client retries and hedged
+// writes are applied once. Keys are namespaced by scope (e.g. the caller's
+// identity) and the route. A key still being processed gets 409; 5xx answers
+// are not remembered so the request can be retried.
+func (c *IdempotencyCache) Middleware(scope func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyHeader)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > 255 {
+				Error(w, "idempotency key too long", http.StatusBadRequest)
+				return
+			}
+			key = scope(r) + "\x00" + r.Method + " " + r.URL.Path + "\x00" + key
+			e, fresh := c.begin(key)
+			if !fresh {
+				if e == nil {
+					idemRequests.WithLabelValues("conflict").Inc()
+					Error(w, "request with this idempotency key is in progress", http.StatusConflict)
+					return
+				}
+				idemRequests.WithLabelValues("replayed").Inc()
+				for k, v := range e.header {
+					w.Header()[k] = v
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(e.status)
+				_, _ = w.Write(e.body)
+				return
+			}
+			idemRequests.WithLabelValues("fresh").Inc()
+			rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			if rec.status >= 500 {
+				c.abort(key)
+				return
+			}
+			c.finish(key, &idemEntry{status: rec.status, header: w.Header().Clone(), body: rec.buf.Bytes()})
+		})
+	}
+}
+
+type idemEntry struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+	done    bool
+}
+
+// begin claims key. It returns (nil, true) when the caller should process the
+// request, the finished entry when it can be replayed, or (nil, false) while
+// another request holds the key.
+func (c *IdempotencyCache) begin(key string) (*idemEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if e, ok := c.entries[key]; ok && (!e.done || now.Before(e.expires)) {
+		if !e.done {
+			return nil, false
+		}
+		return e, false
+	}
+	c.evict(now)
+	c.entries[key] = &idemEntry{}
+	c.order = append(c.order, key)
+	idemEntries.Set(float64(len(c.entries)))
+	return nil, true
+}
+
+func (c *IdempotencyCache) finish(key string, e *idemEntry) {
+	c.mu.Lock()
+	e.done = true
+	e.expires = time.Now().Add(c.ttl)
+	c.entries[key] = e
+	c.mu.Unlock()
+	if c.store == nil {
+		return
+	}
+	// a failed save only reopens the key after a restart
+	if err := c.store.SaveResponse(StoredResponse{Key: key, Status: e.status, Header: e.header, Body: e.body, Expires: e.expires}); err != nil {
+		log.Error().Err(err).Msg("persist idempotent response")
+	}
+}
+
+func (c *IdempotencyCache) abort(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+	idemEntries.Set(float64(len(c.entries)))
+}
+
+// evict drops expired keys from the front of the insertion order and the
+// oldest keys beyond max. The caller holds c.mu.
+func (c *IdempotencyCache) evict(now time.Time) {
+loop:
+	for len(c.order) > 0 {
+		k := c.order[0]
+		e, ok := c.entries[k]
+		switch {
+		case !ok:
+		case e.done && !now.Before(e.expires), len(c.order) >= c.max && e.done:
+			delete(c.entries, k)
+		default:
+			break loop
+		}
+		c.order = c.order[1:]
+	}
+	idemEntries.Set(float64(len(c.entries)))
+}
+
+// recorder captures the response while passing it through.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.buf.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,77 @@
+package httpx
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// memResponses is an IdempotencyStore in memory.
+type memResponses []StoredResponse
+
+func (m *memResponses) SaveResponse(r StoredResponse) error {
+	*m = append(*m, r)
+	return nil
+}
+
+func (m *memResponses) Responses() ([]StoredResponse, error) {
+	var out []StoredResponse
+	for _, r := range *m {
+		if time.Now().Before(r.Expires) {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+// TestIdempotencyRestore replays the responses answered before a restart,
+// while a request answered with a 5xx can be retried.
+func TestIdempotencyRestore(t *testing.T) {
+	store := &memResponses{}
+	calls := 0
+	status := http.StatusCreated
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Location", fmt.Sprintf("/v1/events/%d", calls))
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"id":%d}`, calls)
+	})
+	serve := func(c *IdempotencyCache, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/events", nil)
+		r.Header.Set(IdempotencyHeader, key)
+		rec := httptest.NewRecorder()
+		c.Middleware(func(*http.Request) string { return "k1" })(handler).ServeHTTP(rec, r)
+		return rec
+	}
+
+	before := NewIdempotencyCache(time.Minute, 100, store)
+	serve(before, "a")
+	status = http.StatusServiceUnavailable
+	serve(before, "b")
+	if calls != 2 || len(*store) != 1 {
+		t.Fatalf("%d calls, %d saved", calls, len(*store))
+	}
+	after := NewIdempotencyCache(time.Minute, 100, store)
+	if n, err := after.Restore(); err != nil || n != 1 {
+		t.Fatalf("restored %d, %v", n, err)
+	}
+	status = http.StatusCreated
+	for _, tc := range []struct {
+		key      string
+		replayed bool
+		body     string
+	}{
+		{"a", true, `{"id":1}`},
+		{"b", false, `{"id":3}`},
+	} {
+		rec := serve(after, tc.key)
+		if replayed := rec.Header().Get("Idempotent-Replayed") == "true"; replayed != tc.replayed || rec.Code != http.StatusCreated || rec.Body.String() != tc.body {
+			t.Errorf("key %s: %d %s, replayed %v; want %s, replayed %v", tc.key, rec.Code, rec.Body, replayed, tc.body, tc.replayed)
+		}
+	}
+	if rec := serve(after, "a"); rec.Header().Get("Location") != "/v1/events/1" {
+		t.Errorf("replay lost the headers: %v", rec.Header())
+	}
+}
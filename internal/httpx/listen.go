@@ -0,0 +1,51 @@
+package httpx
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// UnixPrefix marks a listen address as the path of a Unix domain socket.
+const UnixPrefix = "unix://"
+
+// IsUnix reports whether addr is a Unix domain socket address.
+func IsUnix(addr string) bool { return strings.HasPrefix(addr, UnixPrefix) }
+
+// Listen opens addr: a TCP host:port, or unix:///path for a Unix domain
+// socket whose file gets mode. A socket file left behind by a previous run
+// is replaced; one a server still answers on is an error. The socket file is
+// removed when the listener is closed.
+func Listen(addr string, mode os.FileMode) (net.Listener, error) {
+	if !IsUnix(addr) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, UnixPrefix)
+	if path == "" {
+		return nil, errors.New("unix socket path is empty")
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
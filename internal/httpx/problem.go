@@ -0,0 +1,118 @@
+package httpx
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Error codes. Clients branch on these, not on messages, so they never
+// change once published.
+const (
+	CodeMalformed            = "MALFORMED_REQUEST"
+	CodeValidation           = "VALIDATION_FAILED"
+	CodeUnauthorized         = "UNAUTHORIZED"
+	CodeForbidden            = "FORBIDDEN"
+	CodeNotFound             = "NOT_FOUND"
+	CodeMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+	CodeConflict             = "CONFLICT"
+	CodeGone                 = "GONE"
+	CodePreconditionFailed   = "PRECONDITION_FAILED"
+	CodeTooLarge             = "PAYLOAD_TOO_LARGE"
+	CodeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+	CodeRateLimited          = "RATE_LIMITED"
+	CodeInternal             = "INTERNAL"
+	CodeUnavailable          = "UNAVAILABLE"
+)
+
+// ProblemContentType is the media type of error responses (RFC 7807).
+const ProblemContentType = "application/problem+json"
+
+// Problem is an API error. It is written as an RFC 7807 problem document
+// whose "error" member carries the code, the message and optional details:
+//
+//	{"type":"about:blank","title":"Bad Request","status":400,"detail":"...",
+//	 "error":{"code":"VALIDATION_FAILED","message":"...","details":["..."]}}
+type Problem struct {
+	Status  int      `json:"-"`
+	Code    string   `json:"code"`
+	Message string   `json:"message"`
+	Details []string `json:"details,omitempty"`
+}
+
+// Errorf returns a problem with the given status and code.
+func Errorf(status int, code, format string, args ...any) *Problem {
+	return &Problem{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *Problem) Error() string { return p.Message }
+
+// Write sends p as the response.
+func (p *Problem) Write(w http.ResponseWriter) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", ProblemContentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	_, _ = w.Write(p.Body())
+}
+
+// Body returns the problem document Write sends, for writers that are not
+// an http.ResponseWriter.
+func (p *Problem) Body() []byte {
+	b, _ := json.Marshal(struct {
+		Type   string   `json:"type"`
+		Title  string   `json:"title"`
+		Status int      `json:"status"`
+		Detail string   `json:"detail"`
+		Error  *Problem `json:"error"`
+	}{"about:blank", http.StatusText(p.Status), p.Status, p.Message, p})
+	return append(b, '\n')
+}
+
+// Error replaces http.Error: it answers with a problem of the given status
+// and the default code for it, see StatusCode.
+func Error(w http.ResponseWriter, msg string, status int) {
+	(&Problem{Status: status, Code: StatusCode(status), Message: msg}).Write(w)
+}
+
+// Malformed answers 400 MALFORMED_REQUEST, for a body that cannot be read or
+// decoded at all; a body that decodes to unacceptable values is answered
+// with Error and 400, i.e. VALIDATION_FAILED.
+func Malformed(w http.ResponseWriter, msg string) {
+	Errorf(http.StatusBadRequest, CodeMalformed, "%s", msg).Write(w)
+}
+
+// StatusCode is the code of problems that have no more specific one.
+func StatusCode(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusGone:
+		return CodeGone
+	case http.StatusPreconditionFailed:
+		return CodePreconditionFailed
+	case http.StatusRequestEntityTooLarge:
+		return CodeTooLarge
+	case http.StatusUnsupportedMediaType:
+		return CodeUnsupportedMediaType
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return CodeValidation
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	}
+	if status >= 500 {
+		return CodeInternal
+	}
+	return CodeValidation
+}
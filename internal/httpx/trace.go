@@ -0,0 +1,28 @@
+package httpx
+
+import (
+	"net/http"
+	"strings"
+)
+
+// TraceID returns the trace ID of a W3C traceparent header
+// ("00-<trace-id>-<span-id>-<flags>"), or "" when absent or malformed.
+func TraceID(r *http.Request) string {
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || !isHex(parts[1]) {
+		return ""
+	}
+	if strings.Trim(parts[1], "0") == "" {
+		return ""
+	}
+	return parts[1]
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
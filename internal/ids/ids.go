@@ -0,0 +1,231 @@
+// Package ids numbers events when the store's own sequence will not do, and
+// converts event IDs to and from their API representation.
+//
+// Generated IDs are Snowflake-style: an int64 holding the milliseconds since
+// Epoch (41 bits, good until 2093), the node that made it (10 bits) and a
+// sequence within the millisecond (12 bits). They sort by time, then node,
+// like the store's sequence sorts by arrival, and do not collide across
+// nodes. The same bits read as a ULID, whose random part is filled with the
+// node, the sequence and a check of the rest, so a ULID converts back to the
+// int64 the store keys events by.
+package ids
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Strategies of the ids config.
+const (
+	Sequence  = "sequence"
+	Snowflake = "snowflake"
+	ULID      = "ulid"
+)
+
+// Epoch is the start of the time in generated IDs: 2024-01-01 UTC, in Unix
+// milliseconds.
+const Epoch int64 = 1704067200000
+
+const (
+	nodeBits  = 10
+	seqBits   = 12
+	nodeShift = seqBits
+	timeShift = nodeBits + seqBits
+	// MaxNode is the highest node number.
+	MaxNode = 1<<nodeBits - 1
+	maxSeq  = 1<<seqBits - 1
+)
+
+// ErrInvalid is returned for a string that is not an event ID.
+var ErrInvalid = errors.New("invalid event ID")
+
+// Generator hands out increasing Snowflake-style IDs for one node.
+type Generator struct {
+	node int64
+	now  func() time.Time
+
+	mu   sync.Mutex
+	last int64
+}
+
+// New returns a generator for node whose IDs are above after, e.g. the
+// newest ID stored, so they keep increasing across restarts and a clock set
+// back.
+func New(node int, after int64) *Generator {
+	return &Generator{node: int64(node), now: time.Now, last: after}
+}
+
+// Next returns the next ID. Within a millisecond the sequence counts up;
+// past its 4096 IDs, or while the clock is behind the last ID, IDs are taken
+// from the following milliseconds.
+func (g *Generator) Next() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ms := max(g.now().UnixMilli()-Epoch, g.last>>timeShift)
+	id := ms<<timeShift | g.node<<nodeShift
+	if id <= g.last {
+		// same millisecond: count on from the last ID if it is ours, else
+		// (a higher node's ID to start after) move to the next one
+		if seq := g.last&maxSeq + 1; g.last&^maxSeq == id && seq <= maxSeq {
+			id |= seq
+		} else {
+			id = (ms+1)<<timeShift | g.node<<nodeShift
+		}
+	}
+	g.last = id
+	return id
+}
+
+// Time returns when a generated ID was made.
+func Time(id int64) time.Time {
+	return time.UnixMilli(id>>timeShift + Epoch).UTC()
+}
+
+// Codec writes event IDs the way the API shows them: JSON numbers by
+// default, or strings, decimal or ULIDs. Parse reads all of them whatever
+// the codec, so clients that kept IDs from before a change still work.
+type Codec struct {
+	// Strings writes IDs as decimal strings, safe from clients that read
+	// JSON numbers as doubles (generated IDs are above 2^53).
+	Strings bool
+	// ULID writes IDs as ULIDs, which are strings too.
+	ULID bool
+}
+
+// Format returns id as a string: its ULID or its decimal digits.
+func (c Codec) Format(id int64) string {
+	if c.ULID {
+		return encodeULID(id)
+	}
+	return strconv.FormatInt(id, 10)
+}
+
+// Value returns id to be encoded as JSON: a number, unless the codec writes
+// strings. There is no event 0, which is nil (null) when IDs are strings.
+func (c Codec) Value(id int64) any {
+	switch {
+	case !c.Strings && !c.ULID:
+		return id
+	case id == 0:
+		return nil
+	}
+	return c.Format(id)
+}
+
+// Values returns Value for each of list.
+func (c Codec) Values(list []int64) []any {
+	out := make([]any, len(list))
+	for i, id := range list {
+		out[i] = c.Value(id)
+	}
+	return out
+}
+
+// Parse reads a positive event ID in decimal or as a ULID.
+func Parse(s string) (int64, error) {
+	if len(s) == ulidLen {
+		return decodeULID(s)
+	}
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("%w %q", ErrInvalid, s)
+	}
+	return id, nil
+}
+
+// Ref is an event ID read from JSON in any form Codec writes it: a number,
+// or a string Parse reads. null and 0, no event, read as 0.
+type Ref int64
+
+func (r *Ref) UnmarshalJSON(b []byte) error {
+	var s string
+	if len(b) > 0 && b[0] == '"' {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+	} else {
+		s = string(b)
+	}
+	if s == "null" || s == "0" {
+		*r = 0
+		return nil
+	}
+	id, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*r = Ref(id)
+	return nil
+}
+
+// Refs converts refs to IDs.
+func Refs(refs []Ref) []int64 {
+	out := make([]int64, len(refs))
+	for i, r := range refs {
+		out[i] = int64(r)
+	}
+	return out
+}
+
+// ULIDs are 26 characters of Crockford's base32 for 128 bits: the Unix
+// milliseconds (48 bits), the node and sequence (22 bits) and the check
+// (58 bits).
+const (
+	ulidLen   = 26
+	checkBits = 58
+	alphabet  = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+func encodeULID(id int64) string {
+	hi := uint64(id>>timeShift+Epoch)<<16 | uint64(id)>>(timeShift-16)&0xffff
+	lo := uint64(id)&(1<<(timeShift-16)-1)<<checkBits | check(id)
+	var b [ulidLen]byte
+	// 130 bits, the two top ones zero, 5 at a time from the end
+	for i := ulidLen - 1; i >= 0; i-- {
+		b[i] = alphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(b[:])
+}
+
+func decodeULID(s string) (int64, error) {
+	var hi, lo uint64
+	for i := range len(s) {
+		v := strings.IndexByte(alphabet, upper(s[i]))
+		if v < 0 || (i == 0 && v > 7) {
+			return 0, fmt.Errorf("%w %q", ErrInvalid, s)
+		}
+		hi = hi<<5 | lo>>59
+		lo = lo<<5 | uint64(v)
+	}
+	ms := int64(hi>>16) - Epoch
+	id := ms<<timeShift | int64(hi&0xffff)<<(timeShift-16) | int64(lo>>checkBits)
+	if ms < 0 || ms>>(63-timeShift) != 0 || id <= 0 || lo&(1<<checkBits-1) != check(id) {
+		return 0, fmt.Errorf("%w %q", ErrInvalid, s)
+	}
+	return id, nil
+}
+
+func upper(c byte) byte {
+	if 'a' <= c && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
+
+// check returns the last 58 bits of a ULID, derived from the ID so typos
+// and made-up ULIDs are refused.
+func check(id int64) uint64 {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(id))
+	sum := sha256.Sum256(b[:])
+	return binary.BigEndian.Uint64(sum[:8]) & (1<<checkBits - 1)
+}
@@ -0,0 +1,89 @@
+package ids
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestNext checks IDs keep increasing within a millisecond, past its
+// sequence, with the clock set back and after another node's ID.
+func TestNext(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	g := New(5, 0)
+	g.now = func() time.Time { return now }
+	var got []int64
+	for range maxSeq + 3 {
+		got = append(got, g.Next())
+	}
+	now = now.Add(-time.Minute)
+	got = append(got, g.Next())
+	if !slices.IsSorted(got) || len(slices.Compact(slices.Clone(got))) != len(got) {
+		t.Fatal("IDs not strictly increasing")
+	}
+	if first := got[0]; Time(first) != now.Add(time.Minute) || first>>nodeShift&MaxNode != 5 || first&maxSeq != 0 {
+		t.Errorf("first ID %d: time %s, node %d, sequence %d", first, Time(first), first>>nodeShift&MaxNode, first&maxSeq)
+	}
+	if last := got[len(got)-1]; Time(last) != now.Add(time.Minute+time.Millisecond) || last&maxSeq != 2 {
+		t.Errorf("ID after the clock went back: time %s, sequence %d", Time(last), last&maxSeq)
+	}
+
+	// node 9's ID in the same millisecond sorts above node 5's first one
+	other := New(9, 0)
+	other.now = g.now
+	after := other.Next()
+	g = New(5, after)
+	g.now = other.now
+	if id := g.Next(); id <= after {
+		t.Errorf("ID %d not above %d", id, after)
+	}
+}
+
+// TestULID round-trips IDs through ULIDs, which sort like the IDs.
+func TestULID(t *testing.T) {
+	c := Codec{ULID: true}
+	g := New(MaxNode, 0)
+	var prev string
+	for _, id := range []int64{1, 42, g.Next(), g.Next(), 1<<63 - 1} {
+		s := c.Format(id)
+		if len(s) != 26 || s <= prev {
+			t.Errorf("ULID %q of %d after %q", s, id, prev)
+		}
+		prev = s
+		for _, in := range []string{s, strings.ToLower(s)} {
+			if got, err := Parse(in); err != nil || got != id {
+				t.Errorf("Parse(%q) = %d, %v, want %d", in, got, err, id)
+			}
+		}
+	}
+	// a changed character fails the check
+	s := c.Format(g.Next())
+	typo := s[:20] + string(alphabet[(strings.IndexByte(alphabet, s[20])+1)%32]) + s[21:]
+	if _, err := Parse(typo); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Parse(%q) = %v, want ErrInvalid", typo, err)
+	}
+}
+
+// TestRef reads IDs written by every codec.
+func TestRef(t *testing.T) {
+	id := New(3, 0).Next()
+	for _, c := range []Codec{{}, {Strings: true}, {ULID: true}} {
+		b, err := json.Marshal(c.Values([]int64{id, 0}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []Ref
+		if err := json.Unmarshal(b, &got); err != nil || !slices.Equal(Refs(got), []int64{id, 0}) {
+			t.Errorf("%+v: %s read as %v, %v", c, b, got, err)
+		}
+	}
+	for _, bad := range []string{`-1`, `"x"`, `1.5`, `true`} {
+		var r Ref
+		if err := json.Unmarshal([]byte(bad), &r); err == nil {
+			t.Errorf("%s read as %d", bad, r)
+		}
+	}
+}
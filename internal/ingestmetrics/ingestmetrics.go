@@ -0,0 +1,93 @@
+// Package ingestmetrics holds the metrics of the internal stages an event
+// goes through, from the ingest queue to the sinks, under one ingest_
+// prefix for a pipeline dashboard. The packages running each stage record
+// them.
+package ingestmetrics
+
+import (
+	"context"
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// QueueDepth is set by the async ingest queue ("async") and the
+	// in-memory sink queues ("sink:<name>").
+	QueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "ingest_queue_depth", Help: "Items waiting in the in-memory queues by queue (async, sink:<name>)"},
+		[]string{"queue"},
+	)
+	// FlushSize and FlushDuration are observed for every batch a sink
+	// publishes, from its queue or the outbox.
+	FlushSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ingest_batch_flush_size",
+			Help:    "Events per batch flushed to a sink",
+			Buckets: []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000},
+		},
+		[]string{"sink"},
+	)
+	FlushDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ingest_batch_flush_duration_seconds",
+			Help:    "Time to flush a batch to a sink",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"sink"},
+	)
+	// WALSyncDuration is observed for every SQLite commit of an event.
+	WALSyncDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "ingest_wal_sync_duration_seconds",
+			Help:    "Time to commit an event to the SQLite WAL, including the checkpoints and their fsyncs run by the commit",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 14),
+		},
+	)
+	// OutboxBacklog and DLQSize are refreshed every outbox poll interval.
+	OutboxBacklog = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "ingest_outbox_backlog", Help: "Pending outbox deliveries by sink"},
+		[]string{"sink"},
+	)
+	DLQSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "ingest_dlq_size", Help: "Dead outbox deliveries by sink"},
+		[]string{"sink"},
+	)
+	// WebhookDuration is observed for every request of a webhook sink.
+	WebhookDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ingest_webhook_delivery_duration_seconds",
+			Help:    "Webhook delivery latency by sink and result (ok, error)",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"sink", "result"},
+	)
+	// Canceled is counted by the stages that give up on an event when its
+	// context ends, see CountCanceled.
+	Canceled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "ingest_canceled_total", Help: "Work given up when its context ended, by stage (pipeline, store, sink) and reason (canceled, deadline)"},
+		[]string{"stage", "reason"},
+	)
+)
+
+// CountCanceled reports whether err is ctx ending, and counts it in
+// Canceled under stage if so: "deadline" when its deadline passed,
+// "canceled" when it was canceled, as when a client goes away.
+func CountCanceled(ctx context.Context, stage string, err error) bool {
+	cause := ctx.Err()
+	if err == nil || cause == nil || !errors.Is(err, cause) {
+		return false
+	}
+	reason := "canceled"
+	if errors.Is(cause, context.DeadlineExceeded) {
+		reason = "deadline"
+	}
+	Canceled.WithLabelValues(stage, reason).Inc()
+	return true
+}
+
+// Collectors returns the pipeline stage metrics for registration by the
+// caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{QueueDepth, FlushSize, FlushDuration, WALSyncDuration, OutboxBacklog, DLQSize, WebhookDuration, Canceled}
+}
@@ -0,0 +1,381 @@
+// Package keyring encrypts the payloads of each tenant's events with a key
+// of the tenant's own, so that destroying the key erases the tenant's data
+// wherever it was stored: the database, snapshots and archives alike.
+//
+// A tenant key has versions. New events are encrypted with the latest, old
+// ones stay readable with the version they were encrypted with. The keys
+// are only ever stored wrapped, by the configured master key or, for keys
+// created with a KMS reference, by a Vault transit key.
+package keyring
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+// Sources of a key version.
+const (
+	// SourceGenerated keys are made by the service.
+	SourceGenerated = "generated"
+	// SourceImported keys are brought by the tenant.
+	SourceImported = "imported"
+	// SourceVault keys are made by the service and wrapped by a Vault
+	// transit key; destroying that key in Vault erases the tenant's data
+	// without the service being involved.
+	SourceVault = "vault"
+)
+
+var (
+	// ErrInvalid is a key request with an unknown source or bad material.
+	ErrInvalid = errors.New("keyring: invalid key")
+	// ErrNoMasterKey refuses generated and imported keys when there is no
+	// master key to wrap them with.
+	ErrNoMasterKey = errors.New("keyring: encryption.master_key is not configured")
+	// ErrNoKMS refuses vault keys when Vault is not configured.
+	ErrNoKMS = errors.New("keyring: encryption.vault is not configured")
+	// ErrUnavailable refuses the events of a tenant whose latest key could
+	// not be unwrapped: they are not stored in the clear instead.
+	ErrUnavailable = errors.New("keyring: tenant key unavailable")
+)
+
+// keySize is the size of every key: AES-256.
+const keySize = 32
+
+var (
+	keysTotal = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tenant_encryption_keys",
+		Help: "Number of tenant encryption key versions loaded, unwrapped or not.",
+	})
+	payloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tenant_payloads_total",
+		Help: "Tenant event payloads encrypted, decrypted, or left unreadable because their key is gone.",
+	}, []string{"result"})
+)
+
+// Collectors returns the keyring metrics for registration.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{keysTotal, payloadsTotal}
+}
+
+// Key describes a key version, never its material.
+type Key struct {
+	Tenant    string    `json:"tenant"`
+	Version   int       `json:"version"`
+	Source    string    `json:"source"`
+	KMSKey    string    `json:"kms_key,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Available is false for a version that could not be unwrapped, e.g.
+	// because Vault was unreachable at startup.
+	Available bool `json:"available"`
+}
+
+// Keyring holds the unwrapped tenant keys.
+type Keyring struct {
+	store  storage.Store
+	master cipher.AEAD
+	vault  *vault
+
+	mu      sync.RWMutex
+	owner   func(typ string) string
+	tenants map[string]*versions
+}
+
+type versions struct {
+	keys  []Key
+	aeads map[int]cipher.AEAD
+}
+
+func (v *versions) latest() (int, cipher.AEAD) {
+	n := v.keys[len(v.keys)-1].Version
+	return n, v.aeads[n]
+}
+
+// Open loads and unwraps the tenant keys of store. A version that cannot be
+// unwrapped is logged and left unavailable rather than failing startup.
+func Open(cfg config.EncryptionConfig, store storage.Store) (*Keyring, error) {
+	k := &Keyring{store: store, tenants: map[string]*versions{}, owner: func(string) string { return "" }}
+	if cfg.MasterKey != "" {
+		raw, err := base64.StdEncoding.DecodeString(cfg.MasterKey)
+		if err != nil {
+			return nil, fmt.Errorf("master key: %w", err)
+		}
+		if k.master, err = newAEAD(raw); err != nil {
+			return nil, fmt.Errorf("master key: %w", err)
+		}
+	}
+	if cfg.Vault.Address != "" {
+		k.vault = newVault(cfg.Vault)
+	}
+	saved, err := store.TenantKeys(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	for _, sk := range saved {
+		aead, err := k.unwrap(sk)
+		if err != nil {
+			log.Error().Err(err).Str("tenant", sk.Tenant).Int("version", sk.Version).Msg("unwrap tenant key")
+		}
+		k.add(sk, aead)
+	}
+	keysTotal.Set(float64(len(saved)))
+	return k, nil
+}
+
+// Owners sets how an event type maps to its tenant, "" for none. Until it
+// is called no payload is encrypted.
+func (k *Keyring) Owners(owner func(typ string) string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.owner = owner
+}
+
+// Create adds a version of tenant's key, the one its new events are
+// encrypted with from then on. Generated and vault keys are random;
+// imported ones are material, 32 bytes. Vault keys are wrapped by the
+// transit key kmsKey, the others by the master key.
+func (k *Keyring) Create(ctx context.Context, tenant, source string, material []byte, kmsKey string) (Key, error) {
+	switch source {
+	case SourceGenerated, SourceVault:
+		if len(material) > 0 {
+			return Key{}, fmt.Errorf("%w: %s keys take no material", ErrInvalid, source)
+		}
+		material = make([]byte, keySize)
+		_, _ = rand.Read(material)
+	case SourceImported:
+		if len(material) != keySize {
+			return Key{}, fmt.Errorf("%w: imported keys must be %d bytes", ErrInvalid, keySize)
+		}
+	default:
+		return Key{}, fmt.Errorf("%w: unknown source %q", ErrInvalid, source)
+	}
+	if (source == SourceVault) != (kmsKey != "") {
+		return Key{}, fmt.Errorf("%w: kms_key goes with, and only with, source vault", ErrInvalid)
+	}
+	aead, err := newAEAD(material)
+	if err != nil {
+		return Key{}, err
+	}
+
+	// one version at a time per keyring, so concurrent creates do not race
+	// for the same number
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	sk := storage.TenantKey{Tenant: tenant, Version: 1, Source: source, KMSKey: kmsKey, CreatedAt: time.Now().UTC()}
+	if v := k.tenants[tenant]; v != nil {
+		sk.Version = v.keys[len(v.keys)-1].Version + 1
+	}
+	if sk.Wrapped, err = k.wrap(sk, material); err != nil {
+		return Key{}, err
+	}
+	if err := k.store.SaveTenantKey(ctx, sk); err != nil {
+		return Key{}, err
+	}
+	key := k.add(sk, aead)
+	keysTotal.Inc()
+	return key, nil
+}
+
+// Keys returns the versions of tenant's key, oldest first.
+func (k *Keyring) Keys(tenant string) []Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	out := []Key{}
+	if v := k.tenants[tenant]; v != nil {
+		out = append(out, v.keys...)
+	}
+	return out
+}
+
+// Destroy deletes every version of tenant's key, returning how many there
+// were. The payloads encrypted with them can no longer be read, and the
+// tenant's new events are stored in the clear until it gets a new key.
+func (k *Keyring) Destroy(ctx context.Context, tenant string) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	v := k.tenants[tenant]
+	if v == nil {
+		return 0, nil
+	}
+	if err := k.store.DeleteTenantKeys(ctx, tenant); err != nil {
+		return 0, err
+	}
+	delete(k.tenants, tenant)
+	keysTotal.Sub(float64(len(v.keys)))
+	return len(v.keys), nil
+}
+
+// add records sk, unwrapped to aead or nil. The caller holds k.mu or is
+// Open.
+func (k *Keyring) add(sk storage.TenantKey, aead cipher.AEAD) Key {
+	v := k.tenants[sk.Tenant]
+	if v == nil {
+		v = &versions{aeads: map[int]cipher.AEAD{}}
+		k.tenants[sk.Tenant] = v
+	}
+	key := Key{Tenant: sk.Tenant, Version: sk.Version, Source: sk.Source, KMSKey: sk.KMSKey, CreatedAt: sk.CreatedAt, Available: aead != nil}
+	v.keys = append(v.keys, key)
+	if aead != nil {
+		v.aeads[sk.Version] = aead
+	}
+	return key
+}
+
+func (k *Keyring) wrap(sk storage.TenantKey, material []byte) ([]byte, error) {
+	if sk.Source == SourceVault {
+		if k.vault == nil {
+			return nil, ErrNoKMS
+		}
+		return k.vault.encrypt(sk.KMSKey, material)
+	}
+	if k.master == nil {
+		return nil, ErrNoMasterKey
+	}
+	return seal(k.master, material, keyID(sk.Tenant, sk.Version)), nil
+}
+
+func (k *Keyring) unwrap(sk storage.TenantKey) (cipher.AEAD, error) {
+	var material []byte
+	var err error
+	switch {
+	case sk.Source == SourceVault && k.vault == nil:
+		return nil, ErrNoKMS
+	case sk.Source == SourceVault:
+		material, err = k.vault.decrypt(sk.KMSKey, sk.Wrapped)
+	case k.master == nil:
+		return nil, ErrNoMasterKey
+	default:
+		material, err = open(k.master, sk.Wrapped, keyID(sk.Tenant, sk.Version))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(material)
+}
+
+// envelope replaces an encrypted payload. Its JSON starts with
+// envelopePrefix, which is how reads tell it from a plain payload.
+type envelope struct {
+	Encrypted struct {
+		Tenant  string `json:"tenant"`
+		Version int    `json:"version"`
+		Data    []byte `json:"data"`
+	} `json:"$encrypted"`
+}
+
+var envelopePrefix = []byte(`{"$encrypted":`)
+
+// Seal encrypts payload when typ belongs to a tenant with a key, returning
+// it unchanged otherwise.
+func (k *Keyring) Seal(typ string, payload json.RawMessage) (json.RawMessage, error) {
+	if len(payload) == 0 {
+		return payload, nil
+	}
+	k.mu.RLock()
+	owner := k.owner
+	k.mu.RUnlock()
+	// the owner is looked up outside k.mu, which is not held across calls
+	// out of the keyring
+	tenant := owner(typ)
+	if tenant == "" {
+		return payload, nil
+	}
+	k.mu.RLock()
+	v := k.tenants[tenant]
+	var n int
+	var aead cipher.AEAD
+	if v != nil {
+		n, aead = v.latest()
+	}
+	k.mu.RUnlock()
+	if v == nil {
+		return payload, nil
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("%w: %s version %d", ErrUnavailable, tenant, n)
+	}
+	var env envelope
+	env.Encrypted.Tenant, env.Encrypted.Version = tenant, n
+	env.Encrypted.Data = seal(aead, payload, keyID(tenant, n))
+	out, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	payloadsTotal.WithLabelValues("encrypted").Inc()
+	return out, nil
+}
+
+// Open decrypts an encrypted payload. One whose key was destroyed, or is
+// unavailable, is returned as stored.
+func (k *Keyring) Open(payload json.RawMessage) json.RawMessage {
+	if !bytes.HasPrefix(payload, envelopePrefix) {
+		return payload
+	}
+	var env envelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		return payload
+	}
+	e := env.Encrypted
+	k.mu.RLock()
+	var aead cipher.AEAD
+	if v := k.tenants[e.Tenant]; v != nil {
+		aead = v.aeads[e.Version]
+	}
+	k.mu.RUnlock()
+	if aead == nil {
+		payloadsTotal.WithLabelValues("unreadable").Inc()
+		return payload
+	}
+	plain, err := open(aead, e.Data, keyID(e.Tenant, e.Version))
+	if err != nil {
+		payloadsTotal.WithLabelValues("unreadable").Inc()
+		return payload
+	}
+	payloadsTotal.WithLabelValues("decrypted").Inc()
+	return plain
+}
+
+// keyID is the additional data of everything sealed with, or wrapping, a
+// key version, so a ciphertext cannot be passed off as another tenant's.
+func keyID(tenant string, version int) []byte {
+	return fmt.Appendf(nil, "%s#%d", tenant, version)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("%w: want %d bytes, got %d", ErrInvalid, keySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal returns the nonce followed by the ciphertext of plain.
+func seal(aead cipher.AEAD, plain, ad []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	_, _ = rand.Read(nonce)
+	return aead.Seal(nonce, nonce, plain, ad)
+}
+
+func open(aead cipher.AEAD, sealed, ad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("keyring: ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], ad)
+}
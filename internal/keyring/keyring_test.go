@@ -0,0 +1,178 @@
+package keyring
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+func owner(typ string) string {
+	if strings.HasPrefix(typ, "acme/") {
+		return "acme"
+	}
+	return ""
+}
+
+// TestStore writes through the keyring: tenant payloads are stored
+// encrypted and read back plain across a rotation, other payloads are left
+// alone, and destroying the keys leaves the ciphertext unreadable.
+func TestStore(t *testing.T) {
+	mem := storage.NewMemory(1)
+	cfg := config.EncryptionConfig{MasterKey: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, keySize))}
+	k, err := Open(cfg, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Owners(owner)
+	s := k.Wrap(mem)
+
+	if _, err := k.Create(context.Background(), "acme", SourceImported, []byte("short"), ""); !errors.Is(err, ErrInvalid) {
+		t.Errorf("short imported key: %v", err)
+	}
+	if _, err := k.Create(context.Background(), "acme", SourceGenerated, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.Add(context.Background(), event.Event{Type: "acme/order", Payload: json.RawMessage(`{"n":1}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first.Payload) != `{"n":1}` {
+		t.Errorf("Add returned payload %s", first.Payload)
+	}
+	if _, err := k.Create(context.Background(), "acme", SourceImported, bytes.Repeat([]byte{1}, keySize), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(context.Background(), event.Event{Type: "acme/order", Payload: json.RawMessage(`{"n":2}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(context.Background(), event.Event{Type: "other", Payload: json.RawMessage(`{"n":3}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := mem.List(context.Background(), storage.Query{Ascending: true})
+	for i, want := range []string{`"version":1`, `"version":2`} {
+		if !strings.Contains(string(raw[i].Payload), want) || strings.Contains(string(raw[i].Payload), `"n"`) {
+			t.Errorf("stored payload %d: %s", i, raw[i].Payload)
+		}
+	}
+	if string(raw[2].Payload) != `{"n":3}` {
+		t.Errorf("untenanted payload stored as %s", raw[2].Payload)
+	}
+	got, _ := s.List(context.Background(), storage.Query{Ascending: true})
+	for i, want := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`} {
+		if string(got[i].Payload) != want {
+			t.Errorf("payload %d read as %s, want %s", i, got[i].Payload, want)
+		}
+	}
+
+	// a restart unwraps the keys from the store
+	k2, err := Open(cfg, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := k2.Wrap(mem).Get(context.Background(), first.ID); string(e.Payload) != `{"n":1}` {
+		t.Errorf("after reopen: %s", e.Payload)
+	}
+	// without the master key the tenant's events are refused, not stored
+	// in the clear
+	k3, err := Open(config.EncryptionConfig{}, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k3.Owners(owner)
+	if ks := k3.Keys("acme"); len(ks) != 2 || ks[1].Available {
+		t.Errorf("keys without the master key: %+v", ks)
+	}
+	if _, err := k3.Wrap(mem).Add(context.Background(), event.Event{Type: "acme/order", Payload: json.RawMessage(`{}`)}); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("add without an unwrapped key: %v", err)
+	}
+
+	if n, err := k.Destroy(context.Background(), "acme"); err != nil || n != 2 {
+		t.Fatalf("destroy: %d, %v", n, err)
+	}
+	if left, _ := mem.TenantKeys(context.Background()); len(left) != 0 {
+		t.Errorf("%d keys left in the store", len(left))
+	}
+	e, _ := s.Get(context.Background(), first.ID)
+	if !bytes.HasPrefix(e.Payload, envelopePrefix) {
+		t.Errorf("payload readable after destroy: %s", e.Payload)
+	}
+}
+
+// TestVault wraps a key with a fake transit engine and unwraps it on
+// reopen.
+func TestVault(t *testing.T) {
+	var mu sync.Mutex
+	wrapped := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "tok" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		var in map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&in)
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/acme":
+			ct := "vault:v1:" + base64.StdEncoding.EncodeToString([]byte(in["plaintext"]))
+			wrapped[ct] = in["plaintext"]
+			_, _ = w.Write([]byte(`{"data":{"ciphertext":"` + ct + `"}}`))
+		case "/v1/transit/decrypt/acme":
+			_, _ = w.Write([]byte(`{"data":{"plaintext":"` + wrapped[in["ciphertext"]] + `"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors":["no handler"]}`))
+		}
+	}))
+	defer srv.Close()
+
+	mem := storage.NewMemory(1)
+	cfg := config.EncryptionConfig{Vault: config.VaultConfig{Address: srv.URL, Token: "tok", Mount: "transit"}}
+	k, err := Open(cfg, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Create(context.Background(), "acme", SourceGenerated, nil, ""); !errors.Is(err, ErrNoMasterKey) {
+		t.Errorf("generated key without a master key: %v", err)
+	}
+	if _, err := k.Create(context.Background(), "acme", SourceVault, nil, "missing"); err == nil {
+		t.Error("unknown transit key accepted")
+	}
+	if _, err := k.Create(context.Background(), "acme", SourceVault, nil, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	k.Owners(owner)
+	e, err := k.Wrap(mem).Add(context.Background(), event.Event{Type: "acme/order", Payload: json.RawMessage(`{"n":1}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k2, err := Open(cfg, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := k2.Wrap(mem).Get(context.Background(), e.ID); string(got.Payload) != `{"n":1}` {
+		t.Errorf("after reopen: %s", got.Payload)
+	}
+	cfg.Vault.Token = "revoked"
+	k3, err := Open(cfg, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := k3.Wrap(mem).Get(context.Background(), e.ID); !bytes.HasPrefix(got.Payload, envelopePrefix) {
+		t.Errorf("readable without Vault access: %s", got.Payload)
+	}
+}
@@ -0,0 +1,133 @@
+package keyring
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+// Store encrypts the payloads of tenant events on their way into a Store
+// and decrypts them on their way out, so everything above it sees plain
+// payloads and everything below only ciphertext. Payload filters and field
+// indexes see the ciphertext too: they do not match encrypted events.
+type Store struct {
+	storage.Store
+	k *Keyring
+}
+
+// Wrap returns s behind k.
+func (k *Keyring) Wrap(s storage.Store) *Store {
+	return &Store{Store: s, k: k}
+}
+
+func (s *Store) Add(ctx context.Context, e event.Event, sinks ...string) (event.Event, error) {
+	plain := e.Payload
+	sealed, err := s.k.Seal(e.Type, e.Payload)
+	if err != nil {
+		return e, err
+	}
+	e.Payload = sealed
+	out, err := s.Store.Add(ctx, e, sinks...)
+	out.Payload = plain
+	return out, err
+}
+
+func (s *Store) List(ctx context.Context, q storage.Query) ([]event.Event, error) {
+	out, err := s.Store.List(ctx, q)
+	s.open(out)
+	return out, err
+}
+
+func (s *Store) Get(ctx context.Context, id int64) (event.Event, error) {
+	out, err := s.Store.Get(ctx, id)
+	out.Payload = s.k.Open(out.Payload)
+	return out, err
+}
+
+func (s *Store) GetMany(ctx context.Context, ids []int64) ([]event.Event, error) {
+	out, err := s.Store.GetMany(ctx, ids)
+	s.open(out)
+	return out, err
+}
+
+func (s *Store) Trash(ctx context.Context, id int64) (event.Event, error) {
+	out, err := s.Store.Trash(ctx, id)
+	out.Payload = s.k.Open(out.Payload)
+	return out, err
+}
+
+func (s *Store) Restore(ctx context.Context, id int64) (event.Event, error) {
+	out, err := s.Store.Restore(ctx, id)
+	out.Payload = s.k.Open(out.Payload)
+	return out, err
+}
+
+func (s *Store) Scheduled(ctx context.Context) ([]event.Event, error) {
+	out, err := s.Store.Scheduled(ctx)
+	s.open(out)
+	return out, err
+}
+
+func (s *Store) Deliveries(ctx context.Context, sink string, now time.Time, limit int, byKey bool) ([]storage.Delivery, error) {
+	out, err := s.Store.Deliveries(ctx, sink, now, limit, byKey)
+	for i := range out {
+		out[i].Event.Payload = s.k.Open(out[i].Event.Payload)
+	}
+	return out, err
+}
+
+func (s *Store) DeadDeliveries(ctx context.Context, sink string, limit int) ([]storage.Delivery, error) {
+	out, err := s.Store.DeadDeliveries(ctx, sink, limit)
+	for i := range out {
+		out[i].Event.Payload = s.k.Open(out[i].Event.Payload)
+	}
+	return out, err
+}
+
+// open decrypts es in place. Stores may hand out events they keep, like
+// the memory store and the hot tier, so each payload is replaced, never
+// written to.
+func (s *Store) open(es []event.Event) {
+	for i := range es {
+		es[i].Payload = s.k.Open(es[i].Payload)
+	}
+}
+
+// Partitions and DropPartitions pass through to the store, see
+// storage.Partitioner.
+func (s *Store) Partitions() ([]storage.Partition, error) {
+	p, ok := s.Store.(storage.Partitioner)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return p.Partitions()
+}
+
+func (s *Store) DropPartitions(before time.Time) ([]storage.Partition, error) {
+	p, ok := s.Store.(storage.Partitioner)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return p.DropPartitions(before)
+}
+
+// Snapshot passes through to the store, see storage.Snapshotter.
+func (s *Store) Snapshot(path string) (int64, error) {
+	sn, ok := s.Store.(storage.Snapshotter)
+	if !ok {
+		return 0, errors.ErrUnsupported
+	}
+	return sn.Snapshot(path)
+}
+
+// FieldIndexes passes through to the store, see storage.FieldIndexer.
+func (s *Store) FieldIndexes() ([]storage.FieldIndex, error) {
+	fi, ok := s.Store.(storage.FieldIndexer)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return fi.FieldIndexes()
+}
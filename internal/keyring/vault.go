@@ -0,0 +1,77 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// vault wraps and unwraps keys with the transit secrets engine of a
+// HashiCorp Vault; the transit key never leaves Vault.
+type vault struct {
+	cfg    config.VaultConfig
+	client *http.Client
+}
+
+func newVault(cfg config.VaultConfig) *vault {
+	return &vault{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (v *vault) encrypt(key string, plain []byte) ([]byte, error) {
+	var out struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := v.call("encrypt", key, map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plain)}, &out); err != nil {
+		return nil, err
+	}
+	return []byte(out.Ciphertext), nil
+}
+
+func (v *vault) decrypt(key string, wrapped []byte) ([]byte, error) {
+	var out struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := v.call("decrypt", key, map[string]string{"ciphertext": string(wrapped)}, &out); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(out.Plaintext)
+}
+
+// call posts in to the transit op of key and decodes the data of the
+// response into out.
+func (v *vault) call(op, key string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	u := strings.TrimSuffix(v.cfg.Address, "/") + "/v1/" + strings.Trim(v.cfg.Mount, "/") + "/" + op + "/" + url.PathEscape(key)
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", v.cfg.Token)
+	res, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault %s: %w", op, err)
+	}
+	defer res.Body.Close()
+	var resp struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil && res.StatusCode == http.StatusOK {
+		return fmt.Errorf("vault %s: decode response: %w", op, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault %s %s: %s: %s", op, key, res.Status, strings.Join(resp.Errors, "; "))
+	}
+	return json.Unmarshal(resp.Data, out)
+}
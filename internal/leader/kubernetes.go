@@ -0,0 +1,198 @@
+package leader
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// serviceAccount is where Kubernetes mounts the pod's API credentials.
+const serviceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// microTime is the layout of the Lease's MicroTime fields.
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// kubernetes is a coordination.k8s.io/v1 Lease, read and written through
+// the API server with the pod's service account, which needs get, create
+// and update on leases in the namespace. Concurrent updates are settled by
+// the resourceVersion: the loser gets 409 Conflict.
+type kubernetes struct {
+	// url is the namespace's leases collection.
+	url    string
+	name   string
+	client *http.Client
+	// token is the path of the service account token, re-read for every
+	// request since the kubelet rotates it.
+	token string
+}
+
+func newKubernetes(cfg config.LeaderConfig) (*kubernetes, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("kubernetes backend: not running in a cluster (KUBERNETES_SERVICE_HOST is not set)")
+	}
+	ns := cfg.Namespace
+	if ns == "" {
+		b, err := os.ReadFile(serviceAccount + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes backend: namespace: %w", err)
+		}
+		ns = strings.TrimSpace(string(b))
+	}
+	ca, err := os.ReadFile(serviceAccount + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes backend: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("kubernetes backend: no certificate in ca.crt")
+	}
+	return &kubernetes{
+		url:  fmt.Sprintf("https://%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", net.JoinHostPort(host, port), ns),
+		name: cfg.Lease,
+		client: &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+		}},
+		token: serviceAccount + "/token",
+	}, nil
+}
+
+type lease struct {
+	APIVersion string          `json:"apiVersion"`
+	Kind       string          `json:"kind"`
+	Metadata   json.RawMessage `json:"metadata"`
+	Spec       leaseSpec       `json:"spec"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// expired reports whether the lease is free at now.
+func (s leaseSpec) expired(now time.Time) bool {
+	if s.HolderIdentity == "" {
+		return true
+	}
+	renewed, err := time.Parse(microTime, s.RenewTime)
+	return err != nil || !now.Before(renewed.Add(time.Duration(s.LeaseDurationSeconds)*time.Second))
+}
+
+func (k *kubernetes) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	spec := leaseSpec{
+		HolderIdentity:       holder,
+		LeaseDurationSeconds: max(int(ttl.Round(time.Second)/time.Second), 1),
+		AcquireTime:          now.UTC().Format(microTime),
+		RenewTime:            now.UTC().Format(microTime),
+	}
+	cur, err := k.get(ctx, k.name)
+	if errors.Is(err, errNotFound) {
+		meta, _ := json.Marshal(map[string]string{"name": k.name})
+		return k.write(ctx, http.MethodPost, k.url, lease{"coordination.k8s.io/v1", "Lease", meta, spec})
+	}
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case cur.Spec.HolderIdentity == holder:
+		spec.AcquireTime, spec.LeaseTransitions = cur.Spec.AcquireTime, cur.Spec.LeaseTransitions
+	case !cur.Spec.expired(now):
+		return false, nil
+	default:
+		spec.LeaseTransitions = cur.Spec.LeaseTransitions + 1
+	}
+	cur.Spec = spec
+	return k.write(ctx, http.MethodPut, k.url+"/"+k.name, cur)
+}
+
+// Release leaves the lease without a holder, for another instance to take
+// at once.
+func (k *kubernetes) Release(ctx context.Context, holder string) error {
+	cur, err := k.get(ctx, k.name)
+	if err != nil || cur.Spec.HolderIdentity != holder {
+		return err
+	}
+	cur.Spec.HolderIdentity, cur.Spec.LeaseDurationSeconds = "", 1
+	cur.Spec.RenewTime = time.Now().UTC().Format(microTime)
+	_, err = k.write(ctx, http.MethodPut, k.url+"/"+k.name, cur)
+	return err
+}
+
+var errNotFound = errors.New("lease not found")
+
+func (k *kubernetes) get(ctx context.Context, name string) (lease, error) {
+	var l lease
+	resp, err := k.do(ctx, http.MethodGet, k.url+"/"+name, nil)
+	if err != nil {
+		return l, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return l, json.NewDecoder(resp.Body).Decode(&l)
+	case http.StatusNotFound:
+		return l, errNotFound
+	default:
+		return l, apiError(resp)
+	}
+}
+
+// write creates or updates the lease, reporting false when another
+// instance wrote it first.
+func (k *kubernetes) write(ctx context.Context, method, url string, l lease) (bool, error) {
+	body, err := json.Marshal(l)
+	if err != nil {
+		return false, err
+	}
+	resp, err := k.do(ctx, method, url, body)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	default:
+		return false, apiError(resp)
+	}
+}
+
+func (k *kubernetes) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	token, err := os.ReadFile(k.token)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return k.client.Do(req)
+}
+
+func apiError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("kubernetes API: %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
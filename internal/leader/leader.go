@@ -0,0 +1,211 @@
+// Package leader elects one instance among those sharing a store to run
+// the singleton background jobs. The leader holds a lease, in the store or
+// in Kubernetes, and renews it every renew interval; when it stops renewing,
+// by crashing or losing the store, another instance takes the lease over
+// once it expires. An instance that shuts down releases its lease, so that
+// failover is immediate.
+//
+// Leases expire by the clocks of the instances (or of the Kubernetes API
+// server), which must agree to well within the lease duration.
+package leader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+var (
+	isLeader = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "leader_is_leader", Help: "Whether this instance holds the leader lease and runs the singleton jobs (1) or not (0)"},
+	)
+	changes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "leader_changes_total", Help: "Leadership changes of this instance by the state entered (leader, follower)"},
+		[]string{"state"},
+	)
+)
+
+// Collectors returns the leader election metrics for registration by the
+// caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{isLeader, changes}
+}
+
+// Lock is a lease shared by the instances.
+type Lock interface {
+	// Acquire takes the lease for holder for ttl, or renews it, reporting
+	// whether holder holds it.
+	Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error)
+	// Release ends the lease if holder holds it.
+	Release(ctx context.Context, holder string) error
+}
+
+// Elector keeps trying to hold the lease. A nil *Elector, as returned
+// without a backend, always leads.
+type Elector struct {
+	cfg     config.LeaderConfig
+	lock    Lock
+	id      string
+	leading atomic.Bool
+
+	mu       sync.Mutex
+	watchers []func(leading bool)
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// Start makes a first attempt at the lease, so that Leading is known when
+// it returns, and keeps renewing or retrying it until Close.
+func Start(cfg config.LeaderConfig, store storage.Store) (*Elector, error) {
+	var lock Lock
+	switch cfg.Backend {
+	case "":
+		return nil, nil
+	case "storage":
+		lock = storeLock{store: store, name: cfg.Lease}
+	case "kubernetes":
+		k, err := newKubernetes(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("leader: %w", err)
+		}
+		lock = k
+	default:
+		return nil, fmt.Errorf("leader: unknown backend %q", cfg.Backend)
+	}
+	id := cfg.Identity
+	if id == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("leader: identity: %w", err)
+		}
+		id = host
+	}
+	e := &Elector{cfg: cfg, lock: lock, id: id, done: make(chan struct{}), stopped: make(chan struct{})}
+	isLeader.Set(0)
+	renewed := e.try(time.Time{})
+	go e.run(renewed)
+	return e, nil
+}
+
+// Identity is the holder name of this instance.
+func (e *Elector) Identity() string {
+	if e == nil {
+		return ""
+	}
+	return e.id
+}
+
+// Leading reports whether this instance should run the singleton jobs.
+func (e *Elector) Leading() bool {
+	return e == nil || e.leading.Load()
+}
+
+// OnChange calls fn, on the elector's goroutine, whenever this instance
+// becomes the leader or stops being it.
+func (e *Elector) OnChange(fn func(leading bool)) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.watchers = append(e.watchers, fn)
+}
+
+// Close stops renewing the lease and releases it when held.
+func (e *Elector) Close() {
+	if e == nil {
+		return
+	}
+	close(e.done)
+	<-e.stopped
+}
+
+func (e *Elector) run(renewed time.Time) {
+	defer close(e.stopped)
+	ticker := time.NewTicker(e.cfg.RenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			if e.Leading() {
+				e.set(false)
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := e.lock.Release(ctx, e.id); err != nil {
+					log.Warn().Err(err).Str("lease", e.cfg.Lease).Msg("release leader lease")
+				}
+				cancel()
+			}
+			return
+		case <-ticker.C:
+			renewed = e.try(renewed)
+		}
+	}
+}
+
+// try takes or renews the lease and returns when it was last renewed. A
+// leader that fails to renew keeps leading until its lease is about to
+// expire, since nobody else can take it before.
+func (e *Elector) try(renewed time.Time) time.Time {
+	ctx, cancel := context.WithTimeout(context.Background(), e.cfg.RenewInterval)
+	defer cancel()
+	start := time.Now()
+	ok, err := e.lock.Acquire(ctx, e.id, e.cfg.LeaseDuration)
+	switch {
+	case err != nil:
+		log.Warn().Err(err).Str("lease", e.cfg.Lease).Bool("leading", e.Leading()).Msg("renew leader lease")
+		if e.Leading() && !start.Add(e.cfg.RenewInterval).Before(renewed.Add(e.cfg.LeaseDuration)) {
+			e.set(false)
+		}
+	case ok:
+		renewed = start
+		e.set(true)
+	default:
+		e.set(false)
+	}
+	return renewed
+}
+
+func (e *Elector) set(leading bool) {
+	if e.leading.Swap(leading) == leading {
+		return
+	}
+	state := "follower"
+	if leading {
+		state = "leader"
+		isLeader.Set(1)
+	} else {
+		isLeader.Set(0)
+	}
+	changes.WithLabelValues(state).Inc()
+	log.Info().Str("lease", e.cfg.Lease).Str("identity", e.id).Bool("leading", leading).Msg("leadership changed")
+	e.mu.Lock()
+	watchers := e.watchers
+	e.mu.Unlock()
+	for _, fn := range watchers {
+		fn(leading)
+	}
+}
+
+// storeLock is a lease row in the store shared by the instances.
+type storeLock struct {
+	store storage.Store
+	name  string
+}
+
+func (l storeLock) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	return l.store.AcquireLease(ctx, l.name, holder, ttl)
+}
+
+func (l storeLock) Release(ctx context.Context, holder string) error {
+	return l.store.ReleaseLease(ctx, l.name, holder)
+}
@@ -0,0 +1,86 @@
+package leader
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+// TestFailover runs two instances against one SQLite file: the first to
+// start leads, and the second takes over once it releases the lease, or
+// once the lease expires when it stops renewing.
+func TestFailover(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "events.db")
+	open := func() storage.Store {
+		s, err := storage.OpenSQLite(config.StorageConfig{Driver: "sqlite", DSN: dsn})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = s.Close() })
+		return s
+	}
+	cfg := config.LeaderConfig{Backend: "storage", Lease: "test", LeaseDuration: 300 * time.Millisecond, RenewInterval: 50 * time.Millisecond}
+	start := func(id string, s storage.Store) *Elector {
+		c := cfg
+		c.Identity = id
+		e, err := Start(c, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	waitFor := func(e *Elector, leading bool, within time.Duration) {
+		t.Helper()
+		deadline := time.Now().Add(within)
+		for e.Leading() != leading {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: leading %v, want %v after %v", e.Identity(), e.Leading(), leading, within)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	a := start("a", open())
+	lost, err := storage.OpenSQLite(config.StorageConfig{Driver: "sqlite", DSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := start("b", lost)
+	changes := make(chan bool, 4)
+	b.OnChange(func(leading bool) { changes <- leading })
+	if !a.Leading() || b.Leading() {
+		t.Fatalf("a leading %v, b leading %v: want only a", a.Leading(), b.Leading())
+	}
+	time.Sleep(2 * cfg.LeaseDuration)
+	if b.Leading() {
+		t.Fatal("b took a lease a keeps renewing")
+	}
+
+	// a released lease is taken at the next attempt
+	a.Close()
+	waitFor(b, true, 2*cfg.RenewInterval)
+	if !<-changes {
+		t.Error("b was not told it leads")
+	}
+
+	// a leader that cannot renew steps down before its lease expires, and
+	// the lease is taken once it has
+	c := start("c", open())
+	_ = lost.Close()
+	waitFor(b, false, cfg.LeaseDuration)
+	if c.Leading() {
+		t.Error("c took the lease before it expired")
+	}
+	waitFor(c, true, cfg.LeaseDuration+2*cfg.RenewInterval)
+	b.Close()
+	c.Close()
+
+	var off *Elector
+	if !off.Leading() {
+		t.Error("a nil elector does not lead")
+	}
+	off.Close()
+}
@@ -0,0 +1,122 @@
+// Package live fans accepted events out to subscribers as they reach the
+// sinks, for push APIs such as GraphQL subscriptions. Nothing is stored: a
+// subscriber sees the events published while it is subscribed.
+package live
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/expr"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+var (
+	subscribers = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "live_subscribers", Help: "Open live event subscriptions"},
+	)
+	dropped = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "live_subscriptions_dropped_total", Help: "Live subscriptions ended because the subscriber fell behind"},
+	)
+)
+
+// Collectors returns the live metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{subscribers, dropped}
+}
+
+// ErrSlow ends a subscription whose buffer filled up: it missed events, and
+// it is up to the subscriber to catch up from the store.
+var ErrSlow = errors.New("subscriber fell behind")
+
+// Hub delivers published events to the subscriptions whose query they match.
+type Hub struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: map[*Subscription]struct{}{}}
+}
+
+// Len returns the number of open subscriptions.
+func (h *Hub) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subs)
+}
+
+// Subscription receives the matching events on C, which is closed when the
+// subscription ends; Err then tells why.
+type Subscription struct {
+	C <-chan event.Event
+
+	h     *Hub
+	q     storage.Query
+	where *expr.Program
+	ch    chan event.Event
+
+	once sync.Once
+	err  error
+}
+
+// Subscribe starts delivering the events matching q (everything but its
+// Limit and cursors applies) and where, when not nil, buffering up to
+// buffer of them.
+func (h *Hub) Subscribe(q storage.Query, where *expr.Program, buffer int) *Subscription {
+	ch := make(chan event.Event, buffer)
+	s := &Subscription{C: ch, h: h, q: q.Compile(), where: where, ch: ch}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	subscribers.Inc()
+	return s
+}
+
+// Publish hands e to every matching subscription without blocking; those
+// with a full buffer are ended with ErrSlow.
+func (h *Hub) Publish(e event.Event) {
+	var slow []*Subscription
+	env := expr.NewEnv(&e)
+	h.mu.RLock()
+	for s := range h.subs {
+		if !s.q.Match(&e) || !s.where.Match(env) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			slow = append(slow, s)
+		}
+	}
+	h.mu.RUnlock()
+	for _, s := range slow {
+		dropped.Inc()
+		s.end(ErrSlow)
+	}
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() { s.end(nil) }
+
+// Err returns why the subscription ended: nil after Close, ErrSlow when it
+// fell behind.
+func (s *Subscription) Err() error {
+	s.h.mu.RLock()
+	defer s.h.mu.RUnlock()
+	return s.err
+}
+
+func (s *Subscription) end(err error) {
+	s.once.Do(func() {
+		s.h.mu.Lock()
+		defer s.h.mu.Unlock()
+		delete(s.h.subs, s)
+		s.err = err
+		close(s.ch)
+		subscribers.Dec()
+	})
+}
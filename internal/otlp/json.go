@@ -0,0 +1,161 @@
+package otlp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// The OTLP JSON encoding uses lowerCamelCase field names, strings or numbers
+// for 64-bit integers, hex for trace and span IDs and base64 for bytes.
+
+type jsonRequest struct {
+	ResourceLogs []struct {
+		Resource struct {
+			Attributes []jsonKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []struct {
+			Scope      Scope        `json:"scope"`
+			LogRecords []jsonRecord `json:"logRecords"`
+		} `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+type jsonRecord struct {
+	TimeUnixNano         jsonInt        `json:"timeUnixNano"`
+	ObservedTimeUnixNano jsonInt        `json:"observedTimeUnixNano"`
+	SeverityNumber       int            `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Body                 *jsonAnyValue  `json:"body"`
+	Attributes           []jsonKeyValue `json:"attributes"`
+	TraceID              string         `json:"traceId"`
+	SpanID               string         `json:"spanId"`
+	EventName            string         `json:"eventName"`
+}
+
+type jsonKeyValue struct {
+	Key   string        `json:"key"`
+	Value *jsonAnyValue `json:"value"`
+}
+
+type jsonAnyValue struct {
+	StringValue *string  `json:"stringValue"`
+	BoolValue   *bool    `json:"boolValue"`
+	IntValue    *jsonInt `json:"intValue"`
+	DoubleValue *float64 `json:"doubleValue"`
+	ArrayValue  *struct {
+		Values []*jsonAnyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []jsonKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+	BytesValue *string `json:"bytesValue"`
+}
+
+// jsonInt is a 64-bit integer sent as a JSON number or string.
+type jsonInt int64
+
+func (i *jsonInt) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseInt(string(bytes.Trim(b, `"`)), 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = jsonInt(v)
+	return nil
+}
+
+func decodeJSON(body []byte) ([]Record, error) {
+	var req jsonRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	var out []Record
+	for _, rl := range req.ResourceLogs {
+		resource, err := jsonAttributes(rl.Resource.Attributes)
+		if err != nil {
+			return nil, err
+		}
+		for _, sl := range rl.ScopeLogs {
+			for _, jr := range sl.LogRecords {
+				r := Record{
+					Resource:       resource,
+					Scope:          sl.Scope,
+					SeverityNumber: jr.SeverityNumber,
+					SeverityText:   jr.SeverityText,
+					EventName:      jr.EventName,
+				}
+				if jr.TimeUnixNano != 0 {
+					r.Time = time.Unix(0, int64(jr.TimeUnixNano)).UTC()
+				}
+				if jr.ObservedTimeUnixNano != 0 {
+					r.ObservedTime = time.Unix(0, int64(jr.ObservedTimeUnixNano)).UTC()
+				}
+				if r.Body, err = jr.Body.value(); err != nil {
+					return nil, err
+				}
+				if len(jr.Attributes) > 0 {
+					if r.Attributes, err = jsonAttributes(jr.Attributes); err != nil {
+						return nil, err
+					}
+				}
+				if r.TraceID, err = hex.DecodeString(jr.TraceID); err != nil {
+					return nil, fmt.Errorf("%w: traceId: %v", ErrInvalid, err)
+				}
+				if r.SpanID, err = hex.DecodeString(jr.SpanID); err != nil {
+					return nil, fmt.Errorf("%w: spanId: %v", ErrInvalid, err)
+				}
+				out = append(out, r)
+			}
+		}
+	}
+	return out, nil
+}
+
+func jsonAttributes(kvs []jsonKeyValue) (map[string]any, error) {
+	out := make(map[string]any, len(kvs))
+	for _, kv := range kvs {
+		v, err := kv.Value.value()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", kv.Key, err)
+		}
+		out[kv.Key] = v
+	}
+	return out, nil
+}
+
+func (v *jsonAnyValue) value() (any, error) {
+	switch {
+	case v == nil:
+		return nil, nil
+	case v.StringValue != nil:
+		return *v.StringValue, nil
+	case v.BoolValue != nil:
+		return *v.BoolValue, nil
+	case v.IntValue != nil:
+		return int64(*v.IntValue), nil
+	case v.DoubleValue != nil:
+		return *v.DoubleValue, nil
+	case v.ArrayValue != nil:
+		out := make([]any, len(v.ArrayValue.Values))
+		for i, item := range v.ArrayValue.Values {
+			var err error
+			if out[i], err = item.value(); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case v.KvlistValue != nil:
+		return jsonAttributes(v.KvlistValue.Values)
+	case v.BytesValue != nil:
+		b, err := base64.StdEncoding.DecodeString(*v.BytesValue)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bytesValue: %v", ErrInvalid, err)
+		}
+		return b, nil
+	}
+	return nil, nil
+}
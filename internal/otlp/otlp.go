@@ -0,0 +1,154 @@
+// Package otlp reads OTLP/HTTP log exports (ExportLogsServiceRequest, as
+// protobuf or JSON) so OpenTelemetry Collectors and SDKs can ship log records
+// to the service, and maps each record to an event.
+package otlp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+var recordsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "otlp_log_records_total", Help: "OTLP log records received by result (accepted, rejected)"},
+	[]string{"result"},
+)
+
+// Collectors returns the OTLP metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{recordsTotal}
+}
+
+// Count records the outcome of an export.
+func Count(accepted, rejected int) {
+	recordsTotal.WithLabelValues("accepted").Add(float64(accepted))
+	recordsTotal.WithLabelValues("rejected").Add(float64(rejected))
+}
+
+// Record is a log record with the resource and scope it was exported under.
+// Attribute and body values keep their OTLP type as string, bool, int64,
+// float64, []byte, []any or map[string]any.
+type Record struct {
+	Resource       map[string]any
+	Scope          Scope
+	Time           time.Time
+	ObservedTime   time.Time
+	SeverityNumber int
+	SeverityText   string
+	Body           any
+	Attributes     map[string]any
+	TraceID        []byte
+	SpanID         []byte
+	EventName      string
+}
+
+// Scope is the instrumentation scope that emitted a record.
+type Scope struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// Event maps r to an event of type [<service.namespace>/]<service.name>/log,
+// or .../<event name> for records of the OpenTelemetry events API. The body,
+// attributes and resource attributes go into the payload; the severity is
+// also a tag, e.g. severity:error.
+func (r *Record) Event() (event.Event, error) {
+	service, _ := r.Resource["service.name"].(string)
+	if service == "" {
+		service = "unknown_service"
+	}
+	typ := event.TypeSegment(service) + "/log"
+	if r.EventName != "" {
+		typ = event.TypeSegment(service) + "/" + event.TypeSegment(r.EventName)
+	}
+	if ns, _ := r.Resource["service.namespace"].(string); ns != "" {
+		typ = event.TypeSegment(ns) + "/" + typ
+	}
+	payload := map[string]any{}
+	if r.Body != nil {
+		payload["body"] = r.Body
+	}
+	if !r.Time.IsZero() {
+		payload["timestamp"] = r.Time
+	} else if !r.ObservedTime.IsZero() {
+		payload["timestamp"] = r.ObservedTime
+	}
+	severity := severityName(r.SeverityNumber)
+	if severity != "" {
+		payload["severity"] = severity
+		payload["severity_number"] = r.SeverityNumber
+	}
+	if r.SeverityText != "" {
+		payload["severity_text"] = r.SeverityText
+	}
+	if len(r.Attributes) > 0 {
+		payload["attributes"] = r.Attributes
+	}
+	if len(r.Resource) > 0 {
+		payload["resource"] = r.Resource
+	}
+	if r.Scope != (Scope{}) {
+		payload["scope"] = r.Scope
+	}
+	if len(r.TraceID) > 0 {
+		payload["trace_id"] = hex.EncodeToString(r.TraceID)
+	}
+	if len(r.SpanID) > 0 {
+		payload["span_id"] = hex.EncodeToString(r.SpanID)
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return event.Event{}, err
+	}
+	e := event.Event{Type: typ, Payload: raw}
+	// the records of one trace form a flow
+	if len(r.TraceID) > 0 {
+		e.CorrelationID = hex.EncodeToString(r.TraceID)
+	}
+	if severity != "" {
+		e.Tags = []string{"severity:" + severity}
+	}
+	return e, nil
+}
+
+// severityName returns the short name of an OTLP severity number: 1-4
+// trace, 5-8 debug, 9-12 info, 13-16 warn, 17-20 error, 21-24 fatal.
+func severityName(n int) string {
+	if n < 1 || n > 24 {
+		return ""
+	}
+	return [...]string{"trace", "debug", "info", "warn", "error", "fatal"}[(n-1)/4]
+}
+
+// Decode reads an ExportLogsServiceRequest in the encoding of contentType,
+// application/x-protobuf or application/json.
+func Decode(contentType string, body []byte) ([]Record, error) {
+	switch contentType {
+	case "application/x-protobuf", "application/protobuf":
+		return decodeProto(body)
+	case "application/json":
+		return decodeJSON(body)
+	}
+	return nil, fmt.Errorf("%w: content type %q", ErrUnsupported, contentType)
+}
+
+// Response encodes an ExportLogsServiceResponse in the encoding of
+// contentType, reporting rejected records as a partial success.
+func Response(contentType string, rejected int, message string) []byte {
+	if contentType == "application/json" {
+		if rejected == 0 {
+			return []byte("{}")
+		}
+		b, _ := json.Marshal(map[string]any{"partialSuccess": map[string]any{
+			"rejectedLogRecords": fmt.Sprint(rejected),
+			"errorMessage":       message,
+		}})
+		return b
+	}
+	return encodeProtoResponse(rejected, message)
+}
@@ -0,0 +1,146 @@
+package otlp
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func message(num protowire.Number, b []byte) []byte {
+	return protowire.AppendBytes(protowire.AppendTag(nil, num, protowire.BytesType), b)
+}
+
+func str(num protowire.Number, s string) []byte { return message(num, []byte(s)) }
+
+func keyValue(num protowire.Number, key string, value []byte) []byte {
+	return message(num, append(str(1, key), message(2, value)...))
+}
+
+// exportRequest encodes the request that jsonExport encodes as JSON.
+func exportRequest() []byte {
+	var rec []byte
+	rec = protowire.AppendTag(rec, 1, protowire.Fixed64Type)
+	rec = protowire.AppendFixed64(rec, uint64(time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC).UnixNano()))
+	rec = protowire.AppendTag(rec, 2, protowire.VarintType)
+	rec = protowire.AppendVarint(rec, 17)
+	rec = append(rec, str(3, "ERROR")...)
+	rec = append(rec, message(5, str(1, "payment failed"))...)
+	var count, ratio, ok []byte
+	count = protowire.AppendVarint(protowire.AppendTag(count, 3, protowire.VarintType), 3)
+	ratio = protowire.AppendFixed64(protowire.AppendTag(ratio, 4, protowire.Fixed64Type), math.Float64bits(0.5))
+	ok = protowire.AppendVarint(protowire.AppendTag(ok, 2, protowire.VarintType), 1)
+	rec = append(rec, keyValue(6, "retries", count)...)
+	rec = append(rec, keyValue(6, "ratio", ratio)...)
+	rec = append(rec, keyValue(6, "final", ok)...)
+	rec = append(rec, keyValue(6, "tags", message(5, append(message(1, str(1, "a")), message(1, str(1, "b"))...)))...)
+	rec = append(rec, keyValue(6, "blob", str(7, "\x01\x02"))...)
+	rec = append(rec, message(9, []byte{0xab, 0xcd})...)
+	rec = append(rec, message(10, []byte{0x01})...)
+	rec = protowire.AppendVarint(protowire.AppendTag(rec, 99, protowire.VarintType), 1) // unknown field
+
+	scope := append(message(1, append(str(1, "checkout"), str(2, "1.2.0")...)), message(2, rec)...)
+	resource := message(1, append(keyValue(1, "service.name", str(1, "payments")), keyValue(1, "service.namespace", str(1, "shop"))...))
+	return message(1, append(resource, message(2, scope)...))
+}
+
+const jsonExport = `{"resourceLogs":[{
+	"resource":{"attributes":[
+		{"key":"service.name","value":{"stringValue":"payments"}},
+		{"key":"service.namespace","value":{"stringValue":"shop"}}]},
+	"scopeLogs":[{"scope":{"name":"checkout","version":"1.2.0"},"logRecords":[{
+		"timeUnixNano":"1735787045000000000","severityNumber":17,"severityText":"ERROR",
+		"body":{"stringValue":"payment failed"},
+		"attributes":[
+			{"key":"retries","value":{"intValue":"3"}},
+			{"key":"ratio","value":{"doubleValue":0.5}},
+			{"key":"final","value":{"boolValue":true}},
+			{"key":"tags","value":{"arrayValue":{"values":[{"stringValue":"a"},{"stringValue":"b"}]}}},
+			{"key":"blob","value":{"bytesValue":"AQI="}}],
+		"traceId":"abcd","spanId":"01"}]}]}]}`
+
+// TestDecode reads the same export as protobuf and as JSON into the same
+// records.
+func TestDecode(t *testing.T) {
+	fromProto, err := Decode("application/x-protobuf", exportRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := Decode("application/json", []byte(jsonExport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fromProto) != 1 || !reflect.DeepEqual(fromProto, fromJSON) {
+		t.Fatalf("protobuf %+v\njson     %+v", fromProto, fromJSON)
+	}
+	r := fromProto[0]
+	if r.Scope != (Scope{"checkout", "1.2.0"}) || r.SeverityNumber != 17 || r.Body != "payment failed" || r.Attributes["retries"] != int64(3) || !slices.Equal(r.Attributes["blob"].([]byte), []byte{1, 2}) {
+		t.Errorf("record %+v", r)
+	}
+
+	for name, c := range map[string]struct {
+		contentType string
+		body        []byte
+		want        error
+	}{
+		"truncated":    {"application/x-protobuf", exportRequest()[:20], ErrInvalid},
+		"bad json":     {"application/json", []byte(`{"resourceLogs":`), ErrInvalid},
+		"bad trace id": {"application/json", []byte(`{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"traceId":"xyz"}]}]}]}`), ErrInvalid},
+		"text":         {"text/plain", []byte("hi"), ErrUnsupported},
+	} {
+		if _, err := Decode(c.contentType, c.body); !errors.Is(err, c.want) {
+			t.Errorf("%s: %v, want %v", name, err, c.want)
+		}
+	}
+}
+
+// TestEvent maps a record to a type under its service, correlated by trace.
+func TestEvent(t *testing.T) {
+	rs, err := Decode("application/json", []byte(jsonExport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := rs[0].Event()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != "shop/payments/log" || e.CorrelationID != "abcd" || !slices.Equal(e.Tags, []string{"severity:error"}) {
+		t.Errorf("event %+v", e)
+	}
+	var p map[string]any
+	if err := json.Unmarshal(e.Payload, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p["body"] != "payment failed" || p["severity"] != "error" || p["span_id"] != "01" || p["timestamp"] != "2025-01-02T03:04:05Z" {
+		t.Errorf("payload %s", e.Payload)
+	}
+
+	r := Record{EventName: "user login", SeverityNumber: 30}
+	if e, _ := r.Event(); e.Type != "unknown_service/user_login" || e.Tags != nil {
+		t.Errorf("event record: %+v", e)
+	}
+}
+
+// TestResponse reports rejected records as a partial success.
+func TestResponse(t *testing.T) {
+	if got := string(Response("application/json", 0, "")); got != "{}" {
+		t.Errorf("json, none rejected: %s", got)
+	}
+	if got := string(Response("application/json", 2, "too big")); got != `{"partialSuccess":{"errorMessage":"too big","rejectedLogRecords":"2"}}` {
+		t.Errorf("json: %s", got)
+	}
+	if got := Response("application/x-protobuf", 0, ""); len(got) != 0 {
+		t.Errorf("protobuf, none rejected: %x", got)
+	}
+	var partial []byte
+	partial = protowire.AppendVarint(protowire.AppendTag(partial, 1, protowire.VarintType), 2)
+	partial = append(partial, str(2, "too big")...)
+	if got, want := Response("application/x-protobuf", 2, "too big"), message(1, partial); !slices.Equal(got, want) {
+		t.Errorf("protobuf: %x, want %x", got, want)
+	}
+}
@@ -0,0 +1,307 @@
+package otlp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	ErrUnsupported = errors.New("otlp: unsupported")
+	ErrInvalid     = errors.New("otlp: invalid request")
+)
+
+// The messages are read field by field, as the codec package does for
+// api/event.proto, following opentelemetry/proto/collector/logs/v1 and the
+// logs, resource and common messages it uses. Unknown fields are skipped.
+
+func decodeProto(data []byte) ([]Record, error) {
+	var out []Record
+	err := fields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num != 1 || typ != protowire.BytesType {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		msg, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		recs, err := decodeResourceLogs(msg)
+		out = append(out, recs...)
+		return n, err
+	})
+	return out, err
+}
+
+// decodeResourceLogs reads ResourceLogs: resource = 1, scope_logs = 2.
+func decodeResourceLogs(data []byte) ([]Record, error) {
+	var resource map[string]any
+	var scopes [][]byte
+	err := fields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType || (num != 1 && num != 2) {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		msg, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		if num == 2 {
+			scopes = append(scopes, msg)
+			return n, nil
+		}
+		// Resource: attributes = 1
+		var err error
+		resource, err = decodeAttributes(msg, 1)
+		return n, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out []Record
+	for _, s := range scopes {
+		recs, err := decodeScopeLogs(s, resource)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, recs...)
+	}
+	return out, nil
+}
+
+// decodeScopeLogs reads ScopeLogs: scope = 1, log_records = 2.
+func decodeScopeLogs(data []byte, resource map[string]any) ([]Record, error) {
+	var scope Scope
+	var records [][]byte
+	err := fields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType || (num != 1 && num != 2) {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		msg, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		if num == 2 {
+			records = append(records, msg)
+			return n, nil
+		}
+		// InstrumentationScope: name = 1, version = 2
+		return n, fields(msg, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+			if typ != protowire.BytesType || (num != 1 && num != 2) {
+				return protowire.ConsumeFieldValue(num, typ, b), nil
+			}
+			v, n := protowire.ConsumeString(b)
+			if num == 1 {
+				scope.Name = v
+			} else {
+				scope.Version = v
+			}
+			return n, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Record, len(records))
+	for i, msg := range records {
+		out[i] = Record{Resource: resource, Scope: scope}
+		if err := decodeLogRecord(msg, &out[i]); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// decodeLogRecord reads LogRecord: time_unix_nano = 1 (fixed64),
+// severity_number = 2, severity_text = 3, body = 5, attributes = 6,
+// trace_id = 9, span_id = 10, observed_time_unix_nano = 11 (fixed64),
+// event_name = 12.
+func decodeLogRecord(data []byte, r *Record) error {
+	return fields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case (num == 1 || num == 11) && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if v != 0 {
+				ts := time.Unix(0, int64(v)).UTC()
+				if num == 1 {
+					r.Time = ts
+				} else {
+					r.ObservedTime = ts
+				}
+			}
+			return n, nil
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			r.SeverityNumber = int(int32(v))
+			return n, nil
+		case typ != protowire.BytesType:
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		msg, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		var err error
+		switch num {
+		case 3:
+			r.SeverityText = string(msg)
+		case 5:
+			r.Body, err = decodeAnyValue(msg)
+		case 6:
+			var kv map[string]any
+			if kv, err = decodeAttributes(msg, -1); err == nil {
+				if r.Attributes == nil {
+					r.Attributes = map[string]any{}
+				}
+				for k, v := range kv {
+					r.Attributes[k] = v
+				}
+			}
+		case 9:
+			r.TraceID = append([]byte(nil), msg...)
+		case 10:
+			r.SpanID = append([]byte(nil), msg...)
+		case 12:
+			r.EventName = string(msg)
+		}
+		return n, err
+	})
+}
+
+// decodeAttributes reads the repeated KeyValue field num of data; num -1
+// means data is a single KeyValue.
+func decodeAttributes(data []byte, num protowire.Number) (map[string]any, error) {
+	out := map[string]any{}
+	keyValue := func(msg []byte) error {
+		var key string
+		var val any
+		err := fields(msg, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+			if typ != protowire.BytesType || (num != 1 && num != 2) {
+				return protowire.ConsumeFieldValue(num, typ, b), nil
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			var err error
+			if num == 1 {
+				key = string(v)
+			} else {
+				val, err = decodeAnyValue(v)
+			}
+			return n, err
+		})
+		if err == nil {
+			out[key] = val
+		}
+		return err
+	}
+	if num < 0 {
+		return out, keyValue(data)
+	}
+	err := fields(data, func(n protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if n != num || typ != protowire.BytesType {
+			return protowire.ConsumeFieldValue(n, typ, b), nil
+		}
+		msg, m := protowire.ConsumeBytes(b)
+		if m < 0 {
+			return m, nil
+		}
+		return m, keyValue(msg)
+	})
+	return out, err
+}
+
+// decodeAnyValue reads AnyValue: string_value = 1, bool_value = 2,
+// int_value = 3, double_value = 4, array_value = 5, kvlist_value = 6,
+// bytes_value = 7.
+func decodeAnyValue(data []byte) (any, error) {
+	var out any
+	err := fields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			out = v != 0
+			return n, nil
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			out = int64(v)
+			return n, nil
+		case num == 4 && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			out = math.Float64frombits(v)
+			return n, nil
+		case typ != protowire.BytesType || num < 1 || num > 7:
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		msg, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		var err error
+		switch num {
+		case 1:
+			out = string(msg)
+		case 5:
+			// ArrayValue: values = 1
+			values := []any{}
+			err = fields(msg, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+				if num != 1 || typ != protowire.BytesType {
+					return protowire.ConsumeFieldValue(num, typ, b), nil
+				}
+				v, n := protowire.ConsumeBytes(b)
+				if n < 0 {
+					return n, nil
+				}
+				val, err := decodeAnyValue(v)
+				values = append(values, val)
+				return n, err
+			})
+			out = values
+		case 6:
+			// KeyValueList: values = 1
+			out, err = decodeAttributes(msg, 1)
+		case 7:
+			out = append([]byte(nil), msg...)
+		}
+		return n, err
+	})
+	return out, err
+}
+
+// encodeProtoResponse encodes ExportLogsServiceResponse: partial_success = 1
+// holding rejected_log_records = 1 and error_message = 2.
+func encodeProtoResponse(rejected int, message string) []byte {
+	if rejected == 0 {
+		return []byte{}
+	}
+	var partial []byte
+	partial = protowire.AppendTag(partial, 1, protowire.VarintType)
+	partial = protowire.AppendVarint(partial, uint64(rejected))
+	partial = protowire.AppendTag(partial, 2, protowire.BytesType)
+	partial = protowire.AppendString(partial, message)
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, partial)
+}
+
+// fields calls fn with every field of data; fn returns the length it
+// consumed, negative for a protowire error.
+func fields(data []byte, fn func(protowire.Number, protowire.Type, []byte) (int, error)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("%w: %v", ErrInvalid, protowire.ParseError(n))
+		}
+		data = data[n:]
+		m, err := fn(num, typ, data)
+		if err != nil {
+			return err
+		}
+		if m < 0 {
+			return fmt.Errorf("%w: %v", ErrInvalid, protowire.ParseError(m))
+		}
+		data = data[m:]
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package pipeline
+
+import (
+	"errors"
+	"net/netip"
+	"strconv"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/geoip"
+	"github.com/rafaelosorio/go-ingest-service/internal/useragent"
+)
+
+// Client is the sender of the ingest request, which enrichment steps
+// describe when no payload field is configured. Events that did not come
+// over HTTP have a zero Client, or only an address.
+type Client struct {
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// geoDB is the database geoip steps look addresses up in.
+var geoDB *geoip.DB
+
+// UseGeoIP sets the database of geoip steps. It must be called before
+// pipelines with such steps are compiled.
+func UseGeoIP(db *geoip.DB) { geoDB = db }
+
+// source reads the enriched value: a top-level string payload field, or the
+// client's.
+func source(it *Item, field, client string) string {
+	if field == "" {
+		return client
+	}
+	s, _ := it.Payload[field].(string)
+	return s
+}
+
+func newGeo(c config.EnrichConfig) (Processor, error) {
+	if geoDB == nil {
+		return nil, errors.New("geoip needs enrichment.geoip_database")
+	}
+	if c.Prefix == "" {
+		c.Prefix = "geo."
+	}
+	return geo{cfg: c, db: geoDB}, nil
+}
+
+// geo sets the location of an address as metadata. Events without a valid
+// address, or whose address the database does not know, are left as they
+// are.
+type geo struct {
+	cfg config.EnrichConfig
+	db  *geoip.DB
+}
+
+func (geo) Kind() string { return "geoip" }
+
+func (g geo) Process(it *Item) error {
+	addr, err := netip.ParseAddr(source(it, g.cfg.Field, it.Client.IP))
+	if err != nil {
+		return nil
+	}
+	loc, ok, err := g.db.Lookup(addr)
+	if err != nil || !ok {
+		return err
+	}
+	set := func(k, v string) {
+		if v == "" {
+			return
+		}
+		if it.Event.Metadata == nil {
+			it.Event.Metadata = map[string]string{}
+		}
+		it.Event.Metadata[g.cfg.Prefix+k] = v
+	}
+	set("country", loc.Country)
+	set("country_name", loc.CountryName)
+	set("continent", loc.Continent)
+	set("region", loc.Region)
+	set("city", loc.City)
+	set("time_zone", loc.TimeZone)
+	if loc.HasCoordinates {
+		set("lat", strconv.FormatFloat(loc.Latitude, 'f', -1, 64))
+		set("lon", strconv.FormatFloat(loc.Longitude, 'f', -1, 64))
+	}
+	if loc.ASN != 0 {
+		set("asn", strconv.FormatUint(loc.ASN, 10))
+	}
+	set("as_org", loc.ASOrg)
+	return nil
+}
+
+// agent sets the parsed user agent as metadata; events without one are left
+// as they are.
+type agent config.EnrichConfig
+
+func newAgent(c config.EnrichConfig) agent {
+	if c.Prefix == "" {
+		c.Prefix = "ua."
+	}
+	return agent(c)
+}
+
+func (agent) Kind() string { return "user_agent" }
+
+func (a agent) Process(it *Item) error {
+	ua := source(it, a.Field, it.Client.UserAgent)
+	if ua == "" {
+		return nil
+	}
+	p := useragent.Parse(ua)
+	if it.Event.Metadata == nil {
+		it.Event.Metadata = map[string]string{}
+	}
+	for k, v := range map[string]string{
+		"browser": p.Browser, "browser_version": p.BrowserVersion,
+		"os": p.OS, "os_version": p.OSVersion, "device": p.Device,
+	} {
+		if v != "" {
+			it.Event.Metadata[a.Prefix+k] = v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,366 @@
+// Package pipeline transforms events between ingest and storage through an
+// ordered chain of processors configured per event type.
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/ingestmetrics"
+)
+
+var (
+	processedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "pipeline_processor_events_total", Help: "Events handled per pipeline processor by result"},
+		[]string{"pipeline", "processor", "result"},
+	)
+	processDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "pipeline_processor_duration_seconds",
+			Help:    "Pipeline processor latency",
+			Buckets: []float64{.00001, .00005, .0001, .0005, .001, .005, .01},
+		},
+		[]string{"pipeline", "processor"},
+	)
+	redactionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "pipeline_redactions_total", Help: "Payload values redacted per pipeline and redact rule"},
+		[]string{"pipeline", "rule"},
+	)
+)
+
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{processedTotal, processDuration, redactionsTotal}
+}
+
+// Item is the unit flowing through a pipeline. The payload is decoded once
+// (numbers kept as json.Number) and re-encoded only if a processor changed it.
+type Item struct {
+	Event *event.Event
+	// Payload is the decoded object payload, nil when it is not an object.
+	Payload map[string]any
+	// Dirty must be set by processors that modify Payload.
+	Dirty bool
+	// Client sent the event.
+	Client Client
+	// ctx ends when the sender gives up on the event.
+	ctx context.Context
+	// dryRun is set by Trace, whose runs are not counted.
+	dryRun bool
+}
+
+// Context is the context of the run, for processors that call out.
+func (it *Item) Context() context.Context { return it.ctx }
+
+// Processor is one transformation step.
+type Processor interface {
+	Kind() string
+	Process(it *Item) error
+}
+
+type step struct {
+	name string
+	proc Processor
+	// skipOnError isolates a failing step: its changes are rolled back and
+	// the event continues through the rest of the pipeline.
+	skipOnError bool
+}
+
+// Pipeline is a compiled, ordered chain of processors.
+type Pipeline struct {
+	name  string
+	steps []step
+}
+
+// Compile builds a pipeline from its configuration. Plugin steps are
+// refused: they start binaries, so only the service config, through New,
+// may use them.
+func Compile(name string, cfgs []config.ProcessorConfig) (*Pipeline, error) {
+	for i, c := range cfgs {
+		if c.Plugin != nil {
+			return nil, fmt.Errorf("pipeline %s step %d: plugin processors are only allowed in the service config", name, i)
+		}
+	}
+	return compile(name, cfgs)
+}
+
+func compile(name string, cfgs []config.ProcessorConfig) (*Pipeline, error) {
+	p := &Pipeline{name: name}
+	for i, c := range cfgs {
+		switch c.OnError {
+		case "", "reject", "skip":
+		default:
+			p.Close()
+			return nil, fmt.Errorf("pipeline %s step %d: unknown on_error %q", name, i, c.OnError)
+		}
+		proc, err := newProcessor(name, i, c)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("pipeline %s step %d: %w", name, i, err)
+		}
+		stepName := c.Name
+		if stepName == "" {
+			stepName = fmt.Sprintf("%d-%s", i, proc.Kind())
+		}
+		p.steps = append(p.steps, step{name: stepName, proc: proc, skipOnError: c.OnError == "skip"})
+	}
+	return p, nil
+}
+
+func (p *Pipeline) Name() string { return p.name }
+
+// Close stops the plugins of the pipeline's steps.
+func (p *Pipeline) Close() {
+	for _, s := range p.steps {
+		if c, ok := s.proc.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}
+}
+
+// Run applies the pipeline to e, sent by c, in place, recording
+// per-processor metrics. The first failing processor aborts the run, and so
+// does ctx ending before the next processor.
+func (p *Pipeline) Run(ctx context.Context, e *event.Event, c Client) error {
+	it, err := newItem(ctx, e, c)
+	if err != nil {
+		return err
+	}
+	for _, s := range p.steps {
+		if err := ctx.Err(); err != nil {
+			ingestmetrics.CountCanceled(ctx, "pipeline", err)
+			return err
+		}
+		start := time.Now()
+		err := s.apply(it)
+		processDuration.WithLabelValues(p.name, s.name).Observe(time.Since(start).Seconds())
+		switch {
+		case err == nil:
+			processedTotal.WithLabelValues(p.name, s.name, "ok").Inc()
+		case s.skipOnError:
+			processedTotal.WithLabelValues(p.name, s.name, "skipped").Inc()
+		case ingestmetrics.CountCanceled(ctx, "pipeline", err):
+			return err
+		default:
+			processedTotal.WithLabelValues(p.name, s.name, "error").Inc()
+			return fmt.Errorf("processor %s: %w", s.name, err)
+		}
+	}
+	return it.finish()
+}
+
+// TraceStep is the state of the event after one processor in a dry run.
+type TraceStep struct {
+	Processor string            `json:"processor"`
+	Payload   json.RawMessage   `json:"payload"`
+	Tags      []string          `json:"tags,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// Trace runs the pipeline like Run but without metrics, returning the
+// intermediate state after every processor. It stops at the first error.
+func (p *Pipeline) Trace(ctx context.Context, e *event.Event, c Client) ([]TraceStep, error) {
+	it, err := newItem(ctx, e, c)
+	if err != nil {
+		return nil, err
+	}
+	it.dryRun = true
+	var trace []TraceStep
+	for _, s := range p.steps {
+		if err := s.apply(it); err != nil {
+			if !s.skipOnError {
+				trace = append(trace, TraceStep{Processor: s.name, Error: err.Error()})
+				return trace, fmt.Errorf("processor %s: %w", s.name, err)
+			}
+			trace = append(trace, TraceStep{
+				Processor: s.name,
+				Payload:   e.Payload,
+				Tags:      append([]string(nil), e.Tags...),
+				Metadata:  copyMap(e.Metadata),
+				Error:     "skipped: " + err.Error(),
+			})
+			continue
+		}
+		if err := it.finish(); err != nil {
+			return trace, err
+		}
+		trace = append(trace, TraceStep{
+			Processor: s.name,
+			Payload:   e.Payload,
+			Tags:      append([]string(nil), e.Tags...),
+			Metadata:  copyMap(e.Metadata),
+		})
+	}
+	return trace, nil
+}
+
+// apply runs the step's processor. A panic is turned into an error, and on
+// any error the item is restored to its state before the step, so a broken
+// processor cannot leave a half-applied change behind.
+func (s step) apply(it *Item) (err error) {
+	saved := it.snapshot()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+		if err != nil {
+			it.restore(saved)
+		}
+	}()
+	return s.proc.Process(it)
+}
+
+type itemState struct {
+	payload  map[string]any
+	dirty    bool
+	tags     []string
+	metadata map[string]string
+}
+
+func (it *Item) snapshot() itemState {
+	st := itemState{dirty: it.Dirty, metadata: copyMap(it.Event.Metadata)}
+	if it.Payload != nil {
+		st.payload = make(map[string]any, len(it.Payload))
+		for k, v := range it.Payload {
+			st.payload[k] = v
+		}
+	}
+	st.tags = append([]string(nil), it.Event.Tags...)
+	return st
+}
+
+func (it *Item) restore(st itemState) {
+	it.Payload, it.Dirty = st.payload, st.dirty
+	it.Event.Tags, it.Event.Metadata = st.tags, st.metadata
+	if len(st.tags) == 0 {
+		it.Event.Tags = nil
+	}
+}
+
+func newItem(ctx context.Context, e *event.Event, c Client) (*Item, error) {
+	it := &Item{Event: e, Client: c, ctx: ctx}
+	p := bytes.TrimSpace(e.Payload)
+	if len(p) > 0 && p[0] == '{' {
+		dec := json.NewDecoder(bytes.NewReader(p))
+		dec.UseNumber()
+		if err := dec.Decode(&it.Payload); err != nil {
+			return nil, fmt.Errorf("decode payload: %w", err)
+		}
+	}
+	return it, nil
+}
+
+// finish writes a modified payload back to the event.
+func (it *Item) finish() error {
+	if !it.Dirty {
+		return nil
+	}
+	b, err := json.Marshal(it.Payload)
+	if err != nil {
+		return fmt.Errorf("encode payload: %w", err)
+	}
+	it.Event.Payload = b
+	it.Dirty = false
+	return nil
+}
+
+func copyMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// Engine selects the pipeline for each event type.
+type Engine struct {
+	byType   map[string]*Pipeline
+	fallback *Pipeline
+
+	// byNamespace holds the pipelines set at runtime for tenant namespaces.
+	mu          sync.RWMutex
+	byNamespace map[string]*Pipeline
+}
+
+// New compiles all configured pipelines. The "*" pipeline applies to types
+// without a pipeline of their own.
+func New(cfg map[string][]config.ProcessorConfig) (*Engine, error) {
+	en := &Engine{byType: map[string]*Pipeline{}, byNamespace: map[string]*Pipeline{}}
+	for typ, steps := range cfg {
+		p, err := compile(typ, steps)
+		if err != nil {
+			en.Close()
+			return nil, err
+		}
+		if typ == "*" {
+			en.fallback = p
+			continue
+		}
+		en.byType[typ] = p
+	}
+	return en, nil
+}
+
+// Close stops the plugins of the configured pipelines.
+func (en *Engine) Close() {
+	for _, p := range en.byType {
+		p.Close()
+	}
+	if en.fallback != nil {
+		en.fallback.Close()
+	}
+}
+
+// SetNamespace makes p apply to the types in namespace ns that have no
+// pipeline of their own; a nil p removes it.
+func (en *Engine) SetNamespace(ns string, p *Pipeline) {
+	en.mu.Lock()
+	defer en.mu.Unlock()
+	if p == nil {
+		delete(en.byNamespace, ns)
+		return
+	}
+	en.byNamespace[ns] = p
+}
+
+// For returns the pipeline for eventType, or nil if none applies: the type's
+// own pipeline, then that of its innermost namespace, then "*".
+func (en *Engine) For(eventType string) *Pipeline {
+	if p, ok := en.byType[eventType]; ok {
+		return p
+	}
+	en.mu.RLock()
+	defer en.mu.RUnlock()
+	var best *Pipeline
+	bestLen := -1
+	for ns, p := range en.byNamespace {
+		if len(ns) > bestLen && event.InNamespace(eventType, ns) {
+			best, bestLen = p, len(ns)
+		}
+	}
+	if best != nil {
+		return best
+	}
+	return en.fallback
+}
+
+// Process runs the pipeline for e's type, if any, on e sent by c, until ctx
+// ends.
+func (en *Engine) Process(ctx context.Context, e *event.Event, c Client) error {
+	if p := en.For(e.Type); p != nil {
+		return p.Run(ctx, e, c)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+func run(t *testing.T, en *Engine, typ, payload string) (event.Event, error) {
+	t.Helper()
+	e := event.Event{Type: typ, Payload: json.RawMessage(payload)}
+	err := en.Process(context.Background(), &e, Client{})
+	return e, err
+}
+
+// TestEngine picks the type's own pipeline, then its namespace's, then "*",
+// and runs the steps in order on the payload, tags and metadata.
+func TestEngine(t *testing.T) {
+	en, err := New(map[string][]config.ProcessorConfig{
+		"order.created": {
+			{Rename: map[string]string{"amt": "amount"}},
+			{Coerce: map[string]string{"amount": "float", "qty": "int", "gift": "bool"}},
+			{Drop: []string{"internal"}},
+			{Tags: []string{"orders"}},
+			{Metadata: map[string]string{"pipeline": "orders"}},
+		},
+		"*": {{Metadata: map[string]string{"pipeline": "default"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer en.Close()
+	ns, err := Compile("acme", []config.ProcessorConfig{{Metadata: map[string]string{"pipeline": "acme"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	en.SetNamespace("acme", ns)
+
+	e, err := run(t, en, "order.created", `{"amt":"12.50","qty":"3","gift":"true","internal":1,"note":"x"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(e.Payload); got != `{"amount":12.5,"gift":true,"note":"x","qty":3}` {
+		t.Errorf("payload %s", got)
+	}
+	if !slices.Equal(e.Tags, []string{"orders"}) || e.Metadata["pipeline"] != "orders" {
+		t.Errorf("tags %v, metadata %v", e.Tags, e.Metadata)
+	}
+
+	for typ, want := range map[string]string{"acme/login": "acme", "login": "default", "acmecorp/login": "default"} {
+		if e, err := run(t, en, typ, `{"a":1}`); err != nil || e.Metadata["pipeline"] != want || string(e.Payload) != `{"a":1}` {
+			t.Errorf("%s: metadata %v, payload %s, %v", typ, e.Metadata, e.Payload, err)
+		}
+	}
+	en.SetNamespace("acme", nil)
+	if e, _ := run(t, en, "acme/login", `{}`); e.Metadata["pipeline"] != "default" {
+		t.Errorf("after removing the namespace pipeline: %v", e.Metadata)
+	}
+}
+
+// TestOnError refuses an event a step fails on, unless the step is skipped,
+// which rolls back its changes and carries on with the next step.
+func TestOnError(t *testing.T) {
+	steps := func(onError string) []config.ProcessorConfig {
+		return []config.ProcessorConfig{
+			{Name: "count", OnError: onError, Coerce: map[string]string{"a": "int", "b": "int"}},
+			{Tags: []string{"seen"}},
+		}
+	}
+	reject, err := New(map[string][]config.ProcessorConfig{"*": steps("")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run(t, reject, "x", `{"a":"1","b":"many"}`); err == nil || !strings.Contains(err.Error(), "processor count") {
+		t.Errorf("reject: %v", err)
+	}
+
+	skip, err := New(map[string][]config.ProcessorConfig{"*": steps("skip")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := run(t, skip, "x", `{"a":"1","b":"many"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(e.Payload) != `{"a":"1","b":"many"}` || !slices.Equal(e.Tags, []string{"seen"}) {
+		t.Errorf("skip: payload %s, tags %v", e.Payload, e.Tags)
+	}
+}
+
+// halfway changes the payload and the tags, then panics.
+type halfway struct{}
+
+func (halfway) Kind() string { return "halfway" }
+
+func (halfway) Process(it *Item) error {
+	it.Payload["a"] = "changed"
+	it.Dirty = true
+	it.Event.Tags = append(it.Event.Tags, "half")
+	panic("bug")
+}
+
+// TestPanicIsolated turns a panicking step into an error and rolls back what
+// it changed before the panic.
+func TestPanicIsolated(t *testing.T) {
+	tag, err := Compile("t", []config.ProcessorConfig{{Tags: []string{"seen"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, skip := range []bool{false, true} {
+		p := &Pipeline{name: "t", steps: []step{{name: "halfway", proc: halfway{}, skipOnError: skip}, tag.steps[0]}}
+		e := event.Event{Type: "x", Payload: json.RawMessage(`{"a":1}`)}
+		err := p.Run(context.Background(), &e, Client{})
+		if skip && (err != nil || string(e.Payload) != `{"a":1}` || !slices.Equal(e.Tags, []string{"seen"})) {
+			t.Errorf("skipped: payload %s, tags %v, %v", e.Payload, e.Tags, err)
+		}
+		if !skip && (err == nil || !strings.Contains(err.Error(), "panic: bug")) {
+			t.Errorf("rejected: %v", err)
+		}
+	}
+}
+
+// TestTrace returns the event after every step without changing how Run
+// would treat it.
+func TestTrace(t *testing.T) {
+	p, err := Compile("t", []config.ProcessorConfig{
+		{Name: "rename", Rename: map[string]string{"a": "b"}},
+		{Name: "tag", Tags: []string{"t1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := event.Event{Type: "x", Payload: json.RawMessage(`{"a":1}`)}
+	trace, err := p.Trace(context.Background(), &e, Client{})
+	if err != nil || len(trace) != 2 {
+		t.Fatalf("trace %+v, %v", trace, err)
+	}
+	if trace[0].Processor != "rename" || string(trace[0].Payload) != `{"b":1}` || len(trace[0].Tags) != 0 {
+		t.Errorf("after rename: %+v", trace[0])
+	}
+	if !slices.Equal(trace[1].Tags, []string{"t1"}) {
+		t.Errorf("after tag: %+v", trace[1])
+	}
+}
+
+// TestRedact masks, hashes and removes the configured fields and what the
+// detectors find.
+func TestRedact(t *testing.T) {
+	p, err := Compile("pii", []config.ProcessorConfig{{Redact: []config.RedactRuleConfig{
+		{Fields: []string{"$.user.email", "*_token"}},
+		{Fields: []string{"$.cards[*].number"}, Action: "remove"},
+		{Fields: []string{"ssn"}, Action: "hash", HashKey: "k"},
+		{Fields: []string{"$.note"}, Detect: []string{"email", "credit_card"}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := event.Event{Type: "x", Payload: json.RawMessage(`{
+		"user": {"email": "a@example.com", "name": "Ann"},
+		"api_token": "t0k",
+		"cards": [{"number": "4111111111111111", "exp": "12/30"}],
+		"ssn": "123-45-6789",
+		"note": "mail b@example.org, card 4111 1111 1111 1111, order 1234567890123"
+	}`)}
+	if err := p.Run(context.Background(), &e, Client{}); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(e.Payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	user := got["user"].(map[string]any)
+	card := got["cards"].([]any)[0].(map[string]any)
+	if user["email"] != redacted || user["name"] != "Ann" || got["api_token"] != redacted {
+		t.Errorf("masked: %v", got)
+	}
+	if _, ok := card["number"]; ok || card["exp"] != "12/30" {
+		t.Errorf("removed: %v", card)
+	}
+	if ssn, _ := got["ssn"].(string); !strings.HasPrefix(ssn, "sha256:") || len(ssn) != len("sha256:")+64 {
+		t.Errorf("hashed: %q", ssn)
+	}
+	if note := got["note"]; note != "mail [REDACTED], card [REDACTED], order 1234567890123" {
+		t.Errorf("detected: %q", note)
+	}
+}
+
+// TestCompile refuses steps that set none or several processors, unknown
+// values, and plugins outside the service config.
+func TestCompile(t *testing.T) {
+	for name, c := range map[string]config.ProcessorConfig{
+		"empty":           {},
+		"two":             {Drop: []string{"a"}, Tags: []string{"b"}},
+		"coerce type":     {Coerce: map[string]string{"a": "date"}},
+		"on_error":        {OnError: "retry", Drop: []string{"a"}},
+		"redact action":   {Redact: []config.RedactRuleConfig{{Fields: []string{"a"}, Action: "shred"}}},
+		"redact detector": {Redact: []config.RedactRuleConfig{{Detect: []string{"iban"}}}},
+		"redact nothing":  {Redact: []config.RedactRuleConfig{{}}},
+		"plugin":          {Plugin: &config.PluginConfig{Command: "/bin/true"}},
+	} {
+		if _, err := Compile("p", []config.ProcessorConfig{c}); err == nil {
+			t.Errorf("%s: compiled", name)
+		}
+	}
+	if _, err := New(map[string][]config.ProcessorConfig{"x": {{}}}); err == nil {
+		t.Error("New: empty step compiled")
+	}
+}
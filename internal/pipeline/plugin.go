@@ -0,0 +1,62 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/pluginhost"
+)
+
+// plugin sends the event to a processor plugin and takes back its payload,
+// tags and metadata. The type stays, as namespace checks ran before.
+type plugin struct{ proc *pluginhost.Process }
+
+func (plugin) Kind() string { return "plugin" }
+
+func (p plugin) Process(it *Item) error {
+	if err := it.finish(); err != nil {
+		return err
+	}
+	in, err := json.Marshal(it.Event)
+	if err != nil {
+		return err
+	}
+	c, err := p.proc.Processor()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(it.Context(), p.proc.Timeout(time.Second))
+	defer cancel()
+	b, err := c.Process(ctx, in)
+	p.proc.Count(err)
+	if err != nil {
+		return err
+	}
+	var out event.Event
+	if err := json.Unmarshal(b, &out); err != nil {
+		return fmt.Errorf("plugin response: %w", err)
+	}
+	tags, err := event.NormalizeTags(out.Tags)
+	if err != nil {
+		return fmt.Errorf("plugin response: %w", err)
+	}
+	if !bytes.Equal(out.Payload, it.Event.Payload) {
+		next, err := newItem(it.ctx, &out, it.Client)
+		if err != nil {
+			return fmt.Errorf("plugin response: %w", err)
+		}
+		if next.Payload == nil {
+			return errors.New("plugin response: payload must be an object")
+		}
+		it.Payload, it.Dirty = next.Payload, true
+	}
+	it.Event.Tags, it.Event.Metadata = tags, out.Metadata
+	return nil
+}
+
+func (p plugin) Close() error { return p.proc.Close() }
@@ -0,0 +1,218 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/pluginhost"
+	sdk "github.com/rafaelosorio/go-ingest-service/pkg/plugin"
+)
+
+func newProcessor(pipeline string, i int, c config.ProcessorConfig) (Processor, error) {
+	var procs []Processor
+	if len(c.Rename) > 0 {
+		procs = append(procs, rename(c.Rename))
+	}
+	if len(c.Drop) > 0 {
+		procs = append(procs, drop(c.Drop))
+	}
+	if len(c.Metadata) > 0 {
+		procs = append(procs, metadata(c.Metadata))
+	}
+	if len(c.Coerce) > 0 {
+		for field, to := range c.Coerce {
+			switch to {
+			case "int", "float", "string", "bool":
+			default:
+				return nil, fmt.Errorf("coerce %s: unknown type %q", field, to)
+			}
+		}
+		procs = append(procs, coerce(c.Coerce))
+	}
+	if len(c.Tags) > 0 {
+		tags, err := event.NormalizeTags(c.Tags)
+		if err != nil {
+			return nil, err
+		}
+		procs = append(procs, addTags(tags))
+	}
+	if len(c.Redact) > 0 {
+		r, err := newRedact(pipeline, c.Redact)
+		if err != nil {
+			return nil, err
+		}
+		procs = append(procs, r)
+	}
+	if c.GeoIP != nil {
+		g, err := newGeo(*c.GeoIP)
+		if err != nil {
+			return nil, err
+		}
+		procs = append(procs, g)
+	}
+	if c.UserAgent != nil {
+		procs = append(procs, newAgent(*c.UserAgent))
+	}
+	if c.Plugin != nil {
+		if len(procs) > 0 {
+			return nil, errors.New("exactly one of rename, drop, metadata, coerce, tags, redact, geoip, user_agent, plugin must be set")
+		}
+		if c.Plugin.Command == "" {
+			return nil, errors.New("plugin.command is required")
+		}
+		name := c.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		proc, err := pluginhost.Start("processor/"+pipeline+"/"+name, sdk.ProcessorName, *c.Plugin)
+		if err != nil {
+			return nil, err
+		}
+		return plugin{proc: proc}, nil
+	}
+	if len(procs) != 1 {
+		return nil, errors.New("exactly one of rename, drop, metadata, coerce, tags, redact, geoip, user_agent, plugin must be set")
+	}
+	return procs[0], nil
+}
+
+// rename moves payload fields to new names, overwriting existing targets.
+type rename map[string]string
+
+func (rename) Kind() string { return "rename" }
+
+func (r rename) Process(it *Item) error {
+	if it.Payload == nil {
+		return nil
+	}
+	for from, to := range r {
+		if v, ok := it.Payload[from]; ok {
+			delete(it.Payload, from)
+			it.Payload[to] = v
+			it.Dirty = true
+		}
+	}
+	return nil
+}
+
+// drop removes payload fields.
+type drop []string
+
+func (drop) Kind() string { return "drop" }
+
+func (d drop) Process(it *Item) error {
+	if it.Payload == nil {
+		return nil
+	}
+	for _, f := range d {
+		if _, ok := it.Payload[f]; ok {
+			delete(it.Payload, f)
+			it.Dirty = true
+		}
+	}
+	return nil
+}
+
+// metadata sets static metadata entries.
+type metadata map[string]string
+
+func (metadata) Kind() string { return "metadata" }
+
+func (m metadata) Process(it *Item) error {
+	if it.Event.Metadata == nil {
+		it.Event.Metadata = make(map[string]string, len(m))
+	}
+	for k, v := range m {
+		it.Event.Metadata[k] = v
+	}
+	return nil
+}
+
+// addTags appends tags the event does not carry yet.
+type addTags []string
+
+func (addTags) Kind() string { return "tags" }
+
+func (t addTags) Process(it *Item) error {
+	for _, tag := range t {
+		if !it.Event.HasTag(tag) {
+			it.Event.Tags = append(it.Event.Tags, tag)
+		}
+	}
+	if len(it.Event.Tags) > event.MaxTags {
+		return fmt.Errorf("too many tags (max %d)", event.MaxTags)
+	}
+	return nil
+}
+
+// coerce converts payload fields to the configured scalar type. Absent
+// fields are ignored; values that cannot be converted fail the event.
+type coerce map[string]string
+
+func (coerce) Kind() string { return "coerce" }
+
+func (c coerce) Process(it *Item) error {
+	if it.Payload == nil {
+		return nil
+	}
+	for field, to := range c {
+		v, ok := it.Payload[field]
+		if !ok {
+			continue
+		}
+		out, err := convert(v, to)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", field, err)
+		}
+		it.Payload[field] = out
+		it.Dirty = true
+	}
+	return nil
+}
+
+func convert(v any, to string) (any, error) {
+	var s string
+	switch x := v.(type) {
+	case json.Number:
+		s = x.String()
+	case string:
+		s = x
+	case bool:
+		s = strconv.FormatBool(x)
+	case nil:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("cannot convert %T to %s", v, to)
+	}
+	switch to {
+	case "string":
+		return s, nil
+	case "int":
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f != math.Trunc(f) || math.Abs(f) > math.MaxInt64 {
+			return nil, fmt.Errorf("%q is not an integer", s)
+		}
+		return int64(f), nil
+	case "float":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", s)
+		}
+		return f, nil
+	case "bool":
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", s)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown type %q", to)
+}
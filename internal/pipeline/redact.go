@@ -0,0 +1,361 @@
+package pipeline
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+const redacted = "[REDACTED]"
+
+var detectors = map[string]func(string) [][]int{
+	"email": func(s string) [][]int { return emailPattern.FindAllStringIndex(s, -1) },
+	"credit_card": func(s string) [][]int {
+		var out [][]int
+		for _, loc := range cardPattern.FindAllStringIndex(s, -1) {
+			if luhn(s[loc[0]:loc[1]]) {
+				out = append(out, loc)
+			}
+		}
+		return out
+	},
+}
+
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+
+// cardPattern finds 13 to 19 digits, optionally grouped by spaces or dashes.
+var cardPattern = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+
+func luhn(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return sum%10 == 0
+}
+
+// redact applies its rules in order, counting every redacted value.
+type redact struct {
+	pipeline string
+	rules    []redactRule
+}
+
+type redactRule struct {
+	name    string
+	paths   [][]segment
+	detect  []func(string) [][]int
+	action  string
+	hashKey []byte
+}
+
+func newRedact(pipeline string, cfgs []config.RedactRuleConfig) (redact, error) {
+	r := redact{pipeline: pipeline}
+	for i, c := range cfgs {
+		rule := redactRule{name: c.Name, action: c.Action, hashKey: []byte(c.HashKey)}
+		if rule.name == "" {
+			rule.name = strconv.Itoa(i)
+		}
+		switch rule.action {
+		case "":
+			rule.action = "mask"
+		case "mask", "hash", "remove":
+		default:
+			return redact{}, fmt.Errorf("redact %s: unknown action %q", rule.name, c.Action)
+		}
+		if len(c.Fields) == 0 && len(c.Detect) == 0 {
+			return redact{}, fmt.Errorf("redact %s: fields or detect is required", rule.name)
+		}
+		for _, f := range c.Fields {
+			segs, err := parsePath(f)
+			if err != nil {
+				return redact{}, fmt.Errorf("redact %s: field %q: %w", rule.name, f, err)
+			}
+			rule.paths = append(rule.paths, segs)
+		}
+		for _, d := range c.Detect {
+			find, ok := detectors[d]
+			if !ok {
+				return redact{}, fmt.Errorf("redact %s: unknown detector %q", rule.name, d)
+			}
+			rule.detect = append(rule.detect, find)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+func (redact) Kind() string { return "redact" }
+
+func (r redact) Process(it *Item) error {
+	if it.Payload == nil {
+		return nil
+	}
+	for _, rule := range r.rules {
+		n := 0
+		var fn func(any) (any, bool)
+		fn = func(v any) (any, bool) {
+			switch v.(type) {
+			case map[string]any, []any:
+				if len(rule.detect) > 0 {
+					walkValues(v, fn)
+					return v, true
+				}
+			}
+			out, keep, changed := rule.apply(v)
+			if changed {
+				n++
+			}
+			return out, keep
+		}
+		if len(rule.paths) == 0 {
+			walkValues(it.Payload, fn)
+		}
+		for _, segs := range rule.paths {
+			visit(it.Payload, segs, fn)
+		}
+		if n == 0 {
+			continue
+		}
+		it.Dirty = true
+		if !it.dryRun {
+			redactionsTotal.WithLabelValues(r.pipeline, rule.name).Add(float64(n))
+		}
+	}
+	return nil
+}
+
+// apply redacts v: whole without detectors, otherwise the matches in v if it
+// is a string. It returns the new value, false to remove it, and whether
+// anything changed.
+func (rule redactRule) apply(v any) (any, bool, bool) {
+	if len(rule.detect) == 0 {
+		if rule.action == "remove" {
+			return nil, false, true
+		}
+		return rule.replace(v), true, true
+	}
+	s, ok := v.(string)
+	if !ok {
+		return v, true, false
+	}
+	changed := false
+	for _, find := range rule.detect {
+		locs := find(s)
+		if len(locs) == 0 {
+			continue
+		}
+		changed = true
+		if rule.action == "remove" {
+			return nil, false, true
+		}
+		var b strings.Builder
+		last := 0
+		for _, loc := range locs {
+			b.WriteString(s[last:loc[0]])
+			b.WriteString(rule.replace(s[loc[0]:loc[1]]).(string))
+			last = loc[1]
+		}
+		b.WriteString(s[last:])
+		s = b.String()
+	}
+	return s, true, changed
+}
+
+func (rule redactRule) replace(v any) any {
+	if rule.action == "mask" {
+		return redacted
+	}
+	var raw []byte
+	switch x := v.(type) {
+	case string:
+		raw = []byte(x)
+	case json.Number:
+		raw = []byte(x.String())
+	default:
+		raw, _ = json.Marshal(x)
+	}
+	mac := hmac.New(sha256.New, rule.hashKey)
+	mac.Write(raw)
+	return "sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// segment is one step of a path: a key pattern (path.Match syntax, "*" for
+// any key), an array index (-1 for any element), and whether it matches at
+// any depth below the current value.
+type segment struct {
+	key     string
+	index   int
+	isIndex bool
+	descend bool
+}
+
+// parsePath reads the JSONPath subset $.a.b, $.a[*], $.a[0], $..a and
+// $.a['b.c'], or a field name pattern, which matches at any depth.
+func parsePath(p string) ([]segment, error) {
+	if !strings.HasPrefix(p, "$") {
+		if p == "" {
+			return nil, errors.New("empty path")
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, err
+		}
+		return []segment{{key: p, descend: true}}, nil
+	}
+	var segs []segment
+	rest := p[1:]
+	for rest != "" {
+		var s segment
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			s.descend = true
+			rest = rest[2:]
+		case rest[0] == '.':
+			rest = rest[1:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, errors.New("unterminated [")
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				s.isIndex, s.index = true, -1
+			case len(inner) >= 2 && inner[0] == '\'' && inner[len(inner)-1] == '\'':
+				s.key = inner[1 : len(inner)-1]
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("invalid index %q", inner)
+				}
+				s.isIndex, s.index = true, n
+			}
+			segs = append(segs, s)
+			continue
+		default:
+			return nil, fmt.Errorf("unexpected %q", rest[:1])
+		}
+		end := strings.IndexAny(rest, ".[")
+		if end < 0 {
+			end = len(rest)
+		}
+		s.key, rest = rest[:end], rest[end:]
+		if s.key == "" {
+			return nil, errors.New("empty key")
+		}
+		if _, err := path.Match(s.key, ""); err != nil {
+			return nil, err
+		}
+		segs = append(segs, s)
+	}
+	if len(segs) == 0 {
+		return nil, errors.New("path selects the whole payload")
+	}
+	return segs, nil
+}
+
+func (s segment) matchKey(k string) bool {
+	if s.isIndex {
+		return false
+	}
+	ok, _ := path.Match(s.key, k)
+	return ok
+}
+
+func (s segment) matchIndex(i int) bool {
+	return s.isIndex && (s.index < 0 || s.index == i)
+}
+
+// visit calls fn on the values segs select under v, in place: fn returns
+// the new value, or false to remove it (array elements become null).
+func visit(v any, segs []segment, fn func(any) (any, bool)) {
+	s, rest := segs[0], segs[1:]
+	step := func(child any, set func(any), del func()) {
+		if len(rest) == 0 {
+			if out, keep := fn(child); keep {
+				set(out)
+			} else {
+				del()
+			}
+			return
+		}
+		visit(child, rest, fn)
+	}
+	switch x := v.(type) {
+	case map[string]any:
+		for k, child := range x {
+			if s.matchKey(k) {
+				step(child, func(out any) { x[k] = out }, func() { delete(x, k) })
+				if _, ok := x[k]; !ok {
+					continue
+				}
+				child = x[k]
+			}
+			if s.descend {
+				visit(child, segs, fn)
+			}
+		}
+	case []any:
+		for i, child := range x {
+			if s.matchIndex(i) {
+				step(child, func(out any) { x[i] = out }, func() { x[i] = nil })
+				child = x[i]
+			}
+			if s.descend {
+				visit(child, segs, fn)
+			}
+		}
+	}
+}
+
+// walkValues calls fn on every scalar under v, like visit.
+func walkValues(v any, fn func(any) (any, bool)) {
+	switch x := v.(type) {
+	case map[string]any:
+		for k, child := range x {
+			switch child.(type) {
+			case map[string]any, []any:
+				walkValues(child, fn)
+				continue
+			}
+			if out, keep := fn(child); keep {
+				x[k] = out
+			} else {
+				delete(x, k)
+			}
+		}
+	case []any:
+		for i, child := range x {
+			switch child.(type) {
+			case map[string]any, []any:
+				walkValues(child, fn)
+				continue
+			}
+			if out, keep := fn(child); keep {
+				x[i] = out
+			} else {
+				x[i] = nil
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Package pluginhost runs the plugin binaries of sinks and processors and
+// starts them again when they exit, so a crashing plugin only fails the
+// calls made while it is down.
+package pluginhost
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	goplugin "github.com/hashicorp/go-plugin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	sdk "github.com/rafaelosorio/go-ingest-service/pkg/plugin"
+)
+
+var (
+	restartsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "plugin_restarts_total", Help: "Plugin processes started again after exiting"},
+		[]string{"plugin"},
+	)
+	callsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "plugin_calls_total", Help: "Calls to plugins by result (ok, error)"},
+		[]string{"plugin", "result"},
+	)
+)
+
+// Collectors returns the plugin metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{restartsTotal, callsTotal}
+}
+
+var ErrClosed = errors.New("plugin closed")
+
+// restartDelay spaces out the starts of a plugin that keeps exiting.
+const restartDelay = time.Second
+
+// Process is a running plugin binary serving one plugin kind.
+type Process struct {
+	name string
+	kind string
+	cfg  config.PluginConfig
+
+	mu      sync.Mutex
+	client  *goplugin.Client
+	raw     any
+	started time.Time
+	closed  bool
+}
+
+// Start runs the binary of cfg and dispenses its plugin of kind
+// (sdk.SinkName or sdk.ProcessorName); name identifies it in logs and metrics.
+func Start(name, kind string, cfg config.PluginConfig) (*Process, error) {
+	p := &Process{name: name, kind: kind, cfg: cfg}
+	if err := p.start(); err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", name, err)
+	}
+	return p, nil
+}
+
+func (p *Process) start() error {
+	p.started = time.Now()
+	cmd := exec.Command(p.cfg.Command, p.cfg.Args...)
+	cmd.Env = append(os.Environ(), p.cfg.Env...)
+	c := goplugin.NewClient(&goplugin.ClientConfig{
+		HandshakeConfig:  sdk.Handshake,
+		Plugins:          sdk.PluginSet(),
+		Cmd:              cmd,
+		AllowedProtocols: []goplugin.Protocol{goplugin.ProtocolGRPC},
+		StartTimeout:     10 * time.Second,
+		Stderr:           os.Stderr,
+		Logger: hclog.New(&hclog.LoggerOptions{
+			Name:   "plugin." + p.name,
+			Level:  hclog.Warn,
+			Output: os.Stderr,
+		}),
+	})
+	rpc, err := c.Client()
+	if err != nil {
+		c.Kill()
+		return err
+	}
+	raw, err := rpc.Dispense(p.kind)
+	if err != nil {
+		c.Kill()
+		return err
+	}
+	p.client, p.raw = c, raw
+	return nil
+}
+
+// get returns the dispensed plugin, starting the binary again if it exited.
+func (p *Process) get() (any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrClosed
+	}
+	if p.client != nil && !p.client.Exited() {
+		return p.raw, nil
+	}
+	if time.Since(p.started) < restartDelay {
+		return nil, fmt.Errorf("plugin %s: not running", p.name)
+	}
+	if p.client != nil {
+		p.client.Kill()
+		p.client, p.raw = nil, nil
+	}
+	restartsTotal.WithLabelValues(p.name).Inc()
+	log.Warn().Str("plugin", p.name).Msg("plugin exited, restarting")
+	if err := p.start(); err != nil {
+		return nil, fmt.Errorf("plugin %s: restart: %w", p.name, err)
+	}
+	return p.raw, nil
+}
+
+// Sink returns the client of a sink plugin.
+func (p *Process) Sink() (*sdk.SinkClient, error) {
+	raw, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	return raw.(*sdk.SinkClient), nil
+}
+
+// Processor returns the client of a processor plugin.
+func (p *Process) Processor() (*sdk.ProcessorClient, error) {
+	raw, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	return raw.(*sdk.ProcessorClient), nil
+}
+
+// Timeout is the configured call timeout, def when unset.
+func (p *Process) Timeout(def time.Duration) time.Duration {
+	if p.cfg.Timeout > 0 {
+		return p.cfg.Timeout
+	}
+	return def
+}
+
+// Count records the result of a call.
+func (p *Process) Count(err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	callsTotal.WithLabelValues(p.name, result).Inc()
+}
+
+// Close stops the binary.
+func (p *Process) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.client != nil {
+		p.client.Kill()
+	}
+	return nil
+}
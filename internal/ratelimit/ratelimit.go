@@ -0,0 +1,207 @@
+// Package ratelimit caps the requests per second of each API key in a route
+// group with token buckets. The buckets live in the process, or in Redis
+// when server.rate_limit.redis_url is set, so that replicas behind a load
+// balancer share one budget per key instead of each granting it in full.
+// While Redis cannot be reached, every instance falls back to a local
+// bucket holding its share of the rate.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/auth"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/httpx"
+)
+
+var (
+	limitedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "rate_limited_requests_total", Help: "Requests refused with 429 by a route group's rate limit, by group"},
+		[]string{"group"},
+	)
+	redisErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "rate_limit_redis_errors_total", Help: "Rate limit checks that could not reach Redis and were decided locally"},
+	)
+	redisUp = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "rate_limit_redis_up", Help: "1 while the rate limit budgets are shared through Redis, 0 while each instance limits locally"},
+	)
+)
+
+// Collectors returns the rate limit metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{limitedTotal, redisErrors, redisUp}
+}
+
+const (
+	// redisBackoff is how long checks stay local after Redis failed, so
+	// requests do not each wait out a timeout while it is down.
+	redisBackoff = time.Second
+	// sweepEvery spaces the passes forgetting full local buckets.
+	sweepEvery = time.Minute
+)
+
+// bucket is a token bucket refilled at its rate up to its burst; refill is
+// how long it takes from empty to full.
+type bucket struct {
+	tokens float64
+	last   time.Time
+	refill time.Duration
+}
+
+// Limiter holds the budgets of every rate limited route group.
+type Limiter struct {
+	instances int
+	redis     *redisClient
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	swept     time.Time
+	downUntil time.Time
+	down      bool
+}
+
+// New returns a Limiter keeping its budgets as cfg says.
+func New(cfg config.RateLimitConfig) (*Limiter, error) {
+	l := &Limiter{instances: max(cfg.Instances, 1), buckets: map[string]*bucket{}, swept: time.Now()}
+	if cfg.RedisURL != "" {
+		c, err := newRedisClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		l.redis = c
+		redisUp.Set(1)
+	}
+	return l, nil
+}
+
+// Middleware limits the requests of each caller to the group's rate_limit,
+// answering 429 with Retry-After beyond it. It runs after authentication;
+// unauthenticated callers are limited per client address.
+func (l *Limiter) Middleware(group string, g config.RouteGroupConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if g.RateLimit <= 0 {
+			return next
+		}
+		burst := g.Burst
+		if burst <= 0 {
+			burst = max(int(math.Ceil(g.RateLimit)), 1)
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.RemoteAddr
+			if host, _, err := net.SplitHostPort(key); err == nil {
+				key = host
+			}
+			if p, ok := auth.FromContext(r.Context()); ok {
+				key = "key:" + p.Subject
+			}
+			if ok, wait := l.Allow(r.Context(), group+":"+key, g.RateLimit, burst); !ok {
+				limitedTotal.WithLabelValues(group).Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+				httpx.Error(w, "rate limit of "+strconv.FormatFloat(g.RateLimit, 'f', -1, 64)+" requests per second exceeded", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Allow takes a token from the bucket of key, reporting how long until one
+// is due when there is none. Asking Redis stops when ctx ends.
+func (l *Limiter) Allow(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration) {
+	if l.redis != nil && l.redisReady() {
+		wait, err := l.redis.take(ctx, key, rate, burst)
+		if ctx.Err() == nil {
+			// a canceled request says nothing about Redis
+			l.redisDone(err)
+		}
+		if err == nil {
+			return wait <= 0, wait
+		}
+	}
+	if l.redis != nil {
+		// each instance grants its share until Redis is back
+		rate /= float64(l.instances)
+		burst = max(burst/l.instances, 1)
+	}
+	return l.local(key, rate, burst)
+}
+
+// local draws from the in-process bucket of key.
+func (l *Limiter) local(key string, rate float64, burst int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.swept) >= sweepEvery {
+		l.sweep(now)
+	}
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: float64(burst), last: now, refill: time.Duration(float64(burst) / rate * float64(time.Second))}
+		l.buckets[key] = b
+	}
+	b.tokens = min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets the buckets idle long enough to be full again. The caller
+// holds l.mu.
+func (l *Limiter) sweep(now time.Time) {
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > b.refill {
+			delete(l.buckets, k)
+		}
+	}
+	l.swept = now
+}
+
+// redisReady reports whether Redis is worth asking, that is not within
+// redisBackoff of a failure.
+func (l *Limiter) redisReady() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !l.down || time.Now().After(l.downUntil)
+}
+
+// redisDone records the outcome of a call to Redis, logging when the
+// budgets stop or resume being shared.
+func (l *Limiter) redisDone(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil {
+		redisErrors.Inc()
+		l.downUntil = time.Now().Add(redisBackoff)
+		if !l.down {
+			l.down = true
+			redisUp.Set(0)
+			log.Warn().Err(err).Int("instances", l.instances).Msg("rate limit: redis unreachable, limiting locally")
+		}
+		return
+	}
+	if l.down {
+		l.down = false
+		redisUp.Set(1)
+		log.Info().Msg("rate limit: redis reachable again, budgets shared")
+	}
+}
+
+// Close closes the connections to Redis.
+func (l *Limiter) Close() error {
+	if l.redis != nil {
+		l.redis.close()
+	}
+	return nil
+}
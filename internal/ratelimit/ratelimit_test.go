@@ -0,0 +1,129 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/resp"
+)
+
+// TestMiddleware lets a caller's burst through and refuses the next request
+// with 429 and Retry-After, keeping other callers' budgets apart.
+func TestMiddleware(t *testing.T) {
+	l, err := New(config.RateLimitConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := l.Middleware("ingest", config.RouteGroupConfig{RateLimit: 0.5, Burst: 2})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	call := func(addr string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/v1/events", nil)
+		req.RemoteAddr = addr
+		h.ServeHTTP(w, req)
+		return w
+	}
+	for i := range 2 {
+		if w := call("10.0.0.1:1234"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: %d", i, w.Code)
+		}
+	}
+	w := call("10.0.0.1:4321")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("over the burst: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := call("10.0.0.2:1234"); w.Code != http.StatusOK {
+		t.Fatalf("other caller: %d", w.Code)
+	}
+}
+
+// TestRedis takes the verdict of the script in Redis, loading the script
+// when Redis lacks it.
+func TestRedis(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	calls := make(chan string, 10)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		rd := bufio.NewReader(c)
+		for {
+			cmd, err := resp.ReadReply(rd)
+			if err != nil {
+				return
+			}
+			args := cmd.([]any)
+			calls <- args[0].(string) + " " + args[3].(string)
+			switch {
+			case args[0] == "EVALSHA":
+				c.Write([]byte("-NOSCRIPT No matching script\r\n"))
+			case args[3] == "ingest:ratelimit:g:full":
+				c.Write([]byte(":1500\r\n"))
+			default:
+				c.Write([]byte(":0\r\n"))
+			}
+		}
+	}()
+	l, err := New(config.RateLimitConfig{RedisURL: "redis://" + ln.Addr().String(), Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if ok, _ := l.Allow(context.Background(), "g:free", 1, 1); !ok {
+		t.Fatal("refused with a token in Redis")
+	}
+	if ok, wait := l.Allow(context.Background(), "g:full", 1, 1); ok || wait != 1500*time.Millisecond {
+		t.Fatalf("Allow = %v, %s", ok, wait)
+	}
+	close(calls)
+	var got []string
+	for c := range calls {
+		got = append(got, c)
+	}
+	if want := "EVALSHA ingest:ratelimit:g:free,EVAL ingest:ratelimit:g:free,EVALSHA ingest:ratelimit:g:full,EVAL ingest:ratelimit:g:full"; strings.Join(got, ",") != want {
+		t.Fatalf("calls %v", got)
+	}
+}
+
+// TestRedisDown limits locally, to the instance's share of the rate, while
+// Redis cannot be reached.
+func TestRedisDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	l, err := New(config.RateLimitConfig{RedisURL: "redis://" + addr, Instances: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := 0
+	for range 10 {
+		if ok, _ := l.Allow(context.Background(), "g:k", 1, 4); ok {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Fatalf("allowed %d of a burst of 4 shared by 2 instances", allowed)
+	}
+	if l.redisReady() {
+		t.Fatal("redis asked again right after failing")
+	}
+
+	if _, err := New(config.RateLimitConfig{RedisURL: "http://localhost"}); err == nil {
+		t.Fatal("accepted an http:// redis_url")
+	}
+}
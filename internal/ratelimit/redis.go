@@ -0,0 +1,136 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/resp"
+)
+
+// takeScript is the token bucket run atomically in Redis. It reads Redis's
+// clock, so the instances' clocks need not agree, and returns 0 when a
+// token was taken, else the milliseconds until one is due. A bucket
+// expires once it would be full again.
+const takeScript = `
+local rate, burst = tonumber(ARGV[1]), tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = t[1] * 1000 + math.floor(t[2] / 1000)
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'at')
+local tokens, at = tonumber(b[1]), tonumber(b[2])
+if tokens == nil or at == nil then
+  tokens, at = burst, now
+end
+tokens = math.min(burst, tokens + math.max(0, now - at) * rate / 1000)
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+else
+  wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'at', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return wait
+`
+
+var takeSHA = func() string {
+	sum := sha1.Sum([]byte(takeScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// maxIdle is how many connections to Redis are kept between checks.
+const maxIdle = 16
+
+// redisClient runs takeScript over a small pool of connections. A
+// connection is dropped after any error other than an error reply.
+type redisClient struct {
+	opts    resp.Options
+	prefix  string
+	timeout time.Duration
+	idle    chan *resp.Conn
+}
+
+func newRedisClient(cfg config.RateLimitConfig) (*redisClient, error) {
+	opts, err := resp.ParseURL(cfg.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("server.rate_limit.redis_url: %w", err)
+	}
+	c := &redisClient{
+		opts:    opts,
+		prefix:  cfg.Prefix,
+		timeout: cfg.Timeout,
+		idle:    make(chan *resp.Conn, maxIdle),
+	}
+	if c.prefix == "" {
+		c.prefix = "ingest:ratelimit:"
+	}
+	if c.timeout <= 0 {
+		c.timeout = 50 * time.Millisecond
+	}
+	return c, nil
+}
+
+// take runs takeScript on the bucket of key, loading the script when Redis
+// does not have it yet.
+func (c *redisClient) take(ctx context.Context, key string, rate float64, burst int) (time.Duration, error) {
+	args := []string{"1", c.prefix + key, strconv.FormatFloat(rate, 'f', -1, 64), strconv.Itoa(burst)}
+	reply, err := c.do(ctx, append([]string{"EVALSHA", takeSHA}, args...))
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		reply, err = c.do(ctx, append([]string{"EVAL", takeScript}, args...))
+	}
+	if err != nil {
+		return 0, err
+	}
+	ms, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply %v", reply)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// do sends cmd on a pooled connection and reads its reply. An error reply
+// is returned as a resp.Error.
+func (c *redisClient) do(ctx context.Context, cmd []string) (any, error) {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := conn.Do(ctx, c.timeout, cmd)
+	var replyErr resp.Error
+	if err != nil && !errors.As(err, &replyErr) {
+		_ = conn.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- conn:
+	default:
+		_ = conn.Close()
+	}
+	return replies[0], err
+}
+
+func (c *redisClient) get(ctx context.Context) (*resp.Conn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+	return resp.Dial(ctx, c.opts, c.timeout)
+}
+
+func (c *redisClient) close() {
+	for {
+		select {
+		case conn := <-c.idle:
+			_ = conn.Close()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Package receipt stores the events of async ingest requests in the
+// background and keeps a receipt of each for clients to poll, so they can
+// confirm the events are durable without holding the request open.
+package receipt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/ingestmetrics"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+// ErrQueueFull is returned by Submit when every queued request is still
+// waiting for a worker; the client should retry later or send synchronously.
+var ErrQueueFull = errors.New("async ingest queue is full")
+
+var (
+	queueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "async_ingest_queue_depth", Help: "Async ingest requests waiting for a worker"},
+	)
+	receiptsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "async_ingest_receipts_total", Help: "Async ingest requests resolved by status (stored, failed)"},
+		[]string{"status"},
+	)
+	// asyncDepth is the async queue's series of the pipeline dashboard
+	asyncDepth = ingestmetrics.QueueDepth.WithLabelValues("async")
+)
+
+// Collectors returns the async ingest metrics for registration by the
+// caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{queueDepth, receiptsTotal}
+}
+
+// Job stores the events of one request, returning the ID of each stored so
+// far, see storage.Receipt.EventIDs, and the error that stopped it. The
+// error becomes the receipt's message, so it must be fit for the client.
+type Job func() ([]int64, error)
+
+type job struct {
+	id  string
+	run Job
+}
+
+// Tracker runs the jobs of async requests on a fixed pool of workers.
+// Pending receipts are held in memory and saved to the store once
+// resolved, so a receipt unknown to a client that was given it means its
+// request was lost in a crash and must be sent again.
+type Tracker struct {
+	store storage.Store
+	ttl   time.Duration
+	queue chan job
+	wg    sync.WaitGroup
+
+	mu sync.Mutex
+	// live holds the pending receipts, and resolved ones the store failed
+	// to save, by ID.
+	live   map[string]storage.Receipt
+	swept  time.Time
+	closed bool
+}
+
+// New starts cfg.Workers workers saving receipts to store.
+func New(cfg config.AsyncConfig, store storage.Store) *Tracker {
+	t := &Tracker{
+		store: store,
+		ttl:   cfg.ReceiptTTL,
+		queue: make(chan job, cfg.QueueSize),
+		live:  map[string]storage.Receipt{},
+	}
+	for range cfg.Workers {
+		t.wg.Add(1)
+		go t.work()
+	}
+	return t
+}
+
+// Submit queues run for the request of owner carrying events and returns
+// its pending receipt, or ErrQueueFull.
+func (t *Tracker) Submit(owner string, events int, run Job) (storage.Receipt, error) {
+	now := time.Now().UTC()
+	r := storage.Receipt{ID: newID(), Status: storage.ReceiptPending, Owner: owner, Events: events,
+		CreatedAt: now, ExpiresAt: now.Add(t.ttl)}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return storage.Receipt{}, ErrQueueFull
+	}
+	select {
+	case t.queue <- job{id: r.ID, run: run}:
+	default:
+		return storage.Receipt{}, ErrQueueFull
+	}
+	// workers resolve under mu, so the receipt is live before its job runs
+	t.live[r.ID] = r
+	queueDepth.Inc()
+	asyncDepth.Inc()
+	return r, nil
+}
+
+// Lookup returns the receipts among ids that owner sent and that have not
+// expired, in the order of ids.
+func (t *Tracker) Lookup(ctx context.Context, owner string, ids ...string) ([]storage.Receipt, error) {
+	found := make(map[string]storage.Receipt, len(ids))
+	var rest []string
+	t.mu.Lock()
+	for _, id := range ids {
+		if r, ok := t.live[id]; ok {
+			found[id] = r
+		} else {
+			rest = append(rest, id)
+		}
+	}
+	t.mu.Unlock()
+	if len(rest) > 0 {
+		saved, err := t.store.Receipts(ctx, rest...)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range saved {
+			found[r.ID] = r
+		}
+	}
+	now := time.Now()
+	out := make([]storage.Receipt, 0, len(found))
+	for _, id := range ids {
+		if r, ok := found[id]; ok && r.Owner == owner && r.ExpiresAt.After(now) {
+			out = append(out, r)
+			delete(found, id)
+		}
+	}
+	return out, nil
+}
+
+// Close stops taking requests and waits for the queued ones to be stored.
+func (t *Tracker) Close() {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	close(t.queue)
+	t.mu.Unlock()
+	t.wg.Wait()
+}
+
+func (t *Tracker) work() {
+	defer t.wg.Done()
+	for j := range t.queue {
+		queueDepth.Dec()
+		asyncDepth.Dec()
+		ids, err := j.run()
+		t.resolve(j.id, ids, err)
+	}
+}
+
+// resolve records the outcome of the job of receipt id. When the store
+// cannot save it the receipt stays in memory, where it is still found.
+func (t *Tracker) resolve(id string, ids []int64, err error) {
+	now := time.Now().UTC()
+	t.mu.Lock()
+	r := t.live[id]
+	t.mu.Unlock()
+	r.Status, r.EventIDs, r.ResolvedAt, r.ExpiresAt = storage.ReceiptStored, ids, &now, now.Add(t.ttl)
+	if err != nil {
+		r.Status, r.Error = storage.ReceiptFailed, err.Error()
+	}
+	receiptsTotal.WithLabelValues(string(r.Status)).Inc()
+	saveErr := t.store.SaveReceipt(context.Background(), r)
+	if saveErr != nil {
+		log.Error().Err(saveErr).Str("receipt", id).Msg("save receipt")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if saveErr == nil {
+		delete(t.live, id)
+	} else {
+		t.live[id] = r
+	}
+	// unsaved receipts are swept at most once a minute
+	if now.Sub(t.swept) > time.Minute {
+		for k, v := range t.live {
+			if v.Status != storage.ReceiptPending && !v.ExpiresAt.After(now) {
+				delete(t.live, k)
+			}
+		}
+		t.swept = now
+	}
+}
+
+func newID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return "rcpt_" + hex.EncodeToString(b)
+}
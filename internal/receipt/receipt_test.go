@@ -0,0 +1,66 @@
+package receipt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+// TestTracker runs a stored and a failed job through one worker and checks
+// what their owner and another caller see, before and after Close.
+func TestTracker(t *testing.T) {
+	store := storage.NewMemory(1)
+	tr := New(config.AsyncConfig{Workers: 1, QueueSize: 1, ReceiptTTL: time.Hour}, store)
+	release := make(chan struct{})
+	ok, err := tr.Submit("alice", 2, func() ([]int64, error) {
+		<-release
+		return []int64{7, 8}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the worker holds the first job, the queue the second
+	deadline := time.Now().Add(5 * time.Second)
+	var failed storage.Receipt
+	for {
+		if failed, err = tr.Submit("alice", 1, func() ([]int64, error) { return nil, errors.New("storage error") }); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := tr.Submit("alice", 1, nil); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("got %v, want ErrQueueFull", err)
+	}
+
+	got, err := tr.Lookup(context.Background(), "alice", ok.ID, failed.ID, "rcpt_unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Status != storage.ReceiptPending || got[1].Status != storage.ReceiptPending {
+		t.Fatalf("want both pending: %+v", got)
+	}
+	if got, _ := tr.Lookup(context.Background(), "bob", ok.ID); len(got) != 0 {
+		t.Errorf("another caller sees the receipt: %+v", got)
+	}
+
+	close(release)
+	tr.Close()
+	got, err = tr.Lookup(context.Background(), "alice", ok.ID, failed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Status != storage.ReceiptStored || len(got[0].EventIDs) != 2 || got[0].ResolvedAt == nil ||
+		got[1].Status != storage.ReceiptFailed || got[1].Error != "storage error" {
+		t.Errorf("unexpected receipts: %+v", got)
+	}
+	if saved, _ := store.Receipts(context.Background(), ok.ID, failed.ID); len(saved) != 2 {
+		t.Errorf("%d receipts saved, want 2", len(saved))
+	}
+}
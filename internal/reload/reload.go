@@ -0,0 +1,143 @@
+// Package reload applies configuration changes to a running service. Only
+// routing rules, sampling rules, schema policies and the log level are
+// reloadable; the other settings keep the values loaded at startup until the
+// next restart.
+package reload
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+var (
+	generation = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "config_generation", Help: "Generation of the configuration in effect, 1 at startup"},
+	)
+	reloadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "config_reloads_total", Help: "Configuration reloads by result (applied, failed)"},
+		[]string{"result"},
+	)
+	lastReload = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "config_last_reload_timestamp_seconds", Help: "Time of the last applied configuration"},
+	)
+)
+
+// Collectors returns the reload metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{generation, reloadsTotal, lastReload}
+}
+
+// Step prepares a component for next, returning an error when next cannot
+// be applied to it. The returned commit makes next take effect and must not
+// fail.
+type Step func(next *config.Config) (commit func(), err error)
+
+// Reloader loads and applies new configurations, one at a time.
+type Reloader struct {
+	load  func() (*config.Config, error)
+	steps []Step
+
+	mu         sync.Mutex
+	current    *config.Config
+	generation int
+}
+
+// New starts at generation 1 with cur, which must already be applied.
+// load returns a validated configuration, like config.Load.
+func New(cur *config.Config, load func() (*config.Config, error), steps ...Step) *Reloader {
+	SetLogLevel(cur.LogLevel)
+	generation.Set(1)
+	lastReload.SetToCurrentTime()
+	return &Reloader{load: load, steps: steps, current: cur, generation: 1}
+}
+
+// Current returns the configuration in effect. Callers must not modify it.
+func (r *Reloader) Current() *config.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// Generation returns the generation of the configuration in effect.
+func (r *Reloader) Generation() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.generation
+}
+
+// Reload loads the configuration and applies its reloadable settings. Every
+// step is prepared before any is committed, so a configuration is either
+// applied as a whole or not at all. It returns the generation in effect.
+func (r *Reloader) Reload() (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	loaded, err := r.load()
+	if err != nil {
+		reloadsTotal.WithLabelValues("failed").Inc()
+		return r.generation, err
+	}
+	next := *r.current
+	next.Routing = loaded.Routing
+	next.Sampling = loaded.Sampling
+	next.Schemas = loaded.Schemas
+	next.LogLevel = loaded.LogLevel
+
+	commits := make([]func(), 0, len(r.steps))
+	for _, step := range r.steps {
+		commit, err := step(&next)
+		if err != nil {
+			reloadsTotal.WithLabelValues("failed").Inc()
+			return r.generation, err
+		}
+		commits = append(commits, commit)
+	}
+	for _, commit := range commits {
+		commit()
+	}
+	SetLogLevel(next.LogLevel)
+
+	r.current = &next
+	r.generation++
+	generation.Set(float64(r.generation))
+	reloadsTotal.WithLabelValues("applied").Inc()
+	lastReload.SetToCurrentTime()
+	if restart := restartNeeded(loaded, &next); len(restart) > 0 {
+		log.Warn().Strs("settings", restart).Msg("config changes need a restart to take effect")
+	}
+	log.Info().Int("generation", r.generation).Msg("config reloaded")
+	return r.generation, nil
+}
+
+// SetLogLevel applies a level accepted by config.Validate.
+func SetLogLevel(level string) {
+	l, err := zerolog.ParseLevel(level)
+	if err != nil {
+		log.Error().Err(err).Msg("log level")
+		return
+	}
+	zerolog.SetGlobalLevel(l)
+}
+
+// restartNeeded lists the top-level settings of loaded that differ from the
+// configuration in effect.
+func restartNeeded(loaded, applied *config.Config) []string {
+	var out []string
+	a, b := reflect.ValueOf(loaded).Elem(), reflect.ValueOf(applied).Elem()
+	for i := range a.NumField() {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			f := a.Type().Field(i)
+			name := f.Tag.Get("yaml")
+			if name == "" {
+				name = f.Name
+			}
+			out = append(out, name)
+		}
+	}
+	return out
+}
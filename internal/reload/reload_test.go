@@ -0,0 +1,71 @@
+package reload
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// TestReload applies the reloadable settings of a new configuration through
+// every step, or none of them when one step refuses it, and leaves the
+// other settings as they were until a restart.
+func TestReload(t *testing.T) {
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	cur := config.Default()
+	cur.LogLevel = "info"
+	var next *config.Config
+	var loadErr error
+	load := func() (*config.Config, error) { return next, loadErr }
+
+	var committed []string
+	refuse := false
+	step := func(name string) Step {
+		return func(c *config.Config) (func(), error) {
+			if refuse && name == "schemas" {
+				return nil, errors.New("bad schema")
+			}
+			return func() { committed = append(committed, name+":"+c.LogLevel) }, nil
+		}
+	}
+	r := New(cur, load, step("routing"), step("schemas"))
+
+	next = config.Default()
+	next.LogLevel = "debug"
+	next.Routing.Default = []string{"audit"}
+	next.HTTPAddr = ":9999"
+	if gen, err := r.Reload(); err != nil || gen != 2 {
+		t.Fatalf("reload: generation %d, %v", gen, err)
+	}
+	got := r.Current()
+	if got.LogLevel != "debug" || !slices.Equal(got.Routing.Default, []string{"audit"}) || got.HTTPAddr != cur.HTTPAddr {
+		t.Errorf("applied: log level %s, routing %v, http addr %s", got.LogLevel, got.Routing.Default, got.HTTPAddr)
+	}
+	if !slices.Equal(committed, []string{"routing:debug", "schemas:debug"}) {
+		t.Errorf("commits %v", committed)
+	}
+	if zerolog.GlobalLevel() != zerolog.DebugLevel {
+		t.Errorf("log level %v", zerolog.GlobalLevel())
+	}
+	if restart := restartNeeded(next, got); !slices.Contains(restart, "http_addr") || slices.Contains(restart, "log_level") {
+		t.Errorf("restart needed for %v", restart)
+	}
+
+	committed = nil
+	refuse = true
+	next = config.Default()
+	next.LogLevel = "warn"
+	if gen, err := r.Reload(); err == nil || gen != 2 {
+		t.Errorf("refused by a step: generation %d, %v", gen, err)
+	}
+	loadErr = errors.New("parse error")
+	if gen, err := r.Reload(); !errors.Is(err, loadErr) || gen != 2 {
+		t.Errorf("load failed: generation %d, %v", gen, err)
+	}
+	if len(committed) != 0 || r.Current().LogLevel != "debug" || r.Generation() != 2 {
+		t.Errorf("after failed reloads: commits %v, log level %s", committed, r.Current().LogLevel)
+	}
+}
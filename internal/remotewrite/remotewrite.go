@@ -0,0 +1,186 @@
+// Package remotewrite reads Prometheus remote-write requests (a
+// snappy-compressed WriteRequest protobuf) so Prometheus, Agent mode or any
+// compatible shipper can land samples in the service, and maps each sample
+// to an event.
+package remotewrite
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+var (
+	ErrInvalid  = errors.New("remote write: invalid request")
+	ErrTooLarge = errors.New("remote write: decoded request too large")
+)
+
+var samplesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "remote_write_samples_total", Help: "Remote-write samples received by result (accepted, rejected)"},
+	[]string{"result"},
+)
+
+// Collectors returns the remote-write metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{samplesTotal}
+}
+
+// Count records the outcome of a request.
+func Count(accepted, rejected int) {
+	samplesTotal.WithLabelValues("accepted").Add(float64(accepted))
+	samplesTotal.WithLabelValues("rejected").Add(float64(rejected))
+}
+
+// Sample is one value of a series, with the series' labels.
+type Sample struct {
+	Labels    map[string]string
+	Value     float64
+	Timestamp time.Time
+}
+
+// Event maps s to an event whose type is the metric name (the __name__
+// label) and whose payload holds the other labels, the value and the
+// timestamp. NaN and infinite values, such as staleness markers, are written
+// as strings ("NaN", "+Inf", "-Inf"), as the Prometheus HTTP API does.
+func (s *Sample) Event() (event.Event, error) {
+	name := s.Labels["__name__"]
+	if name == "" {
+		return event.Event{}, fmt.Errorf("%w: series without __name__", ErrInvalid)
+	}
+	labels := make(map[string]string, len(s.Labels)-1)
+	for k, v := range s.Labels {
+		if k != "__name__" {
+			labels[k] = v
+		}
+	}
+	var value any = s.Value
+	if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+		value = strconv.FormatFloat(s.Value, 'f', -1, 64)
+	}
+	raw, err := json.Marshal(map[string]any{"labels": labels, "value": value, "timestamp": s.Timestamp})
+	if err != nil {
+		return event.Event{}, err
+	}
+	return event.Event{Type: name, Payload: raw}, nil
+}
+
+// Decode reads a snappy-compressed WriteRequest whose decoded size is at
+// most max bytes (no limit when max <= 0).
+func Decode(body []byte, max int64) ([]Sample, error) {
+	n, err := snappy.DecodedLen(body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: snappy: %v", ErrInvalid, err)
+	}
+	if max > 0 && int64(n) > max {
+		return nil, ErrTooLarge
+	}
+	raw, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: snappy: %v", ErrInvalid, err)
+	}
+	return decodeWriteRequest(raw)
+}
+
+// The messages are read field by field, as the codec and otlp packages do,
+// following prometheus/prompb types.proto and remote.proto. Metadata, native
+// histograms and exemplars are skipped.
+
+// decodeWriteRequest reads WriteRequest: timeseries = 1.
+func decodeWriteRequest(data []byte) ([]Sample, error) {
+	var out []Sample
+	err := fields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num != 1 || typ != protowire.BytesType {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		msg, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		samples, err := decodeTimeSeries(msg)
+		out = append(out, samples...)
+		return n, err
+	})
+	return out, err
+}
+
+// decodeTimeSeries reads TimeSeries: labels = 1, samples = 2.
+func decodeTimeSeries(data []byte) ([]Sample, error) {
+	labels := map[string]string{}
+	var samples []Sample
+	err := fields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType || (num != 1 && num != 2) {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		msg, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		if num == 1 {
+			// Label: name = 1, value = 2
+			var name, value string
+			err := fields(msg, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+				if typ != protowire.BytesType || (num != 1 && num != 2) {
+					return protowire.ConsumeFieldValue(num, typ, b), nil
+				}
+				s, n := protowire.ConsumeString(b)
+				if num == 1 {
+					name = s
+				} else {
+					value = s
+				}
+				return n, nil
+			})
+			labels[name] = value
+			return n, err
+		}
+		// Sample: value = 1 (double), timestamp = 2 (milliseconds)
+		var s Sample
+		err := fields(msg, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+			switch {
+			case num == 1 && typ == protowire.Fixed64Type:
+				v, n := protowire.ConsumeFixed64(b)
+				s.Value = math.Float64frombits(v)
+				return n, nil
+			case num == 2 && typ == protowire.VarintType:
+				v, n := protowire.ConsumeVarint(b)
+				s.Timestamp = time.UnixMilli(int64(v)).UTC()
+				return n, nil
+			}
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		})
+		samples = append(samples, s)
+		return n, err
+	})
+	for i := range samples {
+		samples[i].Labels = labels
+	}
+	return samples, err
+}
+
+func fields(data []byte, fn func(protowire.Number, protowire.Type, []byte) (int, error)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("%w: %v", ErrInvalid, protowire.ParseError(n))
+		}
+		data = data[n:]
+		m, err := fn(num, typ, data)
+		if err != nil {
+			return err
+		}
+		if m < 0 {
+			return fmt.Errorf("%w: %v", ErrInvalid, protowire.ParseError(m))
+		}
+		data = data[m:]
+	}
+	return nil
+}
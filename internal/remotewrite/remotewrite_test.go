@@ -0,0 +1,104 @@
+package remotewrite
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type series struct {
+	labels  [][2]string
+	samples []float64
+}
+
+// writeRequest encodes a WriteRequest with samples one second apart from
+// start, as Prometheus sends it.
+func writeRequest(start time.Time, ss ...series) []byte {
+	var req []byte
+	for _, s := range ss {
+		var ts []byte
+		for _, l := range s.labels {
+			label := protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), l[0])
+			label = protowire.AppendString(protowire.AppendTag(label, 2, protowire.BytesType), l[1])
+			ts = protowire.AppendBytes(protowire.AppendTag(ts, 1, protowire.BytesType), label)
+		}
+		for i, v := range s.samples {
+			sample := protowire.AppendFixed64(protowire.AppendTag(nil, 1, protowire.Fixed64Type), math.Float64bits(v))
+			sample = protowire.AppendVarint(protowire.AppendTag(sample, 2, protowire.VarintType), uint64(start.Add(time.Duration(i)*time.Second).UnixMilli()))
+			ts = protowire.AppendBytes(protowire.AppendTag(ts, 2, protowire.BytesType), sample)
+		}
+		req = protowire.AppendBytes(protowire.AppendTag(req, 1, protowire.BytesType), ts)
+	}
+	return snappy.Encode(nil, req)
+}
+
+// TestDecode reads every sample of every series with the series' labels,
+// and refuses bodies that are not snappy, too large once decoded, or
+// truncated.
+func TestDecode(t *testing.T) {
+	start := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	body := writeRequest(start,
+		series{[][2]string{{"__name__", "http_requests_total"}, {"job", "api"}}, []float64{10, 12}},
+		series{[][2]string{{"__name__", "up"}}, []float64{1}},
+	)
+	samples, err := Decode(body, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 3 {
+		t.Fatalf("%d samples", len(samples))
+	}
+	s := samples[1]
+	if s.Labels["__name__"] != "http_requests_total" || s.Labels["job"] != "api" || s.Value != 12 || !s.Timestamp.Equal(start.Add(time.Second)) {
+		t.Errorf("sample %+v", s)
+	}
+	if samples[2].Labels["__name__"] != "up" || samples[2].Labels["job"] != "" {
+		t.Errorf("labels of another series: %v", samples[2].Labels)
+	}
+
+	raw, _ := snappy.Decode(nil, body)
+	for name, c := range map[string]struct {
+		body []byte
+		max  int64
+		want error
+	}{
+		"not snappy": {[]byte("plain protobuf?"), 0, ErrInvalid},
+		"too large":  {body, 10, ErrTooLarge},
+		"truncated":  {snappy.Encode(nil, raw[:len(raw)-3]), 0, ErrInvalid},
+	} {
+		if _, err := Decode(c.body, c.max); !errors.Is(err, c.want) {
+			t.Errorf("%s: %v, want %v", name, err, c.want)
+		}
+	}
+}
+
+// TestEvent maps a sample to an event of its metric name, writing values
+// JSON cannot hold as strings.
+func TestEvent(t *testing.T) {
+	at := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, c := range []struct {
+		value float64
+		want  string
+	}{
+		{0.25, `{"labels":{"job":"api"},"timestamp":"2025-01-02T03:04:05Z","value":0.25}`},
+		{math.NaN(), `{"labels":{"job":"api"},"timestamp":"2025-01-02T03:04:05Z","value":"NaN"}`},
+		{math.Inf(-1), `{"labels":{"job":"api"},"timestamp":"2025-01-02T03:04:05Z","value":"-Inf"}`},
+	} {
+		s := Sample{Labels: map[string]string{"__name__": "up", "job": "api"}, Value: c.value, Timestamp: at}
+		e, err := s.Event()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != "up" || string(e.Payload) != c.want || !json.Valid(e.Payload) {
+			t.Errorf("%v: %s %s", c.value, e.Type, e.Payload)
+		}
+	}
+	if _, err := (&Sample{Labels: map[string]string{"job": "api"}}).Event(); !errors.Is(err, ErrInvalid) {
+		t.Errorf("without __name__: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package resp
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Pool shares connections to one server between concurrent callers,
+// keeping up to maxIdle of them between calls. A connection is dropped
+// after any error other than an error reply.
+type Pool struct {
+	opts    Options
+	timeout time.Duration
+	idle    chan *Conn
+}
+
+// NewPool dials as o says when it needs a connection; timeout bounds each
+// dial and call.
+func NewPool(o Options, timeout time.Duration, maxIdle int) *Pool {
+	return &Pool{opts: o, timeout: timeout, idle: make(chan *Conn, maxIdle)}
+}
+
+// Do sends cmds on a pooled connection, see Conn.Do.
+func (p *Pool) Do(ctx context.Context, cmds ...[]string) ([]any, error) {
+	var conn *Conn
+	select {
+	case conn = <-p.idle:
+	default:
+		c, err := Dial(ctx, p.opts, p.timeout)
+		if err != nil {
+			return nil, err
+		}
+		conn = c
+	}
+	replies, err := conn.Do(ctx, p.timeout, cmds...)
+	var reply Error
+	if err != nil && !errors.As(err, &reply) {
+		_ = conn.Close()
+		return nil, err
+	}
+	select {
+	case p.idle <- conn:
+	default:
+		_ = conn.Close()
+	}
+	return replies, err
+}
+
+// Close closes the idle connections; those in use are closed as their
+// calls end, if the pool is full by then.
+func (p *Pool) Close() {
+	for {
+		select {
+		case conn := <-p.idle:
+			_ = conn.Close()
+		default:
+			return
+		}
+	}
+}
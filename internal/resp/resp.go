@@ -0,0 +1,207 @@
+// Package resp is the small part of the Redis protocol (RESP2) the service
+// speaks: dialing a redis:// or rediss:// URL with AUTH and SELECT, and
+// pipelining commands on the connection. It backs the Redis sink and the
+// shared rate limit budgets.
+package resp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options say where and as whom to connect.
+type Options struct {
+	// Host is the name the TLS certificate is checked against, Addr the
+	// host:port dialed.
+	Host string
+	Addr string
+	TLS  bool
+	User string
+	Pass string
+	DB   int
+}
+
+// ParseURL reads redis://[user:password@]host:port[/db], or rediss:// for
+// TLS. The port defaults to 6379.
+func ParseURL(raw string) (Options, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		return Options{}, errors.New("must be redis://[user:password@]host:port[/db] or rediss://")
+	}
+	o := Options{Host: u.Hostname(), Addr: u.Host, TLS: u.Scheme == "rediss", User: u.User.Username()}
+	if u.Port() == "" {
+		o.Addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	o.Pass, _ = u.User.Password()
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if o.DB, err = strconv.Atoi(db); err != nil || o.DB < 0 {
+			return Options{}, fmt.Errorf("database %q is not a number", db)
+		}
+	}
+	return o, nil
+}
+
+// Error is an error reply: the command failed but the connection is still
+// usable.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// Conn is a connection to Redis. It is not safe for concurrent use.
+type Conn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+// Dial connects as o says within timeout, or until ctx ends, and
+// authenticates and selects the database when o has them.
+func Dial(ctx context.Context, o Options, timeout time.Duration) (*Conn, error) {
+	d := &net.Dialer{Timeout: timeout}
+	var nc net.Conn
+	var err error
+	if o.TLS {
+		nc, err = (&tls.Dialer{NetDialer: d, Config: &tls.Config{ServerName: o.Host}}).DialContext(ctx, "tcp", o.Addr)
+	} else {
+		nc, err = d.DialContext(ctx, "tcp", o.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{Conn: nc, rd: bufio.NewReader(nc)}
+	var setup [][]string
+	switch {
+	case o.User != "" && o.Pass != "":
+		setup = append(setup, []string{"AUTH", o.User, o.Pass})
+	case o.User != "" || o.Pass != "":
+		setup = append(setup, []string{"AUTH", o.User + o.Pass})
+	}
+	if o.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(o.DB)})
+	}
+	if len(setup) > 0 {
+		if _, err := c.Do(ctx, timeout, setup...); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Do sends cmds in one write and reads their replies, within timeout or
+// until ctx ends, returning ctx's error then. An error reply fails it with
+// an Error once every reply is read; after any other error the connection
+// is unusable.
+func (c *Conn) Do(ctx context.Context, timeout time.Duration, cmds ...[]string) (replies []any, err error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	// a canceled call unblocks the connection at once
+	stop := context.AfterFunc(ctx, func() { _ = c.SetDeadline(time.Now()) })
+	defer func() {
+		if !stop() && ctx.Err() != nil {
+			replies, err = nil, ctx.Err()
+		}
+	}()
+	var buf []byte
+	for _, cmd := range cmds {
+		buf = AppendCommand(buf, cmd)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	replies = make([]any, len(cmds))
+	var first error
+	for i := range cmds {
+		v, err := ReadReply(c.rd)
+		var reply Error
+		if err != nil && !errors.As(err, &reply) {
+			return nil, err
+		}
+		if first == nil {
+			first = err
+		}
+		replies[i] = v
+	}
+	return replies, first
+}
+
+// AppendCommand encodes cmd as a RESP array of bulk strings.
+func AppendCommand(buf []byte, cmd []string) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(cmd)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range cmd {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// ReadReply reads one RESP reply: a string, an int64, nil or a []any of
+// those. An error reply is returned as an Error, after the rest of an
+// array holding it is read.
+func ReadReply(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		out := make([]any, n)
+		var first error
+		for i := range out {
+			v, err := ReadReply(rd)
+			var replyErr Error
+			if err != nil && !errors.As(err, &replyErr) {
+				return nil, err
+			}
+			if first == nil {
+				first = err
+			}
+			out[i] = v
+		}
+		return out, first
+	default:
+		return nil, fmt.Errorf("unexpected reply %q", line)
+	}
+}
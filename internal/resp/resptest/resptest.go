@@ -0,0 +1,572 @@
+// Package resptest runs an in-memory Redis for tests. It speaks the part of
+// Redis the service uses: DEL, PING, the hash commands HSET, HMGET, HDEL
+// and HINCRBY, and the stream commands XADD (with explicit IDs), XRANGE,
+// XREVRANGE, XGROUP CREATE, XREADGROUP, XACK, XPENDING and XAUTOCLAIM.
+package resptest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/resp"
+)
+
+// Server is the in-memory Redis. Its data is kept until the test ends.
+type Server struct {
+	// URL is the redis:// URL of the server.
+	URL string
+
+	ln net.Listener
+	mu sync.Mutex
+	// down makes the server drop every connection, as if unreachable
+	down    bool
+	hashes  map[string]map[string]string
+	streams map[string]*stream
+}
+
+type stream struct {
+	entries []entry
+	groups  map[string]*group
+}
+
+type entry struct {
+	id     streamID
+	fields []string
+}
+
+type group struct {
+	last    streamID
+	pending map[streamID]time.Time
+}
+
+// streamID is an entry ID, ms-seq.
+type streamID struct{ ms, seq uint64 }
+
+func (a streamID) less(b streamID) bool {
+	return a.ms < b.ms || (a.ms == b.ms && a.seq < b.seq)
+}
+
+func (a streamID) String() string { return fmt.Sprintf("%d-%d", a.ms, a.seq) }
+
+// NewServer starts a server closed when t ends.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{URL: "redis://" + ln.Addr().String(), ln: ln,
+		hashes: map[string]map[string]string{}, streams: map[string]*stream{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+// SetDown makes the server drop connections while down is true.
+func (s *Server) SetDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+// Len returns the number of entries of the stream key.
+func (s *Server) Len(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st := s.streams[key]; st != nil {
+		return len(st.entries)
+	}
+	return 0
+}
+
+func (s *Server) serve(c net.Conn) {
+	defer c.Close()
+	rd := bufio.NewReader(c)
+	for {
+		v, err := resp.ReadReply(rd)
+		if err != nil {
+			return
+		}
+		args, _ := v.([]any)
+		cmd := make([]string, len(args))
+		for i, a := range args {
+			cmd[i], _ = a.(string)
+		}
+		s.mu.Lock()
+		if s.down {
+			s.mu.Unlock()
+			return
+		}
+		reply := s.do(cmd)
+		s.mu.Unlock()
+		if _, err := c.Write(appendReply(nil, reply)); err != nil {
+			return
+		}
+	}
+}
+
+// errorReply is an error reply, its message starting with its code.
+type errorReply string
+
+func wrongArgs(cmd string) errorReply {
+	return errorReply("ERR wrong number of arguments for '" + strings.ToLower(cmd) + "' command")
+}
+
+// do runs cmd with s.mu held.
+func (s *Server) do(cmd []string) any {
+	if len(cmd) == 0 {
+		return errorReply("ERR empty command")
+	}
+	name, args := strings.ToUpper(cmd[0]), cmd[1:]
+	switch name {
+	case "PING":
+		return "PONG"
+	case "DEL":
+		var n int64
+		for _, k := range args {
+			if _, ok := s.hashes[k]; ok {
+				n++
+			}
+			if _, ok := s.streams[k]; ok {
+				n++
+			}
+			delete(s.hashes, k)
+			delete(s.streams, k)
+		}
+		return n
+	case "HSET":
+		if len(args) < 3 || len(args)%2 == 0 {
+			return wrongArgs(name)
+		}
+		h := s.hashes[args[0]]
+		if h == nil {
+			h = map[string]string{}
+			s.hashes[args[0]] = h
+		}
+		var n int64
+		for i := 1; i < len(args); i += 2 {
+			if _, ok := h[args[i]]; !ok {
+				n++
+			}
+			h[args[i]] = args[i+1]
+		}
+		return n
+	case "HMGET":
+		if len(args) < 2 {
+			return wrongArgs(name)
+		}
+		out := make([]any, len(args)-1)
+		for i, f := range args[1:] {
+			if v, ok := s.hashes[args[0]][f]; ok {
+				out[i] = v
+			}
+		}
+		return out
+	case "HINCRBY":
+		if len(args) != 3 {
+			return wrongArgs(name)
+		}
+		by, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return errorReply("ERR value is not an integer or out of range")
+		}
+		h := s.hashes[args[0]]
+		if h == nil {
+			h = map[string]string{}
+			s.hashes[args[0]] = h
+		}
+		n, err := strconv.ParseInt(h[args[1]], 10, 64)
+		if err != nil && h[args[1]] != "" {
+			return errorReply("ERR hash value is not an integer")
+		}
+		n += by
+		h[args[1]] = strconv.FormatInt(n, 10)
+		return n
+	case "HDEL":
+		if len(args) < 2 {
+			return wrongArgs(name)
+		}
+		var n int64
+		for _, f := range args[1:] {
+			if _, ok := s.hashes[args[0]][f]; ok {
+				delete(s.hashes[args[0]], f)
+				n++
+			}
+		}
+		return n
+	case "XADD":
+		return s.xadd(args)
+	case "XRANGE", "XREVRANGE":
+		return s.xrange(name == "XREVRANGE", args)
+	case "XGROUP":
+		return s.xgroup(args)
+	case "XREADGROUP":
+		return s.xreadgroup(args)
+	case "XACK":
+		if len(args) < 3 {
+			return wrongArgs(name)
+		}
+		g, err := s.group(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		var n int64
+		for _, a := range args[2:] {
+			id, ok := parseID(a, 0)
+			if !ok {
+				return errorReply("ERR Invalid stream ID specified as stream command argument")
+			}
+			if _, ok := g.pending[id]; ok {
+				delete(g.pending, id)
+				n++
+			}
+		}
+		return n
+	case "XPENDING":
+		if len(args) != 2 {
+			return errorReply("ERR resptest only supports the summary form of XPENDING")
+		}
+		g, err := s.group(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		if len(g.pending) == 0 {
+			return []any{int64(0), nil, nil, nil}
+		}
+		ids := g.pendingIDs()
+		return []any{int64(len(ids)), ids[0].String(), ids[len(ids)-1].String(), nil}
+	case "XAUTOCLAIM":
+		return s.xautoclaim(args)
+	}
+	return errorReply("ERR unknown command '" + cmd[0] + "'")
+}
+
+func (s *Server) xadd(args []string) any {
+	if len(args) < 4 {
+		return wrongArgs("XADD")
+	}
+	key, args := args[0], args[1:]
+	maxLen := -1
+	if strings.EqualFold(args[0], "MAXLEN") {
+		if len(args) > 1 && (args[1] == "~" || args[1] == "=") {
+			args = args[1:]
+		}
+		if len(args) < 2 {
+			return errorReply("ERR syntax error")
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return errorReply("ERR The MAXLEN argument must be >= 0.")
+		}
+		maxLen, args = n, args[2:]
+	}
+	if len(args) < 3 || len(args)%2 == 0 {
+		return wrongArgs("XADD")
+	}
+	id, ok := parseID(args[0], 0)
+	if !ok || id == (streamID{}) {
+		return errorReply("ERR resptest needs an explicit ID greater than 0-0 in XADD")
+	}
+	st := s.stream(key, true)
+	if n := len(st.entries); n > 0 && !st.entries[n-1].id.less(id) {
+		return errorReply("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	}
+	st.entries = append(st.entries, entry{id: id, fields: slices.Clone(args[1:])})
+	if maxLen >= 0 && len(st.entries) > maxLen {
+		st.entries = slices.Delete(st.entries, 0, len(st.entries)-maxLen)
+	}
+	return id.String()
+}
+
+func (s *Server) xrange(rev bool, args []string) any {
+	if len(args) != 3 && len(args) != 5 {
+		return wrongArgs("XRANGE")
+	}
+	lo, hi := args[1], args[2]
+	if rev {
+		lo, hi = hi, lo
+	}
+	start, ok1 := parseBound(lo, false)
+	end, ok2 := parseBound(hi, true)
+	if !ok1 || !ok2 {
+		return errorReply("ERR Invalid stream ID specified as stream command argument")
+	}
+	count := -1
+	if len(args) == 5 {
+		n, err := strconv.Atoi(args[4])
+		if !strings.EqualFold(args[3], "COUNT") || err != nil {
+			return errorReply("ERR syntax error")
+		}
+		count = n
+	}
+	st := s.stream(args[0], false)
+	if st == nil {
+		return []any{}
+	}
+	out := []any{}
+	for i := range st.entries {
+		e := st.entries[i]
+		if rev {
+			e = st.entries[len(st.entries)-1-i]
+		}
+		if e.id.less(start) || end.less(e.id) {
+			continue
+		}
+		if count >= 0 && len(out) == count {
+			break
+		}
+		out = append(out, e.reply())
+	}
+	return out
+}
+
+func (s *Server) xgroup(args []string) any {
+	if len(args) < 4 || !strings.EqualFold(args[0], "CREATE") {
+		return errorReply("ERR resptest only supports XGROUP CREATE")
+	}
+	st := s.stream(args[1], len(args) > 4 && strings.EqualFold(args[4], "MKSTREAM"))
+	if st == nil {
+		return errorReply("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	}
+	if _, ok := st.groups[args[2]]; ok {
+		return errorReply("BUSYGROUP Consumer Group name already exists")
+	}
+	var last streamID
+	if args[3] == "$" {
+		if n := len(st.entries); n > 0 {
+			last = st.entries[n-1].id
+		}
+	} else if id, ok := parseID(args[3], 0); ok {
+		last = id
+	} else {
+		return errorReply("ERR Invalid stream ID specified as stream command argument")
+	}
+	st.groups[args[2]] = &group{last: last, pending: map[streamID]time.Time{}}
+	return "OK"
+}
+
+func (s *Server) xreadgroup(args []string) any {
+	// GROUP g consumer [COUNT n] STREAMS key >
+	if len(args) < 6 || !strings.EqualFold(args[0], "GROUP") {
+		return errorReply("ERR syntax error")
+	}
+	gname, rest := args[1], args[3:]
+	count := -1
+	if strings.EqualFold(rest[0], "COUNT") {
+		n, err := strconv.Atoi(rest[1])
+		if err != nil {
+			return errorReply("ERR syntax error")
+		}
+		count, rest = n, rest[2:]
+	}
+	if len(rest) != 3 || !strings.EqualFold(rest[0], "STREAMS") || rest[2] != ">" {
+		return errorReply("ERR resptest only supports XREADGROUP of new entries of one stream")
+	}
+	g, err := s.group(rest[1], gname)
+	if err != nil {
+		return err
+	}
+	st := s.streams[rest[1]]
+	var entries []any
+	now := time.Now()
+	for _, e := range st.entries {
+		if !g.last.less(e.id) {
+			continue
+		}
+		if count >= 0 && len(entries) == count {
+			break
+		}
+		g.last = e.id
+		g.pending[e.id] = now
+		entries = append(entries, e.reply())
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return []any{[]any{rest[1], entries}}
+}
+
+func (s *Server) xautoclaim(args []string) any {
+	// key group consumer min-idle-ms start [COUNT n]
+	if len(args) != 5 && len(args) != 7 {
+		return wrongArgs("XAUTOCLAIM")
+	}
+	g, err := s.group(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	idle, err1 := strconv.ParseInt(args[3], 10, 64)
+	start, ok := parseID(args[4], 0)
+	if err1 != nil || !ok {
+		return errorReply("ERR Invalid min-idle-time argument for XAUTOCLAIM")
+	}
+	count := 100
+	if len(args) == 7 {
+		if count, err1 = strconv.Atoi(args[6]); err1 != nil {
+			return errorReply("ERR syntax error")
+		}
+	}
+	st := s.streams[args[0]]
+	now := time.Now()
+	claimed, deleted := []any{}, []any{}
+	next := streamID{}
+	for _, id := range g.pendingIDs() {
+		if id.less(start) || now.Sub(g.pending[id]) < time.Duration(idle)*time.Millisecond {
+			continue
+		}
+		if len(claimed)+len(deleted) == count {
+			next = id
+			break
+		}
+		i, found := slices.BinarySearchFunc(st.entries, id, func(e entry, id streamID) int {
+			switch {
+			case e.id.less(id):
+				return -1
+			case id.less(e.id):
+				return 1
+			}
+			return 0
+		})
+		if !found {
+			delete(g.pending, id)
+			deleted = append(deleted, id.String())
+			continue
+		}
+		g.pending[id] = now
+		claimed = append(claimed, st.entries[i].reply())
+	}
+	return []any{next.String(), claimed, deleted}
+}
+
+func (s *Server) stream(key string, create bool) *stream {
+	st := s.streams[key]
+	if st == nil && create {
+		st = &stream{groups: map[string]*group{}}
+		s.streams[key] = st
+	}
+	return st
+}
+
+func (s *Server) group(key, name string) (*group, any) {
+	if st := s.streams[key]; st != nil {
+		if g := st.groups[name]; g != nil {
+			return g, nil
+		}
+	}
+	return nil, errorReply(fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s'", key, name))
+}
+
+func (g *group) pendingIDs() []streamID {
+	ids := make([]streamID, 0, len(g.pending))
+	for id := range g.pending {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, func(a, b streamID) int {
+		switch {
+		case a.less(b):
+			return -1
+		case b.less(a):
+			return 1
+		}
+		return 0
+	})
+	return ids
+}
+
+func (e entry) reply() any {
+	fields := make([]any, len(e.fields))
+	for i, f := range e.fields {
+		fields[i] = f
+	}
+	return []any{e.id.String(), fields}
+}
+
+// parseID reads ms-seq, or ms alone with seq as the sequence.
+func parseID(s string, seq uint64) (streamID, bool) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return streamID{}, false
+	}
+	if hasSeq {
+		if seq, err = strconv.ParseUint(seqPart, 10, 64); err != nil {
+			return streamID{}, false
+		}
+	}
+	return streamID{ms, seq}, true
+}
+
+// parseBound reads a range bound: -, +, an ID, or ( and an ID for an
+// exclusive one.
+func parseBound(s string, end bool) (streamID, bool) {
+	switch s {
+	case "-":
+		return streamID{}, true
+	case "+":
+		return streamID{^uint64(0), ^uint64(0)}, true
+	}
+	exclusive := strings.HasPrefix(s, "(")
+	var seq uint64
+	if end {
+		seq = ^uint64(0)
+	}
+	id, ok := parseID(strings.TrimPrefix(s, "("), seq)
+	if !ok || !exclusive {
+		return id, ok
+	}
+	if end {
+		if id.seq == 0 {
+			return streamID{id.ms - 1, ^uint64(0)}, id.ms > 0
+		}
+		id.seq--
+		return id, true
+	}
+	if id.seq == ^uint64(0) {
+		return streamID{id.ms + 1, 0}, true
+	}
+	id.seq++
+	return id, true
+}
+
+func appendReply(buf []byte, v any) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, "$-1\r\n"...)
+	case string:
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(v)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, v...)
+		return append(buf, "\r\n"...)
+	case int64:
+		buf = append(buf, ':')
+		buf = strconv.AppendInt(buf, v, 10)
+		return append(buf, "\r\n"...)
+	case errorReply:
+		return append(buf, "-"+string(v)+"\r\n"...)
+	case []any:
+		buf = append(buf, '*')
+		buf = strconv.AppendInt(buf, int64(len(v)), 10)
+		buf = append(buf, "\r\n"...)
+		for _, x := range v {
+			buf = appendReply(buf, x)
+		}
+		return buf
+	}
+	panic(fmt.Sprintf("resptest: reply of type %T", v))
+}
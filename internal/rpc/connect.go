@@ -0,0 +1,127 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// connectType is the media type of unary Connect calls in the binary
+// encoding; the JSON one would need the messages' JSON mapping, which the
+// routes do not speak.
+const connectType = "application/proto"
+
+// serveConnect answers a unary call of the Connect protocol
+// (https://connectrpc.com/docs/protocol): a POST of the message, answered
+// with the reply or with an error as JSON.
+func (s *Service) serveConnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		connectError(w, status.Error(codes.Unimplemented, "only unary POSTs are served"), http.StatusMethodNotAllowed)
+		return
+	}
+	if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t != connectType {
+		w.Header().Set("Accept-Post", connectType)
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	if v := r.Header.Get("Connect-Protocol-Version"); v != "" && v != "1" {
+		connectError(w, status.Errorf(codes.InvalidArgument, "unsupported Connect-Protocol-Version %q", v), 0)
+		return
+	}
+	if enc := r.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		w.Header().Set("Accept-Encoding", "identity")
+		connectError(w, status.Errorf(codes.Unimplemented, "unsupported Content-Encoding %q", enc), 0)
+		return
+	}
+	name, ok := strings.CutPrefix(r.URL.Path, "/"+ServiceName+"/")
+	i := slices.IndexFunc(methods, func(m method) bool { return m.name == name })
+	if !ok || i < 0 {
+		connectError(w, status.Errorf(codes.Unimplemented, "no method %s", r.URL.Path), http.StatusNotFound)
+		return
+	}
+	ctx := r.Context()
+	if v := r.Header.Get("Connect-Timeout-Ms"); v != "" {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || ms <= 0 {
+			connectError(w, status.Errorf(codes.InvalidArgument, "invalid Connect-Timeout-Ms %q", v), 0)
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(ms)*time.Millisecond)
+		defer cancel()
+	}
+	in, err := io.ReadAll(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			connectError(w, status.Error(codes.ResourceExhausted, "request body too large"), 0)
+			return
+		}
+		connectError(w, status.Error(codes.InvalidArgument, err.Error()), 0)
+		return
+	}
+	out, reply, err := s.call(ctx, r, methods[i], in)
+	for k, v := range reply {
+		w.Header()[k] = v
+	}
+	if err == nil && ctx.Err() != nil {
+		err = status.FromContextError(ctx.Err()).Err()
+	}
+	if err != nil {
+		connectError(w, err, 0)
+		return
+	}
+	w.Header().Set("Content-Type", connectType)
+	_, _ = w.Write(out)
+}
+
+// connectCodes are the Connect names of the gRPC codes and the HTTP
+// statuses they are sent with.
+var connectCodes = map[codes.Code]struct {
+	name   string
+	status int
+}{
+	codes.Canceled:           {"canceled", 499},
+	codes.Unknown:            {"unknown", http.StatusInternalServerError},
+	codes.InvalidArgument:    {"invalid_argument", http.StatusBadRequest},
+	codes.DeadlineExceeded:   {"deadline_exceeded", http.StatusGatewayTimeout},
+	codes.NotFound:           {"not_found", http.StatusNotFound},
+	codes.AlreadyExists:      {"already_exists", http.StatusConflict},
+	codes.PermissionDenied:   {"permission_denied", http.StatusForbidden},
+	codes.ResourceExhausted:  {"resource_exhausted", http.StatusTooManyRequests},
+	codes.FailedPrecondition: {"failed_precondition", http.StatusBadRequest},
+	codes.Aborted:            {"aborted", http.StatusConflict},
+	codes.OutOfRange:         {"out_of_range", http.StatusBadRequest},
+	codes.Unimplemented:      {"unimplemented", http.StatusNotImplemented},
+	codes.Internal:           {"internal", http.StatusInternalServerError},
+	codes.Unavailable:        {"unavailable", http.StatusServiceUnavailable},
+	codes.DataLoss:           {"data_loss", http.StatusInternalServerError},
+	codes.Unauthenticated:    {"unauthenticated", http.StatusUnauthorized},
+}
+
+// connectError writes err, a gRPC status, as a Connect error, with the
+// HTTP status of its code unless httpStatus is set.
+func connectError(w http.ResponseWriter, err error, httpStatus int) {
+	st := status.Convert(err)
+	c, ok := connectCodes[st.Code()]
+	if !ok {
+		c = connectCodes[codes.Unknown]
+	}
+	if httpStatus == 0 {
+		httpStatus = c.status
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	_ = json.NewEncoder(w).Encode(map[string]string{"code": c.name, "message": st.Message()})
+}
@@ -0,0 +1,316 @@
+// Package rpc serves the typed event API of api/event.proto,
+// ingest.v1.EventService, on the HTTP listener: to browsers and other
+// clients over gRPC-Web, through the in-process gRPC server, and over the
+// Connect protocol. Each call is forwarded to the HTTP route implementing
+// it, in the Protocol Buffers encoding the routes already speak and with
+// the caller's credentials, so authentication, ACLs, admission and quotas
+// apply to both APIs alike.
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/httpx"
+)
+
+// ServiceName is the full name of the service, its path prefix on the
+// listener.
+const ServiceName = "ingest.v1.EventService"
+
+// protobufType is the media type the forwarded requests are encoded in.
+const protobufType = "application/x-protobuf"
+
+// Service forwards the calls of EventService to the service's HTTP handler.
+type Service struct {
+	h http.Handler
+}
+
+// New returns the service forwarding to h, the handler of the listener
+// with the /v1 routes.
+func New(h http.Handler) *Service {
+	return &Service{h: h}
+}
+
+// method is one unary RPC and the HTTP request it becomes.
+type method struct {
+	name string
+	// request returns the method, path and body of the HTTP request for
+	// the message in.
+	request func(in []byte) (string, string, []byte, error)
+}
+
+var methods = []method{
+	// Ingest takes an Event and returns the Event stored.
+	{"Ingest", func(in []byte) (string, string, []byte, error) {
+		return http.MethodPost, "/v1/events", in, nil
+	}},
+	// IngestBatch takes an EventList and returns the events stored.
+	{"IngestBatch", func(in []byte) (string, string, []byte, error) {
+		return http.MethodPost, "/v1/events/batch", in, nil
+	}},
+	// GetEvent takes a GetEventRequest and returns the Event.
+	{"GetEvent", func(in []byte) (string, string, []byte, error) {
+		id, err := stringField(in, 1)
+		if err != nil || id == "" {
+			return "", "", nil, errors.New("need an id")
+		}
+		return http.MethodGet, "/v1/events/" + url.PathEscape(id), nil, nil
+	}},
+	// ListEvents takes a ListEventsRequest, whose query is the query
+	// string of GET /v1/events, and returns an EventList.
+	{"ListEvents", func(in []byte) (string, string, []byte, error) {
+		q, err := stringField(in, 1)
+		if err != nil {
+			return "", "", nil, err
+		}
+		if _, err := url.ParseQuery(q); err != nil {
+			return "", "", nil, fmt.Errorf("query: %w", err)
+		}
+		return http.MethodGet, "/v1/events?" + q, nil, nil
+	}},
+}
+
+// stringField returns the string field num of the message b, the last one
+// when repeated, skipping the other fields.
+func stringField(b []byte, num protowire.Number) (string, error) {
+	var out string
+	for len(b) > 0 {
+		n, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return "", protowire.ParseError(l)
+		}
+		b = b[l:]
+		if n == num && typ == protowire.BytesType {
+			v, l := protowire.ConsumeString(b)
+			if l < 0 {
+				return "", protowire.ParseError(l)
+			}
+			out, b = v, b[l:]
+			continue
+		}
+		l = protowire.ConsumeFieldValue(n, typ, b)
+		if l < 0 {
+			return "", protowire.ParseError(l)
+		}
+		b = b[l:]
+	}
+	return out, nil
+}
+
+// requestKey holds the HTTP request carrying a call, whose credentials the
+// forwarded request takes.
+type requestKey struct{}
+
+// Handler serves the service's path prefix: Connect requests itself and the
+// rest through web, the gRPC-Web handler of the server the service is
+// registered on.
+func (s *Service) Handler(web http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), requestKey{}, r)
+		if strings.HasPrefix(strings.ToLower(r.Header.Get("Content-Type")), "application/grpc-web") {
+			web.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		s.serveConnect(w, r.WithContext(ctx))
+	})
+}
+
+// call forwards the call of m with the message in, sent by the HTTP
+// request outer, and returns the reply message and the headers of the
+// response to pass on. Errors are gRPC statuses.
+func (s *Service) call(ctx context.Context, outer *http.Request, m method, in []byte) ([]byte, http.Header, error) {
+	verb, path, body, err := m.request(in)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "%s: %v", m.name, err)
+	}
+	// the route is looked up afresh, not where the call's own lookup ended
+	ctx = context.WithValue(ctx, chi.RouteCtxKey, nil)
+	r, err := http.NewRequestWithContext(ctx, verb, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, status.Error(codes.Internal, err.Error())
+	}
+	for k, v := range outer.Header {
+		if forwarded(k) {
+			r.Header[k] = v
+		}
+	}
+	if body != nil {
+		r.Header.Set("Content-Type", protobufType)
+	}
+	r.Header.Set("Accept", protobufType)
+	if id := middleware.GetReqID(outer.Context()); id != "" {
+		r.Header.Set(middleware.RequestIDHeader, id)
+	}
+	r.RemoteAddr, r.TLS, r.Host = outer.RemoteAddr, outer.TLS, outer.Host
+
+	rec := &recorder{header: http.Header{}}
+	s.h.ServeHTTP(rec, r)
+	reply := http.Header{}
+	for _, k := range replyHeaders {
+		if v := rec.header.Values(k); len(v) > 0 {
+			reply[k] = v
+		}
+	}
+	if rec.status == http.StatusOK || rec.status == http.StatusCreated {
+		return rec.body.Bytes(), reply, nil
+	}
+	var doc struct {
+		Error httpx.Problem `json:"error"`
+	}
+	msg := http.StatusText(rec.status)
+	if json.Unmarshal(rec.body.Bytes(), &doc) == nil && doc.Error.Message != "" {
+		msg = doc.Error.Message
+	}
+	if len(doc.Error.Details) > 0 {
+		msg += ": " + strings.Join(doc.Error.Details, "; ")
+	}
+	return nil, reply, status.Error(codeOf(rec.status), msg)
+}
+
+// forwarded reports whether the request header k is passed on to the
+// route: credentials, tracing and the like are, the framing of the call
+// and preferences the RPCs have no answer for are not.
+func forwarded(k string) bool {
+	switch k {
+	case "Content-Type", "Content-Length", "Content-Encoding", "Accept", "Accept-Encoding", "Te", "Prefer", "X-Grpc-Web":
+		return false
+	}
+	return !strings.HasPrefix(k, "Grpc-") && !strings.HasPrefix(k, "Connect-")
+}
+
+// replyHeaders are passed back from the route, as response metadata in
+// gRPC-Web.
+var replyHeaders = []string{"Consistency-Token", "Retry-After", "Deprecation", "Sunset", "Warning"}
+
+// codeOf maps the status of a failed route to a gRPC code.
+func codeOf(status int) codes.Code {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity, http.StatusUnsupportedMediaType:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusPreconditionFailed:
+		return codes.FailedPrecondition
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	return codes.Internal
+}
+
+// recorder keeps the response of a forwarded request.
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) Header() http.Header { return rec.header }
+
+func (rec *recorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(b)
+}
+
+// message is a message of the service, kept encoded: the routes read and
+// write the wire format themselves.
+type message []byte
+
+// Codec is the gRPC codec of a server the service is registered on. It
+// passes the service's messages through and marshals the others, those of
+// the health service, as Protocol Buffers.
+type Codec struct{}
+
+func (Codec) Name() string { return "proto" }
+
+func (Codec) Marshal(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case *message:
+		return *v, nil
+	case proto.Message:
+		return proto.Marshal(v)
+	}
+	return nil, fmt.Errorf("rpc: cannot marshal %T", v)
+}
+
+func (Codec) Unmarshal(data []byte, v any) error {
+	switch v := v.(type) {
+	case *message:
+		*v = append((*v)[:0], data...)
+		return nil
+	case proto.Message:
+		return proto.Unmarshal(data, v)
+	}
+	return fmt.Errorf("rpc: cannot unmarshal %T", v)
+}
+
+// Register adds the service to srv, which must use Codec.
+func (s *Service) Register(srv *grpc.Server) {
+	desc := grpc.ServiceDesc{ServiceName: ServiceName, HandlerType: (*any)(nil), Metadata: "api/event.proto"}
+	for _, m := range methods {
+		desc.Methods = append(desc.Methods, grpc.MethodDesc{
+			MethodName: m.name,
+			Handler: func(_ any, ctx context.Context, dec func(any) error, intercept grpc.UnaryServerInterceptor) (any, error) {
+				in := new(message)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				handle := func(ctx context.Context, req any) (any, error) {
+					outer, ok := ctx.Value(requestKey{}).(*http.Request)
+					if !ok {
+						return nil, status.Error(codes.Unimplemented, "only served on the HTTP listener")
+					}
+					out, reply, err := s.call(ctx, outer, m, *req.(*message))
+					md := metadata.MD{}
+					for k, v := range reply {
+						md.Set(k, v...)
+					}
+					_ = grpc.SetHeader(ctx, md)
+					if err != nil {
+						return nil, err
+					}
+					return (*message)(&out), nil
+				}
+				if intercept == nil {
+					return handle(ctx, in)
+				}
+				info := &grpc.UnaryServerInfo{Server: s, FullMethod: "/" + ServiceName + "/" + m.name}
+				return intercept(ctx, in, info, handle)
+			},
+		})
+	}
+	srv.RegisterService(&desc, s)
+}
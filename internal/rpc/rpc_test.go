@@ -0,0 +1,156 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/grpcweb"
+	"github.com/rafaelosorio/go-ingest-service/internal/httpx"
+)
+
+// routes stands in for the /v1 routes: it answers with the request line,
+// the key and the body it was sent, and refuses the key "denied".
+func routes() http.Handler {
+	r := chi.NewRouter()
+	echo := func(status int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-API-Key") == "denied" {
+				httpx.Errorf(http.StatusForbidden, "forbidden", "type %s is not allowed", "secret").Write(w)
+				return
+			}
+			if r.Header.Get("Accept") != protobufType || r.Header.Get("Prefer") != "" {
+				httpx.Error(w, "unexpected headers", http.StatusBadRequest)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("Content-Type", protobufType)
+			w.Header().Set("Consistency-Token", "t1")
+			w.WriteHeader(status)
+			_, _ = io.WriteString(w, r.Method+" "+r.URL.RequestURI()+" "+r.Header.Get("X-API-Key")+" "+string(body))
+		}
+	}
+	r.Post("/v1/events", echo(http.StatusCreated))
+	r.Post("/v1/events/batch", echo(http.StatusCreated))
+	r.Get("/v1/events", echo(http.StatusOK))
+	r.Get("/v1/events/{id}", echo(http.StatusOK))
+	return r
+}
+
+// field encodes a message with the string field 1.
+func field(s string) []byte {
+	return protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), s)
+}
+
+// TestConnect forwards unary Connect calls to their routes with the
+// caller's key, and answers failures as Connect errors.
+func TestConnect(t *testing.T) {
+	ts := httptest.NewServer(New(routes()).Handler(http.NotFoundHandler()))
+	defer ts.Close()
+	for _, tc := range []struct {
+		method, key, contentType string
+		body                     []byte
+		status                   int
+		want                     string
+	}{
+		{"Ingest", "k1", connectType, []byte("event"), 200, "POST /v1/events k1 event"},
+		{"IngestBatch", "k1", connectType, []byte("events"), 200, "POST /v1/events/batch k1 events"},
+		{"GetEvent", "k2", connectType, field("42"), 200, "GET /v1/events/42 k2 "},
+		{"ListEvents", "k2", connectType, field("type=a&limit=2"), 200, "GET /v1/events?type=a&limit=2 k2 "},
+		{"GetEvent", "k2", connectType, nil, 400, `"code":"invalid_argument"`},
+		{"Ingest", "denied", connectType, []byte("event"), 403, `{"code":"permission_denied","message":"type secret is not allowed"}`},
+		{"Nope", "k1", connectType, nil, 404, `"code":"unimplemented"`},
+		{"Ingest", "k1", "application/json", []byte("{}"), 415, ""},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/"+ServiceName+"/"+tc.method, bytes.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+		req.Header.Set("Connect-Protocol-Version", "1")
+		req.Header.Set("X-API-Key", tc.key)
+		req.Header.Set("Prefer", "respond-async")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tc.status || !strings.Contains(string(body), tc.want) {
+			t.Errorf("%s as %s: %d %q, want %d %q", tc.method, tc.key, res.StatusCode, body, tc.status, tc.want)
+		}
+		if tc.status == 200 && (res.Header.Get("Content-Type") != connectType || res.Header.Get("Consistency-Token") != "t1") {
+			t.Errorf("%s: headers %v", tc.method, res.Header)
+		}
+	}
+}
+
+// TestGRPCWeb serves the service next to the health service on one gRPC
+// server, reached over gRPC-Web.
+func TestGRPCWeb(t *testing.T) {
+	srv := grpc.NewServer(grpc.ForceServerCodec(Codec{}))
+	healthpb.RegisterHealthServer(srv, grpchealth.NewServer())
+	svc := New(routes())
+	svc.Register(srv)
+	web := grpcweb.Handler(srv)
+	mux := http.NewServeMux()
+	mux.Handle("/"+ServiceName+"/", svc.Handler(web))
+	mux.Handle("/grpc.health.v1.Health/", web)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	call := func(path, key string, msg []byte) (reply []byte, trailers string) {
+		t.Helper()
+		frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+path, bytes.NewReader(append(frame, msg...)))
+		req.Header.Set("Content-Type", "application/grpc-web+proto")
+		req.Header.Set("X-API-Key", key)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		raw, _ := io.ReadAll(res.Body)
+		for len(raw) >= 5 {
+			n := binary.BigEndian.Uint32(raw[1:5])
+			if raw[0]&0x80 != 0 {
+				trailers = string(raw[5 : 5+n])
+			} else {
+				reply = raw[5 : 5+n]
+			}
+			raw = raw[5+n:]
+		}
+		return reply, trailers
+	}
+
+	reply, trailers := call("/"+ServiceName+"/GetEvent", "k1", field("7"))
+	if string(reply) != "GET /v1/events/7 k1 " || !strings.Contains(trailers, "grpc-status: 0") {
+		t.Errorf("get: %q, trailers %q", reply, trailers)
+	}
+	_, trailers = call("/"+ServiceName+"/Ingest", "denied", []byte("event"))
+	if !strings.Contains(trailers, "grpc-status: 7") || !strings.Contains(trailers, "type secret is not allowed") {
+		t.Errorf("denied ingest: trailers %q", trailers)
+	}
+	// the codec still marshals the health service's messages
+	reply, trailers = call("/grpc.health.v1.Health/Check", "", nil)
+	if !bytes.Equal(reply, []byte{0x08, 0x01}) || !strings.Contains(trailers, "grpc-status: 0") {
+		t.Errorf("health: %x, trailers %q", reply, trailers)
+	}
+}
+
+// TestCodeOf maps the statuses of the routes' failures.
+func TestCodeOf(t *testing.T) {
+	for status, want := range map[int]string{400: "invalid_argument", 401: "unauthenticated", 404: "not_found", 409: "aborted", 413: "resource_exhausted", 429: "resource_exhausted", 503: "unavailable", 500: "internal"} {
+		if got := connectCodes[codeOf(status)].name; got != want {
+			t.Errorf("%d: %s, want %s", status, got, want)
+		}
+	}
+
+}
@@ -0,0 +1,227 @@
+// Package s3 reads and writes whole objects on S3 or an S3-compatible store
+// with Signature Version 4, and presigns URLs for clients to do the same
+// without credentials.
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// ErrNotFound is returned for an object the bucket does not hold.
+var ErrNotFound = errors.New("s3: no such object")
+
+// emptyHash is the SHA-256 of an empty body.
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// MaxPresignExpiry is the longest a presigned URL may be valid for.
+const MaxPresignExpiry = 7 * 24 * time.Hour
+
+// Client puts and gets whole objects. Objects go up in a single PUT, so
+// they can be at most 5 GiB.
+type Client struct {
+	cfg    config.S3Config
+	client *http.Client
+}
+
+// New returns a client with the region and credentials of cfg.
+func New(cfg config.S3Config) *Client {
+	return &Client{cfg: cfg, client: &http.Client{}}
+}
+
+// URL addresses key in bucket: path-style on a custom endpoint,
+// virtual-hosted on AWS.
+func (c *Client) URL(bucket, key string) string {
+	path := "/" + escapePath(key)
+	if c.cfg.Endpoint != "" {
+		return strings.TrimSuffix(c.cfg.Endpoint, "/") + "/" + bucket + path
+	}
+	return "https://" + bucket + ".s3." + c.cfg.Region + ".amazonaws.com" + path
+}
+
+// Put uploads body as key in bucket; body is read twice, to hash and to
+// send it.
+func (c *Client) Put(ctx context.Context, bucket, key, contentType string, body io.ReadSeeker) error {
+	h := sha256.New()
+	size, err := io.Copy(h, body)
+	if err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.URL(bucket, key), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	c.sign(req, hex.EncodeToString(h.Sum(nil)), time.Now())
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return s3Error(res, "PUT", bucket, key)
+}
+
+// Open starts reading key in bucket; the caller closes the body.
+func (c *Client) Open(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL(bucket, key), nil)
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, emptyHash, time.Now())
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := s3Error(res, "GET", bucket, key); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Get copies key in bucket to w.
+func (c *Client) Get(ctx context.Context, bucket, key string, w io.Writer) error {
+	body, err := c.Open(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// Presign returns a URL that lets whoever holds it send method to key in
+// bucket until expires has passed, with the headers given, which the
+// request must carry with these values. The payload is not signed.
+func (c *Client) Presign(method, bucket, key string, headers http.Header, expires time.Duration, now time.Time) (string, error) {
+	if expires <= 0 || expires > MaxPresignExpiry {
+		return "", fmt.Errorf("s3: presigned URLs expire within %s", MaxPresignExpiry)
+	}
+	u, err := url.Parse(c.URL(bucket, key))
+	if err != nil {
+		return "", err
+	}
+	return c.presign(method, u, headers, expires, now), nil
+}
+
+// presign signs a request for method to u in its query.
+func (c *Client) presign(method string, u *url.URL, headers http.Header, expires time.Duration, now time.Time) string {
+	now = now.UTC()
+	stamp, scope := now.Format("20060102T150405Z"), c.scope(now)
+	canonical, signed := canonicalHeaders(u.Host, headers)
+	q := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {c.cfg.AccessKeyID + "/" + scope},
+		"X-Amz-Date":          {stamp},
+		"X-Amz-Expires":       {strconv.Itoa(int(expires / time.Second))},
+		"X-Amz-SignedHeaders": {signed},
+	}
+	if c.cfg.SessionToken != "" {
+		q.Set("X-Amz-Security-Token", c.cfg.SessionToken)
+	}
+	// S3 signs the query escaped as RFC 3986 has it, spaces as %20
+	query := strings.ReplaceAll(q.Encode(), "+", "%20")
+	request := strings.Join([]string{
+		method, u.EscapedPath(), query, canonical, signed, "UNSIGNED-PAYLOAD",
+	}, "\n")
+	return u.String() + "?" + query + "&X-Amz-Signature=" + c.signature(now, request)
+}
+
+// s3Error reports a response other than 2xx, with the start of its body,
+// which holds the S3 error code.
+func s3Error(res *http.Response, method, bucket, key string) error {
+	if res.StatusCode/100 == 2 {
+		return nil
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("s3 %s %s/%s: %w", method, bucket, key, ErrNotFound)
+	}
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	return fmt.Errorf("s3 %s %s/%s: %s: %s", method, bucket, key, res.Status, strings.TrimSpace(string(body)))
+}
+
+// sign adds the Signature Version 4 Authorization header to req, signing
+// the host and every header already set.
+func (c *Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	stamp := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.cfg.SessionToken)
+	}
+	canonical, signed := canonicalHeaders(req.URL.Host, req.Header)
+	request := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonical, signed, payloadHash,
+	}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.cfg.AccessKeyID, c.scope(now), signed, c.signature(now, request)))
+}
+
+// canonicalHeaders lists host and headers the way they are signed,
+// returning them with the names of those signed.
+func canonicalHeaders(host string, h http.Header) (canonical, signed string) {
+	headers := map[string]string{"host": host}
+	for k, v := range h {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := slices.Sorted(func(yield func(string) bool) {
+		for k := range headers {
+			if !yield(k) {
+				return
+			}
+		}
+	})
+	var b strings.Builder
+	for _, k := range names {
+		b.WriteString(k + ":" + headers[k] + "\n")
+	}
+	return b.String(), strings.Join(names, ";")
+}
+
+func (c *Client) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + c.cfg.Region + "/s3/aws4_request"
+}
+
+// signature signs the canonical request made at now.
+func (c *Client) signature(now time.Time, request string) string {
+	sum := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + c.scope(now) + "\n" + hex.EncodeToString(sum[:])
+	key := []byte("AWS4" + c.cfg.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), c.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// escapePath encodes each segment of an object key the way S3 signs it.
+func escapePath(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = strings.ReplaceAll(url.PathEscape(p), "+", "%2B")
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,227 @@
+// Package sampling keeps a share of the events of types that flood the
+// service, by rate or by chance, so a hot type costs a bounded amount of
+// storage and sink traffic instead of every producer being shed alike.
+package sampling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/admission"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/expr"
+	"github.com/rafaelosorio/go-ingest-service/internal/typematch"
+)
+
+// SummaryType is the type of the events summarizing what was sampled out.
+const SummaryType = "_system.sampling"
+
+var sampledOut = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "sampling_dropped_events_total", Help: "Events sampled out instead of stored, by rule type pattern"},
+	[]string{"rule"},
+)
+
+// Collectors returns the sampling metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{sampledOut}
+}
+
+// Sampler decides per event whether it is kept. Its rules can be replaced
+// at runtime, see Prepare.
+type Sampler struct {
+	pressure func() admission.Level
+	changed  chan struct{}
+
+	mu      sync.Mutex
+	cfg     config.SamplingConfig
+	when    []*expr.Program // by rule, nil without when
+	buckets map[bucketKey]*bucket
+	dropped map[string]int64 // by type, since the last summary
+	since   time.Time
+}
+
+type bucketKey struct {
+	rule int
+	typ  string
+}
+
+// bucket is a token bucket holding up to a second's worth of its rate.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New builds a Sampler; pressure returns the admission level, which rules
+// with under set apply from.
+func New(cfg config.SamplingConfig, pressure func() admission.Level) (*Sampler, error) {
+	when, err := compile(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Sampler{
+		pressure: pressure,
+		changed:  make(chan struct{}, 1),
+		cfg:      cfg,
+		when:     when,
+		buckets:  map[bucketKey]*bucket{},
+		dropped:  map[string]int64{},
+		since:    time.Now().UTC(),
+	}, nil
+}
+
+// compile compiles the when expressions of the rules of cfg.
+func compile(cfg config.SamplingConfig) ([]*expr.Program, error) {
+	out := make([]*expr.Program, len(cfg.Rules))
+	for i, r := range cfg.Rules {
+		if r.When == "" {
+			continue
+		}
+		p, err := expr.Compile("sampling:"+strconv.Itoa(i), r.When)
+		if err != nil {
+			return nil, fmt.Errorf("sampling.rules[%d].when: %w", i, err)
+		}
+		out[i] = p
+	}
+	return out, nil
+}
+
+// Prepare validates cfg for a reload; commit replaces the rules, starting
+// their rate buckets afresh.
+func (s *Sampler) Prepare(cfg config.SamplingConfig) (func(), error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	when, err := compile(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		s.mu.Lock()
+		s.cfg, s.when, s.buckets = cfg, when, map[bucketKey]*bucket{}
+		s.mu.Unlock()
+		select {
+		case s.changed <- struct{}{}:
+		default:
+		}
+	}, nil
+}
+
+// Keep reports whether e is kept, counting it when it is not. It goes by
+// the first rule whose type pattern and when expression match it.
+func (s *Sampler) Keep(e *event.Event) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	typ := e.Type
+	var env *expr.Env
+	for i, r := range s.cfg.Rules {
+		if !typematch.Match(r.Type, typ) {
+			continue
+		}
+		if s.when[i] != nil {
+			if env == nil {
+				env = expr.NewEnv(e)
+			}
+			if !s.when[i].Match(env) {
+				continue
+			}
+		}
+		if !s.applies(r.Under) || s.admit(i, r, typ) {
+			return true
+		}
+		s.dropped[typ]++
+		sampledOut.WithLabelValues(r.Type).Inc()
+		return false
+	}
+	return true
+}
+
+// applies reports whether a rule with that under level is in effect.
+func (s *Sampler) applies(under string) bool {
+	switch under {
+	case "elevated":
+		return s.pressure() >= admission.Elevated
+	case "shedding":
+		return s.pressure() >= admission.Shedding
+	default:
+		return true
+	}
+}
+
+// admit draws the event's chance or token. The caller holds s.mu.
+func (s *Sampler) admit(i int, r config.SamplingRuleConfig, typ string) bool {
+	if r.Probability > 0 {
+		return rand.Float64() < r.Probability
+	}
+	now := time.Now()
+	burst := max(r.Rate, 1)
+	b := s.buckets[bucketKey{i, typ}]
+	if b == nil {
+		b = &bucket{tokens: burst, last: now}
+		s.buckets[bucketKey{i, typ}] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*r.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Summary is the payload of a SummaryType event.
+type Summary struct {
+	Since   time.Time        `json:"since"`
+	Until   time.Time        `json:"until"`
+	Dropped map[string]int64 `json:"dropped"`
+}
+
+// Run hands emit a summary event every summary interval in which events
+// were sampled out, until ctx is done. The interval follows reloads.
+func (s *Sampler) Run(ctx context.Context, emit func(event.Event)) {
+	for {
+		s.mu.Lock()
+		every := s.cfg.SummaryInterval
+		s.mu.Unlock()
+		var tick <-chan time.Time
+		if every > 0 {
+			tick = time.After(every)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.changed:
+			continue
+		case <-tick:
+		}
+		if e, ok := s.summary(); ok {
+			emit(e)
+		}
+	}
+}
+
+// summary takes the counts since the last summary.
+func (s *Sampler) summary() (event.Event, bool) {
+	s.mu.Lock()
+	now := time.Now().UTC()
+	sum := Summary{Since: s.since, Until: now, Dropped: maps.Clone(s.dropped)}
+	clear(s.dropped)
+	s.since = now
+	s.mu.Unlock()
+	if len(sum.Dropped) == 0 {
+		return event.Event{}, false
+	}
+	payload, err := json.Marshal(sum)
+	if err != nil {
+		return event.Event{}, false
+	}
+	return event.Event{Type: SummaryType, Payload: payload}, true
+}
@@ -0,0 +1,134 @@
+package sampling
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/admission"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+func normal() admission.Level { return admission.Normal }
+
+func kept(s *Sampler, typ, payload string, n int) int {
+	k := 0
+	for range n {
+		if s.Keep(&event.Event{Type: typ, Payload: json.RawMessage(payload)}) {
+			k++
+		}
+	}
+	return k
+}
+
+// TestKeep goes by the first matching rule: a rate keeps a second's worth
+// of each type, a probability about its share, and types no rule matches
+// are all kept.
+func TestKeep(t *testing.T) {
+	s, err := New(config.SamplingConfig{Rules: []config.SamplingRuleConfig{
+		{Type: "debug.*", When: `payload.level == "trace"`, Probability: 0.01},
+		{Type: "debug.*", Rate: 5},
+		{Type: "click", Probability: 0.5},
+	}}, normal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := kept(s, "debug.cache", `{"level":"info"}`, 50); n < 5 || n > 6 {
+		t.Errorf("rate 5: kept %d of 50", n)
+	}
+	if n := kept(s, "debug.db", `{"level":"info"}`, 50); n < 5 || n > 6 {
+		t.Errorf("rate 5 of another type: kept %d of 50", n)
+	}
+	if n := kept(s, "debug.other", `{"level":"trace"}`, 1000); n > 50 {
+		t.Errorf("probability 0.01: kept %d of 1000", n)
+	}
+	if n := kept(s, "click", `{}`, 2000); n < 800 || n > 1200 {
+		t.Errorf("probability 0.5: kept %d of 2000", n)
+	}
+	if n := kept(s, "order.created", `{}`, 100); n != 100 {
+		t.Errorf("no rule: kept %d of 100", n)
+	}
+}
+
+// TestUnder applies a rule only from its admission pressure level.
+func TestUnder(t *testing.T) {
+	level := admission.Normal
+	s, err := New(config.SamplingConfig{Rules: []config.SamplingRuleConfig{{Type: "*", Rate: 1, Under: "shedding"}}}, func() admission.Level { return level })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := kept(s, "a", `{}`, 20); n != 20 {
+		t.Errorf("normal: kept %d of 20", n)
+	}
+	level = admission.Elevated
+	if n := kept(s, "a", `{}`, 20); n != 20 {
+		t.Errorf("elevated: kept %d of 20", n)
+	}
+	level = admission.Shedding
+	if n := kept(s, "a", `{}`, 20); n > 2 {
+		t.Errorf("shedding: kept %d of 20", n)
+	}
+}
+
+// TestSummary emits the counts sampled out per type once per interval, and
+// nothing for an interval without any.
+func TestSummary(t *testing.T) {
+	s, err := New(config.SamplingConfig{Rules: []config.SamplingRuleConfig{{Type: "noisy.*", Rate: 1}}, SummaryInterval: 20 * time.Millisecond}, normal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept(s, "noisy.a", `{}`, 4)
+	kept(s, "noisy.b", `{}`, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	emitted := make(chan event.Event, 4)
+	go s.Run(ctx, func(e event.Event) { emitted <- e })
+
+	select {
+	case e := <-emitted:
+		var sum Summary
+		if err := json.Unmarshal(e.Payload, &sum); err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != SummaryType || sum.Dropped["noisy.a"] != 3 || sum.Dropped["noisy.b"] != 2 || !sum.Until.After(sum.Since) {
+			t.Errorf("summary %s: %+v", e.Type, sum)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no summary")
+	}
+	select {
+	case e := <-emitted:
+		t.Errorf("summary without drops: %s", e.Payload)
+	case <-time.After(60 * time.Millisecond):
+	}
+}
+
+// TestPrepare replaces the rules on commit and refuses invalid ones.
+func TestPrepare(t *testing.T) {
+	s, err := New(config.SamplingConfig{Rules: []config.SamplingRuleConfig{{Type: "a", Rate: 1}}}, normal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := s.Prepare(config.SamplingConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := kept(s, "a", `{}`, 5); n != 1 {
+		t.Errorf("before commit: kept %d of 5", n)
+	}
+	commit()
+	if n := kept(s, "a", `{}`, 5); n != 5 {
+		t.Errorf("after commit: kept %d of 5", n)
+	}
+	for name, cfg := range map[string]config.SamplingConfig{
+		"rate and probability": {Rules: []config.SamplingRuleConfig{{Type: "a", Rate: 1, Probability: 0.5}}},
+		"neither":              {Rules: []config.SamplingRuleConfig{{Type: "a"}}},
+		"when":                 {Rules: []config.SamplingRuleConfig{{Type: "a", Rate: 1, When: "payload.x =="}}},
+	} {
+		if _, err := s.Prepare(cfg); err == nil {
+			t.Errorf("%s: prepared", name)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Package schedule holds events carrying a deliver_at time back from the
+// sinks until that time arrives.
+package schedule
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+var (
+	pendingEvents = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "scheduled_events_pending", Help: "Events waiting for their deliver_at time"},
+	)
+	releasedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "scheduled_events_released_total", Help: "Scheduled events released to the sinks"},
+	)
+)
+
+// Collectors returns the scheduler metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{pendingEvents, releasedTotal}
+}
+
+// Scheduler is a hashed timer wheel: each slot covers one tick, and an event
+// due more than a full turn ahead waits in its slot for the remaining rounds.
+// Adding and releasing are O(1) regardless of how many events are pending.
+// Events are released at most one tick after their DeliverAt.
+type Scheduler struct {
+	tick    time.Duration
+	release func(event.Event)
+
+	mu    sync.Mutex
+	slots [][]entry
+	// cursor is the slot that was processed last, at time last.
+	cursor int
+	last   time.Time
+	n      int
+	// ids holds the IDs of the pending events and of those released in the
+	// last minute, listed in released, so that a stale copy of one read
+	// from the store before its release was recorded is not added again.
+	ids      map[int64]bool
+	released []releasedID
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type releasedID struct {
+	id int64
+	at time.Time
+}
+
+type entry struct {
+	e      event.Event
+	rounds int
+}
+
+// New starts a wheel of slots ticks calling release for every event whose
+// DeliverAt has arrived. release runs on the scheduler goroutine, one event
+// at a time.
+func New(tick time.Duration, slots int, release func(event.Event)) *Scheduler {
+	s := &Scheduler{
+		tick:    tick,
+		release: release,
+		slots:   make([][]entry, slots),
+		ids:     map[int64]bool{},
+		last:    time.Now(),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Add schedules e, which must have a DeliverAt, unless it is pending or was
+// just released; an overdue event is released on the next tick.
+func (s *Scheduler) Add(e event.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ids[e.ID] {
+		return
+	}
+	s.ids[e.ID] = true
+	ticks := 1
+	if d := e.DeliverAt.Sub(s.last); d > s.tick {
+		ticks = int((d + s.tick - 1) / s.tick)
+	}
+	slot := (s.cursor + ticks) % len(s.slots)
+	s.slots[slot] = append(s.slots[slot], entry{e: e, rounds: (ticks - 1) / len(s.slots)})
+	s.n++
+	pendingEvents.Set(float64(s.n))
+}
+
+// Clear drops the pending events without releasing them, e.g. when another
+// instance takes over their release; the store keeps them.
+func (s *Scheduler) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.slots {
+		s.slots[i] = nil
+	}
+	clear(s.ids)
+	s.released = nil
+	s.n = 0
+	pendingEvents.Set(0)
+}
+
+// Len returns the number of events waiting for release.
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n
+}
+
+// Close stops the wheel. Pending events are not released; the store keeps
+// them for the next start.
+func (s *Scheduler) Close() {
+	close(s.done)
+	<-s.stopped
+}
+
+func (s *Scheduler) run() {
+	defer close(s.stopped)
+	t := time.NewTicker(s.tick)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-t.C:
+			for _, e := range s.advance(now) {
+				s.release(e)
+				releasedTotal.Inc()
+			}
+		}
+	}
+}
+
+// advance moves the cursor up to now, catching up on ticks missed while the
+// process was busy, and returns the events that became due.
+func (s *Scheduler) advance(now time.Time) []event.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []event.Event
+	for !s.last.Add(s.tick).After(now) {
+		s.last = s.last.Add(s.tick)
+		s.cursor = (s.cursor + 1) % len(s.slots)
+		kept := s.slots[s.cursor][:0]
+		for _, en := range s.slots[s.cursor] {
+			if en.rounds > 0 {
+				en.rounds--
+				kept = append(kept, en)
+				continue
+			}
+			due = append(due, en.e)
+			s.released = append(s.released, releasedID{en.e.ID, now})
+		}
+		clear(s.slots[s.cursor][len(kept):])
+		s.slots[s.cursor] = kept
+	}
+	for len(s.released) > 0 && now.Sub(s.released[0].at) > time.Minute {
+		delete(s.ids, s.released[0].id)
+		s.released = s.released[1:]
+	}
+	s.n -= len(due)
+	pendingEvents.Set(float64(s.n))
+	return due
+}
@@ -0,0 +1,83 @@
+package schedule
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+func at(id int64, t time.Time) event.Event {
+	return event.Event{ID: id, Type: "reminder", DeliverAt: &t}
+}
+
+// TestAdvance releases each event on the tick its DeliverAt falls in, also
+// those due more than a turn of the wheel ahead, and an overdue one on the
+// next tick.
+func TestAdvance(t *testing.T) {
+	s := New(time.Hour, 4, func(event.Event) {}) // ticks driven by hand
+	defer s.Close()
+	start := s.last
+	tick := func(n int) []int64 {
+		var ids []int64
+		for _, e := range s.advance(start.Add(time.Duration(n) * time.Hour)) {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+	s.Add(at(1, start.Add(90*time.Minute)))
+	s.Add(at(2, start.Add(10*time.Hour)))
+	s.Add(at(3, start.Add(-time.Minute)))
+	s.Add(at(1, start.Add(90*time.Minute))) // a stale copy
+	if s.Len() != 3 {
+		t.Fatalf("%d pending", s.Len())
+	}
+
+	if got := tick(1); len(got) != 1 || got[0] != 3 {
+		t.Errorf("tick 1: %v", got)
+	}
+	if got := tick(2); len(got) != 1 || got[0] != 1 {
+		t.Errorf("tick 2: %v", got)
+	}
+	if got := tick(9); len(got) != 0 {
+		t.Errorf("ticks 3-9: %v", got)
+	}
+	if got := tick(10); len(got) != 1 || got[0] != 2 {
+		t.Errorf("tick 10: %v", got)
+	}
+	if s.Len() != 0 {
+		t.Errorf("%d pending after release", s.Len())
+	}
+
+	s.Add(at(2, start.Add(11*time.Hour)))
+	if s.Len() != 0 {
+		t.Error("event added again within a minute of its release")
+	}
+	s.Add(at(4, start.Add(12*time.Hour)))
+	s.Clear()
+	if s.Len() != 0 || len(tick(12)) != 0 {
+		t.Error("cleared event released")
+	}
+}
+
+// TestRelease hands due events to release from the wheel's goroutine.
+func TestRelease(t *testing.T) {
+	var mu sync.Mutex
+	var got []int64
+	s := New(5*time.Millisecond, 8, func(e event.Event) {
+		mu.Lock()
+		got = append(got, e.ID)
+		mu.Unlock()
+	})
+	now := time.Now()
+	s.Add(at(2, now.Add(40*time.Millisecond)))
+	s.Add(at(1, now.Add(10*time.Millisecond)))
+	time.Sleep(120 * time.Millisecond)
+	s.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("released %v", got)
+	}
+}
@@ -0,0 +1,219 @@
+package schema
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/pipeline"
+)
+
+// UpgradedFrom is the metadata key recording the version an upgraded event
+// was sent with.
+const UpgradedFrom = "schema_upgraded_from"
+
+var (
+	ErrVersionRejected = errors.New("schema version rejected")
+	ErrInvalidPayload  = errors.New("payload does not match its schema")
+	ErrUpgrade         = errors.New("schema upgrade failed")
+)
+
+// PayloadError lists why a payload does not match its schema version.
+type PayloadError struct {
+	Type     string
+	Version  string
+	Problems []string
+}
+
+func (e *PayloadError) Error() string {
+	return fmt.Sprintf("payload does not match schema %s version %s", e.Type, e.Version)
+}
+
+func (e *PayloadError) Unwrap() error { return ErrInvalidPayload }
+
+// Registry checks events against the schema version they declare and
+// upgrades them to the latest one. Its schemas can be replaced at runtime,
+// see Prepare.
+type Registry struct {
+	mu      sync.RWMutex
+	schemas map[string]*compiled
+}
+
+type compiled struct {
+	cfg     config.SchemaConfig
+	ordered []string
+	// upgrades holds the migration of each version to the next one.
+	upgrades map[string]*pipeline.Pipeline
+}
+
+// NewRegistry compiles the upgrade steps of schemas.
+func NewRegistry(schemas map[string]config.SchemaConfig) (*Registry, error) {
+	m, err := compile(schemas)
+	if err != nil {
+		return nil, err
+	}
+	return &Registry{schemas: m}, nil
+}
+
+// Prepare compiles schemas for a reload; commit replaces the current ones.
+func (r *Registry) Prepare(schemas map[string]config.SchemaConfig) (func(), error) {
+	m, err := compile(schemas)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		r.mu.Lock()
+		r.schemas = m
+		r.mu.Unlock()
+	}, nil
+}
+
+func compile(schemas map[string]config.SchemaConfig) (map[string]*compiled, error) {
+	out := make(map[string]*compiled, len(schemas))
+	for typ, sc := range schemas {
+		if err := sc.Validate(typ); err != nil {
+			return nil, err
+		}
+		c := &compiled{cfg: sc, ordered: sc.Ordered(), upgrades: map[string]*pipeline.Pipeline{}}
+		for v, vc := range sc.Versions {
+			if len(vc.Upgrade) == 0 {
+				continue
+			}
+			p, err := pipeline.Compile("schema:"+typ+"@"+v, vc.Upgrade)
+			if err != nil {
+				return nil, fmt.Errorf("schemas.%s.versions.%s.upgrade: %w", typ, v, err)
+			}
+			c.upgrades[v] = p
+		}
+		out[typ] = c
+	}
+	return out, nil
+}
+
+// Apply holds e to its type's schema, if it has one: an event without a
+// version gets the latest, a rejected version or a payload that does not
+// match its version is refused, and with auto_upgrade an older version is
+// migrated to the latest and checked again, unless ctx ends first.
+func (r *Registry) Apply(ctx context.Context, e *event.Event, now time.Time) error {
+	r.mu.RLock()
+	c, ok := r.schemas[e.Type]
+	r.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	if e.SchemaVersion == "" {
+		if c.cfg.Latest == "" {
+			return nil
+		}
+		e.SchemaVersion = c.cfg.Latest
+	}
+	if n := negotiate(c.cfg, e.Type, e.SchemaVersion, now); n.Status == Rejected {
+		return fmt.Errorf("%w: %s version %s: %s", ErrVersionRejected, e.Type, e.SchemaVersion, n.Reason)
+	}
+	if err := c.check(e); err != nil {
+		return err
+	}
+	from, to := slices.Index(c.ordered, e.SchemaVersion), slices.Index(c.ordered, c.cfg.Latest)
+	if !c.cfg.AutoUpgrade || from >= to {
+		return nil
+	}
+	original := e.SchemaVersion
+	for i := from; i < to; i++ {
+		if p := c.upgrades[c.ordered[i]]; p != nil {
+			if err := p.Run(ctx, e, pipeline.Client{}); err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				return fmt.Errorf("%w: %s version %s to %s: %v", ErrUpgrade, e.Type, c.ordered[i], c.ordered[i+1], err)
+			}
+		}
+		e.SchemaVersion = c.ordered[i+1]
+	}
+	if err := c.check(e); err != nil {
+		var pe *PayloadError
+		if errors.As(err, &pe) {
+			return fmt.Errorf("%w: %s version %s upgraded to %s: %s", ErrUpgrade, e.Type, original, e.SchemaVersion, strings.Join(pe.Problems, "; "))
+		}
+		return err
+	}
+	if e.Metadata == nil {
+		e.Metadata = map[string]string{}
+	}
+	e.Metadata[UpgradedFrom] = original
+	return nil
+}
+
+// check validates the payload of e against the fields of its version.
+func (c *compiled) check(e *event.Event) error {
+	vc := c.cfg.Versions[e.SchemaVersion]
+	if len(vc.Fields) == 0 {
+		return nil
+	}
+	pe := &PayloadError{Type: e.Type, Version: e.SchemaVersion}
+	dec := json.NewDecoder(bytes.NewReader(e.Payload))
+	dec.UseNumber()
+	var payload map[string]any
+	if err := dec.Decode(&payload); err != nil || payload == nil {
+		pe.Problems = append(pe.Problems, "payload is not an object")
+		return pe
+	}
+	for _, f := range vc.Required {
+		if _, ok := payload[f]; !ok {
+			pe.Problems = append(pe.Problems, fmt.Sprintf("%s is required", f))
+		}
+	}
+	for _, f := range slices.Sorted(maps.Keys(vc.Fields)) {
+		v, ok := payload[f]
+		if !ok {
+			continue
+		}
+		if got := jsonType(v); !typeMatches(vc.Fields[f], got, v) {
+			pe.Problems = append(pe.Problems, fmt.Sprintf("%s must be %s, not %s", f, vc.Fields[f], got))
+		}
+	}
+	if len(pe.Problems) > 0 {
+		return pe
+	}
+	return nil
+}
+
+func jsonType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	}
+	return "unknown"
+}
+
+func typeMatches(want, got string, v any) bool {
+	switch want {
+	case "any":
+		return true
+	case "integer":
+		if n, ok := v.(json.Number); ok {
+			_, err := n.Int64()
+			return err == nil
+		}
+		return false
+	}
+	return want == got
+}
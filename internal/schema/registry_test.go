@@ -0,0 +1,120 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+func registry(t *testing.T, autoUpgrade bool) *Registry {
+	t.Helper()
+	r, err := NewRegistry(map[string]config.SchemaConfig{"order.created": {
+		Latest:      "v2",
+		AutoUpgrade: autoUpgrade,
+		Versions: map[string]config.SchemaVersionConfig{
+			"v1": {
+				Status:   "deprecated",
+				Fields:   map[string]string{"amt": "number", "user": "string"},
+				Required: []string{"amt"},
+				Upgrade:  []config.ProcessorConfig{{Rename: map[string]string{"amt": "amount"}}},
+			},
+			"v2": {
+				Status:   "accepted",
+				Fields:   map[string]string{"amount": "number", "qty": "integer", "user": "string"},
+				Required: []string{"amount"},
+			},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func apply(r *Registry, version, payload string) (event.Event, error) {
+	e := event.Event{Type: "order.created", SchemaVersion: version, Payload: json.RawMessage(payload)}
+	err := r.Apply(context.Background(), &e, time.Now())
+	return e, err
+}
+
+// TestApply checks payloads against the version they declare, the latest
+// when none, and lists every problem.
+func TestApply(t *testing.T) {
+	r := registry(t, false)
+	if e, err := apply(r, "", `{"amount":1,"qty":2}`); err != nil || e.SchemaVersion != "v2" {
+		t.Errorf("no version: %s, %v", e.SchemaVersion, err)
+	}
+	if e, err := apply(r, "v1", `{"amt":1}`); err != nil || e.SchemaVersion != "v1" || string(e.Payload) != `{"amt":1}` {
+		t.Errorf("v1 without auto_upgrade: %+v, %v", e, err)
+	}
+	_, err := apply(r, "v2", `{"qty":1.5,"user":7}`)
+	var pe *PayloadError
+	if !errors.As(err, &pe) || !errors.Is(err, ErrInvalidPayload) {
+		t.Fatalf("invalid payload: %v", err)
+	}
+	want := []string{"amount is required", "qty must be integer, not number", "user must be string, not number"}
+	if !slices.Equal(pe.Problems, want) {
+		t.Errorf("problems %q", pe.Problems)
+	}
+	if _, err := apply(r, "v2", `[1]`); !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("array payload: %v", err)
+	}
+	if _, err := apply(r, "v7", `{}`); !errors.Is(err, ErrVersionRejected) {
+		t.Errorf("unknown version: %v", err)
+	}
+	e := event.Event{Type: "login", SchemaVersion: "v7", Payload: json.RawMessage(`1`)}
+	if err := r.Apply(context.Background(), &e, time.Now()); err != nil {
+		t.Errorf("type without schema: %v", err)
+	}
+}
+
+// TestAutoUpgrade migrates an older version to the latest, recording where
+// it came from, and refuses an upgrade whose result does not match.
+func TestAutoUpgrade(t *testing.T) {
+	r := registry(t, true)
+	e, err := apply(r, "v1", `{"amt":3,"user":"u1"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.SchemaVersion != "v2" || e.Metadata[UpgradedFrom] != "v1" || string(e.Payload) != `{"amount":3,"user":"u1"}` {
+		t.Errorf("upgraded: %+v", e)
+	}
+	if _, err := apply(r, "v1", `{"amt":3,"qty":1.5}`); !errors.Is(err, ErrUpgrade) {
+		t.Errorf("upgrade to an invalid payload: %v", err)
+	}
+	if _, err := apply(r, "v1", `{"user":"u1"}`); !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("invalid before the upgrade: %v", err)
+	}
+}
+
+// TestPrepare swaps the schemas only on commit, and not at all when the new
+// ones do not compile.
+func TestPrepare(t *testing.T) {
+	r := registry(t, false)
+	commit, err := r.Prepare(map[string]config.SchemaConfig{"order.created": {
+		Latest:   "v3",
+		Versions: map[string]config.SchemaVersionConfig{"v3": {Status: "accepted"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := apply(r, "v3", `{}`); !errors.Is(err, ErrVersionRejected) {
+		t.Errorf("v3 before commit: %v", err)
+	}
+	commit()
+	if _, err := apply(r, "v3", `{}`); err != nil {
+		t.Errorf("v3 after commit: %v", err)
+	}
+	if _, err := r.Prepare(map[string]config.SchemaConfig{"x": {
+		Latest:   "v1",
+		Versions: map[string]config.SchemaVersionConfig{"v1": {Status: "accepted", Upgrade: []config.ProcessorConfig{{}}}},
+	}}); err == nil {
+		t.Error("invalid upgrade step prepared")
+	}
+}
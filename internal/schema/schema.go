@@ -0,0 +1,63 @@
+// Package schema tracks the lifecycle of producer schema versions per event
+// type, so producers can check at startup whether their version is still
+// accepted and until when, and holds ingested payloads to the version they
+// declare.
+package schema
+
+import (
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+type Status string
+
+const (
+	Accepted   Status = "accepted"
+	Deprecated Status = "deprecated"
+	Rejected   Status = "rejected"
+)
+
+// Negotiation is the answer for one type and version.
+type Negotiation struct {
+	Type    string `json:"type"`
+	Version string `json:"version"`
+	Status  Status `json:"status"`
+	// Deadline is when a deprecated version starts being rejected.
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// Latest is the version producers should migrate to.
+	Latest string `json:"latest,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Negotiate looks up version of typ in policies at now. Types without a
+// policy accept any version; unknown versions of a known type are rejected,
+// and deprecated versions are rejected once their deadline has passed.
+func Negotiate(policies map[string]config.SchemaConfig, typ, version string, now time.Time) Negotiation {
+	p, ok := policies[typ]
+	if !ok {
+		return Negotiation{Type: typ, Version: version, Status: Accepted, Reason: "no schema policy for this type"}
+	}
+	return negotiate(p, typ, version, now)
+}
+
+func negotiate(p config.SchemaConfig, typ, version string, now time.Time) Negotiation {
+	n := Negotiation{Type: typ, Version: version, Status: Accepted, Latest: p.Latest}
+	v, ok := p.Versions[version]
+	if !ok {
+		n.Status, n.Reason = Rejected, "unknown version"
+		return n
+	}
+	n.Status = Status(v.Status)
+	if n.Status == Rejected {
+		n.Reason = "version rejected"
+	}
+	if n.Status == Deprecated && !v.Deadline.IsZero() {
+		d := v.Deadline.UTC()
+		n.Deadline = &d
+		if !now.Before(d) {
+			n.Status, n.Reason = Rejected, "deprecation deadline passed"
+		}
+	}
+	return n
+}
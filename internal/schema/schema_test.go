@@ -0,0 +1,46 @@
+package schema
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// TestNegotiate accepts any version of a type without a policy, rejects
+// unknown versions, and deprecated ones once their deadline passed.
+func TestNegotiate(t *testing.T) {
+	now := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	policies := map[string]config.SchemaConfig{"order.created": {
+		Latest: "v3",
+		Versions: map[string]config.SchemaVersionConfig{
+			"v1": {Status: "deprecated", Deadline: now.Add(-time.Hour)},
+			"v2": {Status: "deprecated", Deadline: now.Add(24 * time.Hour)},
+			"v3": {Status: "accepted"},
+			"v0": {Status: "rejected"},
+		},
+	}}
+	for _, c := range []struct {
+		typ, version string
+		want         Status
+		deadline     bool
+	}{
+		{"login", "anything", Accepted, false},
+		{"order.created", "v3", Accepted, false},
+		{"order.created", "v2", Deprecated, true},
+		{"order.created", "v1", Rejected, true},
+		{"order.created", "v0", Rejected, false},
+		{"order.created", "v9", Rejected, false},
+	} {
+		n := Negotiate(policies, c.typ, c.version, now)
+		if n.Status != c.want || (n.Deadline != nil) != c.deadline {
+			t.Errorf("%s %s: %+v, want %s", c.typ, c.version, n, c.want)
+		}
+		if c.typ == "order.created" && n.Latest != "v3" {
+			t.Errorf("%s: latest %q", c.version, n.Latest)
+		}
+		if n.Status == Rejected && n.Reason == "" {
+			t.Errorf("%s %s: rejected without a reason", c.typ, c.version)
+		}
+	}
+}
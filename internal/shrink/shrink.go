@@ -0,0 +1,291 @@
+// Package shrink compresses large event payloads with zstd on their way
+// into a Store and decompresses them on their way out, since big JSON
+// payloads make up most of what is stored. Events of a type with a trained
+// dictionary compress far better when small, as every payload of the type
+// shares its field names and common values.
+//
+// A compressed payload is stored as a JSON envelope,
+// {"compressed":{"zstd":"<base64>"}}, so it stays valid JSON for every
+// store and whatever reads the database directly.
+package shrink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+	"github.com/rafaelosorio/go-ingest-service/internal/typematch"
+)
+
+// envelopePrefix starts every compressed payload.
+var envelopePrefix = []byte(`{"compressed":{"zstd":`)
+
+type envelope struct {
+	Compressed struct {
+		Zstd []byte `json:"zstd"`
+	} `json:"compressed"`
+}
+
+// maxDecoded bounds a decompressed payload, well above any guardrail.
+const maxDecoded = 256 << 20
+
+var (
+	payloadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "payload_compression_total", Help: "Payloads compressed, stored as they are for lack of gain, decompressed, or left unreadable for want of their dictionary"},
+		[]string{"result"},
+	)
+	inputBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "payload_compression_input_bytes_total", Help: "Bytes of the payloads compressed before storing, by dictionary type pattern (none without one)"},
+		[]string{"dictionary"},
+	)
+	outputBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "payload_compression_output_bytes_total", Help: "Bytes stored for the payloads compressed, envelope included, by dictionary type pattern (none without one)"},
+		[]string{"dictionary"},
+	)
+)
+
+// Collectors returns the compression metrics for registration by the
+// caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{payloadsTotal, inputBytes, outputBytes}
+}
+
+// Compressor compresses payloads as a config.PayloadCompressionConfig says.
+// It is safe for concurrent use.
+type Compressor struct {
+	minBytes int
+	types    []string
+	plain    *zstd.Encoder
+	dicts    map[string]*zstd.Encoder
+	dec      *zstd.Decoder
+}
+
+// New loads the dictionaries of cfg.
+func New(cfg config.PayloadCompressionConfig) (*Compressor, error) {
+	level := zstd.SpeedDefault
+	switch cfg.Level {
+	case "fastest":
+		level = zstd.SpeedFastest
+	case "better":
+		level = zstd.SpeedBetterCompression
+	case "best":
+		level = zstd.SpeedBestCompression
+	}
+	plain, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	c := &Compressor{minBytes: cfg.MinBytes, types: cfg.Types, plain: plain, dicts: map[string]*zstd.Encoder{}}
+	var all [][]byte
+	for pattern, file := range cfg.Dictionaries {
+		dict, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("compression dictionary %s: %w", pattern, err)
+		}
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderDict(dict))
+		if err != nil {
+			return nil, fmt.Errorf("compression dictionary %s: %s: %w", pattern, file, err)
+		}
+		c.dicts[pattern] = enc
+		all = append(all, dict)
+	}
+	for _, file := range cfg.RetiredDictionaries {
+		dict, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("retired compression dictionary: %w", err)
+		}
+		all = append(all, dict)
+	}
+	// a decoder finds the dictionary of a frame by the ID in its header
+	if c.dec, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxDecoded), zstd.WithDecoderDicts(all...)); err != nil {
+		return nil, fmt.Errorf("compression dictionaries: %w", err)
+	}
+	return c, nil
+}
+
+// dictionary returns the longest pattern with a dictionary that typ
+// matches, and its encoder; without one, "none" and the plain encoder.
+func (c *Compressor) dictionary(typ string) (string, *zstd.Encoder) {
+	name, enc := "none", c.plain
+	best := -1
+	for pattern, e := range c.dicts {
+		if len(pattern) > best && typematch.Match(pattern, typ) {
+			name, enc, best = pattern, e, len(pattern)
+		}
+	}
+	return name, enc
+}
+
+// Compress returns payload compressed when it is at least min_bytes, of a
+// compressed type, and smaller for it. A payload that looks like an
+// envelope is always compressed, so it reads back as it was sent.
+func (c *Compressor) Compress(typ string, payload json.RawMessage) json.RawMessage {
+	lookalike := bytes.HasPrefix(payload, envelopePrefix)
+	if !lookalike && (len(payload) < c.minBytes || (len(c.types) > 0 && !typematch.MatchAny(c.types, typ))) {
+		return payload
+	}
+	name, enc := c.dictionary(typ)
+	var env envelope
+	env.Compressed.Zstd = enc.EncodeAll(payload, nil)
+	out, err := json.Marshal(env)
+	if err != nil || (len(out) >= len(payload) && !lookalike) {
+		payloadsTotal.WithLabelValues("skipped").Inc()
+		return payload
+	}
+	payloadsTotal.WithLabelValues("compressed").Inc()
+	inputBytes.WithLabelValues(name).Add(float64(len(payload)))
+	outputBytes.WithLabelValues(name).Add(float64(len(out)))
+	return out
+}
+
+// Decompress returns the payload a compressed one was made from. One whose
+// dictionary is not loaded, or that is corrupt, is returned as stored.
+func (c *Compressor) Decompress(payload json.RawMessage) json.RawMessage {
+	if !bytes.HasPrefix(payload, envelopePrefix) {
+		return payload
+	}
+	var env envelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		return payload
+	}
+	plain, err := c.dec.DecodeAll(env.Compressed.Zstd, nil)
+	if err != nil {
+		payloadsTotal.WithLabelValues("unreadable").Inc()
+		return payload
+	}
+	payloadsTotal.WithLabelValues("decompressed").Inc()
+	return plain
+}
+
+// Close releases the decoder.
+func (c *Compressor) Close() {
+	c.dec.Close()
+}
+
+// Store compresses the payloads on their way into a Store and decompresses
+// them on their way out. It wraps the encrypting store, so payloads are
+// compressed before they are encrypted.
+type Store struct {
+	storage.Store
+	c *Compressor
+}
+
+// Wrap returns s behind c.
+func (c *Compressor) Wrap(s storage.Store) *Store {
+	return &Store{Store: s, c: c}
+}
+
+func (s *Store) Add(ctx context.Context, e event.Event, sinks ...string) (event.Event, error) {
+	plain := e.Payload
+	e.Payload = s.c.Compress(e.Type, e.Payload)
+	out, err := s.Store.Add(ctx, e, sinks...)
+	out.Payload = plain
+	return out, err
+}
+
+func (s *Store) List(ctx context.Context, q storage.Query) ([]event.Event, error) {
+	out, err := s.Store.List(ctx, q)
+	s.decompress(out)
+	return out, err
+}
+
+func (s *Store) Get(ctx context.Context, id int64) (event.Event, error) {
+	out, err := s.Store.Get(ctx, id)
+	out.Payload = s.c.Decompress(out.Payload)
+	return out, err
+}
+
+func (s *Store) GetMany(ctx context.Context, ids []int64) ([]event.Event, error) {
+	out, err := s.Store.GetMany(ctx, ids)
+	s.decompress(out)
+	return out, err
+}
+
+func (s *Store) Trash(ctx context.Context, id int64) (event.Event, error) {
+	out, err := s.Store.Trash(ctx, id)
+	out.Payload = s.c.Decompress(out.Payload)
+	return out, err
+}
+
+func (s *Store) Restore(ctx context.Context, id int64) (event.Event, error) {
+	out, err := s.Store.Restore(ctx, id)
+	out.Payload = s.c.Decompress(out.Payload)
+	return out, err
+}
+
+func (s *Store) Scheduled(ctx context.Context) ([]event.Event, error) {
+	out, err := s.Store.Scheduled(ctx)
+	s.decompress(out)
+	return out, err
+}
+
+func (s *Store) Deliveries(ctx context.Context, sink string, now time.Time, limit int, byKey bool) ([]storage.Delivery, error) {
+	out, err := s.Store.Deliveries(ctx, sink, now, limit, byKey)
+	for i := range out {
+		out[i].Event.Payload = s.c.Decompress(out[i].Event.Payload)
+	}
+	return out, err
+}
+
+func (s *Store) DeadDeliveries(ctx context.Context, sink string, limit int) ([]storage.Delivery, error) {
+	out, err := s.Store.DeadDeliveries(ctx, sink, limit)
+	for i := range out {
+		out[i].Event.Payload = s.c.Decompress(out[i].Event.Payload)
+	}
+	return out, err
+}
+
+// decompress decompresses es in place. Stores may hand out events they
+// keep, like the memory store and the hot tier, so each payload is
+// replaced, never written to.
+func (s *Store) decompress(es []event.Event) {
+	for i := range es {
+		es[i].Payload = s.c.Decompress(es[i].Payload)
+	}
+}
+
+// Partitions and DropPartitions pass through to the store, see
+// storage.Partitioner.
+func (s *Store) Partitions() ([]storage.Partition, error) {
+	p, ok := s.Store.(storage.Partitioner)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return p.Partitions()
+}
+
+func (s *Store) DropPartitions(before time.Time) ([]storage.Partition, error) {
+	p, ok := s.Store.(storage.Partitioner)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return p.DropPartitions(before)
+}
+
+// Snapshot passes through to the store, see storage.Snapshotter.
+func (s *Store) Snapshot(path string) (int64, error) {
+	sn, ok := s.Store.(storage.Snapshotter)
+	if !ok {
+		return 0, errors.ErrUnsupported
+	}
+	return sn.Snapshot(path)
+}
+
+// FieldIndexes passes through to the store, see storage.FieldIndexer.
+func (s *Store) FieldIndexes() ([]storage.FieldIndex, error) {
+	fi, ok := s.Store.(storage.FieldIndexer)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return fi.FieldIndexes()
+}
@@ -0,0 +1,133 @@
+package shrink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+func payload(n int) json.RawMessage {
+	return json.RawMessage(fmt.Sprintf(`{"user":"u-%d","plan":"enterprise","note":%q}`, n, strings.Repeat("lorem ipsum ", 40)))
+}
+
+// TestStore writes through the compressor: large payloads are stored
+// compressed and read back as sent, small ones and other types are left
+// alone.
+func TestStore(t *testing.T) {
+	mem := storage.NewMemory(1)
+	c, err := New(config.PayloadCompressionConfig{Enabled: true, MinBytes: 100, Types: []string{"page.*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s := c.Wrap(mem)
+
+	big, err := s.Add(context.Background(), event.Event{Type: "page.view", Payload: payload(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(big.Payload, payload(1)) {
+		t.Errorf("Add returned payload %s", big.Payload)
+	}
+	small, _ := s.Add(context.Background(), event.Event{Type: "page.view", Payload: json.RawMessage(`{"n":1}`)})
+	other, _ := s.Add(context.Background(), event.Event{Type: "order", Payload: payload(2)})
+
+	stored, err := mem.Get(context.Background(), big.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(stored.Payload, envelopePrefix) || len(stored.Payload) >= len(payload(1)) {
+		t.Fatalf("stored %s", stored.Payload)
+	}
+	for id, want := range map[int64]json.RawMessage{big.ID: payload(1), small.ID: json.RawMessage(`{"n":1}`), other.ID: payload(2)} {
+		raw, _ := mem.Get(context.Background(), id)
+		if id != big.ID && !bytes.Equal(raw.Payload, want) {
+			t.Errorf("event %d stored as %s", id, raw.Payload)
+		}
+		got, err := s.Get(context.Background(), id)
+		if err != nil || !bytes.Equal(got.Payload, want) {
+			t.Errorf("Get(%d) = %s, %v", id, got.Payload, err)
+		}
+	}
+	list, err := s.List(context.Background(), storage.Query{Limit: 10})
+	if err != nil || len(list) != 3 {
+		t.Fatalf("List: %d, %v", len(list), err)
+	}
+	for _, e := range list {
+		if bytes.HasPrefix(e.Payload, envelopePrefix) {
+			t.Errorf("listed %d compressed", e.ID)
+		}
+	}
+
+	// a payload shaped like an envelope reads back as sent
+	fake := json.RawMessage(`{"compressed":{"zstd":"AAAA"}}`)
+	e, _ := s.Add(context.Background(), event.Event{Type: "x", Payload: fake})
+	if got, _ := s.Get(context.Background(), e.ID); !bytes.Equal(got.Payload, fake) {
+		t.Errorf("lookalike read back as %s", got.Payload)
+	}
+}
+
+// TestDictionary compresses a type with its dictionary, better than without,
+// and leaves its payloads unreadable once the dictionary is gone.
+func TestDictionary(t *testing.T) {
+	var samples [][]byte
+	for i := range 200 {
+		samples = append(samples, payload(i))
+	}
+	dict, err := zstd.BuildDict(zstd.BuildDictOptions{ID: 42, Contents: samples, History: bytes.Join(samples[:20], nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "page.dict")
+	if err := os.WriteFile(file, dict, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.PayloadCompressionConfig{Enabled: true, MinBytes: 1, Dictionaries: map[string]string{"page.*": file, "page.view": file}}
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := c.dictionary("page.view"); name != "page.view" {
+		t.Errorf("dictionary of page.view: %s", name)
+	}
+	withDict := c.Compress("page.view", payload(500))
+	plain := c.Compress("order", payload(500))
+	if len(withDict) >= len(plain) {
+		t.Errorf("%d bytes with the dictionary, %d without", len(withDict), len(plain))
+	}
+	if got := c.Decompress(withDict); !bytes.Equal(got, payload(500)) {
+		t.Fatalf("Decompress = %s", got)
+	}
+
+	// without the dictionary, retired or not, the payload stays as stored
+	none, err := New(config.PayloadCompressionConfig{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := none.Decompress(withDict); !bytes.Equal(got, withDict) {
+		t.Errorf("read without its dictionary as %s", got)
+	}
+	retired, err := New(config.PayloadCompressionConfig{Enabled: true, RetiredDictionaries: []string{file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := retired.Decompress(withDict); !bytes.Equal(got, payload(500)) {
+		t.Errorf("read with the retired dictionary as %s", got)
+	}
+
+	cfg.Dictionaries = map[string]string{"page.*": filepath.Join(t.TempDir(), "missing")}
+	if _, err := New(cfg); err == nil {
+		t.Error("New accepted a missing dictionary file")
+	}
+}
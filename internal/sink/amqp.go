@@ -0,0 +1,179 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/amqp"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// amqpExchange publishes each formatted record to a RabbitMQ exchange under
+// a routing key rendered from the event, and returns once the broker has
+// confirmed the whole batch. The connection is kept between batches and
+// redialed after an error; a batch that fails on a kept connection is
+// retried once on a fresh one, since an idle connection may have died
+// unnoticed.
+type amqpExchange struct {
+	name       string
+	url        string
+	exchange   string
+	key        *template.Template
+	payload    bool
+	persistent bool
+	format     Formatter
+	timeout    time.Duration
+
+	mu   sync.Mutex
+	conn *amqp.Conn
+}
+
+func newAMQPExchange(cfg config.SinkConfig, format Formatter) (*amqpExchange, error) {
+	key, err := template.New(cfg.Name).Funcs(templateFuncs).Parse(cfg.AMQP.RoutingKeyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("sink %s: routing_key_template: %w", cfg.Name, err)
+	}
+	a := &amqpExchange{
+		name:       cfg.Name,
+		url:        cfg.URL,
+		exchange:   cfg.AMQP.Exchange,
+		key:        key,
+		payload:    strings.Contains(cfg.AMQP.RoutingKeyTemplate, ".Payload"),
+		persistent: !cfg.AMQP.Transient,
+		format:     format,
+		timeout:    cfg.Timeout,
+	}
+	if a.timeout <= 0 {
+		a.timeout = 10 * time.Second
+	}
+	return a, nil
+}
+
+func (a *amqpExchange) Name() string { return a.name }
+
+// message is a record ready to publish.
+type message struct {
+	key   string
+	props amqp.Properties
+	body  []byte
+}
+
+func (a *amqpExchange) Publish(ctx context.Context, events []event.Event) error {
+	msgs := make([]message, 0, len(events))
+	for _, e := range events {
+		// formatAll would lose which event a record came from
+		rec, err := a.format(e)
+		var body []byte
+		if err == nil {
+			body, err = json.Marshal(rec)
+		}
+		var key string
+		if err == nil {
+			key, err = a.routingKey(e)
+		}
+		if err != nil {
+			formatErrors.WithLabelValues(a.name).Inc()
+			log.Error().Err(err).Str("sink", a.name).Int64("id", e.ID).Msg("format event")
+			continue
+		}
+		msgs = append(msgs, message{key: key, body: body, props: amqp.Properties{
+			ContentType:   "application/json",
+			Persistent:    a.persistent,
+			MessageID:     strconv.FormatInt(e.ID, 10),
+			CorrelationID: e.CorrelationID,
+			Timestamp:     e.ReceivedAt,
+			Type:          e.Type,
+		}})
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	kept := a.conn != nil
+	err := a.publish(ctx, msgs)
+	var closed *amqp.CloseError
+	if err != nil && kept && ctx.Err() == nil && !errors.Is(err, amqp.ErrNacked) && !errors.As(err, &closed) {
+		a.closeLocked()
+		err = a.publish(ctx, msgs)
+	}
+	if err != nil {
+		a.closeLocked()
+		return fmt.Errorf("amqp sink %s: %w", a.name, err)
+	}
+	return nil
+}
+
+// publish sends msgs and waits for their confirms, or fails with ctx's
+// error once ctx ends. The caller holds a.mu.
+func (a *amqpExchange) publish(ctx context.Context, msgs []message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if a.conn == nil {
+		c, err := amqp.Dial(a.url, a.timeout)
+		if err != nil {
+			return err
+		}
+		if err := c.Confirm(); err != nil {
+			_ = c.Abort()
+			return err
+		}
+		a.conn = c
+	}
+	for _, m := range msgs {
+		a.conn.Publish(a.exchange, m.key, m.props, m.body)
+	}
+	// a canceled publish aborts the connection it waits on
+	conn := a.conn
+	stop := context.AfterFunc(ctx, func() { _ = conn.Abort() })
+	err := conn.WaitConfirms()
+	if !stop() && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (a *amqpExchange) routingKey(e event.Event) (string, error) {
+	data := templateData{
+		ID: e.ID, Type: e.Type, Tags: e.Tags, Metadata: e.Metadata,
+		DeliverAt: e.DeliverAt, ReceivedAt: e.ReceivedAt, Sink: a.name,
+	}
+	if a.payload && len(e.Payload) > 0 {
+		if err := json.Unmarshal(e.Payload, &data.Payload); err != nil {
+			return "", fmt.Errorf("payload: %w", err)
+		}
+	}
+	var b strings.Builder
+	if err := a.key.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("routing key: %w", err)
+	}
+	if b.Len() > 255 {
+		return "", fmt.Errorf("routing key longer than 255 bytes")
+	}
+	return b.String(), nil
+}
+
+func (a *amqpExchange) closeLocked() {
+	if a.conn != nil {
+		_ = a.conn.Close()
+		a.conn = nil
+	}
+}
+
+func (a *amqpExchange) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closeLocked()
+	return nil
+}
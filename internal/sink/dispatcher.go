@@ -0,0 +1,673 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/breaker"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/ingestmetrics"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+var (
+	eventsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "sink_events_total", Help: "Events handled by sinks by result"},
+		[]string{"sink", "result"},
+	)
+	filteredTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "sink_filtered_events_total", Help: "Events routed to a sink but dropped by its filter, by filter (allow, deny)"},
+		[]string{"sink", "filter"},
+	)
+	publishDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "sink_publish_duration_seconds",
+			Help:    "Sink batch publish latency",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"sink"},
+	)
+)
+
+// Collectors returns the sink metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{eventsTotal, filteredTotal, publishDuration, routedTotal, formatErrors, outboxDeliveries, spillBytes, spillBatches, failoverTotal, redriveTotal, redriveBacklog}
+}
+
+// Dispatcher fans accepted events out to every configured sink. Each sink has
+// its own bounded queue and worker so a slow destination never blocks ingest
+// or the other sinks; events are dropped (and counted) when a queue is full.
+type Dispatcher struct {
+	queues []*queue
+	// router is nil without routing rules: every sink gets every event.
+	router atomic.Pointer[router]
+	byName map[string]*queue
+	wg     sync.WaitGroup
+
+	// dynamic holds the sinks added at runtime by AddSinks, by name. They
+	// are not subject to routing rules.
+	mu      sync.RWMutex
+	dynamic map[string]*queue
+	// outbox, once started, delivers published events instead of the
+	// queues, which then only carry PublishTo.
+	outbox     *outbox
+	outboxDone chan struct{}
+	// breakers configures the circuit breaker of every sink.
+	breakers config.BreakerConfig
+	// ctx is the context of every publish, canceled by Close when it
+	// stops waiting for them.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type queue struct {
+	sink Sink
+	// ctx is the dispatcher's, set when the queue starts.
+	ctx context.Context
+	// lanes each batch and deliver on their own; an event's partition key
+	// picks its lane when the sink is ordered, else there is one lane.
+	lanes   []chan event.Event
+	ordered bool
+	// wake and stop signal the sink's outbox worker.
+	wake, stop    chan struct{}
+	batchSize     int
+	flushInterval time.Duration
+	// namespaces, when set, limits the sink to events in these subtrees.
+	namespaces []string
+	// allow, when set, and deny filter the events routed to the sink.
+	allow, deny []storage.Query
+	// breaker, when enabled, holds batches back while the sink is failing.
+	breaker *breaker.Breaker
+	// depth is the queue's ingest_queue_depth series.
+	depth prometheus.Gauge
+	// fallback, when set, takes the batches while the breaker is open, and
+	// backlog, when the sink redrives, what it took.
+	fallback *queue
+	backlog  *backlog
+	// standby is set on a fallback, which gets no events of its own.
+	standby bool
+}
+
+func NewDispatcher(cfgs []config.SinkConfig, routing config.RoutingConfig, saved map[string]config.SavedQueryConfig, breakers config.BreakerConfig) (*Dispatcher, error) {
+	d := &Dispatcher{byName: map[string]*queue{}, dynamic: map[string]*queue{}, breakers: breakers}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for _, cfg := range cfgs {
+		q, err := newQueue(cfg, breakers)
+		if err != nil {
+			return nil, err
+		}
+		d.queues = append(d.queues, q)
+		d.byName[cfg.Name] = q
+	}
+	for _, cfg := range cfgs {
+		if cfg.Fallback == "" {
+			continue
+		}
+		q, f := d.byName[cfg.Name], d.byName[cfg.Fallback]
+		if f == nil {
+			return nil, fmt.Errorf("sink %s: unknown fallback %q", cfg.Name, cfg.Fallback)
+		}
+		q.fallback, f.standby = f, true
+		if cfg.Redrive {
+			q.backlog = newBacklog(cfg.Name, orDefault(cfg.QueueSize, 1024))
+		}
+	}
+	apply, err := d.PrepareRouting(routing, saved)
+	if err != nil {
+		return nil, err
+	}
+	apply()
+	for _, q := range d.queues {
+		d.start(q)
+	}
+	return d, nil
+}
+
+func newQueue(cfg config.SinkConfig, breakers config.BreakerConfig) (*queue, error) {
+	s, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if faults != nil {
+		s = faulty{Sink: s, c: faults}
+	}
+	for _, ns := range cfg.Namespaces {
+		if err := event.ValidateNamespace(ns); err != nil {
+			return nil, fmt.Errorf("sink %s: %w", cfg.Name, err)
+		}
+	}
+	q := &queue{
+		sink:          s,
+		ordered:       cfg.Ordering == "key",
+		wake:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		batchSize:     orDefault(cfg.BatchSize, 100),
+		flushInterval: cfg.FlushInterval,
+		namespaces:    cfg.Namespaces,
+		breaker:       breaker.New("sink:"+cfg.Name, breakers),
+		depth:         ingestmetrics.QueueDepth.WithLabelValues("sink:" + cfg.Name),
+	}
+	for _, f := range []struct {
+		name string
+		cfgs []config.SavedQueryConfig
+		dst  *[]storage.Query
+	}{{"allow", cfg.Filter.Allow, &q.allow}, {"deny", cfg.Filter.Deny, &q.deny}} {
+		for i, fc := range f.cfgs {
+			fq := storage.Query{Types: fc.Types, Tags: fc.Tags, Fields: fc.Fields}
+			if err := fq.Validate(); err != nil {
+				return nil, fmt.Errorf("sink %s: filter.%s[%d]: %w", cfg.Name, f.name, i, err)
+			}
+			*f.dst = append(*f.dst, fq.Compile())
+		}
+	}
+	if q.flushInterval <= 0 {
+		q.flushInterval = time.Second
+	}
+	lanes := 1
+	if q.ordered {
+		lanes = orDefault(cfg.Lanes, 8)
+	}
+	// the lanes share the queue size, rounded up
+	size := orDefault(cfg.QueueSize, 1024)
+	for range lanes {
+		q.lanes = append(q.lanes, make(chan event.Event, (size+lanes-1)/lanes))
+	}
+	return q, nil
+}
+
+func (d *Dispatcher) start(q *queue) {
+	q.ctx = d.ctx
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		q.run()
+		if c, ok := q.sink.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}()
+	if d.outbox != nil {
+		d.startOutbox(q)
+	}
+}
+
+func (d *Dispatcher) startOutbox(q *queue) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.outbox.run(q)
+	}()
+}
+
+// StartOutbox switches the sinks to at-least-once delivery from the outbox
+// of store. Events must then be stored with a delivery to each of their
+// Targets; Publish only wakes the workers. The workers deliver only while
+// leading reports true.
+func (d *Dispatcher) StartOutbox(store storage.Store, cfg config.OutboxConfig, leading func() bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.outbox = newOutbox(store, cfg, leading)
+	d.outboxDone = make(chan struct{})
+	for _, q := range d.queues {
+		d.startOutbox(q)
+	}
+	for _, q := range d.dynamic {
+		d.startOutbox(q)
+	}
+	go d.outbox.measure(d.outboxDone)
+}
+
+// Targets returns the names of the sinks e is routed to and passes the
+// filters of, for storing with e, when the outbox is started; nil otherwise.
+func (d *Dispatcher) Targets(e *event.Event) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.outbox == nil {
+		return nil
+	}
+	queues := d.queues
+	if r := d.router.Load(); r != nil {
+		queues = r.targets(e)
+	}
+	var out []string
+	for _, qs := range [][]*queue{queues, slices.Collect(maps.Values(d.dynamic))} {
+		for _, q := range qs {
+			if !q.standby && q.accepts(e) {
+				out = append(out, q.sink.Name())
+			}
+		}
+	}
+	return out
+}
+
+// AddSinks starts sinks at runtime, e.g. for an onboarded tenant. It starts
+// none of them when one is invalid or its name is already in use.
+func (d *Dispatcher) AddSinks(cfgs []config.SinkConfig) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	add := make(map[string]*queue, len(cfgs))
+	for _, cfg := range cfgs {
+		if _, ok := d.byName[cfg.Name]; ok {
+			return fmt.Errorf("sink %s: name already in use", cfg.Name)
+		}
+		if _, ok := d.dynamic[cfg.Name]; ok {
+			return fmt.Errorf("sink %s: name already in use", cfg.Name)
+		}
+		if _, ok := add[cfg.Name]; ok {
+			return fmt.Errorf("sink %s: duplicate name", cfg.Name)
+		}
+		if cfg.Fallback != "" {
+			return fmt.Errorf("sink %s: fallback is only available to configured sinks", cfg.Name)
+		}
+		q, err := newQueue(cfg, d.breakers)
+		if err != nil {
+			return err
+		}
+		add[cfg.Name] = q
+	}
+	for name, q := range add {
+		d.dynamic[name] = q
+		d.start(q)
+	}
+	return nil
+}
+
+// RemoveSinks stops the named sinks added by AddSinks after flushing what
+// they have queued.
+func (d *Dispatcher) RemoveSinks(names ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, name := range names {
+		if q, ok := d.dynamic[name]; ok {
+			delete(d.dynamic, name)
+			q.close()
+			ingestmetrics.QueueDepth.DeleteLabelValues("sink:" + name)
+		}
+	}
+}
+
+// PrepareRouting checks routing against the sinks of d and returns a func
+// that makes it take effect for the events published after it returns.
+func (d *Dispatcher) PrepareRouting(routing config.RoutingConfig, saved map[string]config.SavedQueryConfig) (func(), error) {
+	if len(routing.Rules) == 0 {
+		return func() { d.router.Store(nil) }, nil
+	}
+	r, err := newRouter(routing, saved, d.byName)
+	if err != nil {
+		return nil, err
+	}
+	return func() { d.router.Store(r) }, nil
+}
+
+// Publish enqueues e for every sink it is routed to without blocking. With
+// the outbox started, e is already stored with its deliveries and Publish
+// only wakes the workers.
+func (d *Dispatcher) Publish(e event.Event) {
+	d.mu.RLock()
+	outbox := d.outbox != nil
+	d.mu.RUnlock()
+	if outbox {
+		d.each(func(q *queue) {
+			select {
+			case q.wake <- struct{}{}:
+			default:
+			}
+		})
+		return
+	}
+	queues := d.queues
+	if r := d.router.Load(); r != nil {
+		queues = r.targets(&e)
+	}
+	for _, q := range queues {
+		q.publish(&e)
+	}
+	// hold the lock while sending so RemoveSinks cannot close a queue
+	// under us; sends never block
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, q := range d.dynamic {
+		q.publish(&e)
+	}
+}
+
+func (q *queue) publish(e *event.Event) {
+	if q.standby || !q.accepts(e) {
+		return
+	}
+	q.enqueue(*e)
+}
+
+// enqueue puts e in its lane without blocking, dropping it when the lane is
+// full.
+func (q *queue) enqueue(e event.Event) {
+	select {
+	case q.lanes[q.lane(&e)] <- e:
+		q.depth.Set(float64(q.len()))
+	default:
+		eventsTotal.WithLabelValues(q.sink.Name(), "dropped").Inc()
+	}
+}
+
+// lane returns the index of e's lane: that of its partition key, or of its
+// ID when it has none, as nothing orders it after other events.
+func (q *queue) lane(e *event.Event) int {
+	return laneOf(e, len(q.lanes))
+}
+
+func laneOf(e *event.Event, lanes int) int {
+	if lanes <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	if e.PartitionKey != "" {
+		h.Write([]byte(e.PartitionKey))
+	} else {
+		h.Write(strconv.AppendInt(nil, e.ID, 10))
+	}
+	return int(h.Sum32() % uint32(lanes))
+}
+
+// len returns the number of events waiting in the lanes.
+func (q *queue) len() int {
+	n := 0
+	for _, ch := range q.lanes {
+		n += len(ch)
+	}
+	return n
+}
+
+// fill returns how full the lanes are together, from 0 to 1.
+func (q *queue) fill() float64 {
+	n := 0
+	for _, ch := range q.lanes {
+		n += cap(ch)
+	}
+	return float64(q.len()) / float64(n)
+}
+
+// close stops the lanes, which flush what they hold, and the outbox worker.
+func (q *queue) close() {
+	for _, ch := range q.lanes {
+		close(ch)
+	}
+	close(q.stop)
+}
+
+// PublishTo enqueues e for the named sink only, bypassing routing and sink
+// namespaces, without blocking.
+func (d *Dispatcher) PublishTo(name string, e event.Event) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	q, ok := d.byName[name]
+	if !ok {
+		if q, ok = d.dynamic[name]; !ok {
+			return
+		}
+	}
+	q.enqueue(e)
+}
+
+// QueueDepths returns the number of events waiting in each sink's queue.
+func (d *Dispatcher) QueueDepths() map[string]int {
+	out := make(map[string]int, len(d.queues))
+	d.each(func(q *queue) { out[q.sink.Name()] = q.len() })
+	return out
+}
+
+// QueueFill returns the fill, from 0 to 1, of the fullest sink queue.
+func (d *Dispatcher) QueueFill() float64 {
+	var fill float64
+	d.each(func(q *queue) { fill = max(fill, q.fill()) })
+	return fill
+}
+
+// Breakers returns the state of each sink's circuit breaker, for the sinks
+// that have one.
+func (d *Dispatcher) Breakers() map[string]breaker.State {
+	out := map[string]breaker.State{}
+	d.each(func(q *queue) {
+		if q.breaker != nil {
+			out[q.breaker.Name()] = q.breaker.State()
+		}
+	})
+	return out
+}
+
+// Spills returns the spill directory of each upstream sink that has one.
+func (d *Dispatcher) Spills() map[string]Spill {
+	out := map[string]Spill{}
+	d.each(func(q *queue) {
+		s := q.sink
+		if f, ok := s.(faulty); ok {
+			s = f.Sink
+		}
+		if u, ok := s.(*upstream); ok && u.spill != nil {
+			out[u.name] = u.spill.state()
+		}
+	})
+	return out
+}
+
+// each calls fn for the configured and the runtime queues.
+func (d *Dispatcher) each(fn func(*queue)) {
+	for _, q := range d.queues {
+		fn(q)
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, q := range d.dynamic {
+		fn(q)
+	}
+}
+
+// Close stops accepting events and waits for queued batches to be flushed,
+// canceling the publishes still running once ctx ends.
+func (d *Dispatcher) Close(ctx context.Context) {
+	d.mu.Lock()
+	for _, q := range d.queues {
+		q.close()
+	}
+	for name, q := range d.dynamic {
+		delete(d.dynamic, name)
+		q.close()
+	}
+	if d.outboxDone != nil {
+		close(d.outboxDone)
+	}
+	d.mu.Unlock()
+	flushed := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		d.cancel()
+		<-flushed
+	}
+	d.cancel()
+}
+
+// accepts applies the sink's namespaces and filter to an event routed to it.
+func (q *queue) accepts(e *event.Event) bool {
+	if !q.routes(e.Type) {
+		return false
+	}
+	if f := q.filter(e); f != "" {
+		filteredTotal.WithLabelValues(q.sink.Name(), f).Inc()
+		return false
+	}
+	return true
+}
+
+func (q *queue) routes(typ string) bool {
+	if len(q.namespaces) == 0 {
+		return true
+	}
+	for _, ns := range q.namespaces {
+		if event.InNamespace(typ, ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns "allow" or "deny" when the sink's filter drops e, or "".
+func (q *queue) filter(e *event.Event) string {
+	if len(q.allow) > 0 && !slices.ContainsFunc(q.allow, func(f storage.Query) bool { return f.Match(e) }) {
+		return "allow"
+	}
+	if slices.ContainsFunc(q.deny, func(f storage.Query) bool { return f.Match(e) }) {
+		return "deny"
+	}
+	return ""
+}
+
+// run delivers the lanes until they are closed and flushed.
+func (q *queue) run() {
+	var wg sync.WaitGroup
+	for _, ch := range q.lanes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.runLane(ch)
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *queue) runLane(ch chan event.Event) {
+	ticker := time.NewTicker(q.flushInterval)
+	defer ticker.Stop()
+	batch := make([]event.Event, 0, q.batchSize)
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				q.flush(batch)
+				return
+			}
+			q.depth.Set(float64(q.len()))
+			batch = append(batch, e)
+			if len(batch) >= q.batchSize {
+				q.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			q.flush(batch)
+			batch = batch[:0]
+			q.redriveSome()
+		}
+	}
+}
+
+func (q *queue) flush(batch []event.Event) {
+	if len(batch) == 0 {
+		return
+	}
+	name := q.sink.Name()
+	// while the breaker is open the batch waits for its probe, and the
+	// queue behind it fills up and drops
+	for {
+		var open *breaker.OpenError
+		err := q.breaker.Allow()
+		if !errors.As(err, &open) {
+			break
+		}
+		if q.fallback != nil {
+			q.failover(batch, true)
+			return
+		}
+		select {
+		case <-q.stop:
+			eventsTotal.WithLabelValues(name, "failed").Add(float64(len(batch)))
+			log.Error().Err(err).Str("sink", name).Int("events", len(batch)).Msg("sink publish failed")
+			return
+		case <-time.After(open.RetryAfter):
+		}
+	}
+	if err := q.send(batch); err != nil {
+		eventsTotal.WithLabelValues(name, "failed").Add(float64(len(batch)))
+		log.Error().Err(err).Str("sink", name).Int("events", len(batch)).Msg("sink publish failed")
+		switch {
+		case q.fallback != nil && q.breaker.State() == breaker.Open:
+			q.failover(batch, true)
+		case q.ordered:
+			q.retry(batch)
+		}
+		return
+	}
+	eventsTotal.WithLabelValues(name, "delivered").Add(float64(len(batch)))
+}
+
+// retry publishes the failed batch of an ordered lane again, backing off
+// from one second to a minute, until it is delivered or the sink stops: the
+// events behind it in the lane must not overtake it. Meanwhile the lane
+// fills up and drops, while the other lanes carry on.
+func (q *queue) retry(batch []event.Event) {
+	name := q.sink.Name()
+	for wait := time.Second; ; wait = min(2*wait, time.Minute) {
+		select {
+		case <-q.stop:
+			return
+		case <-time.After(wait):
+		}
+		if err := q.breaker.Allow(); err != nil {
+			if q.fallback != nil {
+				q.failover(batch, true)
+				return
+			}
+			continue
+		}
+		err := q.send(batch)
+		if err == nil {
+			eventsTotal.WithLabelValues(name, "delivered").Add(float64(len(batch)))
+			return
+		}
+		eventsTotal.WithLabelValues(name, "failed").Add(float64(len(batch)))
+		log.Error().Err(err).Str("sink", name).Int("events", len(batch)).Msg("sink publish failed")
+	}
+}
+
+// send publishes batch to q's sink, once its breaker let it through, and
+// records the outcome with the breaker. A publish canceled by Close is
+// abandoned rather than failed: the sink did nothing wrong.
+func (q *queue) send(batch []event.Event) error {
+	start := time.Now()
+	err := q.sink.Publish(q.ctx, batch)
+	observeFlush(q.sink.Name(), len(batch), time.Since(start))
+	if ingestmetrics.CountCanceled(q.ctx, "sink", err) {
+		q.breaker.Abandon()
+	} else {
+		q.breaker.Done(err)
+	}
+	return err
+}
+
+// observeFlush records the publishing of a batch of n events that took d.
+func observeFlush(sink string, n int, d time.Duration) {
+	publishDuration.WithLabelValues(sink).Observe(d.Seconds())
+	ingestmetrics.FlushDuration.WithLabelValues(sink).Observe(d.Seconds())
+	ingestmetrics.FlushSize.WithLabelValues(sink).Observe(float64(n))
+}
+
+func orDefault(v, def int) int {
+	if v > 0 {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,162 @@
+package sink
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/breaker"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+var (
+	failoverTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "sink_failover_events_total", Help: "Events a fallback took while their sink's circuit breaker was open"},
+		[]string{"sink", "fallback"},
+	)
+	redriveTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "sink_redrive_events_total", Help: "Events taken by a fallback and then re-driven to their recovered sink (redriven), or dropped from a full backlog (dropped)"},
+		[]string{"sink", "result"},
+	)
+	redriveBacklog = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "sink_redrive_backlog", Help: "Events taken by a fallback still to be re-driven to their sink"},
+		[]string{"sink"},
+	)
+)
+
+// backlog holds what a sink's fallback took, for re-driving once the sink
+// recovers: the events themselves with the in-memory queues, which keep at
+// most max of them, or the IDs of the deliveries left pending with the
+// outbox.
+type backlog struct {
+	sink   string
+	max    int
+	mu     sync.Mutex
+	events []event.Event
+	ids    map[int64]struct{}
+}
+
+func newBacklog(sink string, max int) *backlog {
+	redriveBacklog.WithLabelValues(sink).Set(0)
+	return &backlog{sink: sink, max: max, ids: map[int64]struct{}{}}
+}
+
+// push keeps batch, dropping what does not fit.
+func (b *backlog) push(batch []event.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := min(len(batch), b.max-len(b.events))
+	b.events = append(b.events, batch[:n]...)
+	if n < len(batch) {
+		redriveTotal.WithLabelValues(b.sink, "dropped").Add(float64(len(batch) - n))
+	}
+	b.measure()
+}
+
+// take removes and returns up to n of the oldest events.
+func (b *backlog) take(n int) []event.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n = min(n, len(b.events))
+	out := slices.Clone(b.events[:n])
+	b.events = b.events[n:]
+	b.measure()
+	return out
+}
+
+// putBack returns a batch take removed that could not be re-driven.
+func (b *backlog) putBack(batch []event.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(batch, b.events...)
+	b.measure()
+}
+
+// remember records the IDs of outbox deliveries the fallback took.
+func (b *backlog) remember(ds []storage.Delivery) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, d := range ds {
+		b.ids[d.Event.ID] = struct{}{}
+	}
+	b.measure()
+}
+
+// taken reports whether the fallback already took the delivery of id.
+func (b *backlog) taken(id int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.ids[id]
+	return ok
+}
+
+// forget drops the IDs of outbox deliveries that are done with, returning
+// how many of them the fallback had taken.
+func (b *backlog) forget(ids []int64) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, id := range ids {
+		if _, ok := b.ids[id]; ok {
+			delete(b.ids, id)
+			n++
+		}
+	}
+	b.measure()
+	return n
+}
+
+// measure updates the backlog gauge. The caller holds b.mu.
+func (b *backlog) measure() {
+	redriveBacklog.WithLabelValues(b.sink).Set(float64(len(b.events) + len(b.ids)))
+}
+
+// failover publishes batch to q's fallback, and reports whether the
+// fallback took it. With keep, a batch taken is kept in the backlog of a
+// sink that redrives.
+func (q *queue) failover(batch []event.Event, keep bool) bool {
+	name, fallback := q.sink.Name(), q.fallback.sink.Name()
+	err := q.fallback.breaker.Allow()
+	if err == nil {
+		err = q.fallback.send(batch)
+	}
+	if err != nil {
+		eventsTotal.WithLabelValues(fallback, "failed").Add(float64(len(batch)))
+		log.Error().Err(err).Str("sink", name).Str("fallback", fallback).Int("events", len(batch)).Msg("sink failover failed")
+		return false
+	}
+	eventsTotal.WithLabelValues(fallback, "delivered").Add(float64(len(batch)))
+	failoverTotal.WithLabelValues(name, fallback).Add(float64(len(batch)))
+	if keep && q.backlog != nil {
+		q.backlog.push(batch)
+	}
+	return true
+}
+
+// redriveSome publishes a batch of the in-memory backlog to q, unless its
+// breaker is still open, putting it back when q fails it.
+func (q *queue) redriveSome() {
+	if q.backlog == nil || q.breaker.State() == breaker.Open {
+		return
+	}
+	batch := q.backlog.take(q.batchSize)
+	if len(batch) == 0 {
+		return
+	}
+	if q.breaker.Allow() != nil {
+		q.backlog.putBack(batch)
+		return
+	}
+	name := q.sink.Name()
+	if err := q.send(batch); err != nil {
+		q.backlog.putBack(batch)
+		eventsTotal.WithLabelValues(name, "failed").Add(float64(len(batch)))
+		log.Error().Err(err).Str("sink", name).Int("events", len(batch)).Msg("sink redrive failed")
+		return
+	}
+	eventsTotal.WithLabelValues(name, "delivered").Add(float64(len(batch)))
+	redriveTotal.WithLabelValues(name, "redriven").Add(float64(len(batch)))
+}
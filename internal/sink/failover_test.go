@@ -0,0 +1,170 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+// failoverSinks configures sink hook to primary, falling over to sink spare
+// at fallback once one failure opened its breaker.
+func failoverSinks(primary, fallback string, redrive bool) ([]config.SinkConfig, config.BreakerConfig) {
+	return []config.SinkConfig{
+		{Name: "hook", Kind: "webhook", URL: primary, BatchSize: 2, FlushInterval: 10 * time.Millisecond, Fallback: "spare", Redrive: redrive},
+		{Name: "spare", Kind: "webhook", URL: fallback},
+	}, config.BreakerConfig{FailureThreshold: 1, OpenTimeout: 100 * time.Millisecond}
+}
+
+func sorted(ids []int64) []int64 {
+	slices.Sort(ids)
+	return ids
+}
+
+// TestFailover publishes the batches of a sink whose breaker is open to its
+// fallback and, when the sink redrives, to the sink as well once it
+// recovers.
+func TestFailover(t *testing.T) {
+	for _, redrive := range []bool{false, true} {
+		primary, primarySrv := newReceiver(t)
+		spare, spareSrv := newReceiver(t)
+		primary.failing.Store(true)
+		sinks, breakers := failoverSinks(primarySrv.URL, spareSrv.URL, redrive)
+		d, err := NewDispatcher(sinks, config.RoutingConfig{}, nil, breakers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []int64
+		for i := range 4 {
+			want = append(want, int64(i+1))
+			d.Publish(event.Event{ID: int64(i + 1), Type: "order.created", Payload: json.RawMessage(`{}`)})
+		}
+
+		if !eventually(2*time.Second, func() bool { return slices.Equal(sorted(spare.received()), want) }) {
+			t.Fatalf("redrive %v: fallback received %v", redrive, spare.received())
+		}
+		primary.failing.Store(false)
+		time.Sleep(200 * time.Millisecond)
+		d.Close(context.Background())
+		got := primary.received()
+		if redrive && !slices.Equal(sorted(got), want) {
+			t.Errorf("redriven %v, want %v", got, want)
+		}
+		if !redrive && len(got) != 0 {
+			t.Errorf("sent %v to the sink without redrive", got)
+		}
+	}
+}
+
+// TestFailoverUnavailable drops the batch when the fallback fails too.
+func TestFailoverUnavailable(t *testing.T) {
+	primary, primarySrv := newReceiver(t)
+	spare, spareSrv := newReceiver(t)
+	primary.failing.Store(true)
+	spare.failing.Store(true)
+	sinks, breakers := failoverSinks(primarySrv.URL, spareSrv.URL, true)
+	d, err := NewDispatcher(sinks, config.RoutingConfig{}, nil, breakers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Publish(event.Event{ID: 1, Type: "order.created", Payload: json.RawMessage(`{}`)})
+	time.Sleep(50 * time.Millisecond)
+	primary.failing.Store(false)
+	spare.failing.Store(false)
+	time.Sleep(200 * time.Millisecond)
+	d.Close(context.Background())
+	if got := append(primary.received(), spare.received()...); len(got) != 0 {
+		t.Errorf("dropped batch delivered: %v", got)
+	}
+}
+
+// TestBacklog keeps at most max events, oldest first, and puts a batch
+// back in front.
+func TestBacklog(t *testing.T) {
+	b := newBacklog("hook", 3)
+	batch := func(ids ...int64) []event.Event {
+		var out []event.Event
+		for _, id := range ids {
+			out = append(out, event.Event{ID: id})
+		}
+		return out
+	}
+	ids := func(events []event.Event) string {
+		var out []int64
+		for _, e := range events {
+			out = append(out, e.ID)
+		}
+		return fmt.Sprint(out)
+	}
+	b.push(batch(1, 2))
+	b.push(batch(3, 4))
+	taken := b.take(2)
+	if got := ids(taken); got != "[1 2]" {
+		t.Errorf("took %s", got)
+	}
+	b.putBack(taken)
+	if got := ids(b.take(10)); got != "[1 2 3]" {
+		t.Errorf("backlog %s", got)
+	}
+
+	b.remember([]storage.Delivery{{Event: event.Event{ID: 7}}, {Event: event.Event{ID: 8}}})
+	if !b.taken(7) || b.taken(9) {
+		t.Error("taken deliveries not remembered")
+	}
+	if n := b.forget([]int64{7, 9}); n != 1 || b.taken(7) || !b.taken(8) {
+		t.Errorf("forgot %d", n)
+	}
+}
+
+// TestOutboxFailover acknowledges the deliveries the fallback took or,
+// when the sink redrives, leaves them pending for the sink once it
+// recovers, publishing each to the fallback once.
+func TestOutboxFailover(t *testing.T) {
+	for _, redrive := range []bool{false, true} {
+		primary, primarySrv := newReceiver(t)
+		spare, spareSrv := newReceiver(t)
+		primary.failing.Store(true)
+		sinks, breakers := failoverSinks(primarySrv.URL, spareSrv.URL, redrive)
+		d, err := NewDispatcher(sinks, config.RoutingConfig{}, nil, breakers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := storage.NewMemory(1)
+		d.StartOutbox(s, config.OutboxConfig{PollInterval: 10 * time.Millisecond, MinBackoff: 5 * time.Millisecond, MaxBackoff: 5 * time.Millisecond}, func() bool { return true })
+		if got := d.Targets(&event.Event{Type: "x"}); !slices.Equal(got, []string{"hook"}) {
+			t.Fatalf("targets %v", got)
+		}
+		want := ingest(t, d, s, 3)
+
+		if !eventually(2*time.Second, func() bool { return slices.Equal(sorted(spare.received()), want) }) {
+			t.Fatalf("redrive %v: fallback received %v", redrive, spare.received())
+		}
+		if !redrive {
+			if !eventually(2*time.Second, func() bool { return depth(t, s).Pending == 0 }) {
+				t.Errorf("taken deliveries pending: %+v", depth(t, s))
+			}
+			d.Close(context.Background())
+			continue
+		}
+		if c := depth(t, s); c.Pending != 3 {
+			t.Errorf("depth %+v before recovery", c)
+		}
+		primary.failing.Store(false)
+		if !eventually(2*time.Second, func() bool { return depth(t, s).Pending == 0 }) {
+			t.Fatalf("still pending: %+v", depth(t, s))
+		}
+		if got := sorted(primary.received()); !slices.Equal(got, want) {
+			t.Errorf("redriven %v, want %v", got, want)
+		}
+		if got := sorted(spare.received()); !slices.Equal(got, want) {
+			t.Errorf("fallback received %v, want each of %v once", got, want)
+		}
+		d.Close(context.Background())
+	}
+}
@@ -0,0 +1,47 @@
+package sink
+
+import (
+	"context"
+	"io"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/chaos"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// faults, when chaos mode is on, slow down and fail the sinks' publishes.
+var faults *chaos.Controller
+
+// InjectFaults makes the sinks inject the faults of c. It must be called
+// before the dispatcher is created.
+func InjectFaults(c *chaos.Controller) { faults = c }
+
+// faulty injects the faults of target sink:<name> into a sink's publishes.
+// On a partial failure it publishes the first half of the batch before
+// failing, so the whole batch is retried and the half delivered twice.
+type faulty struct {
+	Sink
+	c *chaos.Controller
+}
+
+func (f faulty) Publish(ctx context.Context, events []event.Event) error {
+	partial, err := f.c.Inject(chaos.SinkTarget(f.Name()), "publish")
+	if err != nil {
+		return err
+	}
+	if partial == nil {
+		return f.Sink.Publish(ctx, events)
+	}
+	if half := events[:len(events)/2]; len(half) > 0 {
+		if err := f.Sink.Publish(ctx, half); err != nil {
+			return err
+		}
+	}
+	return partial
+}
+
+func (f faulty) Close() error {
+	if c, ok := f.Sink.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
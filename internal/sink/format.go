@@ -0,0 +1,157 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+var formatErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "sink_format_errors_total", Help: "Events left out of a sink's output because they could not be formatted"},
+	[]string{"sink"},
+)
+
+// Formatter turns an event into the JSON-encodable record a sink emits.
+type Formatter func(e event.Event) (any, error)
+
+func NewFormatter(cfg config.SinkConfig) (Formatter, error) {
+	switch cfg.Format {
+	case "", "json":
+		return func(e event.Event) (any, error) { return e, nil }, nil
+	case "debezium":
+		return debeziumFormatter(cfg.Debezium), nil
+	case "template":
+		return templateFormatter(cfg)
+	default:
+		return nil, fmt.Errorf("sink %s: unknown format %q", cfg.Name, cfg.Format)
+	}
+}
+
+// debeziumEnvelope mirrors the value of a Debezium change event as produced by
+// the JSON converter with schemas disabled. Every ingested event is an insert.
+type debeziumEnvelope struct {
+	Before      *event.Event   `json:"before"`
+	After       event.Event    `json:"after"`
+	Source      debeziumSource `json:"source"`
+	Op          string         `json:"op"`
+	TsMs        int64          `json:"ts_ms"`
+	Transaction any            `json:"transaction"`
+}
+
+type debeziumSource struct {
+	Version   string `json:"version"`
+	Connector string `json:"connector"`
+	Name      string `json:"name"`
+	TsMs      int64  `json:"ts_ms"`
+	Snapshot  string `json:"snapshot"`
+	DB        string `json:"db"`
+	Table     string `json:"table"`
+}
+
+func debeziumFormatter(cfg config.DebeziumConfig) Formatter {
+	name := cfg.ServerName
+	if name == "" {
+		name = "go-ingest-service"
+	}
+	db := cfg.Database
+	if db == "" {
+		db = "ingest"
+	}
+	table := cfg.Table
+	if table == "" {
+		table = "events"
+	}
+	return func(e event.Event) (any, error) {
+		return debeziumEnvelope{
+			After: e,
+			Source: debeziumSource{
+				Version:   "1.0",
+				Connector: "go-ingest-service",
+				Name:      name,
+				TsMs:      e.ReceivedAt.UnixMilli(),
+				Snapshot:  "false",
+				DB:        db,
+				Table:     table,
+			},
+			Op:   "c",
+			TsMs: time.Now().UnixMilli(),
+		}, nil
+	}
+}
+
+// templateData is what sink templates see: the event with its payload
+// decoded, so {{.Payload.user_id}} reaches a field.
+type templateData struct {
+	ID         int64
+	Type       string
+	Payload    any
+	Tags       []string
+	Metadata   map[string]string
+	DeliverAt  *time.Time
+	ReceivedAt time.Time
+	Sink       string
+}
+
+var templateFuncs = template.FuncMap{
+	// json renders a value as JSON, e.g. to embed a string safely
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// templateFormatter renders cfg.Template, which must produce a JSON
+// document, once per event.
+func templateFormatter(cfg config.SinkConfig) (Formatter, error) {
+	tmpl, err := template.New(cfg.Name).Funcs(templateFuncs).Parse(cfg.Template)
+	if err != nil {
+		return nil, fmt.Errorf("sink %s: template: %w", cfg.Name, err)
+	}
+	return func(e event.Event) (any, error) {
+		data := templateData{
+			ID: e.ID, Type: e.Type, Tags: e.Tags, Metadata: e.Metadata,
+			DeliverAt: e.DeliverAt, ReceivedAt: e.ReceivedAt, Sink: cfg.Name,
+		}
+		if len(e.Payload) > 0 {
+			if err := json.Unmarshal(e.Payload, &data.Payload); err != nil {
+				return nil, fmt.Errorf("payload: %w", err)
+			}
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		if !json.Valid(buf.Bytes()) {
+			return nil, fmt.Errorf("template output is not valid JSON: %.200s", buf.String())
+		}
+		return json.RawMessage(buf.Bytes()), nil
+	}, nil
+}
+
+// formatAll formats events for the named sink, leaving out (and logging)
+// those that fail.
+func formatAll(name string, format Formatter, events []event.Event) []any {
+	records := make([]any, 0, len(events))
+	for _, e := range events {
+		rec, err := format(e)
+		if err != nil {
+			formatErrors.WithLabelValues(name).Inc()
+			log.Error().Err(err).Str("sink", name).Int64("id", e.ID).Msg("format event")
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records
+}
@@ -0,0 +1,275 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/breaker"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/ingestmetrics"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+var outboxDeliveries = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{Name: "sink_outbox_deliveries", Help: "Deliveries left in the outbox by state (pending, dead)"},
+	[]string{"sink", "state"},
+)
+
+// outbox delivers the events stored with a pending delivery, one worker per
+// sink, instead of the in-memory queues. A delivery is deleted only once the
+// sink accepted it, so a crash before that delivers it again after the
+// restart.
+type outbox struct {
+	store       storage.Store
+	poll        time.Duration
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	maxAttempts int
+	// leading reports whether this instance delivers; with several
+	// sharing the store only the leader does.
+	leading func() bool
+}
+
+func newOutbox(store storage.Store, cfg config.OutboxConfig, leading func() bool) *outbox {
+	o := &outbox{
+		store:       store,
+		leading:     leading,
+		poll:        cfg.PollInterval,
+		minBackoff:  cfg.MinBackoff,
+		maxBackoff:  cfg.MaxBackoff,
+		maxAttempts: cfg.MaxAttempts,
+	}
+	if o.poll <= 0 {
+		o.poll = time.Second
+	}
+	if o.minBackoff <= 0 {
+		o.minBackoff = time.Second
+	}
+	if o.maxBackoff <= 0 {
+		o.maxBackoff = 5 * time.Minute
+	}
+	o.maxBackoff = max(o.maxBackoff, o.minBackoff)
+	return o
+}
+
+// run delivers q's due deliveries whenever it is woken or polls, until q is
+// stopped.
+func (o *outbox) run(q *queue) {
+	ticker := time.NewTicker(o.poll)
+	defer ticker.Stop()
+	for {
+		if o.leading() {
+			o.drain(q)
+		}
+		select {
+		case <-q.stop:
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// drain publishes due deliveries in batches until none is left or a batch
+// fails, which pushes its deliveries back. An ordered sink fetches a batch
+// for each lane at once, leaving out the keys held back by a failed
+// delivery, and goes on while any lane delivers.
+func (o *outbox) drain(q *queue) {
+	name := q.sink.Name()
+	for {
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+		now := time.Now()
+		ds, err := o.store.Deliveries(q.ctx, name, now, q.batchSize*len(q.lanes), q.ordered)
+		if err != nil {
+			log.Error().Err(err).Str("sink", name).Msg("read outbox")
+			return
+		}
+		if len(ds) == 0 {
+			return
+		}
+		var open *breaker.OpenError
+		if errors.As(q.breaker.Allow(), &open) {
+			// leave the deliveries pending without spending an attempt,
+			// unless a fallback takes them
+			if q.fallback != nil && o.failover(q, ds, now.Add(open.RetryAfter)) {
+				continue
+			}
+			return
+		}
+		if !q.ordered {
+			if !o.deliver(q, ds, now) {
+				return
+			}
+			continue
+		}
+		lanes := make([][]storage.Delivery, len(q.lanes))
+		for _, d := range ds {
+			i := laneOf(&d.Event, len(lanes))
+			lanes[i] = append(lanes[i], d)
+		}
+		var wg sync.WaitGroup
+		var delivered atomic.Bool
+		for _, lane := range lanes {
+			if len(lane) == 0 {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// the lane's batches go in order; after a failed one the
+				// rest stays pending for the next round, where its keys
+				// are held back
+				for len(lane) > 0 {
+					n := min(q.batchSize, len(lane))
+					if !o.deliver(q, lane[:n], now) {
+						return
+					}
+					delivered.Store(true)
+					lane = lane[n:]
+				}
+			}()
+		}
+		wg.Wait()
+		if !delivered.Load() {
+			return
+		}
+	}
+}
+
+// deliver publishes ds as one batch, acknowledging the deliveries or
+// pushing them back, and reports whether they were acknowledged.
+func (o *outbox) deliver(q *queue, ds []storage.Delivery, now time.Time) bool {
+	name := q.sink.Name()
+	batch := make([]event.Event, len(ds))
+	ids := make([]int64, len(ds))
+	for i, d := range ds {
+		batch[i], ids[i] = d.Event, d.Event.ID
+	}
+	err := q.send(batch)
+	if err == nil {
+		eventsTotal.WithLabelValues(name, "delivered").Add(float64(len(batch)))
+		// what was published is recorded even while the dispatcher stops
+		if err := o.store.AckDeliveries(context.WithoutCancel(q.ctx), name, ids...); err != nil {
+			// the batch will be delivered again
+			log.Error().Err(err).Str("sink", name).Msg("acknowledge outbox deliveries")
+			return false
+		}
+		if q.backlog != nil {
+			if n := q.backlog.forget(ids); n > 0 {
+				redriveTotal.WithLabelValues(name, "redriven").Add(float64(n))
+			}
+		}
+		return true
+	}
+	if q.ctx.Err() != nil {
+		// stopped mid-publish: the deliveries stay pending as they were
+		return false
+	}
+	eventsTotal.WithLabelValues(name, "failed").Add(float64(len(batch)))
+	log.Error().Err(err).Str("sink", name).Int("events", len(batch)).Msg("sink publish failed")
+	for i := range ds {
+		d := &ds[i]
+		d.Attempts++
+		d.LastError = err.Error()
+		d.NextAttempt = now.Add(o.backoff(d.Attempts))
+		if o.maxAttempts > 0 && d.Attempts >= o.maxAttempts {
+			d.Dead = true
+			eventsTotal.WithLabelValues(name, "dead").Inc()
+			if q.backlog != nil {
+				q.backlog.forget([]int64{d.Event.ID})
+			}
+		}
+	}
+	if err := o.store.RetryDeliveries(context.WithoutCancel(q.ctx), ds); err != nil {
+		log.Error().Err(err).Str("sink", name).Msg("reschedule outbox deliveries")
+	}
+	return false
+}
+
+// failover publishes the deliveries of q, whose breaker is open, to its
+// fallback in batches, and reports whether it took them all. They are
+// acknowledged, or, when q redrives, left pending until the breaker lets a
+// probe through at retry, without spending an attempt. A delivery the
+// fallback took before is not published to it again.
+func (o *outbox) failover(q *queue, ds []storage.Delivery, retry time.Time) bool {
+	name := q.sink.Name()
+	for len(ds) > 0 {
+		chunk := ds[:min(q.batchSize, len(ds))]
+		ds = ds[len(chunk):]
+		var batch []event.Event
+		for _, d := range chunk {
+			if q.backlog == nil || !q.backlog.taken(d.Event.ID) {
+				batch = append(batch, d.Event)
+			}
+		}
+		if len(batch) > 0 && !q.failover(batch, false) {
+			return false
+		}
+		if q.backlog == nil {
+			ids := make([]int64, len(chunk))
+			for i, d := range chunk {
+				ids[i] = d.Event.ID
+			}
+			if err := o.store.AckDeliveries(context.WithoutCancel(q.ctx), name, ids...); err != nil {
+				log.Error().Err(err).Str("sink", name).Msg("acknowledge outbox deliveries")
+				return false
+			}
+			continue
+		}
+		q.backlog.remember(chunk)
+		for i := range chunk {
+			chunk[i].NextAttempt = retry
+		}
+		if err := o.store.RetryDeliveries(context.WithoutCancel(q.ctx), chunk); err != nil {
+			log.Error().Err(err).Str("sink", name).Msg("reschedule outbox deliveries")
+			return false
+		}
+	}
+	return true
+}
+
+// backoff doubles from minBackoff with each failed attempt, up to maxBackoff.
+func (o *outbox) backoff(attempts int) time.Duration {
+	d := o.minBackoff
+	for i := 1; i < attempts && d < o.maxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, o.maxBackoff)
+}
+
+// measure updates the outbox gauges every poll interval until done closes.
+func (o *outbox) measure(done <-chan struct{}) {
+	ticker := time.NewTicker(o.poll)
+	defer ticker.Stop()
+	for {
+		counts, err := o.store.OutboxDepth(context.Background())
+		if err != nil {
+			log.Error().Err(err).Msg("count outbox deliveries")
+		}
+		outboxDeliveries.Reset()
+		ingestmetrics.OutboxBacklog.Reset()
+		ingestmetrics.DLQSize.Reset()
+		for sink, c := range counts {
+			outboxDeliveries.WithLabelValues(sink, "pending").Set(float64(c.Pending))
+			outboxDeliveries.WithLabelValues(sink, "dead").Set(float64(c.Dead))
+			ingestmetrics.OutboxBacklog.WithLabelValues(sink).Set(float64(c.Pending))
+			ingestmetrics.DLQSize.WithLabelValues(sink).Set(float64(c.Dead))
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+// receiver is a webhook endpoint recording the ids it accepted; it answers
+// 500 while failing is set.
+type receiver struct {
+	mu      sync.Mutex
+	ids     []int64
+	failing atomic.Bool
+}
+
+func newReceiver(t *testing.T) (*receiver, *httptest.Server) {
+	rc := &receiver{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rc.failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var batch []struct {
+			ID int64 `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rc.mu.Lock()
+		for _, e := range batch {
+			rc.ids = append(rc.ids, e.ID)
+		}
+		rc.mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	return rc, srv
+}
+
+func (rc *receiver) received() []int64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return slices.Clone(rc.ids)
+}
+
+// outboxSetup starts a dispatcher with one webhook sink to url delivering
+// from the outbox of a memory store while leading reports true.
+func outboxSetup(t *testing.T, url string, cfg config.OutboxConfig, leading func() bool) (*Dispatcher, storage.Store) {
+	t.Helper()
+	d, err := NewDispatcher([]config.SinkConfig{{Name: "hook", Kind: "webhook", URL: url, BatchSize: 2}}, config.RoutingConfig{}, nil, config.BreakerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewMemory(1)
+	d.StartOutbox(store, cfg, leading)
+	t.Cleanup(func() { d.Close(context.Background()) })
+	return d, store
+}
+
+// ingest adds n events with their deliveries, as the ingest handler does,
+// and wakes the workers.
+func ingest(t *testing.T, d *Dispatcher, s storage.Store, n int) []int64 {
+	t.Helper()
+	var ids []int64
+	for range n {
+		e := event.Event{Type: "order.created", Payload: json.RawMessage(`{}`)}
+		e, err := s.Add(context.Background(), e, d.Targets(&e)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, e.ID)
+		d.Publish(e)
+	}
+	return ids
+}
+
+func eventually(d time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(d)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func depth(t *testing.T, s storage.Store) storage.OutboxCount {
+	t.Helper()
+	counts, err := s.OutboxDepth(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return counts["hook"]
+}
+
+// TestOutboxDelivery delivers every stored event and deletes its delivery,
+// keeping the deliveries of a failing sink pending with the attempt and
+// error recorded until it accepts them.
+func TestOutboxDelivery(t *testing.T) {
+	rc, srv := newReceiver(t)
+	rc.failing.Store(true)
+	d, s := outboxSetup(t, srv.URL, config.OutboxConfig{PollInterval: 10 * time.Millisecond, MinBackoff: 20 * time.Millisecond, MaxBackoff: 20 * time.Millisecond}, func() bool { return true })
+	want := ingest(t, d, s, 5)
+	if got := d.Targets(&event.Event{Type: "x"}); !slices.Equal(got, []string{"hook"}) {
+		t.Fatalf("targets %v", got)
+	}
+
+	var pending []storage.Delivery
+	if !eventually(2*time.Second, func() bool {
+		pending, _ = s.Deliveries(context.Background(), "hook", time.Now().Add(time.Hour), 10, false)
+		return len(pending) == 5 && !slices.ContainsFunc(pending, func(d storage.Delivery) bool { return d.Attempts == 0 })
+	}) {
+		t.Fatalf("no failed attempt recorded: %+v", pending)
+	}
+	if pending[0].LastError == "" {
+		t.Error("failed attempt without error")
+	}
+	if got := rc.received(); len(got) != 0 {
+		t.Fatalf("received %v while failing", got)
+	}
+
+	rc.failing.Store(false)
+	if !eventually(2*time.Second, func() bool { return depth(t, s).Pending == 0 }) {
+		t.Fatalf("still pending: %+v", depth(t, s))
+	}
+	got := rc.received()
+	slices.Sort(got)
+	if !slices.Equal(slices.Compact(got), want) {
+		t.Errorf("received %v, want %v", got, want)
+	}
+}
+
+// TestOutboxDeadLetter marks deliveries dead after MaxAttempts failures and
+// stops retrying them.
+func TestOutboxDeadLetter(t *testing.T) {
+	rc, srv := newReceiver(t)
+	rc.failing.Store(true)
+	d, s := outboxSetup(t, srv.URL, config.OutboxConfig{PollInterval: 10 * time.Millisecond, MinBackoff: 5 * time.Millisecond, MaxBackoff: 5 * time.Millisecond, MaxAttempts: 3}, func() bool { return true })
+	ingest(t, d, s, 3)
+
+	if !eventually(2*time.Second, func() bool { return depth(t, s).Dead == 3 }) {
+		t.Fatalf("depth %+v", depth(t, s))
+	}
+	dead, err := s.DeadDeliveries(context.Background(), "hook", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dl := range dead {
+		if dl.Attempts != 3 || dl.LastError == "" {
+			t.Errorf("dead delivery %d: %d attempts, error %q", dl.Event.ID, dl.Attempts, dl.LastError)
+		}
+	}
+	rc.failing.Store(false)
+	time.Sleep(50 * time.Millisecond)
+	if got := rc.received(); len(got) != 0 {
+		t.Errorf("dead deliveries retried: %v", got)
+	}
+	if c := depth(t, s); c.Pending != 0 || c.Dead != 3 {
+		t.Errorf("depth %+v", c)
+	}
+}
+
+// TestOutboxFollower leaves the deliveries to the leader: an instance that
+// does not lead delivers nothing until it takes over.
+func TestOutboxFollower(t *testing.T) {
+	rc, srv := newReceiver(t)
+	var leading atomic.Bool
+	d, s := outboxSetup(t, srv.URL, config.OutboxConfig{PollInterval: 10 * time.Millisecond}, leading.Load)
+	want := ingest(t, d, s, 3)
+
+	time.Sleep(50 * time.Millisecond)
+	if got := rc.received(); len(got) != 0 {
+		t.Fatalf("follower delivered %v", got)
+	}
+	if c := depth(t, s); c.Pending != 3 {
+		t.Fatalf("depth %+v", c)
+	}
+	leading.Store(true)
+	if !eventually(2*time.Second, func() bool { return depth(t, s).Pending == 0 }) {
+		t.Fatalf("leader left %+v", depth(t, s))
+	}
+	got := rc.received()
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("received %v, want %v", got, want)
+	}
+}
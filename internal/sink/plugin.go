@@ -0,0 +1,52 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/pluginhost"
+	sdk "github.com/rafaelosorio/go-ingest-service/pkg/plugin"
+)
+
+// plugin hands each batch, as a JSON array of formatted records, to a sink
+// plugin running in its own process.
+type plugin struct {
+	name   string
+	format Formatter
+	proc   *pluginhost.Process
+}
+
+func newPlugin(cfg config.SinkConfig, format Formatter) (*plugin, error) {
+	proc, err := pluginhost.Start("sink/"+cfg.Name, sdk.SinkName, cfg.Plugin)
+	if err != nil {
+		return nil, err
+	}
+	return &plugin{name: cfg.Name, format: format, proc: proc}, nil
+}
+
+func (p *plugin) Name() string { return p.name }
+
+func (p *plugin) Publish(ctx context.Context, events []event.Event) error {
+	records := formatAll(p.name, p.format, events)
+	if len(records) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	c, err := p.proc.Sink()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.proc.Timeout(10*time.Second))
+	defer cancel()
+	err = c.Publish(ctx, body)
+	p.proc.Count(err)
+	return err
+}
+
+func (p *plugin) Close() error { return p.proc.Close() }
@@ -0,0 +1,109 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/resp"
+)
+
+// redisStream XADDs each formatted record to a Redis stream, with the event
+// ID and type as fields beside the record, trimming the stream to about
+// max_len entries. A batch is pipelined on one connection, which is kept
+// between batches and redialed after an error.
+type redisStream struct {
+	name    string
+	opts    resp.Options
+	stream  string
+	maxLen  int64
+	format  Formatter
+	timeout time.Duration
+
+	mu   sync.Mutex
+	conn *resp.Conn
+}
+
+func newRedisStream(cfg config.SinkConfig, format Formatter) (*redisStream, error) {
+	opts, err := resp.ParseURL(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("sink %s: url: %w", cfg.Name, err)
+	}
+	r := &redisStream{
+		name:    cfg.Name,
+		opts:    opts,
+		stream:  cfg.Redis.Stream,
+		maxLen:  cfg.Redis.MaxLen,
+		format:  format,
+		timeout: cfg.Timeout,
+	}
+	if r.stream == "" {
+		r.stream = "ingest:events"
+	}
+	if r.timeout <= 0 {
+		r.timeout = 10 * time.Second
+	}
+	return r, nil
+}
+
+func (r *redisStream) Name() string { return r.name }
+
+func (r *redisStream) Publish(ctx context.Context, events []event.Event) error {
+	cmds := make([][]string, 0, len(events))
+	for _, e := range events {
+		// formatAll would lose which event a record came from
+		rec, err := r.format(e)
+		if err != nil {
+			formatErrors.WithLabelValues(r.name).Inc()
+			log.Error().Err(err).Str("sink", r.name).Int64("id", e.ID).Msg("format event")
+			continue
+		}
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		cmd := []string{"XADD", r.stream}
+		if r.maxLen > 0 {
+			cmd = append(cmd, "MAXLEN", "~", strconv.FormatInt(r.maxLen, 10))
+		}
+		cmds = append(cmds, append(cmd, "*", "id", strconv.FormatInt(e.ID, 10), "type", e.Type, "data", string(data)))
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		conn, err := resp.Dial(ctx, r.opts, r.timeout)
+		if err != nil {
+			return fmt.Errorf("redis sink %s: %w", r.name, err)
+		}
+		r.conn = conn
+	}
+	if _, err := r.conn.Do(ctx, r.timeout, cmds...); err != nil {
+		r.closeLocked()
+		return fmt.Errorf("redis sink %s: %w", r.name, err)
+	}
+	return nil
+}
+
+func (r *redisStream) closeLocked() {
+	if r.conn != nil {
+		_ = r.conn.Close()
+		r.conn = nil
+	}
+}
+
+func (r *redisStream) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeLocked()
+	return nil
+}
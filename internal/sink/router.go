@@ -0,0 +1,98 @@
+package sink
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/expr"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+var routedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "sink_route_events_total", Help: "Events matched per routing rule (\"default\" when none matched)"},
+	[]string{"route"},
+)
+
+// router picks the sink queues of an event from the routing rules. An event
+// goes to the sinks of every matching rule, or to the default route when no
+// rule matches.
+type router struct {
+	routes   []route
+	fallback []*queue
+}
+
+type route struct {
+	name   string
+	query  storage.Query
+	when   *expr.Program
+	queues []*queue
+}
+
+func newRouter(cfg config.RoutingConfig, saved map[string]config.SavedQueryConfig, queues map[string]*queue) (*router, error) {
+	lookup := func(names []string) ([]*queue, error) {
+		out := make([]*queue, 0, len(names))
+		for _, n := range names {
+			q, ok := queues[n]
+			if !ok {
+				return nil, fmt.Errorf("unknown sink %q", n)
+			}
+			out = append(out, q)
+		}
+		return out, nil
+	}
+	r := &router{}
+	var err error
+	if r.fallback, err = lookup(cfg.Default); err != nil {
+		return nil, fmt.Errorf("routing.default: %w", err)
+	}
+	for _, rc := range cfg.Rules {
+		f := rc.Filter
+		if rc.Query != "" {
+			var ok bool
+			if f, ok = saved[rc.Query]; !ok {
+				return nil, fmt.Errorf("route %s: unknown saved query %q", rc.Name, rc.Query)
+			}
+		}
+		rt := route{name: rc.Name, query: storage.Query{Types: f.Types, Tags: f.Tags, Fields: f.Fields}}
+		if err := rt.query.Validate(); err != nil {
+			return nil, fmt.Errorf("route %s: %w", rc.Name, err)
+		}
+		if rt.queues, err = lookup(rc.Sinks); err != nil {
+			return nil, fmt.Errorf("route %s: %w", rc.Name, err)
+		}
+		if rc.When != "" {
+			if rt.when, err = expr.Compile("route:"+rc.Name, rc.When); err != nil {
+				return nil, fmt.Errorf("route %s: when: %w", rc.Name, err)
+			}
+		}
+		rt.query = rt.query.Compile()
+		r.routes = append(r.routes, rt)
+	}
+	return r, nil
+}
+
+// targets returns the queues for e, each at most once.
+func (r *router) targets(e *event.Event) []*queue {
+	var out []*queue
+	env := expr.NewEnv(e)
+	for _, rt := range r.routes {
+		if !rt.query.Match(e) || !rt.when.Match(env) {
+			continue
+		}
+		routedTotal.WithLabelValues(rt.name).Inc()
+		for _, q := range rt.queues {
+			if !slices.Contains(out, q) {
+				out = append(out, q)
+			}
+		}
+	}
+	if out == nil {
+		routedTotal.WithLabelValues("default").Inc()
+		return r.fallback
+	}
+	return out
+}
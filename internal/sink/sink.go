@@ -0,0 +1,41 @@
+// Package sink delivers accepted events to downstream systems.
+package sink
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// Sink publishes a batch of events to one downstream destination.
+type Sink interface {
+	Name() string
+	// Publish gives up with ctx's error once ctx ends.
+	Publish(ctx context.Context, events []event.Event) error
+}
+
+// New builds the sink described by cfg.
+func New(cfg config.SinkConfig) (Sink, error) {
+	format, err := NewFormatter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.Kind {
+	case "webhook":
+		return newWebhook(cfg, format)
+	case "stdout":
+		return newStdout(cfg, format), nil
+	case "plugin":
+		return newPlugin(cfg, format)
+	case "redis":
+		return newRedisStream(cfg, format)
+	case "upstream":
+		return newUpstream(cfg)
+	case "amqp":
+		return newAMQPExchange(cfg, format)
+	default:
+		return nil, fmt.Errorf("sink %s: unknown kind %q", cfg.Name, cfg.Kind)
+	}
+}
@@ -0,0 +1,166 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// TestFormat renders an event as itself, as a Debezium insert and through
+// a template, and refuses a template that does not produce JSON.
+func TestFormat(t *testing.T) {
+	received := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	e := event.Event{ID: 7, Type: "order.created", Payload: json.RawMessage(`{"user":"u1","total":12.5}`), ReceivedAt: received}
+	render := func(cfg config.SinkConfig) string {
+		t.Helper()
+		f, err := NewFormatter(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := f(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	var plain event.Event
+	if err := json.Unmarshal([]byte(render(config.SinkConfig{Name: "s"})), &plain); err != nil || plain.ID != 7 || plain.Type != e.Type {
+		t.Errorf("json: %+v, %v", plain, err)
+	}
+
+	var env struct {
+		Before *event.Event `json:"before"`
+		After  event.Event  `json:"after"`
+		Op     string       `json:"op"`
+		Source struct {
+			Name  string `json:"name"`
+			DB    string `json:"db"`
+			Table string `json:"table"`
+			TsMs  int64  `json:"ts_ms"`
+		} `json:"source"`
+	}
+	if err := json.Unmarshal([]byte(render(config.SinkConfig{Name: "s", Format: "debezium", Debezium: config.DebeziumConfig{Table: "orders"}})), &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.Before != nil || env.Op != "c" || env.After.ID != 7 || env.Source.Name != "go-ingest-service" || env.Source.DB != "ingest" || env.Source.Table != "orders" || env.Source.TsMs != received.UnixMilli() {
+		t.Errorf("debezium: %+v", env)
+	}
+
+	tmpl := config.SinkConfig{Name: "chat", Format: "template", Template: `{"text":{{json (printf "%s by %s" (upper .Type) .Payload.user)}},"sink":"{{.Sink}}"}`}
+	if got, want := render(tmpl), `{"text":"ORDER.CREATED by u1","sink":"chat"}`; got != want {
+		t.Errorf("template: %s, want %s", got, want)
+	}
+	broken, err := NewFormatter(config.SinkConfig{Name: "chat", Format: "template", Template: `text: {{.Type}}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broken(e); err == nil {
+		t.Error("template output that is not JSON accepted")
+	}
+	for _, cfg := range []config.SinkConfig{{Name: "s", Format: "avro"}, {Name: "s", Format: "template", Template: "{{.Type"}} {
+		if _, err := NewFormatter(cfg); err == nil {
+			t.Errorf("format %q accepted", cfg.Format)
+		}
+	}
+}
+
+// TestDispatch routes events to the sinks of every rule they match, or to
+// the default sinks, applies each sink's namespaces, and flushes what is
+// queued on Close.
+func TestDispatch(t *testing.T) {
+	orders, ordersSrv := newReceiver(t)
+	audit, auditSrv := newReceiver(t)
+	acme, acmeSrv := newReceiver(t)
+	d, err := NewDispatcher([]config.SinkConfig{
+		{Name: "orders", Kind: "webhook", URL: ordersSrv.URL, FlushInterval: time.Hour},
+		{Name: "audit", Kind: "webhook", URL: auditSrv.URL, FlushInterval: time.Hour},
+		{Name: "acme", Kind: "webhook", URL: acmeSrv.URL, FlushInterval: time.Hour, Namespaces: []string{"acme"}},
+	}, config.RoutingConfig{
+		Rules: []config.RouteConfig{
+			{Name: "orders", Filter: config.SavedQueryConfig{Types: []string{"order.*", "acme/order.*"}}, Sinks: []string{"orders", "acme"}},
+			{Name: "refunds", Filter: config.SavedQueryConfig{Types: []string{"order.refunded"}}, Sinks: []string{"orders", "audit"}},
+		},
+		Default: []string{"audit"},
+	}, nil, config.BreakerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, typ := range []string{"order.created", "order.refunded", "login", "acme/order.created"} {
+		d.Publish(event.Event{ID: int64(i + 1), Type: typ, Payload: json.RawMessage(`{}`)})
+	}
+	d.Close(context.Background())
+
+	for name, c := range map[string]struct {
+		rc   *receiver
+		want []int64
+	}{
+		"orders": {orders, []int64{1, 2, 4}},
+		"audit":  {audit, []int64{2, 3}},
+		"acme":   {acme, []int64{4}},
+	} {
+		got := c.rc.received()
+		slices.Sort(got)
+		if !slices.Equal(got, c.want) {
+			t.Errorf("%s received %v, want %v", name, got, c.want)
+		}
+	}
+
+	for name, routing := range map[string]config.RoutingConfig{
+		"unknown sink":  {Rules: []config.RouteConfig{{Name: "r", Sinks: []string{"a"}}}, Default: []string{"nowhere"}},
+		"unknown query": {Rules: []config.RouteConfig{{Name: "r", Query: "missing", Sinks: []string{"a"}}}},
+		"bad when":      {Rules: []config.RouteConfig{{Name: "r", When: "payload.total >", Sinks: []string{"a"}}}},
+	} {
+		if _, err := NewDispatcher([]config.SinkConfig{{Name: "a", Kind: "stdout"}}, routing, nil, config.BreakerConfig{}); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+// TestRouter matches rules by saved query, tags, payload fields and a when
+// expression, and sends an event matching several rules to each sink once.
+func TestRouter(t *testing.T) {
+	queues := map[string]*queue{"big": {}, "eu": {}, "vip": {}, "rest": {}}
+	r, err := newRouter(config.RoutingConfig{
+		Rules: []config.RouteConfig{
+			{Name: "big", Query: "orders", When: "payload.amount > 1000", Sinks: []string{"big", "vip"}},
+			{Name: "eu", Filter: config.SavedQueryConfig{Fields: map[string]string{"region": "eu"}}, Sinks: []string{"eu"}},
+			{Name: "vip", Filter: config.SavedQueryConfig{Tags: []string{"vip"}}, Sinks: []string{"vip"}},
+		},
+		Default: []string{"rest"},
+	}, map[string]config.SavedQueryConfig{"orders": {Types: []string{"order.*"}}}, queues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		typ, payload string
+		tags         []string
+		want         []string
+	}{
+		{"order.paid", `{"amount":5000,"region":"us"}`, []string{"vip"}, []string{"big", "vip"}},
+		{"order.paid", `{"amount":10,"region":"eu"}`, nil, []string{"eu"}},
+		{"invoice.paid", `{"amount":5000}`, nil, []string{"rest"}},
+		{"order.paid", `{"amount":10}`, []string{"vip"}, []string{"vip"}},
+	} {
+		var got []string
+		for _, q := range r.targets(&event.Event{Type: tc.typ, Payload: json.RawMessage(tc.payload), Tags: tc.tags}) {
+			for name, nq := range queues {
+				if q == nq {
+					got = append(got, name)
+				}
+			}
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s %s %v: routed to %v, want %v", tc.typ, tc.payload, tc.tags, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// stdout writes formatted records as NDJSON, mostly useful for local debugging.
+type stdout struct {
+	name   string
+	format Formatter
+	mu     sync.Mutex
+	out    io.Writer
+}
+
+func newStdout(cfg config.SinkConfig, format Formatter) *stdout {
+	return &stdout{name: cfg.Name, format: format, out: os.Stdout}
+}
+
+func (s *stdout) Name() string { return s.name }
+
+func (s *stdout) Publish(_ context.Context, events []event.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	enc := json.NewEncoder(s.out)
+	for _, rec := range formatAll(s.name, s.format, events) {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,459 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+var (
+	spillBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "sink_spill_bytes", Help: "Bytes of batches spilled to disk awaiting the upstream"},
+		[]string{"sink"},
+	)
+	spillBatches = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "sink_spill_batches", Help: "Batches spilled to disk awaiting the upstream"},
+		[]string{"sink"},
+	)
+)
+
+// replayInterval is how often spilled batches are offered to the upstream.
+const replayInterval = 5 * time.Second
+
+// errRejected marks a batch the upstream refused for good (a 4xx other than
+// 408 and 429): retrying or spilling it would not help.
+var errRejected = errors.New("rejected by upstream")
+
+// upstream forwards batches to the POST /v1/events/batch endpoint of another
+// instance of the service, compressed, with an Idempotency-Key per batch so
+// retries are not stored twice. Failed batches are retried with backoff and
+// then, with a spill directory, written to disk and replayed in order once
+// the upstream answers again; while batches are spilled new ones join them,
+// so events keep their order.
+type upstream struct {
+	name     string
+	url      string
+	headers  map[string]string
+	encoding string
+	retries  int
+	reserved []string
+	client   *http.Client
+	zstd     *zstd.Encoder
+
+	// spill is nil without a spill directory.
+	spill *spill
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newUpstream(cfg config.SinkConfig) (*upstream, error) {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	u := &upstream{
+		name:     cfg.Name,
+		url:      strings.TrimRight(cfg.URL, "/") + "/v1/events/batch",
+		headers:  cfg.Headers,
+		encoding: cfg.Upstream.Compression,
+		retries:  cfg.Upstream.Retries,
+		reserved: cfg.Upstream.ReservedTypes,
+		client:   &http.Client{Timeout: timeout},
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if u.encoding == "" {
+		u.encoding = "gzip"
+	}
+	if u.encoding == "zstd" {
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		u.zstd = enc
+	}
+	if cfg.Upstream.SpillDir == "" {
+		close(u.stopped)
+		return u, nil
+	}
+	s, err := openSpill(cfg.Name, cfg.Upstream.SpillDir, cfg.Upstream.MaxSpillBytes)
+	if err != nil {
+		return nil, err
+	}
+	u.spill = s
+	go u.run()
+	return u, nil
+}
+
+func (u *upstream) Name() string { return u.name }
+
+// forwarded is the part of an event the upstream accepts; it assigns its own
+// ID and receive time.
+type forwarded struct {
+	Type          string            `json:"type"`
+	Payload       json.RawMessage   `json:"payload"`
+	Tags          []string          `json:"tags,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	SchemaVersion string            `json:"schema_version,omitempty"`
+	ExpiresAt     *time.Time        `json:"expires_at,omitempty"`
+	OccurredAt    *time.Time        `json:"occurred_at,omitempty"`
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	CausationID   string            `json:"causation_id,omitempty"`
+	PartitionKey  string            `json:"partition_key,omitempty"`
+}
+
+func (u *upstream) Publish(ctx context.Context, events []event.Event) error {
+	out := make([]forwarded, 0, len(events))
+	for _, e := range events {
+		out = append(out, forwarded{e.Type, e.Payload, e.Tags, e.Metadata, e.SchemaVersion, e.ExpiresAt, e.OccurredAt, e.CorrelationID, e.CausationID, e.PartitionKey})
+	}
+	out = u.admissible(out, time.Now())
+	if len(out) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	key := batchKey()
+	if u.spill != nil && u.spill.pending() {
+		return u.spill.write(key, body)
+	}
+	err = u.send(ctx, key, body)
+	if err == nil || errors.Is(err, errRejected) || u.spill == nil {
+		return err
+	}
+	if serr := u.spill.write(key, body); serr != nil {
+		return errors.Join(err, serr)
+	}
+	log.Warn().Err(err).Str("sink", u.name).Int("events", len(events)).Msg("upstream unreachable, batch spilled to disk")
+	return nil
+}
+
+// admissible drops the events the upstream would refuse the whole batch
+// for: expired ones, and those of reserved types, which only the service
+// emits.
+func (u *upstream) admissible(events []forwarded, now time.Time) []forwarded {
+	return slices.DeleteFunc(events, func(f forwarded) bool {
+		return f.ExpiresAt != nil && !f.ExpiresAt.After(now) || event.Reserved(u.reserved, f.Type)
+	})
+}
+
+// send posts body, retrying transport errors and retryable statuses with
+// exponential backoff until ctx ends.
+func (u *upstream) send(ctx context.Context, key string, body []byte) error {
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := u.post(ctx, key, body)
+		if err == nil || errors.Is(err, errRejected) || attempt >= u.retries {
+			return err
+		}
+		select {
+		case <-u.done:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, 10*time.Second)
+	}
+}
+
+func (u *upstream) post(ctx context.Context, key string, body []byte) error {
+	var buf bytes.Buffer
+	switch u.encoding {
+	case "gzip":
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	case "zstd":
+		buf.Write(u.zstd.EncodeAll(body, nil))
+	default:
+		buf.Write(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if u.encoding != "none" {
+		req.Header.Set("Content-Encoding", u.encoding)
+	}
+	req.Header.Set("Idempotency-Key", key)
+	for k, v := range u.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("upstream %s: status %d: %s: %w", u.name, resp.StatusCode, bytes.TrimSpace(msg), errRejected)
+	default:
+		return fmt.Errorf("upstream %s: unexpected status %d", u.name, resp.StatusCode)
+	}
+}
+
+// run replays the spilled batches every replayInterval until Close.
+func (u *upstream) run() {
+	defer close(u.stopped)
+	ticker := time.NewTicker(replayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-ticker.C:
+			u.replay()
+		}
+	}
+}
+
+// replay sends the spilled batches oldest first, stopping at the first one
+// the upstream does not take. Events that expired while spilled are dropped
+// first, keeping the batch's key: if the upstream took the original before
+// it was spilled, it answers the changed body with a conflict and the batch
+// is set aside like a rejected one. Rejected batches are kept aside with
+// the suffix .rejected for inspection.
+func (u *upstream) replay() {
+	for _, name := range u.spill.list() {
+		key, body, err := u.spill.read(name)
+		if err != nil {
+			log.Error().Err(err).Str("sink", u.name).Str("file", name).Msg("read spilled batch")
+			return
+		}
+		var events []forwarded
+		if err := json.Unmarshal(body, &events); err != nil {
+			log.Error().Err(err).Str("sink", u.name).Str("file", name).Msg("decode spilled batch")
+			u.spill.remove(name, true)
+			continue
+		}
+		n := len(events)
+		if events = u.admissible(events, time.Now()); len(events) < n {
+			if len(events) == 0 {
+				u.spill.remove(name, false)
+				continue
+			}
+			if body, err = json.Marshal(events); err != nil {
+				log.Error().Err(err).Str("sink", u.name).Str("file", name).Msg("encode spilled batch")
+				return
+			}
+		}
+		switch err := u.post(context.Background(), key, body); {
+		case err == nil:
+			u.spill.remove(name, false)
+		case errors.Is(err, errRejected):
+			log.Error().Err(err).Str("sink", u.name).Str("file", name).Msg("spilled batch rejected")
+			u.spill.remove(name, true)
+		default:
+			return
+		}
+		select {
+		case <-u.done:
+			return
+		default:
+		}
+	}
+}
+
+// Close stops replaying; spilled batches stay on disk for the next start.
+func (u *upstream) Close() error {
+	select {
+	case <-u.done:
+	default:
+		close(u.done)
+	}
+	<-u.stopped
+	if u.zstd != nil {
+		_ = u.zstd.Close()
+	}
+	return nil
+}
+
+// batchKey returns a random Idempotency-Key for a batch.
+func batchKey() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// spill keeps batches in a directory, one file each, named so that they sort
+// in the order they were written: <unix nanos>-<idempotency key>.json.
+type spill struct {
+	sink     string
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	files map[string]int64
+	bytes int64
+	// rejected counts the batches set aside.
+	rejected int
+	// last is the sequence of the newest file, so names keep sorting in
+	// order when the clock steps back.
+	last int64
+}
+
+func openSpill(sink, dir string, maxBytes int64) (*spill, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("sink %s: spill directory: %w", sink, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("sink %s: spill directory: %w", sink, err)
+	}
+	s := &spill{sink: sink, dir: dir, maxBytes: maxBytes, files: map[string]int64{}}
+	for _, e := range entries {
+		if !e.IsDir() && filepath.Ext(e.Name()) == ".rejected" {
+			s.rejected++
+		}
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.files[e.Name()] = info.Size()
+		s.bytes += info.Size()
+		var seq int64
+		if _, err := fmt.Sscanf(e.Name(), "%d-", &seq); err == nil {
+			s.last = max(s.last, seq)
+		}
+	}
+	s.observe()
+	return s, nil
+}
+
+func (s *spill) pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files) > 0
+}
+
+// write stores body durably under a new name after every spilled batch.
+func (s *spill) write(key string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxBytes > 0 && s.bytes+int64(len(body)) > s.maxBytes {
+		return fmt.Errorf("sink %s: spill directory full (%d bytes)", s.sink, s.bytes)
+	}
+	seq := max(time.Now().UnixNano(), s.last+1)
+	s.last = seq
+	name := fmt.Sprintf("%019d-%s.json", seq, key)
+	tmp := filepath.Join(s.dir, name+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(body); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(s.dir, name))
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("sink %s: spill batch: %w", s.sink, err)
+	}
+	s.files[name] = int64(len(body))
+	s.bytes += int64(len(body))
+	s.observe()
+	return nil
+}
+
+// list returns the spilled batches, oldest first.
+func (s *spill) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (s *spill) read(name string) (key string, body []byte, err error) {
+	body, err = os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return "", nil, err
+	}
+	_, key, _ = strings.Cut(strings.TrimSuffix(name, ".json"), "-")
+	return key, body, nil
+}
+
+// remove forgets a replayed batch, deleting its file or, when rejected,
+// renaming it out of the way.
+func (s *spill) remove(name string, rejected bool) {
+	path := filepath.Join(s.dir, name)
+	var err error
+	if rejected {
+		err = os.Rename(path, path+".rejected")
+	} else {
+		err = os.Remove(path)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Error().Err(err).Str("sink", s.sink).Str("file", name).Msg("remove spilled batch")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rejected {
+		s.rejected++
+	}
+	s.bytes -= s.files[name]
+	delete(s.files, name)
+	s.observe()
+}
+
+// Spill is what the spill directory of an upstream sink holds.
+type Spill struct {
+	// Batches and Bytes wait to be replayed.
+	Batches int   `json:"batches"`
+	Bytes   int64 `json:"bytes"`
+	// Rejected are the batches set aside with the suffix .rejected.
+	Rejected int `json:"rejected"`
+}
+
+func (s *spill) state() Spill {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Spill{Batches: len(s.files), Bytes: s.bytes, Rejected: s.rejected}
+}
+
+// observe updates the spill gauges; s.mu is held.
+func (s *spill) observe() {
+	spillBytes.WithLabelValues(s.sink).Set(float64(s.bytes))
+	spillBatches.WithLabelValues(s.sink).Set(float64(len(s.files)))
+}
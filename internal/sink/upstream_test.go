@@ -0,0 +1,177 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// batchEndpoint stands in for POST /v1/events/batch, answering status while
+// it is set and recording the types of the batches it accepts.
+type batchEndpoint struct {
+	status atomic.Int32
+	mu     sync.Mutex
+	types  [][]string
+	keys   []string
+}
+
+func newBatchEndpoint(t *testing.T) (*batchEndpoint, *httptest.Server) {
+	be := &batchEndpoint{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code := int(be.status.Load()); code != 0 {
+			w.WriteHeader(code)
+			return
+		}
+		var batch []forwarded
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var types []string
+		for _, f := range batch {
+			types = append(types, f.Type)
+		}
+		be.mu.Lock()
+		be.types = append(be.types, types)
+		be.keys = append(be.keys, r.Header.Get("Idempotency-Key"))
+		be.mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	return be, srv
+}
+
+func (be *batchEndpoint) batches() [][]string {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	return slices.Clone(be.types)
+}
+
+func newTestUpstream(t *testing.T, url, dir string) *upstream {
+	t.Helper()
+	u, err := newUpstream(config.SinkConfig{
+		Name: "up",
+		Kind: "upstream",
+		URL:  url,
+		Upstream: config.UpstreamSinkConfig{
+			Compression:   "none",
+			SpillDir:      dir,
+			ReservedTypes: []string{"_system."},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = u.Close() })
+	return u
+}
+
+// TestUpstreamSpill spills batches while the upstream fails, in order,
+// and replays them once it answers, dropping the events that expired in
+// between and those of reserved types.
+func TestUpstreamSpill(t *testing.T) {
+	be, srv := newBatchEndpoint(t)
+	dir := t.TempDir()
+	u := newTestUpstream(t, srv.URL, dir)
+	ctx := context.Background()
+
+	soon := time.Now().Add(150 * time.Millisecond)
+	be.status.Store(http.StatusServiceUnavailable)
+	if err := u.Publish(ctx, []event.Event{{Type: "a"}, {Type: "short", ExpiresAt: &soon}, {Type: "_system.digest"}}); err != nil {
+		t.Fatal(err)
+	}
+	be.status.Store(0)
+	// the upstream answers again, but the spill is not empty: the batch
+	// joins it to keep the order
+	if err := u.Publish(ctx, []event.Event{{Type: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := u.spill.list(); len(got) != 2 {
+		t.Fatalf("spilled %v", got)
+	}
+	if got := be.batches(); len(got) != 0 {
+		t.Fatalf("sent %v while spilling", got)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	u.replay()
+	if got := be.batches(); len(got) != 2 || !slices.Equal(got[0], []string{"a"}) || !slices.Equal(got[1], []string{"b"}) {
+		t.Errorf("replayed %v", got)
+	}
+	if u.spill.pending() {
+		t.Errorf("still spilled: %v", u.spill.list())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("spill directory holds %d files", len(entries))
+	}
+
+	// a batch of nothing but reserved types is not sent at all
+	if err := u.Publish(ctx, []event.Event{{Type: "acme/_system.anomaly"}}); err != nil || len(be.batches()) != 2 {
+		t.Errorf("reserved batch: %v, %v", err, be.batches())
+	}
+}
+
+// TestUpstreamReplayRejected sets a spilled batch the upstream refuses
+// aside with its key kept, drops one whose events all expired, and stops
+// at a batch the upstream cannot take yet.
+func TestUpstreamReplayRejected(t *testing.T) {
+	be, srv := newBatchEndpoint(t)
+	dir := t.TempDir()
+	u := newTestUpstream(t, srv.URL, dir)
+	past := time.Now().Add(-time.Minute)
+	for _, batch := range []string{`[{"type":"gone","expires_at":"` + past.Format(time.RFC3339Nano) + `"}]`, `[{"type":"bad"}]`, `[{"type":"later"}]`} {
+		if err := u.spill.write(batchKey(), []byte(batch)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names := u.spill.list()
+
+	be.status.Store(http.StatusBadRequest)
+	u.replay()
+	// the expired batch is dropped unsent, the next one rejected, and the
+	// third rejected too since the endpoint refuses everything
+	if u.spill.pending() {
+		t.Fatalf("still spilled: %v", u.spill.list())
+	}
+	for _, name := range names[1:] {
+		if _, err := os.Stat(filepath.Join(dir, name+".rejected")); err != nil {
+			t.Errorf("%s not set aside: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, names[0]+".rejected")); err == nil {
+		t.Error("expired batch set aside instead of dropped")
+	}
+	// a restart finds them set aside
+	if s, err := openSpill("up", dir, 0); err != nil || s.state() != (Spill{Rejected: 2}) || u.spill.state() != s.state() {
+		t.Errorf("reopened spill: %+v, %v; was %+v", s.state(), err, u.spill.state())
+	}
+
+	if err := u.spill.write("k1", []byte(`[{"type":"x"}]`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.spill.write("k2", []byte(`[{"type":"y"}]`)); err != nil {
+		t.Fatal(err)
+	}
+	be.status.Store(http.StatusServiceUnavailable)
+	u.replay()
+	if got := u.spill.list(); len(got) != 2 {
+		t.Fatalf("unavailable upstream: spill %v", got)
+	}
+	be.status.Store(0)
+	u.replay()
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if !slices.Equal(be.keys, []string{"k1", "k2"}) {
+		t.Errorf("replayed keys %v", be.keys)
+	}
+}
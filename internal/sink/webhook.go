@@ -0,0 +1,103 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/egress"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/ingestmetrics"
+)
+
+// webhook POSTs each batch as a JSON array of formatted records, or, with a
+// template, each record on its own, as chat and paging APIs expect.
+type webhook struct {
+	name    string
+	url     string
+	headers map[string]string
+	format  Formatter
+	single  bool
+	client  *http.Client
+}
+
+func newWebhook(cfg config.SinkConfig, format Formatter) (*webhook, error) {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	var policy *egress.Policy
+	if cfg.Egress != nil {
+		var err error
+		if policy, err = egress.New(*cfg.Egress); err != nil {
+			return nil, fmt.Errorf("sink %s: %w", cfg.Name, err)
+		}
+	}
+	return &webhook{
+		name:    cfg.Name,
+		url:     cfg.URL,
+		headers: cfg.Headers,
+		format:  format,
+		single:  cfg.Format == "template",
+		client:  policy.Client(timeout),
+	}, nil
+}
+
+func (w *webhook) Name() string { return w.name }
+
+func (w *webhook) Publish(ctx context.Context, events []event.Event) error {
+	records := formatAll(w.name, w.format, events)
+	if len(records) == 0 {
+		return nil
+	}
+	if !w.single {
+		return w.post(ctx, records)
+	}
+	for _, rec := range records {
+		if err := w.post(ctx, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *webhook) post(ctx context.Context, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	start := time.Now()
+	err = w.do(req)
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	ingestmetrics.WebhookDuration.WithLabelValues(w.name, result).Observe(time.Since(start).Seconds())
+	return err
+}
+
+func (w *webhook) do(req *http.Request) error {
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: unexpected status %d", w.name, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Package skew checks the occurred_at producers stamp on events by their own
+// clocks against the service's clock, so an event from a device whose clock
+// is off by days does not land far from its neighbours in listings by
+// occurrence.
+package skew
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// ErrOutOfRange is returned by Check for an event the reject policy
+// refuses.
+var ErrOutOfRange = errors.New("occurred_at out of range")
+
+// OriginalKey is the metadata key keeping the occurred_at of a clamped
+// event as the producer sent it.
+const OriginalKey = "occurred_at.original"
+
+var outOfRange = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "occurred_at_out_of_range_total", Help: "Events with an occurred_at beyond clock.max_future_skew or clock.max_past_age by bound (future, past) and action (rejected, clamped)"},
+	[]string{"bound", "action"},
+)
+
+// Collectors returns the clock skew metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{outOfRange}
+}
+
+// Checker applies a config.ClockConfig.
+type Checker struct {
+	cfg config.ClockConfig
+	now func() time.Time
+}
+
+// New returns a checker reading the service's time from now, time.Now when
+// nil.
+func New(cfg config.ClockConfig, now func() time.Time) *Checker {
+	if now == nil {
+		now = time.Now
+	}
+	return &Checker{cfg: cfg, now: now}
+}
+
+// Check returns an error wrapping ErrOutOfRange when the occurred_at of e
+// is out of bounds and the policy rejects it; with the clamp policy, it
+// moves occurred_at to the bound instead.
+func (c *Checker) Check(e *event.Event) error {
+	if e.OccurredAt == nil {
+		return nil
+	}
+	now := c.now()
+	at := *e.OccurredAt
+	var bound string
+	var limit time.Time
+	switch {
+	case c.cfg.MaxFutureSkew > 0 && at.After(now.Add(c.cfg.MaxFutureSkew)):
+		bound, limit = "future", now.Add(c.cfg.MaxFutureSkew)
+	case c.cfg.MaxPastAge > 0 && at.Before(now.Add(-c.cfg.MaxPastAge)):
+		bound, limit = "past", now.Add(-c.cfg.MaxPastAge)
+	default:
+		return nil
+	}
+	if c.cfg.Policy != "clamp" {
+		outOfRange.WithLabelValues(bound, "rejected").Inc()
+		if bound == "future" {
+			return fmt.Errorf("%w: %s is more than %s ahead of the service's clock", ErrOutOfRange, at.Format(time.RFC3339), c.cfg.MaxFutureSkew)
+		}
+		return fmt.Errorf("%w: %s is more than %s old", ErrOutOfRange, at.Format(time.RFC3339), c.cfg.MaxPastAge)
+	}
+	outOfRange.WithLabelValues(bound, "clamped").Inc()
+	if e.Metadata == nil {
+		e.Metadata = map[string]string{}
+	}
+	e.Metadata[OriginalKey] = at.Format(time.RFC3339Nano)
+	limit = limit.UTC()
+	e.OccurredAt = &limit
+	return nil
+}
@@ -0,0 +1,53 @@
+package skew
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// TestCheck rejects or clamps occurred_at beyond either bound and leaves
+// events within them, or without occurred_at, alone.
+func TestCheck(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	at := func(d time.Duration) *event.Event {
+		t := now.Add(d)
+		return &event.Event{Type: "x", OccurredAt: &t}
+	}
+	cfg := config.ClockConfig{MaxFutureSkew: time.Minute, MaxPastAge: time.Hour}
+
+	reject := New(cfg, clock)
+	for _, e := range []*event.Event{{Type: "x"}, at(time.Minute), at(-time.Hour), at(0)} {
+		if err := reject.Check(e); err != nil {
+			t.Errorf("Check(%v): %v", e.OccurredAt, err)
+		}
+	}
+	for _, d := range []time.Duration{time.Minute + time.Second, -time.Hour - time.Second} {
+		if err := reject.Check(at(d)); !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("Check(now%+v) = %v, want ErrOutOfRange", d, err)
+		}
+	}
+
+	cfg.Policy = "clamp"
+	clamp := New(cfg, clock)
+	e := at(24 * time.Hour)
+	if err := clamp.Check(e); err != nil {
+		t.Fatal(err)
+	}
+	if !e.OccurredAt.Equal(now.Add(time.Minute)) || e.Metadata[OriginalKey] != "2026-03-02T12:00:00Z" {
+		t.Fatalf("clamped to %v, metadata %v", e.OccurredAt, e.Metadata)
+	}
+	e = at(-48 * time.Hour)
+	if err := clamp.Check(e); err != nil || !e.OccurredAt.Equal(now.Add(-time.Hour)) {
+		t.Fatalf("clamped to %v, err %v", e.OccurredAt, err)
+	}
+
+	// without bounds anything goes
+	if err := New(config.ClockConfig{}, clock).Check(at(1000 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,158 @@
+// Package snapshot copies the event store to a local directory or to S3 and
+// bootstraps a new instance from such a copy.
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/s3"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+// Targets a snapshot can be written to.
+const (
+	TargetLocal = "local"
+	TargetS3    = "s3"
+)
+
+// ErrInvalid reports a snapshot request that cannot be served: an unknown
+// target, a bad name or a target that is not configured.
+var ErrInvalid = errors.New("invalid snapshot request")
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// Result describes a snapshot that was written.
+type Result struct {
+	Location    string    `json:"location"`
+	Bytes       int64     `json:"bytes"`
+	LastEventID int64     `json:"last_event_id"`
+	TakenAt     time.Time `json:"taken_at"`
+}
+
+// Name returns the default file name of a snapshot taken at t.
+func Name(t time.Time) string {
+	return "ingest-" + t.UTC().Format("20060102T150405Z") + ".db"
+}
+
+// Take writes a snapshot of s named name to target: a file in cfg.Dir, or
+// an object under cfg.S3.Prefix in cfg.S3.Bucket.
+func Take(ctx context.Context, cfg config.SnapshotConfig, s storage.Snapshotter, target, name string) (*Result, error) {
+	if !validName.MatchString(name) {
+		return nil, fmt.Errorf("%w: name %q may only hold letters, digits, '.', '_' and '-'", ErrInvalid, name)
+	}
+	now := time.Now().UTC()
+	switch target {
+	case TargetLocal:
+		if cfg.Dir == "" {
+			return nil, fmt.Errorf("%w: snapshot.dir is not configured", ErrInvalid)
+		}
+		if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+			return nil, err
+		}
+		path := filepath.Join(cfg.Dir, name)
+		last, err := s.Snapshot(path)
+		if err != nil {
+			return nil, err
+		}
+		return result(path, path, last, now)
+	case TargetS3:
+		if cfg.S3.Bucket == "" {
+			return nil, fmt.Errorf("%w: snapshot.s3.bucket is not configured", ErrInvalid)
+		}
+		tmp, err := os.MkdirTemp("", "ingest-snapshot-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(tmp)
+		path := filepath.Join(tmp, name)
+		last, err := s.Snapshot(path)
+		if err != nil {
+			return nil, err
+		}
+		key := cfg.S3.Prefix + name
+		if err := putFile(ctx, cfg.S3, key, path); err != nil {
+			return nil, err
+		}
+		return result(path, "s3://"+cfg.S3.Bucket+"/"+key, last, now)
+	default:
+		return nil, fmt.Errorf("%w: unknown target %q, want %q or %q", ErrInvalid, target, TargetLocal, TargetS3)
+	}
+}
+
+// putFile uploads the snapshot at path as key in cfg's bucket.
+func putFile(ctx context.Context, cfg config.S3Config, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s3.New(cfg).Put(ctx, cfg.Bucket, key, "application/vnd.sqlite3", f)
+}
+
+func result(path, location string, last int64, at time.Time) (*Result, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{Location: location, Bytes: info.Size(), LastEventID: last, TakenAt: at}, nil
+}
+
+// Restore copies the snapshot at from, a file path or an s3://bucket/key
+// URL, to the SQLite database file db. It refuses to overwrite a database
+// that already holds data, and checks the copy before moving it in place.
+func Restore(ctx context.Context, cfg config.S3Config, from, db string) error {
+	if info, err := os.Stat(db); err == nil && info.Size() > 0 {
+		return fmt.Errorf("restore: %s already exists", db)
+	}
+	f, err := os.CreateTemp(filepath.Dir(db), ".restore-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if rest, ok := strings.CutPrefix(from, "s3://"); ok {
+		bucket, key, _ := strings.Cut(rest, "/")
+		if bucket == "" || key == "" {
+			f.Close()
+			return fmt.Errorf("restore: %q is not an s3://bucket/key URL", from)
+		}
+		err = s3.New(cfg).Get(ctx, bucket, key, f)
+	} else {
+		err = copyFile(from, f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("restore from %s: %w", from, err)
+	}
+	if err := storage.CheckSQLite(tmp); err != nil {
+		return fmt.Errorf("restore from %s: %w", from, err)
+	}
+	// a WAL left next to an empty database would be replayed over the copy
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(db + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(tmp, db)
+}
+
+func copyFile(path string, dst *os.File) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = dst.ReadFrom(src)
+	return err
+}
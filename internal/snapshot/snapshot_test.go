@@ -0,0 +1,129 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+func sqlite(t *testing.T, path string) *storage.SQLite {
+	t.Helper()
+	s, err := storage.OpenSQLite(config.StorageConfig{Driver: "sqlite", DSN: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func count(t *testing.T, s storage.Store) int {
+	t.Helper()
+	es, err := s.List(context.Background(), storage.Query{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(es)
+}
+
+// bucket serves objects PUT to it, path-style, as an S3-compatible store.
+func bucket(t *testing.T) *httptest.Server {
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			objects[r.URL.Path], _ = io.ReadAll(r.Body)
+		case http.MethodGet:
+			b, ok := objects[r.URL.Path]
+			if !ok {
+				http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(b)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// TestRoundTrip restores a new instance from a snapshot written to a
+// directory and to S3, holding the events stored before it.
+func TestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	src := sqlite(t, filepath.Join(dir, "events.db"))
+	for range 3 {
+		if _, err := src.Add(context.Background(), event.Event{Type: "order.created", Payload: json.RawMessage(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s3cfg := config.S3Config{Bucket: "snaps", Prefix: "ingest/", Endpoint: bucket(t).URL, Region: "us-east-1", AccessKeyID: "k", SecretAccessKey: "s"}
+	cfg := config.SnapshotConfig{Dir: filepath.Join(dir, "snapshots"), S3: s3cfg}
+
+	for target, from := range map[string]string{
+		TargetLocal: filepath.Join(dir, "snapshots", "snap.db"),
+		TargetS3:    "s3://snaps/ingest/snap.db",
+	} {
+		res, err := Take(context.Background(), cfg, src, target, "snap.db")
+		if err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		if res.Location != from || res.LastEventID != 3 || res.Bytes == 0 {
+			t.Errorf("%s: result %+v", target, res)
+		}
+		db := filepath.Join(t.TempDir(), "restored.db")
+		if err := Restore(context.Background(), s3cfg, from, db); err != nil {
+			t.Fatalf("%s: restore: %v", target, err)
+		}
+		if n := count(t, sqlite(t, db)); n != 3 {
+			t.Errorf("%s: %d events restored", target, n)
+		}
+		if err := Restore(context.Background(), s3cfg, from, db); err == nil {
+			t.Errorf("%s: restored over a database with data", target)
+		}
+	}
+}
+
+// TestTakeInvalid refuses bad names, unknown targets and targets that are
+// not configured, and Restore refuses what is not a database.
+func TestTakeInvalid(t *testing.T) {
+	dir := t.TempDir()
+	src := sqlite(t, filepath.Join(dir, "events.db"))
+	for name, c := range map[string]struct {
+		cfg          config.SnapshotConfig
+		target, name string
+	}{
+		"name":      {config.SnapshotConfig{Dir: dir}, TargetLocal, "../escape.db"},
+		"target":    {config.SnapshotConfig{Dir: dir}, "ftp", "a.db"},
+		"no dir":    {config.SnapshotConfig{}, TargetLocal, "a.db"},
+		"no bucket": {config.SnapshotConfig{Dir: dir}, TargetS3, "a.db"},
+	} {
+		if _, err := Take(context.Background(), c.cfg, src, c.target, c.name); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	junk := filepath.Join(dir, "junk.db")
+	if err := os.WriteFile(junk, []byte("not a database"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db := filepath.Join(dir, "restored.db")
+	if err := Restore(context.Background(), config.S3Config{}, junk, db); err == nil {
+		t.Error("restored a file that is not a database")
+	}
+	if _, err := os.Stat(db); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("failed restore left %s: %v", db, err)
+	}
+}
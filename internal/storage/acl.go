@@ -0,0 +1,17 @@
+package storage
+
+import "time"
+
+// ACLRule allows or denies the callers named by Subject to write or read
+// the event types matching Types.
+type ACLRule struct {
+	ID string `json:"id"`
+	// Subject is an API key ID or token subject, or "*" for every caller.
+	Subject string `json:"subject"`
+	// Actions holds "write", "read" or both.
+	Actions []string `json:"actions"`
+	Types   []string `json:"types"`
+	// Effect is "allow" or "deny".
+	Effect    string    `json:"effect"`
+	CreatedAt time.Time `json:"created_at"`
+}
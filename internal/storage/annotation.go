@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned for an event that does not exist, was purged
+	// or is in the trash.
+	ErrNotFound = errors.New("event not found")
+	// ErrVersionMismatch is returned by Annotate when the event's latest
+	// annotation is not the one the change was based on.
+	ErrVersionMismatch = errors.New("annotation version mismatch")
+)
+
+// Annotation is one version of the mutable state kept beside an immutable
+// event. Versions start at 1; every change stores a new one, so the
+// versions of an event are its change history.
+type Annotation struct {
+	EventID     int64             `json:"event_id"`
+	Version     int64             `json:"version"`
+	Status      string            `json:"status,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Actor is the API key ID or token subject that made the change.
+	Actor string    `json:"actor"`
+	Time  time.Time `json:"time"`
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// AuditEntry is one record of the append-only audit trail.
+type AuditEntry struct {
+	ID   int64     `json:"id"`
+	Time time.Time `json:"time"`
+	// Actor is the API key ID or token subject, "anonymous" without auth,
+	// or "system"/"config" for actions taken by the service itself.
+	Actor  string `json:"actor"`
+	Action string `json:"action"`
+	Target string `json:"target,omitempty"`
+	// Method, Path, RequestID and RemoteAddr describe the API request, if any.
+	Method     string          `json:"method,omitempty"`
+	Path       string          `json:"path,omitempty"`
+	RequestID  string          `json:"request_id,omitempty"`
+	RemoteAddr string          `json:"remote_addr,omitempty"`
+	Details    json.RawMessage `json:"details,omitempty"`
+}
+
+// AuditQuery filters the audit trail; zero values are ignored.
+type AuditQuery struct {
+	Actor  string
+	Action string
+	Since  time.Time
+	// Until is exclusive.
+	Until time.Time
+	// Limit caps the result, newest first; 0 means the default of 100.
+	Limit int
+}
+
+const maxAuditLimit = 1000
+
+func (q AuditQuery) Validate() error {
+	if q.Limit < 0 || q.Limit > maxAuditLimit {
+		return fmt.Errorf("limit must be 1-%d", maxAuditLimit)
+	}
+	if !q.Since.IsZero() && !q.Until.IsZero() && !q.Since.Before(q.Until) {
+		return fmt.Errorf("since must be before until")
+	}
+	return nil
+}
+
+func (q AuditQuery) limit() int {
+	if q.Limit == 0 {
+		return 100
+	}
+	return q.Limit
+}
+
+func (q AuditQuery) match(e *AuditEntry) bool {
+	return (q.Actor == "" || e.Actor == q.Actor) &&
+		(q.Action == "" || e.Action == q.Action) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until))
+}
@@ -0,0 +1,15 @@
+package storage
+
+import "time"
+
+// Consumer is the persisted state of a named pull consumer: every matching
+// event with an ID up to Offset has been acknowledged. Epoch is the fencing
+// token of the latest lease, persisted so tokens keep growing across
+// restarts.
+type Consumer struct {
+	Name      string    `json:"name"`
+	Types     []string  `json:"types,omitempty"`
+	Offset    int64     `json:"offset"`
+	Epoch     int64     `json:"epoch"`
+	CreatedAt time.Time `json:"created_at"`
+}
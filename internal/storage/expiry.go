@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	eventsExpired = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "storage_events_expired_total", Help: "Events deleted by the janitor after their expires_at"},
+	)
+	eventsTrashPurged = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "storage_events_trash_purged_total", Help: "Events deleted by the janitor after their trash retention"},
+	)
+	eventsCompacted = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "storage_events_compacted_total", Help: "Events deleted by compaction after a newer event with the same partition key"},
+	)
+)
+
+// PurgeExpired deletes the events of s whose ExpiresAt has passed, with
+// their pending deliveries and annotations, returning how many there were.
+func PurgeExpired(ctx context.Context, s Store) (int64, error) {
+	n, err := s.Purge(ctx, Query{Expired: true})
+	eventsExpired.Add(float64(n))
+	return n, err
+}
+
+// PurgeTrash deletes the events of s moved to the trash before before,
+// returning how many there were.
+func PurgeTrash(ctx context.Context, s Store, before time.Time) (int64, error) {
+	n, err := s.Purge(ctx, Query{Trashed: true, TrashedBefore: before})
+	eventsTrashPurged.Add(float64(n))
+	return n, err
+}
+
+// Compact deletes the events of the types matching patterns that a newer
+// event of the same type and partition key supersedes, returning how many
+// there were. Events without a partition key are kept.
+func Compact(ctx context.Context, s Store, patterns []string) (int64, error) {
+	n, err := s.Purge(ctx, Query{Types: patterns, Superseded: true})
+	eventsCompacted.Add(float64(n))
+	return n, err
+}
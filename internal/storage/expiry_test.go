@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// TestCompact keeps the newest event per type and partition key, and the
+// events without a key or of other types, in every driver and the hot tier.
+func TestCompact(t *testing.T) {
+	sqlite, err := OpenSQLite(config.StorageConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "events.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+	hotCold, err := OpenSQLite(config.StorageConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "events.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hotCold.Close()
+	hot, err := NewTiered(hotCold, config.HotTierConfig{EventsPerType: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]Store{"memory": NewMemory(2), "sqlite": sqlite, "tiered": hot} {
+		add := func(typ, key string) int64 {
+			e, err := s.Add(context.Background(), event.Event{Type: typ, PartitionKey: key, Payload: json.RawMessage("{}")}, "sink")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return e.ID
+		}
+		var want []int64
+		for i := range 3 {
+			for _, key := range []string{"a", "b"} {
+				id := add("device.heartbeat", key)
+				if i == 2 {
+					want = append(want, id)
+				}
+			}
+		}
+		want = append(want, add("device.heartbeat", ""), add("device.heartbeat", ""), add("device.boot", "a"), add("device.boot", "a"))
+		want = append(want, add("device.heartbeat", "c"))
+
+		n, err := Compact(context.Background(), s, []string{"device.heartbeat"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 4 {
+			t.Errorf("%s: compacted %d events, want 4", name, n)
+		}
+		list, err := s.List(context.Background(), Query{Ascending: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int64
+		for _, e := range list {
+			got = append(got, e.ID)
+		}
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: kept %v, want %v", name, got, want)
+		}
+		if got, _ := s.List(context.Background(), Query{Types: []string{"device.heartbeat"}, Limit: 1}); len(got) != 1 || got[0].PartitionKey != "c" {
+			t.Errorf("%s: newest heartbeat %+v", name, got)
+		}
+		ds, err := s.Deliveries(context.Background(), "sink", list[len(list)-1].ReceivedAt, 100, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ds) != len(want) {
+			t.Errorf("%s: %d deliveries left, want %d", name, len(ds), len(want))
+		}
+		if n, _ := Compact(context.Background(), s, []string{"device.*"}); n != 1 {
+			t.Errorf("%s: second compaction deleted %d, want the older boot", name, n)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/chaos"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// Faulty injects the chaos faults of target "storage" into the calls that
+// serve requests, Add, List, Stats, Get and GetMany, and into the outbox's
+// Deliveries and AckDeliveries. It goes under the Guarded breaker, which
+// counts the injected failures like real ones. Everything else passes
+// through.
+type Faulty struct {
+	Store
+	c *chaos.Controller
+}
+
+// InjectFaults wraps s with c, or returns s when c is nil.
+func InjectFaults(s Store, c *chaos.Controller) Store {
+	if c == nil {
+		return s
+	}
+	return &Faulty{Store: s, c: c}
+}
+
+func (f *Faulty) Add(ctx context.Context, e event.Event, sinks ...string) (event.Event, error) {
+	partial, err := f.c.Inject("storage", "add")
+	if err != nil {
+		return e, err
+	}
+	out, err := f.Store.Add(ctx, e, sinks...)
+	if err == nil && partial != nil {
+		return e, partial
+	}
+	return out, err
+}
+
+func (f *Faulty) List(ctx context.Context, q Query) ([]event.Event, error) {
+	partial, err := f.c.Inject("storage", "list")
+	if err != nil {
+		return nil, err
+	}
+	out, err := f.Store.List(ctx, q)
+	if err == nil && partial != nil {
+		return nil, partial
+	}
+	return out, err
+}
+
+func (f *Faulty) Stats(ctx context.Context, q Query, bucket time.Duration) (*Stats, error) {
+	partial, err := f.c.Inject("storage", "stats")
+	if err != nil {
+		return nil, err
+	}
+	out, err := f.Store.Stats(ctx, q, bucket)
+	if err == nil && partial != nil {
+		return nil, partial
+	}
+	return out, err
+}
+
+func (f *Faulty) Get(ctx context.Context, id int64) (event.Event, error) {
+	partial, err := f.c.Inject("storage", "get")
+	if err != nil {
+		return event.Event{}, err
+	}
+	out, err := f.Store.Get(ctx, id)
+	if err == nil && partial != nil {
+		return event.Event{}, partial
+	}
+	return out, err
+}
+
+func (f *Faulty) GetMany(ctx context.Context, ids []int64) ([]event.Event, error) {
+	partial, err := f.c.Inject("storage", "get")
+	if err != nil {
+		return nil, err
+	}
+	out, err := f.Store.GetMany(ctx, ids)
+	if err == nil && partial != nil {
+		return nil, partial
+	}
+	return out, err
+}
+
+func (f *Faulty) Deliveries(ctx context.Context, sink string, now time.Time, limit int, byKey bool) ([]Delivery, error) {
+	partial, err := f.c.Inject("storage", "deliveries")
+	if err != nil {
+		return nil, err
+	}
+	out, err := f.Store.Deliveries(ctx, sink, now, limit, byKey)
+	if err == nil && partial != nil {
+		return nil, partial
+	}
+	return out, err
+}
+
+// AckDeliveries acknowledges only the first half of ids on a partial
+// failure, so the rest are delivered again.
+func (f *Faulty) AckDeliveries(ctx context.Context, sink string, ids ...int64) error {
+	partial, err := f.c.Inject("storage", "ack")
+	if err != nil {
+		return err
+	}
+	if partial != nil {
+		ids = ids[:len(ids)/2]
+	}
+	if err := f.Store.AckDeliveries(ctx, sink, ids...); err != nil {
+		return err
+	}
+	return partial
+}
+
+// Partitions and DropPartitions pass through to the store, see Partitioner.
+func (f *Faulty) Partitions() ([]Partition, error) {
+	p, ok := f.Store.(Partitioner)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return p.Partitions()
+}
+
+func (f *Faulty) DropPartitions(before time.Time) ([]Partition, error) {
+	p, ok := f.Store.(Partitioner)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return p.DropPartitions(before)
+}
+
+// Snapshot passes through to the store, see Snapshotter.
+func (f *Faulty) Snapshot(path string) (int64, error) {
+	sn, ok := f.Store.(Snapshotter)
+	if !ok {
+		return 0, errors.ErrUnsupported
+	}
+	return sn.Snapshot(path)
+}
+
+// FieldIndexes passes through to the store, see FieldIndexer.
+func (f *Faulty) FieldIndexes() ([]FieldIndex, error) {
+	fi, ok := f.Store.(FieldIndexer)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return fi.FieldIndexes()
+}
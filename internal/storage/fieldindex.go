@@ -0,0 +1,416 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/typematch"
+)
+
+var fieldIndexProgress = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{Name: "storage_field_index_progress", Help: "Share of the existing events backfilled into each declared payload field index, 1 once it serves queries"},
+	[]string{"types", "field"},
+)
+
+// FieldIndexer is implemented by stores that index payload fields for the
+// payload.<field> filters of list and search queries.
+type FieldIndexer interface {
+	// FieldIndexes reports the declared indexes and how far each is built.
+	FieldIndexes() ([]FieldIndex, error)
+}
+
+// Field index states.
+const (
+	IndexBuilding = "building"
+	IndexReady    = "ready"
+	// IndexDropping marks a field no longer declared whose index rows are
+	// being deleted.
+	IndexDropping = "dropping"
+)
+
+// FieldIndex is a declared payload field index: the field, or "*" for every
+// short scalar top-level field, of the events whose type matches Types.
+// Events stored before the declaration are indexed in the background, in
+// ascending ID order up to Target; queries use the index once it is ready.
+type FieldIndex struct {
+	Types     string     `json:"types"`
+	Field     string     `json:"field"`
+	State     string     `json:"state"`
+	IndexedTo int64      `json:"indexed_to"`
+	Target    int64      `json:"target"`
+	Progress  float64    `json:"progress"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadyAt   *time.Time `json:"ready_at,omitempty"`
+}
+
+func (f *FieldIndex) progress() float64 {
+	if f.State == IndexReady || f.Target <= 0 {
+		return 1
+	}
+	return min(float64(f.IndexedTo)/float64(f.Target), 1)
+}
+
+// DefaultFieldIndexes indexes every short scalar top-level field of every
+// event, for stores without storage.indexes.
+var DefaultFieldIndexes = map[string][]string{"*": {"*"}}
+
+// backfillBatch is the number of events indexed per write transaction, so
+// ingest does not wait long on the write connection.
+const backfillBatch = 500
+
+// fieldIndexes holds the declared field indexes of a SQLite store and builds
+// the new ones, and drops the rows of undeclared fields, in the background.
+type fieldIndexes struct {
+	db *sql.DB
+
+	mu       sync.Mutex
+	decls    []*FieldIndex
+	dropping []string
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// syncFieldIndexes reconciles the declarations recorded in the database with
+// declared (type pattern to fields) and starts building and dropping.
+func syncFieldIndexes(db *sql.DB, declared map[string][]string) (*fieldIndexes, error) {
+	if len(declared) == 0 {
+		declared = DefaultFieldIndexes
+	}
+	f := &fieldIndexes{db: db, done: make(chan struct{}), stopped: make(chan struct{})}
+	rows, err := db.Query(`SELECT types, field, indexed_to, target, ready_at, created_at FROM field_indexes`)
+	if err != nil {
+		return nil, err
+	}
+	recorded := map[[2]string]*FieldIndex{}
+	for rows.Next() {
+		var d FieldIndex
+		var readyAt sql.NullInt64
+		var createdAt int64
+		if err := rows.Scan(&d.Types, &d.Field, &d.IndexedTo, &d.Target, &readyAt, &createdAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		d.CreatedAt = time.Unix(0, createdAt).UTC()
+		d.State = IndexBuilding
+		if readyAt.Valid {
+			at := time.Unix(0, readyAt.Int64).UTC()
+			d.ReadyAt, d.State = &at, IndexReady
+		}
+		recorded[[2]string{d.Types, d.Field}] = &d
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var head int64
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM events`).Scan(&head); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	for _, types := range slices.Sorted(maps.Keys(declared)) {
+		for _, field := range declared[types] {
+			key := [2]string{types, field}
+			if d, ok := recorded[key]; ok {
+				f.decls = append(f.decls, d)
+				delete(recorded, key)
+				continue
+			}
+			// events from here on are indexed as they are added
+			d := &FieldIndex{Types: types, Field: field, State: IndexBuilding, Target: head, CreatedAt: now}
+			var readyAt sql.NullInt64
+			if head == 0 {
+				d.State, d.ReadyAt = IndexReady, &now
+				readyAt = sql.NullInt64{Int64: now.UnixNano(), Valid: true}
+			}
+			if _, err := db.Exec(`INSERT INTO field_indexes (types, field, indexed_to, target, ready_at, created_at) VALUES (?, ?, 0, ?, ?, ?)`,
+				types, field, head, readyAt, now.UnixNano()); err != nil {
+				return nil, err
+			}
+			f.decls = append(f.decls, d)
+		}
+	}
+	for key := range recorded {
+		if _, err := db.Exec(`DELETE FROM field_indexes WHERE types = ? AND field = ?`, key[0], key[1]); err != nil {
+			return nil, err
+		}
+	}
+	if !f.indexesEverything() {
+		if f.dropping, err = f.undeclaredFields(); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range f.decls {
+		fieldIndexProgress.WithLabelValues(d.Types, d.Field).Set(d.progress())
+	}
+	go f.run()
+	return f, nil
+}
+
+func (f *fieldIndexes) indexesEverything() bool {
+	return slices.ContainsFunc(f.decls, func(d *FieldIndex) bool { return d.Field == "*" })
+}
+
+// undeclaredFields lists the fields with index rows that no declaration
+// names.
+func (f *fieldIndexes) undeclaredFields() ([]string, error) {
+	rows, err := f.db.Query(`SELECT DISTINCT field FROM event_fields`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var field string
+		if err := rows.Scan(&field); err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(f.decls, func(d *FieldIndex) bool { return d.Field == field }) {
+			out = append(out, field)
+		}
+	}
+	return out, rows.Err()
+}
+
+func (f *fieldIndexes) stop() {
+	close(f.done)
+	<-f.stopped
+}
+
+func (f *fieldIndexes) run() {
+	defer close(f.stopped)
+	for {
+		f.mu.Lock()
+		var next *FieldIndex
+		for _, d := range f.decls {
+			if d.State == IndexBuilding {
+				next = d
+				break
+			}
+		}
+		var drop string
+		if next == nil && len(f.dropping) > 0 {
+			drop = f.dropping[0]
+		}
+		f.mu.Unlock()
+		var err error
+		switch {
+		case next != nil:
+			err = f.backfill(next)
+		case drop != "":
+			err = f.drop(drop)
+		default:
+			return
+		}
+		if errors.Is(err, errStopped) {
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("field index")
+			select {
+			case <-f.done:
+				return
+			case <-time.After(10 * time.Second):
+			}
+		}
+	}
+}
+
+var errStopped = errors.New("stopped")
+
+// backfill indexes the events of d up to its target, a batch per
+// transaction, recording its progress so a restart resumes it.
+func (f *fieldIndexes) backfill(d *FieldIndex) error {
+	f.mu.Lock()
+	from := d.IndexedTo
+	f.mu.Unlock()
+	log.Info().Str("types", d.Types).Str("field", d.Field).Int64("from", from).Int64("target", d.Target).Msg("building field index")
+	for from < d.Target {
+		select {
+		case <-f.done:
+			return errStopped
+		default:
+		}
+		to, err := f.backfillBatch(d, from)
+		if err != nil {
+			return fmt.Errorf("index %s %s: %w", d.Types, d.Field, err)
+		}
+		f.mu.Lock()
+		d.IndexedTo, from = to, to
+		f.mu.Unlock()
+		fieldIndexProgress.WithLabelValues(d.Types, d.Field).Set(d.progress())
+	}
+	now := time.Now().UTC()
+	if _, err := f.db.Exec(`UPDATE field_indexes SET ready_at = ? WHERE types = ? AND field = ?`, now.UnixNano(), d.Types, d.Field); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	d.State, d.ReadyAt = IndexReady, &now
+	f.mu.Unlock()
+	fieldIndexProgress.WithLabelValues(d.Types, d.Field).Set(1)
+	log.Info().Str("types", d.Types).Str("field", d.Field).Msg("field index ready")
+	return nil
+}
+
+// backfillBatch indexes the events of d after the ID from and returns the
+// last ID it covered.
+func (f *fieldIndexes) backfillBatch(d *FieldIndex, from int64) (int64, error) {
+	tx, err := f.db.Begin()
+	if err != nil {
+		return from, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	rows, err := tx.Query(`SELECT id, type, payload FROM events WHERE id > ? AND id <= ? ORDER BY id LIMIT ?`, from, d.Target, backfillBatch)
+	if err != nil {
+		return from, err
+	}
+	type pending struct {
+		id      int64
+		payload string
+	}
+	var batch []pending
+	to := from
+	for rows.Next() {
+		var p pending
+		var typ string
+		if err := rows.Scan(&p.id, &typ, &p.payload); err != nil {
+			rows.Close()
+			return from, err
+		}
+		to = p.id
+		if typematch.Match(d.Types, typ) {
+			batch = append(batch, p)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return from, err
+	}
+	if to == from {
+		// nothing left up to the target, e.g. its events were deleted
+		to = d.Target
+	}
+	for _, p := range batch {
+		for name, value := range indexedFields(json.RawMessage(p.payload)) {
+			if d.Field != "*" && d.Field != name {
+				continue
+			}
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO event_fields (field, value, event_id) VALUES (?, ?, ?)`, name, value, p.id); err != nil {
+				return from, err
+			}
+		}
+	}
+	if _, err := tx.Exec(`UPDATE field_indexes SET indexed_to = ? WHERE types = ? AND field = ?`, to, d.Types, d.Field); err != nil {
+		return from, err
+	}
+	return to, tx.Commit()
+}
+
+// drop deletes the index rows of a field no longer declared, a batch per
+// transaction.
+func (f *fieldIndexes) drop(field string) error {
+	for {
+		select {
+		case <-f.done:
+			return errStopped
+		default:
+		}
+		res, err := f.db.Exec(`DELETE FROM event_fields WHERE (field, value, event_id) IN
+			(SELECT field, value, event_id FROM event_fields WHERE field = ? LIMIT ?)`, field, backfillBatch*10)
+		if err != nil {
+			return fmt.Errorf("drop index rows of %s: %w", field, err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			break
+		}
+	}
+	f.mu.Lock()
+	f.dropping = slices.DeleteFunc(f.dropping, func(d string) bool { return d == field })
+	f.mu.Unlock()
+	log.Info().Str("field", field).Msg("field index dropped")
+	return nil
+}
+
+// fields returns the index rows Add writes for an event: its short scalar
+// top-level fields that a declaration matching typ names.
+func (f *fieldIndexes) fields(typ string, payload json.RawMessage) map[string]string {
+	all := indexedFields(payload)
+	if len(all) == 0 {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make(map[string]string, len(all))
+	for _, d := range f.decls {
+		if !typematch.Match(d.Types, typ) {
+			continue
+		}
+		if d.Field == "*" {
+			return all
+		}
+		if v, ok := all[d.Field]; ok {
+			out[d.Field] = v
+		}
+	}
+	return out
+}
+
+// covers reports whether the index rows of field hold every event of the
+// types a query asks for, so that its filter can use them. A type pattern is
+// covered by a ready declaration for "*", by one with the same pattern, or,
+// for a plain type, by one whose pattern matches it.
+func (f *fieldIndexes) covers(field string, types []string) bool {
+	if f == nil {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	covered := func(p string) bool {
+		for _, d := range f.decls {
+			if d.State != IndexReady || (d.Field != "*" && d.Field != field) {
+				continue
+			}
+			if d.Types == "*" || d.Types == p || (typematch.IsLiteral(p) && typematch.Match(d.Types, p)) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(types) == 0 {
+		return covered("*")
+	}
+	for _, p := range types {
+		if !covered(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// FieldIndexes reports the declared field indexes and the fields being
+// dropped, see FieldIndexer.
+func (s *SQLite) FieldIndexes() ([]FieldIndex, error) {
+	f := s.fields
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]FieldIndex, 0, len(f.decls)+len(f.dropping))
+	for _, d := range f.decls {
+		c := *d
+		c.Progress = d.progress()
+		out = append(out, c)
+	}
+	for _, field := range f.dropping {
+		out = append(out, FieldIndex{Field: field, State: IndexDropping})
+	}
+	return out, nil
+}
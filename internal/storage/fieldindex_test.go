@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// TestFieldIndexes reopens a store with declared field indexes: the new
+// index is backfilled, payload filters give the same results whether or not
+// they use it, and the rows of undeclared fields are dropped.
+func TestFieldIndexes(t *testing.T) {
+	cfg := config.StorageConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "events.db")}
+	s, err := OpenSQLite(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 1200 {
+		typ := []string{"order.created", "order.paid", "signup"}[i%3]
+		payload := fmt.Sprintf(`{"user_id":%d,"plan":"p%d"}`, i%7, i%2)
+		if _, err := s.Add(context.Background(), event.Event{Type: typ, Payload: json.RawMessage(payload)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = s.Close()
+
+	cfg.Indexes = map[string][]string{"order.*": {"user_id"}}
+	if s, err = OpenSQLite(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		idx, _ := s.FieldIndexes()
+		if len(idx) == 1 && idx[0].State == IndexReady {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("index not built: %+v", idx)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, q := range []Query{
+		{Types: []string{"order.paid"}, Fields: map[string]string{"user_id": "3"}},
+		{Types: []string{"order.*"}, Fields: map[string]string{"user_id": "3"}},
+		{Fields: map[string]string{"user_id": "3"}},
+		{Types: []string{"order.created"}, NotFields: map[string]string{"user_id": "3"}},
+		{Types: []string{"signup"}, Fields: map[string]string{"plan": "p1"}},
+	} {
+		got, err := s.List(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, err := s.List(context.Background(), Query{Types: q.Types})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 0
+		for _, e := range all {
+			if q.Match(&e) {
+				want++
+			}
+		}
+		if len(got) != want || want == 0 {
+			t.Errorf("%+v: %d events, want %d", q, len(got), want)
+		}
+	}
+	if !s.fields.covers("user_id", []string{"order.paid"}) || !s.fields.covers("user_id", []string{"order.*"}) {
+		t.Error("order types should use the user_id index")
+	}
+	if s.fields.covers("user_id", nil) || s.fields.covers("plan", []string{"order.paid"}) {
+		t.Error("only declared fields and types should use the index")
+	}
+
+	var undeclared int
+	for time.Now().Before(deadline) {
+		if err := s.db.QueryRow(`SELECT COUNT(*) FROM event_fields WHERE field = 'plan'`).Scan(&undeclared); err != nil {
+			t.Fatal(err)
+		}
+		if undeclared == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if undeclared != 0 {
+		t.Errorf("%d rows of the undeclared field plan left", undeclared)
+	}
+}
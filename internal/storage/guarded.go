@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/breaker"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// Guarded puts a circuit breaker in front of the calls to a Store that
+// serve requests: Add, List, Stats and Get. While it is open they fail at
+// once with a *breaker.OpenError instead of waiting on a store that is
+// down. Invalid queries and missing events are the caller's error, not the
+// store's, and count as successes; a call given up on when its context
+// ended counts as neither. Everything else passes through.
+type Guarded struct {
+	Store
+	b *breaker.Breaker
+}
+
+// Guard wraps s with b, or returns s when b is nil.
+func Guard(s Store, b *breaker.Breaker) Store {
+	if b == nil {
+		return s
+	}
+	return &Guarded{Store: s, b: b}
+}
+
+func (g *Guarded) Add(ctx context.Context, e event.Event, sinks ...string) (event.Event, error) {
+	if err := g.b.Allow(); err != nil {
+		return e, err
+	}
+	out, err := g.Store.Add(ctx, e, sinks...)
+	g.done(ctx, err)
+	return out, err
+}
+
+func (g *Guarded) List(ctx context.Context, q Query) ([]event.Event, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	if err := g.b.Allow(); err != nil {
+		return nil, err
+	}
+	out, err := g.Store.List(ctx, q)
+	g.done(ctx, err)
+	return out, err
+}
+
+func (g *Guarded) Stats(ctx context.Context, q Query, bucket time.Duration) (*Stats, error) {
+	if err := g.b.Allow(); err != nil {
+		return nil, err
+	}
+	out, err := g.Store.Stats(ctx, q, bucket)
+	g.done(ctx, err)
+	return out, err
+}
+
+func (g *Guarded) Get(ctx context.Context, id int64) (event.Event, error) {
+	if err := g.b.Allow(); err != nil {
+		return event.Event{}, err
+	}
+	out, err := g.Store.Get(ctx, id)
+	g.done(ctx, err)
+	return out, err
+}
+
+func (g *Guarded) GetMany(ctx context.Context, ids []int64) ([]event.Event, error) {
+	if err := g.b.Allow(); err != nil {
+		return nil, err
+	}
+	out, err := g.Store.GetMany(ctx, ids)
+	g.done(ctx, err)
+	return out, err
+}
+
+func (g *Guarded) done(ctx context.Context, err error) {
+	if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		g.b.Abandon()
+		return
+	}
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrInvalidQuery) {
+		err = nil
+	}
+	g.b.Done(err)
+}
+
+// Partitions and DropPartitions pass through to the store, see Partitioner.
+func (g *Guarded) Partitions() ([]Partition, error) {
+	p, ok := g.Store.(Partitioner)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return p.Partitions()
+}
+
+func (g *Guarded) DropPartitions(before time.Time) ([]Partition, error) {
+	p, ok := g.Store.(Partitioner)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return p.DropPartitions(before)
+}
+
+// Snapshot passes through to the store, see Snapshotter.
+func (g *Guarded) Snapshot(path string) (int64, error) {
+	sn, ok := g.Store.(Snapshotter)
+	if !ok {
+		return 0, errors.ErrUnsupported
+	}
+	return sn.Snapshot(path)
+}
+
+// FieldIndexes passes through to the store, see FieldIndexer.
+func (g *Guarded) FieldIndexes() ([]FieldIndex, error) {
+	fi, ok := g.Store.(FieldIndexer)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return fi.FieldIndexes()
+}
@@ -0,0 +1,16 @@
+package storage
+
+import (
+	"net/http"
+	"time"
+)
+
+// IdempotentResponse is the response to a write carrying an Idempotency-Key,
+// replayed to retries until Expires.
+type IdempotentResponse struct {
+	Key     string
+	Status  int
+	Header  http.Header
+	Body    []byte
+	Expires time.Time
+}
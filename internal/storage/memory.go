@@ -0,0 +1,905 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// Memory keeps events in process memory; everything is lost on restart.
+//
+// Events are spread over shards by ID (id % shards), each with its own lock,
+// so concurrent writers rarely contend. IDs are dense, which puts event id at
+// a fixed slot of its shard; List read-locks all shards and walks IDs (or the
+// merged tag postings) newest first, down to the lowest ID still held.
+// Purged events are freed: their slots keep a shared marker, and the purged
+// slots at the start of a shard, where retention purges, are dropped.
+type Memory struct {
+	seq    atomic.Int64
+	shards []*shard
+
+	mu sync.Mutex
+	// scheduled holds the IDs of events whose delivery is still pending.
+	scheduled map[int64]bool
+	consumers map[string]Consumer
+	audit     []AuditEntry
+	idem      map[string]IdempotentResponse
+	idemSwept time.Time
+	tenants   map[string]Tenant
+	// outbox holds the pending deliveries by sink and event ID, without
+	// the event.
+	outbox map[string]map[int64]Delivery
+	// annotations holds the annotation versions by event ID, oldest first.
+	annotations map[int64][]Annotation
+	// usage holds the usage records by hour, key and tenant.
+	usage map[usageID]Usage
+	// receipts holds the resolved async receipts by ID; expired ones are
+	// swept at most once a minute.
+	receipts      map[string]Receipt
+	receiptsSwept time.Time
+	tenantKeys    map[string][]TenantKey
+	leases        map[string]lease
+	aclRules      map[string]ACLRule
+}
+
+type lease struct {
+	holder  string
+	expires time.Time
+}
+
+type usageID struct {
+	hour        int64
+	key, tenant string
+}
+
+type shard struct {
+	mu sync.RWMutex
+	// base is the slot of events[0]; the slots before it were purged.
+	base int
+	// events[i] holds slot base+i, which is ID (base+i)*len(shards)+index+1:
+	// nil while its Add has not finished, purgedSlot once purged.
+	events []*event.Event
+	// tags indexes event IDs by tag, ascending.
+	tags map[string][]int64
+}
+
+// NewMemory returns a memory store with n shards; n <= 0 picks a default
+// based on GOMAXPROCS.
+func NewMemory(n int) *Memory {
+	if n <= 0 {
+		n = 4 * runtime.GOMAXPROCS(0)
+	}
+	s := &Memory{shards: make([]*shard, n), scheduled: map[int64]bool{}, consumers: map[string]Consumer{},
+		idem: map[string]IdempotentResponse{}, tenants: map[string]Tenant{}, outbox: map[string]map[int64]Delivery{},
+		annotations: map[int64][]Annotation{}, usage: map[usageID]Usage{}, receipts: map[string]Receipt{},
+		tenantKeys: map[string][]TenantKey{}, leases: map[string]lease{}, aclRules: map[string]ACLRule{}}
+	for i := range s.shards {
+		s.shards[i] = &shard{tags: map[string][]int64{}}
+	}
+	return s
+}
+
+// purgedSlot marks the slot of a purged event.
+var purgedSlot = &event.Event{}
+
+func (s *Memory) Add(ctx context.Context, e event.Event, sinks ...string) (event.Event, error) {
+	if err := ctx.Err(); err != nil {
+		return event.Event{}, err
+	}
+	e.ID = s.seq.Add(1)
+	e.ReceivedAt = time.Now().UTC()
+	due := e.ReceivedAt
+	if e.DeliverAt != nil {
+		at := e.DeliverAt.UTC()
+		e.DeliverAt, due = &at, at
+	}
+	if e.ExpiresAt != nil {
+		at := e.ExpiresAt.UTC()
+		e.ExpiresAt = &at
+	}
+	if e.OccurredAt != nil {
+		at := e.OccurredAt.UTC()
+		e.OccurredAt = &at
+	}
+	e.TTLSeconds, e.DeletedAt = 0, nil
+	if e.DeliverAt != nil || len(sinks) > 0 {
+		s.mu.Lock()
+		if e.DeliverAt != nil {
+			s.scheduled[e.ID] = true
+		}
+		// Deliveries skips the event until its slot below is filled
+		for _, name := range sinks {
+			if s.outbox[name] == nil {
+				s.outbox[name] = map[int64]Delivery{}
+			}
+			s.outbox[name][e.ID] = Delivery{Sink: name, NextAttempt: due}
+		}
+		s.mu.Unlock()
+	}
+	n := int64(len(s.shards))
+	sh, slot := s.shards[(e.ID-1)%n], int((e.ID-1)/n)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	// an unfinished slot is never dropped, so slot >= sh.base
+	slot -= sh.base
+	if slot >= len(sh.events) {
+		sh.events = slices.Grow(sh.events, slot+1-len(sh.events))[:slot+1]
+	}
+	sh.events[slot] = &e
+	for _, t := range e.Tags {
+		sh.tags[t] = insertSorted(sh.tags[t], e.ID)
+	}
+	return e, nil
+}
+
+// insertSorted adds id to the ascending list ids. Writers finish nearly in ID
+// order, so the position is searched from the end.
+func insertSorted(ids []int64, id int64) []int64 {
+	i := len(ids)
+	for i > 0 && ids[i-1] > id {
+		i--
+	}
+	return slices.Insert(ids, i, id)
+}
+
+func (s *Memory) List(ctx context.Context, q Query) ([]event.Event, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	q = q.Compile()
+	// read-lock every shard so the merged view is consistent; writers to
+	// other shards are only held up for the duration of the walk
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		defer sh.mu.RUnlock()
+	}
+	out := []event.Event{}
+	full := func() bool { return q.Limit > 0 && len(out) >= q.Limit }
+	if q.FromID > 0 {
+		// stop at the first slot still being added so the reader's cursor
+		// cannot move past it
+		for id := max(q.FromID, s.lowest()); id <= s.seq.Load() && !full(); id++ {
+			e := s.at(id)
+			if e == nil {
+				if s.purged(id) {
+					continue
+				}
+				break
+			}
+			if q.Match(e) {
+				out = append(out, *e)
+			}
+		}
+		return out, nil
+	}
+	if q.OrderBy == "received_at" || q.OrderBy == "occurred_at" || (q.Ascending && len(q.Tags) > 0) {
+		// receipt order only roughly follows IDs, and producer clocks not
+		// at all, so sort every match
+		all := s.newest(Query{Tags: q.Tags}, q.Match)
+		switch q.OrderBy {
+		case "received_at":
+			slices.SortStableFunc(all, func(a, b event.Event) int {
+				return cmp.Or(a.ReceivedAt.Compare(b.ReceivedAt), cmp.Compare(a.ID, b.ID))
+			})
+		case "occurred_at":
+			slices.SortStableFunc(all, func(a, b event.Event) int {
+				return cmp.Or(a.Occurred().Compare(b.Occurred()), cmp.Compare(a.ID, b.ID))
+			})
+		}
+		if q.OrderBy == "" || q.OrderBy == "id" || !q.Ascending {
+			slices.Reverse(all)
+		}
+		if q.Limit > 0 && len(all) > q.Limit {
+			all = all[:q.Limit]
+		}
+		return all, nil
+	}
+	if q.Ascending {
+		for id := s.lowest(); id <= s.seq.Load() && !full(); id++ {
+			if e := s.at(id); e != nil && q.Match(e) {
+				out = append(out, *e)
+			}
+		}
+		return out, nil
+	}
+	return s.newest(q, q.Match), nil
+}
+
+// newest returns the events match keeps, highest ID first, up to q.Limit.
+// Only the Tags, BeforeID and Limit of q are used. The caller holds every
+// shard's lock.
+func (s *Memory) newest(q Query, match func(*event.Event) bool) []event.Event {
+	out := []event.Event{}
+	full := func() bool { return q.Limit > 0 && len(out) >= q.Limit }
+	if len(q.Tags) > 0 {
+		// merge the shards' shortest posting lists, highest ID first
+		cursors := make([][]int64, len(s.shards))
+		for i, sh := range s.shards {
+			for j, t := range q.Tags {
+				if p := sh.tags[t]; j == 0 || len(p) < len(cursors[i]) {
+					cursors[i] = p
+				}
+			}
+		}
+		for !full() {
+			best := -1
+			for i, c := range cursors {
+				if len(c) > 0 && (best < 0 || c[len(c)-1] > cursors[best][len(cursors[best])-1]) {
+					best = i
+				}
+			}
+			if best < 0 {
+				break
+			}
+			c := cursors[best]
+			id := c[len(c)-1]
+			cursors[best] = c[:len(c)-1]
+			if e := s.at(id); e != nil && match(e) {
+				out = append(out, *e)
+			}
+		}
+		return out
+	}
+	// IDs are dense, so walking them downwards visits events newest first
+	top := s.seq.Load()
+	if q.BeforeID > 0 {
+		top = min(top, q.BeforeID-1)
+	}
+	for id, low := top, s.lowest(); id >= low && !full(); id-- {
+		if e := s.at(id); e != nil && match(e) {
+			out = append(out, *e)
+		}
+	}
+	return out
+}
+
+// eventTypes returns the types of the events stored, for warming a hot
+// tier.
+func (s *Memory) eventTypes(context.Context, int64) ([]string, error) {
+	seen := map[string]bool{}
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for _, e := range sh.events {
+			if e != nil && e != purgedSlot {
+				seen[e.Type] = true
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return slices.Sorted(maps.Keys(seen)), nil
+}
+
+// at returns the event with the given ID, or nil while its Add is still in
+// flight or once it is purged. The caller holds the shard's lock.
+func (s *Memory) at(id int64) *event.Event {
+	n := int64(len(s.shards))
+	sh, slot := s.shards[(id-1)%n], int((id-1)/n)
+	slot -= sh.base
+	if slot < 0 || slot >= len(sh.events) || sh.events[slot] == purgedSlot {
+		return nil
+	}
+	return sh.events[slot]
+}
+
+// purged reports whether the event with the given ID was purged. The caller
+// holds the shard's lock.
+func (s *Memory) purged(id int64) bool {
+	n := int64(len(s.shards))
+	sh, slot := s.shards[(id-1)%n], int((id-1)/n)
+	slot -= sh.base
+	return slot < 0 || (slot < len(sh.events) && sh.events[slot] == purgedSlot)
+}
+
+// lowest returns the lowest ID that may still be held: below it every slot
+// was purged and dropped. The caller holds every shard's lock.
+func (s *Memory) lowest() int64 {
+	n := int64(len(s.shards))
+	low := s.seq.Load() + 1
+	for i, sh := range s.shards {
+		low = min(low, int64(sh.base)*n+int64(i)+1)
+	}
+	return max(low, 1)
+}
+
+func (s *Memory) Purge(ctx context.Context, q Query) (int64, error) {
+	if err := q.Validate(); err != nil {
+		return 0, err
+	}
+	q.FromID, q.purge = 0, true
+	q = q.Compile()
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		defer sh.mu.Unlock()
+	}
+	var purged []int64
+	// newest holds the type and partition key of the events walked, which
+	// supersede the older ones
+	type key struct{ typ, key string }
+	newest := map[key]bool{}
+	n := int64(len(s.shards))
+	for id, low := s.seq.Load(), s.lowest(); id >= low; id-- {
+		e := s.at(id)
+		if e == nil || !q.Match(e) {
+			continue
+		}
+		if q.Superseded {
+			k := key{e.Type, e.PartitionKey}
+			if k.key == "" || !newest[k] {
+				newest[k] = true
+				continue
+			}
+		}
+		sh := s.shards[(id-1)%n]
+		for _, t := range e.Tags {
+			ids := sh.tags[t]
+			if i, ok := slices.BinarySearch(ids, id); ok {
+				ids = slices.Delete(ids, i, i+1)
+			}
+			if len(ids) == 0 {
+				delete(sh.tags, t)
+			} else {
+				sh.tags[t] = ids
+			}
+		}
+		// mark the slot so IDs stay dense for the cursor walk
+		sh.events[int((id-1)/n)-sh.base] = purgedSlot
+		purged = append(purged, id)
+	}
+	// drop the purged slots at the start of each shard; the backing array
+	// goes once the shard grows into a new one
+	for _, sh := range s.shards {
+		k := 0
+		for k < len(sh.events) && sh.events[k] == purgedSlot {
+			k++
+		}
+		clear(sh.events[:k])
+		sh.events = sh.events[k:]
+		sh.base += k
+	}
+	s.mu.Lock()
+	for _, id := range purged {
+		delete(s.scheduled, id)
+		delete(s.annotations, id)
+		for _, ds := range s.outbox {
+			delete(ds, id)
+		}
+	}
+	s.mu.Unlock()
+	return int64(len(purged)), nil
+}
+
+func (s *Memory) Get(ctx context.Context, id int64) (event.Event, error) {
+	if id <= 0 || id > s.seq.Load() {
+		return event.Event{}, ErrNotFound
+	}
+	sh := s.shards[(id-1)%int64(len(s.shards))]
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	e := s.at(id)
+	if e == nil || e.Expired(time.Now()) || e.DeletedAt != nil {
+		return event.Event{}, ErrNotFound
+	}
+	return *e, nil
+}
+
+func (s *Memory) GetMany(ctx context.Context, ids []int64) ([]event.Event, error) {
+	out := make([]event.Event, 0, len(ids))
+	for _, id := range ids {
+		if e, err := s.Get(ctx, id); err == nil {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+func (s *Memory) Trash(ctx context.Context, id int64) (event.Event, error) {
+	return s.setDeleted(id, true)
+}
+
+func (s *Memory) Restore(ctx context.Context, id int64) (event.Event, error) {
+	return s.setDeleted(id, false)
+}
+
+// setDeleted moves the event id into the trash, or out of it.
+func (s *Memory) setDeleted(id int64, trash bool) (event.Event, error) {
+	if id <= 0 || id > s.seq.Load() {
+		return event.Event{}, ErrNotFound
+	}
+	sh := s.shards[(id-1)%int64(len(s.shards))]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	e := s.at(id)
+	if e == nil || e.Expired(time.Now()) || (e.DeletedAt != nil) == trash {
+		return event.Event{}, ErrNotFound
+	}
+	e.DeletedAt = nil
+	if trash {
+		at := time.Now().UTC()
+		e.DeletedAt = &at
+	}
+	return *e, nil
+}
+
+// Annotate holds the event's shard lock, as Purge does, so an annotation
+// cannot outlive its event.
+func (s *Memory) Annotate(ctx context.Context, a Annotation) (Annotation, error) {
+	if a.EventID <= 0 || a.EventID > s.seq.Load() {
+		return Annotation{}, ErrNotFound
+	}
+	sh := s.shards[(a.EventID-1)%int64(len(s.shards))]
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	if s.at(a.EventID) == nil {
+		return Annotation{}, ErrNotFound
+	}
+	if a.Time.IsZero() {
+		a.Time = time.Now().UTC()
+	}
+	a.Annotations = maps.Clone(a.Annotations)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if int64(len(s.annotations[a.EventID])) != a.Version-1 {
+		return Annotation{}, ErrVersionMismatch
+	}
+	s.annotations[a.EventID] = append(s.annotations[a.EventID], a)
+	return a, nil
+}
+
+func (s *Memory) Annotations(ctx context.Context, id int64) ([]Annotation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Annotation, 0, len(s.annotations[id]))
+	for _, a := range s.annotations[id] {
+		a.Annotations = maps.Clone(a.Annotations)
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+func (s *Memory) Stats(ctx context.Context, q Query, bucket time.Duration) (*Stats, error) {
+	if err := ValidateStats(q, bucket); err != nil {
+		return nil, err
+	}
+	q.Limit = 0
+	events, err := s.List(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	st := newStats(q, bucket)
+	byType := map[string]*TypeStats{}
+	for i := range events {
+		e := &events[i]
+		size := int64(len(e.Payload))
+		t, ok := byType[e.Type]
+		if !ok {
+			t = &TypeStats{Type: e.Type, MinPayloadBytes: size, MaxPayloadBytes: size}
+			byType[e.Type] = t
+		}
+		t.Count++
+		t.MinPayloadBytes = min(t.MinPayloadBytes, size)
+		t.MaxPayloadBytes = max(t.MaxPayloadBytes, size)
+		t.AvgPayloadBytes += float64(size)
+		st.addBucket(int(e.ReceivedAt.Sub(q.Since)/bucket), 1)
+	}
+	for _, t := range byType {
+		t.AvgPayloadBytes /= float64(t.Count)
+		st.addType(*t)
+	}
+	return st.finish(), nil
+}
+
+func (s *Memory) Scheduled(ctx context.Context) ([]event.Event, error) {
+	s.mu.Lock()
+	ids := make([]int64, 0, len(s.scheduled))
+	for id := range s.scheduled {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	out := []event.Event{}
+	for _, id := range ids {
+		n := int64(len(s.shards))
+		sh := s.shards[(id-1)%n]
+		sh.mu.RLock()
+		if e := s.at(id); e != nil {
+			out = append(out, *e)
+		}
+		sh.mu.RUnlock()
+	}
+	slices.SortFunc(out, func(a, b event.Event) int { return a.DeliverAt.Compare(*b.DeliverAt) })
+	return out, nil
+}
+
+func (s *Memory) Release(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.scheduled, id)
+	return nil
+}
+
+func (s *Memory) Consumers(ctx context.Context) ([]Consumer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Consumer, 0, len(s.consumers))
+	for _, c := range s.consumers {
+		c.Types = slices.Clone(c.Types)
+		out = append(out, c)
+	}
+	slices.SortFunc(out, func(a, b Consumer) int { return strings.Compare(a.Name, b.Name) })
+	return out, nil
+}
+
+func (s *Memory) SaveConsumer(ctx context.Context, c Consumer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.Types = slices.Clone(c.Types)
+	s.consumers[c.Name] = c
+	return nil
+}
+
+func (s *Memory) AppendAudit(ctx context.Context, e AuditEntry) (AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.ID = int64(len(s.audit)) + 1
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	s.audit = append(s.audit, e)
+	return e, nil
+}
+
+func (s *Memory) Audit(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []AuditEntry{}
+	for i := len(s.audit) - 1; i >= 0 && len(out) < q.limit(); i-- {
+		if q.match(&s.audit[i]) {
+			out = append(out, s.audit[i])
+		}
+	}
+	return out, nil
+}
+
+func (s *Memory) AddUsage(ctx context.Context, us []Usage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range us {
+		id := usageID{u.Hour.UnixNano(), u.Key, u.Tenant}
+		cur, ok := s.usage[id]
+		if !ok {
+			cur = Usage{Hour: u.Hour.UTC(), Key: u.Key, Tenant: u.Tenant}
+		}
+		cur.Events += u.Events
+		cur.Bytes += u.Bytes
+		cur.Rejected += u.Rejected
+		s.usage[id] = cur
+	}
+	return nil
+}
+
+func (s *Memory) Usage(ctx context.Context, q UsageQuery) ([]Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []Usage{}
+	for _, u := range s.usage {
+		if q.match(&u) {
+			out = append(out, u)
+		}
+	}
+	slices.SortFunc(out, compareUsage)
+	return out, nil
+}
+
+func (s *Memory) Close() error { return nil }
+
+func (s *Memory) SaveIdempotent(ctx context.Context, r IdempotentResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// expired responses are swept at most once a minute
+	if now := time.Now(); now.Sub(s.idemSwept) > time.Minute {
+		for k, v := range s.idem {
+			if !v.Expires.After(now) {
+				delete(s.idem, k)
+			}
+		}
+		s.idemSwept = now
+	}
+	s.idem[r.Key] = r
+	return nil
+}
+
+func (s *Memory) IdempotentResponses(ctx context.Context) ([]IdempotentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	out := []IdempotentResponse{}
+	for _, v := range s.idem {
+		if v.Expires.After(now) {
+			out = append(out, v)
+		}
+	}
+	return out, nil
+}
+
+func (s *Memory) SaveReceipt(ctx context.Context, r Receipt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now := time.Now(); now.Sub(s.receiptsSwept) > time.Minute {
+		for id, v := range s.receipts {
+			if !v.ExpiresAt.After(now) {
+				delete(s.receipts, id)
+			}
+		}
+		s.receiptsSwept = now
+	}
+	r.EventIDs = slices.Clone(r.EventIDs)
+	s.receipts[r.ID] = r
+	return nil
+}
+
+func (s *Memory) Receipts(ctx context.Context, ids ...string) ([]Receipt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	out := []Receipt{}
+	for _, id := range ids {
+		if r, ok := s.receipts[id]; ok && r.ExpiresAt.After(now) {
+			r.EventIDs = slices.Clone(r.EventIDs)
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+func (s *Memory) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if l, ok := s.leases[name]; ok && l.holder != holder && l.expires.After(now) {
+		return false, nil
+	}
+	s.leases[name] = lease{holder: holder, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (s *Memory) ReleaseLease(ctx context.Context, name, holder string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leases[name].holder == holder {
+		delete(s.leases, name)
+	}
+	return nil
+}
+
+func (s *Memory) Tenants(ctx context.Context) ([]Tenant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Tenant, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		out = append(out, t)
+	}
+	slices.SortFunc(out, func(a, b Tenant) int { return strings.Compare(a.Config.Name, b.Config.Name) })
+	return out, nil
+}
+
+func (s *Memory) SaveTenant(ctx context.Context, t Tenant) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tenants[t.Config.Name] = t
+	return nil
+}
+
+func (s *Memory) DeleteTenant(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tenants, name)
+	return nil
+}
+
+func (s *Memory) ACLRules(ctx context.Context) ([]ACLRule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]ACLRule, 0, len(s.aclRules))
+	for _, r := range s.aclRules {
+		r.Actions, r.Types = slices.Clone(r.Actions), slices.Clone(r.Types)
+		out = append(out, r)
+	}
+	slices.SortFunc(out, func(a, b ACLRule) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return out, nil
+}
+
+func (s *Memory) SaveACLRule(ctx context.Context, r ACLRule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r.Actions, r.Types = slices.Clone(r.Actions), slices.Clone(r.Types)
+	s.aclRules[r.ID] = r
+	return nil
+}
+
+func (s *Memory) DeleteACLRule(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.aclRules, id)
+	return nil
+}
+
+func (s *Memory) TenantKeys(ctx context.Context) ([]TenantKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []TenantKey{}
+	for _, ks := range s.tenantKeys {
+		out = append(out, ks...)
+	}
+	slices.SortFunc(out, func(a, b TenantKey) int {
+		if c := strings.Compare(a.Tenant, b.Tenant); c != 0 {
+			return c
+		}
+		return a.Version - b.Version
+	})
+	return out, nil
+}
+
+func (s *Memory) SaveTenantKey(ctx context.Context, k TenantKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.ContainsFunc(s.tenantKeys[k.Tenant], func(v TenantKey) bool { return v.Version == k.Version }) {
+		return fmt.Errorf("tenant %s key version %d exists", k.Tenant, k.Version)
+	}
+	k.Wrapped = slices.Clone(k.Wrapped)
+	s.tenantKeys[k.Tenant] = append(s.tenantKeys[k.Tenant], k)
+	return nil
+}
+
+func (s *Memory) DeleteTenantKeys(ctx context.Context, tenant string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.tenantKeys[tenant] {
+		clear(k.Wrapped)
+	}
+	delete(s.tenantKeys, tenant)
+	return nil
+}
+
+func (s *Memory) Deliveries(ctx context.Context, sink string, now time.Time, limit int, byKey bool) ([]Delivery, error) {
+	s.mu.Lock()
+	var due, retrying []Delivery
+	for id, d := range s.outbox[sink] {
+		d.Event.ID = id
+		switch {
+		case d.Dead:
+		case !d.NextAttempt.After(now):
+			due = append(due, d)
+		case byKey && d.Attempts > 0:
+			retrying = append(retrying, d)
+		}
+	}
+	s.mu.Unlock()
+	slices.SortFunc(due, func(a, b Delivery) int { return cmp.Compare(a.Event.ID, b.Event.ID) })
+	n := int64(len(s.shards))
+	load := func(id int64) (event.Event, bool) {
+		sh := s.shards[(id-1)%n]
+		sh.mu.RLock()
+		defer sh.mu.RUnlock()
+		if e := s.at(id); e != nil {
+			return *e, true
+		}
+		return event.Event{}, false
+	}
+	// the oldest delivery waiting for its retry holds back its key
+	held := map[string]int64{}
+	for _, d := range retrying {
+		if e, ok := load(d.Event.ID); ok && e.PartitionKey != "" {
+			if first, ok := held[e.PartitionKey]; !ok || d.Event.ID < first {
+				held[e.PartitionKey] = d.Event.ID
+			}
+		}
+	}
+	out := []Delivery{}
+	for _, d := range due {
+		if len(out) >= limit {
+			break
+		}
+		e, ok := load(d.Event.ID)
+		if !ok {
+			continue
+		}
+		if first, ok := held[e.PartitionKey]; ok && e.PartitionKey != "" && first < e.ID {
+			continue
+		}
+		d.Event = e
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+func (s *Memory) DeadDeliveries(ctx context.Context, sink string, limit int) ([]Delivery, error) {
+	s.mu.Lock()
+	var dead []Delivery
+	for name, ds := range s.outbox {
+		if sink != "" && name != sink {
+			continue
+		}
+		for id, d := range ds {
+			if d.Dead {
+				d.Event.ID = id
+				dead = append(dead, d)
+			}
+		}
+	}
+	s.mu.Unlock()
+	slices.SortFunc(dead, func(a, b Delivery) int {
+		return cmp.Or(cmp.Compare(b.Event.ID, a.Event.ID), strings.Compare(a.Sink, b.Sink))
+	})
+	out := []Delivery{}
+	n := int64(len(s.shards))
+	for _, d := range dead {
+		if limit > 0 && len(out) >= limit {
+			break
+		}
+		sh := s.shards[(d.Event.ID-1)%n]
+		sh.mu.RLock()
+		e := s.at(d.Event.ID)
+		if e != nil {
+			d.Event = *e
+		}
+		sh.mu.RUnlock()
+		if e != nil {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+func (s *Memory) AckDeliveries(ctx context.Context, sink string, ids ...int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		delete(s.outbox[sink], id)
+	}
+	return nil
+}
+
+func (s *Memory) RetryDeliveries(ctx context.Context, ds []Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range ds {
+		id := d.Event.ID
+		if _, ok := s.outbox[d.Sink][id]; ok {
+			d.Event = event.Event{}
+			s.outbox[d.Sink][id] = d
+		}
+	}
+	return nil
+}
+
+func (s *Memory) OutboxDepth(ctx context.Context) (map[string]OutboxCount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]OutboxCount, len(s.outbox))
+	for sink, ds := range s.outbox {
+		var c OutboxCount
+		for _, d := range ds {
+			if d.Dead {
+				c.Dead++
+			} else {
+				c.Pending++
+			}
+		}
+		out[sink] = c
+	}
+	return out, nil
+}
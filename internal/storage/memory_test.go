@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+func TestMemoryListNewestFirst(t *testing.T) {
+	s := NewMemory(4)
+	var wg sync.WaitGroup
+	for i := range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e := event.Event{Type: "t", Payload: json.RawMessage(fmt.Sprint(i))}
+			if i%3 == 0 {
+				e.Tags = []string{"three"}
+			}
+			_, _ = s.Add(context.Background(), e)
+		}()
+	}
+	wg.Wait()
+
+	all, err := s.List(context.Background(), Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 100 {
+		t.Fatalf("got %d events, want 100", len(all))
+	}
+	for i, e := range all {
+		if want := int64(100 - i); e.ID != want {
+			t.Fatalf("event %d has ID %d, want %d", i, e.ID, want)
+		}
+	}
+
+	tagged, err := s.List(context.Background(), Query{Tags: []string{"three"}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tagged) != 10 {
+		t.Fatalf("got %d tagged events, want 10", len(tagged))
+	}
+	for i := 1; i < len(tagged); i++ {
+		if tagged[i].ID >= tagged[i-1].ID || !tagged[i].HasTag("three") {
+			t.Fatalf("tagged results out of order or untagged: %v", tagged)
+		}
+	}
+}
+
+func TestMemoryExpiredEvents(t *testing.T) {
+	s := NewMemory(2)
+	past := time.Now().Add(-time.Second)
+	expired, _ := s.Add(context.Background(), event.Event{Type: "t", Payload: json.RawMessage("1"), ExpiresAt: &past})
+	live, _ := s.Add(context.Background(), event.Event{Type: "t", Payload: json.RawMessage("2")})
+
+	all, err := s.List(context.Background(), Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].ID != live.ID {
+		t.Fatalf("got %v, want only event %d", all, live.ID)
+	}
+	if _, err := s.Get(context.Background(), expired.ID); err != ErrNotFound {
+		t.Fatalf("get expired event: got %v, want ErrNotFound", err)
+	}
+	if n, err := PurgeExpired(context.Background(), s); err != nil || n != 1 {
+		t.Fatalf("purged %d expired events (%v), want 1", n, err)
+	}
+	// Purge deletes expired events with the rest
+	_, _ = s.Add(context.Background(), event.Event{Type: "t", Payload: json.RawMessage("3"), ExpiresAt: &past})
+	if n, err := s.Purge(context.Background(), Query{}); err != nil || n != 2 {
+		t.Fatalf("purged %d events (%v), want 2", n, err)
+	}
+}
+
+// BenchmarkMemoryAdd compares a single lock (shards=1, like the former
+// store) with the default sharding under parallel writers.
+func BenchmarkMemoryAdd(b *testing.B) {
+	for _, n := range []int{1, 0} {
+		name := fmt.Sprintf("shards=%d", n)
+		if n == 0 {
+			name = "shards=default"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := NewMemory(n)
+			e := event.Event{Type: "bench", Payload: json.RawMessage(`{"n":1}`), Tags: []string{"a"}}
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, _ = s.Add(context.Background(), e)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkMemoryMixed runs 9 writes per read of the latest page, the
+// workload where the global mutex used to dominate p99 latency.
+func BenchmarkMemoryMixed(b *testing.B) {
+	for _, n := range []int{1, 0} {
+		name := fmt.Sprintf("shards=%d", n)
+		if n == 0 {
+			name = "shards=default"
+		}
+		b.Run(name, func(b *testing.B) {
+			s := NewMemory(n)
+			e := event.Event{Type: "bench", Payload: json.RawMessage(`{"n":1}`)}
+			for range 10_000 {
+				_, _ = s.Add(context.Background(), e)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					if i++; i%10 == 0 {
+						_, _ = s.List(context.Background(), Query{Limit: 50})
+					} else {
+						_, _ = s.Add(context.Background(), e)
+					}
+				}
+			})
+		})
+	}
+}
+
+// TestMemoryPurgeFreesSlots drops the slots of a purged prefix and keeps
+// cursor reads, gets and lists correct around purged events.
+func TestMemoryPurgeFreesSlots(t *testing.T) {
+	s := NewMemory(2)
+	past := time.Now().Add(-time.Second)
+	for i := range 10 {
+		e := event.Event{Type: "t", Payload: json.RawMessage(fmt.Sprint(i))}
+		if i < 6 || i == 8 {
+			e.ExpiresAt = &past
+		}
+		_, _ = s.Add(context.Background(), e)
+	}
+	if n, err := PurgeExpired(context.Background(), s); err != nil || n != 7 {
+		t.Fatalf("purged %d events (%v), want 7", n, err)
+	}
+	for i, sh := range s.shards {
+		if sh.base != 3 {
+			t.Errorf("shard %d starts at slot %d, want 3", i, sh.base)
+		}
+	}
+	if low := s.lowest(); low != 7 {
+		t.Errorf("lowest ID %d, want 7", low)
+	}
+
+	for _, tc := range []struct {
+		name string
+		q    Query
+		want []int64
+	}{
+		{"newest", Query{}, []int64{10, 8, 7}},
+		{"ascending", Query{Ascending: true}, []int64{7, 8, 10}},
+		{"from purged", Query{FromID: 2}, []int64{7, 8, 10}},
+		{"from hole", Query{FromID: 9}, []int64{10}},
+	} {
+		got, err := s.List(context.Background(), tc.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		for _, e := range got {
+			ids = append(ids, e.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, ids, tc.want)
+		}
+	}
+	for id, ok := range map[int64]bool{1: false, 6: false, 9: false, 7: true, 10: true} {
+		if _, err := s.Get(context.Background(), id); (err == nil) != ok {
+			t.Errorf("get %d: %v", id, err)
+		}
+	}
+
+	// a later event lands at its slot past the dropped ones
+	e, _ := s.Add(context.Background(), event.Event{Type: "t", Payload: json.RawMessage("10")})
+	if got, err := s.Get(context.Background(), e.ID); err != nil || got.ID != 11 {
+		t.Errorf("get new event: %v, %v", got, err)
+	}
+}
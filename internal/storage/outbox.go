@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// Delivery is the outbox entry of an event for one sink. It is deleted once
+// the sink accepts the event.
+type Delivery struct {
+	Sink     string
+	Event    event.Event
+	Attempts int
+	// NextAttempt is when the delivery is due: the event's DeliverAt or
+	// ReceivedAt at first, then pushed back after each failure.
+	NextAttempt time.Time
+	LastError   string
+	// Dead deliveries have run out of attempts and are no longer retried.
+	Dead bool
+}
+
+// OutboxCount is the number of deliveries left to a sink.
+type OutboxCount struct {
+	Pending int64
+	Dead    int64
+}
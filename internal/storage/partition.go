@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	partitionsDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "storage_partitions_dropped_total", Help: "Event partitions dropped by retention"},
+	)
+	partitionEventsDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{Name: "storage_partition_events_dropped_total", Help: "Events deleted with their partition by retention"},
+	)
+)
+
+// Partition is a time partition of the events: the IDs from FirstID to
+// LastID, received in [Start, End).
+type Partition struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	FirstID int64     `json:"first_id"`
+	LastID  int64     `json:"last_id"`
+	// Events and PayloadBytes count what is left of the partition after
+	// purges and deletes.
+	Events       int64 `json:"events"`
+	PayloadBytes int64 `json:"payload_bytes"`
+}
+
+// Partitioner is implemented by stores that can keep events in time
+// partitions, see config.StorageConfig.Partition.
+type Partitioner interface {
+	// Partitions returns the partitions, oldest first.
+	Partitions() ([]Partition, error)
+	// DropPartitions deletes the partitions that end at or before before,
+	// with their events, their pending deliveries and annotations, and
+	// returns them.
+	DropPartitions(before time.Time) ([]Partition, error)
+}
+
+// partition records event id, received at, in the open partition, opening
+// the next one once at is past its end. An event received while the clock
+// is behind the open partition joins it, so partitions never overlap. The
+// caller holds the write transaction.
+func (s *SQLite) partition(tx *sql.Tx, id int64, at time.Time) error {
+	var start, end int64
+	err := tx.QueryRow(`SELECT start, end FROM event_partitions ORDER BY start DESC LIMIT 1`).Scan(&start, &end)
+	switch {
+	case err == nil && at.UnixNano() < end:
+		_, err = tx.Exec(`UPDATE event_partitions SET last_id = ? WHERE start = ?`, id, start)
+		return err
+	case err != nil && !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+	// a wider partition than before may start inside the last one
+	next := max(at.Truncate(s.width).UnixNano(), end)
+	_, err = tx.Exec(`INSERT INTO event_partitions (start, end, first_id, last_id) VALUES (?, ?, ?, ?)`,
+		next, at.Truncate(s.width).Add(s.width).UnixNano(), id, id)
+	return err
+}
+
+// backfillPartitions partitions the events stored while partitioning was
+// off, by their receive time. Partitions start where time.Truncate puts
+// them, on Mondays for weeks, which the Unix epoch is not: shift moves
+// the epoch back onto a boundary.
+func (s *SQLite) backfillPartitions() error {
+	w := int64(s.width)
+	epoch := time.Unix(0, 0)
+	shift := int64(epoch.Sub(epoch.Truncate(s.width)))
+	_, err := s.db.Exec(`INSERT INTO event_partitions (start, end, first_id, last_id)
+		SELECT (received_at + ?) / ? * ? - ?, (received_at + ?) / ? * ? - ? + ?, MIN(id), MAX(id) FROM events
+		WHERE id > (SELECT COALESCE(MAX(last_id), 0) FROM event_partitions)
+		GROUP BY (received_at + ?) / ? ORDER BY 1
+		ON CONFLICT (start) DO UPDATE SET last_id = MAX(last_id, excluded.last_id)`,
+		shift, w, w, shift, shift, w, w, shift, w, shift, w)
+	return err
+}
+
+func (s *SQLite) Partitions() ([]Partition, error) {
+	rows, err := s.readers.primary.Query(`SELECT p.start, p.end, p.first_id, p.last_id,
+			COUNT(e.id), COALESCE(SUM(length(CAST(e.payload AS BLOB))), 0)
+		FROM event_partitions p LEFT JOIN events e ON e.id BETWEEN p.first_id AND p.last_id
+		GROUP BY p.start ORDER BY p.start`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Partition
+	for rows.Next() {
+		var p Partition
+		var start, end int64
+		if err := rows.Scan(&start, &end, &p.FirstID, &p.LastID, &p.Events, &p.PayloadBytes); err != nil {
+			return nil, err
+		}
+		p.Start, p.End = time.Unix(0, start).UTC(), time.Unix(0, end).UTC()
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// DropPartitions deletes each partition by its ID range, one transaction
+// per partition, relying on the foreign keys like Purge.
+func (s *SQLite) DropPartitions(before time.Time) ([]Partition, error) {
+	rows, err := s.db.Query(`SELECT start, end, first_id, last_id FROM event_partitions WHERE end <= ? ORDER BY start`, before.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	var due []Partition
+	for rows.Next() {
+		var p Partition
+		var start, end int64
+		if err := rows.Scan(&start, &end, &p.FirstID, &p.LastID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		p.Start, p.End = time.Unix(0, start).UTC(), time.Unix(0, end).UTC()
+		due = append(due, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var dropped []Partition
+	for _, p := range due {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return dropped, err
+		}
+		res, err := tx.Exec(`DELETE FROM events WHERE id BETWEEN ? AND ?`, p.FirstID, p.LastID)
+		if err == nil {
+			p.Events, err = res.RowsAffected()
+		}
+		if err == nil {
+			_, err = tx.Exec(`DELETE FROM event_partitions WHERE start = ?`, p.Start.UnixNano())
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return dropped, err
+		}
+		partitionsDropped.Inc()
+		partitionEventsDropped.Add(float64(p.Events))
+		dropped = append(dropped, p)
+	}
+	return dropped, nil
+}
+
+// partitionBounds narrows a time range of q to the IDs of the partitions
+// it overlaps, which SQLite scans as a rowid range.
+func partitionBounds(q Query) ([]string, []any) {
+	var where []string
+	var args []any
+	if !q.Since.IsZero() {
+		where = append(where, `id >= COALESCE((SELECT MIN(first_id) FROM event_partitions WHERE end > ?), 0)`)
+		args = append(args, q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		where = append(where, `id <= COALESCE((SELECT MAX(last_id) FROM event_partitions WHERE start < ?), 0)`)
+		args = append(args, q.Until.UnixNano())
+	}
+	return where, args
+}
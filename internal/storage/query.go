@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/typematch"
+)
+
+// Query selects events for List.
+type Query struct {
+	// Limit caps the number of events returned; <= 0 means no limit.
+	Limit int
+	// Fields filters on top-level payload fields by equality. Values are
+	// compared against the field's scalar rendering (see event.ScalarString),
+	// so payload.user_id=42 matches both 42 and "42".
+	Fields map[string]string
+	// NotFields drops events whose field renders as the value, the way
+	// Fields compares; events without the field, or with an object or array
+	// in it, are kept.
+	NotFields map[string]string
+	// Tags keeps events carrying every listed tag.
+	Tags []string
+	// Types keeps events whose type matches any of the patterns, where *
+	// matches any run of characters and ? a single one (see typematch).
+	Types []string
+	// NotTypes drops events whose type matches any of the patterns.
+	NotTypes []string
+	// types and notTypes are Types and NotTypes compiled by Compile.
+	types, notTypes *typematch.Set
+	// CorrelationID and CausationID, when set, keep the events carrying that
+	// ID.
+	CorrelationID, CausationID string
+	// Since and Until bound ReceivedAt to [Since, Until); zero means unbounded.
+	Since, Until time.Time
+	// FromID, when > 0, keeps events with an ID of at least FromID and makes
+	// List return them oldest first, for readers resuming from a cursor.
+	// Events still being added never let the cursor skip past them.
+	FromID int64
+	// BeforeID, when > 0, keeps events with an ID below it, for readers
+	// paging newest first.
+	BeforeID int64
+	// OrderBy is "id" (the default), "received_at" or "occurred_at", the
+	// latter falling back to received_at for events without occurred_at;
+	// List returns events newest first unless Ascending. FromID always
+	// lists by ascending ID.
+	OrderBy   string
+	Ascending bool
+	// MinID, when > 0, comes from a consistency token: the result must
+	// reflect every event up to that ID, so only replicas that caught up to
+	// it may answer.
+	MinID int64
+	// Expired, when set, keeps only the events whose ExpiresAt has passed,
+	// for the retention janitor. Otherwise expired events are left out as
+	// if already deleted, except by Purge, which deletes them with the rest.
+	Expired bool
+	// Trashed, when set, keeps only the events in the trash, those deleted
+	// before TrashedBefore when it is set too. Otherwise trashed events are
+	// left out like expired ones, except by Purge.
+	Trashed       bool
+	TrashedBefore time.Time
+	// Superseded keeps only the events with a partition key that a newer
+	// event of the same type and key supersedes, for compaction. Only Purge
+	// supports it.
+	Superseded bool
+	// purge is set by Purge, so that expired and trashed events match
+	// unless Expired or Trashed picks them alone.
+	purge bool
+}
+
+var fieldName = regexp.MustCompile(`^[A-Za-z0-9_\-]{1,64}$`)
+
+// SavedQuery resolves a named filter from the configuration. A relative
+// Last window is anchored at now.
+func SavedQuery(c config.SavedQueryConfig, now time.Time) Query {
+	q := Query{Types: c.Types, Tags: c.Tags, Fields: c.Fields, Since: c.Since, Until: c.Until}
+	if c.Last > 0 {
+		q.Since = now.Add(-c.Last)
+	}
+	return q
+}
+
+// Validate rejects malformed tags and field names that are not plain top-level keys.
+func (q Query) Validate() error {
+	if _, err := event.NormalizeTags(q.Tags); err != nil {
+		return err
+	}
+	for _, fields := range []map[string]string{q.Fields, q.NotFields} {
+		for name := range fields {
+			if !fieldName.MatchString(name) {
+				return fmt.Errorf("invalid payload field name %q", name)
+			}
+		}
+	}
+	for _, p := range slices.Concat(q.Types, q.NotTypes) {
+		if err := typematch.Validate(p); err != nil {
+			return err
+		}
+	}
+	switch q.OrderBy {
+	case "", "id", "received_at", "occurred_at":
+	default:
+		return fmt.Errorf("order_by: want id, received_at or occurred_at, got %q", q.OrderBy)
+	}
+	if !q.Since.IsZero() && !q.Until.IsZero() && !q.Until.After(q.Since) {
+		return fmt.Errorf("until must be after since")
+	}
+	return nil
+}
+
+// Match reports whether e satisfies the filters of q (everything but Limit).
+func (q Query) Match(e *event.Event) bool {
+	if expired := e.Expired(time.Now()); (q.Expired && !expired) || (!q.Expired && !q.purge && expired) {
+		return false
+	}
+	if trashed := e.DeletedAt != nil; (q.Trashed && !trashed) || (!q.Trashed && !q.purge && trashed) {
+		return false
+	}
+	if !q.TrashedBefore.IsZero() && (e.DeletedAt == nil || !e.DeletedAt.Before(q.TrashedBefore)) {
+		return false
+	}
+	if e.ID < q.FromID || (q.BeforeID > 0 && e.ID >= q.BeforeID) {
+		return false
+	}
+	if !q.Since.IsZero() && e.ReceivedAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !e.ReceivedAt.Before(q.Until) {
+		return false
+	}
+	if (q.CorrelationID != "" && e.CorrelationID != q.CorrelationID) || (q.CausationID != "" && e.CausationID != q.CausationID) {
+		return false
+	}
+	if len(q.Types) > 0 && !matchTypes(q.types, q.Types, e.Type) {
+		return false
+	}
+	if matchTypes(q.notTypes, q.NotTypes, e.Type) {
+		return false
+	}
+	for _, t := range q.Tags {
+		if !e.HasTag(t) {
+			return false
+		}
+	}
+	for name, want := range q.Fields {
+		raw, ok := e.Field(name)
+		if !ok {
+			return false
+		}
+		got, ok := event.ScalarString(raw)
+		if !ok || got != want {
+			return false
+		}
+	}
+	for name, unwanted := range q.NotFields {
+		if raw, ok := e.Field(name); ok {
+			if got, ok := event.ScalarString(raw); ok && got == unwanted {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Compile returns q with its type patterns compiled, for a query that is
+// matched against many events, like a subscription or a routing rule. Types
+// and NotTypes must not change afterwards.
+func (q Query) Compile() Query {
+	q.types, q.notTypes = typematch.Compile(q.Types), typematch.Compile(q.NotTypes)
+	return q
+}
+
+func matchTypes(set *typematch.Set, patterns []string, typ string) bool {
+	if set != nil {
+		return set.Match(typ)
+	}
+	return typematch.MatchAny(patterns, typ)
+}
@@ -0,0 +1,33 @@
+package storage
+
+import "time"
+
+// ReceiptStatus is how far the events of an async ingest request got.
+type ReceiptStatus string
+
+const (
+	ReceiptPending ReceiptStatus = "pending"
+	ReceiptStored  ReceiptStatus = "stored"
+	ReceiptFailed  ReceiptStatus = "failed"
+)
+
+// Receipt tracks an ingest request accepted with "Prefer: respond-async"
+// until its events are stored or fail, and for a while after, until
+// ExpiresAt.
+type Receipt struct {
+	ID     string        `json:"receipt_id"`
+	Status ReceiptStatus `json:"status"`
+	// Owner is the API key ID or token subject that sent the request, the
+	// only caller the receipt is shown to.
+	Owner string `json:"-"`
+	// Events is how many events the request carried.
+	Events int `json:"events"`
+	// EventIDs holds the ID of each event stored, in request order: the
+	// original's for a duplicate, 0 for one sampled out. A failed batch
+	// lists the events stored before the failure.
+	EventIDs   []int64    `json:"event_ids,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+}
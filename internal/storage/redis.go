@@ -0,0 +1,590 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/resp"
+)
+
+var (
+	redisReads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "storage_redis_reads_total", Help: "List and get queries by whether the Redis stream answered them (hit) or the store (miss)"},
+		[]string{"result"},
+	)
+	redisBacklog = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "storage_redis_backlog", Help: "Events stored but not yet added to the Redis stream, which was unreachable"},
+	)
+)
+
+const (
+	// redisPage is how many entries one read of the stream returns.
+	redisPage = 256
+	// maxRedisScan bounds the entries a list query reads from the stream
+	// before it leaves the query to the store.
+	maxRedisScan = 4096
+	// maxRedisBacklog bounds the events waiting for Redis; the oldest are
+	// given up beyond it.
+	maxRedisBacklog = 100_000
+	// maxRedisPurges bounds the purges the tier remembers, see RedisStream.
+	maxRedisPurges = 64
+)
+
+// RedisStream keeps the events added to a Store in a Redis stream, trimmed
+// to about MaxLen entries, in front of it. List and Get are answered from
+// the stream when its entries are provably the whole answer, and by the
+// store otherwise; everything else goes to the store. Entries hold the
+// events as stored, under the entry ID <event ID>-0, so that an event is
+// found by its ID and pull consumers can be served by consumer groups on
+// the stream (see consumer.NewRedis).
+//
+// Adds are serialized, keeping the entries in event ID order. The stream
+// answers for the events added since the tier opened, above its floor:
+// older events, and those of the trimmed part of the stream, are read from
+// the store. Events stored while Redis is unreachable wait in a backlog,
+// during which reads go to the store, and are added once it is back.
+//
+// Entries are not changed once added. The tier remembers the events moved
+// to the trash and the purges since, hiding what they deleted, and raises
+// the floor past what it cannot tell: compactions and dropped partitions.
+type RedisStream struct {
+	Store
+	pool   *resp.Pool
+	stream string
+	maxLen string
+	// last is the newest event added, behind the size of the backlog
+	last   atomic.Int64
+	behind atomic.Int64
+
+	// mu serializes Add and guards the backlog
+	mu      sync.Mutex
+	backlog []event.Event
+
+	state sync.RWMutex
+	// floor is the newest event the stream does not answer for
+	floor int64
+	// trashed holds the DeletedAt of the events above floor in the trash
+	trashed map[int64]time.Time
+	purges  []redisPurge
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// redisPurge is a purge of the events matching q up to the event upTo.
+type redisPurge struct {
+	q    Query
+	upTo int64
+}
+
+// NewRedisStream puts the stream cfg names in front of s. A stream holding
+// events newer than any s has, like a memory store's before a restart, is
+// deleted first.
+func NewRedisStream(s Store, cfg config.StorageRedisConfig) (*RedisStream, error) {
+	opts, err := resp.ParseURL(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("storage redis url: %w", err)
+	}
+	// the tier is built at startup, before any request
+	ctx := context.Background()
+	newest, err := s.List(ctx, Query{Limit: 1, purge: true})
+	if err != nil {
+		return nil, err
+	}
+	r := &RedisStream{
+		Store:   s,
+		pool:    resp.NewPool(opts, cfg.Timeout, 16),
+		stream:  cfg.Stream,
+		maxLen:  strconv.FormatInt(cfg.MaxLen, 10),
+		trashed: map[int64]time.Time{},
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if len(newest) > 0 {
+		r.floor = newest[0].ID
+		r.last.Store(r.floor)
+	}
+	replies, err := r.pool.Do(ctx, []string{"XREVRANGE", r.stream, "+", "-", "COUNT", "1"})
+	if err != nil {
+		r.pool.Close()
+		return nil, fmt.Errorf("storage redis: %w", err)
+	}
+	if top := entryIDs(replies[0]); len(top) > 0 && top[0] > r.floor {
+		log.Warn().Str("stream", r.stream).Int64("stream_top", top[0]).Int64("store_top", r.floor).
+			Msg("redis stream ahead of the store, deleting it")
+		if _, err := r.pool.Do(ctx, []string{"DEL", r.stream}); err != nil {
+			r.pool.Close()
+			return nil, fmt.Errorf("storage redis: %w", err)
+		}
+	}
+	go r.run()
+	return r, nil
+}
+
+func (r *RedisStream) Add(ctx context.Context, e event.Event, sinks ...string) (event.Event, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	created, err := r.Store.Add(ctx, e, sinks...)
+	if err != nil {
+		return created, err
+	}
+	r.backlog = append(r.backlog, created)
+	if n := len(r.backlog) - maxRedisBacklog; n > 0 {
+		// the stream no longer answers for the events given up
+		log.Error().Int("events", n).Str("stream", r.stream).Msg("redis backlog full, giving up its oldest events")
+		r.raiseFloor(r.backlog[n-1].ID)
+		r.backlog = r.backlog[n:]
+	}
+	r.flush(ctx)
+	return created, nil
+}
+
+// flush adds the backlog to the stream, keeping what Redis did not take.
+// The caller holds r.mu.
+func (r *RedisStream) flush(ctx context.Context) {
+	defer func() {
+		r.behind.Store(int64(len(r.backlog)))
+		redisBacklog.Set(float64(len(r.backlog)))
+	}()
+	for len(r.backlog) > 0 {
+		n := min(len(r.backlog), redisPage)
+		cmds := make([][]string, n)
+		for i, e := range r.backlog[:n] {
+			id := strconv.FormatInt(e.ID, 10)
+			data, err := json.Marshal(e)
+			if err != nil {
+				// the store answers for it; PING keeps the replies in step
+				log.Error().Err(err).Int64("id", e.ID).Msg("encode event for the redis stream")
+				r.raiseFloor(e.ID)
+				cmds[i] = []string{"PING"}
+				continue
+			}
+			cmds[i] = []string{"XADD", r.stream, "MAXLEN", "~", r.maxLen, id + "-0", "id", id, "type", e.Type, "event", string(data)}
+		}
+		replies, err := r.pool.Do(ctx, cmds...)
+		var reply resp.Error
+		if err != nil && !errors.As(err, &reply) {
+			log.Warn().Err(err).Int("backlog", len(r.backlog)).Str("stream", r.stream).Msg("redis stream unavailable")
+			return
+		}
+		for i, v := range replies {
+			e := &r.backlog[i]
+			if v == nil {
+				// an entry ID at or below the stream's newest: another
+				// writer added to the stream
+				log.Error().Int64("id", e.ID).Str("stream", r.stream).Msg("event out of order for the redis stream")
+				r.raiseFloor(e.ID)
+			}
+			r.last.Store(max(r.last.Load(), e.ID))
+		}
+		r.backlog = r.backlog[n:]
+	}
+	r.backlog = nil
+}
+
+// run retries the backlog, and forgets what the tier knew of trimmed
+// entries, every second until Close.
+func (r *RedisStream) run() {
+	defer close(r.stopped)
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-t.C:
+			if r.behind.Load() > 0 {
+				r.mu.Lock()
+				r.flush(context.Background())
+				r.mu.Unlock()
+			}
+			r.prune(context.Background())
+		}
+	}
+}
+
+// prune drops the trash and purges of events no longer in the stream,
+// which the store answers for.
+func (r *RedisStream) prune(ctx context.Context) {
+	r.state.RLock()
+	known := len(r.trashed) + len(r.purges)
+	r.state.RUnlock()
+	if known == 0 {
+		return
+	}
+	replies, err := r.pool.Do(ctx, []string{"XRANGE", r.stream, "-", "+", "COUNT", "1"})
+	if err != nil {
+		return
+	}
+	if oldest := entryIDs(replies[0]); len(oldest) > 0 {
+		r.raiseFloor(oldest[0] - 1)
+	}
+}
+
+func (r *RedisStream) List(ctx context.Context, q Query) ([]event.Event, error) {
+	out, ok, err := r.list(ctx, q)
+	if err != nil {
+		log.Warn().Err(err).Str("stream", r.stream).Msg("redis stream read failed, using the store")
+	}
+	if ok {
+		redisReads.WithLabelValues("hit").Inc()
+		return out, nil
+	}
+	redisReads.WithLabelValues("miss").Inc()
+	return r.Store.List(ctx, q)
+}
+
+// list answers q from the stream, reporting false when the entries read
+// may not be all of the answer.
+func (r *RedisStream) list(ctx context.Context, q Query) ([]event.Event, bool, error) {
+	if q.Expired || q.Trashed || (q.OrderBy != "" && q.OrderBy != "id") || q.Validate() != nil || r.behind.Load() > 0 {
+		return nil, false, nil
+	}
+	q = q.Compile()
+	r.state.RLock()
+	floor := r.floor
+	r.state.RUnlock()
+	ascending := q.FromID > 0 || q.Ascending
+	// the range of IDs to read, lo to hi
+	lo, hi := max(floor+1, q.FromID), int64(math.MaxInt64)
+	if q.BeforeID > 0 {
+		hi = q.BeforeID - 1
+	}
+	if (ascending && lo > max(q.FromID, 1)) || hi <= floor {
+		// the answer starts at or below the floor
+		return nil, false, nil
+	}
+	full := func(out []event.Event) bool { return q.Limit > 0 && len(out) >= q.Limit }
+	out := []event.Event{}
+	exhausted := false
+	for scanned := 0; !full(out) && !exhausted && scanned < maxRedisScan && lo <= hi; {
+		cmd := []string{"XRANGE", r.stream, strconv.FormatInt(lo, 10) + "-0", strconv.FormatInt(hi, 10) + "-0", "COUNT", strconv.Itoa(redisPage)}
+		if !ascending {
+			cmd = []string{"XREVRANGE", r.stream, cmd[3], cmd[2], "COUNT", cmd[5]}
+		}
+		replies, err := r.pool.Do(ctx, cmd)
+		if err != nil {
+			return nil, false, err
+		}
+		page, err := entryEvents(replies[0])
+		if err != nil {
+			return nil, false, err
+		}
+		exhausted = len(page) < redisPage
+		scanned += len(page)
+		r.state.RLock()
+		for i := range page {
+			e := &page[i]
+			if ascending {
+				lo = e.ID + 1
+			} else {
+				hi = e.ID - 1
+			}
+			if !full(out) && !r.hidden(e) && q.Match(e) {
+				out = append(out, *e)
+			}
+		}
+		r.state.RUnlock()
+	}
+	if !full(out) && !exhausted && lo <= hi {
+		return nil, false, nil
+	}
+	// entries trimmed while the stream was read are gone for good, so the
+	// oldest entry after reading bounds what it holds
+	replies, err := r.pool.Do(ctx, []string{"XRANGE", r.stream, "-", "+", "COUNT", "1"})
+	if err != nil {
+		return nil, false, err
+	}
+	held := r.last.Load()
+	if oldest := entryIDs(replies[0]); len(oldest) > 0 {
+		held = oldest[0] - 1
+	}
+	held = max(held, floor)
+	if ascending {
+		return out, max(q.FromID, 1) > held, nil
+	}
+	// short of the limit, the answer goes on below the floor unless there
+	// is nothing there
+	return out, full(out) || (held == floor && floor == 0), nil
+}
+
+func (r *RedisStream) Get(ctx context.Context, id int64) (event.Event, error) {
+	es, ok := r.get(ctx, []int64{id})
+	if e, held := es[id]; ok && held {
+		redisReads.WithLabelValues("hit").Inc()
+		if e == nil {
+			return event.Event{}, ErrNotFound
+		}
+		return *e, nil
+	}
+	redisReads.WithLabelValues("miss").Inc()
+	return r.Store.Get(ctx, id)
+}
+
+// GetMany reads the events the stream holds from it, and the others from
+// the store in one call.
+func (r *RedisStream) GetMany(ctx context.Context, ids []int64) ([]event.Event, error) {
+	held, _ := r.get(ctx, ids)
+	found := make(map[int64]event.Event, len(ids))
+	var misses []int64
+	for _, id := range ids {
+		e, ok := held[id]
+		switch {
+		case !ok:
+			misses = append(misses, id)
+		case e != nil:
+			found[id] = *e
+		}
+	}
+	redisReads.WithLabelValues("hit").Add(float64(len(ids) - len(misses)))
+	if len(misses) == 0 {
+		return orderByIDs(ids, found), nil
+	}
+	redisReads.WithLabelValues("miss").Add(float64(len(misses)))
+	cold, err := r.Store.GetMany(ctx, misses)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range cold {
+		found[e.ID] = e
+	}
+	return orderByIDs(ids, found), nil
+}
+
+// get reads the events ids from the stream: an event it answers for maps
+// to itself, or to nil when it is hidden, expired or in the trash. The
+// others are left out. It reports false when the stream could not be read.
+func (r *RedisStream) get(ctx context.Context, ids []int64) (map[int64]*event.Event, bool) {
+	out := map[int64]*event.Event{}
+	if r.behind.Load() > 0 {
+		return out, false
+	}
+	r.state.RLock()
+	floor := r.floor
+	r.state.RUnlock()
+	var cmds [][]string
+	for _, id := range ids {
+		if id > floor {
+			entry := strconv.FormatInt(id, 10) + "-0"
+			cmds = append(cmds, []string{"XRANGE", r.stream, entry, entry})
+		}
+	}
+	if len(cmds) == 0 {
+		return out, true
+	}
+	replies, err := r.pool.Do(ctx, cmds...)
+	if err != nil {
+		log.Warn().Err(err).Str("stream", r.stream).Msg("redis stream read failed, using the store")
+		return out, false
+	}
+	now := time.Now()
+	r.state.RLock()
+	defer r.state.RUnlock()
+	for _, reply := range replies {
+		es, err := entryEvents(reply)
+		if err != nil || len(es) == 0 {
+			continue
+		}
+		e := &es[0]
+		if r.hidden(e) || e.Expired(now) || e.DeletedAt != nil {
+			out[e.ID] = nil
+			continue
+		}
+		out[e.ID] = e
+	}
+	return out, true
+}
+
+// hidden sets the DeletedAt of e from the trash, and reports whether a
+// purge since deleted it. The caller holds r.state.
+func (r *RedisStream) hidden(e *event.Event) bool {
+	if at, ok := r.trashed[e.ID]; ok {
+		e.DeletedAt = &at
+	}
+	for _, p := range r.purges {
+		if e.ID <= p.upTo && p.q.Match(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RedisStream) Trash(ctx context.Context, id int64) (event.Event, error) {
+	e, err := r.Store.Trash(ctx, id)
+	if err == nil && e.DeletedAt != nil {
+		r.state.Lock()
+		if e.ID > r.floor {
+			r.trashed[e.ID] = *e.DeletedAt
+		}
+		r.state.Unlock()
+	}
+	return e, err
+}
+
+func (r *RedisStream) Restore(ctx context.Context, id int64) (event.Event, error) {
+	e, err := r.Store.Restore(ctx, id)
+	if err == nil {
+		r.state.Lock()
+		delete(r.trashed, e.ID)
+		r.state.Unlock()
+	}
+	return e, err
+}
+
+// Purge remembers q to hide the events it deleted, unless it could only
+// delete events hidden anyway: expired ones or those in the trash.
+// Compactions, which the tier cannot tell from the stream, raise the floor.
+func (r *RedisStream) Purge(ctx context.Context, q Query) (int64, error) {
+	n, err := r.Store.Purge(ctx, q)
+	if err != nil || n == 0 || q.Expired || q.Trashed {
+		return n, err
+	}
+	upTo := r.last.Load()
+	if q.Superseded {
+		r.raiseFloor(upTo)
+		return n, nil
+	}
+	q.FromID, q.Limit, q.purge = 0, 0, true
+	r.state.Lock()
+	defer r.state.Unlock()
+	if len(r.purges) == maxRedisPurges {
+		r.raiseFloorLocked(upTo)
+		return n, nil
+	}
+	r.purges = append(r.purges, redisPurge{q: q.Compile(), upTo: upTo})
+	return n, nil
+}
+
+// Partitions and DropPartitions pass through to the store, see Partitioner.
+func (r *RedisStream) Partitions() ([]Partition, error) {
+	p, ok := r.Store.(Partitioner)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return p.Partitions()
+}
+
+func (r *RedisStream) DropPartitions(before time.Time) ([]Partition, error) {
+	p, ok := r.Store.(Partitioner)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	dropped, err := p.DropPartitions(before)
+	for _, d := range dropped {
+		r.raiseFloor(d.LastID)
+	}
+	return dropped, err
+}
+
+// Snapshot passes through to the store, see Snapshotter.
+func (r *RedisStream) Snapshot(path string) (int64, error) {
+	sn, ok := r.Store.(Snapshotter)
+	if !ok {
+		return 0, errors.ErrUnsupported
+	}
+	return sn.Snapshot(path)
+}
+
+// FieldIndexes passes through to the store, see FieldIndexer.
+func (r *RedisStream) FieldIndexes() ([]FieldIndex, error) {
+	fi, ok := r.Store.(FieldIndexer)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return fi.FieldIndexes()
+}
+
+func (r *RedisStream) raiseFloor(id int64) {
+	r.state.Lock()
+	defer r.state.Unlock()
+	r.raiseFloorLocked(id)
+}
+
+// raiseFloorLocked leaves the events up to id to the store, forgetting
+// what the tier knew of them. The caller holds r.state.
+func (r *RedisStream) raiseFloorLocked(id int64) {
+	if id <= r.floor {
+		return
+	}
+	r.floor = id
+	for e := range r.trashed {
+		if e <= id {
+			delete(r.trashed, e)
+		}
+	}
+	kept := r.purges[:0]
+	for _, p := range r.purges {
+		if p.upTo > id {
+			kept = append(kept, p)
+		}
+	}
+	r.purges = kept
+}
+
+// Close stops retrying the backlog, tries it once more and closes the
+// store.
+func (r *RedisStream) Close() error {
+	close(r.done)
+	<-r.stopped
+	r.mu.Lock()
+	r.flush(context.Background())
+	r.mu.Unlock()
+	r.pool.Close()
+	return r.Store.Close()
+}
+
+// entryIDs returns the event IDs of the entries of an XRANGE reply.
+func entryIDs(reply any) []int64 {
+	entries, _ := reply.([]any)
+	ids := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		fields, _ := entry.([]any)
+		if len(fields) == 0 {
+			continue
+		}
+		id, _ := fields[0].(string)
+		ms, _, _ := strings.Cut(id, "-")
+		if n, err := strconv.ParseInt(ms, 10, 64); err == nil {
+			ids = append(ids, n)
+		}
+	}
+	return ids
+}
+
+// entryEvents decodes the events of the entries of an XRANGE reply.
+func entryEvents(reply any) ([]event.Event, error) {
+	entries, _ := reply.([]any)
+	out := make([]event.Event, 0, len(entries))
+	for _, entry := range entries {
+		parts, _ := entry.([]any)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("unexpected stream entry %v", entry)
+		}
+		fields, _ := parts[1].([]any)
+		for i := 0; i+1 < len(fields); i += 2 {
+			if fields[i] != "event" {
+				continue
+			}
+			data, _ := fields[i+1].(string)
+			var e event.Event
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				return nil, fmt.Errorf("stream entry %v: %w", parts[0], err)
+			}
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/resp/resptest"
+)
+
+func newRedisStream(t *testing.T, s Store, srv *resptest.Server, maxLen int64) *RedisStream {
+	t.Helper()
+	r, err := NewRedisStream(s, config.StorageRedisConfig{URL: srv.URL, Stream: "ingest:store", MaxLen: maxLen, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = r.Close() })
+	return r
+}
+
+// TestRedisStreamMatchesStore checks that whatever the stream answers, the
+// store would have answered the same, through trimming, trash, restores
+// and purges, and that the stream answers the recent queries.
+func TestRedisStreamMatchesStore(t *testing.T) {
+	ctx := context.Background()
+	cold := NewMemory(2)
+	for i := range 20 {
+		_, _ = cold.Add(ctx, event.Event{Type: "old", Payload: json.RawMessage(fmt.Sprint(i))})
+	}
+	srv := resptest.NewServer(t)
+	s := newRedisStream(t, cold, srv, 40)
+	rng := rand.New(rand.NewPCG(1, 2))
+	types := []string{"a.x", "a.y", "b"}
+	queries := []Query{
+		{Limit: 10},
+		{Limit: 50},
+		{},
+		{Types: []string{"a.*"}, Limit: 5},
+		{NotTypes: []string{"b"}, Limit: 15},
+		{Tags: []string{"even"}, Limit: 5},
+		{Fields: map[string]string{"n": "3"}, Limit: 3},
+		{FromID: 15, Limit: 10},
+		{FromID: 150, Limit: 10},
+		{Types: []string{"b"}, Ascending: true},
+		{BeforeID: 120, Limit: 5},
+	}
+	hits := 0
+	for round := range 20 {
+		for range 10 {
+			e := event.Event{Type: types[rng.IntN(len(types))], Payload: json.RawMessage(fmt.Sprintf(`{"n":%d}`, rng.IntN(5)))}
+			if rng.IntN(2) == 0 {
+				e.Tags = []string{"even"}
+			}
+			if _, err := s.Add(ctx, e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		last := s.last.Load()
+		switch round % 4 {
+		case 1:
+			if _, err := s.Trash(ctx, last-int64(rng.IntN(5))); err != nil {
+				t.Fatal(err)
+			}
+		case 2:
+			trash, _ := cold.List(ctx, Query{Trashed: true, Limit: 1})
+			if len(trash) > 0 {
+				if _, err := s.Restore(ctx, trash[0].ID); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if round == 10 {
+			if _, err := s.Purge(ctx, Query{Types: []string{"a.y"}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, q := range queries {
+			want, err := cold.List(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok, err := s.list(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				continue
+			}
+			hits++
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("round %d, query %+v:\n got %v\nwant %v", round, q, ids(got), ids(want))
+			}
+		}
+		for id := last - 45; id <= last; id += 3 {
+			want, wantErr := cold.Get(ctx, id)
+			got, err := s.Get(ctx, id)
+			if err != wantErr || !reflect.DeepEqual(got, want) {
+				t.Fatalf("round %d, get %d: %v %v, want %v %v", round, id, got.ID, err, want.ID, wantErr)
+			}
+		}
+	}
+	if hits == 0 {
+		t.Fatal("the stream answered no query")
+	}
+	if n := srv.Len("ingest:store"); n != 40 {
+		t.Fatalf("stream holds %d entries, want 40", n)
+	}
+	// the stream does not answer for the events before it
+	if _, ok, _ := s.list(ctx, Query{Types: []string{"old"}}); ok {
+		t.Fatal("the stream answered for the events stored before it")
+	}
+}
+
+// TestRedisStreamBacklog checks that events stored while Redis is down are
+// read from the store, and added to the stream once it is back.
+func TestRedisStreamBacklog(t *testing.T) {
+	ctx := context.Background()
+	srv := resptest.NewServer(t)
+	s := newRedisStream(t, NewMemory(1), srv, 100)
+	add := func() {
+		t.Helper()
+		if _, err := s.Add(ctx, event.Event{Type: "a", Payload: json.RawMessage(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add()
+	srv.SetDown(true)
+	add()
+	add()
+	if _, ok, _ := s.list(ctx, Query{Limit: 10}); ok {
+		t.Fatal("the stream answered with a backlog")
+	}
+	if got, err := s.List(ctx, Query{Limit: 10}); err != nil || len(got) != 3 {
+		t.Fatalf("list from the store: %v %v", ids(got), err)
+	}
+	if got, err := s.Get(ctx, 3); err != nil || got.ID != 3 {
+		t.Fatalf("get from the store: %v %v", got.ID, err)
+	}
+
+	srv.SetDown(false)
+	add()
+	if n := srv.Len("ingest:store"); n != 4 {
+		t.Fatalf("stream holds %d entries, want 4", n)
+	}
+	got, ok, err := s.list(ctx, Query{Limit: 10})
+	if err != nil || !ok || !reflect.DeepEqual(ids(got), []int64{4, 3, 2, 1}) {
+		t.Fatalf("list from the stream: %v %v %v", ids(got), ok, err)
+	}
+}
+
+// TestRedisStreamRestart checks that a stream ahead of the store, as after
+// a memory store restarts, is deleted rather than served.
+func TestRedisStreamRestart(t *testing.T) {
+	ctx := context.Background()
+	srv := resptest.NewServer(t)
+	s := newRedisStream(t, NewMemory(1), srv, 100)
+	for range 3 {
+		if _, err := s.Add(ctx, event.Event{Type: "a", Payload: json.RawMessage(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s = newRedisStream(t, NewMemory(1), srv, 100)
+	if n := srv.Len("ingest:store"); n != 0 {
+		t.Fatalf("stream holds %d entries, want 0", n)
+	}
+	if _, err := s.Add(ctx, event.Event{Type: "b", Payload: json.RawMessage(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := s.list(ctx, Query{})
+	if err != nil || !ok || len(got) != 1 || got[0].Type != "b" {
+		t.Fatalf("list: %v %v %v", got, ok, err)
+	}
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"database/sql"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	replicaLag = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "storage_replica_lag_seconds", Help: "Age of a read replica's newest event relative to the primary"},
+		[]string{"replica"},
+	)
+	readsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "storage_reads_total", Help: "List and stats queries by serving database (primary or replica)"},
+		[]string{"target"},
+	)
+)
+
+// Collectors returns the storage metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{replicaLag, readsTotal, partitionsDropped, partitionEventsDropped, eventsExpired, eventsTrashPurged, eventsCompacted, hotReads, hotEvents, hotBytes, hotWarmSeconds, fieldIndexProgress, redisReads, redisBacklog}
+}
+
+// readers serves List and Stats from a read-only pool, so analytical reads
+// never queue behind ingest on the single write connection. Replicas are
+// preferred while they lag the primary by at most maxLag; otherwise, or when
+// a replica query fails, the primary's read pool answers.
+type readers struct {
+	primary  *sql.DB
+	replicas []*replica
+	maxLag   time.Duration
+	next     atomic.Uint64
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type replica struct {
+	name string
+	db   *sql.DB
+	ok   atomic.Bool
+}
+
+func openReaders(path string, replicaPaths []string, maxLag time.Duration) (*readers, error) {
+	if maxLag <= 0 {
+		maxLag = 5 * time.Second
+	}
+	primary, err := sql.Open("sqlite", sqliteDSN(path)+"&_pragma=query_only(1)")
+	if err != nil {
+		return nil, err
+	}
+	r := &readers{primary: primary, maxLag: maxLag, done: make(chan struct{}), stopped: make(chan struct{})}
+	for _, p := range replicaPaths {
+		db, err := sql.Open("sqlite", sqliteDSN(p)+"&_pragma=query_only(1)")
+		if err != nil {
+			for _, rep := range r.replicas {
+				_ = rep.db.Close()
+			}
+			_ = primary.Close()
+			return nil, err
+		}
+		name, _, _ := strings.Cut(p, "?")
+		r.replicas = append(r.replicas, &replica{name: name, db: db})
+	}
+	if len(r.replicas) == 0 {
+		close(r.stopped)
+		return r, nil
+	}
+	r.check()
+	go r.run()
+	return r, nil
+}
+
+// read runs fn on a replica within the lag budget that holds the event
+// minID, when > 0, falling back to the primary.
+func (r *readers) read(minID int64, fn func(*sql.DB) error) error {
+	rep := r.pick()
+	if rep != nil && minID > 0 {
+		if head, err := newestID(rep.db); err != nil || head < minID {
+			rep = nil
+		}
+	}
+	if rep != nil {
+		err := fn(rep.db)
+		if err == nil {
+			readsTotal.WithLabelValues(rep.name).Inc()
+			return nil
+		}
+		log.Warn().Err(err).Str("replica", rep.name).Msg("replica read failed, using primary")
+		rep.ok.Store(false)
+	}
+	readsTotal.WithLabelValues("primary").Inc()
+	return fn(r.primary)
+}
+
+// pick returns the next healthy replica, round robin, or nil.
+func (r *readers) pick() *replica {
+	n := uint64(len(r.replicas))
+	for range n {
+		if rep := r.replicas[r.next.Add(1)%n]; rep.ok.Load() {
+			return rep
+		}
+	}
+	return nil
+}
+
+func (r *readers) run() {
+	defer close(r.stopped)
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-t.C:
+			r.check()
+		}
+	}
+}
+
+// check measures each replica's lag as the gap between the newest event on
+// the primary and on the replica; an idle primary therefore shows no lag.
+func (r *readers) check() {
+	head, err := newest(r.primary)
+	if err != nil {
+		log.Error().Err(err).Msg("replica lag check")
+		return
+	}
+	for _, rep := range r.replicas {
+		at, err := newest(rep.db)
+		if err != nil {
+			if rep.ok.Swap(false) {
+				log.Warn().Err(err).Str("replica", rep.name).Msg("replica unavailable")
+			}
+			continue
+		}
+		lag := max(time.Duration(head-at), 0)
+		replicaLag.WithLabelValues(rep.name).Set(lag.Seconds())
+		if ok := lag <= r.maxLag; rep.ok.Swap(ok) != ok {
+			log.Info().Str("replica", rep.name).Dur("lag", lag).Bool("serving", ok).Msg("replica state changed")
+		}
+	}
+}
+
+func newest(db *sql.DB) (int64, error) {
+	var at int64
+	err := db.QueryRow(`SELECT COALESCE(MAX(received_at), 0) FROM events`).Scan(&at)
+	return at, err
+}
+
+func newestID(db *sql.DB) (int64, error) {
+	var id int64
+	err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM events`).Scan(&id)
+	return id, err
+}
+
+func (r *readers) close() {
+	if len(r.replicas) > 0 {
+		close(r.done)
+		<-r.stopped
+	}
+	for _, rep := range r.replicas {
+		_ = rep.db.Close()
+	}
+	_ = r.primary.Close()
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+func count(c prometheus.Counter) float64 {
+	var m dto.Metric
+	_ = c.Write(&m)
+	return m.GetCounter().GetValue()
+}
+
+// TestReplicaReads serves reads from a replica, and from the primary for a
+// consistency token the replica has not reached, while the replica lags
+// past the budget, and once a replica query fails. Writes go to the
+// primary alone.
+func TestReplicaReads(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	cfg := config.StorageConfig{Driver: "sqlite", DSN: filepath.Join(dir, "primary.db")}
+	s, err := OpenSQLite(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if _, err := s.Add(ctx, event.Event{Type: "primary", Payload: json.RawMessage(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = s.Close()
+	// the replica is a copy of the primary, its events renamed to tell
+	// which database answered
+	b, err := os.ReadFile(cfg.DSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicaPath := filepath.Join(dir, "replica.db")
+	if err := os.WriteFile(replicaPath, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	replica, err := sql.Open("sqlite", replicaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+	exec := func(stmt string) {
+		t.Helper()
+		if _, err := replica.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exec(`UPDATE events SET type = 'replica'`)
+
+	cfg.ReadDSNs, cfg.MaxReplicaLag = []string{replicaPath}, time.Minute
+	if s, err = OpenSQLite(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	served := func(q Query) (string, int) {
+		t.Helper()
+		list, err := s.List(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) == 0 {
+			return "", 0
+		}
+		return list[0].Type, len(list)
+	}
+	before := count(readsTotal.WithLabelValues(replicaPath))
+	if typ, n := served(Query{}); typ != "replica" || n != 3 {
+		t.Errorf("read served by %q with %d events, want the replica", typ, n)
+	}
+	if got := count(readsTotal.WithLabelValues(replicaPath)) - before; got != 1 {
+		t.Errorf("%v replica reads counted, want 1", got)
+	}
+
+	added, err := s.Add(ctx, event.Event{Type: "primary", Payload: json.RawMessage(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := replica.QueryRow(`SELECT COUNT(*) FROM events`).Scan(&n); err != nil || n != 3 {
+		t.Errorf("the write reached the replica: %d events, %v", n, err)
+	}
+	if typ, n := served(Query{MinID: added.ID}); typ != "primary" || n != 4 {
+		t.Errorf("read of a token past the replica served by %q with %d events, want the primary", typ, n)
+	}
+	if e, err := s.Get(ctx, added.ID); err != nil || e.Type != "primary" {
+		t.Errorf("get of an event past the replica: %+v %v", e, err)
+	}
+
+	exec(`UPDATE events SET received_at = received_at - 3600000000000`)
+	s.readers.check()
+	if typ, _ := served(Query{}); typ != "primary" {
+		t.Errorf("read served by %q while the replica lags an hour, want the primary", typ)
+	}
+	exec(`UPDATE events SET received_at = received_at + 3600000000000`)
+	s.readers.check()
+	if typ, _ := served(Query{}); typ != "replica" {
+		t.Errorf("read served by %q once the replica caught up, want the replica", typ)
+	}
+
+	exec(`DROP TABLE events`)
+	if typ, n := served(Query{}); typ != "primary" || n != 4 {
+		t.Errorf("read served by %q with %d events when the replica fails, want the primary", typ, n)
+	}
+	if s.readers.replicas[0].ok.Load() {
+		t.Error("the failed replica is still in rotation")
+	}
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Snapshotter is implemented by stores that can write a consistent copy of
+// themselves, for backups and for cloning an instance: every event, and
+// the consumers, outbox, audit trail and the rest of the state kept with
+// them.
+type Snapshotter interface {
+	// Snapshot writes the copy to the file path, which must not exist, and
+	// returns the ID of the newest event in it.
+	Snapshot(path string) (lastID int64, err error)
+}
+
+// SQLiteFile returns the database file of a SQLite DSN, without its
+// parameters.
+func SQLiteFile(dsn string) string {
+	if dsn == "" {
+		dsn = "ingest.db"
+	}
+	path, _, _ := strings.Cut(strings.TrimPrefix(dsn, "file:"), "?")
+	return path
+}
+
+// Snapshot runs VACUUM INTO on a connection of its own, which reads one
+// transaction of the primary while writes go on; the copy is compacted and
+// complete without its WAL.
+func (s *SQLite) Snapshot(path string) (int64, error) {
+	if _, err := os.Stat(path); err == nil {
+		return 0, fmt.Errorf("snapshot %s: %w", path, os.ErrExist)
+	}
+	// the readers are query_only, which VACUUM INTO refuses; a read-only
+	// open does not
+	db, err := sql.Open("sqlite", "file:"+s.file+"?mode=ro&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`VACUUM INTO ?`, path); err != nil {
+		// a failed VACUUM INTO can leave the file behind, empty
+		_ = os.Remove(path)
+		return 0, fmt.Errorf("snapshot: %w", err)
+	}
+	copied, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer copied.Close()
+	var last int64
+	if err := copied.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM events`).Scan(&last); err != nil {
+		return 0, fmt.Errorf("snapshot: %w", err)
+	}
+	return last, nil
+}
+
+// CheckSQLite verifies that the file path is an intact SQLite database, for
+// a snapshot about to be restored.
+func CheckSQLite(path string) error {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var result string
+	if err := db.QueryRow(`PRAGMA quick_check`).Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return errors.New("database check failed: " + result)
+	}
+	return nil
+}
@@ -0,0 +1,1415 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" database/sql driver
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	idgen "github.com/rafaelosorio/go-ingest-service/internal/ids"
+	"github.com/rafaelosorio/go-ingest-service/internal/ingestmetrics"
+)
+
+// sqliteMigrations are applied in order; the index+1 is the schema version
+// recorded in schema_migrations. Only ever append to this list.
+var sqliteMigrations = []string{
+	`CREATE TABLE events (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		type        TEXT    NOT NULL,
+		payload     TEXT    NOT NULL,
+		received_at INTEGER NOT NULL
+	)`,
+	`CREATE INDEX events_type_idx ON events (type)`,
+	`CREATE INDEX events_received_at_idx ON events (received_at)`,
+	// payload switched from an opaque string to raw JSON; keep legacy rows as JSON strings
+	`UPDATE events SET payload = json_quote(payload)`,
+	`ALTER TABLE events ADD COLUMN metadata TEXT`,
+	// tags are kept in order on the row and indexed in event_tags for ?tag= filters
+	`ALTER TABLE events ADD COLUMN tags TEXT`,
+	`CREATE TABLE event_tags (
+		tag      TEXT    NOT NULL,
+		event_id INTEGER NOT NULL REFERENCES events (id) ON DELETE CASCADE,
+		PRIMARY KEY (tag, event_id)
+	) WITHOUT ROWID`,
+	// scheduled_deliveries holds the events not yet released to the sinks
+	`ALTER TABLE events ADD COLUMN deliver_at INTEGER`,
+	`CREATE TABLE scheduled_deliveries (
+		event_id   INTEGER PRIMARY KEY REFERENCES events (id) ON DELETE CASCADE,
+		deliver_at INTEGER NOT NULL
+	)`,
+	`CREATE INDEX scheduled_deliveries_deliver_at_idx ON scheduled_deliveries (deliver_at)`,
+	`CREATE TABLE consumers (
+		name       TEXT    PRIMARY KEY,
+		types      TEXT,
+		offset_id  INTEGER NOT NULL,
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE audit_log (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		time        INTEGER NOT NULL,
+		actor       TEXT    NOT NULL,
+		action      TEXT    NOT NULL,
+		target      TEXT    NOT NULL,
+		method      TEXT    NOT NULL,
+		path        TEXT    NOT NULL,
+		request_id  TEXT    NOT NULL,
+		remote_addr TEXT    NOT NULL,
+		details     TEXT
+	)`,
+	`CREATE INDEX audit_log_time_idx ON audit_log (time)`,
+	// the trail is append-only
+	`CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+		BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END`,
+	`CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+		BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END`,
+	`CREATE TABLE idempotency_keys (
+		key        TEXT    PRIMARY KEY,
+		status     INTEGER NOT NULL,
+		header     TEXT,
+		body       BLOB    NOT NULL,
+		expires_at INTEGER NOT NULL
+	)`,
+	`CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at)`,
+	// event_fields indexes the short scalar top-level payload fields for
+	// payload.<field> filters, rendered like event.ScalarString
+	`CREATE TABLE event_fields (
+		field    TEXT    NOT NULL,
+		value    TEXT    NOT NULL,
+		event_id INTEGER NOT NULL REFERENCES events (id) ON DELETE CASCADE,
+		PRIMARY KEY (field, value, event_id)
+	) WITHOUT ROWID`,
+	`INSERT OR IGNORE INTO event_fields (field, value, event_id)
+		SELECT j.key, CASE j.type WHEN 'text' THEN j.value ELSE events.payload -> j.fullkey END, events.id
+		FROM events, json_each(events.payload) AS j
+		WHERE json_type(events.payload) = 'object' AND j.type NOT IN ('object', 'array')
+			AND length(j.key) BETWEEN 1 AND 64 AND j.key NOT GLOB '*[^A-Za-z0-9_-]*'
+			AND length(CAST(CASE j.type WHEN 'text' THEN j.value ELSE events.payload -> j.fullkey END AS BLOB)) <= 128`,
+	`CREATE TABLE tenants (
+		name       TEXT    PRIMARY KEY,
+		config     TEXT    NOT NULL,
+		created_at INTEGER NOT NULL
+	)`,
+	// sink_outbox holds the deliveries not yet accepted by their sink,
+	// written in the transaction that stores the event
+	`CREATE TABLE sink_outbox (
+		sink            TEXT    NOT NULL,
+		event_id        INTEGER NOT NULL REFERENCES events (id) ON DELETE CASCADE,
+		attempts        INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at INTEGER NOT NULL,
+		last_error      TEXT,
+		dead            INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (sink, event_id)
+	) WITHOUT ROWID`,
+	`CREATE INDEX sink_outbox_event_id_idx ON sink_outbox (event_id)`,
+	// event_annotations keeps every version of an event's annotation
+	`CREATE TABLE event_annotations (
+		event_id    INTEGER NOT NULL REFERENCES events (id) ON DELETE CASCADE,
+		version     INTEGER NOT NULL,
+		status      TEXT    NOT NULL,
+		annotations TEXT,
+		actor       TEXT    NOT NULL,
+		time        INTEGER NOT NULL,
+		PRIMARY KEY (event_id, version)
+	) WITHOUT ROWID`,
+	`ALTER TABLE consumers ADD COLUMN epoch INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE events ADD COLUMN schema_version TEXT`,
+	// event_partitions maps receive time ranges to event ID ranges
+	`CREATE TABLE event_partitions (
+		start    INTEGER PRIMARY KEY,
+		end      INTEGER NOT NULL,
+		first_id INTEGER NOT NULL,
+		last_id  INTEGER NOT NULL
+	)`,
+	// usage accumulates what each caller ingested per hour and tenant
+	`CREATE TABLE usage (
+		hour     INTEGER NOT NULL,
+		key      TEXT    NOT NULL,
+		tenant   TEXT    NOT NULL,
+		events   INTEGER NOT NULL,
+		bytes    INTEGER NOT NULL,
+		rejected INTEGER NOT NULL,
+		PRIMARY KEY (hour, key, tenant)
+	) WITHOUT ROWID`,
+	// expired events are hidden from reads until the janitor deletes them
+	`ALTER TABLE events ADD COLUMN expires_at INTEGER`,
+	`CREATE INDEX events_expires_at_idx ON events (expires_at) WHERE expires_at IS NOT NULL`,
+	// correlation and causation IDs link the events of one flow
+	`ALTER TABLE events ADD COLUMN correlation_id TEXT`,
+	`ALTER TABLE events ADD COLUMN causation_id TEXT`,
+	`CREATE INDEX events_correlation_id_idx ON events (correlation_id) WHERE correlation_id IS NOT NULL`,
+	`CREATE INDEX events_causation_id_idx ON events (causation_id) WHERE causation_id IS NOT NULL`,
+	// field_indexes records the declared payload field indexes and how far
+	// each is backfilled; every field of every event so far is indexed
+	`CREATE TABLE field_indexes (
+		types      TEXT    NOT NULL,
+		field      TEXT    NOT NULL,
+		indexed_to INTEGER NOT NULL,
+		target     INTEGER NOT NULL,
+		ready_at   INTEGER,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (types, field)
+	)`,
+	`INSERT INTO field_indexes (types, field, indexed_to, target, ready_at, created_at)
+		SELECT '*', '*', 0, 0, unixepoch() * 1000000000, unixepoch() * 1000000000`,
+	// receipts keeps the outcome of async ingest requests for clients to
+	// poll; pending ones live in memory only
+	`CREATE TABLE receipts (
+		id          TEXT    PRIMARY KEY,
+		status      TEXT    NOT NULL,
+		owner       TEXT    NOT NULL,
+		events      INTEGER NOT NULL,
+		event_ids   TEXT,
+		error       TEXT,
+		created_at  INTEGER NOT NULL,
+		resolved_at INTEGER,
+		expires_at  INTEGER NOT NULL
+	)`,
+	`CREATE INDEX receipts_expires_at_idx ON receipts (expires_at)`,
+	// tenant_keys holds the wrapped versions of each tenant's payload
+	// encryption key
+	`CREATE TABLE tenant_keys (
+		tenant     TEXT    NOT NULL,
+		version    INTEGER NOT NULL,
+		source     TEXT    NOT NULL,
+		kms_key    TEXT    NOT NULL DEFAULT '',
+		wrapped    BLOB    NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (tenant, version)
+	)`,
+	// partition_key lets compaction keep the newest event per type and key
+	`ALTER TABLE events ADD COLUMN partition_key TEXT`,
+	`CREATE INDEX events_partition_key_idx ON events (type, partition_key, id) WHERE partition_key IS NOT NULL`,
+	// leases elects the instance that runs the singleton background jobs
+	`CREATE TABLE leases (
+		name       TEXT    PRIMARY KEY,
+		holder     TEXT    NOT NULL,
+		expires_at INTEGER NOT NULL
+	)`,
+	// deleted_at marks the events in the trash, hidden from reads until
+	// they are restored or the janitor purges them
+	`ALTER TABLE events ADD COLUMN deleted_at INTEGER`,
+	`CREATE INDEX events_deleted_at_idx ON events (deleted_at) WHERE deleted_at IS NOT NULL`,
+	// occurred_at is the producer's time; listings by it fall back to
+	// received_at
+	`ALTER TABLE events ADD COLUMN occurred_at INTEGER`,
+	`CREATE INDEX events_occurred_at_idx ON events (COALESCE(occurred_at, received_at), id)`,
+	// acl_rules restricts which callers write or read which event types
+	`CREATE TABLE acl_rules (
+		id         TEXT    PRIMARY KEY,
+		subject    TEXT    NOT NULL,
+		actions    TEXT    NOT NULL,
+		types      TEXT    NOT NULL,
+		effect     TEXT    NOT NULL,
+		created_at INTEGER NOT NULL
+	)`,
+}
+
+// maxIndexedValue is the longest field value, in bytes, kept in
+// event_fields; filters on longer values scan the payloads.
+const maxIndexedValue = 128
+
+// SQLite stores events in a single database file, for single-binary
+// deployments without an external database.
+type SQLite struct {
+	// db is the single write connection; reads go through readers.
+	db      *sql.DB
+	readers *readers
+	// width is the span of the event partitions, 0 when not partitioned.
+	width time.Duration
+	// file is the database file, for Snapshot.
+	file string
+	// fields are the declared payload field indexes.
+	fields *fieldIndexes
+	// ids numbers new events when set, instead of the table's sequence.
+	ids *idgen.Generator
+}
+
+// OpenSQLite opens (or creates) the database at cfg.DSN in WAL mode and
+// brings its schema up to date. cfg.ReadDSNs are opened read-only as
+// replicas for List and Stats.
+func OpenSQLite(cfg config.StorageConfig) (*SQLite, error) {
+	path := cfg.DSN
+	if path == "" {
+		path = "ingest.db"
+	}
+	db, err := sql.Open("sqlite", sqliteDSN(path))
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time; queue writers here rather than
+	// in busy_timeout
+	db.SetMaxOpenConns(1)
+	s := &SQLite{db: db, width: cfg.PartitionWidth(), file: SQLiteFile(path)}
+	if err := s.migrate(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if s.width > 0 {
+		if err := s.backfillPartitions(); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("partition events: %w", err)
+		}
+	}
+	if s.fields, err = syncFieldIndexes(db, cfg.Indexes); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("field indexes: %w", err)
+	}
+	if s.readers, err = openReaders(path, cfg.ReadDSNs, cfg.MaxReplicaLag); err != nil {
+		s.fields.stop()
+		_ = db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// GenerateIDs numbers the events added from now on with Snowflake-style IDs
+// of node, above every ID the table has handed out, instead of its sequence.
+// IDs are made on the write connection, so they are committed in order.
+func (s *SQLite) GenerateIDs(node int) error {
+	var last int64
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM sqlite_sequence WHERE name = 'events'`).Scan(&last); err != nil {
+		return fmt.Errorf("sqlite ids: %w", err)
+	}
+	s.ids = idgen.New(node, last)
+	return nil
+}
+
+func sqliteDSN(path string) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + "_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)&_pragma=foreign_keys(1)"
+}
+
+func (s *SQLite) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return fmt.Errorf("sqlite migrate: %w", err)
+	}
+	var current int
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("sqlite migrate: %w", err)
+	}
+	for i := current; i < len(sqliteMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("sqlite migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, i+1); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("sqlite migration %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add waits for the write connection and runs its statements under ctx, so
+// a request given up on does not queue behind the others.
+func (s *SQLite) Add(ctx context.Context, e event.Event, sinks ...string) (event.Event, error) {
+	e.ReceivedAt = time.Now().UTC()
+	if len(e.Payload) == 0 {
+		e.Payload = json.RawMessage("null")
+	}
+	meta, err := marshalJSON(e.Metadata, len(e.Metadata) == 0)
+	if err != nil {
+		return event.Event{}, err
+	}
+	tags, err := marshalJSON(e.Tags, len(e.Tags) == 0)
+	if err != nil {
+		return event.Event{}, err
+	}
+	var deliverAt sql.NullInt64
+	if e.DeliverAt != nil {
+		at := e.DeliverAt.UTC()
+		e.DeliverAt = &at
+		deliverAt = sql.NullInt64{Int64: at.UnixNano(), Valid: true}
+	}
+	var expiresAt sql.NullInt64
+	if e.ExpiresAt != nil {
+		at := e.ExpiresAt.UTC()
+		e.ExpiresAt = &at
+		expiresAt = sql.NullInt64{Int64: at.UnixNano(), Valid: true}
+	}
+	var occurredAt sql.NullInt64
+	if e.OccurredAt != nil {
+		at := e.OccurredAt.UTC()
+		e.OccurredAt = &at
+		occurredAt = sql.NullInt64{Int64: at.UnixNano(), Valid: true}
+	}
+	e.TTLSeconds, e.DeletedAt = 0, nil
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return event.Event{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	// a NULL id takes the next of the sequence
+	var id sql.NullInt64
+	if s.ids != nil {
+		id = sql.NullInt64{Int64: s.ids.Next(), Valid: true}
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO events (id, type, payload, metadata, tags, deliver_at, received_at, schema_version, expires_at, correlation_id, causation_id, partition_key, occurred_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, e.Type, string(e.Payload), meta, tags, deliverAt, e.ReceivedAt.UnixNano(), nullString(e.SchemaVersion), expiresAt, nullString(e.CorrelationID), nullString(e.CausationID), nullString(e.PartitionKey), occurredAt)
+	if err != nil {
+		return event.Event{}, err
+	}
+	if e.ID, err = res.LastInsertId(); err != nil {
+		return event.Event{}, err
+	}
+	if s.width > 0 {
+		if err := s.partition(tx, e.ID, e.ReceivedAt); err != nil {
+			return event.Event{}, err
+		}
+	}
+	for _, t := range e.Tags {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO event_tags (tag, event_id) VALUES (?, ?)`, t, e.ID); err != nil {
+			return event.Event{}, err
+		}
+	}
+	for name, value := range s.fields.fields(e.Type, e.Payload) {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO event_fields (field, value, event_id) VALUES (?, ?, ?)`, name, value, e.ID); err != nil {
+			return event.Event{}, err
+		}
+	}
+	if deliverAt.Valid {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO scheduled_deliveries (event_id, deliver_at) VALUES (?, ?)`, e.ID, deliverAt); err != nil {
+			return event.Event{}, err
+		}
+	}
+	due := e.ReceivedAt.UnixNano()
+	if deliverAt.Valid {
+		due = deliverAt.Int64
+	}
+	for _, name := range sinks {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO sink_outbox (sink, event_id, next_attempt_at) VALUES (?, ?, ?)`, name, e.ID, due); err != nil {
+			return event.Event{}, err
+		}
+	}
+	start := time.Now()
+	err = tx.Commit()
+	ingestmetrics.WALSyncDuration.Observe(time.Since(start).Seconds())
+	return e, err
+}
+
+// fieldExpr renders the payload field at a path (bound three times) the way
+// Query.Match compares it: strings unquoted, other scalars by their JSON
+// text, objects and arrays as NULL.
+const fieldExpr = `(CASE json_type(payload, ?) WHEN 'text' THEN payload ->> ? ` +
+	`WHEN 'object' THEN NULL WHEN 'array' THEN NULL ELSE payload -> ? END)`
+
+// indexedFields returns the top-level scalar fields of an object payload
+// that go into event_fields.
+func indexedFields(payload json.RawMessage) map[string]string {
+	p := bytes.TrimSpace(payload)
+	if len(p) == 0 || p[0] != '{' {
+		return nil
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(p, &obj); err != nil {
+		return nil
+	}
+	out := make(map[string]string, len(obj))
+	for name, raw := range obj {
+		if !fieldName.MatchString(name) {
+			continue
+		}
+		if v, ok := event.ScalarString(raw); ok && len(v) <= maxIndexedValue {
+			out[name] = v
+		}
+	}
+	return out
+}
+
+// whereClause renders the filters of q (everything but Limit) as SQL.
+func whereClause(q Query, partitioned bool, fields *fieldIndexes) (string, []any) {
+	var where []string
+	var args []any
+	if partitioned {
+		where, args = partitionBounds(q)
+	}
+	switch {
+	case q.Expired:
+		where = append(where, `expires_at <= ?`)
+		args = append(args, time.Now().UnixNano())
+	case !q.purge:
+		where = append(where, `(expires_at IS NULL OR expires_at > ?)`)
+		args = append(args, time.Now().UnixNano())
+	}
+	switch {
+	case q.Trashed:
+		where = append(where, `deleted_at IS NOT NULL`)
+	case !q.purge:
+		where = append(where, `deleted_at IS NULL`)
+	}
+	if !q.TrashedBefore.IsZero() {
+		where = append(where, `deleted_at < ?`)
+		args = append(args, q.TrashedBefore.UnixNano())
+	}
+	if q.CorrelationID != "" {
+		where = append(where, `correlation_id = ?`)
+		args = append(args, q.CorrelationID)
+	}
+	if q.CausationID != "" {
+		where = append(where, `causation_id = ?`)
+		args = append(args, q.CausationID)
+	}
+	if q.purge && q.Superseded {
+		where = append(where, `partition_key IS NOT NULL AND id < (SELECT MAX(newer.id) FROM events AS newer
+			WHERE newer.type = events.type AND newer.partition_key = events.partition_key)`)
+	}
+	for _, t := range q.Tags {
+		where = append(where, `id IN (SELECT event_id FROM event_tags WHERE tag = ?)`)
+		args = append(args, t)
+	}
+	if len(q.Types) > 0 {
+		or := make([]string, len(q.Types))
+		for i, p := range q.Types {
+			or[i] = `type GLOB ?`
+			args = append(args, p)
+		}
+		where = append(where, `(`+strings.Join(or, ` OR `)+`)`)
+	}
+	for _, p := range q.NotTypes {
+		where = append(where, `type NOT GLOB ?`)
+		args = append(args, p)
+	}
+	if q.FromID > 0 {
+		where = append(where, `id >= ?`)
+		args = append(args, q.FromID)
+	}
+	if q.BeforeID > 0 {
+		where = append(where, `id < ?`)
+		args = append(args, q.BeforeID)
+	}
+	if !q.Since.IsZero() {
+		where = append(where, `received_at >= ?`)
+		args = append(args, q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		where = append(where, `received_at < ?`)
+		args = append(args, q.Until.UnixNano())
+	}
+	for name, want := range q.Fields {
+		if len(want) <= maxIndexedValue && fields.covers(name, q.Types) {
+			where = append(where, `id IN (SELECT event_id FROM event_fields WHERE field = ? AND value = ?)`)
+			args = append(args, name, want)
+			continue
+		}
+		path := `$."` + name + `"`
+		where = append(where, fieldExpr+` = ?`)
+		args = append(args, path, path, path, want)
+	}
+	for name, unwanted := range q.NotFields {
+		if len(unwanted) <= maxIndexedValue && fields.covers(name, q.Types) {
+			where = append(where, `id NOT IN (SELECT event_id FROM event_fields WHERE field = ? AND value = ?)`)
+			args = append(args, name, unwanted)
+			continue
+		}
+		path := `$."` + name + `"`
+		where = append(where, fieldExpr+` IS NOT ?`)
+		args = append(args, path, path, path, unwanted)
+	}
+	if len(where) == 0 {
+		return "", nil
+	}
+	return ` WHERE ` + strings.Join(where, ` AND `), args
+}
+
+func (s *SQLite) List(ctx context.Context, q Query) ([]event.Event, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	where, args := whereClause(q, s.width > 0, s.fields)
+	stmt := `SELECT ` + eventColumns + ` FROM events` + where
+	stmt += orderClause(q)
+	if q.Limit > 0 {
+		stmt += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+	var out []event.Event
+	err := s.readers.read(q.MinID, func(db *sql.DB) error {
+		var err error
+		out, err = queryEvents(ctx, db, stmt, args...)
+		return err
+	})
+	return out, err
+}
+
+func orderClause(q Query) string {
+	if q.FromID > 0 {
+		return ` ORDER BY id`
+	}
+	dir := ` DESC`
+	if q.Ascending {
+		dir = ``
+	}
+	switch q.OrderBy {
+	case "received_at":
+		return ` ORDER BY received_at` + dir + `, id` + dir
+	case "occurred_at":
+		return ` ORDER BY COALESCE(occurred_at, received_at)` + dir + `, id` + dir
+	}
+	return ` ORDER BY id` + dir
+}
+
+// Scheduled reads the primary, which replicas may trail.
+func (s *SQLite) Scheduled(ctx context.Context) ([]event.Event, error) {
+	return queryEvents(ctx, s.readers.primary, `SELECT `+eventColumns+` FROM events
+		JOIN scheduled_deliveries ON scheduled_deliveries.event_id = events.id
+		ORDER BY scheduled_deliveries.deliver_at, id`)
+}
+
+func (s *SQLite) Release(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM scheduled_deliveries WHERE event_id = ?`, id)
+	return err
+}
+
+func (s *SQLite) Consumers(ctx context.Context) ([]Consumer, error) {
+	rows, err := s.readers.primary.QueryContext(ctx, `SELECT name, types, offset_id, epoch, created_at FROM consumers ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Consumer{}
+	for rows.Next() {
+		var c Consumer
+		var types sql.NullString
+		var created int64
+		if err := rows.Scan(&c.Name, &types, &c.Offset, &c.Epoch, &created); err != nil {
+			return nil, err
+		}
+		if types.Valid {
+			if err := json.Unmarshal([]byte(types.String), &c.Types); err != nil {
+				return nil, fmt.Errorf("consumer %s: decode types: %w", c.Name, err)
+			}
+		}
+		c.CreatedAt = time.Unix(0, created).UTC()
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLite) SaveConsumer(ctx context.Context, c Consumer) error {
+	types, err := marshalJSON(c.Types, len(c.Types) == 0)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO consumers (name, types, offset_id, epoch, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET types = excluded.types, offset_id = excluded.offset_id, epoch = excluded.epoch`,
+		c.Name, types, c.Offset, c.Epoch, c.CreatedAt.UnixNano())
+	return err
+}
+
+func (s *SQLite) AppendAudit(ctx context.Context, e AuditEntry) (AuditEntry, error) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	var details sql.NullString
+	if len(e.Details) > 0 {
+		details = sql.NullString{String: string(e.Details), Valid: true}
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO audit_log (time, actor, action, target, method, path, request_id, remote_addr, details)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Time.UnixNano(), e.Actor, e.Action, e.Target, e.Method, e.Path, e.RequestID, e.RemoteAddr, details)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+	if e.ID, err = res.LastInsertId(); err != nil {
+		return AuditEntry{}, err
+	}
+	return e, nil
+}
+
+func (s *SQLite) Audit(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	var where []string
+	var args []any
+	if q.Actor != "" {
+		where, args = append(where, "actor = ?"), append(args, q.Actor)
+	}
+	if q.Action != "" {
+		where, args = append(where, "action = ?"), append(args, q.Action)
+	}
+	if !q.Since.IsZero() {
+		where, args = append(where, "time >= ?"), append(args, q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		where, args = append(where, "time < ?"), append(args, q.Until.UnixNano())
+	}
+	stmt := `SELECT id, time, actor, action, target, method, path, request_id, remote_addr, details FROM audit_log`
+	if len(where) > 0 {
+		stmt += " WHERE " + strings.Join(where, " AND ")
+	}
+	rows, err := s.readers.primary.QueryContext(ctx, stmt+" ORDER BY id DESC LIMIT ?", append(args, q.limit())...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var at int64
+		var details sql.NullString
+		if err := rows.Scan(&e.ID, &at, &e.Actor, &e.Action, &e.Target, &e.Method, &e.Path, &e.RequestID, &e.RemoteAddr, &details); err != nil {
+			return nil, err
+		}
+		e.Time = time.Unix(0, at).UTC()
+		if details.Valid {
+			e.Details = json.RawMessage(details.String)
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLite) AddUsage(ctx context.Context, us []Usage) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	for _, u := range us {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO usage (hour, key, tenant, events, bytes, rejected) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (hour, key, tenant) DO UPDATE SET events = events + excluded.events,
+				bytes = bytes + excluded.bytes, rejected = rejected + excluded.rejected`,
+			u.Hour.UnixNano(), u.Key, u.Tenant, u.Events, u.Bytes, u.Rejected); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLite) Usage(ctx context.Context, q UsageQuery) ([]Usage, error) {
+	var where []string
+	var args []any
+	if q.Key != "" {
+		where, args = append(where, "key = ?"), append(args, q.Key)
+	}
+	if q.Tenant != "" {
+		where, args = append(where, "tenant = ?"), append(args, q.Tenant)
+	}
+	if !q.Since.IsZero() {
+		where, args = append(where, "hour >= ?"), append(args, q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		where, args = append(where, "hour < ?"), append(args, q.Until.UnixNano())
+	}
+	stmt := `SELECT hour, key, tenant, events, bytes, rejected FROM usage`
+	if len(where) > 0 {
+		stmt += " WHERE " + strings.Join(where, " AND ")
+	}
+	rows, err := s.readers.primary.QueryContext(ctx, stmt+" ORDER BY hour, tenant, key", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Usage{}
+	for rows.Next() {
+		var u Usage
+		var hour int64
+		if err := rows.Scan(&hour, &u.Key, &u.Tenant, &u.Events, &u.Bytes, &u.Rejected); err != nil {
+			return nil, err
+		}
+		u.Hour = time.Unix(0, hour).UTC()
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLite) SaveIdempotent(ctx context.Context, r IdempotentResponse) error {
+	header, err := marshalJSON(r.Header, len(r.Header) == 0)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= ?`, time.Now().UnixNano()); err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO idempotency_keys (key, status, header, body, expires_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET status = excluded.status, header = excluded.header,
+			body = excluded.body, expires_at = excluded.expires_at`,
+		r.Key, r.Status, header, r.Body, r.Expires.UnixNano())
+	return err
+}
+
+func (s *SQLite) IdempotentResponses(ctx context.Context) ([]IdempotentResponse, error) {
+	rows, err := s.readers.primary.QueryContext(ctx, `SELECT key, status, header, body, expires_at FROM idempotency_keys
+		WHERE expires_at > ?`, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []IdempotentResponse{}
+	for rows.Next() {
+		var r IdempotentResponse
+		var header sql.NullString
+		var expires int64
+		if err := rows.Scan(&r.Key, &r.Status, &header, &r.Body, &expires); err != nil {
+			return nil, err
+		}
+		if header.Valid {
+			if err := json.Unmarshal([]byte(header.String), &r.Header); err != nil {
+				return nil, fmt.Errorf("idempotency key %s: header: %w", r.Key, err)
+			}
+		}
+		r.Expires = time.Unix(0, expires)
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLite) SaveReceipt(ctx context.Context, r Receipt) error {
+	ids, err := marshalJSON(r.EventIDs, len(r.EventIDs) == 0)
+	if err != nil {
+		return err
+	}
+	var resolved sql.NullInt64
+	if r.ResolvedAt != nil {
+		resolved = sql.NullInt64{Int64: r.ResolvedAt.UnixNano(), Valid: true}
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM receipts WHERE expires_at <= ?`, time.Now().UnixNano()); err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO receipts (id, status, owner, events, event_ids, error, created_at, resolved_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET status = excluded.status, event_ids = excluded.event_ids,
+			error = excluded.error, resolved_at = excluded.resolved_at, expires_at = excluded.expires_at`,
+		r.ID, r.Status, r.Owner, r.Events, ids, r.Error, r.CreatedAt.UnixNano(), resolved, r.ExpiresAt.UnixNano())
+	return err
+}
+
+// AcquireLease takes a free or expired lease, or renews the holder's, in a
+// single upsert, which SQLite runs atomically even for processes sharing
+// the database file.
+func (s *SQLite) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	res, err := s.db.ExecContext(ctx, `INSERT INTO leases (name, holder, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+		WHERE leases.holder = excluded.holder OR leases.expires_at <= ?`,
+		name, holder, now.Add(ttl).UnixNano(), now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *SQLite) ReleaseLease(ctx context.Context, name, holder string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM leases WHERE name = ? AND holder = ?`, name, holder)
+	return err
+}
+
+func (s *SQLite) Receipts(ctx context.Context, ids ...string) ([]Receipt, error) {
+	out := []Receipt{}
+	if len(ids) == 0 {
+		return out, nil
+	}
+	args := make([]any, 0, len(ids)+1)
+	args = append(args, time.Now().UnixNano())
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	rows, err := s.readers.primary.QueryContext(ctx, `SELECT id, status, owner, events, event_ids, error, created_at, resolved_at, expires_at
+		FROM receipts WHERE expires_at > ? AND id IN (?`+strings.Repeat(`, ?`, len(ids)-1)+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r Receipt
+		var eventIDs sql.NullString
+		var created, expires int64
+		var resolved sql.NullInt64
+		if err := rows.Scan(&r.ID, &r.Status, &r.Owner, &r.Events, &eventIDs, &r.Error, &created, &resolved, &expires); err != nil {
+			return nil, err
+		}
+		if eventIDs.Valid {
+			if err := json.Unmarshal([]byte(eventIDs.String), &r.EventIDs); err != nil {
+				return nil, fmt.Errorf("receipt %s: event ids: %w", r.ID, err)
+			}
+		}
+		r.CreatedAt, r.ExpiresAt = time.Unix(0, created).UTC(), time.Unix(0, expires).UTC()
+		if resolved.Valid {
+			at := time.Unix(0, resolved.Int64).UTC()
+			r.ResolvedAt = &at
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLite) Tenants(ctx context.Context) ([]Tenant, error) {
+	rows, err := s.readers.primary.QueryContext(ctx, `SELECT name, config, created_at FROM tenants ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Tenant{}
+	for rows.Next() {
+		var t Tenant
+		var name, cfg string
+		var created int64
+		if err := rows.Scan(&name, &cfg, &created); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(cfg), &t.Config); err != nil {
+			return nil, fmt.Errorf("tenant %s: decode config: %w", name, err)
+		}
+		t.CreatedAt = time.Unix(0, created).UTC()
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLite) SaveTenant(ctx context.Context, t Tenant) error {
+	cfg, err := json.Marshal(t.Config)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO tenants (name, config, created_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET config = excluded.config`,
+		t.Config.Name, string(cfg), t.CreatedAt.UnixNano())
+	return err
+}
+
+func (s *SQLite) DeleteTenant(ctx context.Context, name string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM tenants WHERE name = ?`, name)
+	return err
+}
+
+func (s *SQLite) ACLRules(ctx context.Context) ([]ACLRule, error) {
+	rows, err := s.readers.primary.QueryContext(ctx, `SELECT id, subject, actions, types, effect, created_at FROM acl_rules ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []ACLRule{}
+	for rows.Next() {
+		var r ACLRule
+		var actions, types string
+		var created int64
+		if err := rows.Scan(&r.ID, &r.Subject, &actions, &types, &r.Effect, &created); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(actions), &r.Actions); err != nil {
+			return nil, fmt.Errorf("acl rule %s: decode actions: %w", r.ID, err)
+		}
+		if err := json.Unmarshal([]byte(types), &r.Types); err != nil {
+			return nil, fmt.Errorf("acl rule %s: decode types: %w", r.ID, err)
+		}
+		r.CreatedAt = time.Unix(0, created).UTC()
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLite) SaveACLRule(ctx context.Context, r ACLRule) error {
+	actions, err := json.Marshal(r.Actions)
+	if err != nil {
+		return err
+	}
+	types, err := json.Marshal(r.Types)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO acl_rules (id, subject, actions, types, effect, created_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET subject = excluded.subject, actions = excluded.actions, types = excluded.types, effect = excluded.effect`,
+		r.ID, r.Subject, string(actions), string(types), r.Effect, r.CreatedAt.UnixNano())
+	return err
+}
+
+func (s *SQLite) DeleteACLRule(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM acl_rules WHERE id = ?`, id)
+	return err
+}
+
+func (s *SQLite) TenantKeys(ctx context.Context) ([]TenantKey, error) {
+	rows, err := s.readers.primary.QueryContext(ctx, `SELECT tenant, version, source, kms_key, wrapped, created_at
+		FROM tenant_keys ORDER BY tenant, version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []TenantKey{}
+	for rows.Next() {
+		var k TenantKey
+		var created int64
+		if err := rows.Scan(&k.Tenant, &k.Version, &k.Source, &k.KMSKey, &k.Wrapped, &created); err != nil {
+			return nil, err
+		}
+		k.CreatedAt = time.Unix(0, created).UTC()
+		out = append(out, k)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLite) SaveTenantKey(ctx context.Context, k TenantKey) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO tenant_keys (tenant, version, source, kms_key, wrapped, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, k.Tenant, k.Version, k.Source, k.KMSKey, k.Wrapped, k.CreatedAt.UnixNano())
+	return err
+}
+
+// DeleteTenantKeys overwrites the deleted rows on disk and checkpoints the
+// WAL, so the wrapped keys do not linger in free pages or the log.
+func (s *SQLite) DeleteTenantKeys(ctx context.Context, tenant string) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `PRAGMA secure_delete = ON`); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `PRAGMA secure_delete = OFF`)
+	if _, err := conn.ExecContext(ctx, `DELETE FROM tenant_keys WHERE tenant = ?`, tenant); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`)
+	return err
+}
+
+// Get reads a replica that holds the event, if any; events never change.
+func (s *SQLite) Get(ctx context.Context, id int64) (event.Event, error) {
+	var out []event.Event
+	err := s.readers.read(id, func(db *sql.DB) error {
+		var err error
+		out, err = queryEvents(ctx, db, `SELECT `+eventColumns+` FROM events
+			WHERE id = ? AND (expires_at IS NULL OR expires_at > ?) AND deleted_at IS NULL`, id, time.Now().UnixNano())
+		return err
+	})
+	if err != nil {
+		return event.Event{}, err
+	}
+	if len(out) == 0 {
+		return event.Event{}, ErrNotFound
+	}
+	return out[0], nil
+}
+
+// GetMany looks ids up in chunks, to stay under SQLite's limit on query
+// parameters.
+func (s *SQLite) GetMany(ctx context.Context, ids []int64) ([]event.Event, error) {
+	found := make(map[int64]event.Event, len(ids))
+	now := time.Now().UnixNano()
+	for chunk := range slices.Chunk(ids, 500) {
+		args := make([]any, 0, len(chunk)+1)
+		for _, id := range chunk {
+			args = append(args, id)
+		}
+		args = append(args, now)
+		err := s.readers.read(slices.Max(chunk), func(db *sql.DB) error {
+			list, err := queryEvents(ctx, db, `SELECT `+eventColumns+` FROM events
+				WHERE id IN (?`+strings.Repeat(", ?", len(chunk)-1)+`) AND (expires_at IS NULL OR expires_at > ?)
+				AND deleted_at IS NULL`, args...)
+			for _, e := range list {
+				found[e.ID] = e
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return orderByIDs(ids, found), nil
+}
+
+// Trash and Restore update the row in place; the event's outbox
+// deliveries and annotations stay with it.
+func (s *SQLite) Trash(ctx context.Context, id int64) (event.Event, error) {
+	now := time.Now().UTC()
+	return s.setDeleted(ctx, `deleted_at = ? WHERE id = ? AND deleted_at IS NULL`, now.UnixNano(), id, now.UnixNano())
+}
+
+func (s *SQLite) Restore(ctx context.Context, id int64) (event.Event, error) {
+	return s.setDeleted(ctx, `deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL`, id, time.Now().UnixNano())
+}
+
+// setDeleted runs the UPDATE of set on an event that has not expired,
+// whose time is bound last.
+func (s *SQLite) setDeleted(ctx context.Context, set string, args ...any) (event.Event, error) {
+	out, err := queryEvents(ctx, s.db, `UPDATE events SET `+set+` AND (expires_at IS NULL OR expires_at > ?)
+		RETURNING `+eventColumns, args...)
+	if err != nil {
+		return event.Event{}, err
+	}
+	if len(out) == 0 {
+		return event.Event{}, ErrNotFound
+	}
+	return out[0], nil
+}
+
+// orderByIDs returns the events of found in the order of ids.
+func orderByIDs(ids []int64, found map[int64]event.Event) []event.Event {
+	out := make([]event.Event, 0, len(found))
+	for _, id := range ids {
+		if e, ok := found[id]; ok {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func (s *SQLite) Annotate(ctx context.Context, a Annotation) (Annotation, error) {
+	if a.Time.IsZero() {
+		a.Time = time.Now().UTC()
+	}
+	annotations, err := marshalJSON(a.Annotations, len(a.Annotations) == 0)
+	if err != nil {
+		return Annotation{}, err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Annotation{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	var exists bool
+	var latest int64
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM events WHERE id = ?),
+		(SELECT COALESCE(MAX(version), 0) FROM event_annotations WHERE event_id = ?)`, a.EventID, a.EventID).Scan(&exists, &latest)
+	if err != nil {
+		return Annotation{}, err
+	}
+	if !exists {
+		return Annotation{}, ErrNotFound
+	}
+	if latest != a.Version-1 {
+		return Annotation{}, ErrVersionMismatch
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO event_annotations (event_id, version, status, annotations, actor, time) VALUES (?, ?, ?, ?, ?, ?)`,
+		a.EventID, a.Version, a.Status, annotations, a.Actor, a.Time.UnixNano())
+	if err != nil {
+		return Annotation{}, err
+	}
+	return a, tx.Commit()
+}
+
+// Annotations reads the primary, so a version just written is seen.
+func (s *SQLite) Annotations(ctx context.Context, id int64) ([]Annotation, error) {
+	rows, err := s.readers.primary.QueryContext(ctx, `SELECT version, status, annotations, actor, time FROM event_annotations
+		WHERE event_id = ? ORDER BY version`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Annotation{}
+	for rows.Next() {
+		a := Annotation{EventID: id}
+		var annotations sql.NullString
+		var at int64
+		if err := rows.Scan(&a.Version, &a.Status, &annotations, &a.Actor, &at); err != nil {
+			return nil, err
+		}
+		if annotations.Valid {
+			if err := json.Unmarshal([]byte(annotations.String), &a.Annotations); err != nil {
+				return nil, fmt.Errorf("event %d: decode annotations: %w", id, err)
+			}
+		}
+		a.Time = time.Unix(0, at).UTC()
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// Purge relies on the foreign keys to drop the tag and field index rows,
+// the pending deliveries and the annotations of the deleted events.
+func (s *SQLite) Purge(ctx context.Context, q Query) (int64, error) {
+	if err := q.Validate(); err != nil {
+		return 0, err
+	}
+	q.FromID, q.purge = 0, true
+	where, args := whereClause(q, s.width > 0, s.fields)
+	res, err := s.db.ExecContext(ctx, `DELETE FROM events`+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Deliveries reads the primary, which replicas may trail.
+func (s *SQLite) Deliveries(ctx context.Context, sink string, now time.Time, limit int, byKey bool) ([]Delivery, error) {
+	args := []any{sink, now.UnixNano()}
+	held := ""
+	if byKey {
+		// an earlier delivery of the key waiting for its retry holds it back
+		held = ` AND (events.partition_key IS NULL OR NOT EXISTS (SELECT 1
+			FROM sink_outbox AS r JOIN events AS re ON re.id = r.event_id
+			WHERE r.sink = o.sink AND r.event_id < o.event_id AND NOT r.dead AND r.attempts > 0
+				AND r.next_attempt_at > ? AND re.partition_key = events.partition_key))`
+		args = append(args, now.UnixNano())
+	}
+	rows, err := s.readers.primary.QueryContext(ctx, `SELECT `+eventColumns+`, o.attempts, o.next_attempt_at, o.last_error
+		FROM sink_outbox AS o JOIN events ON events.id = o.event_id
+		WHERE o.sink = ? AND NOT o.dead AND o.next_attempt_at <= ?`+held+`
+		ORDER BY o.event_id LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Delivery{}
+	for rows.Next() {
+		d := Delivery{Sink: sink}
+		var next int64
+		var lastErr sql.NullString
+		if d.Event, err = scanEvent(rows, &d.Attempts, &next, &lastErr); err != nil {
+			return nil, err
+		}
+		d.NextAttempt = time.Unix(0, next).UTC()
+		d.LastError = lastErr.String
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLite) DeadDeliveries(ctx context.Context, sink string, limit int) ([]Delivery, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.readers.primary.QueryContext(ctx, `SELECT `+eventColumns+`, o.sink, o.attempts, o.next_attempt_at, o.last_error
+		FROM sink_outbox AS o JOIN events ON events.id = o.event_id
+		WHERE o.dead AND (? = '' OR o.sink = ?)
+		ORDER BY o.event_id DESC, o.sink LIMIT ?`, sink, sink, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Delivery{}
+	for rows.Next() {
+		d := Delivery{Dead: true}
+		var next int64
+		var lastErr sql.NullString
+		if d.Event, err = scanEvent(rows, &d.Sink, &d.Attempts, &next, &lastErr); err != nil {
+			return nil, err
+		}
+		d.NextAttempt = time.Unix(0, next).UTC()
+		d.LastError = lastErr.String
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLite) AckDeliveries(ctx context.Context, sink string, ids ...int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]any, 0, len(ids)+1)
+	args = append(args, sink)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	_, err := s.db.ExecContext(ctx, `DELETE FROM sink_outbox WHERE sink = ? AND event_id IN (?`+strings.Repeat(`, ?`, len(ids)-1)+`)`, args...)
+	return err
+}
+
+func (s *SQLite) RetryDeliveries(ctx context.Context, ds []Delivery) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	for _, d := range ds {
+		if _, err := tx.ExecContext(ctx, `UPDATE sink_outbox SET attempts = ?, next_attempt_at = ?, last_error = ?, dead = ?
+			WHERE sink = ? AND event_id = ?`,
+			d.Attempts, d.NextAttempt.UnixNano(), d.LastError, d.Dead, d.Sink, d.Event.ID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLite) OutboxDepth(ctx context.Context) (map[string]OutboxCount, error) {
+	rows, err := s.readers.primary.QueryContext(ctx, `SELECT sink, dead, count(*) FROM sink_outbox GROUP BY sink, dead`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[string]OutboxCount{}
+	for rows.Next() {
+		var sink string
+		var dead bool
+		var n int64
+		if err := rows.Scan(&sink, &dead, &n); err != nil {
+			return nil, err
+		}
+		c := out[sink]
+		if dead {
+			c.Dead = n
+		} else {
+			c.Pending = n
+		}
+		out[sink] = c
+	}
+	return out, rows.Err()
+}
+
+// eventColumns are the columns scanned by queryEvents, in order.
+const eventColumns = `id, type, payload, metadata, tags, events.deliver_at, received_at, schema_version, expires_at, correlation_id, causation_id, partition_key, deleted_at, occurred_at`
+
+func queryEvents(ctx context.Context, db *sql.DB, stmt string, args ...any) ([]event.Event, error) {
+	rows, err := db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []event.Event{}
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// scanEvent scans eventColumns, followed by the extra columns into extra.
+func scanEvent(rows *sql.Rows, extra ...any) (event.Event, error) {
+	var e event.Event
+	var payload string
+	var meta, tags, version, correlation, causation, key sql.NullString
+	var deliverAt, expiresAt, deletedAt, occurredAt sql.NullInt64
+	var received int64
+	dest := append([]any{&e.ID, &e.Type, &payload, &meta, &tags, &deliverAt, &received, &version, &expiresAt, &correlation, &causation, &key, &deletedAt, &occurredAt}, extra...)
+	if err := rows.Scan(dest...); err != nil {
+		return event.Event{}, err
+	}
+	e.Payload = json.RawMessage(payload)
+	if meta.Valid {
+		if err := json.Unmarshal([]byte(meta.String), &e.Metadata); err != nil {
+			return event.Event{}, fmt.Errorf("event %d: decode metadata: %w", e.ID, err)
+		}
+	}
+	if tags.Valid {
+		if err := json.Unmarshal([]byte(tags.String), &e.Tags); err != nil {
+			return event.Event{}, fmt.Errorf("event %d: decode tags: %w", e.ID, err)
+		}
+	}
+	if deliverAt.Valid {
+		at := time.Unix(0, deliverAt.Int64).UTC()
+		e.DeliverAt = &at
+	}
+	if expiresAt.Valid {
+		at := time.Unix(0, expiresAt.Int64).UTC()
+		e.ExpiresAt = &at
+	}
+	if deletedAt.Valid {
+		at := time.Unix(0, deletedAt.Int64).UTC()
+		e.DeletedAt = &at
+	}
+	if occurredAt.Valid {
+		at := time.Unix(0, occurredAt.Int64).UTC()
+		e.OccurredAt = &at
+	}
+	e.ReceivedAt = time.Unix(0, received).UTC()
+	e.SchemaVersion = version.String
+	e.CorrelationID, e.CausationID = correlation.String, causation.String
+	e.PartitionKey = key.String
+	return e, nil
+}
+
+// nullString stores "" as NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func (s *SQLite) Close() error {
+	s.fields.stop()
+	s.readers.close()
+	return s.db.Close()
+}
+
+// marshalJSON encodes v for a nullable JSON column, storing NULL when empty.
+func marshalJSON(v any, empty bool) (sql.NullString, error) {
+	if empty {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+// eventTypes returns the types of the events stored, for warming a hot
+// tier; the type index answers it.
+func (s *SQLite) eventTypes(ctx context.Context, minID int64) ([]string, error) {
+	var types []string
+	err := s.readers.read(minID, func(db *sql.DB) error {
+		rows, err := db.QueryContext(ctx, `SELECT DISTINCT type FROM events ORDER BY type`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var typ string
+			if err := rows.Scan(&typ); err != nil {
+				return err
+			}
+			types = append(types, typ)
+		}
+		return rows.Err()
+	})
+	return types, err
+}
+
+func (s *SQLite) Stats(ctx context.Context, q Query, bucket time.Duration) (*Stats, error) {
+	if err := ValidateStats(q, bucket); err != nil {
+		return nil, err
+	}
+	var st *Stats
+	err := s.readers.read(q.MinID, func(db *sql.DB) error {
+		var err error
+		st, err = sqliteStats(ctx, db, q, bucket, s.width > 0, s.fields)
+		return err
+	})
+	return st, err
+}
+
+func sqliteStats(ctx context.Context, db *sql.DB, q Query, bucket time.Duration, partitioned bool, fields *fieldIndexes) (*Stats, error) {
+	where, args := whereClause(q, partitioned, fields)
+	st := newStats(q, bucket)
+	rows, err := db.QueryContext(ctx, `SELECT type, COUNT(*), MIN(length(CAST(payload AS BLOB))), `+
+		`MAX(length(CAST(payload AS BLOB))), SUM(length(CAST(payload AS BLOB))) FROM events`+where+
+		` GROUP BY type`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t TypeStats
+		var sum int64
+		if err := rows.Scan(&t.Type, &t.Count, &t.MinPayloadBytes, &t.MaxPayloadBytes, &sum); err != nil {
+			return nil, err
+		}
+		t.AvgPayloadBytes = float64(sum) / float64(t.Count)
+		st.addType(t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	brows, err := db.QueryContext(ctx, `SELECT (received_at - ?) / ?, COUNT(*) FROM events`+where+` GROUP BY 1`,
+		append([]any{q.Since.UnixNano(), bucket.Nanoseconds()}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer brows.Close()
+	for brows.Next() {
+		var i, n int64
+		if err := brows.Scan(&i, &n); err != nil {
+			return nil, err
+		}
+		st.addBucket(int(i), n)
+	}
+	return st.finish(), brows.Err()
+}
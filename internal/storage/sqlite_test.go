@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// TestSQLiteSchema opens a new database in WAL mode with every migration
+// and the type and received_at indexes, and reopens it without running the
+// migrations again.
+func TestSQLiteSchema(t *testing.T) {
+	cfg := config.StorageConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "events.db")}
+	for open := range 2 {
+		s, err := OpenSQLite(cfg)
+		if err != nil {
+			t.Fatalf("open %d: %v", open+1, err)
+		}
+		var mode string
+		if err := s.db.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil || mode != "wal" {
+			t.Errorf("open %d: journal mode %q, %v", open+1, mode, err)
+		}
+		var version, applied int
+		if err := s.db.QueryRow(`SELECT MAX(version), COUNT(*) FROM schema_migrations`).Scan(&version, &applied); err != nil {
+			t.Fatal(err)
+		}
+		if version != len(sqliteMigrations) || applied != len(sqliteMigrations) {
+			t.Errorf("open %d: schema version %d with %d migrations applied, want %d", open+1, version, applied, len(sqliteMigrations))
+		}
+		for _, index := range []string{"events_type_idx", "events_received_at_idx"} {
+			var table string
+			if err := s.db.QueryRow(`SELECT tbl_name FROM sqlite_master WHERE type = 'index' AND name = ?`, index).Scan(&table); err != nil || table != "events" {
+				t.Errorf("open %d: index %s on %q, %v", open+1, index, table, err)
+			}
+		}
+		_ = s.Close()
+	}
+}
+
+// TestSQLiteRoundTrip reads back what was added, through a reopen, and
+// deletes it.
+func TestSQLiteRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	cfg := config.StorageConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "events.db")}
+	s, err := OpenSQLite(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	occurred := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	var added []event.Event
+	for _, e := range []event.Event{
+		{Type: "order.created", Payload: json.RawMessage(`{"total":12}`), Tags: []string{"eu"}},
+		{Type: "signup", Payload: json.RawMessage(`{"plan":"free"}`), OccurredAt: &occurred},
+		{Type: "order.paid", Payload: json.RawMessage(`{"total":12}`)},
+	} {
+		e, err := s.Add(ctx, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		added = append(added, e)
+	}
+	_ = s.Close()
+
+	if s, err = OpenSQLite(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, want := range added {
+		got, err := s.Get(ctx, want.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Type != want.Type || string(got.Payload) != string(want.Payload) || !reflect.DeepEqual(got.Tags, want.Tags) ||
+			!got.ReceivedAt.Equal(want.ReceivedAt) || (want.OccurredAt != nil) != (got.OccurredAt != nil) {
+			t.Errorf("event %d: got %+v, want %+v", want.ID, got, want)
+		}
+	}
+	for _, c := range []struct {
+		q    Query
+		want []int64
+	}{
+		{Query{}, []int64{3, 2, 1}},
+		{Query{Types: []string{"order.*"}, Ascending: true}, []int64{1, 3}},
+		{Query{Tags: []string{"eu"}}, []int64{1}},
+		{Query{Fields: map[string]string{"total": "12"}, Limit: 1}, []int64{3}},
+	} {
+		got, err := s.List(ctx, c.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids(got), c.want) {
+			t.Errorf("list %+v: %v, want %v", c.q, ids(got), c.want)
+		}
+	}
+
+	n, err := s.Purge(ctx, Query{Types: []string{"order.*"}})
+	if err != nil || n != 2 {
+		t.Fatalf("purge: %d %v", n, err)
+	}
+	if _, err := s.Get(ctx, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("get a purged event: %v", err)
+	}
+	if got, _ := s.List(ctx, Query{}); !reflect.DeepEqual(ids(got), []int64{2}) {
+		t.Errorf("list after the purge: %v", ids(got))
+	}
+	var tags int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM event_tags`).Scan(&tags); err != nil || tags != 0 {
+		t.Errorf("%d tag rows left, %v", tags, err)
+	}
+}
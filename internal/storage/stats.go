@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// ErrInvalidQuery wraps the errors Stats returns for unusable arguments.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// MaxStatsBuckets caps the number of time buckets in one Stats call.
+const MaxStatsBuckets = 10_080
+
+// Stats aggregates the events matching a query over [Since, Until).
+type Stats struct {
+	Since  time.Time     `json:"since"`
+	Until  time.Time     `json:"until"`
+	Bucket time.Duration `json:"bucket_ns"`
+	Total  int64         `json:"total"`
+	// Types is ordered by descending count.
+	Types []TypeStats `json:"types"`
+	// Buckets holds one entry per Bucket interval from Since, including
+	// empty ones.
+	Buckets []BucketCount `json:"buckets"`
+}
+
+type TypeStats struct {
+	Type            string  `json:"type"`
+	Count           int64   `json:"count"`
+	MinPayloadBytes int64   `json:"min_payload_bytes"`
+	MaxPayloadBytes int64   `json:"max_payload_bytes"`
+	AvgPayloadBytes float64 `json:"avg_payload_bytes"`
+}
+
+type BucketCount struct {
+	Start time.Time `json:"start"`
+	Count int64     `json:"count"`
+}
+
+// ValidateStats checks q and bucket; Stats needs both time bounds.
+func ValidateStats(q Query, bucket time.Duration) error {
+	if err := q.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidQuery, err)
+	}
+	if q.Since.IsZero() || q.Until.IsZero() {
+		return fmt.Errorf("%w: stats need since and until", ErrInvalidQuery)
+	}
+	if bucket <= 0 {
+		return fmt.Errorf("%w: bucket must be positive", ErrInvalidQuery)
+	}
+	if n := q.Until.Sub(q.Since) / bucket; n >= MaxStatsBuckets {
+		return fmt.Errorf("%w: too many buckets (max %d), use a larger bucket or a shorter range", ErrInvalidQuery, MaxStatsBuckets)
+	}
+	return nil
+}
+
+func newStats(q Query, bucket time.Duration) *Stats {
+	n := int((q.Until.Sub(q.Since) + bucket - 1) / bucket)
+	st := &Stats{Since: q.Since, Until: q.Until, Bucket: bucket, Types: []TypeStats{}, Buckets: make([]BucketCount, n)}
+	for i := range st.Buckets {
+		st.Buckets[i].Start = q.Since.Add(time.Duration(i) * bucket)
+	}
+	return st
+}
+
+func (st *Stats) addType(t TypeStats) {
+	st.Types = append(st.Types, t)
+	st.Total += t.Count
+}
+
+func (st *Stats) addBucket(i int, n int64) {
+	if i >= 0 && i < len(st.Buckets) {
+		st.Buckets[i].Count += n
+	}
+}
+
+func (st *Stats) finish() *Stats {
+	slices.SortFunc(st.Types, func(a, b TypeStats) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Type, b.Type)
+	})
+	return st
+}
+
+// StatsChunks splits the window of q into at most n consecutive queries of
+// whole buckets, for computing Stats piecewise.
+func StatsChunks(q Query, bucket time.Duration, n int) []Query {
+	buckets := int((q.Until.Sub(q.Since) + bucket - 1) / bucket)
+	per := time.Duration((buckets+n-1)/n) * bucket
+	var out []Query
+	for since := q.Since; since.Before(q.Until); since = since.Add(per) {
+		c := q
+		c.Since, c.Until = since, since.Add(per)
+		if c.Until.After(q.Until) {
+			c.Until = q.Until
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// Merge adds o, the stats of the window right after st's with the same
+// bucket, to st.
+func (st *Stats) Merge(o *Stats) {
+	st.Until = o.Until
+	st.Total += o.Total
+	st.Buckets = append(st.Buckets, o.Buckets...)
+	for _, t := range o.Types {
+		i := slices.IndexFunc(st.Types, func(s TypeStats) bool { return s.Type == t.Type })
+		if i < 0 {
+			st.Types = append(st.Types, t)
+			continue
+		}
+		s := &st.Types[i]
+		s.AvgPayloadBytes = (s.AvgPayloadBytes*float64(s.Count) + t.AvgPayloadBytes*float64(t.Count)) / float64(s.Count+t.Count)
+		s.Count += t.Count
+		s.MinPayloadBytes = min(s.MinPayloadBytes, t.MinPayloadBytes)
+		s.MaxPayloadBytes = max(s.MaxPayloadBytes, t.MaxPayloadBytes)
+	}
+	st.finish()
+}
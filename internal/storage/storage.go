@@ -0,0 +1,166 @@
+// Package storage persists accepted events behind a driver-agnostic Store.
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// Store is implemented by every storage driver. Its methods take the
+// context of the request or job they serve: a driver stops waiting on its
+// database, and fails with ctx's error, once ctx ends.
+type Store interface {
+	// Add persists e, assigning its ID and ReceivedAt, together with a
+	// pending delivery to each of sinks in the outbox. It gives up with
+	// ctx's error, writing nothing, once ctx ends before the write commits.
+	Add(ctx context.Context, e event.Event, sinks ...string) (event.Event, error)
+	// List returns the events matching q, newest first.
+	List(ctx context.Context, q Query) ([]event.Event, error)
+	// Stats aggregates the events matching q, which must have both time
+	// bounds, per type and per bucket interval.
+	Stats(ctx context.Context, q Query, bucket time.Duration) (*Stats, error)
+	// Scheduled returns the events with a DeliverAt that have not been
+	// released yet, earliest DeliverAt first.
+	Scheduled(ctx context.Context) ([]event.Event, error)
+	// Release records that the scheduled event id was handed to the sinks.
+	Release(ctx context.Context, id int64) error
+	// Consumers returns every pull consumer, by name.
+	Consumers(ctx context.Context) ([]Consumer, error)
+	// SaveConsumer creates or updates c.
+	SaveConsumer(ctx context.Context, c Consumer) error
+	// AppendAudit adds e to the audit trail, assigning its ID and, when
+	// zero, its Time. Entries are never updated or deleted.
+	AppendAudit(ctx context.Context, e AuditEntry) (AuditEntry, error)
+	// Audit returns the audit entries matching q, newest first.
+	Audit(ctx context.Context, q AuditQuery) ([]AuditEntry, error)
+	// SaveIdempotent creates or replaces the response stored under r.Key,
+	// dropping expired ones.
+	SaveIdempotent(ctx context.Context, r IdempotentResponse) error
+	// IdempotentResponses returns the responses that have not expired.
+	IdempotentResponses(ctx context.Context) ([]IdempotentResponse, error)
+	// SaveReceipt creates or replaces the receipt r.ID, dropping expired
+	// ones.
+	SaveReceipt(ctx context.Context, r Receipt) error
+	// Receipts returns the receipts among ids that have not expired, in no
+	// particular order.
+	Receipts(ctx context.Context, ids ...string) ([]Receipt, error)
+	// Deliveries returns up to limit pending deliveries to sink that are due
+	// at now, oldest event first. With byKey it leaves out the deliveries
+	// held back by an earlier failed delivery of the same partition key
+	// waiting for its retry, so the sink gets each key's events in order.
+	Deliveries(ctx context.Context, sink string, now time.Time, limit int, byKey bool) ([]Delivery, error)
+	// AckDeliveries deletes the deliveries of the events ids to sink.
+	AckDeliveries(ctx context.Context, sink string, ids ...int64) error
+	// RetryDeliveries saves the Attempts, NextAttempt, LastError and Dead
+	// of each of ds.
+	RetryDeliveries(ctx context.Context, ds []Delivery) error
+	// DeadDeliveries returns up to limit dead deliveries to sink, or to
+	// every sink when empty, newest event first; limit <= 0 means all.
+	DeadDeliveries(ctx context.Context, sink string, limit int) ([]Delivery, error)
+	// OutboxDepth counts the pending and dead deliveries per sink.
+	OutboxDepth(ctx context.Context) (map[string]OutboxCount, error)
+	// Tenants returns every onboarded tenant, by name.
+	Tenants(ctx context.Context) ([]Tenant, error)
+	// SaveTenant creates or replaces the tenant named t.Config.Name.
+	SaveTenant(ctx context.Context, t Tenant) error
+	// DeleteTenant removes the tenant record; its events are left to Purge.
+	DeleteTenant(ctx context.Context, name string) error
+	// ACLRules returns every event type ACL rule, oldest first.
+	ACLRules(ctx context.Context) ([]ACLRule, error)
+	// SaveACLRule creates or replaces the rule r.ID.
+	SaveACLRule(ctx context.Context, r ACLRule) error
+	// DeleteACLRule removes the rule id.
+	DeleteACLRule(ctx context.Context, id string) error
+	// TenantKeys returns every tenant encryption key version, by tenant
+	// and version.
+	TenantKeys(ctx context.Context) ([]TenantKey, error)
+	// SaveTenantKey adds the key version k.Version of k.Tenant.
+	SaveTenantKey(ctx context.Context, k TenantKey) error
+	// DeleteTenantKeys removes every key version of tenant, so that it
+	// cannot be recovered from the store.
+	DeleteTenantKeys(ctx context.Context, tenant string) error
+	// Get returns the event id, or ErrNotFound.
+	Get(ctx context.Context, id int64) (event.Event, error)
+	// GetMany returns the events among ids that exist and have not
+	// expired, in the order of ids; the others are left out.
+	GetMany(ctx context.Context, ids []int64) ([]event.Event, error)
+	// Trash moves the event id to the trash, setting its DeletedAt, or
+	// fails with ErrNotFound when it does not exist, has expired or is in
+	// the trash already.
+	Trash(ctx context.Context, id int64) (event.Event, error)
+	// Restore takes the event id out of the trash, or fails with
+	// ErrNotFound when it is not there.
+	Restore(ctx context.Context, id int64) (event.Event, error)
+	// Annotate stores a.Version of the annotation of event a.EventID,
+	// assigning a.Time when zero. It fails with ErrVersionMismatch unless
+	// the latest stored version is a.Version-1, and with ErrNotFound when
+	// the event does not exist.
+	Annotate(ctx context.Context, a Annotation) (Annotation, error)
+	// Annotations returns every version of the annotation of event id,
+	// oldest first.
+	Annotations(ctx context.Context, id int64) ([]Annotation, error)
+	// AddUsage adds the counts of each of us to the record of its hour,
+	// key and tenant, creating it when missing.
+	AddUsage(ctx context.Context, us []Usage) error
+	// Usage returns the usage records matching q, oldest hour first.
+	Usage(ctx context.Context, q UsageQuery) ([]Usage, error)
+	// AcquireLease takes the lease name for holder until ttl from now, or
+	// renews it, unless another holder's lease has not expired yet. It
+	// reports whether holder holds the lease.
+	AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error)
+	// ReleaseLease ends the lease name if holder holds it.
+	ReleaseLease(ctx context.Context, name, holder string) error
+	// Purge deletes the events matching q (Limit and FromID are ignored),
+	// with their pending deliveries and annotations, returning how many
+	// were deleted.
+	Purge(ctx context.Context, q Query) (int64, error)
+	Close() error
+}
+
+// Open returns the Store selected by cfg.Driver, numbering events as ids
+// says, behind the Redis stream of cfg.Redis when it has a URL.
+func Open(cfg config.StorageConfig, ids config.IDsConfig) (Store, error) {
+	s, err := open(cfg, ids)
+	if err != nil || cfg.Redis.URL == "" {
+		return s, err
+	}
+	r, err := NewRedisStream(s, cfg.Redis)
+	if err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func open(cfg config.StorageConfig, ids config.IDsConfig) (Store, error) {
+	switch cfg.Driver {
+	case "", "memory":
+		return NewMemory(cfg.Shards), nil
+	case "sqlite":
+		s, err := OpenSQLite(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if ids.Strategy != "" && ids.Strategy != "sequence" {
+			if err := s.GenerateIDs(ids.Node); err != nil {
+				_ = s.Close()
+				return nil, err
+			}
+		}
+		if cfg.Hot.EventsPerType <= 0 {
+			return s, nil
+		}
+		t, err := NewTiered(s, cfg.Hot)
+		if err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+		return t, nil
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", cfg.Driver)
+	}
+}
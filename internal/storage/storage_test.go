@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/breaker"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// TestGetMany returns the events asked for in the order asked, past the
+// SQLite chunk size and across the hot tier and its store, leaving out
+// unknown and expired IDs.
+func TestGetMany(t *testing.T) {
+	sqlite, err := OpenSQLite(config.StorageConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "events.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+	hot, err := NewTiered(NewMemory(2), config.HotTierConfig{EventsPerType: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]Store{"memory": NewMemory(2), "sqlite": sqlite, "tiered": hot} {
+		for range 520 {
+			if _, err := s.Add(context.Background(), event.Event{Type: "a", Payload: json.RawMessage("{}")}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		past := time.Now().Add(-time.Second)
+		expired, err := s.Add(context.Background(), event.Event{Type: "a", Payload: json.RawMessage("{}"), ExpiresAt: &past})
+		if err != nil {
+			t.Fatal(err)
+		}
+		asked := []int64{520, 9999, expired.ID, 3}
+		for id := int64(510); id > 0; id -= 2 {
+			asked = append(asked, id)
+		}
+		got, err := s.GetMany(context.Background(), asked)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := slices.DeleteFunc(slices.Clone(asked), func(id int64) bool { return id == 9999 || id == expired.ID })
+		if !slices.Equal(ids(got), want) {
+			t.Errorf("%s: got IDs %v\nwant %v", name, ids(got), want)
+		}
+	}
+}
+
+// TestTrash hides trashed events from reads until they are restored, and
+// purges those left in the trash past its retention.
+func TestTrash(t *testing.T) {
+	sqlite, err := OpenSQLite(config.StorageConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "events.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+	hot, err := NewTiered(NewMemory(2), config.HotTierConfig{EventsPerType: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]Store{"memory": NewMemory(2), "sqlite": sqlite, "tiered": hot} {
+		for range 3 {
+			if _, err := s.Add(context.Background(), event.Event{Type: "a", Payload: json.RawMessage("{}")}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, id := range []int64{1, 2} {
+			if e, err := s.Trash(context.Background(), id); err != nil || e.DeletedAt == nil {
+				t.Fatalf("%s: trash %d: %v, deleted at %v", name, id, err, e.DeletedAt)
+			}
+		}
+		if _, err := s.Trash(context.Background(), 2); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: trash twice: got %v, want %v", name, err, ErrNotFound)
+		}
+		if _, err := s.Get(context.Background(), 1); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: get trashed: got %v, want %v", name, err, ErrNotFound)
+		}
+		list, err := s.List(context.Background(), Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		trash, err := s.List(context.Background(), Query{Trashed: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(ids(list), []int64{3}) || !slices.Equal(ids(trash), []int64{2, 1}) {
+			t.Errorf("%s: listed %v, trash %v", name, ids(list), ids(trash))
+		}
+
+		if _, err := s.Restore(context.Background(), 3); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: restore untrashed: got %v, want %v", name, err, ErrNotFound)
+		}
+		if e, err := s.Restore(context.Background(), 1); err != nil || e.DeletedAt != nil {
+			t.Fatalf("%s: restore: %v, deleted at %v", name, err, e.DeletedAt)
+		}
+		if _, err := s.Get(context.Background(), 1); err != nil {
+			t.Errorf("%s: get restored: %v", name, err)
+		}
+		if n, err := PurgeTrash(context.Background(), s, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+			t.Errorf("%s: purge within retention: %d, %v", name, n, err)
+		}
+		if n, err := PurgeTrash(context.Background(), s, time.Now().Add(time.Second)); err != nil || n != 1 {
+			t.Errorf("%s: purge past retention: %d, %v", name, n, err)
+		}
+		if _, err := s.Restore(context.Background(), 2); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: restore purged: got %v, want %v", name, err, ErrNotFound)
+		}
+	}
+}
+
+// TestOrderByOccurred lists by the producer's time, falling back to the
+// receipt time for events without one.
+func TestOrderByOccurred(t *testing.T) {
+	sqlite, err := OpenSQLite(config.StorageConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "events.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+	hot, err := NewTiered(NewMemory(2), config.HotTierConfig{EventsPerType: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	hourAgo, dayAgo := now.Add(-time.Hour), now.Add(-24*time.Hour)
+	for name, s := range map[string]Store{"memory": NewMemory(2), "sqlite": sqlite, "tiered": hot} {
+		for _, at := range []*time.Time{&hourAgo, nil, &dayAgo} {
+			if _, err := s.Add(context.Background(), event.Event{Type: "a", Payload: json.RawMessage("{}"), OccurredAt: at}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		list, err := s.List(context.Background(), Query{OrderBy: "occurred_at"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		asc, err := s.List(context.Background(), Query{OrderBy: "occurred_at", Ascending: true, Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(ids(list), []int64{2, 1, 3}) || !slices.Equal(ids(asc), []int64{3, 1}) {
+			t.Errorf("%s: newest first %v, oldest first %v", name, ids(list), ids(asc))
+		}
+		if e, err := s.Get(context.Background(), 3); err != nil || e.OccurredAt == nil || !e.OccurredAt.Equal(dayAgo) {
+			t.Errorf("%s: get: occurred at %v, %v", name, e.OccurredAt, err)
+		}
+	}
+}
+
+// TestDeliveriesByKey holds back the deliveries of a partition key behind
+// an earlier one waiting for its retry, until it is due again or dead.
+func TestDeliveriesByKey(t *testing.T) {
+	sqlite, err := OpenSQLite(config.StorageConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "events.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+	for name, s := range map[string]Store{"memory": NewMemory(2), "sqlite": sqlite} {
+		for _, key := range []string{"order-1", "order-2", "order-1", "", "order-1"} {
+			if _, err := s.Add(context.Background(), event.Event{Type: "order", Payload: json.RawMessage("{}"), PartitionKey: key}, "hook"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		now := time.Now()
+		first, err := s.Deliveries(context.Background(), "hook", now, 1, true)
+		if err != nil || len(first) != 1 {
+			t.Fatalf("%s: %v, %v", name, first, err)
+		}
+		first[0].Attempts, first[0].NextAttempt = 1, now.Add(time.Minute)
+		if err := s.RetryDeliveries(context.Background(), first); err != nil {
+			t.Fatal(err)
+		}
+		held, err := s.Deliveries(context.Background(), "hook", now, 10, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, err := s.Deliveries(context.Background(), "hook", now, 10, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		due, err := s.Deliveries(context.Background(), "hook", now.Add(2*time.Minute), 10, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first[0].Dead = true
+		if err := s.RetryDeliveries(context.Background(), first); err != nil {
+			t.Fatal(err)
+		}
+		dead, err := s.Deliveries(context.Background(), "hook", now, 10, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []struct {
+			got  []Delivery
+			want []int64
+		}{{held, []int64{2, 4}}, {all, []int64{2, 3, 4, 5}}, {due, []int64{1, 2, 3, 4, 5}}, {dead, []int64{2, 3, 4, 5}}} {
+			var got []int64
+			for _, d := range c.got {
+				got = append(got, d.Event.ID)
+			}
+			if !slices.Equal(got, c.want) {
+				t.Errorf("%s: deliveries %v, want %v", name, got, c.want)
+			}
+		}
+	}
+}
+
+// TestAddCanceled writes nothing, outbox deliveries included, for an Add
+// whose context ended, and breaks no breaker with it.
+func TestAddCanceled(t *testing.T) {
+	sqlite, err := OpenSQLite(config.StorageConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "events.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for name, s := range map[string]Store{"memory": NewMemory(2), "sqlite": sqlite} {
+		b := breaker.New("storage", config.BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute})
+		guarded := Guard(s, b)
+		if _, err := guarded.Add(ctx, event.Event{Type: "a", Payload: json.RawMessage("{}")}, "hook"); !errors.Is(err, context.Canceled) {
+			t.Fatalf("%s: add with a canceled context: %v", name, err)
+		}
+		if got := b.State(); got != breaker.Closed {
+			t.Errorf("%s: breaker %v after a canceled add", name, got)
+		}
+		events, err := s.List(context.Background(), Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds, err := s.Deliveries(context.Background(), "hook", time.Now(), 10, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) > 0 || len(ds) > 0 {
+			t.Errorf("%s: a canceled add left %d events and %d deliveries", name, len(events), len(ds))
+		}
+	}
+}
+
+// TestSQLiteCanceled fails the reads and writes whose context ended with
+// its error, without touching the rows or breaking the breaker.
+func TestSQLiteCanceled(t *testing.T) {
+	s, err := OpenSQLite(config.StorageConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "events.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	e, err := s.Add(context.Background(), event.Event{Type: "a", Payload: json.RawMessage("{}")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := breaker.New("storage", config.BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute})
+	guarded := Guard(s, b)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := guarded.List(ctx, Query{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("list: %v", err)
+	}
+	if _, err := guarded.Get(ctx, e.ID); !errors.Is(err, context.Canceled) {
+		t.Errorf("get: %v", err)
+	}
+	if _, err := s.Purge(ctx, Query{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("purge: %v", err)
+	}
+	if got := b.State(); got != breaker.Closed {
+		t.Errorf("breaker %v after canceled reads", got)
+	}
+	if _, err := s.Get(context.Background(), e.ID); err != nil {
+		t.Errorf("canceled purge deleted the event: %v", err)
+	}
+}
+
+// TestGenerateIDs numbers events after the sequence's with generated IDs,
+// which keep increasing after a restart and page like the sequence.
+func TestGenerateIDs(t *testing.T) {
+	cfg := config.StorageConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "events.db")}
+	add := func(s *SQLite) int64 {
+		e, err := s.Add(context.Background(), event.Event{Type: "a", Payload: json.RawMessage("{}")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e.ID
+	}
+	var added []int64
+	for _, generate := range []bool{false, true, true} {
+		s, err := OpenSQLite(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if generate {
+			if err := s.GenerateIDs(7); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for range 3 {
+			added = append(added, add(s))
+		}
+		s.Close()
+	}
+	if added[2] != 3 || added[3] < 1<<22 || !slices.IsSorted(added) || len(slices.Compact(slices.Clone(added))) != len(added) {
+		t.Fatalf("IDs %v: want 1-3, then increasing generated ones", added)
+	}
+	s, err := OpenSQLite(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	page, err := s.List(context.Background(), Query{FromID: added[3], Ascending: true, Limit: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ids(page), added[3:7]) {
+		t.Errorf("page from %d: %v, want %v", added[3], ids(page), added[3:7])
+	}
+}
+
+// TestWeekPartitions backfills weekly partitions starting on Mondays, the
+// boundaries new events are partitioned on, and drops them whole.
+func TestWeekPartitions(t *testing.T) {
+	cfg := config.StorageConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "events.db")}
+	s, err := OpenSQLite(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wednesday, the Sunday night before a Monday, and that Monday
+	for _, at := range []string{"2026-10-14T09:00:00Z", "2026-10-18T23:59:00Z", "2026-10-19T00:00:00Z"} {
+		e, err := s.Add(context.Background(), event.Event{Type: "a", Payload: json.RawMessage("{}")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts, _ := time.Parse(time.RFC3339, at)
+		if _, err := s.db.Exec(`UPDATE events SET received_at = ? WHERE id = ?`, ts.UnixNano(), e.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	cfg.Partition = "week"
+	if s, err = OpenSQLite(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	parts, err := s.Partitions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	monday := time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC)
+	if len(parts) != 2 || !parts[0].Start.Equal(monday) || !parts[1].Start.Equal(monday.AddDate(0, 0, 7)) ||
+		!parts[1].End.Equal(monday.AddDate(0, 0, 14)) || parts[0].Events != 2 || parts[1].Events != 1 {
+		t.Fatalf("partitions %+v", parts)
+	}
+	if !monday.Equal(monday.Add(40 * time.Hour).Truncate(cfg.PartitionWidth())) {
+		t.Errorf("new events are partitioned on other boundaries")
+	}
+	dropped, err := s.DropPartitions(monday.AddDate(0, 0, 7))
+	if err != nil || len(dropped) != 1 {
+		t.Fatalf("dropped %v, %v", dropped, err)
+	}
+	if page, _ := s.List(context.Background(), Query{Limit: 10}); len(page) != 1 || page[0].ID != 3 {
+		t.Errorf("left %v, want event 3", ids(page))
+	}
+}
+
+// TestSavedQuery filters by type pattern, tags, fields and a window
+// relative to the request, alike in memory and in SQLite.
+func TestSavedQuery(t *testing.T) {
+	sqlite, err := OpenSQLite(config.StorageConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "events.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+	for name, s := range map[string]Store{"memory": NewMemory(2), "sqlite": sqlite} {
+		add := func(typ, payload string, tags ...string) {
+			t.Helper()
+			if _, err := s.Add(context.Background(), event.Event{Type: typ, Payload: json.RawMessage(payload), Tags: tags}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		add("order.created", `{"region":"eu"}`, "vip")
+		time.Sleep(5 * time.Millisecond)
+		mark := time.Now()
+		time.Sleep(5 * time.Millisecond)
+		add("order.paid", `{"region":"eu"}`, "vip")
+		add("order.paid", `{"region":"us"}`, "vip")
+		add("order.refund.v2", `{"region":"eu"}`)
+		add("user.signup", `{"region":"eu"}`, "vip")
+		add("orders", `{"region":"eu"}`, "vip")
+
+		now := time.Now()
+		for _, tc := range []struct {
+			saved config.SavedQueryConfig
+			want  []int64
+		}{
+			{config.SavedQueryConfig{Types: []string{"order.*"}}, []int64{4, 3, 2, 1}},
+			{config.SavedQueryConfig{Types: []string{"order.????", "user.*"}}, []int64{5, 3, 2}},
+			{config.SavedQueryConfig{Types: []string{"order.*"}, Tags: []string{"vip"}, Fields: map[string]string{"region": "eu"}}, []int64{2, 1}},
+			{config.SavedQueryConfig{Types: []string{"order.*"}, Last: now.Sub(mark)}, []int64{4, 3, 2}},
+			{config.SavedQueryConfig{Until: mark}, []int64{1}},
+		} {
+			q := SavedQuery(tc.saved, now)
+			if err := q.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			list, err := s.List(context.Background(), q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(ids(list), tc.want) {
+				t.Errorf("%s: %+v: got %v, want %v", name, tc.saved, ids(list), tc.want)
+			}
+		}
+	}
+}
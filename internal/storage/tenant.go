@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// Tenant is an onboarded tenant. Its keys carry only KeySHA256; the
+// plaintext secrets are handed out once, at creation.
+type Tenant struct {
+	Config    config.TenantConfig
+	CreatedAt time.Time
+}
+
+// TenantKey is a version of a tenant's payload encryption key, stored only
+// wrapped: by the master key, or by a KMS key when KMSKey is set.
+type TenantKey struct {
+	Tenant  string
+	Version int
+	// Source is how the key was made: generated, imported or vault.
+	Source string
+	// KMSKey names the Vault transit key that wrapped the key.
+	KMSKey    string
+	Wrapped   []byte
+	CreatedAt time.Time
+}
@@ -0,0 +1,517 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/typematch"
+)
+
+var (
+	hotReads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "storage_hot_reads_total", Help: "List and get queries by whether the hot tier answered them (hit) or the store (miss)"},
+		[]string{"result"},
+	)
+	hotEvents = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "storage_hot_events", Help: "Events held by the hot tier"},
+	)
+	hotBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "storage_hot_bytes", Help: "Estimated memory held by the hot tier"},
+	)
+	hotWarmSeconds = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "storage_hot_warm_seconds", Help: "How long the hot tier took to load recent events from the store at startup"},
+	)
+)
+
+// Tiered keeps the newest events of each type in memory in front of a
+// persistent Store. List and Get are answered from memory when the events
+// held there are provably the whole answer, and by the store otherwise;
+// everything else goes to the store, Purge and DropPartitions also drop
+// what they delete from memory, and Trash and Restore update it.
+//
+// The tier learns events through Add, so it starts empty and covers the
+// events added after the newest one stored at startup, unless it is warmed:
+// then it starts with the newest events of each type loaded from the store.
+// For each type it holds every event above a floor that rises as events are
+// evicted, by EventsPerType or by the MaxBytes budget, oldest first.
+type Tiered struct {
+	Store
+	perType  int
+	maxBytes int64
+	// base is the newest event in the store when the tier started, below
+	// which the tier holds nothing of a type it did not warm
+	base int64
+	// adding counts Adds between the store and the tier, during which a
+	// cursor read from memory could skip the event
+	adding atomic.Int64
+
+	mu    sync.RWMutex
+	types map[string]*hotType
+	// ids holds the type of each event held, for Get
+	ids map[int64]string
+	// order holds the events in the order they were added, for the budget;
+	// entries of events evicted since are skipped
+	order []hotRef
+	bytes int64
+}
+
+type hotType struct {
+	// events are ascending by ID
+	events []event.Event
+	// floor is the newest evicted event; every event of the type above it
+	// is held
+	floor int64
+}
+
+type hotRef struct {
+	id  int64
+	typ string
+}
+
+// typeLister is implemented by the stores a tier can warm from.
+type typeLister interface {
+	// eventTypes returns the types of the events stored, on a reader that
+	// has seen the event minID.
+	eventTypes(ctx context.Context, minID int64) ([]string, error)
+}
+
+// NewTiered wraps s with a hot tier sized by cfg, warming it first when
+// cfg.Warm is enabled.
+func NewTiered(s Store, cfg config.HotTierConfig) (*Tiered, error) {
+	// the tier is built at startup, before any request
+	ctx := context.Background()
+	newest, err := s.List(ctx, Query{Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	t := &Tiered{Store: s, perType: cfg.EventsPerType, maxBytes: cfg.MaxBytes,
+		types: map[string]*hotType{}, ids: map[int64]string{}}
+	if len(newest) > 0 {
+		t.base = newest[0].ID
+	}
+	if cfg.Warm.Enabled && t.base > 0 {
+		if err := t.warm(ctx, cfg.Warm); err != nil {
+			return nil, fmt.Errorf("warm hot tier: %w", err)
+		}
+	}
+	return t, nil
+}
+
+// warm loads the newest events of each type stored, as many as w gives it
+// up to EventsPerType, setting its floor to the newest event left behind.
+// Since every type stored then has a floor of its own, base no longer
+// bounds them. It runs before the tier is shared.
+func (t *Tiered) warm(ctx context.Context, w config.HotWarmConfig) error {
+	lister, ok := t.Store.(typeLister)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	start := time.Now()
+	types, err := lister.eventTypes(ctx, t.base)
+	if err != nil {
+		return err
+	}
+	var loaded []event.Event
+	for _, typ := range types {
+		h := &hotType{floor: t.base}
+		t.types[typ] = h
+		n := min(w.WarmEvents(typ), t.perType)
+		if n == 0 || !typematch.IsLiteral(typ) {
+			// a type with wildcards would match others as a pattern
+			continue
+		}
+		es, err := t.Store.List(ctx, Query{Types: []string{typ}, BeforeID: t.base + 1, MinID: t.base, Limit: n + 1})
+		if err != nil {
+			return err
+		}
+		h.floor = 0
+		if len(es) > n {
+			h.floor, es = es[n].ID, es[:n]
+		}
+		slices.Reverse(es)
+		h.events = es
+		loaded = append(loaded, es...)
+	}
+	// the budget evicts the oldest first, whatever their type
+	slices.SortFunc(loaded, func(a, b event.Event) int { return cmp.Compare(a.ID, b.ID) })
+	for i := range loaded {
+		e := &loaded[i]
+		t.ids[e.ID] = e.Type
+		t.order = append(t.order, hotRef{id: e.ID, typ: e.Type})
+		t.bytes += hotSize(e)
+	}
+	t.trim()
+	t.base = 0
+	t.gauge()
+	took := time.Since(start)
+	hotWarmSeconds.Set(took.Seconds())
+	log.Info().Int("types", len(types)).Int("events", len(t.ids)).Dur("took", took).Msg("hot tier warmed")
+	return nil
+}
+
+func (t *Tiered) Add(ctx context.Context, e event.Event, sinks ...string) (event.Event, error) {
+	t.adding.Add(1)
+	defer t.adding.Add(-1)
+	created, err := t.Store.Add(ctx, e, sinks...)
+	if err != nil {
+		return created, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.hold(&created)
+	return created, nil
+}
+
+// hold inserts e, unless it is at or below the floor of its type, and
+// evicts what no longer fits. The caller holds t.mu.
+func (t *Tiered) hold(e *event.Event) {
+	h := t.types[e.Type]
+	if h == nil {
+		h = &hotType{}
+		t.types[e.Type] = h
+	}
+	if e.ID <= h.floor {
+		// evicted while it was being added
+		return
+	}
+	i := len(h.events)
+	for i > 0 && h.events[i-1].ID > e.ID {
+		i--
+	}
+	h.events = slices.Insert(h.events, i, *e)
+	t.ids[e.ID] = e.Type
+	t.order = append(t.order, hotRef{id: e.ID, typ: e.Type})
+	t.bytes += hotSize(e)
+	if len(h.events) > t.perType {
+		t.evict(e.Type, h.events[len(h.events)-t.perType-1].ID)
+	}
+	t.trim()
+	t.gauge()
+}
+
+// trim evicts the events held longest until the tier fits its budget. The
+// caller holds t.mu.
+func (t *Tiered) trim() {
+	for t.bytes > t.maxBytes && len(t.order) > 0 {
+		ref := t.order[0]
+		t.order = t.order[1:]
+		if _, ok := t.ids[ref.id]; ok {
+			t.evict(ref.typ, ref.id)
+		}
+	}
+	if len(t.order) > 2*len(t.ids)+64 {
+		// per-type evictions leave their entries behind
+		t.order = slices.DeleteFunc(t.order, func(ref hotRef) bool {
+			_, ok := t.ids[ref.id]
+			return !ok
+		})
+	}
+}
+
+// evict drops the events of typ up to id and raises its floor. The caller
+// holds t.mu.
+func (t *Tiered) evict(typ string, id int64) {
+	h := t.types[typ]
+	n := 0
+	for n < len(h.events) && h.events[n].ID <= id {
+		t.forget(&h.events[n])
+		n++
+	}
+	h.events = slices.Delete(h.events, 0, n)
+	h.floor = max(h.floor, id)
+}
+
+func (t *Tiered) forget(e *event.Event) {
+	delete(t.ids, e.ID)
+	t.bytes -= hotSize(e)
+}
+
+func (t *Tiered) gauge() {
+	hotEvents.Set(float64(len(t.ids)))
+	hotBytes.Set(float64(t.bytes))
+}
+
+func (t *Tiered) List(ctx context.Context, q Query) ([]event.Event, error) {
+	if out, ok := t.list(q); ok {
+		hotReads.WithLabelValues("hit").Inc()
+		return out, nil
+	}
+	hotReads.WithLabelValues("miss").Inc()
+	return t.Store.List(ctx, q)
+}
+
+// list answers q from memory, reporting false when the events held may not
+// be all of the answer.
+func (t *Tiered) list(q Query) ([]event.Event, bool) {
+	if q.Expired || q.Trashed || (q.OrderBy != "" && q.OrderBy != "id") || q.Validate() != nil {
+		return nil, false
+	}
+	if q.FromID > 0 && t.adding.Load() > 0 {
+		return nil, false
+	}
+	q = q.Compile()
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	// every event of the queried types above floor is held
+	floor := t.base
+	var types []*hotType
+	for name, h := range t.types {
+		if (len(q.Types) > 0 && !q.types.Match(name)) || q.notTypes.Match(name) {
+			continue
+		}
+		types = append(types, h)
+		floor = max(floor, h.floor)
+	}
+	// a cursor above floor, or a floor below every event, make the
+	// answer complete whatever the limit; otherwise the newest Limit
+	// events must all be above it
+	complete := floor == 0 || (q.FromID > floor)
+	if !complete && (q.FromID > 0 || q.Ascending || q.Limit <= 0) {
+		return nil, false
+	}
+	ascending := q.FromID > 0 || q.Ascending
+	out := []event.Event{}
+	for _, h := range types {
+		n := 0
+		for i := range h.events {
+			e := &h.events[len(h.events)-1-i]
+			if ascending {
+				e = &h.events[i]
+			}
+			if e.ID <= floor {
+				if ascending {
+					continue
+				}
+				break
+			}
+			if q.Limit > 0 && n == q.Limit {
+				break
+			}
+			if q.Match(e) {
+				out = append(out, *e)
+				n++
+			}
+		}
+	}
+	slices.SortFunc(out, func(a, b event.Event) int {
+		if ascending {
+			return cmp.Compare(a.ID, b.ID)
+		}
+		return cmp.Compare(b.ID, a.ID)
+	})
+	if q.Limit > 0 && len(out) > q.Limit {
+		out = out[:q.Limit]
+	}
+	if !complete && len(out) < q.Limit {
+		return nil, false
+	}
+	return out, true
+}
+
+func (t *Tiered) Get(ctx context.Context, id int64) (event.Event, error) {
+	t.mu.RLock()
+	if typ, ok := t.ids[id]; ok {
+		h := t.types[typ]
+		i, _ := slices.BinarySearchFunc(h.events, id, func(e event.Event, id int64) int { return cmp.Compare(e.ID, id) })
+		e := h.events[i]
+		t.mu.RUnlock()
+		hotReads.WithLabelValues("hit").Inc()
+		if e.Expired(time.Now()) || e.DeletedAt != nil {
+			return event.Event{}, ErrNotFound
+		}
+		return e, nil
+	}
+	t.mu.RUnlock()
+	hotReads.WithLabelValues("miss").Inc()
+	return t.Store.Get(ctx, id)
+}
+
+// GetMany reads the events the tier holds from it, and the others from the
+// store in one call.
+func (t *Tiered) GetMany(ctx context.Context, ids []int64) ([]event.Event, error) {
+	hot := make(map[int64]event.Event)
+	var misses []int64
+	now := time.Now()
+	t.mu.RLock()
+	for _, id := range ids {
+		typ, ok := t.ids[id]
+		if !ok {
+			misses = append(misses, id)
+			continue
+		}
+		h := t.types[typ]
+		i, _ := slices.BinarySearchFunc(h.events, id, func(e event.Event, id int64) int { return cmp.Compare(e.ID, id) })
+		if e := h.events[i]; !e.Expired(now) && e.DeletedAt == nil {
+			hot[id] = e
+		}
+	}
+	t.mu.RUnlock()
+	hotReads.WithLabelValues("hit").Add(float64(len(ids) - len(misses)))
+	if len(misses) == 0 {
+		return orderByIDs(ids, hot), nil
+	}
+	hotReads.WithLabelValues("miss").Add(float64(len(misses)))
+	cold, err := t.Store.GetMany(ctx, misses)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range cold {
+		hot[e.ID] = e
+	}
+	return orderByIDs(ids, hot), nil
+}
+
+func (t *Tiered) Trash(ctx context.Context, id int64) (event.Event, error) {
+	e, err := t.Store.Trash(ctx, id)
+	if err == nil {
+		t.update(&e)
+	}
+	return e, err
+}
+
+func (t *Tiered) Restore(ctx context.Context, id int64) (event.Event, error) {
+	e, err := t.Store.Restore(ctx, id)
+	if err == nil {
+		t.update(&e)
+	}
+	return e, err
+}
+
+// update copies the DeletedAt of e to the event held. An event restored
+// that the tier should hold but does not, since it was in the trash when
+// its type was warmed, is inserted.
+func (t *Tiered) update(e *event.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	typ, ok := t.ids[e.ID]
+	if !ok {
+		if e.DeletedAt == nil && e.ID > t.base {
+			t.hold(e)
+		}
+		return
+	}
+	h := t.types[typ]
+	i, _ := slices.BinarySearchFunc(h.events, e.ID, func(e event.Event, id int64) int { return cmp.Compare(e.ID, id) })
+	h.events[i].DeletedAt = e.DeletedAt
+}
+
+func (t *Tiered) Purge(ctx context.Context, q Query) (int64, error) {
+	n, err := t.Store.Purge(ctx, q)
+	if err != nil {
+		return n, err
+	}
+	q.FromID, q.purge = 0, true
+	if q.Superseded {
+		// the tier holds the newest events of each type, so the newer
+		// event superseding one it holds is there too
+		t.drop(t.superseded(q))
+		return n, nil
+	}
+	t.drop(q.Match)
+	return n, nil
+}
+
+// Partitions and DropPartitions pass through to the store, see Partitioner.
+func (t *Tiered) Partitions() ([]Partition, error) {
+	p, ok := t.Store.(Partitioner)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return p.Partitions()
+}
+
+func (t *Tiered) DropPartitions(before time.Time) ([]Partition, error) {
+	p, ok := t.Store.(Partitioner)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	dropped, err := p.DropPartitions(before)
+	var last int64
+	for _, d := range dropped {
+		last = max(last, d.LastID)
+	}
+	if last > 0 {
+		t.drop(func(e *event.Event) bool { return e.ID <= last })
+	}
+	return dropped, err
+}
+
+// drop removes the events held that the store deleted.
+func (t *Tiered) drop(deleted func(*event.Event) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name, h := range t.types {
+		h.events = slices.DeleteFunc(h.events, func(e event.Event) bool {
+			if deleted(&e) {
+				t.forget(&e)
+				return true
+			}
+			return false
+		})
+		if len(h.events) == 0 && h.floor <= t.base {
+			delete(t.types, name)
+		}
+	}
+	t.gauge()
+}
+
+// superseded returns whether an event held matches q and is older than
+// another held of its type and partition key.
+func (t *Tiered) superseded(q Query) func(*event.Event) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	type key struct{ typ, key string }
+	newest := map[key]int64{}
+	for _, h := range t.types {
+		for _, e := range h.events {
+			if e.PartitionKey != "" {
+				newest[key{e.Type, e.PartitionKey}] = e.ID
+			}
+		}
+	}
+	return func(e *event.Event) bool {
+		return e.PartitionKey != "" && e.ID < newest[key{e.Type, e.PartitionKey}] && q.Match(e)
+	}
+}
+
+// hotSize estimates the memory held by e, including the tier's own
+// bookkeeping.
+func hotSize(e *event.Event) int64 {
+	n := 256 + len(e.Type) + len(e.Payload) + len(e.SchemaVersion) + len(e.CorrelationID) + len(e.CausationID) + len(e.PartitionKey)
+	for _, tag := range e.Tags {
+		n += 16 + len(tag)
+	}
+	for k, v := range e.Metadata {
+		n += 48 + len(k) + len(v)
+	}
+	return int64(n)
+}
+
+// Snapshot passes through to the store, see Snapshotter.
+func (t *Tiered) Snapshot(path string) (int64, error) {
+	sn, ok := t.Store.(Snapshotter)
+	if !ok {
+		return 0, errors.ErrUnsupported
+	}
+	return sn.Snapshot(path)
+}
+
+// FieldIndexes passes through to the store, see FieldIndexer.
+func (t *Tiered) FieldIndexes() ([]FieldIndex, error) {
+	fi, ok := t.Store.(FieldIndexer)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return fi.FieldIndexes()
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"reflect"
+	"testing"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// TestTieredMatchesStore checks that whatever the hot tier answers, the
+// store would have answered the same, through evictions by count and by
+// budget and through purges.
+func TestTieredMatchesStore(t *testing.T) {
+	cold := NewMemory(2)
+	for i := range 50 {
+		_, _ = cold.Add(context.Background(), event.Event{Type: "old", Payload: json.RawMessage(fmt.Sprint(i))})
+	}
+	s, err := NewTiered(cold, config.HotTierConfig{EventsPerType: 20, MaxBytes: 40 * 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewPCG(1, 2))
+	types := []string{"a.x", "a.y", "b", "old"}
+	queries := []Query{
+		{Limit: 10},
+		{Limit: 50},
+		{},
+		{Types: []string{"a.*"}, Limit: 5},
+		{Types: []string{"b"}, Limit: 30},
+		{NotTypes: []string{"old"}, Limit: 15},
+		{Tags: []string{"even"}, Limit: 5},
+		{Fields: map[string]string{"n": "3"}, Limit: 3},
+		{FromID: 60, Limit: 10},
+		{FromID: 200, Limit: 10},
+		{Types: []string{"b"}, Ascending: true},
+		{BeforeID: 120, Limit: 5},
+	}
+	hits := 0
+	for round := range 20 {
+		for range 10 {
+			e := event.Event{Type: types[rng.IntN(len(types))], Payload: json.RawMessage(fmt.Sprintf(`{"n":%d}`, rng.IntN(5)))}
+			if rng.IntN(2) == 0 {
+				e.Tags = []string{"even"}
+			}
+			if _, err := s.Add(context.Background(), e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if round == 10 {
+			if _, err := s.Purge(context.Background(), Query{Types: []string{"a.y"}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, q := range queries {
+			want, err := cold.List(context.Background(), q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := s.list(q)
+			if !ok {
+				continue
+			}
+			hits++
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("round %d, query %+v:\n got %v\nwant %v", round, q, ids(got), ids(want))
+			}
+		}
+	}
+	if hits == 0 {
+		t.Fatal("the hot tier answered no query")
+	}
+	if s.bytes > s.maxBytes {
+		t.Fatalf("hot tier holds %d bytes, over its budget of %d", s.bytes, s.maxBytes)
+	}
+}
+
+// TestTieredWarm checks that a warmed tier answers queries on the events
+// stored before it started, as the store would, and leaves the types it did
+// not warm to the store.
+func TestTieredWarm(t *testing.T) {
+	cold := NewMemory(2)
+	for i := range 60 {
+		typ := []string{"a", "b", "c"}[i%3]
+		if i >= 50 {
+			typ = "a"
+		}
+		if _, err := cold.Add(context.Background(), event.Event{Type: typ, Payload: json.RawMessage(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// trashed when its type is warmed, restored after
+	if _, err := cold.Trash(context.Background(), 58); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewTiered(cold, config.HotTierConfig{EventsPerType: 20, MaxBytes: 1 << 20,
+		Warm: config.HotWarmConfig{Enabled: true, Events: 15, Types: map[string]int{"b": 5, "c": 0}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(q Query, hit bool) {
+		t.Helper()
+		want, err := cold.List(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := s.list(q)
+		if ok != hit {
+			t.Fatalf("query %+v: hot tier answered %v, want %v", q, ok, hit)
+		}
+		if ok && !reflect.DeepEqual(got, want) {
+			t.Fatalf("query %+v:\n got %v\nwant %v", q, ids(got), ids(want))
+		}
+	}
+	check(Query{Types: []string{"a"}, Limit: 15}, true)
+	check(Query{Types: []string{"a"}, Limit: 30}, false)
+	check(Query{Types: []string{"b"}, Limit: 5}, true)
+	check(Query{Types: []string{"b"}, Limit: 6}, false)
+	check(Query{Types: []string{"c"}, Limit: 1}, false)
+	check(Query{Types: []string{"a", "b"}, Limit: 10}, true)
+	check(Query{Limit: 3}, false)
+	check(Query{Types: []string{"a"}, FromID: 45}, true)
+
+	if _, err := s.Restore(context.Background(), 58); err != nil {
+		t.Fatal(err)
+	}
+	check(Query{Types: []string{"a"}, Limit: 15}, true)
+	for range 5 {
+		if _, err := s.Add(context.Background(), event.Event{Type: "c"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Add(context.Background(), event.Event{Type: "d"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(Query{Types: []string{"c"}, Limit: 5}, true)
+	check(Query{Types: []string{"d"}}, true)
+	check(Query{Types: []string{"a", "d"}, Limit: 12}, true)
+}
+
+func ids(es []event.Event) []int64 {
+	out := make([]int64, len(es))
+	for i, e := range es {
+		out[i] = e.ID
+	}
+	return out
+}
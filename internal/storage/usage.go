@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"cmp"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Usage is what one caller ingested into one tenant's namespace in one hour.
+type Usage struct {
+	// Hour is the UTC start of the hour, or of the day in daily reports.
+	Hour time.Time `json:"start"`
+	// Key is the API key ID or token subject, "anonymous" without auth.
+	Key string `json:"key"`
+	// Tenant is empty for event types outside every tenant.
+	Tenant   string `json:"tenant,omitempty"`
+	Events   int64  `json:"events"`
+	Bytes    int64  `json:"bytes"`
+	Rejected int64  `json:"rejected"`
+}
+
+// UsageQuery filters the usage records; zero values are ignored.
+type UsageQuery struct {
+	Key    string
+	Tenant string
+	Since  time.Time
+	// Until is exclusive.
+	Until time.Time
+}
+
+func (q UsageQuery) Validate() error {
+	if !q.Since.IsZero() && !q.Until.IsZero() && !q.Since.Before(q.Until) {
+		return fmt.Errorf("since must be before until")
+	}
+	return nil
+}
+
+func (q UsageQuery) match(u *Usage) bool {
+	return (q.Key == "" || u.Key == q.Key) &&
+		(q.Tenant == "" || u.Tenant == q.Tenant) &&
+		(q.Since.IsZero() || !u.Hour.Before(q.Since)) &&
+		(q.Until.IsZero() || u.Hour.Before(q.Until))
+}
+
+// compareUsage orders usage records by hour, tenant and key.
+func compareUsage(a, b Usage) int {
+	return cmp.Or(a.Hour.Compare(b.Hour), strings.Compare(a.Tenant, b.Tenant), strings.Compare(a.Key, b.Key))
+}
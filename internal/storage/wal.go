@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// maxSkippedFrames caps the frames WALRecovery lists; SkippedFrames counts
+// them all.
+const maxSkippedFrames = 100
+
+// WALRecovery describes the write-ahead log found next to a SQLite database
+// before it is opened, which SQLite replays on open. A clean shutdown
+// checkpoints and removes the log, leaving nothing to replay.
+type WALRecovery struct {
+	Bytes int64 `json:"bytes"`
+	// Frames are the page images of the Transactions committed in the log.
+	Frames       int `json:"frames"`
+	Transactions int `json:"transactions"`
+	// SkippedFrames are the frames SQLite leaves out: those of a
+	// transaction the crash cut short, before its commit frame, and a
+	// damaged frame, where it stops reading. Skipped lists the first of
+	// them.
+	SkippedFrames int            `json:"skipped_frames"`
+	Skipped       []SkippedFrame `json:"skipped,omitempty"`
+}
+
+// SkippedFrame is a frame of the log left out of the replay.
+type SkippedFrame struct {
+	// Offset is the frame's byte offset in the log file.
+	Offset int64  `json:"offset"`
+	Page   uint32 `json:"page"`
+	// Reason is "uncommitted" for a valid frame of a transaction with no
+	// commit frame, or "checksum" for a frame that does not match the log.
+	Reason string `json:"reason"`
+}
+
+// InspectWAL reads the log of the database file db without changing it,
+// following the checks SQLite makes when it recovers the log
+// (https://www.sqlite.org/fileformat2.html#walformat). Frames written
+// before the log was last reset carry other salts and are not counted.
+func InspectWAL(db string) (WALRecovery, error) {
+	var out WALRecovery
+	f, err := os.Open(db + "-wal")
+	if errors.Is(err, os.ErrNotExist) {
+		return out, nil
+	}
+	if err != nil {
+		return out, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return out, err
+	}
+	if out.Bytes = info.Size(); out.Bytes == 0 {
+		return out, nil
+	}
+	rd := bufio.NewReaderSize(f, 1<<16)
+	hdr := make([]byte, 32)
+	if _, err := io.ReadFull(rd, hdr); err != nil {
+		out.skip(0, 0, "checksum")
+		return out, nil
+	}
+	magic := binary.BigEndian.Uint32(hdr)
+	var order binary.ByteOrder = binary.LittleEndian
+	if magic == 0x377f0683 {
+		order = binary.BigEndian
+	}
+	pageSize := int(binary.BigEndian.Uint32(hdr[8:]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	s1, s2 := walChecksum(order, hdr[:24], 0, 0)
+	if magic&^1 != 0x377f0682 || pageSize < 512 || pageSize&(pageSize-1) != 0 ||
+		s1 != binary.BigEndian.Uint32(hdr[24:]) || s2 != binary.BigEndian.Uint32(hdr[28:]) {
+		// SQLite ignores a log whose header is damaged
+		out.skip(0, 0, "checksum")
+		return out, nil
+	}
+
+	// pending are the offsets and pages of the frames since the last commit
+	type frame struct {
+		offset int64
+		page   uint32
+	}
+	var pending []frame
+	frameHdr, page := make([]byte, 24), make([]byte, pageSize)
+	for offset := int64(32); ; offset += int64(24 + pageSize) {
+		if _, err := io.ReadFull(rd, frameHdr); err != nil {
+			break
+		}
+		pgno := binary.BigEndian.Uint32(frameHdr)
+		if _, err := io.ReadFull(rd, page); err != nil {
+			// a frame the crash cut short
+			pending = append(pending, frame{offset, pgno})
+			for _, p := range pending {
+				out.skip(p.offset, p.page, "uncommitted")
+			}
+			return out, nil
+		}
+		if string(frameHdr[8:16]) != string(hdr[16:24]) {
+			// left over from before the log was reset
+			break
+		}
+		n1, n2 := walChecksum(order, frameHdr[:8], s1, s2)
+		n1, n2 = walChecksum(order, page, n1, n2)
+		if n1 != binary.BigEndian.Uint32(frameHdr[16:]) || n2 != binary.BigEndian.Uint32(frameHdr[20:]) {
+			for _, p := range pending {
+				out.skip(p.offset, p.page, "uncommitted")
+			}
+			out.skip(offset, pgno, "checksum")
+			return out, nil
+		}
+		s1, s2 = n1, n2
+		pending = append(pending, frame{offset, pgno})
+		if binary.BigEndian.Uint32(frameHdr[4:]) != 0 {
+			out.Frames += len(pending)
+			out.Transactions++
+			pending = pending[:0]
+		}
+	}
+	for _, p := range pending {
+		out.skip(p.offset, p.page, "uncommitted")
+	}
+	return out, nil
+}
+
+func (w *WALRecovery) skip(offset int64, page uint32, reason string) {
+	w.SkippedFrames++
+	if len(w.Skipped) < maxSkippedFrames {
+		w.Skipped = append(w.Skipped, SkippedFrame{Offset: offset, Page: page, Reason: reason})
+	}
+}
+
+// walChecksum continues the checksum s1, s2 over b, a multiple of 8 bytes
+// read as pairs of 32-bit words in the log's byte order.
+func walChecksum(order binary.ByteOrder, b []byte, s1, s2 uint32) (uint32, uint32) {
+	for i := 0; i+8 <= len(b); i += 8 {
+		s1 += order.Uint32(b[i:]) + s2
+		s2 += order.Uint32(b[i+4:]) + s1
+	}
+	return s1, s2
+}
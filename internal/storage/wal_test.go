@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// TestInspectWAL counts the transactions of the log a crash leaves behind,
+// and the frames SQLite skips when the last one is damaged or cut short.
+func TestInspectWAL(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSQLite(config.StorageConfig{Driver: "sqlite", DSN: filepath.Join(dir, "events.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for range 3 {
+		if _, err := s.Add(context.Background(), event.Event{Type: "a", Payload: json.RawMessage("{}")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// copy the files while the store is open, as a crash leaves them
+	crash := func(name string, damage func(wal []byte) []byte) string {
+		t.Helper()
+		db := filepath.Join(t.TempDir(), name)
+		for _, suffix := range []string{"", "-wal"} {
+			b, err := os.ReadFile(filepath.Join(dir, "events.db") + suffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if suffix == "-wal" {
+				b = damage(b)
+			}
+			if err := os.WriteFile(db+suffix, b, 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return db
+	}
+	events := func(db string) int {
+		t.Helper()
+		s, err := OpenSQLite(config.StorageConfig{Driver: "sqlite", DSN: db})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		page, err := s.List(context.Background(), Query{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(page)
+	}
+
+	wal, err := os.ReadFile(filepath.Join(dir, "events.db-wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageSize := int64(binary.BigEndian.Uint32(wal[8:]))
+	clean, err := InspectWAL(crash("clean.db", func(b []byte) []byte { return b }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clean.Frames == 0 || clean.Transactions < 3 || clean.SkippedFrames != 0 {
+		t.Fatalf("intact log: %+v", clean)
+	}
+
+	damaged := crash("damaged.db", func(b []byte) []byte { b[len(b)-1] ^= 0xff; return b })
+	w, err := InspectWAL(damaged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := w.Skipped[len(w.Skipped)-1]
+	if w.Transactions != clean.Transactions-1 || w.Frames+w.SkippedFrames != clean.Frames ||
+		last.Reason != "checksum" || last.Offset+24+pageSize != w.Bytes {
+		t.Errorf("damaged last frame: %+v", w)
+	}
+	if n := events(damaged); n != 2 {
+		t.Errorf("%d events recovered past a damaged commit, want 2", n)
+	}
+
+	cut, err := InspectWAL(crash("cut.db", func(b []byte) []byte { return b[:len(b)-100] }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cut.Transactions != clean.Transactions-1 || cut.Skipped[len(cut.Skipped)-1].Reason != "uncommitted" {
+		t.Errorf("log cut short: %+v", cut)
+	}
+
+	if w, err := InspectWAL(filepath.Join(t.TempDir(), "none.db")); err != nil || w.Bytes != 0 {
+		t.Errorf("no log: %+v, %v", w, err)
+	}
+}
@@ -0,0 +1,271 @@
+package synthetic
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// Job states.
+const (
+	StateRunning   = "running"
+	StateDone      = "done"
+	StateCancelled = "cancelled"
+)
+
+const (
+	// MaxRunning caps the jobs generating at once.
+	MaxRunning = 4
+	// keepFinished is how many finished jobs stay listed.
+	keepFinished = 50
+	// retryDelay spaces the attempts at an event the pipeline could not
+	// take.
+	retryDelay = time.Second
+)
+
+// ErrBusy is returned by Start while MaxRunning jobs are running.
+var ErrBusy = errors.New("too many synthetic jobs running")
+
+// ErrNotFound is returned for an unknown job.
+var ErrNotFound = errors.New("synthetic job not found")
+
+var eventsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "synthetic_events_total", Help: "Events generated by synthetic jobs by result (accepted, rejected)"},
+	[]string{"result"},
+)
+
+// Collectors returns the synthetic job metrics for registration by the
+// caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{eventsTotal}
+}
+
+// Handler ingests a generated event. Errors wrapped by Reject are final and
+// the event is counted as rejected; on any other error the same event is
+// tried again a second later.
+type Handler func(event.Event) error
+
+type rejectError struct{ err error }
+
+func (e rejectError) Error() string { return e.err.Error() }
+func (e rejectError) Unwrap() error { return e.err }
+
+// Reject marks err as final: the event is not worth trying again.
+func Reject(err error) error { return rejectError{err} }
+
+// Status is the progress of a job.
+type Status struct {
+	ID         string     `json:"id"`
+	Type       string     `json:"type"`
+	Count      int        `json:"count"`
+	Rate       float64    `json:"rate,omitempty"`
+	State      string     `json:"state"`
+	Accepted   int        `json:"accepted"`
+	Rejected   int        `json:"rejected"`
+	LastError  string     `json:"last_error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type job struct {
+	tpl    *Compiled
+	stop   chan struct{}
+	once   sync.Once
+	status Status
+}
+
+// Runner runs the jobs, each on its own goroutine.
+type Runner struct {
+	handle Handler
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	jobs   []*job
+	closed bool
+}
+
+// NewRunner returns a runner ingesting through handle.
+func NewRunner(handle Handler) *Runner {
+	return &Runner{handle: handle}
+}
+
+// Start runs a job generating the events of c. Every event carries the
+// job's ID in its synthetic.job metadata.
+func (r *Runner) Start(c *Compiled) (Status, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	running := 0
+	for _, j := range r.jobs {
+		if j.status.State == StateRunning {
+			running++
+		}
+	}
+	if r.closed || running >= MaxRunning {
+		return Status{}, ErrBusy
+	}
+	j := &job{tpl: c, stop: make(chan struct{}), status: Status{
+		ID: newID(), Type: c.Type, Count: c.Count, Rate: c.Rate, State: StateRunning, StartedAt: time.Now().UTC(),
+	}}
+	r.jobs = append(r.jobs, j)
+	r.prune()
+	r.wg.Add(1)
+	go r.run(j)
+	return j.status, nil
+}
+
+// List returns the jobs, newest first.
+func (r *Runner) List() []Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]Status, 0, len(r.jobs))
+	for _, j := range slices.Backward(r.jobs) {
+		out = append(out, j.status)
+	}
+	return out
+}
+
+// Get returns the job id.
+func (r *Runner) Get(id string) (Status, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if j := r.find(id); j != nil {
+		return j.status, nil
+	}
+	return Status{}, ErrNotFound
+}
+
+// Cancel stops the job id once the event being ingested is done; the events
+// already accepted stay.
+func (r *Runner) Cancel(id string) (Status, error) {
+	r.mu.Lock()
+	j := r.find(id)
+	r.mu.Unlock()
+	if j == nil {
+		return Status{}, ErrNotFound
+	}
+	j.once.Do(func() { close(j.stop) })
+	return r.Get(id)
+}
+
+// Close cancels every job and waits for them to stop.
+func (r *Runner) Close() {
+	r.mu.Lock()
+	r.closed = true
+	jobs := slices.Clone(r.jobs)
+	r.mu.Unlock()
+	for _, j := range jobs {
+		j.once.Do(func() { close(j.stop) })
+	}
+	r.wg.Wait()
+}
+
+func (r *Runner) find(id string) *job {
+	for _, j := range r.jobs {
+		if j.status.ID == id {
+			return j
+		}
+	}
+	return nil
+}
+
+// prune forgets the oldest finished jobs beyond keepFinished.
+func (r *Runner) prune() {
+	finished := 0
+	for _, j := range r.jobs {
+		if j.status.State != StateRunning {
+			finished++
+		}
+	}
+	for i := 0; finished > keepFinished && i < len(r.jobs); {
+		if r.jobs[i].status.State == StateRunning {
+			i++
+			continue
+		}
+		r.jobs = slices.Delete(r.jobs, i, i+1)
+		finished--
+	}
+}
+
+func (r *Runner) run(j *job) {
+	defer r.wg.Done()
+	start := time.Now()
+	state := StateDone
+	for seq := 1; seq <= j.tpl.Count && state == StateDone; seq++ {
+		var pause time.Duration
+		if j.tpl.Rate > 0 {
+			pause = time.Until(start.Add(time.Duration(float64(seq-1) / j.tpl.Rate * float64(time.Second))))
+		}
+		if !j.wait(pause) {
+			state = StateCancelled
+			break
+		}
+		e := j.tpl.Event(seq)
+		e.Metadata["synthetic.job"] = j.status.ID
+		e.Metadata["synthetic.seq"] = strconv.Itoa(seq)
+		for {
+			err := r.handle(e)
+			var final rejectError
+			r.mu.Lock()
+			switch {
+			case err == nil:
+				j.status.Accepted++
+				eventsTotal.WithLabelValues("accepted").Inc()
+			case errors.As(err, &final):
+				j.status.Rejected++
+				j.status.LastError = err.Error()
+				eventsTotal.WithLabelValues("rejected").Inc()
+			default:
+				j.status.LastError = err.Error()
+			}
+			r.mu.Unlock()
+			if err == nil || errors.As(err, &final) {
+				break
+			}
+			log.Warn().Err(err).Str("job", j.status.ID).Msg("synthetic: event deferred")
+			if !j.wait(retryDelay) {
+				state = StateCancelled
+				break
+			}
+		}
+	}
+	now := time.Now().UTC()
+	r.mu.Lock()
+	j.status.State, j.status.FinishedAt = state, &now
+	r.mu.Unlock()
+	log.Info().Str("job", j.status.ID).Str("state", state).Int("accepted", j.status.Accepted).Int("rejected", j.status.Rejected).Msg("synthetic: job finished")
+}
+
+// wait sleeps for d and reports false if the job was cancelled meanwhile.
+func (j *job) wait(d time.Duration) bool {
+	if d <= 0 {
+		select {
+		case <-j.stop:
+			return false
+		default:
+			return true
+		}
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-j.stop:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return "syn_" + hex.EncodeToString(b)
+}
@@ -0,0 +1,117 @@
+package synthetic
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// TestTemplate fills typed values from whole-string generators and
+// interpolates the others, keeping literals and the field order.
+func TestTemplate(t *testing.T) {
+	c, err := Compile(Template{
+		Type:  "page.view",
+		Count: 3,
+		Payload: json.RawMessage(`{"n":"{{seq}}","user":"u-{{int 7 7}}","amount":"{{float 1 1}}",
+			"plan":"{{pick pro}}","fixed":42,"nested":{"ok":"{{bool}}","id":"{{uuid}}"},"list":["{{hex 6}}"]}`),
+		Tags: []string{"synthetic"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := c.Event(2)
+	var got struct {
+		N      int    `json:"n"`
+		User   string `json:"user"`
+		Amount float64
+		Plan   string
+		Fixed  int
+		Nested struct {
+			OK *bool
+			ID string
+		}
+		List []string
+	}
+	if err := json.Unmarshal(e.Payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.N != 2 || got.User != "u-7" || got.Amount != 1 || got.Plan != "pro" || got.Fixed != 42 ||
+		got.Nested.OK == nil || len(got.Nested.ID) != 36 || len(got.List) != 1 || len(got.List[0]) != 6 {
+		t.Fatalf("payload %s", e.Payload)
+	}
+	if !strings.HasPrefix(string(e.Payload), `{"n":2,"user":`) || e.Type != "page.view" || e.Tags[0] != "synthetic" {
+		t.Fatalf("event %+v", e)
+	}
+
+	for _, bad := range []Template{
+		{Count: 1},
+		{Type: "x"},
+		{Type: "x", Count: 1, Rate: -1},
+		{Type: "x", Count: 1, Payload: json.RawMessage(`{"a":"{{int 5 1}}"}`)},
+		{Type: "x", Count: 1, Payload: json.RawMessage(`{"a":"{{nope}}"}`)},
+		{Type: "x", Count: 1, Payload: json.RawMessage(`{"a":"{{seq"}`)},
+	} {
+		if _, err := Compile(bad); err == nil {
+			t.Errorf("Compile(%+v) accepted", bad)
+		}
+	}
+}
+
+// TestRunner retries deferred events, counts rejected ones and stops a
+// cancelled job.
+func TestRunner(t *testing.T) {
+	var mu sync.Mutex
+	var seqs []string
+	deferred := false
+	r := NewRunner(func(e event.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		switch seq := e.Metadata["synthetic.seq"]; {
+		case seq == "2" && !deferred:
+			deferred = true
+			return errors.New("busy")
+		case seq == "3":
+			return Reject(errors.New("refused"))
+		default:
+			seqs = append(seqs, seq)
+		}
+		return nil
+	})
+	defer r.Close()
+	c, err := Compile(Template{Type: "x", Count: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := r.Start(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); st.State == StateRunning && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		st, _ = r.Get(st.ID)
+	}
+	if st.State != StateDone || st.Accepted != 3 || st.Rejected != 1 || strings.Join(seqs, ",") != "1,2,4" {
+		t.Fatalf("status %+v, seqs %v", st, seqs)
+	}
+
+	slow, _ := Compile(Template{Type: "x", Count: 1000, Rate: 1})
+	if st, err = r.Start(slow); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Cancel(st.ID); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); st.State == StateRunning && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		st, _ = r.Get(st.ID)
+	}
+	if st.State != StateCancelled || st.Accepted > 1 {
+		t.Fatalf("cancelled job %+v", st)
+	}
+	if _, err := r.Get("syn_unknown"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get unknown: %v", err)
+	}
+}
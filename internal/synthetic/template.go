@@ -0,0 +1,304 @@
+// Package synthetic generates events from templates into the ingest
+// pipeline, so staging environments and demos can exercise retention,
+// sinks and dashboards without external producers.
+//
+// A template's payload is JSON whose strings may hold generators in double
+// braces: "u-{{int 1 500}}" interpolates a random number into the string,
+// while a string made of a single generator, like "{{float 5 200}}", is
+// replaced by the generated JSON value itself.
+package synthetic
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mrand "math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// MaxCount caps the events of one job.
+const MaxCount = 1_000_000
+
+// Template describes the events of a job.
+type Template struct {
+	Type string `json:"type"`
+	// Count is the number of events to generate.
+	Count int `json:"count"`
+	// Rate is in events per second; 0 sends them as fast as the pipeline
+	// takes them.
+	Rate float64 `json:"rate,omitempty"`
+	// Payload is the payload shape with its generators, see the package
+	// documentation; an empty payload is {}.
+	Payload  json.RawMessage   `json:"payload,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// node is a compiled payload value.
+type node interface {
+	value(seq int) any
+}
+
+type literal struct{ v any }
+
+func (l literal) value(int) any { return l.v }
+
+type object struct {
+	keys   []string
+	fields []node
+}
+
+// value keeps the keys in the template's order.
+func (o object) value(seq int) any {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range o.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		val, _ := json.Marshal(o.fields[i].value(seq))
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(val)
+	}
+	b.WriteByte('}')
+	return json.RawMessage(b.Bytes())
+}
+
+type array []node
+
+func (a array) value(seq int) any {
+	out := make([]any, len(a))
+	for i, n := range a {
+		out[i] = n.value(seq)
+	}
+	return out
+}
+
+// text is a string interpolating generators between its parts.
+type text struct {
+	parts []string
+	gens  []generator
+}
+
+func (t text) value(seq int) any {
+	var b strings.Builder
+	for i, g := range t.gens {
+		b.WriteString(t.parts[i])
+		fmt.Fprint(&b, g(seq))
+	}
+	b.WriteString(t.parts[len(t.parts)-1])
+	return b.String()
+}
+
+type single struct{ gen generator }
+
+func (s single) value(seq int) any { return s.gen(seq) }
+
+// generator returns the value for the event numbered seq, from 1.
+type generator func(seq int) any
+
+// Compiled is a validated template.
+type Compiled struct {
+	Template
+	payload node
+}
+
+// Compile validates t and parses its payload generators.
+func Compile(t Template) (*Compiled, error) {
+	if t.Type == "" {
+		return nil, errors.New("type is required")
+	}
+	if t.Count < 1 || t.Count > MaxCount {
+		return nil, fmt.Errorf("count must be between 1 and %d", MaxCount)
+	}
+	if t.Rate < 0 {
+		return nil, errors.New("rate must not be negative")
+	}
+	raw := bytes.TrimSpace(t.Payload)
+	if len(raw) == 0 {
+		raw = []byte("{}")
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	n, err := parse(dec)
+	if err != nil {
+		return nil, fmt.Errorf("payload: %w", err)
+	}
+	if dec.More() {
+		return nil, errors.New("payload: trailing data")
+	}
+	return &Compiled{Template: t, payload: n}, nil
+}
+
+// Event returns the event numbered seq, from 1.
+func (c *Compiled) Event(seq int) event.Event {
+	payload, _ := json.Marshal(c.payload.value(seq))
+	e := event.Event{Type: c.Type, Payload: payload}
+	if len(c.Tags) > 0 {
+		e.Tags = append([]string(nil), c.Tags...)
+	}
+	e.Metadata = make(map[string]string, len(c.Metadata)+1)
+	for k, v := range c.Metadata {
+		e.Metadata[k] = v
+	}
+	return e
+}
+
+// parse reads the next JSON value of dec.
+func parse(dec *json.Decoder) (node, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok := tok.(type) {
+	case json.Delim:
+		if tok == '[' {
+			var a array
+			for dec.More() {
+				n, err := parse(dec)
+				if err != nil {
+					return nil, err
+				}
+				a = append(a, n)
+			}
+			_, err := dec.Token()
+			return a, err
+		}
+		var o object
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			n, err := parse(dec)
+			if err != nil {
+				return nil, err
+			}
+			o.keys = append(o.keys, key.(string))
+			o.fields = append(o.fields, n)
+		}
+		_, err := dec.Token()
+		return o, err
+	case string:
+		return parseText(tok)
+	default:
+		return literal{tok}, nil
+	}
+}
+
+// parseText compiles the generators of a template string.
+func parseText(s string) (node, error) {
+	var t text
+	rest := s
+	for {
+		before, after, ok := strings.Cut(rest, "{{")
+		if !ok {
+			break
+		}
+		spec, tail, ok := strings.Cut(after, "}}")
+		if !ok {
+			return nil, fmt.Errorf("%q: unclosed {{", s)
+		}
+		g, err := parseGenerator(strings.Fields(spec))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", s, err)
+		}
+		t.parts = append(t.parts, before)
+		t.gens = append(t.gens, g)
+		rest = tail
+	}
+	t.parts = append(t.parts, rest)
+	switch {
+	case len(t.gens) == 0:
+		return literal{s}, nil
+	case len(t.gens) == 1 && t.parts[0] == "" && t.parts[1] == "":
+		return single{t.gens[0]}, nil
+	}
+	return t, nil
+}
+
+// parseGenerator compiles one {{name args...}}.
+func parseGenerator(f []string) (generator, error) {
+	if len(f) == 0 {
+		return nil, errors.New("empty {{}}")
+	}
+	name, args := f[0], f[1:]
+	want := func(n int) error {
+		if len(args) != n {
+			return fmt.Errorf("%s takes %d arguments", name, n)
+		}
+		return nil
+	}
+	switch name {
+	case "seq":
+		return func(seq int) any { return seq }, want(0)
+	case "bool":
+		return func(int) any { return mrand.IntN(2) == 1 }, want(0)
+	case "uuid":
+		return func(int) any { return uuid() }, want(0)
+	case "now":
+		return func(int) any { return time.Now().UTC().Format(time.RFC3339Nano) }, want(0)
+	case "int":
+		if err := want(2); err != nil {
+			return nil, err
+		}
+		lo, err1 := strconv.ParseInt(args[0], 10, 64)
+		hi, err2 := strconv.ParseInt(args[1], 10, 64)
+		if err1 != nil || err2 != nil || hi < lo {
+			return nil, errors.New("int takes a min and a max integer")
+		}
+		return func(int) any { return lo + mrand.Int64N(hi-lo+1) }, nil
+	case "float":
+		if err := want(2); err != nil {
+			return nil, err
+		}
+		lo, err1 := strconv.ParseFloat(args[0], 64)
+		hi, err2 := strconv.ParseFloat(args[1], 64)
+		if err1 != nil || err2 != nil || hi < lo {
+			return nil, errors.New("float takes a min and a max number")
+		}
+		// two decimals, like the amounts demos are made of
+		return func(int) any {
+			v, _ := strconv.ParseFloat(strconv.FormatFloat(lo+mrand.Float64()*(hi-lo), 'f', 2, 64), 64)
+			return v
+		}, nil
+	case "pick":
+		if len(args) == 0 {
+			return nil, errors.New("pick takes at least one value")
+		}
+		return func(int) any { return args[mrand.IntN(len(args))] }, nil
+	case "hex":
+		if err := want(1); err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 || n > 64 {
+			return nil, errors.New("hex takes a length between 1 and 64")
+		}
+		return func(int) any {
+			b := make([]byte, (n+1)/2)
+			_, _ = rand.Read(b)
+			return hex.EncodeToString(b)[:n]
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown generator %q (seq, int, float, pick, bool, uuid, now, hex)", name)
+}
+
+// uuid returns a random (version 4) UUID.
+func uuid() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
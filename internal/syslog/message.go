@@ -0,0 +1,230 @@
+// Package syslog ingests syslog messages (RFC 5424 and RFC 3164) received
+// over UDP or TCP, for network appliances that cannot call the HTTP API.
+package syslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+var errInvalid = errors.New("invalid syslog message")
+
+var facilities = [...]string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "clock",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var severities = [...]string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// Message is a parsed syslog message. Fields absent from the message, or
+// sent as the RFC 5424 nil value "-", are empty.
+type Message struct {
+	Facility  int
+	Severity  int
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	ProcID    string
+	MsgID     string
+	// StructuredData maps SD-IDs to their parameters (RFC 5424 only).
+	StructuredData map[string]map[string]string
+	Text           string
+}
+
+// Parse parses an RFC 5424 message, or else an RFC 3164 one. Like relays
+// do, a message without priority is taken as user.notice and a BSD message
+// without a readable timestamp as text received at now.
+func Parse(raw []byte, now time.Time) (Message, error) {
+	raw = bytes.TrimRight(raw, "\r\n\x00")
+	if len(raw) == 0 {
+		return Message{}, fmt.Errorf("%w: empty", errInvalid)
+	}
+	m := Message{Facility: 1, Severity: 5}
+	rest := raw
+	if raw[0] == '<' {
+		end := bytes.IndexByte(raw, '>')
+		if end < 2 || end > 4 {
+			return Message{}, fmt.Errorf("%w: bad priority", errInvalid)
+		}
+		pri, err := strconv.Atoi(string(raw[1:end]))
+		if err != nil || pri < 0 || pri > 191 {
+			return Message{}, fmt.Errorf("%w: bad priority", errInvalid)
+		}
+		m.Facility, m.Severity = pri/8, pri%8
+		rest = raw[end+1:]
+	}
+	if bytes.HasPrefix(rest, []byte("1 ")) {
+		return m, m.parse5424(rest[2:])
+	}
+	m.parse3164(rest, now)
+	return m, nil
+}
+
+func (m *Message) parse5424(b []byte) error {
+	fields := make([]string, 5)
+	for i := range fields {
+		var f []byte
+		f, b, _ = bytes.Cut(b, []byte(" "))
+		if len(f) == 0 {
+			return fmt.Errorf("%w: missing header field", errInvalid)
+		}
+		if string(f) != "-" {
+			fields[i] = string(f)
+		}
+	}
+	if fields[0] != "" {
+		ts, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return fmt.Errorf("%w: timestamp: %v", errInvalid, err)
+		}
+		m.Timestamp = ts
+	}
+	m.Hostname, m.AppName, m.ProcID, m.MsgID = fields[1], fields[2], fields[3], fields[4]
+	var err error
+	if m.StructuredData, b, err = parseSD(b); err != nil {
+		return err
+	}
+	b = bytes.TrimPrefix(b, []byte(" "))
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	m.Text = string(b)
+	return nil
+}
+
+// parseSD parses the structured data at the start of b and returns the rest.
+func parseSD(b []byte) (map[string]map[string]string, []byte, error) {
+	if len(b) == 0 || b[0] == '-' {
+		if len(b) > 0 {
+			b = b[1:]
+		}
+		return nil, b, nil
+	}
+	sd := map[string]map[string]string{}
+	for len(b) > 0 && b[0] == '[' {
+		b = b[1:]
+		end := bytes.IndexAny(b, " ]")
+		if end <= 0 {
+			return nil, nil, fmt.Errorf("%w: structured data", errInvalid)
+		}
+		params := map[string]string{}
+		sd[string(b[:end])] = params
+		b = b[end:]
+		for len(b) > 0 && b[0] == ' ' {
+			b = b[1:]
+			eq := bytes.Index(b, []byte(`="`))
+			if eq <= 0 {
+				return nil, nil, fmt.Errorf("%w: structured data", errInvalid)
+			}
+			name := string(b[:eq])
+			b = b[eq+2:]
+			var val strings.Builder
+			for {
+				if len(b) == 0 {
+					return nil, nil, fmt.Errorf("%w: unterminated structured data", errInvalid)
+				}
+				c := b[0]
+				b = b[1:]
+				if c == '"' {
+					break
+				}
+				if c == '\\' && len(b) > 0 && (b[0] == '"' || b[0] == '\\' || b[0] == ']') {
+					c, b = b[0], b[1:]
+				}
+				val.WriteByte(c)
+			}
+			params[name] = val.String()
+		}
+		if len(b) == 0 || b[0] != ']' {
+			return nil, nil, fmt.Errorf("%w: structured data", errInvalid)
+		}
+		b = b[1:]
+	}
+	return sd, b, nil
+}
+
+// parse3164 reads "Mmm dd hh:mm:ss host tag[pid]: text", taking whatever
+// does not fit that shape as text.
+func (m *Message) parse3164(b []byte, now time.Time) {
+	const stamp = "Jan _2 15:04:05"
+	if len(b) > len(stamp) && b[len(stamp)] == ' ' {
+		if ts, err := time.ParseInLocation(stamp, string(b[:len(stamp)]), now.Location()); err == nil {
+			// the year is not sent; a date ahead of now is from last year
+			ts = ts.AddDate(now.Year(), 0, 0)
+			if ts.After(now.Add(24 * time.Hour)) {
+				ts = ts.AddDate(-1, 0, 0)
+			}
+			m.Timestamp = ts
+			b = b[len(stamp)+1:]
+			if host, rest, ok := bytes.Cut(b, []byte(" ")); ok && len(host) > 0 && !bytes.ContainsAny(host, ":[") {
+				m.Hostname, b = string(host), rest
+			}
+		}
+	}
+	if m.Timestamp.IsZero() {
+		m.Timestamp = now
+	}
+	// the tag is alphanumeric, up to 32 characters, optionally followed by
+	// [pid], and ends with a colon
+	if end := bytes.IndexByte(b, ':'); end > 0 && end <= 48 {
+		tag := string(b[:end])
+		if name, pid, ok := strings.Cut(tag, "["); ok && strings.HasSuffix(pid, "]") {
+			tag, m.ProcID = name, strings.TrimSuffix(pid, "]")
+		}
+		if tag != "" && !strings.ContainsAny(tag, " \t") {
+			m.AppName = tag
+			b = bytes.TrimPrefix(b[end+1:], []byte(" "))
+		} else {
+			m.ProcID = ""
+		}
+	}
+	m.Text = string(b)
+}
+
+// FacilityName returns the keyword of the facility, e.g. "auth".
+func (m *Message) FacilityName() string { return facilities[m.Facility] }
+
+// SeverityName returns the keyword of the severity, e.g. "err".
+func (m *Message) SeverityName() string { return severities[m.Severity] }
+
+// Event maps m to an event of type <namespace>/<facility>/<app-name>, or
+// <namespace>/<facility> without app name. Severity and facility are also
+// tags, so ?tag=severity:err selects errors across types.
+func (m *Message) Event(namespace string) (event.Event, error) {
+	typ := namespace + "/" + m.FacilityName()
+	if app := event.TypeSegment(m.AppName); app != "" {
+		typ += "/" + app
+	}
+	payload := map[string]any{
+		"facility": m.FacilityName(),
+		"severity": m.SeverityName(),
+		"message":  strings.ToValidUTF8(m.Text, string(utf8.RuneError)),
+	}
+	for k, v := range map[string]string{"hostname": m.Hostname, "app_name": m.AppName, "proc_id": m.ProcID, "msg_id": m.MsgID} {
+		if v != "" {
+			payload[k] = v
+		}
+	}
+	if !m.Timestamp.IsZero() {
+		payload["timestamp"] = m.Timestamp
+	}
+	if len(m.StructuredData) > 0 {
+		payload["structured_data"] = m.StructuredData
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return event.Event{}, err
+	}
+	return event.Event{
+		Type:    typ,
+		Payload: raw,
+		Tags:    []string{"facility:" + m.FacilityName(), "severity:" + m.SeverityName()},
+	}, nil
+}
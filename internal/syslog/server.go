@@ -0,0 +1,238 @@
+package syslog
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+var (
+	messagesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "syslog_messages_total", Help: "Syslog messages received by transport and result (accepted, invalid, rejected)"},
+		[]string{"transport", "result"},
+	)
+	connections = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "syslog_tcp_connections", Help: "Open syslog TCP connections"},
+	)
+)
+
+// Collectors returns the syslog metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{messagesTotal, connections}
+}
+
+// Handler ingests the event of a message; an error rejects it.
+type Handler func(event.Event) error
+
+// Server receives syslog messages on the listeners enabled in its config.
+type Server struct {
+	namespace string
+	maxBytes  int
+	handle    Handler
+
+	udp net.PacketConn
+	tcp net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Listen starts the UDP and TCP listeners of cfg, whichever are set.
+func Listen(cfg config.SyslogConfig, handle Handler) (*Server, error) {
+	s := &Server{
+		namespace: cfg.Namespace,
+		maxBytes:  cfg.MaxMessageBytes,
+		handle:    handle,
+		conns:     map[net.Conn]bool{},
+	}
+	if s.namespace == "" {
+		s.namespace = "syslog"
+	}
+	if err := event.ValidateNamespace(s.namespace); err != nil {
+		return nil, err
+	}
+	if s.maxBytes <= 0 {
+		s.maxBytes = 64 << 10
+	}
+	if cfg.UDPAddr != "" {
+		pc, err := net.ListenPacket("udp", cfg.UDPAddr)
+		if err != nil {
+			return nil, err
+		}
+		s.udp = pc
+		s.wg.Add(1)
+		go s.serveUDP()
+	}
+	if cfg.TCPAddr != "" {
+		lis, err := net.Listen("tcp", cfg.TCPAddr)
+		if err != nil {
+			if s.udp != nil {
+				_ = s.udp.Close()
+			}
+			return nil, err
+		}
+		s.tcp = lis
+		s.wg.Add(1)
+		go s.serveTCP()
+	}
+	return s, nil
+}
+
+// Close stops the listeners and closes open connections, waiting for the
+// messages being handled.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+	if s.udp != nil {
+		_ = s.udp.Close()
+	}
+	if s.tcp != nil {
+		_ = s.tcp.Close()
+	}
+	s.wg.Wait()
+}
+
+// serveUDP handles each datagram as one message.
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, s.maxBytes)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error().Err(err).Msg("syslog udp read")
+			}
+			return
+		}
+		s.receive("udp", addr, buf[:n])
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		c, err := s.tcp.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error().Err(err).Msg("syslog tcp accept")
+			}
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = c.Close()
+			return
+		}
+		s.conns[c] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+		connections.Inc()
+		go s.serveConn(c)
+	}
+}
+
+// serveConn reads the messages of a TCP stream, framed by octet counting
+// ("<len> <msg>", RFC 6587) or, when a frame does not start with a digit,
+// by newlines.
+func (s *Server) serveConn(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		_ = c.Close()
+		connections.Dec()
+	}()
+	r := bufio.NewReaderSize(c, 4096)
+	for {
+		msg, err := s.frame(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				messagesTotal.WithLabelValues("tcp", "invalid").Inc()
+				log.Warn().Err(err).Str("peer", c.RemoteAddr().String()).Msg("syslog tcp connection dropped")
+			}
+			return
+		}
+		s.receive("tcp", c.RemoteAddr(), msg)
+	}
+}
+
+func (s *Server) frame(r *bufio.Reader) ([]byte, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] >= '1' && first[0] <= '9' {
+		digits, err := r.ReadSlice(' ')
+		if err != nil {
+			return nil, fmt.Errorf("octet count: %w", err)
+		}
+		n, err := strconv.Atoi(string(digits[:len(digits)-1]))
+		if err != nil || n > s.maxBytes {
+			return nil, fmt.Errorf("octet count %q: invalid or over %d bytes", digits[:len(digits)-1], s.maxBytes)
+		}
+		msg := make([]byte, n)
+		_, err = io.ReadFull(r, msg)
+		return msg, err
+	}
+	var msg []byte
+	for {
+		line, err := r.ReadSlice('\n')
+		msg = append(msg, line...)
+		if len(msg) > s.maxBytes {
+			return nil, fmt.Errorf("message over %d bytes", s.maxBytes)
+		}
+		switch {
+		case err == nil:
+			return msg, nil
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case errors.Is(err, io.EOF) && len(bytes.TrimSpace(msg)) > 0:
+			return msg, nil
+		default:
+			return nil, err
+		}
+	}
+}
+
+func (s *Server) receive(transport string, peer net.Addr, raw []byte) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return
+	}
+	m, err := Parse(raw, time.Now())
+	var e event.Event
+	if err == nil {
+		e, err = m.Event(s.namespace)
+	}
+	if err != nil {
+		messagesTotal.WithLabelValues(transport, "invalid").Inc()
+		log.Debug().Err(err).Str("peer", peer.String()).Msg("syslog message dropped")
+		return
+	}
+	e.Metadata = map[string]string{"syslog.transport": transport, "syslog.peer": peer.String()}
+	if err := s.handle(e); err != nil {
+		messagesTotal.WithLabelValues(transport, "rejected").Inc()
+		log.Debug().Err(err).Str("peer", peer.String()).Str("type", e.Type).Msg("syslog message rejected")
+		return
+	}
+	messagesTotal.WithLabelValues(transport, "accepted").Inc()
+}
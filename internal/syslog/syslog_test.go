@@ -0,0 +1,151 @@
+package syslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// TestParse reads RFC 5424 and RFC 3164 messages, and whatever a relay
+// would pass on of a message in neither shape.
+func TestParse(t *testing.T) {
+	now := time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC)
+	m, err := Parse([]byte(`<165>1 2025-01-02T11:59:58.5Z fw01 sshd 4242 ID47 [auth@32473 user="ann" ip="10.0.0.1"][x@1 q="a\"b"] `+"\xef\xbb\xbf"+"Failed password\n"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.FacilityName() != "local4" || m.SeverityName() != "notice" || m.Hostname != "fw01" || m.AppName != "sshd" || m.ProcID != "4242" || m.MsgID != "ID47" || m.Text != "Failed password" {
+		t.Errorf("5424: %+v", m)
+	}
+	if !m.Timestamp.Equal(time.Date(2025, 1, 2, 11, 59, 58, 5e8, time.UTC)) || m.StructuredData["auth@32473"]["user"] != "ann" || m.StructuredData["x@1"]["q"] != `a"b` {
+		t.Errorf("5424 timestamp %v, structured data %v", m.Timestamp, m.StructuredData)
+	}
+
+	m, err = Parse([]byte("<13>1 - - - - - - hello"), now)
+	if err != nil || m.Hostname != "" || !m.Timestamp.IsZero() || m.StructuredData != nil || m.Text != "hello" {
+		t.Errorf("5424 nil values: %+v, %v", m, err)
+	}
+
+	m, err = Parse([]byte("<34>Dec 31 23:59:00 router1 kernel[7]: link down"), now)
+	if err != nil || m.FacilityName() != "auth" || m.SeverityName() != "crit" || m.Hostname != "router1" || m.AppName != "kernel" || m.ProcID != "7" || m.Text != "link down" {
+		t.Errorf("3164: %+v, %v", m, err)
+	}
+	if m.Timestamp.Year() != 2024 {
+		t.Errorf("3164 date ahead of now taken as this year: %v", m.Timestamp)
+	}
+
+	m, err = Parse([]byte("just some text"), now)
+	if err != nil || m.FacilityName() != "user" || m.SeverityName() != "notice" || !m.Timestamp.Equal(now) || m.Text != "just some text" {
+		t.Errorf("no priority: %+v, %v", m, err)
+	}
+
+	for name, raw := range map[string]string{
+		"empty":           "\r\n",
+		"priority":        "<192>x",
+		"unclosed":        "<13 x",
+		"timestamp":       "<13>1 yesterday host app - - - x",
+		"header":          "<13>1 2025-01-02T00:00:00Z host",
+		"structured data": `<13>1 - h a - - [id k="v x`,
+	} {
+		if _, err := Parse([]byte(raw), now); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+}
+
+// TestEvent maps a message to a type under the namespace, with severity and
+// facility as tags.
+func TestEvent(t *testing.T) {
+	m := Message{Facility: 4, Severity: 3, AppName: "ssh d", Hostname: "h1", Text: "bad \xff byte"}
+	e, err := m.Event("net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != "net/auth/ssh_d" || !slices.Equal(e.Tags, []string{"facility:auth", "severity:err"}) {
+		t.Errorf("type %s, tags %v", e.Type, e.Tags)
+	}
+	var p map[string]any
+	if err := json.Unmarshal(e.Payload, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p["hostname"] != "h1" || p["message"] != "bad � byte" || p["proc_id"] != nil {
+		t.Errorf("payload %s", e.Payload)
+	}
+	if e, _ := (&Message{Facility: 16, Severity: 6}).Event("syslog"); e.Type != "syslog/local0" {
+		t.Errorf("without app name: %s", e.Type)
+	}
+}
+
+// TestServer ingests datagrams and TCP streams framed by octet counting or
+// newlines, and drops a TCP connection whose frame is too long.
+func TestServer(t *testing.T) {
+	var mu sync.Mutex
+	var got []event.Event
+	s, err := Listen(config.SyslogConfig{UDPAddr: "127.0.0.1:0", TCPAddr: "127.0.0.1:0", MaxMessageBytes: 256}, func(e event.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	received := func(n int) []event.Event {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			mu.Lock()
+			out := slices.Clone(got)
+			mu.Unlock()
+			if len(out) >= n || time.Now().After(deadline) {
+				return out
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	udp, err := net.Dial("udp", s.udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	if _, err := udp.Write([]byte("<14>udpapp: over udp")); err != nil {
+		t.Fatal(err)
+	}
+	if es := received(1); len(es) != 1 || es[0].Type != "syslog/user/udpapp" || es[0].Metadata["syslog.transport"] != "udp" {
+		t.Fatalf("udp: %+v", es)
+	}
+
+	tcp, err := net.Dial("tcp", s.tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	framed := "<14>1 - h one - - - first"
+	fmt.Fprintf(tcp, "%d %s<14>two: second\n<14>three: third\n", len(framed), framed)
+	es := received(4)
+	var types []string
+	for _, e := range es[1:] {
+		types = append(types, e.Type)
+	}
+	if !slices.Equal(types, []string{"syslog/user/one", "syslog/user/two", "syslog/user/three"}) {
+		t.Errorf("tcp: %v", types)
+	}
+
+	fmt.Fprintf(tcp, "%d %s", 1000, strings.Repeat("x", 1000))
+	_ = tcp.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := tcp.Read(make([]byte, 1)); err == nil {
+		t.Error("connection kept open after an oversized frame")
+	}
+	tcp.Close()
+	if n := len(received(5)); n != 4 {
+		t.Errorf("%d events after the oversized frame", n)
+	}
+}
@@ -0,0 +1,767 @@
+// Package tenant onboards and offboards tenants at runtime. A tenant owns the
+// namespace of its name: its API keys, sinks and alert rules are limited to
+// it, its default pipeline applies in it, and its quota and retention count
+// the events stored in it. Within the limits set by an admin, a tenant's
+// manage keys change its keys, sinks and alert rules themselves.
+package tenant
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/alert"
+	"github.com/rafaelosorio/go-ingest-service/internal/auth"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/pipeline"
+	"github.com/rafaelosorio/go-ingest-service/internal/sink"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+var (
+	tenantsTotal = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "tenants", Help: "Tenants onboarded"},
+	)
+	quotaRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "tenant_quota_rejected_total", Help: "Events rejected because the tenant's daily quota was used up"},
+		[]string{"tenant"},
+	)
+	purgedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "tenant_events_purged_total", Help: "Tenant events deleted by reason (retention, offboard)"},
+		[]string{"tenant", "reason"},
+	)
+)
+
+// Collectors returns the tenant metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{tenantsTotal, quotaRejected, purgedTotal}
+}
+
+var (
+	ErrNotFound = errors.New("tenant not found")
+	ErrExists   = errors.New("tenant already exists")
+	ErrInvalid  = errors.New("invalid tenant")
+	ErrQuota    = errors.New("daily event quota exceeded")
+	ErrLimit    = errors.New("tenant limit reached")
+	// ErrNoTenant is returned for callers whose keys belong to no tenant.
+	ErrNoTenant = errors.New("caller does not belong to a tenant")
+)
+
+// Default self-service limits.
+const (
+	defaultMaxKeys       = 10
+	defaultMaxSinks      = 5
+	defaultMaxAlertRules = 10
+)
+
+// retentionSweep is how often events past a tenant's retention are purged.
+const retentionSweep = time.Minute
+
+// Manager applies the tenants kept in the store to the authenticator, the
+// sink dispatcher, the pipeline engine and the alert engine.
+type Manager struct {
+	store     storage.Store
+	authn     *auth.Authenticator
+	sinks     *sink.Dispatcher
+	pipelines *pipeline.Engine
+	alerts    *alert.Engine
+	// reserved matches the reserved types, which retention keeps.
+	reserved []string
+	// egress limits where the tenants' webhooks and notifiers connect.
+	egress config.EgressConfig
+
+	mu      sync.Mutex
+	tenants map[string]*tenant
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type tenant struct {
+	storage.Tenant
+	// offboarding is set once its keys are revoked; the record stays until
+	// the purge is done.
+	offboarding bool
+	// day is the UTC midnight that used counts from.
+	day  time.Time
+	used int64
+}
+
+// Status describes a tenant for listing.
+type Status struct {
+	Name         string    `json:"name"`
+	CreatedAt    time.Time `json:"created_at"`
+	Keys         []string  `json:"keys"`
+	Sinks        []string  `json:"sinks"`
+	Alerts       []string  `json:"alert_rules"`
+	Pipeline     int       `json:"pipeline_steps"`
+	EventsPerDay int64     `json:"events_per_day,omitempty"`
+	EventsToday  int64     `json:"events_today"`
+	Retention    string    `json:"retention,omitempty"`
+	Offboarding  bool      `json:"offboarding,omitempty"`
+	Limits       Limits    `json:"limits"`
+}
+
+// Limits are a tenant's self-service limits with defaults applied.
+type Limits struct {
+	Keys       int `json:"keys"`
+	Sinks      int `json:"sinks"`
+	AlertRules int `json:"alert_rules"`
+}
+
+// IssuedKey is an API key secret, only ever returned when it is issued.
+type IssuedKey struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+}
+
+// New applies the tenants of store and starts purging events past their
+// retention. The tenants' webhooks and notifiers connect as egress allows.
+func New(store storage.Store, authn *auth.Authenticator, sinks *sink.Dispatcher, pipelines *pipeline.Engine, alerts *alert.Engine, reserved []string, egress config.EgressConfig) (*Manager, error) {
+	saved, err := store.Tenants(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	m := &Manager{
+		store: store, authn: authn, sinks: sinks, pipelines: pipelines, alerts: alerts,
+		reserved: event.ReservedPatterns(reserved),
+		egress:   egress,
+		tenants:  map[string]*tenant{},
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	for _, st := range saved {
+		t := &tenant{Tenant: st}
+		if err := m.apply(t); err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", st.Config.Name, err)
+		}
+		m.tenants[st.Config.Name] = t
+	}
+	tenantsTotal.Set(float64(len(m.tenants)))
+	go m.run()
+	return m, nil
+}
+
+// Close stops the retention sweep.
+func (m *Manager) Close() {
+	close(m.done)
+	<-m.stopped
+}
+
+// Create onboards a tenant: it issues its keys and starts its sinks, alert
+// rules and pipeline. The key secrets are returned once and only their hashes kept.
+func (m *Manager) Create(ctx context.Context, cfg config.TenantConfig) (Status, []IssuedKey, error) {
+	issued, err := m.prepare(&cfg)
+	if err != nil {
+		return Status{}, nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name := range m.tenants {
+		switch {
+		case name == cfg.Name:
+			return Status{}, nil, ErrExists
+		case event.InNamespace(cfg.Name, name), event.InNamespace(name, cfg.Name):
+			return Status{}, nil, fmt.Errorf("%w: namespace overlaps tenant %s", ErrInvalid, name)
+		}
+	}
+	t := &tenant{Tenant: storage.Tenant{Config: cfg, CreatedAt: time.Now().UTC()}}
+	if err := m.apply(t); err != nil {
+		return Status{}, nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if err := m.store.SaveTenant(ctx, t.Tenant); err != nil {
+		m.unapply(t)
+		return Status{}, nil, err
+	}
+	m.tenants[cfg.Name] = t
+	tenantsTotal.Set(float64(len(m.tenants)))
+	return t.status(), issued, nil
+}
+
+// prepare validates cfg and fills in what the tenant owns: its keys get
+// generated secrets, and like its sinks and alert rules are limited to its
+// namespace and have their names prefixed with the tenant's.
+func (m *Manager) prepare(cfg *config.TenantConfig) ([]IssuedKey, error) {
+	if err := event.ValidateNamespace(cfg.Name); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if cfg.Quota.EventsPerDay < 0 || cfg.Retention < 0 {
+		return nil, fmt.Errorf("%w: quota and retention must not be negative", ErrInvalid)
+	}
+	if l := cfg.Limits; l.MaxKeys < 0 || l.MaxSinks < 0 || l.MaxAlertRules < 0 {
+		return nil, fmt.Errorf("%w: limits must not be negative", ErrInvalid)
+	}
+	if len(cfg.Keys) == 0 {
+		return nil, fmt.Errorf("%w: at least one key is required", ErrInvalid)
+	}
+	issued := make([]IssuedKey, len(cfg.Keys))
+	for i := range cfg.Keys {
+		var err error
+		if issued[i], err = issue(cfg.Name, &cfg.Keys[i]); err != nil {
+			return nil, fmt.Errorf("keys[%d]: %w", i, err)
+		}
+	}
+	var err error
+	if cfg.Sinks, err = scopeSinks(cfg.Name, cfg.Sinks); err != nil {
+		return nil, err
+	}
+	if cfg.Alerts, err = scopeAlerts(cfg.Name, cfg.Alerts); err != nil {
+		return nil, err
+	}
+	if _, err := pipeline.Compile(cfg.Name+"/*", cfg.Pipeline); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return issued, nil
+}
+
+// issue generates the secret of a key of tenant name and keeps only its
+// hash in k. Tenant keys cannot be admins.
+func issue(name string, k *config.APIKeyConfig) (IssuedKey, error) {
+	if k.ID == "" || len(k.Roles) == 0 {
+		return IssuedKey{}, fmt.Errorf("%w: id and roles are required", ErrInvalid)
+	}
+	for _, r := range k.Roles {
+		switch auth.Role(r) {
+		case auth.RoleIngest, auth.RoleRead, auth.RoleManage:
+		default:
+			return IssuedKey{}, fmt.Errorf("%w: role %q not allowed for tenant keys", ErrInvalid, r)
+		}
+	}
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return IssuedKey{}, err
+	}
+	k.ID = own(name, k.ID)
+	key := IssuedKey{ID: k.ID, Key: "ik_" + hex.EncodeToString(secret)}
+	k.Key, k.KeySHA256 = "", auth.HashKey(key.Key)
+	k.Namespaces = []string{name}
+	return key, nil
+}
+
+// scopeSinks limits sinks to the namespace of tenant name.
+func scopeSinks(name string, sinks []config.SinkConfig) ([]config.SinkConfig, error) {
+	out := slices.Clone(sinks)
+	for i := range out {
+		s := &out[i]
+		if s.Name == "" {
+			return nil, fmt.Errorf("%w: sinks[%d]: name is required", ErrInvalid, i)
+		}
+		if s.Kind == "plugin" {
+			return nil, fmt.Errorf("%w: sinks[%d]: plugin sinks belong to the service config", ErrInvalid, i)
+		}
+		s.Name = own(name, s.Name)
+		s.Namespaces = []string{name}
+		if err := s.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+	}
+	return out, nil
+}
+
+// scopeAlerts limits the rules of a to the namespace of tenant name. Saved
+// queries belong to the service config, so tenant rules filter inline.
+func scopeAlerts(name string, a config.AlertsConfig) (config.AlertsConfig, error) {
+	scope := &auth.Principal{Namespaces: []string{name}}
+	out := config.AlertsConfig{
+		Notifiers: slices.Clone(a.Notifiers),
+		Rules:     slices.Clone(a.Rules),
+	}
+	for i := range out.Notifiers {
+		out.Notifiers[i].Name = own(name, out.Notifiers[i].Name)
+	}
+	for i := range out.Rules {
+		r := &out.Rules[i]
+		if r.Query != "" {
+			return config.AlertsConfig{}, fmt.Errorf("%w: rule %s: saved queries are not available to tenants", ErrInvalid, r.Name)
+		}
+		types, err := scope.ScopeTypes(r.Filter.Types)
+		if err != nil {
+			return config.AlertsConfig{}, fmt.Errorf("%w: rule %s: %v", ErrInvalid, r.Name, err)
+		}
+		r.Filter.Types = types
+		r.Name = own(name, r.Name)
+		notify := make([]string, len(r.Notify))
+		for j, n := range r.Notify {
+			notify[j] = own(name, n)
+		}
+		r.Notify = notify
+	}
+	if err := out.Validate(nil); err != nil {
+		return config.AlertsConfig{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return out, nil
+}
+
+// own prefixes id with the tenant name unless it already is, so names given
+// either way refer to the same thing.
+func own(name, id string) string {
+	if id == "" || strings.HasPrefix(id, name+"/") {
+		return id
+	}
+	return name + "/" + id
+}
+
+// apply issues the keys and starts the sinks and pipeline of t, undoing what
+// it did when one of them fails, and loads the events it stored today.
+func (m *Manager) apply(t *tenant) error {
+	cfg := t.Config
+	p, err := pipeline.Compile(cfg.Name+"/*", cfg.Pipeline)
+	if err != nil {
+		return err
+	}
+	if err := m.authn.AddKeys(cfg.Keys); err != nil {
+		return err
+	}
+	if err := m.addSinks(cfg.Sinks); err != nil {
+		m.authn.RemoveKeys(keyIDs(cfg)...)
+		return err
+	}
+	if err := m.addRules(cfg.Alerts); err != nil {
+		m.sinks.RemoveSinks(sinkNames(cfg.Sinks)...)
+		m.authn.RemoveKeys(keyIDs(cfg)...)
+		return err
+	}
+	if len(cfg.Pipeline) > 0 {
+		m.pipelines.SetNamespace(cfg.Name, p)
+	}
+	t.day = today()
+	if t.used, err = m.countSince(context.Background(), cfg.Name, t.day); err != nil {
+		log.Error().Err(err).Str("tenant", cfg.Name).Msg("count today's events")
+	}
+	return nil
+}
+
+// addSinks starts sinks, connecting only where m.egress allows: tenants
+// choose the URLs and headers, which must not reach the service's network.
+func (m *Manager) addSinks(sinks []config.SinkConfig) error {
+	guarded := slices.Clone(sinks)
+	for i := range guarded {
+		guarded[i].Egress = &m.egress
+	}
+	return m.sinks.AddSinks(guarded)
+}
+
+// addRules starts the rules and notifiers of a, connecting only where
+// m.egress allows.
+func (m *Manager) addRules(a config.AlertsConfig) error {
+	a.Notifiers = slices.Clone(a.Notifiers)
+	for i := range a.Notifiers {
+		a.Notifiers[i].Egress = &m.egress
+	}
+	return m.alerts.AddRules(a)
+}
+
+// unapply revokes the keys and stops the sinks, alert rules and pipeline of
+// t.
+func (m *Manager) unapply(t *tenant) {
+	m.authn.RemoveKeys(keyIDs(t.Config)...)
+	m.sinks.RemoveSinks(sinkNames(t.Config.Sinks)...)
+	m.alerts.RemoveRules(t.Config.Alerts)
+	m.pipelines.SetNamespace(t.Config.Name, nil)
+}
+
+func (m *Manager) countSince(ctx context.Context, name string, since time.Time) (int64, error) {
+	q := storage.Query{Types: []string{name + "/*"}, Since: since, Until: since.Add(24 * time.Hour)}
+	st, err := m.store.Stats(ctx, q, 24*time.Hour)
+	if err != nil {
+		return 0, err
+	}
+	return st.Total, nil
+}
+
+// List returns every tenant by name.
+func (m *Manager) List() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Status, 0, len(m.tenants))
+	for _, t := range m.tenants {
+		out = append(out, t.status())
+	}
+	slices.SortFunc(out, func(a, b Status) int { return strings.Compare(a.Name, b.Name) })
+	return out
+}
+
+// Owner returns the tenant the keys of p belong to: tenant keys are limited
+// to exactly the tenant's namespace.
+func (m *Manager) Owner(p *auth.Principal) (string, error) {
+	if p == nil || len(p.Namespaces) != 1 {
+		return "", ErrNoTenant
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tenants[p.Namespaces[0]]; !ok || t.offboarding {
+		return "", ErrNoTenant
+	}
+	return p.Namespaces[0], nil
+}
+
+// Get returns the status of tenant name.
+func (m *Manager) Get(name string) (Status, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, err := m.live(name)
+	if err != nil {
+		return Status{}, err
+	}
+	return t.status(), nil
+}
+
+// IssueKey adds a key to tenant name and returns its secret.
+func (m *Manager) IssueKey(ctx context.Context, name string, k config.APIKeyConfig) (IssuedKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, err := m.live(name)
+	if err != nil {
+		return IssuedKey{}, err
+	}
+	if limit := t.limits().Keys; len(t.Config.Keys) >= limit {
+		return IssuedKey{}, fmt.Errorf("%w: at most %d keys", ErrLimit, limit)
+	}
+	issued, err := issue(name, &k)
+	if err != nil {
+		return IssuedKey{}, err
+	}
+	if err := m.authn.AddKeys([]config.APIKeyConfig{k}); err != nil {
+		return IssuedKey{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	cfg := t.Config
+	cfg.Keys = append(slices.Clone(cfg.Keys), k)
+	if err := m.save(ctx, t, cfg); err != nil {
+		m.authn.RemoveKeys(k.ID)
+		return IssuedKey{}, err
+	}
+	return issued, nil
+}
+
+// RevokeKey removes a key of tenant name. The last key with the manage role
+// cannot be removed, so the tenant is never locked out of self-service.
+func (m *Manager) RevokeKey(ctx context.Context, name, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, err := m.live(name)
+	if err != nil {
+		return err
+	}
+	id = own(name, id)
+	i := slices.IndexFunc(t.Config.Keys, func(k config.APIKeyConfig) bool { return k.ID == id })
+	if i < 0 {
+		return fmt.Errorf("key %s: %w", id, ErrNotFound)
+	}
+	cfg := t.Config
+	cfg.Keys = slices.Delete(slices.Clone(cfg.Keys), i, i+1)
+	if !slices.ContainsFunc(cfg.Keys, canManage) {
+		return fmt.Errorf("%w: key %s is the last with the manage role", ErrInvalid, id)
+	}
+	if err := m.save(ctx, t, cfg); err != nil {
+		return err
+	}
+	m.authn.RemoveKeys(id)
+	return nil
+}
+
+// SetSinks replaces the sinks of tenant name. Tenants may only set up
+// webhooks; events queued for the old sinks are flushed first.
+func (m *Manager) SetSinks(ctx context.Context, name string, sinks []config.SinkConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, err := m.live(name)
+	if err != nil {
+		return err
+	}
+	if limit := t.limits().Sinks; len(sinks) > limit {
+		return fmt.Errorf("%w: at most %d sinks", ErrLimit, limit)
+	}
+	for _, s := range sinks {
+		if s.Kind != "webhook" {
+			return fmt.Errorf("%w: sink %s: only webhook sinks are available to tenants", ErrInvalid, s.Name)
+		}
+	}
+	scoped, err := scopeSinks(name, sinks)
+	if err != nil {
+		return err
+	}
+	old := t.Config.Sinks
+	m.sinks.RemoveSinks(sinkNames(old)...)
+	if err := m.addSinks(scoped); err != nil {
+		m.restoreSinks(name, old)
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	cfg := t.Config
+	cfg.Sinks = scoped
+	if err := m.save(ctx, t, cfg); err != nil {
+		m.sinks.RemoveSinks(sinkNames(scoped)...)
+		m.restoreSinks(name, old)
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) restoreSinks(name string, sinks []config.SinkConfig) {
+	if err := m.addSinks(sinks); err != nil {
+		log.Error().Err(err).Str("tenant", name).Msg("restore sinks")
+	}
+}
+
+// SetAlerts replaces the notifiers and alert rules of tenant name.
+func (m *Manager) SetAlerts(ctx context.Context, name string, alerts config.AlertsConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, err := m.live(name)
+	if err != nil {
+		return err
+	}
+	if limit := t.limits().AlertRules; len(alerts.Rules) > limit || len(alerts.Notifiers) > limit {
+		return fmt.Errorf("%w: at most %d rules and %d notifiers", ErrLimit, limit, limit)
+	}
+	scoped, err := scopeAlerts(name, alerts)
+	if err != nil {
+		return err
+	}
+	old := t.Config.Alerts
+	m.alerts.RemoveRules(old)
+	if err := m.addRules(scoped); err != nil {
+		m.restoreAlerts(name, old)
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	cfg := t.Config
+	cfg.Alerts = scoped
+	if err := m.save(ctx, t, cfg); err != nil {
+		m.alerts.RemoveRules(scoped)
+		m.restoreAlerts(name, old)
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) restoreAlerts(name string, alerts config.AlertsConfig) {
+	if err := m.addRules(alerts); err != nil {
+		log.Error().Err(err).Str("tenant", name).Msg("restore alert rules")
+	}
+}
+
+// live returns tenant name unless it is unknown or being offboarded. The
+// caller holds m.mu.
+func (m *Manager) live(name string) (*tenant, error) {
+	t, ok := m.tenants[name]
+	if !ok || t.offboarding {
+		return nil, ErrNotFound
+	}
+	return t, nil
+}
+
+// save stores cfg as the configuration of t. The caller holds m.mu.
+func (m *Manager) save(ctx context.Context, t *tenant, cfg config.TenantConfig) error {
+	if err := m.store.SaveTenant(ctx, storage.Tenant{Config: cfg, CreatedAt: t.CreatedAt}); err != nil {
+		return err
+	}
+	t.Config = cfg
+	return nil
+}
+
+// Offboard revokes the tenant's keys and stops its sinks and pipeline, then
+// calls export, when not nil, with the query selecting its events. Only once
+// export succeeds are the events purged and the tenant removed; after a
+// failed export Offboard can be called again.
+func (m *Manager) Offboard(ctx context.Context, name string, export func(storage.Query) error) (int64, error) {
+	m.mu.Lock()
+	t, ok := m.tenants[name]
+	if ok && !t.offboarding {
+		t.offboarding = true
+		m.unapply(t)
+	}
+	m.mu.Unlock()
+	if !ok {
+		return 0, ErrNotFound
+	}
+	q := storage.Query{Types: []string{name + "/*"}}
+	if export != nil {
+		if err := export(q); err != nil {
+			return 0, fmt.Errorf("export: %w", err)
+		}
+	}
+	n, err := m.store.Purge(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	purgedTotal.WithLabelValues(name, "offboard").Add(float64(n))
+	if err := m.store.DeleteTenant(ctx, name); err != nil {
+		return n, err
+	}
+	m.mu.Lock()
+	delete(m.tenants, name)
+	tenantsTotal.Set(float64(len(m.tenants)))
+	m.mu.Unlock()
+	return n, nil
+}
+
+// Admit returns ErrQuota when the tenant owning typ has used up its daily
+// quota. Events are counted once stored, so a batch admitted just under the
+// quota is stored whole.
+func (m *Manager) Admit(typ string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.owner(typ)
+	if t == nil || t.Config.Quota.EventsPerDay == 0 {
+		return nil
+	}
+	t.rollover()
+	if t.used >= t.Config.Quota.EventsPerDay {
+		quotaRejected.WithLabelValues(t.Config.Name).Inc()
+		return fmt.Errorf("tenant %s: %w (%d)", t.Config.Name, ErrQuota, t.Config.Quota.EventsPerDay)
+	}
+	return nil
+}
+
+// Record counts a stored event against the quota of the tenant owning typ.
+func (m *Manager) Record(typ string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t := m.owner(typ); t != nil {
+		t.rollover()
+		t.used++
+	}
+}
+
+// Tenant returns the name of the tenant whose namespace holds typ, or "".
+func (m *Manager) Tenant(typ string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t := m.owner(typ); t != nil {
+		return t.Config.Name
+	}
+	return ""
+}
+
+// owner returns the tenant whose namespace holds typ, or nil. The caller
+// holds m.mu.
+func (m *Manager) owner(typ string) *tenant {
+	for i := strings.LastIndexByte(typ, '/'); i > 0; i = strings.LastIndexByte(typ[:i], '/') {
+		if t, ok := m.tenants[typ[:i]]; ok {
+			return t
+		}
+	}
+	return nil
+}
+
+func (m *Manager) run() {
+	defer close(m.stopped)
+	ticker := time.NewTicker(retentionSweep)
+	defer ticker.Stop()
+	// what expired while the service was down goes right away
+	m.expire(time.Now())
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			m.expire(now)
+		}
+	}
+}
+
+// expire purges the events older than their tenant's retention, but for
+// reserved types.
+func (m *Manager) expire(now time.Time) {
+	m.mu.Lock()
+	retention := map[string]time.Duration{}
+	for name, t := range m.tenants {
+		if t.Config.Retention > 0 && !t.offboarding {
+			retention[name] = t.Config.Retention
+		}
+	}
+	m.mu.Unlock()
+	for name, d := range retention {
+		n, err := m.store.Purge(context.Background(), storage.Query{Types: []string{name + "/*"}, NotTypes: m.reserved, Until: now.Add(-d)})
+		if err != nil {
+			log.Error().Err(err).Str("tenant", name).Msg("purge expired events")
+			continue
+		}
+		if n > 0 {
+			purgedTotal.WithLabelValues(name, "retention").Add(float64(n))
+			log.Info().Str("tenant", name).Int64("events", n).Msg("purged expired events")
+		}
+	}
+}
+
+// rollover restarts the count at UTC midnight. The caller holds m.mu.
+func (t *tenant) rollover() {
+	if d := today(); d.After(t.day) {
+		t.day, t.used = d, 0
+	}
+}
+
+func (t *tenant) status() Status {
+	s := Status{
+		Name:         t.Config.Name,
+		CreatedAt:    t.CreatedAt,
+		Keys:         keyIDs(t.Config),
+		Sinks:        []string{},
+		Pipeline:     len(t.Config.Pipeline),
+		EventsPerDay: t.Config.Quota.EventsPerDay,
+		Offboarding:  t.offboarding,
+		Limits:       t.limits(),
+	}
+	t.rollover()
+	s.EventsToday = t.used
+	s.Sinks = append(s.Sinks, sinkNames(t.Config.Sinks)...)
+	s.Alerts = make([]string, len(t.Config.Alerts.Rules))
+	for i, r := range t.Config.Alerts.Rules {
+		s.Alerts[i] = r.Name
+	}
+	if t.Config.Retention > 0 {
+		s.Retention = t.Config.Retention.String()
+	}
+	return s
+}
+
+func (t *tenant) limits() Limits {
+	l := Limits{
+		Keys:       t.Config.Limits.MaxKeys,
+		Sinks:      t.Config.Limits.MaxSinks,
+		AlertRules: t.Config.Limits.MaxAlertRules,
+	}
+	if l.Keys == 0 {
+		l.Keys = defaultMaxKeys
+	}
+	if l.Sinks == 0 {
+		l.Sinks = defaultMaxSinks
+	}
+	if l.AlertRules == 0 {
+		l.AlertRules = defaultMaxAlertRules
+	}
+	return l
+}
+
+func canManage(k config.APIKeyConfig) bool {
+	return slices.Contains(k.Roles, string(auth.RoleManage))
+}
+
+func sinkNames(sinks []config.SinkConfig) []string {
+	names := make([]string, len(sinks))
+	for i, s := range sinks {
+		names[i] = s.Name
+	}
+	return names
+}
+
+func keyIDs(cfg config.TenantConfig) []string {
+	ids := make([]string, len(cfg.Keys))
+	for i, k := range cfg.Keys {
+		ids[i] = k.ID
+	}
+	return ids
+}
+
+func today() time.Time {
+	return time.Now().UTC().Truncate(24 * time.Hour)
+}
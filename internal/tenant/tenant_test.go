@@ -0,0 +1,322 @@
+package tenant
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/alert"
+	"github.com/rafaelosorio/go-ingest-service/internal/auth"
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/pipeline"
+	"github.com/rafaelosorio/go-ingest-service/internal/sink"
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+type fixture struct {
+	m     *Manager
+	store *storage.Memory
+	authn *auth.Authenticator
+	sinks *sink.Dispatcher
+}
+
+// setup lets the tenants' webhooks reach the test servers on loopback.
+func setup(t *testing.T) *fixture {
+	t.Helper()
+	return setupEgress(t, config.EgressConfig{AllowCIDRs: []string{"127.0.0.0/8"}})
+}
+
+func setupEgress(t *testing.T, egress config.EgressConfig) *fixture {
+	t.Helper()
+	store := storage.NewMemory(1)
+	authn, err := auth.New(config.AuthConfig{Enabled: true, APIKeys: []config.APIKeyConfig{{ID: "root", Key: "root-key", Roles: []string{"admin"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sinks, err := sink.NewDispatcher(nil, config.RoutingConfig{}, nil, config.BreakerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sinks.Close(context.Background()) })
+	pipelines, err := pipeline.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alerts, err := alert.New(config.AlertsConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(store, authn, sinks, pipelines, alerts, nil, egress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	return &fixture{m: m, store: store, authn: authn, sinks: sinks}
+}
+
+// principal returns who key authenticates as, nil when it does not.
+func (f *fixture) principal(key string) *auth.Principal {
+	var p *auth.Principal
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-API-Key", key)
+	f.authn.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ = auth.FromContext(r.Context())
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	return p
+}
+
+func (f *fixture) add(t *testing.T, typ string) {
+	t.Helper()
+	if _, err := f.store.Add(context.Background(), event.Event{Type: typ, Payload: json.RawMessage(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (f *fixture) count(t *testing.T, types ...string) int {
+	t.Helper()
+	es, err := f.store.List(context.Background(), storage.Query{Types: types, Limit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(es)
+}
+
+func onboard(t *testing.T, f *fixture, cfg config.TenantConfig) map[string]string {
+	t.Helper()
+	if cfg.Keys == nil {
+		cfg.Keys = []config.APIKeyConfig{{ID: "ops", Roles: []string{"ingest", "read", "manage"}}}
+	}
+	_, issued, err := f.m.Create(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]string{}
+	for _, k := range issued {
+		keys[k.ID] = k.Key
+	}
+	return keys
+}
+
+// TestIsolation: a tenant's keys are confined to its namespace, tenants
+// cannot nest, and tenant keys are never admins.
+func TestIsolation(t *testing.T) {
+	f := setup(t)
+	acme := onboard(t, f, config.TenantConfig{Name: "acme"})
+	globex := onboard(t, f, config.TenantConfig{Name: "globex"})
+
+	p := f.principal(acme["acme/ops"])
+	if p == nil || p.Subject != "acme/ops" || !slices.Equal(p.Namespaces, []string{"acme"}) {
+		t.Fatalf("acme key: %+v", p)
+	}
+	if owner, err := f.m.Owner(p); err != nil || owner != "acme" {
+		t.Errorf("owner %q, %v", owner, err)
+	}
+	if _, err := p.ScopeTypes([]string{"globex/order"}); err == nil {
+		t.Error("acme key scoped to a globex type")
+	}
+	if owner, _ := f.m.Owner(f.principal(globex["globex/ops"])); owner != "globex" {
+		t.Errorf("globex key owned by %q", owner)
+	}
+	if _, err := f.m.Owner(f.principal("root-key")); !errors.Is(err, ErrNoTenant) {
+		t.Errorf("service key owner: %v", err)
+	}
+
+	for name, cfg := range map[string]config.TenantConfig{
+		"nested":      {Name: "acme/eu"},
+		"admin key":   {Name: "initech", Keys: []config.APIKeyConfig{{ID: "root", Roles: []string{"admin"}}}},
+		"no keys":     {Name: "initech", Keys: []config.APIKeyConfig{}},
+		"plugin sink": {Name: "initech", Sinks: []config.SinkConfig{{Name: "p", Kind: "plugin"}}},
+	} {
+		if cfg.Keys == nil {
+			cfg.Keys = []config.APIKeyConfig{{ID: "ops", Roles: []string{"manage"}}}
+		}
+		if _, _, err := f.m.Create(context.Background(), cfg); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, _, err := f.m.Create(context.Background(), config.TenantConfig{Name: "acme", Keys: []config.APIKeyConfig{{ID: "x", Roles: []string{"read"}}}}); !errors.Is(err, ErrExists) {
+		t.Errorf("duplicate: %v", err)
+	}
+
+	for typ, want := range map[string]string{"acme/order": "acme", "acme/eu/order": "acme", "acmecorp/order": "", "globex/a": "globex", "order": ""} {
+		if got := f.m.Tenant(typ); got != want {
+			t.Errorf("Tenant(%s) = %q, want %q", typ, got, want)
+		}
+	}
+}
+
+// TestQuota admits a tenant's events until its daily quota is used up,
+// without counting other tenants' events against it.
+func TestQuota(t *testing.T) {
+	f := setup(t)
+	onboard(t, f, config.TenantConfig{Name: "acme", Quota: config.QuotaConfig{EventsPerDay: 2}})
+	onboard(t, f, config.TenantConfig{Name: "globex", Quota: config.QuotaConfig{EventsPerDay: 1}})
+	for range 2 {
+		if err := f.m.Admit("acme/order"); err != nil {
+			t.Fatal(err)
+		}
+		f.m.Record("acme/order")
+	}
+	if err := f.m.Admit("acme/order"); !errors.Is(err, ErrQuota) {
+		t.Errorf("over quota: %v", err)
+	}
+	if err := f.m.Admit("globex/order"); err != nil {
+		t.Errorf("globex charged for acme: %v", err)
+	}
+	if err := f.m.Admit("order"); err != nil {
+		t.Errorf("untenanted type: %v", err)
+	}
+	if st, _ := f.m.Get("acme"); st.EventsToday != 2 {
+		t.Errorf("events today %d", st.EventsToday)
+	}
+}
+
+// TestOffboard revokes the tenant's keys and purges its events only once
+// the export succeeded, leaving the other tenants' events alone.
+func TestOffboard(t *testing.T) {
+	f := setup(t)
+	acme := onboard(t, f, config.TenantConfig{Name: "acme"})
+	onboard(t, f, config.TenantConfig{Name: "globex"})
+	f.add(t, "acme/order")
+	f.add(t, "acme/eu/order")
+	f.add(t, "globex/order")
+	f.add(t, "acmecorp/order")
+
+	if _, err := f.m.Offboard(context.Background(), "acme", func(storage.Query) error { return errors.New("bucket unavailable") }); err == nil {
+		t.Fatal("offboarded despite a failed export")
+	}
+	if f.principal(acme["acme/ops"]) != nil {
+		t.Error("key still valid while offboarding")
+	}
+	if n := f.count(t, "acme/*"); n != 2 {
+		t.Fatalf("failed export purged events: %d left", n)
+	}
+	if _, err := f.m.Get("acme"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("offboarding tenant: %v", err)
+	}
+
+	var exported storage.Query
+	n, err := f.m.Offboard(context.Background(), "acme", func(q storage.Query) error { exported = q; return nil })
+	if err != nil || n != 2 {
+		t.Fatalf("offboard: %d, %v", n, err)
+	}
+	if !slices.Equal(exported.Types, []string{"acme/*"}) {
+		t.Errorf("exported %v", exported.Types)
+	}
+	if f.count(t, "acme/*") != 0 || f.count(t, "globex/*") != 1 || f.count(t, "acmecorp/*") != 1 {
+		t.Error("purge crossed the tenant's namespace")
+	}
+	if names := f.m.List(); len(names) != 1 || names[0].Name != "globex" {
+		t.Errorf("tenants %+v", names)
+	}
+}
+
+// TestRetention purges the tenant's events past its retention, but for
+// reserved types and events outside its namespace.
+func TestRetention(t *testing.T) {
+	f := setup(t)
+	onboard(t, f, config.TenantConfig{Name: "acme", Retention: time.Hour})
+	f.add(t, "acme/order")
+	f.add(t, "acme/_system.audit")
+	f.add(t, "globex/order")
+	f.m.reserved = event.ReservedPatterns([]string{"_system."})
+
+	f.m.expire(time.Now())
+	if n := f.count(t, "acme/*"); n != 2 {
+		t.Fatalf("fresh events purged: %d left", n)
+	}
+	f.m.expire(time.Now().Add(2 * time.Hour))
+	if f.count(t, "acme/order") != 0 || f.count(t, "acme/_system.audit") != 1 || f.count(t, "globex/order") != 1 {
+		t.Error("retention purged the wrong events")
+	}
+}
+
+// TestSelfService: manage keys change the tenant's keys and sinks within its
+// limits, and the sinks only see the tenant's events.
+func TestSelfService(t *testing.T) {
+	f := setup(t)
+	onboard(t, f, config.TenantConfig{Name: "acme", Limits: config.TenantLimitsConfig{MaxKeys: 2, MaxSinks: 1}})
+
+	ci, err := f.m.IssueKey(context.Background(), "acme", config.APIKeyConfig{ID: "ci", Roles: []string{"ingest"}})
+	if err != nil || ci.ID != "acme/ci" {
+		t.Fatalf("issue: %+v, %v", ci, err)
+	}
+	if p := f.principal(ci.Key); p == nil || !slices.Equal(p.Namespaces, []string{"acme"}) {
+		t.Errorf("issued key: %+v", p)
+	}
+	if _, err := f.m.IssueKey(context.Background(), "acme", config.APIKeyConfig{ID: "third", Roles: []string{"read"}}); !errors.Is(err, ErrLimit) {
+		t.Errorf("past max_keys: %v", err)
+	}
+	if err := f.m.RevokeKey(context.Background(), "acme", "ops"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("revoking the last manage key: %v", err)
+	}
+	if err := f.m.RevokeKey(context.Background(), "acme", "ci"); err != nil {
+		t.Fatal(err)
+	}
+	if f.principal(ci.Key) != nil {
+		t.Error("revoked key still valid")
+	}
+
+	var mu sync.Mutex
+	var received []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, b...)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	hook := config.SinkConfig{Name: "hook", Kind: "webhook", URL: srv.URL}
+	if err := f.m.SetSinks(context.Background(), "acme", []config.SinkConfig{{Name: "out", Kind: "stdout"}}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("stdout sink: %v", err)
+	}
+	if err := f.m.SetSinks(context.Background(), "acme", []config.SinkConfig{hook, hook}); !errors.Is(err, ErrLimit) {
+		t.Errorf("past max_sinks: %v", err)
+	}
+	if err := f.m.SetSinks(context.Background(), "acme", []config.SinkConfig{hook}); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := f.m.Get("acme"); !slices.Equal(st.Sinks, []string{"acme/hook"}) {
+		t.Errorf("sinks %v", st.Sinks)
+	}
+	for _, typ := range []string{"acme/order", "globex/order", "order"} {
+		f.sinks.Publish(event.Event{ID: 1, Type: typ, Payload: json.RawMessage(`{}`)})
+	}
+	f.sinks.Close(context.Background())
+	mu.Lock()
+	defer mu.Unlock()
+	if !bytes.Contains(received, []byte(`"acme/order"`)) || bytes.Contains(received, []byte(`"globex/order"`)) || bytes.Contains(received, []byte(`"order"`)) {
+		t.Errorf("acme/hook received %s", received)
+	}
+	if _, err := f.m.IssueKey(context.Background(), "globex", config.APIKeyConfig{ID: "x", Roles: []string{"read"}}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown tenant: %v", err)
+	}
+}
+
+// TestEgress keeps a tenant's webhook from connecting to the service's
+// network, here loopback, whatever URL it sets.
+func TestEgress(t *testing.T) {
+	f := setupEgress(t, config.EgressConfig{})
+	onboard(t, f, config.TenantConfig{Name: "acme"})
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { hits.Add(1) }))
+	defer srv.Close()
+	if err := f.m.SetSinks(context.Background(), "acme", []config.SinkConfig{{Name: "hook", Kind: "webhook", URL: srv.URL}}); err != nil {
+		t.Fatal(err)
+	}
+	f.sinks.Publish(event.Event{ID: 1, Type: "acme/order", Payload: json.RawMessage(`{}`)})
+	f.sinks.Close(context.Background())
+	if n := hits.Load(); n != 0 {
+		t.Errorf("loopback webhook called %d times", n)
+	}
+}
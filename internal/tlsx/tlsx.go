@@ -0,0 +1,152 @@
+// Package tlsx serves TLS with certificates that can be swapped at runtime and
+// optional client certificate verification (mutual TLS).
+package tlsx
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// Reloader holds the current certificate and client CA pool. Reload swaps
+// both atomically; handshakes already in progress keep the old ones.
+type Reloader struct {
+	cfg     config.TLSConfig
+	current atomic.Pointer[material]
+}
+
+type material struct {
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modified []time.Time
+}
+
+// New loads the files named by cfg.
+func New(cfg config.TLSConfig) (*Reloader, error) {
+	r := &Reloader{cfg: cfg}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the certificate, key and client CA bundle again. On error the
+// previous material stays in use.
+func (r *Reloader) Reload() error {
+	m := &material{modified: r.modTimes()}
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("tls: load certificate: %w", err)
+	}
+	m.cert = &cert
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("tls: read client CA: %w", err)
+		}
+		m.clientCA = x509.NewCertPool()
+		if !m.clientCA.AppendCertsFromPEM(pem) {
+			return errors.New("tls: client CA file holds no PEM certificates")
+		}
+	}
+	r.current.Store(m)
+	return nil
+}
+
+// Config returns the server TLS configuration, resolving the certificate
+// and client CAs per handshake so that reloads apply to new connections.
+// Everything else stays on the returned config, so the NextProtos that
+// http.Server adds to it for HTTP/2 are offered on every connection.
+func (r *Reloader) Config() *tls.Config {
+	c := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.current.Load().cert, nil
+		},
+	}
+	if r.cfg.ClientCAFile != "" {
+		// the chain is verified against the current pool in verifyClient,
+		// since ClientCAs would pin the pool loaded first
+		c.ClientAuth = tls.RequireAnyClientCert
+		c.VerifyConnection = r.verifyClient
+	}
+	return c
+}
+
+// verifyClient verifies the client's chain against the current client CA
+// pool and enforces AllowedClientNames against the leaf's CN and SANs.
+func (r *Reloader) verifyClient(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("tls: no client certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	opts := x509.VerifyOptions{
+		Roots:         r.current.Load().clientCA,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		return fmt.Errorf("tls: client certificate: %w", err)
+	}
+	if len(r.cfg.AllowedClientNames) == 0 {
+		return nil
+	}
+	names := append([]string{leaf.Subject.CommonName}, leaf.DNSNames...)
+	names = append(names, leaf.EmailAddresses...)
+	for _, u := range leaf.URIs {
+		names = append(names, u.String())
+	}
+	for _, n := range names {
+		if n != "" && slices.Contains(r.cfg.AllowedClientNames, n) {
+			return nil
+		}
+	}
+	return fmt.Errorf("tls: client certificate %q is not allowed", leaf.Subject.CommonName)
+}
+
+// Watch reloads whenever one of the files changes, checking every interval,
+// until done is closed. Certificate managers (cert-manager, certbot) replace
+// the files in place, so polling modification times is enough.
+func (r *Reloader) Watch(interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			if slices.Equal(r.modTimes(), r.current.Load().modified) {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				log.Error().Err(err).Msg("tls reload")
+				continue
+			}
+			log.Info().Msg("tls certificates reloaded")
+		}
+	}
+}
+
+func (r *Reloader) modTimes() []time.Time {
+	var out []time.Time
+	for _, f := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.ClientCAFile} {
+		var mod time.Time
+		if fi, err := os.Stat(f); f != "" && err == nil {
+			mod = fi.ModTime()
+		}
+		out = append(out, mod)
+	}
+	return out
+}
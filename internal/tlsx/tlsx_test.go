@@ -0,0 +1,238 @@
+package tlsx
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+)
+
+// issuer is a test CA.
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newIssuer(t *testing.T, name string) *issuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &issuer{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a leaf certificate for cn, for servers on 127.0.0.1 or for
+// clients, with its key, in PEM.
+func (ca *issuer) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+}
+
+func write(t *testing.T, path string, b []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serve runs an http.Server on the reloader's config the way main does and
+// returns its address.
+func serve(t *testing.T, r *Reloader) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}),
+		TLSConfig: r.Config(),
+		ErrorLog:  log.New(io.Discard, "", 0),
+	}
+	go func() { _ = srv.ServeTLS(ln, "", "") }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return "https://" + ln.Addr().String()
+}
+
+// get makes a request on a new connection, trusting roots and presenting
+// client when set.
+func get(url string, roots *x509.CertPool, client *tls.Certificate) (*http.Response, error) {
+	cfg := &tls.Config{RootCAs: roots}
+	if client != nil {
+		cfg.Certificates = []tls.Certificate{*client}
+	}
+	tr := &http.Transport{TLSClientConfig: cfg, ForceAttemptHTTP2: true}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr, Timeout: 5 * time.Second}).Get(url)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// TestReload serves HTTP/2 over ALPN and the new certificate to connections
+// made after a reload, keeping the old one when the new files are broken.
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newIssuer(t, "ca")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	cfg := config.TLSConfig{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")}
+	cert, key := ca.issue(t, "first", x509.ExtKeyUsageServerAuth)
+	write(t, cfg.CertFile, cert)
+	write(t, cfg.KeyFile, key)
+	r, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := serve(t, r)
+
+	served := func() string {
+		t.Helper()
+		resp, err := get(url, roots, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Proto != "HTTP/2.0" {
+			t.Errorf("negotiated %s, want HTTP/2.0", resp.Proto)
+		}
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if got := served(); got != "first" {
+		t.Fatalf("served %q", got)
+	}
+
+	cert, key = ca.issue(t, "second", x509.ExtKeyUsageServerAuth)
+	write(t, cfg.CertFile, cert)
+	write(t, cfg.KeyFile, key)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := served(); got != "second" {
+		t.Errorf("after reload served %q", got)
+	}
+
+	write(t, cfg.KeyFile, []byte("not a key"))
+	if err := r.Reload(); err == nil {
+		t.Error("broken key reloaded")
+	}
+	if got := served(); got != "second" {
+		t.Errorf("after failed reload served %q", got)
+	}
+}
+
+// TestClientCertificates requires a client certificate from the client CA
+// with an allowed name, and verifies against the reloaded CA bundle.
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca, clients := newIssuer(t, "ca"), newIssuer(t, "clients")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	cfg := config.TLSConfig{
+		CertFile:           filepath.Join(dir, "tls.crt"),
+		KeyFile:            filepath.Join(dir, "tls.key"),
+		ClientCAFile:       filepath.Join(dir, "ca.crt"),
+		AllowedClientNames: []string{"producer"},
+	}
+	cert, key := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	write(t, cfg.CertFile, cert)
+	write(t, cfg.KeyFile, key)
+	write(t, cfg.ClientCAFile, clients.pem)
+	r, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := serve(t, r)
+
+	pair := func(ca *issuer, cn string) *tls.Certificate {
+		c, k := ca.issue(t, cn, x509.ExtKeyUsageClientAuth)
+		p, err := tls.X509KeyPair(c, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &p
+	}
+	producer := pair(clients, "producer")
+	for _, tc := range []struct {
+		name   string
+		client *tls.Certificate
+		ok     bool
+	}{
+		{"none", nil, false},
+		{"allowed", producer, true},
+		{"other name", pair(clients, "intruder"), false},
+		{"other CA", pair(ca, "producer"), false},
+	} {
+		resp, err := get(url, roots, tc.client)
+		if tc.ok && (err != nil || resp.Proto != "HTTP/2.0") {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%s: accepted", tc.name)
+		}
+	}
+
+	// a new client CA bundle applies to the next handshake
+	write(t, cfg.ClientCAFile, ca.pem)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(url, roots, producer); err == nil {
+		t.Error("client of the replaced CA accepted")
+	}
+	if _, err := get(url, roots, pair(ca, "producer")); err != nil {
+		t.Errorf("client of the new CA: %v", err)
+	}
+}
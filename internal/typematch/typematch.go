@@ -0,0 +1,153 @@
+// Package typematch matches event types against the type patterns of
+// queries, routing rules, sink filters and subscriptions. Patterns are
+// SQLite GLOBs without character classes: * matches any run of characters,
+// dots and slashes included, and ? a single one. Since types nest by dots
+// and namespaces by slashes, a pattern ending in * covers a whole subtree:
+// order.* matches order.created and order.item.added, acme/* every type of
+// the acme namespace.
+//
+// Most patterns are exact types or such prefixes, which a Set matches by a
+// map lookup and a binary search instead of trying each pattern in turn.
+package typematch
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Validate rejects empty patterns and character classes, which the stores
+// do not agree on.
+func Validate(p string) error {
+	if p == "" || strings.ContainsAny(p, "[]") {
+		return fmt.Errorf("invalid type pattern %q", p)
+	}
+	return nil
+}
+
+// IsLiteral reports whether p has no wildcard and so matches one type.
+func IsLiteral(p string) bool {
+	return !strings.ContainsAny(p, "*?")
+}
+
+// Prefix returns the literal part of p when p is a prefix pattern, a
+// literal followed by a single trailing *.
+func Prefix(p string) (string, bool) {
+	prefix, ok := strings.CutSuffix(p, "*")
+	return prefix, ok && IsLiteral(prefix)
+}
+
+// Match reports whether typ matches the pattern p.
+func Match(p, typ string) bool {
+	if IsLiteral(p) {
+		return p == typ
+	}
+	if prefix, ok := Prefix(p); ok {
+		return strings.HasPrefix(typ, prefix)
+	}
+	return glob(p, typ)
+}
+
+// MatchAny reports whether typ matches any of patterns.
+func MatchAny(patterns []string, typ string) bool {
+	for _, p := range patterns {
+		if Match(p, typ) {
+			return true
+		}
+	}
+	return false
+}
+
+// glob matches the wildcards in linear time, backtracking only to the last
+// *: since * matches anything, an earlier one never needs to take more.
+func glob(p, s string) bool {
+	var pi, si int
+	star, next := -1, 0
+	for si < len(s) {
+		if pi < len(p) {
+			switch p[pi] {
+			case '*':
+				star, next = pi, si
+				pi++
+				continue
+			case '?':
+				_, n := utf8.DecodeRuneInString(s[si:])
+				pi, si = pi+1, si+n
+				continue
+			default:
+				if p[pi] == s[si] {
+					pi, si = pi+1, si+1
+					continue
+				}
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// let the last * take one more character
+		_, n := utf8.DecodeRuneInString(s[next:])
+		next += n
+		pi, si = star+1, next
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// Set is a compiled list of patterns, for matching many types against the
+// same ones. The zero Set matches nothing.
+type Set struct {
+	exact map[string]bool
+	// prefixes are sorted, and none is a prefix of another: the only one
+	// that can be a prefix of a type is the greatest not above it.
+	prefixes []string
+	globs    []string
+}
+
+// Compile compiles patterns, which must be valid.
+func Compile(patterns []string) *Set {
+	s := &Set{}
+	var prefixes []string
+	for _, p := range patterns {
+		if IsLiteral(p) {
+			if s.exact == nil {
+				s.exact = map[string]bool{}
+			}
+			s.exact[p] = true
+		} else if prefix, ok := Prefix(p); ok {
+			prefixes = append(prefixes, prefix)
+		} else {
+			s.globs = append(s.globs, p)
+		}
+	}
+	slices.Sort(prefixes)
+	for _, p := range prefixes {
+		if n := len(s.prefixes); n == 0 || !strings.HasPrefix(p, s.prefixes[n-1]) {
+			s.prefixes = append(s.prefixes, p)
+		}
+	}
+	return s
+}
+
+// Match reports whether typ matches any pattern of s.
+func (s *Set) Match(typ string) bool {
+	if s.exact[typ] {
+		return true
+	}
+	if i, found := slices.BinarySearch(s.prefixes, typ); found || (i > 0 && strings.HasPrefix(typ, s.prefixes[i-1])) {
+		return true
+	}
+	for _, p := range s.globs {
+		if glob(p, typ) {
+			return true
+		}
+	}
+	return false
+}
+
+// Empty reports whether s has no pattern.
+func (s *Set) Empty() bool {
+	return len(s.exact) == 0 && len(s.prefixes) == 0 && len(s.globs) == 0
+}
@@ -0,0 +1,69 @@
+package typematch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, typ string
+		want         bool
+	}{
+		{"order.created", "order.created", true},
+		{"order.created", "order.created.v2", false},
+		{"order.*", "order.created", true},
+		{"order.*", "order.item.added", true},
+		{"order.*", "order", false},
+		{"order*", "orders.created", true},
+		{"*", "", true},
+		{"*.created", "order.created", true},
+		{"*.created", "order.updated", false},
+		{"order.*.added", "order.item.added", true},
+		{"order.*.added", "order.item.removed", false},
+		{"acme/*", "acme/billing/invoice.paid", true},
+		{"acme/*", "acmecorp/invoice.paid", false},
+		{"order.?", "order.é", true},
+		{"order.?", "order.ab", false},
+		{"*a*b*c", "xaybzc", true},
+		{"*a*b*c", "xaybzcd", false},
+		{"**", "order.created", true},
+	} {
+		if got := Match(tc.pattern, tc.typ); got != tc.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tc.pattern, tc.typ, got, tc.want)
+		}
+		if got := Compile([]string{tc.pattern}).Match(tc.typ); got != tc.want {
+			t.Errorf("Set{%q}.Match(%q) = %v, want %v", tc.pattern, tc.typ, got, tc.want)
+		}
+	}
+	// a backtracking matcher takes exponential time on this
+	if Match(strings.Repeat("*a", 30)+"b", strings.Repeat("a", 100)) {
+		t.Error("pathological pattern matched")
+	}
+}
+
+func TestSet(t *testing.T) {
+	s := Compile([]string{"user.signed_up", "order.*", "order.item.*", "ord*", "billing.*", "*.failed"})
+	for typ, want := range map[string]bool{
+		"user.signed_up":    true,
+		"user.signed_out":   false,
+		"order.created":     true,
+		"ordinal":           true,
+		"billing.paid":      true,
+		"billing":           false,
+		"bill":              false,
+		"payment.failed":    true,
+		"payment.succeeded": false,
+		"":                  false,
+	} {
+		if got := s.Match(typ); got != want {
+			t.Errorf("Match(%q) = %v, want %v", typ, got, want)
+		}
+	}
+	if len(s.prefixes) != 2 {
+		t.Errorf("prefixes %q: order. and order.item. are covered by ord", s.prefixes)
+	}
+	if !Compile(nil).Empty() || Compile(nil).Match("order.created") {
+		t.Error("an empty set matched")
+	}
+}
@@ -0,0 +1,198 @@
+// Admin UI: polls the read and admin APIs with the key in sessionStorage.
+// Everything is rendered through textContent, never as HTML.
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+const refreshEvery = 5000;
+let key = sessionStorage.getItem("ingest-key") || "";
+let actions = false;
+
+class HTTPError extends Error {
+  constructor(status, message) {
+    super(message);
+    this.status = status;
+  }
+}
+
+async function api(path, init = {}) {
+  const headers = new Headers(init.headers);
+  if (key) headers.set("X-API-Key", key);
+  if (init.body) headers.set("Content-Type", "application/json");
+  const res = await fetch(path, { ...init, headers });
+  const body = await res.json().catch(() => null);
+  if (!res.ok) {
+    const msg = (body && (body.detail || (body.error && body.error.message))) || res.statusText;
+    throw new HTTPError(res.status, msg);
+  }
+  return body;
+}
+
+function row(tbody, cells, onclick) {
+  const tr = document.createElement("tr");
+  for (const c of cells) {
+    const td = document.createElement("td");
+    if (c instanceof Node) td.append(c);
+    else td.textContent = c;
+    tr.append(td);
+  }
+  if (onclick) tr.addEventListener("click", onclick);
+  tbody.append(tr);
+  return tr;
+}
+
+// show renders the outcome of a section's refresh: nothing when it worked,
+// a hint when the key lacks the role, the error otherwise.
+function show(section, err) {
+  let note = section.querySelector(".note");
+  if (!err) {
+    if (note) note.remove();
+    return;
+  }
+  if (!note) {
+    note = document.createElement("p");
+    section.querySelector("h2").after(note);
+  }
+  const denied = err.status === 401 || err.status === 403;
+  note.className = "note " + (denied ? "denied" : "error");
+  note.textContent = denied ? "This needs a key with the " + (section.classList.contains("admin") ? "admin" : "read") + " role." : err.message;
+}
+
+function drawChart(buckets) {
+  const canvas = $("chart");
+  canvas.width = canvas.clientWidth * devicePixelRatio;
+  canvas.height = 120 * devicePixelRatio;
+  const ctx = canvas.getContext("2d");
+  ctx.clearRect(0, 0, canvas.width, canvas.height);
+  const peak = Math.max(1, ...buckets.map((b) => b.count));
+  const w = canvas.width / Math.max(1, buckets.length);
+  ctx.fillStyle = "#3c78b4";
+  buckets.forEach((b, i) => {
+    const h = (b.count / peak) * (canvas.height - 14 * devicePixelRatio);
+    ctx.fillRect(i * w + 1, canvas.height - h, Math.max(1, w - 2), h);
+  });
+  ctx.fillStyle = "#68707a";
+  ctx.font = 11 * devicePixelRatio + "px system-ui";
+  ctx.fillText("peak " + (peak / 10).toFixed(1) + "/s", 4, 12 * devicePixelRatio);
+}
+
+async function refreshThroughput() {
+  const since = new Date(Date.now() - 15 * 60 * 1000).toISOString();
+  try {
+    const st = await api("/v1/events/stats?bucket=10s&since=" + encodeURIComponent(since));
+    drawChart(st.buckets);
+    $("total").textContent = st.total + " events, " + (st.total / 900).toFixed(2) + "/s on average";
+    const tbody = $("types");
+    tbody.replaceChildren();
+    for (const t of st.types.sort((a, b) => b.count - a.count).slice(0, 15)) {
+      row(tbody, [t.type, t.count, Math.round(t.avg_payload_bytes) + " B"]);
+    }
+    show($("throughput"));
+  } catch (err) {
+    show($("throughput"), err);
+  }
+}
+
+async function refreshEvents() {
+  const type = $("type").value.trim();
+  try {
+    const events = await api("/v1/events" + (type ? "?type=" + encodeURIComponent(type) : ""));
+    const tbody = $("events");
+    tbody.replaceChildren();
+    for (const e of events) {
+      const payload = document.createElement("span");
+      payload.textContent = JSON.stringify(e.payload);
+      const tr = row(tbody, [e.id, e.type, new Date(e.received_at).toLocaleString(), payload], () => {
+        $("event").hidden = false;
+        $("event").textContent = JSON.stringify(e, null, 2);
+      });
+      tr.lastChild.className = "payload";
+    }
+    show($("recent"));
+  } catch (err) {
+    show($("recent"), err);
+  }
+}
+
+async function refreshAdmin() {
+  try {
+    const o = await api("/admin/overview");
+    actions = o.ui_actions;
+    for (const el of document.querySelectorAll(".actions")) el.hidden = !actions;
+    $("live").textContent = o.live_subscribers + " live subscription(s) (GraphQL)";
+    const consumers = $("consumers");
+    consumers.replaceChildren();
+    for (const c of o.consumers) row(consumers, [c.name, (c.types || ["*"]).join(", "), c.offset, c.pending]);
+    if (!o.consumers.length) row(consumers, ["no pull consumers"]);
+    const sinks = $("sinks");
+    sinks.replaceChildren();
+    for (const [name, c] of Object.entries(o.outbox)) row(sinks, [name, c.pending, c.dead]);
+    if (!o.outbox_enabled) row(sinks, ["the outbox is disabled: sinks keep no dead letters"]);
+    $("generation").textContent = "generation " + o.config_generation + ", up since " + new Date(o.started_at).toLocaleString();
+
+    const dead = $("dead");
+    const checked = new Set([...dead.querySelectorAll("input:checked")].map((c) => c.value));
+    dead.replaceChildren();
+    for (const d of await api("/admin/outbox/dead?limit=100")) {
+      const box = document.createElement("input");
+      box.type = "checkbox";
+      box.value = d.sink + "\n" + d.event.id;
+      box.checked = checked.has(box.value);
+      box.disabled = !actions;
+      row(dead, [box, d.sink, d.event.id, d.event.type, d.attempts, d.last_error || ""]);
+    }
+    $("settings").textContent = JSON.stringify(await api("/admin/config"), null, 2);
+    for (const id of ["subscriptions", "outbox", "config"]) show($(id));
+  } catch (err) {
+    for (const id of ["subscriptions", "outbox", "config"]) show($(id), err);
+  }
+}
+
+// deadLetters retries or discards the checked dead letters, one request
+// per sink.
+async function deadLetters(action) {
+  const bySink = new Map();
+  for (const box of $("dead").querySelectorAll("input:checked")) {
+    const [sink, id] = box.value.split("\n");
+    bySink.set(sink, [...(bySink.get(sink) || []), Number(id)]);
+  }
+  if (!bySink.size || (action === "discard" && !confirm("Discard the selected deliveries for good?"))) return;
+  try {
+    for (const [sink, ids] of bySink) {
+      await api("/admin/outbox/dead/" + action, { method: "POST", body: JSON.stringify({ sink, ids }) });
+    }
+  } catch (err) {
+    alert(err.message);
+  }
+  refreshAdmin();
+}
+
+async function refresh() {
+  await Promise.all([refreshThroughput(), refreshEvents(), refreshAdmin()]);
+  $("status").textContent = "updated " + new Date().toLocaleTimeString();
+}
+
+$("login").addEventListener("submit", (ev) => {
+  ev.preventDefault();
+  key = $("key").value;
+  $("key").value = "";
+  sessionStorage.setItem("ingest-key", key);
+  refresh();
+});
+$("filter").addEventListener("submit", (ev) => {
+  ev.preventDefault();
+  refreshEvents();
+});
+$("retry").addEventListener("click", () => deadLetters("retry"));
+$("discard").addEventListener("click", () => deadLetters("discard"));
+$("reload").addEventListener("click", async () => {
+  try {
+    const r = await api("/admin/reload", { method: "POST" });
+    alert("Configuration generation " + r.generation + " in effect.");
+  } catch (err) {
+    alert(err.message);
+  }
+  refreshAdmin();
+});
+
+refresh();
+setInterval(refresh, refreshEvery);
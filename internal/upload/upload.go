@@ -0,0 +1,369 @@
+// Package upload takes payloads too big for a request through object
+// storage: the producer is given a presigned URL to PUT the payload to, and
+// finalizing the upload stores its event with a reference to the object as
+// the payload, which readers may ask to have resolved.
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+	"github.com/rafaelosorio/go-ingest-service/internal/s3"
+)
+
+var (
+	// ErrNotFound is returned for an upload that does not exist, or that
+	// another caller asked for.
+	ErrNotFound = errors.New("upload not found")
+	// ErrExpired is returned when finalizing an upload too late.
+	ErrExpired = errors.New("upload expired")
+	// ErrIncomplete is returned when finalizing an upload whose payload was
+	// not uploaded yet.
+	ErrIncomplete = errors.New("payload not uploaded yet")
+	// ErrInvalid is returned for an upload asked for with a bad size, or
+	// whose payload is not the single JSON value of the size announced.
+	ErrInvalid = errors.New("invalid upload")
+	// ErrTooLarge is returned for a payload over uploads.max_bytes.
+	ErrTooLarge = errors.New("payload too large")
+	// ErrInFlight is returned when the upload is being finalized already.
+	ErrInFlight = errors.New("upload is being finalized")
+	// ErrChanged is returned when resolving a reference whose object was
+	// overwritten after its event was stored.
+	ErrChanged = errors.New("uploaded payload changed since it was finalized")
+)
+
+var uploadsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{Name: "uploads_total", Help: "Payload uploads by result (issued, finalized, expired, incomplete, invalid)"},
+	[]string{"result"},
+)
+
+// Collectors returns the upload metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{uploadsTotal}
+}
+
+// contentType is the only one payloads are uploaded with.
+const contentType = "application/json"
+
+// Ticket is what a producer needs to upload a payload: a request to send
+// before ExpiresAt, carrying the headers given, then the upload to finalize.
+type Ticket struct {
+	ID        string            `json:"upload_id"`
+	Status    string            `json:"status"`
+	Method    string            `json:"method"`
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// pending is the record of an upload, kept as an object next to its
+// payload so that any instance can finalize it.
+type pending struct {
+	Subject string      `json:"subject,omitempty"`
+	Event   event.Event `json:"event"`
+	Bytes   int64       `json:"bytes"`
+	// ExpiresAt is when the URL expires; the upload can be finalized for
+	// as long again after it.
+	ExpiresAt time.Time `json:"expires_at"`
+	// EventID is set once the upload is finalized, so finalizing it again
+	// answers with the same event.
+	EventID int64 `json:"event_id,omitempty"`
+}
+
+// Ref is the payload of an event finalized from an upload.
+type Ref struct {
+	// Object is the s3://bucket/key URL of the payload.
+	Object string `json:"$object"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// Uploads issues and finalizes the uploads of one bucket.
+type Uploads struct {
+	cfg config.UploadsConfig
+	s3  *s3.Client
+
+	mu sync.Mutex
+	// finalizing holds the uploads being finalized by this instance
+	finalizing map[string]struct{}
+}
+
+// New returns the uploads of cfg's bucket.
+func New(cfg config.UploadsConfig) *Uploads {
+	return &Uploads{cfg: cfg, s3: s3.New(cfg.S3), finalizing: map[string]struct{}{}}
+}
+
+// Begin records a pending upload of a payload of size bytes for e, which
+// is stored once the upload is finalized by subject, and returns the URL
+// to upload it to.
+func (u *Uploads) Begin(ctx context.Context, subject string, e event.Event, size int64) (Ticket, error) {
+	if size <= 0 {
+		return Ticket{}, fmt.Errorf("%w: bytes must be positive", ErrInvalid)
+	}
+	if size > u.cfg.MaxBytes {
+		return Ticket{}, fmt.Errorf("%w: %d bytes, the limit is %d", ErrTooLarge, size, u.cfg.MaxBytes)
+	}
+	now := time.Now().UTC()
+	id := newID()
+	e.Payload = nil
+	p := pending{Subject: subject, Event: e, Bytes: size, ExpiresAt: now.Add(u.cfg.URLTTL).Truncate(time.Second)}
+	if err := u.save(ctx, id, p); err != nil {
+		return Ticket{}, err
+	}
+	headers := http.Header{"Content-Type": {contentType}, "Content-Length": {strconv.FormatInt(size, 10)}}
+	url, err := u.s3.Presign(http.MethodPut, u.cfg.S3.Bucket, u.key(id), headers, u.cfg.URLTTL, now)
+	if err != nil {
+		return Ticket{}, err
+	}
+	uploadsTotal.WithLabelValues("issued").Inc()
+	return Ticket{
+		ID:        id,
+		Status:    "pending",
+		Method:    http.MethodPut,
+		URL:       url,
+		Headers:   map[string]string{"Content-Type": contentType, "Content-Length": strconv.FormatInt(size, 10)},
+		ExpiresAt: p.ExpiresAt,
+	}, nil
+}
+
+// Finalize checks that the payload of upload id was uploaded as announced
+// and stores its event through store, with a Ref to the payload of size
+// bytes, returning the event's ID. An upload finalized already returns its event's ID
+// again, with created false.
+func (u *Uploads) Finalize(ctx context.Context, id, subject string, store func(e event.Event, size int64) (int64, error)) (eventID int64, created bool, err error) {
+	if !validID(id) {
+		return 0, false, ErrNotFound
+	}
+	u.mu.Lock()
+	if _, ok := u.finalizing[id]; ok {
+		u.mu.Unlock()
+		return 0, false, ErrInFlight
+	}
+	u.finalizing[id] = struct{}{}
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		delete(u.finalizing, id)
+		u.mu.Unlock()
+	}()
+
+	p, err := u.load(ctx, id)
+	if err != nil {
+		return 0, false, err
+	}
+	if p.Subject != subject {
+		return 0, false, ErrNotFound
+	}
+	if p.EventID != 0 {
+		return p.EventID, false, nil
+	}
+	if time.Now().After(p.ExpiresAt.Add(u.cfg.URLTTL)) {
+		uploadsTotal.WithLabelValues("expired").Inc()
+		return 0, false, ErrExpired
+	}
+	ref, err := u.check(ctx, id, p.Bytes)
+	if err != nil {
+		return 0, false, err
+	}
+	e := p.Event
+	if e.Payload, err = json.Marshal(ref); err != nil {
+		return 0, false, err
+	}
+	if p.EventID, err = store(e, p.Bytes); err != nil {
+		return 0, false, err
+	}
+	uploadsTotal.WithLabelValues("finalized").Inc()
+	// the event is stored: failing to record it only lets a retry store it
+	// twice, which the client is not to be told as a failure; an event
+	// sampled out has no ID to record
+	if p.EventID == 0 {
+		return 0, true, nil
+	}
+	if err := u.save(ctx, id, p); err != nil {
+		log.Error().Err(err).Str("upload", id).Int64("event_id", p.EventID).Msg("record finalized upload")
+	}
+	return p.EventID, true, nil
+}
+
+// check reads the payload of upload id, which must be a single JSON value
+// of size bytes, and returns the reference to it.
+func (u *Uploads) check(ctx context.Context, id string, size int64) (Ref, error) {
+	body, err := u.s3.Open(ctx, u.cfg.S3.Bucket, u.key(id))
+	if errors.Is(err, s3.ErrNotFound) {
+		uploadsTotal.WithLabelValues("incomplete").Inc()
+		return Ref{}, ErrIncomplete
+	}
+	if err != nil {
+		return Ref{}, err
+	}
+	defer body.Close()
+	h := sha256.New()
+	n := &counter{}
+	err = checkJSON(io.TeeReader(io.LimitReader(body, size+1), io.MultiWriter(h, n)))
+	if ctx.Err() != nil {
+		return Ref{}, ctx.Err()
+	}
+	switch {
+	case err != nil:
+		err = fmt.Errorf("%w: the payload uploaded is not a JSON value: %v", ErrInvalid, err)
+	case n.n != size:
+		err = fmt.Errorf("%w: the payload uploaded is not %d bytes", ErrInvalid, size)
+	}
+	if err != nil {
+		uploadsTotal.WithLabelValues("invalid").Inc()
+		return Ref{}, err
+	}
+	return Ref{Object: "s3://" + u.cfg.S3.Bucket + "/" + u.key(id), Bytes: size, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// Resolve returns the payload payload refers to, when it is a Ref to an
+// upload of this bucket.
+func (u *Uploads) Resolve(ctx context.Context, payload json.RawMessage) (json.RawMessage, bool, error) {
+	ref, key, ok := u.parse(payload)
+	if !ok {
+		return nil, false, nil
+	}
+	body, err := u.s3.Open(ctx, u.cfg.S3.Bucket, key)
+	if errors.Is(err, s3.ErrNotFound) {
+		return nil, true, ErrChanged
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	defer body.Close()
+	b, err := io.ReadAll(io.LimitReader(body, ref.Bytes+1))
+	if err != nil {
+		return nil, true, err
+	}
+	if sum := sha256.Sum256(b); hex.EncodeToString(sum[:]) != ref.SHA256 {
+		return nil, true, ErrChanged
+	}
+	return b, true, nil
+}
+
+// URL returns a presigned URL to download the payload payload refers to,
+// valid for uploads.url_ttl, when it is a Ref to an upload of this bucket.
+func (u *Uploads) URL(payload json.RawMessage) (string, bool, error) {
+	_, key, ok := u.parse(payload)
+	if !ok {
+		return "", false, nil
+	}
+	url, err := u.s3.Presign(http.MethodGet, u.cfg.S3.Bucket, key, nil, u.cfg.URLTTL, time.Now())
+	return url, true, err
+}
+
+// parse reads payload as a Ref, returning the key of its object. Only
+// uploads of this bucket are references: events may carry anything else
+// that looks like one.
+func (u *Uploads) parse(payload json.RawMessage) (Ref, string, bool) {
+	if !bytes.Contains(payload, []byte(`"$object"`)) {
+		return Ref{}, "", false
+	}
+	var ref Ref
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&ref); err != nil {
+		return Ref{}, "", false
+	}
+	key, ok := strings.CutPrefix(ref.Object, "s3://"+u.cfg.S3.Bucket+"/"+u.cfg.S3.Prefix)
+	if !ok || !validID(key) {
+		return Ref{}, "", false
+	}
+	return ref, u.key(key), true
+}
+
+func (u *Uploads) key(id string) string {
+	return u.cfg.S3.Prefix + id
+}
+
+func (u *Uploads) recordKey(id string) string {
+	return u.cfg.S3.Prefix + id + ".upload.json"
+}
+
+func (u *Uploads) save(ctx context.Context, id string, p pending) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return u.s3.Put(ctx, u.cfg.S3.Bucket, u.recordKey(id), contentType, bytes.NewReader(b))
+}
+
+func (u *Uploads) load(ctx context.Context, id string) (pending, error) {
+	var p pending
+	body, err := u.s3.Open(ctx, u.cfg.S3.Bucket, u.recordKey(id))
+	if errors.Is(err, s3.ErrNotFound) {
+		return p, ErrNotFound
+	}
+	if err != nil {
+		return p, err
+	}
+	defer body.Close()
+	return p, json.NewDecoder(body).Decode(&p)
+}
+
+// checkJSON reads a single JSON value from r without holding it in
+// memory.
+func checkJSON(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for depth := 0; ; {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			break
+		}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("more than one value")
+	}
+	return nil
+}
+
+// counter counts the bytes written to it.
+type counter struct{ n int64 }
+
+func (c *counter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return "upl_" + hex.EncodeToString(b)
+}
+
+// validID reports whether id is one newID could have made, so that no
+// other object of the bucket is taken for an upload.
+func validID(id string) bool {
+	rest, ok := strings.CutPrefix(id, "upl_")
+	if !ok || len(rest) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(rest)
+	return err == nil && strings.ToLower(rest) == rest
+}
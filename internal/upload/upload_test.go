@@ -0,0 +1,160 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/config"
+	"github.com/rafaelosorio/go-ingest-service/internal/event"
+)
+
+// bucket is an S3-compatible store holding objects in memory, checking
+// that uploads carry the headers their URL was signed with.
+type bucket struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (b *bucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		if signed := r.URL.Query().Get("X-Amz-SignedHeaders"); signed != "" && signed != "content-length;content-type;host" {
+			http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		b.objects[r.URL.Path] = body
+	case http.MethodGet:
+		body, ok := b.objects[r.URL.Path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	}
+}
+
+func (b *bucket) overwrite(path string, body []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[path] = body
+}
+
+// TestUpload begins, uploads, finalizes and resolves a payload.
+func TestUpload(t *testing.T) {
+	b := &bucket{objects: map[string][]byte{}}
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+	u := New(config.UploadsConfig{
+		Enabled:  true,
+		S3:       config.S3Config{Bucket: "uploads", Prefix: "big/", Region: "us-east-1", Endpoint: srv.URL},
+		URLTTL:   time.Minute,
+		MaxBytes: 1 << 20,
+	})
+	ctx := context.Background()
+	payload := []byte(`{"rows":[1,2,3],"note":"large"}`)
+
+	if _, err := u.Begin(ctx, "w", event.Event{Type: "report"}, 2<<20); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("begin over max_bytes: %v", err)
+	}
+	ticket, err := u.Begin(ctx, "w", event.Event{Type: "report", Payload: json.RawMessage(`{}`)}, int64(len(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := []event.Event{}
+	store := func(e event.Event, _ int64) (int64, error) {
+		stored = append(stored, e)
+		return int64(len(stored)), nil
+	}
+	if _, _, err := u.Finalize(ctx, ticket.ID, "w", store); !errors.Is(err, ErrIncomplete) {
+		t.Fatalf("finalize before the upload: %v", err)
+	}
+
+	req, err := http.NewRequest(ticket.Method, ticket.URL, bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range ticket.Headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("upload: %s", res.Status)
+	}
+
+	if _, _, err := u.Finalize(ctx, ticket.ID, "someone-else", store); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("finalize by another caller: %v", err)
+	}
+	id, created, err := u.Finalize(ctx, ticket.ID, "w", store)
+	if err != nil || !created || id != 1 {
+		t.Fatalf("finalize: %d, %v, %v", id, created, err)
+	}
+	if id, created, err := u.Finalize(ctx, ticket.ID, "w", store); err != nil || created || id != 1 || len(stored) != 1 {
+		t.Fatalf("finalize again: %d, %v, %v, %d stored", id, created, err, len(stored))
+	}
+	e := stored[0]
+	if e.Type != "report" || !strings.Contains(string(e.Payload), `"$object":"s3://uploads/big/`+ticket.ID+`"`) {
+		t.Fatalf("stored %s %s", e.Type, e.Payload)
+	}
+
+	got, ok, err := u.Resolve(ctx, e.Payload)
+	if err != nil || !ok || !bytes.Equal(got, payload) {
+		t.Fatalf("resolve: %s, %v, %v", got, ok, err)
+	}
+	if link, ok, err := u.URL(e.Payload); err != nil || !ok || !strings.HasPrefix(link, srv.URL+"/uploads/big/"+ticket.ID+"?") {
+		t.Fatalf("url: %s, %v, %v", link, ok, err)
+	}
+	// a payload that merely looks like a reference is left alone
+	other := json.RawMessage(`{"$object":"s3://elsewhere/big/` + ticket.ID + `","bytes":1,"sha256":""}`)
+	if _, ok, _ := u.Resolve(ctx, other); ok {
+		t.Error("resolved a reference to another bucket")
+	}
+	b.overwrite("/uploads/big/"+ticket.ID, []byte(`{"rows":[]}`))
+	if _, _, err := u.Resolve(ctx, e.Payload); !errors.Is(err, ErrChanged) {
+		t.Errorf("resolve an overwritten payload: %v", err)
+	}
+}
+
+// TestFinalizeInvalid refuses payloads that are not the JSON value
+// announced.
+func TestFinalizeInvalid(t *testing.T) {
+	b := &bucket{objects: map[string][]byte{}}
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+	u := New(config.UploadsConfig{
+		S3:       config.S3Config{Bucket: "uploads", Region: "us-east-1", Endpoint: srv.URL},
+		URLTTL:   time.Minute,
+		MaxBytes: 1 << 20,
+	})
+	ctx := context.Background()
+	for _, body := range []string{`{"a":1`, `{"a":1} {"b":2}`, `{"a":1}   `, `nope`} {
+		ticket, err := u.Begin(ctx, "", event.Event{Type: "report"}, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		target, _ := url.Parse(ticket.URL)
+		b.overwrite(target.Path, []byte(body))
+		if _, _, err := u.Finalize(ctx, ticket.ID, "", func(event.Event, int64) (int64, error) { return 1, nil }); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%q: %v", body, err)
+		}
+	}
+	if _, _, err := u.Finalize(ctx, "../../secrets", "", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("finalize a made-up ID: %v", err)
+	}
+}
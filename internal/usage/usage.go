@@ -0,0 +1,187 @@
+// Package usage accounts what each caller ingests, per hour and tenant:
+// events accepted, their payload bytes and the events refused. Counts are
+// kept in memory and added to the store every flush interval, so billing
+// and the search for runaway producers do not cost a write per event.
+package usage
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+var flushErrors = prometheus.NewCounter(
+	prometheus.CounterOpts{Name: "usage_flush_errors_total", Help: "Usage flushes that could not be stored and were retried"},
+)
+
+// Collectors returns the usage metrics for registration by the caller.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{flushErrors}
+}
+
+// ErrInvalid is returned for reports that cannot be built.
+var ErrInvalid = errors.New("invalid usage report")
+
+// Meter counts usage and adds it to the store.
+type Meter struct {
+	store storage.Store
+
+	mu      sync.Mutex
+	pending map[counter]*storage.Usage
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type counter struct {
+	hour        time.Time
+	key, tenant string
+}
+
+// New starts a Meter adding its counts to store every interval.
+func New(store storage.Store, interval time.Duration) *Meter {
+	m := &Meter{
+		store:   store,
+		pending: map[counter]*storage.Usage{},
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go m.run(interval)
+	return m
+}
+
+// Close stores what is still pending.
+func (m *Meter) Close() {
+	close(m.done)
+	<-m.stopped
+}
+
+// Accept counts an event of size payload bytes that key ingested into
+// tenant's namespace ("" for none).
+func (m *Meter) Accept(key, tenant string, size int) {
+	m.add(key, tenant, func(u *storage.Usage) {
+		u.Events++
+		u.Bytes += int64(size)
+	})
+}
+
+// Reject counts n events of key that were refused.
+func (m *Meter) Reject(key, tenant string, n int) {
+	m.add(key, tenant, func(u *storage.Usage) { u.Rejected += int64(n) })
+}
+
+func (m *Meter) add(key, tenant string, f func(*storage.Usage)) {
+	c := counter{time.Now().UTC().Truncate(time.Hour), key, tenant}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.pending[c]
+	if u == nil {
+		u = &storage.Usage{Hour: c.hour, Key: key, Tenant: tenant}
+		m.pending[c] = u
+	}
+	f(u)
+}
+
+func (m *Meter) run(interval time.Duration) {
+	defer close(m.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			if err := m.Flush(); err != nil {
+				log.Error().Err(err).Msg("usage: final flush")
+			}
+			return
+		case <-ticker.C:
+			if err := m.Flush(); err != nil {
+				log.Warn().Err(err).Msg("usage: flush")
+			}
+		}
+	}
+}
+
+// Flush adds the pending counts to the store. Counts that fail to be
+// stored are kept for the next flush.
+func (m *Meter) Flush() error {
+	m.mu.Lock()
+	taken := m.pending
+	m.pending = map[counter]*storage.Usage{}
+	m.mu.Unlock()
+	if len(taken) == 0 {
+		return nil
+	}
+	us := make([]storage.Usage, 0, len(taken))
+	for _, u := range taken {
+		us = append(us, *u)
+	}
+	err := m.store.AddUsage(context.Background(), us)
+	if err == nil {
+		return nil
+	}
+	flushErrors.Inc()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for c, u := range taken {
+		if cur := m.pending[c]; cur != nil {
+			cur.Events += u.Events
+			cur.Bytes += u.Bytes
+			cur.Rejected += u.Rejected
+		} else {
+			m.pending[c] = u
+		}
+	}
+	return err
+}
+
+// Report returns the usage matching q, including what is still pending,
+// per "hour" or per "day" (UTC), oldest first.
+func (m *Meter) Report(ctx context.Context, q storage.UsageQuery, granularity string) ([]storage.Usage, error) {
+	var width time.Duration
+	switch granularity {
+	case "", "hour":
+		width = time.Hour
+	case "day":
+		width = 24 * time.Hour
+	default:
+		return nil, fmt.Errorf("%w: granularity: want hour or day", ErrInvalid)
+	}
+	if err := q.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if err := m.Flush(); err != nil {
+		return nil, err
+	}
+	list, err := m.store.Usage(ctx, q)
+	if err != nil || width == time.Hour {
+		return list, err
+	}
+	out := []storage.Usage{}
+	index := map[counter]int{}
+	for _, u := range list {
+		c := counter{u.Hour.Truncate(width), u.Key, u.Tenant}
+		i, ok := index[c]
+		if !ok {
+			i = len(out)
+			index[c] = i
+			out = append(out, storage.Usage{Hour: c.hour, Key: u.Key, Tenant: u.Tenant})
+		}
+		out[i].Events += u.Events
+		out[i].Bytes += u.Bytes
+		out[i].Rejected += u.Rejected
+	}
+	slices.SortFunc(out, func(a, b storage.Usage) int {
+		return cmp.Or(a.Hour.Compare(b.Hour), strings.Compare(a.Tenant, b.Tenant), strings.Compare(a.Key, b.Key))
+	})
+	return out, nil
+}
@@ -0,0 +1,85 @@
+package usage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/storage"
+)
+
+// failing is a store whose usage writes fail while down is set.
+type failing struct {
+	storage.Store
+	down bool
+}
+
+func (f *failing) AddUsage(ctx context.Context, us []storage.Usage) error {
+	if f.down {
+		return errors.New("store down")
+	}
+	return f.Store.AddUsage(ctx, us)
+}
+
+// TestReport includes what is still pending and keeps the counts of a
+// failed flush for the next one.
+func TestReport(t *testing.T) {
+	store := &failing{Store: storage.NewMemory(1)}
+	m := New(store, time.Hour)
+	defer m.Close()
+
+	m.Accept("k1", "acme", 100)
+	m.Accept("k1", "acme", 50)
+	m.Reject("k1", "acme", 3)
+	m.Accept("k2", "", 10)
+	store.down = true
+	if err := m.Flush(); err == nil {
+		t.Fatal("flush to a failing store succeeded")
+	}
+	store.down = false
+	m.Accept("k1", "acme", 1)
+
+	list, err := m.Report(context.Background(), storage.UsageQuery{Key: "k1"}, "hour")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Events != 3 || list[0].Bytes != 151 || list[0].Rejected != 3 || list[0].Tenant != "acme" {
+		t.Fatalf("report: %+v", list)
+	}
+	// flushed once, not again on the next report
+	if list, _ := m.Report(context.Background(), storage.UsageQuery{}, ""); len(list) != 2 || list[0].Events+list[1].Events != 4 {
+		t.Errorf("second report: %+v", list)
+	}
+}
+
+// TestDaily adds up the hours of each day, oldest first.
+func TestDaily(t *testing.T) {
+	store := storage.NewMemory(1)
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	err := store.AddUsage(context.Background(), []storage.Usage{
+		{Hour: day.Add(25 * time.Hour), Key: "k1", Events: 5},
+		{Hour: day.Add(time.Hour), Key: "k1", Events: 1, Bytes: 10},
+		{Hour: day.Add(23 * time.Hour), Key: "k1", Events: 2, Bytes: 20},
+		{Hour: day.Add(2 * time.Hour), Key: "k2", Events: 7},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := New(store, time.Hour)
+	defer m.Close()
+
+	list, err := m.Report(context.Background(), storage.UsageQuery{Key: "k1"}, "day")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || !list[0].Hour.Equal(day) || list[0].Events != 3 || list[0].Bytes != 30 || list[1].Events != 5 {
+		t.Errorf("daily: %+v", list)
+	}
+	if _, err := m.Report(context.Background(), storage.UsageQuery{}, "week"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("week: %v", err)
+	}
+	if _, err := m.Report(context.Background(), storage.UsageQuery{Since: day, Until: day}, "day"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("empty range: %v", err)
+	}
+}
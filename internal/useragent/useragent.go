@@ -0,0 +1,157 @@
+// Package useragent parses User-Agent headers into browser, operating
+// system and device class. It knows the common browsers, platforms and
+// bots, in the order their tokens must be checked; anything else is Other.
+package useragent
+
+import (
+	"strings"
+)
+
+// Device classes.
+const (
+	Desktop = "desktop"
+	Mobile  = "mobile"
+	Tablet  = "tablet"
+	Bot     = "bot"
+)
+
+// Other names a browser or OS the rules do not know.
+const Other = "Other"
+
+// Agent is a parsed User-Agent; versions are as the header has them, with
+// underscores turned into dots.
+type Agent struct {
+	Browser        string
+	BrowserVersion string
+	OS             string
+	OSVersion      string
+	Device         string
+}
+
+// bots are matched, case-insensitively, before anything else: tools and
+// crawlers often claim to be a browser too.
+var bots = []struct{ token, name string }{
+	{"googlebot", "Googlebot"},
+	{"bingbot", "Bingbot"},
+	{"curl/", "curl"},
+	{"wget/", "Wget"},
+	{"python-requests/", "python-requests"},
+	{"go-http-client/", "Go-http-client"},
+	{"bot", "Bot"},
+	{"crawler", "Bot"},
+	{"spider", "Bot"},
+}
+
+// browsers are checked in order: Edge and Opera also send Chrome/, Chrome
+// also sends Safari/.
+var browsers = []struct{ token, name string }{
+	{"Edg/", "Edge"},
+	{"EdgA/", "Edge"},
+	{"EdgiOS/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"MSIE ", "Internet Explorer"},
+}
+
+// windows maps Windows NT versions to release names.
+var windows = map[string]string{
+	"10.0": "10", "6.3": "8.1", "6.2": "8", "6.1": "7", "6.0": "Vista", "5.1": "XP",
+}
+
+// Parse parses ua; an empty header is an Other desktop.
+func Parse(ua string) Agent {
+	a := Agent{Browser: Other, OS: Other, Device: Desktop}
+	lower := strings.ToLower(ua)
+	for _, b := range bots {
+		if i := strings.Index(lower, b.token); i >= 0 {
+			a.Browser, a.Device = b.name, Bot
+			if strings.HasSuffix(b.token, "/") {
+				a.BrowserVersion = version(ua[i+len(b.token):])
+			}
+			break
+		}
+	}
+	if a.Device != Bot {
+		a.Browser, a.BrowserVersion = browser(ua)
+	}
+	a.OS, a.OSVersion = system(ua)
+	if a.Device == Bot {
+		return a
+	}
+	switch {
+	case strings.Contains(ua, "iPad"), strings.Contains(ua, "Tablet"),
+		strings.Contains(ua, "Android") && !strings.Contains(ua, "Mobile"):
+		a.Device = Tablet
+	case strings.Contains(ua, "Mobile"), strings.Contains(ua, "iPhone"):
+		a.Device = Mobile
+	}
+	return a
+}
+
+func browser(ua string) (string, string) {
+	for _, b := range browsers {
+		if i := strings.Index(ua, b.token); i >= 0 {
+			return b.name, version(ua[i+len(b.token):])
+		}
+	}
+	if i := strings.Index(ua, "Trident/"); i >= 0 {
+		if j := strings.Index(ua, "rv:"); j >= 0 {
+			return "Internet Explorer", version(ua[j+3:])
+		}
+		return "Internet Explorer", ""
+	}
+	if strings.Contains(ua, "Safari/") {
+		if i := strings.Index(ua, "Version/"); i >= 0 {
+			return "Safari", version(ua[i+len("Version/"):])
+		}
+		return "Safari", ""
+	}
+	return Other, ""
+}
+
+func system(ua string) (string, string) {
+	switch {
+	case strings.Contains(ua, "Windows NT "):
+		v := version(ua[strings.Index(ua, "Windows NT ")+len("Windows NT "):])
+		if name, ok := windows[v]; ok {
+			v = name
+		}
+		return "Windows", v
+	case strings.Contains(ua, "iPhone OS "):
+		return "iOS", version(ua[strings.Index(ua, "iPhone OS ")+len("iPhone OS "):])
+	case strings.Contains(ua, "iPad"):
+		if i := strings.Index(ua, "CPU OS "); i >= 0 {
+			return "iPadOS", version(ua[i+len("CPU OS "):])
+		}
+		return "iPadOS", ""
+	case strings.Contains(ua, "Android"):
+		if i := strings.Index(ua, "Android "); i >= 0 {
+			return "Android", version(ua[i+len("Android "):])
+		}
+		return "Android", ""
+	case strings.Contains(ua, "Mac OS X"):
+		if i := strings.Index(ua, "Mac OS X "); i >= 0 {
+			return "macOS", version(ua[i+len("Mac OS X "):])
+		}
+		return "macOS", ""
+	case strings.Contains(ua, "CrOS"):
+		return "ChromeOS", ""
+	case strings.Contains(ua, "Linux"):
+		return "Linux", ""
+	}
+	return Other, ""
+}
+
+// version reads the version at the start of s: digits, dots and
+// underscores, the latter turned into dots.
+func version(s string) string {
+	end := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' && r != '_' })
+	if end < 0 {
+		end = len(s)
+	}
+	return strings.Trim(strings.ReplaceAll(s[:end], "_", "."), ".")
+}
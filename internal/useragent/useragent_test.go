@@ -0,0 +1,33 @@
+package useragent
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		ua   string
+		want Agent
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			Agent{"Chrome", "124.0.0.0", "Windows", "10", Desktop}},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.2478.51",
+			Agent{"Edge", "124.0.2478.51", "Windows", "10", Desktop}},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15",
+			Agent{"Safari", "17.4", "macOS", "10.15.7", Desktop}},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/124.0.6367.88 Mobile/15E148 Safari/604.1",
+			Agent{"Chrome", "124.0.6367.88", "iOS", "17.4", Mobile}},
+		{"Mozilla/5.0 (iPad; CPU OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.6 Mobile/15E148 Safari/604.1",
+			Agent{"Safari", "16.6", "iPadOS", "16.6", Tablet}},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.6367.82 Mobile Safari/537.36",
+			Agent{"Chrome", "124.0.6367.82", "Android", "14", Mobile}},
+		{"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0",
+			Agent{"Firefox", "125.0", "Linux", "", Desktop}},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			Agent{"Googlebot", "", Other, "", Bot}},
+		{"curl/8.5.0", Agent{"curl", "8.5.0", Other, "", Bot}},
+		{"", Agent{Other, "", Other, "", Desktop}},
+	} {
+		if got := Parse(tc.ua); got != tc.want {
+			t.Errorf("%q:\n got %+v\nwant %+v", tc.ua, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// server is a service endpoint answering each request with the next of its
+// statuses, then 200, and recording the idempotency keys it was sent.
+type server struct {
+	*httptest.Server
+	calls    atomic.Int32
+	statuses []int
+	// delay, when set, holds every answer back until it passes or the
+	// request is canceled, which closes canceled.
+	delay    atomic.Int64
+	canceled chan struct{}
+
+	mu   sync.Mutex
+	keys []string
+}
+
+func newServer(t *testing.T, statuses ...int) *server {
+	s := &server{statuses: statuses, canceled: make(chan struct{})}
+	var once sync.Once
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(s.calls.Add(1))
+		s.mu.Lock()
+		s.keys = append(s.keys, r.Header.Get("Idempotency-Key"))
+		s.mu.Unlock()
+		if d := time.Duration(s.delay.Load()); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-r.Context().Done():
+				once.Do(func() { close(s.canceled) })
+				return
+			}
+		}
+		if n <= len(s.statuses) && s.statuses[n-1] != http.StatusOK {
+			w.WriteHeader(s.statuses[n-1])
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPost {
+			_, _ = w.Write([]byte(`{"id":1,"type":"t","payload":{}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`[{"id":1,"type":"t","payload":{}}]`))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *server) lastKey() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys[len(s.keys)-1]
+}
+
+// TestHedge sends a read on to the next endpoint once the first is slower
+// than the hedge delay, takes the faster answer and cancels the slow
+// request; writes are not hedged unless enabled.
+func TestHedge(t *testing.T) {
+	slow, fast := newServer(t), newServer(t)
+	slow.delay.Store(int64(5 * time.Second))
+	c, err := New([]string{slow.URL, fast.URL}, WithHedgeDelay(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	events, err := c.ListEvents(context.Background(), ListOptions{})
+	if err != nil || len(events) != 1 {
+		t.Fatalf("list: %v, %v", events, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("hedged read took %v", d)
+	}
+	select {
+	case <-slow.canceled:
+	case <-time.After(time.Second):
+		t.Error("slow request not canceled")
+	}
+
+	slow.delay.Store(int64(100 * time.Millisecond))
+	slow.calls.Store(0)
+	fast.calls.Store(0)
+	if _, err := c.SendEvent(context.Background(), Event{Type: "t"}); err != nil {
+		t.Fatal(err)
+	}
+	if slow.calls.Load() != 1 || fast.calls.Load() != 0 {
+		t.Errorf("write hedged: %d and %d calls", slow.calls.Load(), fast.calls.Load())
+	}
+
+	hedging, _ := New([]string{slow.URL, fast.URL}, WithHedgeDelay(20*time.Millisecond), WithHedgeWrites(true))
+	if _, err := hedging.SendEvent(context.Background(), Event{Type: "t"}); err != nil {
+		t.Fatal(err)
+	}
+	if fast.calls.Load() != 1 {
+		t.Error("write not hedged with WithHedgeWrites")
+	}
+	if slow.lastKey() != fast.lastKey() {
+		t.Errorf("hedged write keys %q and %q", slow.lastKey(), fast.lastKey())
+	}
+}
+
+// TestRetry retries throttling and server errors under one idempotency
+// key, but not client errors, and gives up once the attempts are used.
+func TestRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		statuses []int
+		calls    int32
+		status   int
+	}{
+		{"server error", []int{500, 503}, 3, 0},
+		{"throttled", []int{429}, 2, 0},
+		{"client error", []int{400}, 1, 400},
+		{"attempts used", []int{500, 502, 503, 200}, 3, 503},
+	} {
+		s := newServer(t, tc.statuses...)
+		c, err := New([]string{s.URL}, WithRetry(3, time.Millisecond, 5*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.SendEvent(context.Background(), Event{Type: "t"})
+		var apiErr *APIError
+		switch {
+		case tc.status == 0 && err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case tc.status != 0 && (!errors.As(err, &apiErr) || apiErr.StatusCode != tc.status):
+			t.Errorf("%s: got %v, want status %d", tc.name, err, tc.status)
+		}
+		if got := s.calls.Load(); got != tc.calls {
+			t.Errorf("%s: %d calls, want %d", tc.name, got, tc.calls)
+		}
+		for _, k := range s.keys {
+			if k == "" || k != s.keys[0] {
+				t.Errorf("%s: keys %q", tc.name, s.keys)
+				break
+			}
+		}
+	}
+
+	// a canceled context stops the retries
+	s := newServer(t, 500, 500, 500)
+	c, _ := New([]string{s.URL}, WithRetry(3, time.Second, time.Second))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.SendEvent(ctx, Event{Type: "t"}); err == nil {
+		t.Error("canceled retries succeeded")
+	}
+	if got := s.calls.Load(); got != 1 {
+		t.Errorf("%d calls after cancellation", got)
+	}
+}
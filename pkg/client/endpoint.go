@@ -0,0 +1,53 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// endpoint tracks the health of one base URL.
+type endpoint struct {
+	base string
+
+	mu             sync.Mutex
+	failures       int
+	unhealthyUntil time.Time
+}
+
+func (e *endpoint) healthy(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !now.Before(e.unhealthyUntil)
+}
+
+func (e *endpoint) success() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures = 0
+	e.unhealthyUntil = time.Time{}
+}
+
+func (e *endpoint) failure(max int, cooldown time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures++
+	if max > 0 && e.failures >= max {
+		e.unhealthyUntil = time.Now().Add(cooldown)
+	}
+}
+
+// order returns healthy endpoints in preference order followed by the
+// unhealthy ones, which are only used once everything else has failed.
+func (c *Client) order() []*endpoint {
+	now := time.Now()
+	out := make([]*endpoint, 0, len(c.endpoints))
+	var down []*endpoint
+	for _, e := range c.endpoints {
+		if e.healthy(now) {
+			out = append(out, e)
+		} else {
+			down = append(down, e)
+		}
+	}
+	return append(out, down...)
+}
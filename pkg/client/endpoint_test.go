@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// list reads through c, failing t unless it succeeds exactly when ok.
+func list(t *testing.T, c *Client, ok bool) {
+	t.Helper()
+	_, err := c.ListEvents(context.Background(), ListOptions{})
+	if ok && err != nil {
+		t.Fatal(err)
+	}
+	if !ok && err == nil {
+		t.Fatal("read succeeded")
+	}
+}
+
+func calls(servers ...*server) []int32 {
+	var out []int32
+	for _, s := range servers {
+		out = append(out, s.calls.Load())
+	}
+	return out
+}
+
+// TestEndpointHealth fails over to the next endpoint, stops trying one
+// marked down until its cooldown passes, and prefers it again once it
+// answers.
+func TestEndpointHealth(t *testing.T) {
+	primary, secondary := newServer(t, 503, 503), newServer(t)
+	c, err := New([]string{primary.URL, secondary.URL}, WithHedgeDelay(0), WithRetry(1, 0, 0), WithHealthTracking(2, 100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list(t, c, true)
+	list(t, c, true)
+	if got := calls(primary, secondary); got[0] != 2 || got[1] != 2 {
+		t.Fatalf("calls %v after failing over twice", got)
+	}
+
+	// primary is down: reads go to secondary alone
+	list(t, c, true)
+	if got := calls(primary, secondary); got[0] != 2 || got[1] != 3 {
+		t.Errorf("calls %v while primary is down", got)
+	}
+
+	// after the cooldown primary is tried first again, and answers
+	time.Sleep(150 * time.Millisecond)
+	list(t, c, true)
+	list(t, c, true)
+	if got := calls(primary, secondary); got[0] != 4 || got[1] != 3 {
+		t.Errorf("calls %v after primary recovered", got)
+	}
+}
+
+// TestAllEndpointsDown still tries every endpoint, in preference order,
+// when all of them are marked down, and returns the last error.
+func TestAllEndpointsDown(t *testing.T) {
+	primary, secondary := newServer(t, 503, 503, 503), newServer(t, 502, 502)
+	c, err := New([]string{primary.URL, secondary.URL}, WithHedgeDelay(0), WithRetry(1, 0, 0), WithHealthTracking(1, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list(t, c, false)
+	_, err = c.ListEvents(context.Background(), ListOptions{})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 502 {
+		t.Fatalf("got %v, want the last endpoint's 502", err)
+	}
+	if got := calls(primary, secondary); got[0] != 2 || got[1] != 2 {
+		t.Fatalf("calls %v with every endpoint down", got)
+	}
+
+	// secondary answers again and becomes the only healthy endpoint
+	list(t, c, true)
+	list(t, c, true)
+	if got := calls(primary, secondary); got[0] != 3 || got[1] != 4 {
+		t.Errorf("calls %v after secondary recovered", got)
+	}
+}
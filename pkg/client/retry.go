@@ -0,0 +1,72 @@
+package client
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+type retryPolicy struct {
+	attempts  int
+	base, max time.Duration
+}
+
+// retrying runs fn until it succeeds, fails permanently or the attempts are
+// used up, sleeping with full jitter in between.
+func (c *Client) retrying(ctx context.Context, fn func() error) error {
+	var err error
+	for n := 0; ; n++ {
+		if err = fn(); err == nil || !retryable(err) || n+1 >= c.retry.attempts {
+			return err
+		}
+		t := time.NewTimer(c.retry.backoff(n))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+func (p retryPolicy) backoff(n int) time.Duration {
+	d := p.max
+	if n < 30 && p.base<<n < p.max {
+		d = p.base << n
+	}
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d)
+}
+
+// retryable reports whether err may go away on its own: transport errors,
+// throttling and server errors, but not cancellation or 4xx.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500
+	}
+	return true
+}
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey makes writes using ctx send key instead of a generated
+// one, e.g. to carry a key derived from the producer's own message ID.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+func newIdempotencyKey() string {
+	var b [16]byte
+	_, _ = crand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// StreamOptions tunes a Stream; zero values use the defaults.
+type StreamOptions struct {
+	// BatchSize is the most events sent per request (default 100).
+	BatchSize int
+	// FlushInterval bounds how long an event waits for its batch (default 1s).
+	FlushInterval time.Duration
+	// Buffer is the number of events Send can queue before it blocks
+	// (default 10 * BatchSize).
+	Buffer int
+	// OnError is called with the events of a batch that could not be sent
+	// after retries. Without it, failures are only reported by Close.
+	OnError func(events []Event, err error)
+}
+
+// Stream sends events in the background, batching them into SendBatch calls.
+type Stream struct {
+	c       *Client
+	ctx     context.Context
+	opts    StreamOptions
+	ch      chan Event
+	flushCh chan chan struct{}
+	done    chan struct{}
+
+	mu      sync.Mutex
+	err     error
+	closed  bool
+	closeMu sync.RWMutex
+}
+
+// ErrStreamClosed is returned by Send after Close.
+var ErrStreamClosed = errors.New("client: stream closed")
+
+// Stream starts a batching sender bound to ctx; cancelling ctx drops
+// unsent events. Close must be called to flush and release it.
+func (c *Client) Stream(ctx context.Context, opts StreamOptions) *Stream {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+	if opts.Buffer <= 0 {
+		opts.Buffer = 10 * opts.BatchSize
+	}
+	s := &Stream{
+		c:       c,
+		ctx:     ctx,
+		opts:    opts,
+		ch:      make(chan Event, opts.Buffer),
+		flushCh: make(chan chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Send queues e, blocking while the buffer is full.
+func (s *Stream) Send(e Event) error {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if s.closed {
+		return ErrStreamClosed
+	}
+	select {
+	case s.ch <- e:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+// Flush sends everything queued so far and waits for it.
+func (s *Stream) Flush() {
+	ack := make(chan struct{})
+	select {
+	case s.flushCh <- ack:
+		<-ack
+	case <-s.done:
+	}
+}
+
+// Close flushes queued events, stops the stream and returns the last send
+// error, if any.
+func (s *Stream) Close() error {
+	s.closeMu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+	s.closeMu.Unlock()
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Stream) run() {
+	defer close(s.done)
+	batch := make([]Event, 0, s.opts.BatchSize)
+	t := time.NewTicker(s.opts.FlushInterval)
+	defer t.Stop()
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if _, err := s.c.SendBatch(s.ctx, batch); err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			if s.opts.OnError != nil {
+				s.opts.OnError(append([]Event(nil), batch...), err)
+			}
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case e, ok := <-s.ch:
+			if !ok {
+				send()
+				return
+			}
+			if batch = append(batch, e); len(batch) >= s.opts.BatchSize {
+				send()
+			}
+		case ack := <-s.flushCh:
+			for n := len(s.ch); n > 0; n-- {
+				if batch = append(batch, <-s.ch); len(batch) >= s.opts.BatchSize {
+					send()
+				}
+			}
+			send()
+			close(ack)
+		case <-t.C:
+			send()
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Package plugin serves sinks and pipeline processors as separate processes
+// the service starts and talks to over gRPC (hashicorp/go-plugin), so a
+// crashing or hanging plugin cannot take down ingestion.
+//
+// A Go plugin is a main package calling Serve:
+//
+//	func main() {
+//		plugin.Serve(plugin.Plugins{Sink: mySink{}})
+//	}
+//
+// Plugins in other languages implement the services of api/plugin.proto and
+// the go-plugin handshake: exit unless the environment variable
+// INGEST_PLUGIN is "ingest-v1", then print
+// "1|1|tcp|127.0.0.1:<port>|grpc" (or a unix socket) on stdout and serve
+// the plugin services and grpc.health.v1 on that address.
+//
+// Events and records travel as JSON in the format of the HTTP API.
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	goplugin "github.com/hashicorp/go-plugin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Handshake is shared by the service and its plugins; a binary started
+// without the magic cookie is not a plugin of this service.
+var Handshake = goplugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "INGEST_PLUGIN",
+	MagicCookieValue: "ingest-v1",
+}
+
+// Names of the plugins a binary can serve.
+const (
+	SinkName      = "sink"
+	ProcessorName = "processor"
+)
+
+// Event mirrors the service's event representation.
+type Event struct {
+	ID         int64             `json:"id,omitzero"`
+	Type       string            `json:"type"`
+	Payload    json.RawMessage   `json:"payload"`
+	Tags       []string          `json:"tags,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	ReceivedAt time.Time         `json:"received_at,omitzero"`
+}
+
+// Sink delivers batches of records, the events in the format configured for
+// the sink (json by default). An error fails the batch like any other sink.
+type Sink interface {
+	Publish(ctx context.Context, records []json.RawMessage) error
+}
+
+// Processor is a pipeline step. It returns the event with its payload, tags
+// and metadata changed; changes to other fields are ignored. An error fails
+// the step, whose on_error decides the event's fate.
+type Processor interface {
+	Process(ctx context.Context, e Event) (Event, error)
+}
+
+// Plugins are the implementations a binary serves; either may be nil.
+type Plugins struct {
+	Sink      Sink
+	Processor Processor
+}
+
+// Serve serves p to the service that started the process and returns when
+// the service stops it.
+func Serve(p Plugins) {
+	set := goplugin.PluginSet{}
+	if p.Sink != nil {
+		set[SinkName] = &SinkPlugin{Impl: p.Sink}
+	}
+	if p.Processor != nil {
+		set[ProcessorName] = &ProcessorPlugin{Impl: p.Processor}
+	}
+	goplugin.Serve(&goplugin.ServeConfig{
+		HandshakeConfig: Handshake,
+		Plugins:         set,
+		GRPCServer:      goplugin.DefaultGRPCServer,
+	})
+}
+
+// PluginSet is what the service dispenses plugins from; Impl is only set on
+// the plugin side.
+func PluginSet() goplugin.PluginSet {
+	return goplugin.PluginSet{SinkName: &SinkPlugin{}, ProcessorName: &ProcessorPlugin{}}
+}
+
+// SinkPlugin adapts a Sink to go-plugin. Dispensing it yields a *SinkClient.
+type SinkPlugin struct {
+	goplugin.NetRPCUnsupportedPlugin
+	Impl Sink
+}
+
+func (p *SinkPlugin) GRPCServer(_ *goplugin.GRPCBroker, s *grpc.Server) error {
+	s.RegisterService(&sinkDesc, p.Impl)
+	return nil
+}
+
+func (p *SinkPlugin) GRPCClient(_ context.Context, _ *goplugin.GRPCBroker, cc *grpc.ClientConn) (any, error) {
+	return &SinkClient{cc: cc}, nil
+}
+
+// ProcessorPlugin adapts a Processor to go-plugin. Dispensing it yields a
+// *ProcessorClient.
+type ProcessorPlugin struct {
+	goplugin.NetRPCUnsupportedPlugin
+	Impl Processor
+}
+
+func (p *ProcessorPlugin) GRPCServer(_ *goplugin.GRPCBroker, s *grpc.Server) error {
+	s.RegisterService(&processorDesc, p.Impl)
+	return nil
+}
+
+func (p *ProcessorPlugin) GRPCClient(_ context.Context, _ *goplugin.GRPCBroker, cc *grpc.ClientConn) (any, error) {
+	return &ProcessorClient{cc: cc}, nil
+}
+
+// SinkClient calls a sink plugin with records already encoded as a JSON
+// array.
+type SinkClient struct{ cc *grpc.ClientConn }
+
+func (c *SinkClient) Publish(ctx context.Context, records []byte) error {
+	return c.cc.Invoke(ctx, "/ingest.plugin.v1.Sink/Publish", wrapperspb.Bytes(records), new(emptypb.Empty))
+}
+
+// ProcessorClient calls a processor plugin with a JSON event and returns the
+// JSON of the processed one.
+type ProcessorClient struct{ cc *grpc.ClientConn }
+
+func (c *ProcessorClient) Process(ctx context.Context, e []byte) ([]byte, error) {
+	out := new(wrapperspb.BytesValue)
+	if err := c.cc.Invoke(ctx, "/ingest.plugin.v1.Processor/Process", wrapperspb.Bytes(e), out); err != nil {
+		return nil, err
+	}
+	return out.Value, nil
+}
+
+// The service descriptors below are what protoc-gen-go-grpc would generate
+// for api/plugin.proto.
+
+var sinkDesc = grpc.ServiceDesc{
+	ServiceName: "ingest.plugin.v1.Sink",
+	HandlerType: (*Sink)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Publish",
+		Handler: func(srv any, ctx context.Context, dec func(any) error, intercept grpc.UnaryServerInterceptor) (any, error) {
+			in := new(wrapperspb.BytesValue)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			handle := func(ctx context.Context, req any) (any, error) {
+				var records []json.RawMessage
+				if err := json.Unmarshal(req.(*wrapperspb.BytesValue).Value, &records); err != nil {
+					return nil, status.Errorf(codes.InvalidArgument, "records: %v", err)
+				}
+				if err := srv.(Sink).Publish(ctx, records); err != nil {
+					return nil, err
+				}
+				return &emptypb.Empty{}, nil
+			}
+			if intercept == nil {
+				return handle(ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/ingest.plugin.v1.Sink/Publish"}
+			return intercept(ctx, in, info, handle)
+		},
+	}},
+	Metadata: "api/plugin.proto",
+}
+
+var processorDesc = grpc.ServiceDesc{
+	ServiceName: "ingest.plugin.v1.Processor",
+	HandlerType: (*Processor)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Process",
+		Handler: func(srv any, ctx context.Context, dec func(any) error, intercept grpc.UnaryServerInterceptor) (any, error) {
+			in := new(wrapperspb.BytesValue)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			handle := func(ctx context.Context, req any) (any, error) {
+				var e Event
+				if err := json.Unmarshal(req.(*wrapperspb.BytesValue).Value, &e); err != nil {
+					return nil, status.Errorf(codes.InvalidArgument, "event: %v", err)
+				}
+				out, err := srv.(Processor).Process(ctx, e)
+				if err != nil {
+					return nil, err
+				}
+				b, err := json.Marshal(out)
+				if err != nil {
+					return nil, status.Errorf(codes.Internal, "event: %v", err)
+				}
+				return wrapperspb.Bytes(b), nil
+			}
+			if intercept == nil {
+				return handle(ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/ingest.plugin.v1.Processor/Process"}
+			return intercept(ctx, in, info, handle)
+		},
+	}},
+	Metadata: "api/plugin.proto",
+}
@@ -0,0 +1,35 @@
+#!/bin/sh
+# Runs the benchmarks in bench/ on a base revision and on the working tree
+# and compares them with bench/benchcmp, failing when a result got worse by
+# more than THRESHOLD percent. Run it against the last release before
+# tagging the next one.
+#
+#   scripts/bench.sh                      # against HEAD
+#   scripts/bench.sh v1.0.0               # against a release tag
+#   BENCH=Decode COUNT=10 THRESHOLD=5 scripts/bench.sh main
+set -eu
+
+cd "$(dirname "$0")/.."
+BASE=${1:-HEAD}
+BENCH=${BENCH:-.}
+COUNT=${COUNT:-6}
+BENCHTIME=${BENCHTIME:-1s}
+THRESHOLD=${THRESHOLD:-10}
+
+out=$(mktemp -d)
+trap 'git worktree remove --force "$out/base" 2>/dev/null || true; rm -rf "$out"' EXIT
+
+run() {
+	(cd "$1" && go test -run '^$' -timeout 30m -bench "$BENCH" -benchmem -count "$COUNT" -benchtime "$BENCHTIME" ./bench/) >"$2"
+}
+
+git worktree add --detach --quiet "$out/base" "$BASE"
+if [ ! -d "$out/base/bench" ]; then
+	echo "$BASE has no bench/ package to compare against" >&2
+	exit 2
+fi
+echo "benchmarking $BASE" >&2
+run "$out/base" "$out/base.txt"
+echo "benchmarking the working tree" >&2
+run . "$out/head.txt"
+go run ./bench/benchcmp -threshold "$THRESHOLD" "$out/base.txt" "$out/head.txt"
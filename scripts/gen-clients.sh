@@ -0,0 +1,25 @@
+#!/bin/sh
+# Generates the TypeScript and Python clients from api/openapi.yaml into
+# clients/ with openapi-generator (run through Docker, no local JVM needed).
+#
+#   scripts/gen-clients.sh            # both clients
+#   scripts/gen-clients.sh python     # just one
+set -eu
+
+cd "$(dirname "$0")/.."
+GENERATOR_IMAGE=${GENERATOR_IMAGE:-openapitools/openapi-generator-cli:v7.10.0}
+VERSION=${VERSION:-$(sed -n 's/^  version: //p' api/openapi.yaml)}
+
+gen() {
+	docker run --rm -u "$(id -u):$(id -g)" -v "$PWD:/work" -w /work "$GENERATOR_IMAGE" generate \
+		-i api/openapi.yaml -g "$1" -o "clients/$2" --additional-properties="$3"
+}
+
+[ $# -gt 0 ] || set -- typescript python
+for lang in "$@"; do
+	case "$lang" in
+	typescript) gen typescript-fetch typescript "npmName=@go-ingest-service/client,npmVersion=$VERSION,supportsES6=true" ;;
+	python) gen python python "packageName=ingest_client,packageVersion=$VERSION" ;;
+	*) echo "unknown client $lang" >&2; exit 2 ;;
+	esac
+done
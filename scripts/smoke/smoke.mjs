@@ -0,0 +1,19 @@
+// Sends an event with the generated TypeScript client and lists it back.
+import { randomUUID } from 'node:crypto';
+import { pathToFileURL } from 'node:url';
+
+const { Configuration, DefaultApi } = await import(pathToFileURL(`${process.env.CLIENT_DIR}/dist/index.js`));
+const api = new DefaultApi(new Configuration({
+  basePath: process.env.BASE_URL,
+  headers: { 'X-API-Key': process.env.API_KEY },
+}));
+
+const run = randomUUID();
+const sent = await api.sendEvent({ newEvent: { type: 'smoke.typescript', payload: { run }, tags: ['smoke'] } });
+if (sent.type !== 'smoke.typescript' || !sent.id) {
+  throw new Error(`sendEvent returned ${JSON.stringify(sent)}`);
+}
+const listed = await api.listEvents({});
+if (!listed.some((e) => e.id === sent.id && e.payload?.run === run)) {
+  throw new Error(`event ${sent.id} missing from listEvents`);
+}
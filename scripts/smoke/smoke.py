@@ -0,0 +1,18 @@
+"""Sends an event with the generated Python client and lists it back."""
+import os
+import sys
+import uuid
+
+import ingest_client
+
+config = ingest_client.Configuration(host=os.environ["BASE_URL"])
+with ingest_client.ApiClient(config) as client:
+    client.set_default_header("X-API-Key", os.environ["API_KEY"])
+    api = ingest_client.DefaultApi(client)
+    run = uuid.uuid4().hex
+    sent = api.send_event(ingest_client.NewEvent.from_dict(
+        {"type": "smoke.python", "payload": {"run": run}, "tags": ["smoke"]}))
+    if sent.type != "smoke.python" or not sent.id:
+        sys.exit(f"sendEvent returned {sent}")
+    if not any(e.id == sent.id and e.payload == {"run": run} for e in api.list_events()):
+        sys.exit(f"event {sent.id} missing from listEvents")
@@ -0,0 +1,44 @@
+package e2e
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// redisURL returns the Redis of the test, see backend.
+func redisURL(t *testing.T) string {
+	return backend(t, "E2E_REDIS_URL", "redis:7-alpine", "6379/tcp", "redis")
+}
+
+// backend returns the URL in the variable env when set. Otherwise it starts
+// image with testcontainers, removed when the test ends, and returns
+// scheme://host:port of its port. The test is skipped with -short, or when
+// neither is available: no URL and no Docker.
+func backend(t *testing.T, env, image, port, scheme string) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("e2e: skipped with -short")
+	}
+	if url := os.Getenv(env); url != "" {
+		return url
+	}
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	ctx := context.Background()
+	c, err := testcontainers.Run(ctx, image,
+		testcontainers.WithExposedPorts(port),
+		testcontainers.WithWaitStrategy(wait.ForListeningPort(port)),
+	)
+	testcontainers.CleanupContainer(t, c)
+	if err != nil {
+		t.Fatalf("start %s: %v", image, err)
+	}
+	url, err := c.PortEndpoint(ctx, port, scheme)
+	if err != nil {
+		t.Fatalf("%s endpoint: %v", image, err)
+	}
+	return url
+}
@@ -0,0 +1,278 @@
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIngestAndQuery(t *testing.T) {
+	s := start(t, "")
+
+	var one event
+	s.call("POST", "/v1/events", adminKey, `{"type":"order.created","payload":{"n":1},"tags":["eu"]}`, &one, http.StatusCreated)
+	if one.ID == 0 || one.Type != "order.created" || !slices.Equal(one.Tags, []string{"eu"}) {
+		t.Fatalf("created %+v", one)
+	}
+	var batch []event
+	s.call("POST", "/v1/events/batch", adminKey, `[
+		{"type":"order.created","payload":{"n":2}},
+		{"type":"order.paid","payload":{"n":3},"tags":["eu"]}
+	]`, &batch, http.StatusCreated)
+	if len(batch) != 2 || batch[0].ID <= one.ID || batch[1].ID <= batch[0].ID {
+		t.Fatalf("batch %+v after %d", batch, one.ID)
+	}
+
+	var got event
+	s.call("GET", fmt.Sprintf("/v1/events/%d", one.ID), adminKey, nil, &got, http.StatusOK)
+	if string(got.Payload) != `{"n":1}` {
+		t.Fatalf("get %d: payload %s", one.ID, got.Payload)
+	}
+	var list []event
+	s.call("GET", "/v1/events?type=order.created", adminKey, nil, &list, http.StatusOK)
+	if ids := eventIDs(list); !slices.Equal(ids, []int64{batch[0].ID, one.ID}) {
+		t.Fatalf("type filter: ids %v", ids)
+	}
+	s.call("GET", "/v1/events?tag=eu", adminKey, nil, &list, http.StatusOK)
+	if ids := eventIDs(list); !slices.Equal(ids, []int64{batch[1].ID, one.ID}) {
+		t.Fatalf("tag filter: ids %v", ids)
+	}
+
+	// a batch with an invalid event is refused whole
+	var p problem
+	s.call("POST", "/v1/events/batch", adminKey, `[{"type":"a","payload":{}},{"payload":{}}]`, &p, http.StatusBadRequest)
+	if p.Error.Code != "VALIDATION_FAILED" || len(p.Error.Details) != 1 {
+		t.Fatalf("invalid batch: %+v", p)
+	}
+	s.call("GET", "/v1/events?type=a", adminKey, nil, &list, http.StatusOK)
+	if len(list) != 0 {
+		t.Fatalf("refused batch stored %d events", len(list))
+	}
+	// dry runs answer with what would be stored and store nothing
+	var dry event
+	s.call("POST", "/v1/events?dry_run=true", adminKey, `{"type":"a","payload":{"n":4}}`, &dry, http.StatusOK)
+	if dry.ID != 0 || dry.Type != "a" || string(dry.Payload) != `{"n":4}` {
+		t.Fatalf("dry run: %+v", dry)
+	}
+	s.call("POST", "/v1/events/batch?dry_run=true", adminKey, `[{"type":"a","payload":{}},{"payload":{}}]`, &p, http.StatusBadRequest)
+	s.call("GET", "/v1/events?type=a", adminKey, nil, &list, http.StatusOK)
+	if len(list) != 0 {
+		t.Fatalf("dry runs stored %d events", len(list))
+	}
+	s.call("POST", "/v1/events", "", `{"type":"a","payload":{}}`, &p, http.StatusUnauthorized)
+
+	// everything acknowledged survives a restart
+	s.restart()
+	s.call("GET", "/v1/events", adminKey, nil, &list, http.StatusOK)
+	if len(list) != 3 {
+		t.Fatalf("after restart: %d events, want 3", len(list))
+	}
+}
+
+func TestTenantRetention(t *testing.T) {
+	s := start(t, "")
+
+	var tenant struct {
+		Keys []struct {
+			Key string `json:"key"`
+		} `json:"keys"`
+	}
+	s.call("POST", "/admin/tenants", adminKey, `{"name":"acme","retention":"1s","keys":[{"id":"acme-rw","roles":["ingest","read"]}]}`, &tenant, http.StatusCreated)
+	if len(tenant.Keys) != 1 {
+		t.Fatalf("tenant keys: %+v", tenant.Keys)
+	}
+	key := tenant.Keys[0].Key
+	s.call("POST", "/v1/events", key, `{"type":"acme/signup","payload":{}}`, nil, http.StatusCreated)
+	s.call("POST", "/v1/events", adminKey, `{"type":"other","payload":{}}`, nil, http.StatusCreated)
+
+	// the retention sweep runs at startup and then every minute
+	time.Sleep(1500 * time.Millisecond)
+	s.restart()
+	var list []event
+	s.call("GET", "/v1/events", adminKey, nil, &list, http.StatusOK)
+	if len(list) != 1 || list[0].Type != "other" {
+		t.Fatalf("after retention: %+v", list)
+	}
+	// the tenant and its key outlive the restart
+	s.call("POST", "/v1/events", key, `{"type":"acme/signup","payload":{}}`, nil, http.StatusCreated)
+}
+
+func TestSinkDelivery(t *testing.T) {
+	rc := newReceiver(t)
+	s := start(t, fmt.Sprintf(`
+sinks:
+  - {name: hook, kind: webhook, url: %q, batch_size: 10, flush_interval: 50ms}
+outbox: {enabled: true, poll_interval: 100ms, min_backoff: 100ms, max_backoff: 200ms}
+`, rc.url))
+
+	// failures are retried until the sink accepts
+	rc.setFailing(true)
+	ids := ingest(t, s, 5)
+	if !eventually(5*time.Second, func() bool {
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		return rc.requests >= 2
+	}) {
+		t.Fatal("sink was not called")
+	}
+	rc.setFailing(false)
+	rc.await(t, ids, 5*time.Second)
+
+	// pending deliveries survive a restart
+	rc.setFailing(true)
+	more := ingest(t, s, 3)
+	if err := s.stop(); err != nil {
+		t.Fatalf("graceful stop: %v", err)
+	}
+	if missing := rc.missing(more); len(missing) != len(more) {
+		t.Fatalf("failing sink accepted events %v", more)
+	}
+	rc.setFailing(false)
+	s.run()
+	rc.await(t, more, 5*time.Second)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	rc := newReceiver(t)
+	s := start(t, fmt.Sprintf(`
+health: {drain_delay: 1s}
+sinks:
+  - {name: hook, kind: webhook, url: %q, batch_size: 100, flush_interval: 1h}
+`, rc.url))
+
+	// producers keep sending while the service drains
+	var mu sync.Mutex
+	var acked []int64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				var e event
+				status, raw, err := s.send("POST", "/v1/events", adminKey, `{"type":"load","payload":{}}`)
+				if err != nil || status != http.StatusCreated {
+					time.Sleep(10 * time.Millisecond)
+					continue
+				}
+				if err := json.Unmarshal(raw, &e); err == nil {
+					mu.Lock()
+					acked = append(acked, e.ID)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	time.Sleep(300 * time.Millisecond)
+	if err := s.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	// readiness fails first, while requests are still served
+	if !eventually(time.Second, func() bool {
+		status, _, err := s.send("GET", "/readyz", "", nil)
+		return err == nil && status == http.StatusServiceUnavailable
+	}) {
+		t.Fatal("readiness did not fail during the drain delay")
+	}
+	status, _, err := s.send("POST", "/v1/events", adminKey, `{"type":"load","payload":{}}`)
+	if err != nil || status != http.StatusCreated {
+		t.Fatalf("ingest while draining: status %d, %v", status, err)
+	}
+	if err := s.wait(20 * time.Second); err != nil {
+		t.Fatalf("graceful stop: %v", err)
+	}
+	close(stop)
+	wg.Wait()
+
+	// the queued batch was flushed to the sink on the way out
+	mu.Lock()
+	defer mu.Unlock()
+	if len(acked) == 0 {
+		t.Fatal("no event was acknowledged")
+	}
+	if missing := rc.missing(acked); len(missing) > 0 {
+		t.Fatalf("%d of %d acknowledged events not delivered: %v", len(missing), len(acked), missing)
+	}
+	s.run()
+	var list []event
+	s.call("GET", "/v1/events?type=load&limit=1", adminKey, nil, &list, http.StatusOK)
+	if len(list) == 0 || list[0].ID < slices.Max(acked) {
+		t.Fatalf("acknowledged events lost in shutdown: newest stored %+v, newest acked %d", list, slices.Max(acked))
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "ingest.sock")
+	s := start(t, fmt.Sprintf("server: {unix_socket: %q, socket_mode: \"0600\"}\n", sock))
+
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Fatalf("socket mode %v, want 0600", fi.Mode().Perm())
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	req, _ := http.NewRequest("POST", "http://ingest/v1/events", strings.NewReader(`{"type":"local","payload":{}}`))
+	req.Header.Set("X-API-Key", adminKey)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("ingest over the socket: status %d", resp.StatusCode)
+	}
+	// the TCP listener serves the same service
+	var list []event
+	s.call("GET", "/v1/events?type=local", adminKey, nil, &list, http.StatusOK)
+	if len(list) != 1 {
+		t.Fatalf("got %d events over TCP, want 1", len(list))
+	}
+	if err := s.stop(); err != nil {
+		t.Fatalf("graceful stop: %v", err)
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Fatalf("socket left behind after shutdown: %v", err)
+	}
+}
+
+// ingest stores n events and returns their IDs.
+func ingest(t *testing.T, s *service, n int) []int64 {
+	t.Helper()
+	ids := make([]int64, n)
+	for i := range ids {
+		var e event
+		s.call("POST", "/v1/events", adminKey, fmt.Sprintf(`{"type":"delivery","payload":{"n":%d}}`, i), &e, http.StatusCreated)
+		ids[i] = e.ID
+	}
+	return ids
+}
+
+func eventIDs(events []event) []int64 {
+	out := make([]int64, len(events))
+	for i, e := range events {
+		out[i] = e.ID
+	}
+	return out
+}
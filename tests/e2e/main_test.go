@@ -0,0 +1,42 @@
+// Package e2e runs the service binary as deployed, against SQLite and live
+// sinks, and checks what producers and consumers rely on end to end:
+// ingest and query, retention, sink delivery and graceful shutdown. The
+// suite builds the binary once and is skipped with -short. Tests with a
+// backend of their own start it with testcontainers, or use the server an
+// E2E_*_URL variable names, and are skipped with neither Docker nor one.
+package e2e
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// binary is the service built for the suite.
+var binary string
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if testing.Short() {
+		os.Exit(m.Run())
+	}
+	dir, err := os.MkdirTemp("", "ingest-e2e")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "e2e:", err)
+		os.Exit(1)
+	}
+	binary = filepath.Join(dir, "api")
+	build := exec.Command("go", "build", "-o", binary, "../../cmd/api")
+	build.Stdout, build.Stderr = os.Stderr, os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "e2e: build service:", err)
+		_ = os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
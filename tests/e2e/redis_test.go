@@ -0,0 +1,149 @@
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rafaelosorio/go-ingest-service/internal/resp"
+)
+
+// TestRedisSink delivers through the outbox to a real Redis, see redisURL.
+func TestRedisSink(t *testing.T) {
+	url := redisURL(t)
+	stream := fmt.Sprintf("e2e:%s:%d", t.Name(), time.Now().UnixNano())
+	s := start(t, fmt.Sprintf(`
+sinks:
+  - {name: cache, kind: redis, url: %q, batch_size: 10, flush_interval: 50ms, redis: {stream: %q, max_len: 1000}}
+outbox: {enabled: true, poll_interval: 100ms, min_backoff: 100ms, max_backoff: 200ms}
+`, url, stream))
+
+	opts, err := resp.ParseURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	c, err := resp.Dial(ctx, opts, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial %s: %v", opts.Addr, err)
+	}
+	defer c.Close()
+	defer c.Do(ctx, time.Second, []string{"DEL", stream})
+	// streamed returns the event IDs and types in the stream, in order
+	streamed := func() (ids []int64, types []string) {
+		replies, err := c.Do(ctx, 5*time.Second, []string{"XRANGE", stream, "-", "+"})
+		if err != nil {
+			t.Fatalf("XRANGE: %v", err)
+		}
+		entries, _ := replies[0].([]any)
+		for _, entry := range entries {
+			fields := entry.([]any)[1].([]any)
+			for i := 0; i+1 < len(fields); i += 2 {
+				switch fields[i] {
+				case "id":
+					id, _ := strconv.ParseInt(fields[i+1].(string), 10, 64)
+					ids = append(ids, id)
+				case "type":
+					types = append(types, fields[i+1].(string))
+				}
+			}
+		}
+		return ids, types
+	}
+
+	var got []int64
+	ids := ingest(t, s, 5)
+	if !eventually(5*time.Second, func() bool { got, _ = streamed(); return len(got) >= len(ids) }) {
+		t.Fatalf("stream holds %v, want %v", got, ids)
+	}
+	// the restart resumes delivery where it stopped, without resending
+	if err := s.stop(); err != nil {
+		t.Fatalf("graceful stop: %v", err)
+	}
+	s.run()
+	more := ingest(t, s, 3)
+	want := append(ids, more...)
+	if !eventually(5*time.Second, func() bool { got, _ = streamed(); return len(got) >= len(want) }) {
+		t.Fatalf("stream holds %v, want %v", got, want)
+	}
+	got, types := streamed()
+	if !slices.Equal(got, want) || slices.ContainsFunc(types, func(typ string) bool { return typ != "delivery" }) {
+		t.Errorf("stream holds %v of types %v, want %v", got, types, want)
+	}
+}
+
+// TestRedisStorage serves reads and a pull consumer from the Redis stream
+// in front of SQLite, through a restart.
+func TestRedisStorage(t *testing.T) {
+	url := redisURL(t)
+	stream := fmt.Sprintf("e2e:%s:%d", t.Name(), time.Now().UnixNano())
+	s := start(t, fmt.Sprintf(`
+storage:
+  redis: {url: %q, stream: %q, consumer_groups: true}
+`, url, stream))
+	// pull leases the next events of the consumer and acknowledges them
+	pull := func() []int64 {
+		t.Helper()
+		req, err := http.NewRequest("GET", s.url("/v1/consumers/work/pull?max=10"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-API-Key", adminKey)
+		res, err := s.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var events []event
+		if err := json.NewDecoder(res.Body).Decode(&events); err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("pull: %d %v", res.StatusCode, err)
+		}
+		ids := eventIDs(events)
+		if len(ids) > 0 {
+			token, _ := strconv.ParseInt(res.Header.Get("Lease-Token"), 10, 64)
+			var acked map[string]int
+			s.call("POST", "/v1/consumers/work/ack", adminKey, map[string]any{"ids": ids, "token": token}, &acked, http.StatusOK)
+			if acked["acked"] != len(ids) {
+				t.Fatalf("acked %v of %v", acked, ids)
+			}
+		}
+		return ids
+	}
+
+	s.call("POST", "/v1/consumers", adminKey, `{"name":"work","types":["delivery"]}`, nil, http.StatusCreated)
+	ids := ingest(t, s, 3)
+	var list []event
+	s.call("GET", "/v1/events?type=delivery", adminKey, nil, &list, http.StatusOK)
+	if got := eventIDs(list); !slices.Equal(got, []int64{ids[2], ids[1], ids[0]}) {
+		t.Fatalf("list: %v, want %v newest first", got, ids)
+	}
+	if got := pull(); !slices.Equal(got, ids) {
+		t.Fatalf("pull: %v, want %v", got, ids)
+	}
+
+	// the group and its acks outlive the restart
+	s.restart()
+	more := ingest(t, s, 2)
+	if got := pull(); !slices.Equal(got, more) {
+		t.Fatalf("pull after restart: %v, want %v", got, more)
+	}
+	if got := pull(); len(got) != 0 {
+		t.Fatalf("pull with all acked: %v", got)
+	}
+
+	opts, err := resp.ParseURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := resp.Dial(context.Background(), opts, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial %s: %v", opts.Addr, err)
+	}
+	defer c.Close()
+	_, _ = c.Do(context.Background(), time.Second, []string{"DEL", stream, stream + ":epochs", stream + ":leases:work"})
+}
@@ -0,0 +1,316 @@
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// adminKey is the API key with the admin role in every config of the suite.
+const adminKey = "e2e-admin"
+
+// service is a running instance of the binary. Its database and logs live
+// in the test's temp dir, so restarts keep the data; the log is printed if
+// the test fails.
+type service struct {
+	t      *testing.T
+	dir    string
+	addr   string
+	env    []string
+	cmd    *exec.Cmd
+	exited chan error
+	client *http.Client
+}
+
+// start runs the service with config, a YAML document that auth and the
+// SQLite store are added to, and waits until it is ready.
+func start(t *testing.T, config string, env ...string) *service {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("e2e: skipped with -short")
+	}
+	s := &service{t: t, dir: t.TempDir(), client: &http.Client{Timeout: 10 * time.Second}}
+	config = fmt.Sprintf("auth:\n  enabled: true\n  api_keys:\n    - {id: admin, key: %s, roles: [admin]}\n%s", adminKey, config)
+	path := filepath.Join(s.dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s.addr = freeAddr(t)
+	s.env = append(os.Environ(),
+		"CONFIG_FILE="+path,
+		"HTTP_ADDR="+s.addr,
+		"STORAGE_DRIVER=sqlite",
+		"STORAGE_DSN="+filepath.Join(s.dir, "events.db"),
+		"LOG_LEVEL=debug",
+	)
+	s.env = append(s.env, env...)
+	t.Cleanup(func() {
+		if s.cmd != nil {
+			_ = s.cmd.Process.Kill()
+			<-s.exited
+		}
+		if t.Failed() {
+			if b, err := os.ReadFile(filepath.Join(s.dir, "service.log")); err == nil {
+				t.Logf("service log:\n%s", b)
+			}
+		}
+	})
+	s.run()
+	return s
+}
+
+// run starts the process and waits for readiness.
+func (s *service) run() {
+	s.t.Helper()
+	logs, err := os.OpenFile(filepath.Join(s.dir, "service.log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer logs.Close()
+	cmd := exec.Command(binary)
+	cmd.Env, cmd.Stdout, cmd.Stderr = s.env, logs, logs
+	if err := cmd.Start(); err != nil {
+		s.t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	s.cmd, s.exited = cmd, exited
+
+	deadline := time.Now().Add(15 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-exited:
+			s.cmd = nil
+			s.t.Fatalf("service exited during startup: %v", err)
+		default:
+		}
+		if resp, err := s.client.Get(s.url("/readyz")); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	s.t.Fatal("service not ready after 15s")
+}
+
+// stop sends SIGTERM and waits for the process to exit, returning its
+// error, if any.
+func (s *service) stop() error {
+	s.t.Helper()
+	if err := s.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		s.t.Fatal(err)
+	}
+	return s.wait(20 * time.Second)
+}
+
+// wait waits up to d for the process to exit.
+func (s *service) wait(d time.Duration) error {
+	s.t.Helper()
+	select {
+	case err := <-s.exited:
+		s.cmd = nil
+		return err
+	case <-time.After(d):
+		s.t.Fatalf("service still running %s after SIGTERM", d)
+		return nil
+	}
+}
+
+// restart stops the service gracefully and starts it again on the same data.
+func (s *service) restart() {
+	s.t.Helper()
+	if err := s.stop(); err != nil {
+		s.t.Fatalf("graceful stop: %v", err)
+	}
+	s.run()
+}
+
+func (s *service) url(path string) string { return "http://" + s.addr + path }
+
+// call sends body (JSON-encoded unless it is a string) with key and
+// decodes the response into out if it is not nil. It fails the test unless
+// the status is want.
+func (s *service) call(method, path, key string, body, out any, want int) {
+	s.t.Helper()
+	status, raw, err := s.send(method, path, key, body)
+	if err != nil {
+		s.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	if status != want {
+		s.t.Fatalf("%s %s: status %d, want %d: %s", method, path, status, want, raw)
+	}
+	if out != nil {
+		if err := json.Unmarshal(raw, out); err != nil {
+			s.t.Fatalf("%s %s: decode %s: %v", method, path, raw, err)
+		}
+	}
+}
+
+// send is call without the checks, safe to use from other goroutines.
+func (s *service) send(method, path, key string, body any) (int, []byte, error) {
+	var rd io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		rd = strings.NewReader(b)
+	default:
+		raw, err := json.Marshal(b)
+		if err != nil {
+			return 0, nil, err
+		}
+		rd = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, s.url(path), rd)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, raw, err
+}
+
+// event is the part of the API's event the suite looks at.
+type event struct {
+	ID            int64             `json:"id"`
+	Type          string            `json:"type"`
+	Payload       json.RawMessage   `json:"payload"`
+	Tags          []string          `json:"tags"`
+	Metadata      map[string]string `json:"metadata"`
+	SchemaVersion string            `json:"schema_version"`
+}
+
+// problem is the error member of a problem document.
+type problem struct {
+	Error struct {
+		Code    string   `json:"code"`
+		Message string   `json:"message"`
+		Details []string `json:"details"`
+	} `json:"error"`
+}
+
+// receiver is a webhook sink endpoint recording the event IDs it accepted.
+// While failing, it answers 503 without recording.
+type receiver struct {
+	url string
+
+	mu       sync.Mutex
+	failing  bool
+	requests int
+	seen     map[int64]int
+}
+
+func newReceiver(t *testing.T) *receiver {
+	t.Helper()
+	rc := &receiver{seen: map[int64]int{}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(rc.serve)}
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	rc.url = "http://" + ln.Addr().String()
+	return rc
+}
+
+func (rc *receiver) serve(w http.ResponseWriter, r *http.Request) {
+	raw, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests++
+	if rc.failing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var batch []event
+	if err := json.Unmarshal(raw, &batch); err != nil {
+		var one event
+		if err := json.Unmarshal(raw, &one); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		batch = []event{one}
+	}
+	for _, e := range batch {
+		rc.seen[e.ID]++
+	}
+}
+
+func (rc *receiver) setFailing(failing bool) {
+	rc.mu.Lock()
+	rc.failing = failing
+	rc.mu.Unlock()
+}
+
+// missing returns the ids not received yet.
+func (rc *receiver) missing(ids []int64) []int64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	var out []int64
+	for _, id := range ids {
+		if rc.seen[id] == 0 {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// await waits up to d for all of ids to be received.
+func (rc *receiver) await(t *testing.T, ids []int64, d time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(d)
+	for {
+		missing := rc.missing(ids)
+		if len(missing) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sink did not receive events %v within %s", missing, d)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// freeAddr returns a loopback address with a port nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// eventually retries cond every 50ms for up to d.
+func eventually(d time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(d)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}